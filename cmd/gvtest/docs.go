@@ -0,0 +1,134 @@
+package main
+
+import "github.com/perbu/GTest/pkg/vtc"
+
+// commandDocs documents the commands of RegisterBuiltinCommands
+var commandDocs = []vtc.CommandDoc{
+	{
+		Name:    "client",
+		Context: vtc.DocTop,
+		Usage:   "cNAME [options] [{ SPEC }]",
+		Help:    "Connects to a server and runs SPEC, an HTTP/1 spec or an HTTP/2 one with stream blocks.",
+		Options: []vtc.OptionDoc{
+			{Name: "-connect", Arg: "ADDR", Help: "Address to connect to, such as ${s1_sock} or \"${s1_addr} ${s1_port}\""},
+			{Name: "-start", Help: "Run the spec in the background"},
+			{Name: "-wait", Help: "Wait for a started spec"},
+			{Name: "-run", Help: "Same as -start -wait"},
+			{Name: "-repeat", Arg: "N", Help: "Run the spec N times"},
+			{Name: "-keepalive", Help: "Reuse the connection when repeating"},
+			{Name: "-reconnect-on-fail", Help: "Run a repeat whose connect or spec fails again, on a new connection"},
+			{Name: "-max-attempts", Arg: "N", Help: "Attempts per repeat with -reconnect-on-fail (default 3)"},
+			{Name: "-backoff", Arg: "DURATION", Help: "Wait before the first retry, doubled for each further one"},
+			{Name: "-backoff-max", Arg: "DURATION", Help: "Longest wait between retries"},
+			{Name: "-rcvbuf", Arg: "BYTES", Help: "Socket receive buffer size"},
+			{Name: "-proxy1", Arg: "\"SRC DST\"", Help: "Accepted, but no PROXY protocol header is sent yet"},
+			{Name: "-proxy2", Arg: "\"SRC DST\"", Help: "Accepted, but no PROXY protocol header is sent yet"},
+			{Name: "-bind", Arg: "ADDR", Help: "Local address to connect from"},
+			{Name: "-interface", Arg: "NAME", Help: "Network interface to connect from"},
+			{Name: "-via", Arg: "URL", Help: "Tunnel through a socks5:// or http:// proxy"},
+			{Name: "-happy-eyeballs", Help: "Race IPv6 and IPv4 connection attempts"},
+			{Name: "-prefer", Arg: "v4|v6", Help: "Address family to try first"},
+			{Name: "-attempt-delay", Arg: "DURATION", Help: "Delay between happy eyeballs attempts"},
+			{Name: "-tls", Help: "Speak TLS, without checking the server certificate"},
+			{Name: "-tls-resume", Help: "Speak TLS, resuming the session of the previous connection"},
+			{Name: "-tls-full", Help: "Forget the sessions of -tls-resume and do full handshakes"},
+			{Name: "-tls-early-data", Help: "Refused: 0-RTT early data cannot be sent yet"},
+			{Name: "-servername", Arg: "NAME", Help: "Send NAME as SNI and check it against the server certificate"},
+			{Name: "-sni", Arg: "NAME", Help: "Send NAME as SNI instead, checking the certificate against -servername if given"},
+			{Name: "-cafile", Arg: "FILE", Help: "Check the server certificate against these CAs, for tls.verify"},
+			{Name: "-clientcert", Arg: "FILE", Help: "Present this PEM certificate to the server"},
+			{Name: "-clientkey", Arg: "FILE", Help: "Key of -clientcert"},
+		},
+	},
+	{
+		Name:    "server",
+		Context: vtc.DocTop,
+		Usage:   "sNAME [options] [{ SPEC }]",
+		Help:    "Accepts connections and runs SPEC on them. Defines ${sNAME_addr}, ${sNAME_port} and ${sNAME_sock}.",
+		Options: []vtc.OptionDoc{
+			{Name: "-listen", Arg: "ADDR", Help: "Address to listen on (default 127.0.0.1:0)"},
+			{Name: "-start", Help: "Start accepting"},
+			{Name: "-wait", Help: "Wait for the server to finish"},
+			{Name: "-break", Help: "Stop the server"},
+			{Name: "-stop-drain", Arg: "DURATION", Help: "Stop accepting and let running specs finish within DURATION"},
+			{Name: "-stop-now", Arg: "[-rst]", Help: "Close all connections, with a reset if -rst"},
+			{Name: "-dispatch", Help: "Start, running the spec on every connection concurrently"},
+			{Name: "-dispatch-spec-per-conn", Help: "Like -dispatch, with ${conn_seq}, ${conn_worker} and ${conn_remote} set per connection"},
+			{Name: "-repeat", Arg: "N", Help: "Run the spec N times (default 1), then stop"},
+			{Name: "-keepalive", Help: "Run the repeats on one connection"},
+			{Name: "-rcvbuf", Arg: "BYTES", Help: "Socket receive buffer size"},
+			{Name: "-accept-limit", Arg: "N", Help: "Stop accepting after N connections, leaving the socket open"},
+			{Name: "-accept-delay", Arg: "DURATION", Help: "Wait before each accept"},
+			{Name: "-close-on-accept", Help: "Close connections as soon as they are accepted"},
+			{Name: "-backlog", Arg: "N", Help: "Length of the accept queue (default: the system's)"},
+			{Name: "-reuseport", Help: "Set SO_REUSEPORT, so that other servers can -listen on the same port"},
+			{Name: "-workers", Arg: "N", Help: "Listen with N SO_REUSEPORT sockets, each with its own accept loop"},
+			{Name: "-tls", Help: "Speak TLS, with a self-signed certificate for localhost unless -cert is given"},
+			{Name: "-tls-no-tickets", Help: "Speak TLS, refusing to resume sessions"},
+			{Name: "-cert", Arg: "FILE", Help: "PEM certificate to present"},
+			{Name: "-key", Arg: "FILE", Help: "Key of -cert"},
+			{Name: "-ocsp", Arg: "FILE", Help: "Staple this DER OCSP response to -cert"},
+			{Name: "-cert-for", Arg: "HOST=CERT,KEY[,OCSP]", Help: "Present CERT, with the DER OCSP response OCSP stapled, to clients asking for HOST by SNI; HOST may be *.domain; repeatable"},
+			{Name: "-verify-client", Arg: "CAFILE", Help: "Ask for a client certificate and check it against these CAs, for tls.verify"},
+		},
+	},
+	{
+		Name:    "loadgen",
+		Context: vtc.DocTop,
+		Usage:   "lNAME [options] { SPEC }",
+		Help:    "Runs a client spec from many connections and checks the totals.",
+		Options: []vtc.OptionDoc{
+			{Name: "-connect", Arg: "ADDR", Help: "Address to connect to"},
+			{Name: "-clients", Arg: "N", Help: "Concurrent connections"},
+			{Name: "-requests", Arg: "N", Help: "Stop after N runs of the spec"},
+			{Name: "-duration", Arg: "DURATION", Help: "Stop after DURATION"},
+			{Name: "-keepalive", Help: "Reuse connections"},
+			{Name: "-expect", Arg: "FIELD OP VALUE", Help: "Check a total, such as errors == 0"},
+			{Name: "-start", Help: "Start in the background"},
+			{Name: "-wait", Help: "Wait for a started run"},
+			{Name: "-run", Help: "Same as -start -wait"},
+		},
+	},
+	{
+		Name:    "tunnel",
+		Context: vtc.DocTop,
+		Usage:   "tNAME [options] [{ SPEC }]",
+		Help:    "Accepts a connection and forwards its bytes to a server, while SPEC pauses and meters them. Defines ${tNAME_addr}, ${tNAME_port} and ${tNAME_sock}. SPEC commands: pause, resume, send N and recv N, which let N more bytes of a paused tunnel through to the server or to the client.",
+		Options: []vtc.OptionDoc{
+			{Name: "-listen", Arg: "ADDR", Help: "Address to listen on (default 127.0.0.1:0)"},
+			{Name: "-connect", Arg: "ADDR", Help: "Address to forward to (default ${s1_sock})"},
+			{Name: "-latency", Arg: "send|recv DURATION", Help: "Delay the bytes to the server or to the client"},
+			{Name: "-rate", Arg: "send|recv BYTES", Help: "Forward at most BYTES (K or M suffix) per second"},
+			{Name: "-drop", Arg: "send|recv OFFSET LEN", Help: "Leave out LEN bytes at OFFSET of the stream (repeatable)"},
+			{Name: "-dup", Arg: "send|recv OFFSET LEN", Help: "Send LEN bytes at OFFSET twice (repeatable)"},
+			{Name: "-inject", Arg: "send|recv OFFSET BYTES", Help: "Insert BYTES (with \\r, \\n, \\xHH escapes) at OFFSET (repeatable)"},
+			{Name: "-start", Help: "Forward the next connection in the background"},
+			{Name: "-start+pause", Help: "Same as -start, with the tunnel paused"},
+			{Name: "-wait", Help: "Wait for the spec and the connection to finish"},
+			{Name: "-break", Help: "Close the connection and stop listening"},
+			{Name: "-pause", Help: "Pause a running tunnel"},
+			{Name: "-resume", Help: "Resume a paused tunnel"},
+		},
+	},
+	{
+		Name:    "httpreq",
+		Context: vtc.DocAny,
+		Usage:   "URL [options]",
+		Help:    "Makes one request to an http:// or https:// URL, without checking certificates. The response is in ${httpreq_status} and ${httpreq_body}.",
+		Options: []vtc.OptionDoc{
+			{Name: "-method", Arg: "METHOD", Help: "Request method (default GET)"},
+			{Name: "-hdr", Arg: "\"NAME: VALUE\"", Help: "Add a header (repeatable)"},
+			{Name: "-body", Arg: "TEXT", Help: "Request body"},
+			{Name: "-h2", Help: "Speak HTTP/2, with prior knowledge on http:// URLs"},
+			{Name: "-timeout", Arg: "SECONDS", Help: "Give up after this long (default 10)"},
+			{Name: "-status", Arg: "N", Help: "Expect status N"},
+			{Name: "-match-body", Arg: "REGEX", Help: "Expect the body to match REGEX"},
+		},
+	},
+	{
+		Name:    "dump",
+		Context: vtc.DocTop,
+		Usage:   "NAME...",
+		Help:    "Logs the state of the named clients, servers, loadgens and tunnels.",
+	},
+}
@@ -2,15 +2,22 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/perbu/GTest/pkg/client"
 	"github.com/perbu/GTest/pkg/http1"
 	"github.com/perbu/GTest/pkg/http2"
+	"github.com/perbu/GTest/pkg/loadgen"
 	"github.com/perbu/GTest/pkg/logging"
+	gnet "github.com/perbu/GTest/pkg/net"
 	"github.com/perbu/GTest/pkg/server"
+	"github.com/perbu/GTest/pkg/tunnel"
+	"github.com/perbu/GTest/pkg/util"
 	"github.com/perbu/GTest/pkg/vtc"
 )
 
@@ -19,6 +26,13 @@ func RegisterBuiltinCommands() {
 	// Register client and server commands (Phase 2+)
 	vtc.RegisterCommand("client", cmdClient, vtc.FlagNone)
 	vtc.RegisterCommand("server", cmdServer, vtc.FlagNone)
+	vtc.RegisterCommand("dump", cmdDump, vtc.FlagNone)
+	vtc.RegisterCommand("loadgen", cmdLoadgen, vtc.FlagNone)
+	vtc.RegisterCommand("tunnel", cmdTunnel, vtc.FlagNone)
+	vtc.RegisterCommand("httpreq", cmdHTTPReq, vtc.FlagGlobal)
+	vtc.RegisterDocs(commandDocs)
+	vtc.RegisterDocs(http1.Docs)
+	vtc.RegisterDocs(http2.Docs)
 }
 
 // nodeToSpec converts AST child nodes to a spec string
@@ -32,6 +46,14 @@ func nodeToSpecWithDelim(children []*vtc.Node, delim string) string {
 	var lines []string
 	for _, child := range children {
 		if child.Type == "command" {
+			if (child.Name == "repeat" || child.Name == "loop") && len(child.Children) > 0 {
+				// A repeat block keeps its lines, between a "repeat N {"
+				// line and a "}" line, for the handler to run N times
+				lines = append(lines, child.Name+" "+joinArgs(child.Args)+" {")
+				lines = append(lines, nodeToSpecWithDelim(child.Children, delim))
+				lines = append(lines, "}")
+				continue
+			}
 			// Check if this is a command with children (like stream)
 			if len(child.Children) > 0 {
 				// This is a block command - need to include the children
@@ -83,7 +105,9 @@ func nodeToSpecWithDelim(children []*vtc.Node, delim string) string {
 func joinArgs(args []string) string {
 	var quoted []string
 	for _, arg := range args {
-		if needsQuoting(arg) {
+		if needsVerbatim(arg) {
+			quoted = append(quoted, util.QuoteVerbatim(arg))
+		} else if needsQuoting(arg) {
 			quoted = append(quoted, `"`+arg+`"`)
 		} else {
 			quoted = append(quoted, arg)
@@ -92,6 +116,12 @@ func joinArgs(args []string) string {
 	return strings.Join(quoted, " ")
 }
 
+// needsVerbatim reports whether arg holds text that "..." quoting cannot
+// carry through a spec line, such as a <<WORD block
+func needsVerbatim(arg string) bool {
+	return strings.ContainsAny(arg, "\n\r\"") || strings.Contains(arg, "|||")
+}
+
 // needsQuoting returns true if an argument needs to be quoted
 func needsQuoting(arg string) bool {
 	// Quote if contains space, colon (after first char), or other special chars
@@ -105,28 +135,113 @@ func needsQuoting(arg string) bool {
 	return false
 }
 
+// sessionLogger returns the logger of an HTTP session of a client or
+// server. Its lines carry the object's name; the component (http1 or
+// http2) lets levels be set for all sessions of a protocol.
+func sessionLogger(ctx *vtc.ExecContext, name, component string) *logging.Logger {
+	logger := ctx.Logger.Child(name)
+	logger.SetComponent(component)
+	return logger
+}
+
 // createHTTP1ProcessFunc creates a processFunc for HTTP/1 server connections
-func createHTTP1ProcessFunc(spec string, ctx *vtc.ExecContext, name string) server.ProcessFunc {
+func createHTTP1ProcessFunc(spec string, ctx *vtc.ExecContext, s *server.Server) server.ProcessFunc {
 	return func(conn net.Conn, specStr string, listenAddr string) error {
-		logger := logging.NewLogger("http")
+		// Connections accepted together start in a random order
+		vtc.ChaosDelay(ctx)
+		logger := sessionLogger(ctx, s.Name, "http1")
 		h := http1.New(conn, logger)
-		h.Name = name
+		h.Name = s.Name
+		h.Clock = ctx.Now
+		h.Stats = s.ConnStats(conn)
+		h.ConnCount = s.Accepted
 		handler := http1.NewHandler(h)
 		handler.SetContext(ctx)
-		return handler.ProcessSpec(spec)
+		handler.AcceptFunc = s.AcceptConn
+		handler.ConnStats = s.ConnStats
+		handler.Expanded = s.SpecPerConn
+		err := handler.ProcessSpec(specStr)
+		if summary := exchangeSummary(h); summary != "" {
+			s.SetLast(summary)
+		}
+		defineReuseMacro(ctx, s.Name, h)
+		// Connections picked up by accept are not owned by the session
+		if h.Conn != conn {
+			h.Close()
+		}
+		return err
 	}
 }
 
 // createHTTP1ClientProcessFunc creates a processFunc for HTTP/1 client connections
-func createHTTP1ClientProcessFunc(spec string, ctx *vtc.ExecContext, name string) client.ProcessFunc {
+func createHTTP1ClientProcessFunc(spec string, ctx *vtc.ExecContext, c *client.Client) client.ProcessFunc {
 	return func(conn net.Conn, specStr string) error {
-		logger := logging.NewLogger("http")
+		logger := sessionLogger(ctx, c.Name, "http1")
 		h := http1.New(conn, logger)
-		h.Name = name
+		h.Name = c.Name
+		h.Clock = ctx.Now
+		h.Timing.Connect = c.ConnectTime
+		h.Stats = c.ConnStats(conn)
+		h.ConnCount = c.Connections
+		definePeerMacros(ctx, c.Name, conn)
 		handler := http1.NewHandler(h)
 		handler.SetContext(ctx)
-		return handler.ProcessSpec(spec)
+		err := handler.ProcessSpec(spec)
+		defineClientMacros(ctx, c, exchangeSummary(h))
+		defineReuseMacro(ctx, c.Name, h)
+		return err
+	}
+}
+
+// exchangeSummary describes the last request and response seen by h, for
+// dump and the ${NAME_last} macro
+func exchangeSummary(h *http1.HTTP) string {
+	if h.Method == "" && h.Status == 0 {
+		return ""
+	}
+	summary := strings.TrimSpace(h.Method + " " + h.URL)
+	if h.Status != 0 {
+		summary += fmt.Sprintf(" -> %d %s", h.Status, h.Reason)
+		summary = strings.TrimSpace(summary)
 	}
+	return fmt.Sprintf("%s (%d body bytes)", summary, h.BodyLen)
+}
+
+// defineClientMacros records the client's last exchange and publishes
+// ${NAME_conn_count}, ${NAME_attempts} and ${NAME_last}
+func defineClientMacros(ctx *vtc.ExecContext, c *client.Client, summary string) {
+	if summary != "" {
+		c.SetLast(summary)
+		ctx.Macros.Define(c.Name+"_last", summary)
+	}
+	ctx.Macros.Definef(c.Name+"_conn_count", "%d", c.Connections())
+	ctx.Macros.Definef(c.Name+"_attempts", "%d", c.Session.Attempts)
+}
+
+// defineReuseMacro publishes whether the last request of a client or
+// server went over a connection used before as ${NAME_conn_reused}
+func defineReuseMacro(ctx *vtc.ExecContext, name string, h *http1.HTTP) {
+	ctx.Macros.Define(name+"_conn_reused", strconv.FormatBool(h.Stats.Requests > 1))
+}
+
+// definePeerMacros publishes the address a client connected to as
+// ${NAME_peer_ip}, ${NAME_peer_port} and ${NAME_peer_family} (4 or 6)
+func definePeerMacros(ctx *vtc.ExecContext, name string, conn net.Conn) {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	family := "6"
+	if addr.IP.To4() != nil {
+		family = "4"
+	}
+	ip := addr.IP.String()
+	if addr.Zone != "" {
+		ip += "%" + addr.Zone
+	}
+	ctx.Macros.Define(name+"_peer_ip", ip)
+	ctx.Macros.Definef(name+"_peer_port", "%d", addr.Port)
+	ctx.Macros.Define(name+"_peer_family", family)
 }
 
 // isHTTP2Spec detects if a spec is for HTTP/2
@@ -140,6 +255,8 @@ func isHTTP2Spec(spec string) bool {
 		"txgoaway", "rxgoaway",
 		"txwinup", "rxwinup",
 		"txprio", "rxprio",
+		"txupgrade", "rxupgrade",
+		"rxerror", "hpack_reset",
 	}
 
 	specLower := strings.ToLower(spec)
@@ -152,42 +269,120 @@ func isHTTP2Spec(spec string) bool {
 	return false
 }
 
+// startHTTP2 starts h2conn and waits for the SETTINGS exchange, unless
+// spec sends or receives SETTINGS itself
+func startHTTP2(h2conn *http2.Conn, spec string) error {
+	if http2.SettingsSpec(spec) {
+		return h2conn.Start()
+	}
+	return h2conn.StartAndWaitSettings(http2.DefaultSettingsTimeout)
+}
+
 // createHTTP2ProcessFunc creates a processFunc for HTTP/2 server connections
-func createHTTP2ProcessFunc(spec string) server.ProcessFunc {
+func createHTTP2ProcessFunc(spec string, ctx *vtc.ExecContext, s *server.Server) server.ProcessFunc {
 	return func(conn net.Conn, specStr string, listenAddr string) error {
-		logger := logging.NewLogger("http2")
+		vtc.ChaosDelay(ctx)
+		logger := sessionLogger(ctx, s.Name, "http2")
 		h2conn := http2.NewConn(conn, logger, false) // false = server mode
 		handler := http2.NewHandler(h2conn)
+		handler.Name = s.Name
+		handler.SetContext(ctx)
+		handler.Expanded = s.SpecPerConn
 
-		// Start HTTP/2 connection
-		if err := h2conn.Start(); err != nil {
-			return fmt.Errorf("failed to start HTTP/2 connection: %w", err)
+		// Start HTTP/2 connection, unless the spec upgrades to it first.
+		// A spec that exchanges SETTINGS itself starts without waiting.
+		if !http2.UpgradeSpec(specStr) {
+			if err := startHTTP2(h2conn, specStr); err != nil {
+				return fmt.Errorf("failed to start HTTP/2 connection: %w", err)
+			}
 		}
 		defer h2conn.Stop()
 
 		// Process the spec
-		return handler.ProcessSpec(spec)
+		err := handler.ProcessSpec(specStr)
+		if summary := h2conn.LastExchange(); summary != "" {
+			s.SetLast(summary)
+		}
+		return err
 	}
 }
 
 // createHTTP2ClientProcessFunc creates a processFunc for HTTP/2 client connections
-func createHTTP2ClientProcessFunc(spec string) client.ProcessFunc {
+func createHTTP2ClientProcessFunc(spec string, ctx *vtc.ExecContext, c *client.Client) client.ProcessFunc {
 	return func(conn net.Conn, specStr string) error {
-		logger := logging.NewLogger("http2")
+		logger := sessionLogger(ctx, c.Name, "http2")
 		h2conn := http2.NewConn(conn, logger, true) // true = client mode
+		h2conn.ConnectTime = c.ConnectTime
+		definePeerMacros(ctx, c.Name, conn)
 		handler := http2.NewHandler(h2conn)
+		handler.Name = c.Name
+		handler.SetContext(ctx)
 
-		// Start HTTP/2 connection
-		if err := h2conn.Start(); err != nil {
-			return fmt.Errorf("failed to start HTTP/2 connection: %w", err)
+		// Start HTTP/2 connection, unless the spec upgrades to it first.
+		// A spec that exchanges SETTINGS itself starts without waiting.
+		if !http2.UpgradeSpec(spec) {
+			if err := startHTTP2(h2conn, spec); err != nil {
+				return fmt.Errorf("failed to start HTTP/2 connection: %w", err)
+			}
 		}
 		defer h2conn.Stop()
 
 		// Process the spec
-		return handler.ProcessSpec(spec)
+		err := handler.ProcessSpec(spec)
+		defineClientMacros(ctx, c, h2conn.LastExchange())
+		return err
 	}
 }
 
+// cmdDump logs the state of the named clients, servers, loadgens and tunnels
+func cmdDump(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*vtc.ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for dump command")
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("dump: missing object name")
+	}
+
+	for _, name := range args {
+		if obj, ok := ctx.Servers[name]; ok {
+			s := obj.(*server.Server)
+			logger.Log(1, "%s: listen=%s running=%v dispatch=%v accepted=%d active=%d",
+				name, s.Listen, s.Running, s.IsDispatch, s.Accepted(), s.Active())
+			if last := s.Last(); last != "" {
+				logger.Log(1, "%s: last request: %s", name, last)
+			}
+			continue
+		}
+		if obj, ok := ctx.Clients[name]; ok {
+			c := obj.(*client.Client)
+			logger.Log(1, "%s: connect=%s running=%v connections=%d connect_time=%v",
+				name, c.ConnectAddr, c.Running, c.Connections(), c.ConnectTime)
+			if last := c.Last(); last != "" {
+				logger.Log(1, "%s: last response: %s", name, last)
+			}
+			continue
+		}
+		if obj, ok := ctx.LoadGens[name]; ok {
+			l := obj.(*loadgen.LoadGen)
+			logger.Log(1, "%s: connect=%s running=%v clients=%d", name, l.ConnectAddr, l.Running, l.Clients)
+			if r := l.Result(); r != nil {
+				logger.Log(1, "%s: last run: %s", name, r)
+			}
+			continue
+		}
+		if obj, ok := ctx.Tunnels[name]; ok {
+			t := obj.(*tunnel.Tunnel)
+			logger.Log(1, "%s: listen=%s connect=%s running=%v sent=%d received=%d",
+				name, t.Listen, t.Connect, t.Running, t.Forwarded(tunnel.Send), t.Forwarded(tunnel.Recv))
+			continue
+		}
+		return fmt.Errorf("dump: no client, server, loadgen or tunnel named %s", name)
+	}
+	return nil
+}
+
 // cmdClient implements the "client" command
 func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 	logger.Debug("cmdClient called with args: %v", args)
@@ -217,19 +412,36 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 		logger.Debug("Using existing client: %s", clientName)
 	} else {
 		c = client.New(logger, clientName)
+		c.Macros = ctx.Macros
+		c.Session.Done = ctx.Done()
 		ctx.Clients[clientName] = c
+		if _, err := ctx.ObjectDir(clientName); err != nil {
+			return err
+		}
 		logger.Debug("Created new client: %s", clientName)
 	}
 
 	// Convert child nodes to spec if present
 	if ctx.CurrentNode != nil && len(ctx.CurrentNode.Children) > 0 {
-		c.Spec = nodeToSpec(ctx.CurrentNode.Children)
+		children, err := ctx.ExpandSpecs(ctx.CurrentNode.Children)
+		if err != nil {
+			return fmt.Errorf("client %s: %w", clientName, err)
+		}
+		if err := waitClient(ctx, c); err != nil {
+			return err
+		}
+		c.Spec = nodeToSpec(children)
 		logger.Debug("Set client spec from child nodes, length: %d", len(c.Spec))
 	}
 
 	// Parse command options
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
+		if arg != "-wait" {
+			if err := waitClient(ctx, c); err != nil {
+				return err
+			}
+		}
 
 		switch arg {
 		case "-connect":
@@ -249,10 +461,10 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 			var processFunc client.ProcessFunc
 			if isHTTP2Spec(c.Spec) {
 				logger.Debug("Client %s: using HTTP/2 handler", clientName)
-				processFunc = createHTTP2ClientProcessFunc(c.Spec)
+				processFunc = createHTTP2ClientProcessFunc(c.Spec, ctx, c)
 			} else {
 				logger.Debug("Client %s: using HTTP/1 handler", clientName)
-				processFunc = createHTTP1ClientProcessFunc(c.Spec, ctx, clientName)
+				processFunc = createHTTP1ClientProcessFunc(c.Spec, ctx, c)
 			}
 			err := c.Start(processFunc)
 			if err != nil {
@@ -264,7 +476,9 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 		case "-wait":
 			// Wait for client to complete
 			logger.Debug("Client %s: processing -wait flag", clientName)
-			c.Wait()
+			if err := waitAbortable(ctx, c.Wait); err != nil {
+				return err
+			}
 			logger.Debug("Client %s: -wait completed", clientName)
 
 		case "-run":
@@ -273,10 +487,10 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 			var processFunc client.ProcessFunc
 			if isHTTP2Spec(c.Spec) {
 				logger.Debug("Client %s: using HTTP/2 handler", clientName)
-				processFunc = createHTTP2ClientProcessFunc(c.Spec)
+				processFunc = createHTTP2ClientProcessFunc(c.Spec, ctx, c)
 			} else {
 				logger.Debug("Client %s: using HTTP/1 handler", clientName)
-				processFunc = createHTTP1ClientProcessFunc(c.Spec, ctx, clientName)
+				processFunc = createHTTP1ClientProcessFunc(c.Spec, ctx, c)
 			}
 			err := c.Run(processFunc)
 			if err != nil {
@@ -298,12 +512,21 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 				return fmt.Errorf("client: failed to parse -repeat")
 			}
 
-		case "-keepalive":
+		case "-keepalive", "-reconnect-on-fail":
 			_, err := c.Session.ParseOption([]string{arg})
 			if err != nil {
 				return fmt.Errorf("client: %w", err)
 			}
 
+		case "-max-attempts", "-backoff", "-backoff-max":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: %s requires an argument", arg)
+			}
+			i++
+			if _, err := c.Session.ParseOption([]string{arg, args[i]}); err != nil {
+				return fmt.Errorf("client: %w", err)
+			}
+
 		case "-rcvbuf":
 			if i+1 >= len(args) {
 				return fmt.Errorf("client: -rcvbuf requires an argument")
@@ -331,6 +554,117 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 			i++
 			c.SetProxy(client.ProxyV2, args[i])
 
+		case "-bind":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: -bind requires an argument")
+			}
+			i++
+			addr, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("client: -bind macro expansion failed: %w", err)
+			}
+			c.SetBind(addr, c.Interface)
+
+		case "-via":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: -via requires an argument")
+			}
+			i++
+			proxyURL, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("client: -via macro expansion failed: %w", err)
+			}
+			via, err := client.ParseVia(proxyURL)
+			if err != nil {
+				return fmt.Errorf("client: %w", err)
+			}
+			c.SetVia(via)
+
+		case "-happy-eyeballs":
+			policy := c.DialPolicy
+			policy.Race = true
+			c.SetDialPolicy(policy)
+
+		case "-prefer":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: -prefer requires an argument")
+			}
+			i++
+			if args[i] != "v4" && args[i] != "v6" {
+				return fmt.Errorf("client: -prefer must be v4 or v6 (got %s)", args[i])
+			}
+			policy := c.DialPolicy
+			policy.Prefer = args[i]
+			c.SetDialPolicy(policy)
+
+		case "-attempt-delay":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: -attempt-delay requires an argument")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil {
+				return fmt.Errorf("client: invalid -attempt-delay: %w", err)
+			}
+			policy := c.DialPolicy
+			policy.AttemptDelay = d
+			c.SetDialPolicy(policy)
+
+		case "-interface":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: -interface requires an argument")
+			}
+			i++
+			iface, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("client: -interface macro expansion failed: %w", err)
+			}
+			c.SetBind(c.BindAddr, iface)
+
+		case "-tls":
+			c.SetTLS(tlsOptions(c.TLS))
+
+		case "-tls-resume":
+			// Later connections resume the session of earlier ones
+			opts := tlsOptions(c.TLS)
+			opts.SessionCache = tls.NewLRUClientSessionCache(0)
+			c.SetTLS(opts)
+
+		case "-tls-full":
+			// Forget the sessions of -tls-resume: every handshake is full
+			opts := tlsOptions(c.TLS)
+			opts.SessionCache = nil
+			c.SetTLS(opts)
+
+		case "-tls-early-data":
+			// Refused rather than ignored, so that a 0-RTT test cannot
+			// pass without sending early data
+			return fmt.Errorf("client: -tls-early-data is not supported: Go's crypto/tls cannot send TLS 1.3 early data")
+
+		case "-servername", "-sni", "-cafile", "-clientcert", "-clientkey":
+			if i+1 >= len(args) {
+				return fmt.Errorf("client: %s requires an argument", arg)
+			}
+			i++
+			value, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("client: %s macro expansion failed: %w", arg, err)
+			}
+			opts := tlsOptions(c.TLS)
+			switch arg {
+			case "-servername":
+				opts.ServerName = value
+			case "-sni":
+				opts.SNI = value
+			case "-cafile":
+				opts.CAFile = value
+			case "-clientcert":
+				opts.Cert = value
+			case "-clientkey":
+				opts.Key = value
+			}
+			c.SetTLS(opts)
+
 		default:
 			if arg[0] == '-' {
 				return fmt.Errorf("client: unknown option: %s", arg)
@@ -343,6 +677,53 @@ func cmdClient(args []string, priv interface{}, logger *logging.Logger) error {
 	return nil
 }
 
+// tlsOptions returns a copy of opts to change, or new options if the
+// client or server does not speak TLS yet: any TLS option turns it on
+func tlsOptions(opts *gnet.TLSOptions) *gnet.TLSOptions {
+	if opts == nil {
+		return &gnet.TLSOptions{}
+	}
+	c := *opts
+	return &c
+}
+
+// waitClient waits for a running client to finish before it is changed or
+// started again. VTest2 does the same implicit -wait, so that a new spec
+// never replaces one still running.
+func waitClient(ctx *vtc.ExecContext, c *client.Client) error {
+	if !c.IsRunning() {
+		return nil
+	}
+	c.Logger.Log(3, "Waiting for the running client before changing it")
+	return waitAbortable(ctx, c.Wait)
+}
+
+// waitServer waits for a running server to end, as waitClient does for
+// clients. The server can then be started again, on the same address.
+func waitServer(ctx *vtc.ExecContext, s *server.Server) error {
+	if !s.IsRunning() {
+		return nil
+	}
+	s.Logger.Log(3, "Waiting for the running server before changing it")
+	return waitAbortable(ctx, s.Wait)
+}
+
+// waitAbortable runs wait, giving up with the reason if the test is
+// aborted first, as a failing client or server does
+func waitAbortable(ctx *vtc.ExecContext, wait func()) error {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // cmdServer implements the "server" command
 func cmdServer(args []string, priv interface{}, logger *logging.Logger) error {
 	logger.Debug("cmdServer called with args: %v", args)
@@ -373,18 +754,35 @@ func cmdServer(args []string, priv interface{}, logger *logging.Logger) error {
 	} else {
 		s = server.New(logger, ctx.Macros, serverName)
 		ctx.Servers[serverName] = s
+		if _, err := ctx.ObjectDir(serverName); err != nil {
+			return err
+		}
 		logger.Debug("Created new server: %s", serverName)
 	}
 
 	// Convert child nodes to spec if present
 	if ctx.CurrentNode != nil && len(ctx.CurrentNode.Children) > 0 {
-		s.Spec = nodeToSpec(ctx.CurrentNode.Children)
+		children, err := ctx.ExpandSpecs(ctx.CurrentNode.Children)
+		if err != nil {
+			return fmt.Errorf("server %s: %w", serverName, err)
+		}
+		if err := waitServer(ctx, s); err != nil {
+			return err
+		}
+		s.Spec = nodeToSpec(children)
 		logger.Debug("Set server spec from child nodes, length: %d", len(s.Spec))
 	}
 
 	// Parse command options
 	for i := 0; i < len(args); i++ {
 		arg := args[i]
+		switch arg {
+		case "-wait", "-break", "-stop-drain", "-stop-now":
+		default:
+			if err := waitServer(ctx, s); err != nil {
+				return err
+			}
+		}
 
 		switch arg {
 		case "-listen":
@@ -401,13 +799,15 @@ func cmdServer(args []string, priv interface{}, logger *logging.Logger) error {
 		case "-start":
 			// Start server with appropriate processFunc
 			logger.Debug("Server %s: processing -start flag", serverName)
+			s.IsDispatch = false // A restart after -dispatch runs one spec again
+			s.SpecPerConn = false
 			var processFunc server.ProcessFunc
 			if isHTTP2Spec(s.Spec) {
 				logger.Debug("Server %s: using HTTP/2 handler", serverName)
-				processFunc = createHTTP2ProcessFunc(s.Spec)
+				processFunc = createHTTP2ProcessFunc(s.Spec, ctx, s)
 			} else {
 				logger.Debug("Server %s: using HTTP/1 handler", serverName)
-				processFunc = createHTTP1ProcessFunc(s.Spec, ctx, serverName)
+				processFunc = createHTTP1ProcessFunc(s.Spec, ctx, s)
 			}
 			err := s.Start(processFunc)
 			if err != nil {
@@ -419,7 +819,9 @@ func cmdServer(args []string, priv interface{}, logger *logging.Logger) error {
 		case "-wait":
 			// Wait for server to stop
 			logger.Debug("Server %s: processing -wait flag", serverName)
-			s.Wait()
+			if err := waitAbortable(ctx, s.Wait); err != nil {
+				return err
+			}
 			logger.Debug("Server %s: -wait completed", serverName)
 
 		case "-break":
@@ -432,20 +834,42 @@ func cmdServer(args []string, priv interface{}, logger *logging.Logger) error {
 			}
 			logger.Debug("Server %s: -break completed", serverName)
 
-		case "-dispatch":
-			// Enable dispatch mode (only for s0)
-			logger.Debug("Server %s: processing -dispatch flag", serverName)
-			if serverName != "s0" {
-				return fmt.Errorf("server: -dispatch only works on s0")
+		case "-stop-drain":
+			// Stop accepting, let in-flight specs finish within the timeout
+			if i+1 >= len(args) {
+				return fmt.Errorf("server: -stop-drain requires an argument")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil {
+				return fmt.Errorf("server: invalid -stop-drain timeout %s: %w", args[i], err)
+			}
+			s.StopDrain(d)
+
+		case "-stop-now":
+			// Close all connections immediately, with an optional RST
+			rst := false
+			if i+1 < len(args) && args[i+1] == "-rst" {
+				rst = true
+				i++
 			}
+			s.StopNow(rst)
+
+		case "-dispatch", "-dispatch-spec-per-conn":
+			// Enable dispatch mode: every accepted connection runs the spec
+			// concurrently. The per-conn variant expands macros in the spec
+			// for each connection, with ${conn_seq}, ${conn_worker} and
+			// ${conn_remote} set.
+			logger.Debug("Server %s: processing %s flag", serverName, arg)
 			s.IsDispatch = true
+			s.SpecPerConn = arg == "-dispatch-spec-per-conn"
 			var processFunc server.ProcessFunc
 			if isHTTP2Spec(s.Spec) {
 				logger.Debug("Server %s: using HTTP/2 handler for dispatch", serverName)
-				processFunc = createHTTP2ProcessFunc(s.Spec)
+				processFunc = createHTTP2ProcessFunc(s.Spec, ctx, s)
 			} else {
 				logger.Debug("Server %s: using HTTP/1 handler for dispatch", serverName)
-				processFunc = createHTTP1ProcessFunc(s.Spec, ctx, serverName)
+				processFunc = createHTTP1ProcessFunc(s.Spec, ctx, s)
 			}
 			err := s.Start(processFunc)
 			if err != nil {
@@ -454,6 +878,98 @@ func cmdServer(args []string, priv interface{}, logger *logging.Logger) error {
 			}
 			logger.Debug("Server %s: -dispatch completed", serverName)
 
+		case "-accept-limit":
+			// Stop accepting after N connections, leaving the socket open
+			if i+1 >= len(args) {
+				return fmt.Errorf("server: -accept-limit requires an argument")
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				return fmt.Errorf("server: invalid -accept-limit %s", args[i])
+			}
+			s.AcceptLimit = n
+
+		case "-accept-delay":
+			if i+1 >= len(args) {
+				return fmt.Errorf("server: -accept-delay requires an argument")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil {
+				return fmt.Errorf("server: invalid -accept-delay %s: %w", args[i], err)
+			}
+			s.AcceptDelay = d
+
+		case "-close-on-accept":
+			s.CloseOnAccept = true
+
+		case "-backlog":
+			if i+1 >= len(args) {
+				return fmt.Errorf("server: -backlog requires an argument")
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				return fmt.Errorf("server: invalid -backlog %s", args[i])
+			}
+			s.Depth = n
+
+		case "-tls":
+			s.TLS = tlsOptions(s.TLS)
+
+		case "-tls-no-tickets":
+			s.TLS = tlsOptions(s.TLS)
+			s.TLS.NoTickets = true
+
+		case "-cert", "-key", "-cert-for", "-ocsp", "-verify-client":
+			if i+1 >= len(args) {
+				return fmt.Errorf("server: %s requires an argument", arg)
+			}
+			i++
+			value, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("server: %s macro expansion failed: %w", arg, err)
+			}
+			opts := tlsOptions(s.TLS)
+			switch arg {
+			case "-cert":
+				opts.Cert = value
+			case "-key":
+				opts.Key = value
+			case "-ocsp":
+				opts.OCSP = value
+			case "-cert-for":
+				// HOST=CERT,KEY[,OCSP]
+				host, files, ok := strings.Cut(value, "=")
+				cert, key, ok2 := strings.Cut(files, ",")
+				key, ocsp, _ := strings.Cut(key, ",")
+				if !ok || !ok2 || host == "" || cert == "" || key == "" {
+					return fmt.Errorf("server: -cert-for must be HOST=CERT,KEY[,OCSP] (got %s)", value)
+				}
+				opts.HostCerts = append(opts.HostCerts, gnet.HostCert{Host: host, Cert: cert, Key: key, OCSP: ocsp})
+			case "-verify-client":
+				opts.CAFile = value
+				opts.RequestClientCert = true
+			}
+			s.TLS = opts
+
+		case "-reuseport":
+			s.ReusePort = true
+
+		case "-workers":
+			// Listen on the port with N SO_REUSEPORT sockets, each with
+			// its own accept loop
+			if i+1 >= len(args) {
+				return fmt.Errorf("server: -workers requires an argument")
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				return fmt.Errorf("server: invalid -workers %s", args[i])
+			}
+			s.Workers = n
+
 		case "-repeat":
 			if i+1 >= len(args) {
 				return fmt.Errorf("server: -repeat requires an argument")
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/perbu/GTest/pkg/runner"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// runHelp implements "gvtest help [COMMAND...]": lists the VTC commands,
+// or shows the usage and options of the named ones
+func runHelp(args []string) int {
+	if len(args) == 0 {
+		vtc.WriteIndex(os.Stdout)
+		return runner.ExitPass
+	}
+
+	status := runner.ExitPass
+	for i, name := range args {
+		docs := vtc.LookupDocs(name)
+		if len(docs) == 0 {
+			if _, ok := vtc.GetCommand(name); ok {
+				fmt.Fprintf(os.Stderr, "%s: %s is not documented\n", os.Args[0], name)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: unknown command %s\n", os.Args[0], name)
+			}
+			status = runner.ExitError
+			continue
+		}
+		for j, doc := range docs {
+			if i > 0 || j > 0 {
+				fmt.Println()
+			}
+			doc.Write(os.Stdout)
+		}
+	}
+	return status
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perbu/GTest/pkg/http1"
+	"github.com/perbu/GTest/pkg/http2"
+	"github.com/perbu/GTest/pkg/logging"
+	gnet "github.com/perbu/GTest/pkg/net"
+	"github.com/perbu/GTest/pkg/util"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// httpreqOptions is a request of the "httpreq" command
+type httpreqOptions struct {
+	method  string
+	headers map[string]string
+	body    []byte
+	h2      bool
+	timeout time.Duration
+}
+
+// httpreqResponse is what the request got back
+type httpreqResponse struct {
+	status int
+	body   []byte
+}
+
+// cmdHTTPReq implements the "httpreq" command: a one-shot request to a
+// URL, with the HTTP/1 or HTTP/2 engine the clients use. The response is
+// exported as ${httpreq_status} and ${httpreq_body}.
+func cmdHTTPReq(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*vtc.ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for httpreq command")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("httpreq: usage: httpreq URL [options]")
+	}
+
+	rawURL, err := ctx.Macros.Expand(logger, args[0])
+	if err != nil {
+		return fmt.Errorf("httpreq: %w", err)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("httpreq: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("httpreq: need an http:// or https:// URL, got %s", rawURL)
+	}
+
+	opts := httpreqOptions{
+		method:  "GET",
+		headers: make(map[string]string),
+		timeout: 10 * time.Second,
+	}
+	var (
+		status    int
+		matchBody *regexp.Regexp
+	)
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch arg {
+		case "-h2":
+			opts.h2 = true
+			continue
+		case "-method", "-hdr", "-body", "-timeout", "-status", "-match-body":
+		default:
+			return fmt.Errorf("httpreq: unknown option: %s", arg)
+		}
+
+		if i+1 >= len(args) {
+			return fmt.Errorf("httpreq: %s requires a value", arg)
+		}
+		i++
+		value, err := ctx.Macros.Expand(logger, args[i])
+		if err != nil {
+			return fmt.Errorf("httpreq: %s: %w", arg, err)
+		}
+		switch arg {
+		case "-method":
+			opts.method = value
+		case "-hdr":
+			name, val, ok := strings.Cut(value, ":")
+			if !ok || name == "" {
+				return fmt.Errorf("httpreq: -hdr requires \"Name: value\", got %q", value)
+			}
+			opts.headers[name] = strings.TrimSpace(val)
+		case "-body":
+			opts.body = []byte(value)
+		case "-timeout":
+			seconds, err := util.ParseNumber(value)
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("httpreq: invalid timeout: %s", value)
+			}
+			opts.timeout = time.Duration(seconds * float64(time.Second))
+		case "-status":
+			status, err = strconv.Atoi(value)
+			if err != nil || status < 100 || status > 999 {
+				return fmt.Errorf("httpreq: invalid status: %s", value)
+			}
+		case "-match-body":
+			matchBody, err = regexp.Compile(value)
+			if err != nil {
+				return fmt.Errorf("httpreq: invalid regex: %w", err)
+			}
+		}
+	}
+
+	logger.Log(3, "httpreq %s %s", opts.method, u)
+	resp, err := httpreq(ctx, u, opts)
+	if err != nil {
+		return fmt.Errorf("httpreq: %s %s: %w", opts.method, u, err)
+	}
+	logger.Log(3, "httpreq %s %s: status %d, %d bytes", opts.method, u, resp.status, len(resp.body))
+	ctx.Macros.Definef("httpreq_status", "%d", resp.status)
+	ctx.Macros.Define("httpreq_body", string(resp.body))
+
+	if status != 0 && resp.status != status {
+		return fmt.Errorf("httpreq: expected status %d, got %d", status, resp.status)
+	}
+	if matchBody != nil && !matchBody.Match(resp.body) {
+		return fmt.Errorf("httpreq: body did not match pattern %s", matchBody)
+	}
+	return nil
+}
+
+// httpreq connects to the host of u and makes the request. Certificates
+// are not checked, as test servers rarely have real ones.
+func httpreq(ctx *vtc.ExecContext, u *url.URL, opts httpreqOptions) (*httpreqResponse, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := gnet.TCPConnect(addr, opts.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		tlsOpts := &gnet.TLSOptions{ServerName: u.Hostname(), ALPN: []string{"http/1.1"}}
+		if opts.h2 {
+			tlsOpts.ALPN = []string{"h2"}
+		}
+		tlsConn, err := gnet.TLSClient(conn, tlsOpts, opts.timeout)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	defer conn.Close()
+
+	// The whole exchange shares the timeout, and a test that ends
+	// aborts it
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if opts.h2 {
+		return httpreqH2(ctx, conn, u, opts)
+	}
+
+	h := http1.New(conn, sessionLogger(ctx, "httpreq", "http1"))
+	h.Name = "httpreq"
+	h.SetTimeout(opts.timeout)
+	opts.headers["Host"] = u.Host
+	if _, ok := opts.headers["Connection"]; !ok {
+		opts.headers["Connection"] = "close"
+	}
+	err = h.TxReq(&http1.TxReqOptions{
+		Method:  opts.method,
+		URL:     u.RequestURI(),
+		Headers: opts.headers,
+		Body:    opts.body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := h.RxResp(&http1.RxRespOptions{}); err != nil {
+		return nil, err
+	}
+	return &httpreqResponse{status: h.Status, body: h.Body}, nil
+}
+
+// httpreqH2 makes the request on stream 1 of an HTTP/2 connection,
+// with prior knowledge on http:// URLs
+func httpreqH2(ctx *vtc.ExecContext, conn net.Conn, u *url.URL, opts httpreqOptions) (*httpreqResponse, error) {
+	h2conn := http2.NewConn(conn, sessionLogger(ctx, "httpreq", "http2"), true)
+	if err := h2conn.StartAndWaitSettings(opts.timeout); err != nil {
+		return nil, err
+	}
+	defer h2conn.Stop()
+
+	headers := make(map[string]string, len(opts.headers))
+	for name, value := range opts.headers {
+		headers[strings.ToLower(name)] = value
+	}
+	id := h2conn.NextStreamID()
+	err := h2conn.TxReq(id, http2.TxReqOptions{
+		Method:    opts.method,
+		Path:      u.RequestURI(),
+		Scheme:    u.Scheme,
+		Authority: u.Host,
+		Headers:   headers,
+		Body:      opts.body,
+		EndStream: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The receive loop keeps moving the read deadline, so the timeout
+	// closes the connection instead
+	timer := time.AfterFunc(opts.timeout, func() { h2conn.Stop() })
+	defer timer.Stop()
+	if err := h2conn.WaitEnd(id); err != nil {
+		if !timer.Stop() {
+			return nil, fmt.Errorf("no response after %v", opts.timeout)
+		}
+		return nil, err
+	}
+
+	statusField, err := h2conn.Field(id, "resp.status")
+	if err != nil {
+		return nil, err
+	}
+	status, err := strconv.Atoi(statusField)
+	if err != nil {
+		return nil, fmt.Errorf("invalid :status %q", statusField)
+	}
+	body, err := h2conn.Field(id, "resp.body")
+	if err != nil {
+		return nil, err
+	}
+	return &httpreqResponse{status: status, body: []byte(body)}, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/perbu/GTest/pkg/http1"
+	"github.com/perbu/GTest/pkg/loadgen"
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// cmdLoadgen implements the "loadgen" command
+func cmdLoadgen(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*vtc.ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for loadgen command")
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("loadgen: missing loadgen name")
+	}
+
+	name := args[0]
+	args = args[1:]
+
+	// Validate loadgen name starts with 'l'
+	if name[0] != 'l' {
+		return fmt.Errorf("loadgen name must start with 'l' (got %s)", name)
+	}
+
+	// Get or create loadgen
+	var l *loadgen.LoadGen
+	if existing, ok := ctx.LoadGens[name]; ok {
+		l = existing.(*loadgen.LoadGen)
+	} else {
+		l = loadgen.New(logger, name)
+		ctx.LoadGens[name] = l
+		if _, err := ctx.ObjectDir(name); err != nil {
+			return err
+		}
+	}
+
+	// Convert child nodes to spec if present
+	if ctx.CurrentNode != nil && len(ctx.CurrentNode.Children) > 0 {
+		children, err := ctx.ExpandSpecs(ctx.CurrentNode.Children)
+		if err != nil {
+			return fmt.Errorf("loadgen %s: %w", name, err)
+		}
+		l.Spec = nodeToSpec(children)
+	}
+
+	// Parse command options
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch arg {
+		case "-connect":
+			if i+1 >= len(args) {
+				return fmt.Errorf("loadgen: -connect requires an argument")
+			}
+			i++
+			addr, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("loadgen: -connect macro expansion failed: %w", err)
+			}
+			l.ConnectAddr = addr
+
+		case "-clients", "-requests":
+			if i+1 >= len(args) {
+				return fmt.Errorf("loadgen: %s requires an argument", arg)
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil || n < 1 {
+				return fmt.Errorf("loadgen: invalid %s %q", arg, args[i])
+			}
+			if arg == "-clients" {
+				l.Clients = n
+			} else {
+				l.Requests = n
+			}
+
+		case "-duration":
+			if i+1 >= len(args) {
+				return fmt.Errorf("loadgen: -duration requires an argument")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil || d <= 0 {
+				return fmt.Errorf("loadgen: invalid -duration %q", args[i])
+			}
+			l.Duration = d
+
+		case "-keepalive":
+			l.KeepAlive = true
+
+		case "-expect":
+			if i+3 >= len(args) {
+				return fmt.Errorf("loadgen: -expect requires a field, an operator and a value")
+			}
+			t, err := loadgen.ParseThreshold(args[i+1], args[i+2], args[i+3])
+			if err != nil {
+				return fmt.Errorf("loadgen: %w", err)
+			}
+			i += 3
+			l.Thresholds = append(l.Thresholds, t)
+			// A finished run is checked right away
+			if r := l.Result(); r != nil {
+				if err := t.Check(r); err != nil {
+					return fmt.Errorf("loadgen %s: %w", name, err)
+				}
+			}
+
+		case "-start":
+			process, err := loadgenProcessFunc(ctx, l)
+			if err != nil {
+				return err
+			}
+			if err := l.Start(process, ctx.Done()); err != nil {
+				return fmt.Errorf("loadgen: -start failed: %w", err)
+			}
+
+		case "-wait":
+			err := l.Wait()
+			defineLoadgenMacros(ctx, l)
+			if err != nil {
+				return err
+			}
+
+		case "-run":
+			process, err := loadgenProcessFunc(ctx, l)
+			if err != nil {
+				return err
+			}
+			_, err = l.Run(process, ctx.Done())
+			defineLoadgenMacros(ctx, l)
+			if err != nil {
+				return err
+			}
+
+		default:
+			if arg[0] == '-' {
+				return fmt.Errorf("loadgen: unknown option: %s", arg)
+			}
+			// This is the spec (command script)
+			l.Spec = arg
+		}
+	}
+
+	return nil
+}
+
+// loadgenProcessFunc runs the loadgen spec once per call with a fresh
+// HTTP/1 session
+func loadgenProcessFunc(ctx *vtc.ExecContext, l *loadgen.LoadGen) (loadgen.ProcessFunc, error) {
+	if isHTTP2Spec(l.Spec) {
+		return nil, fmt.Errorf("loadgen %s: HTTP/2 specs are not supported", l.Name)
+	}
+	spec := l.Spec
+	return func(conn net.Conn) error {
+		h := http1.New(conn, sessionLogger(ctx, l.Name, "http1"))
+		h.Name = l.Name
+		handler := http1.NewHandler(h)
+		handler.SetContext(ctx)
+		return handler.ProcessSpec(spec)
+	}, nil
+}
+
+// defineLoadgenMacros publishes the fields of the last result as
+// ${NAME_requests}, ${NAME_rps}, ${NAME_p99} and so on
+func defineLoadgenMacros(ctx *vtc.ExecContext, l *loadgen.LoadGen) {
+	r := l.Result()
+	if r == nil {
+		return
+	}
+	for _, field := range loadgen.Fields {
+		if v, err := r.Format(field); err == nil {
+			ctx.Macros.Define(l.Name+"_"+field, v)
+		}
+	}
+}
@@ -5,289 +5,251 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
-	"sync"
+	"os/signal"
+	"runtime/debug"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/process"
+	"github.com/perbu/GTest/pkg/runner"
 	"github.com/perbu/GTest/pkg/vtc"
 )
 
 var (
-	verbose   = flag.Bool("v", false, "Verbose output")
-	quiet     = flag.Bool("q", false, "Quiet mode")
-	keepTmp   = flag.Bool("k", false, "Keep temp directories")
-	jobs      = flag.Int("j", 1, "Number of parallel jobs")
-	timeoutSec = flag.Int("t", 60, "Test timeout in seconds")
-	dumpAST   = flag.Bool("dump-ast", false, "Dump AST and exit")
-	version   = flag.Bool("version", false, "Show version")
+	verbose       = flag.Bool("v", false, "Verbose output")
+	bodyExcerpt   = flag.Int("L", 0, "Log the first `N` bytes of each HTTP/1 message body")
+	quiet         = flag.Bool("q", false, "Quiet mode")
+	keepTmp       = flag.Bool("k", false, "Keep temp directories")
+	jobs          = flag.Int("j", 1, "Number of parallel jobs")
+	timeoutSec    = flag.Int("t", 60, "Test timeout in seconds")
+	dumpAST       = flag.Bool("dump-ast", false, "Dump the AST as JSON and exit")
+	ignoreUnknown = flag.Bool("ignore-unknown-commands", false, "Log and skip unknown commands instead of failing")
+	version       = flag.Bool("version", false, "Show version")
+	failuresLast  = flag.Bool("print-failures-last", false, "Print the logs of failed tests after all tests have run")
+	order         = flag.String("order", "", "Run tests in `alpha` order or by mtime (most recently modified first)")
+	shuffleSeed   = flag.Int64("shuffle", 0, "Shuffle tests using `seed` (0 = no shuffle)")
+	list          = flag.Bool("list", false, "List the discovered tests and their descriptions without running them")
+	failFast      = flag.Bool("failfast", false, "Stop after the first failed test (same as -max-failures 1)")
+	maxFailures   = flag.Int("max-failures", 0, "Stop scheduling tests after `N` failures and cancel running ones")
+	watch         = flag.Bool("watch", false, "Keep running and re-run tests whose files change")
+	tags          = flag.String("tags", "", "Run only tests tagged with one of `tags` (comma separated)")
+	skipTags      = flag.String("skip-tags", "", "Don't run tests tagged with any of `tags` (comma separated)")
+	artifactDir   = flag.String("o", "", "Save artifacts of failed tests under `dir`")
+	keepProcs     = flag.Bool("keep-processes", false, "Leave processes started by a test running when it ends, instead of killing their process groups")
+	shell         = flag.String("shell", process.DefaultShell, "Run the commands of shell and process with `shell` (sh, bash, cmd, powershell, ...)")
+	groupLogs     = flag.Bool("group-logs", false, "After each test log, print it again grouped by client, server and other object")
+	color         = flag.String("color", "auto", "Color the output: `auto` (on a terminal, unless NO_COLOR is set), always or never")
+	summary       = flag.String("summary", "", "Print a summary of the run in `format` (json) after the results")
+	summaryFile   = flag.String("summary-file", "", "Write a JSON summary of the run to `file`")
+	junit         = flag.String("junit", "", "Write a JUnit XML report of the run, with test descriptions and tags, to `file`")
+	chaos         = flag.Bool("chaos", false, "Inject random delays before each command and where goroutines race, to find timing assumptions")
+	chaosSeed     = flag.Int64("chaos-seed", 0, "Seed of -chaos, to repeat a run (0 = pick one; implies -chaos otherwise)")
+	chaosMax      = flag.Duration("chaos-max", vtc.DefaultChaosMax, "Longest delay of -chaos")
+	strict        = flag.Bool("strict", false, "Fail tests that leave goroutines, listening servers or tunnels, or open temp files behind")
+	watchInterval = flag.Duration("watch-interval", runner.DefaultWatchInterval, "How often -watch checks for changes")
+	defines       macroDefs
+	verbosity     string
 )
 
-const (
-	versionString = "gvtest 0.5.0 (Phase 5)"
-	exitPass      = 0
-	exitFail      = 1
-	exitSkip      = 77
-	exitError     = 2
-)
+// macroDefs collects repeated -D name=value flags
+type macroDefs []string
 
-// testResult holds the result of running a single test
-type testResult struct {
-	testFile string
-	exitCode int
-	output   string
-	err      error
+func (d *macroDefs) String() string {
+	return strings.Join(*d, " ")
 }
 
+func (d *macroDefs) Set(value string) error {
+	name, _, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	*d = append(*d, value)
+	return nil
+}
+
+const versionString = "gvtest 0.5.0 (Phase 5)"
+
 func init() {
+	flag.Var(&defines, "D", "Define macro `name=value` (repeatable)")
+	flag.Func("verbosity", "Log levels by `component=level`, comma separated; a bare level sets the default (e.g. warning,http2=debug)", func(spec string) error {
+		if _, err := logging.ParseLevels(spec); err != nil {
+			return err
+		}
+		verbosity = spec
+		return nil
+	})
+	flag.Func("feature", "Declare feature `name` as present (repeatable)", func(name string) error {
+		if name == "" {
+			return fmt.Errorf("empty feature name")
+		}
+		vtc.DeclareFeature(name)
+		return nil
+	})
+
 	// Register all built-in commands
 	vtc.RegisterBuiltinCommands()
 	RegisterBuiltinCommands()
 }
 
 func main() {
+	// Fatal errors fail their test and unwind through errors; a panic
+	// that still gets here is a bug and is reported with its stack
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "%s: internal error: %v\n%s", os.Args[0], r, debug.Stack())
+			os.Exit(runner.ExitError)
+		}
+	}()
+
+	if len(os.Args) > 1 && os.Args[1] == "record" {
+		os.Exit(runRecord(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "help" {
+		os.Exit(runHelp(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	if *version {
 		fmt.Println(versionString)
-		os.Exit(exitPass)
+		os.Exit(runner.ExitPass)
 	}
 
 	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] test.vtc [test2.vtc ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] test.vtc|dir|glob ...\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s record -upstream HOST:PORT [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s help [command]\n", os.Args[0])
 		flag.PrintDefaults()
-		os.Exit(exitError)
-	}
-
-	// Set up logging verbosity based on flags
-	logging.SetVerbose(*verbose)
-
-	// Determine if parallel execution is needed
-	var exitCode int
-	if *jobs <= 1 {
-		// Sequential execution
-		exitCode = runTestsSequential(args)
-	} else {
-		// Parallel execution
-		exitCode = runTestsParallel(args, *jobs)
+		os.Exit(runner.ExitError)
 	}
 
-	os.Exit(exitCode)
-}
-
-// runTestsSequential runs tests sequentially (original behavior)
-func runTestsSequential(testFiles []string) int {
-	exitCode := exitPass
-	for _, testFile := range testFiles {
-		result := runTest(testFile)
-		if result != exitPass {
-			exitCode = result
+	discover := func() ([]string, error) {
+		files, err := runner.Discover(args)
+		if err == nil {
+			err = runner.Order(files, *order)
 		}
-	}
-	return exitCode
-}
-
-// runTestsParallel runs tests in parallel using a worker pool
-func runTestsParallel(testFiles []string, numWorkers int) int {
-	// Create channels for work distribution and result collection
-	testChan := make(chan string, len(testFiles))
-	resultChan := make(chan testResult, len(testFiles))
-
-	// Start worker pool
-	var wg sync.WaitGroup
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go testWorker(testChan, resultChan, &wg)
-	}
-
-	// Send test files to workers
-	for _, testFile := range testFiles {
-		testChan <- testFile
-	}
-	close(testChan)
-
-	// Wait for all workers to complete
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
-
-	// Collect and display results
-	exitCode := exitPass
-	var mu sync.Mutex
-	for result := range resultChan {
-		mu.Lock()
-		displayTestResult(result)
-
-		// Update exit code with priority: error > fail > skip > pass
-		if result.exitCode == exitError {
-			exitCode = exitError
-		} else if result.exitCode == exitFail && exitCode != exitError {
-			exitCode = exitFail
-		} else if result.exitCode == exitSkip && exitCode == exitPass {
-			exitCode = exitSkip
+		if err == nil && *shuffleSeed != 0 {
+			runner.Shuffle(files, *shuffleSeed)
 		}
-		mu.Unlock()
+		return files, err
 	}
-
-	return exitCode
-}
-
-// testWorker processes test files from the channel
-func testWorker(testChan <-chan string, resultChan chan<- testResult, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	for testFile := range testChan {
-		result := runTestCapture(testFile)
-		resultChan <- result
+	testFiles, err := discover()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(runner.ExitError)
 	}
-}
 
-// runTestCapture runs a test and captures its output
-func runTestCapture(testFile string) testResult {
-	// Create logger
-	testName := filepath.Base(testFile)
-	logger := logging.NewLogger(testName)
-
-	// Reset output before each test
-	logging.ResetOutput()
-
-	// Create macro store with default macros
-	macros := vtc.NewMacroStore()
-	vtc.SetupDefaultMacros(macros, testFile)
-
-	// Run the test
-	timeout := time.Duration(*timeoutSec) * time.Second
-	code, err := vtc.RunTest(testFile, logger, macros, *keepTmp, timeout)
-
-	// Capture log output
-	logOutput := logging.GetOutput()
-
-	return testResult{
-		testFile: testFile,
-		exitCode: code,
-		output:   logOutput,
-		err:      err,
+	if *list {
+		for _, testFile := range runner.FilterTags(testFiles, vtc.SplitTags(*tags), vtc.SplitTags(*skipTags)) {
+			info, err := runner.ReadInfo(testFile)
+			if err != nil {
+				info.Description = "(" + err.Error() + ")"
+			}
+			if len(info.Tags) > 0 {
+				fmt.Printf("%s\t%s\t[%s]\n", testFile, info.Description, strings.Join(info.Tags, ","))
+			} else {
+				fmt.Printf("%s\t%s\n", testFile, info.Description)
+			}
+		}
+		os.Exit(runner.ExitPass)
 	}
-}
 
-// displayTestResult outputs the result of a test
-func displayTestResult(result testResult) {
-	testName := filepath.Base(result.testFile)
+	if *failFast {
+		*maxFailures = 1
+	}
+	process.DefaultShell = *shell
 
-	switch result.exitCode {
-	case exitPass:
-		if !*quiet {
-			fmt.Printf("✓ %s\n", testName)
-		}
-		if *verbose && result.output != "" {
-			fmt.Print(result.output)
-		}
-	case exitSkip:
-		if !*quiet {
-			fmt.Printf("⊘ %s (skipped)\n", testName)
-		}
-		if *verbose && result.output != "" {
-			fmt.Print(result.output)
-		}
-	case exitFail:
-		if !*quiet {
-			fmt.Printf("✗ %s\n", testName)
-		}
-		if !*quiet && result.output != "" {
-			fmt.Print(result.output)
-		}
-	case exitError:
-		if !*quiet {
-			fmt.Printf("✗ %s (error)\n", testName)
-		}
-		if !*quiet && result.output != "" {
-			fmt.Print(result.output)
+	var chaosOpts *vtc.Chaos
+	if *chaos || *chaosSeed != 0 {
+		seed := *chaosSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
 		}
+		chaosOpts = vtc.NewChaos(seed, *chaosMax)
 	}
-}
-
-func runTest(testFile string) int {
-	// Create logger
-	testName := filepath.Base(testFile)
-	logger := logging.NewLogger(testName)
-
-	// Reset output before each test
-	logging.ResetOutput()
 
-	if !*quiet {
-		logger.Info("Running test: %s", testFile)
+	useColor, err := colorMode(*color)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		os.Exit(runner.ExitError)
 	}
 
-	// Create macro store with default macros
-	macros := vtc.NewMacroStore()
-	vtc.SetupDefaultMacros(macros, testFile)
-
-	// If just dumping AST, do that
-	if *dumpAST {
-		ast, err := vtc.ParseTestFile(testFile, logger, macros)
-		if err != nil {
-			logger.Error("Parse error: %v", err)
-			return exitError
-		}
-		vtc.DumpAST(ast, 0)
-		return exitPass
+	var summaryOut io.Writer
+	switch *summary {
+	case "":
+	case "json":
+		summaryOut = os.Stdout
+	default:
+		fmt.Fprintf(os.Stderr, "%s: invalid -summary %q (want json)\n", os.Args[0], *summary)
+		os.Exit(runner.ExitError)
 	}
 
-	// Run the test
-	timeout := time.Duration(*timeoutSec) * time.Second
-	code, err := vtc.RunTest(testFile, logger, macros, *keepTmp, timeout)
+	r := runner.New(runner.Options{
+		Verbose:       *verbose,
+		Verbosity:     verbosity,
+		BodyExcerpt:   *bodyExcerpt,
+		Quiet:         *quiet,
+		KeepTmp:       *keepTmp,
+		Jobs:          *jobs,
+		Timeout:       time.Duration(*timeoutSec) * time.Second,
+		DumpAST:       *dumpAST,
+		IgnoreUnknown: *ignoreUnknown,
+		Defines:       defines,
+		Progress:      isTerminal(os.Stdout),
+		Color:         useColor,
+		GroupLogs:     *groupLogs,
+		Summary:       summaryOut,
+		SummaryFile:   *summaryFile,
+		JUnit:         *junit,
+		FailuresLast:  *failuresLast,
+		MaxFailures:   *maxFailures,
+		ArtifactDir:   *artifactDir,
+		KeepProcesses: *keepProcs,
+		Tags:          vtc.SplitTags(*tags),
+		SkipTags:      vtc.SplitTags(*skipTags),
+		Chaos:         chaosOpts,
+		Strict:        *strict,
+	})
+
+	if *watch {
+		stop := make(chan struct{})
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sig
+			close(stop)
+		}()
+		if err := r.Watch(discover, *watchInterval, stop); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			os.Exit(runner.ExitError)
+		}
+		os.Exit(runner.ExitPass)
+	}
 
-	// Get log output
-	logOutput := logging.GetOutput()
+	os.Exit(r.Run(testFiles))
+}
 
-	// Handle different exit codes
-	switch code {
-	case exitPass:
-		if !*quiet {
-			fmt.Printf("✓ %s\n", testName)
-		}
-		// Print logs in verbose mode
-		if *verbose && logOutput != "" {
-			fmt.Print(logOutput)
-		}
-	case exitSkip:
-		if !*quiet {
-			fmt.Printf("⊘ %s (skipped)\n", testName)
-		}
-		if *verbose && logOutput != "" {
-			fmt.Print(logOutput)
-		}
-	case exitFail:
-		if err != nil {
-			logger.Error("Test failed: %v", err)
-			// Refresh log output after adding error
-			logOutput = logging.GetOutput()
-		}
-		if !*quiet {
-			fmt.Printf("✗ %s\n", testName)
-		}
-		// Always print logs on failure (unless quiet)
-		if !*quiet && logOutput != "" {
-			fmt.Print(logOutput)
-		}
-	case exitError:
-		if err != nil {
-			logger.Error("Test error: %v", err)
-			// Refresh log output after adding error
-			logOutput = logging.GetOutput()
-		}
-		if !*quiet {
-			fmt.Printf("✗ %s (error)\n", testName)
-		}
-		// Always print logs on error (unless quiet)
-		if !*quiet && logOutput != "" {
-			fmt.Print(logOutput)
-		}
+// colorMode decides whether to color the output for a -color value
+func colorMode(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		return isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == "", nil
 	}
-
-	return code
+	return false, fmt.Errorf("invalid -color %q (want auto, always or never)", mode)
 }
 
+// isTerminal reports whether f is a terminal, where the live progress line
+// of parallel runs can be redrawn in place
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestMacroDefs(t *testing.T) {
+	var defs macroDefs
+	fs := flag.NewFlagSet("gvtest", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var(&defs, "D", "")
+
+	err := fs.Parse([]string{"-D", "host=example.com", "-D", "query=a=b", "-D", "empty=", "test.vtc"})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := []string{"host=example.com", "query=a=b", "empty="}
+	if len(defs) != len(want) {
+		t.Fatalf("Got %q, want %q", defs, want)
+	}
+	for i := range want {
+		if defs[i] != want[i] {
+			t.Errorf("Definition %d: got %q, want %q", i, defs[i], want[i])
+		}
+	}
+	if fs.Arg(0) != "test.vtc" {
+		t.Errorf("Expected the test file to remain as an argument, got %q", fs.Args())
+	}
+
+	for _, bad := range []string{"novalue", "=value"} {
+		if err := defs.Set(bad); err == nil {
+			t.Errorf("Expected -D %q to be rejected", bad)
+		}
+	}
+}
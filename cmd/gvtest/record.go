@@ -0,0 +1,93 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/perbu/GTest/pkg/record"
+	"github.com/perbu/GTest/pkg/runner"
+)
+
+// runRecord implements "gvtest record": proxy traffic to a server and write
+// a skeleton test from what was seen
+func runRecord(args []string) int {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:0", "Address to accept client connections on")
+	upstream := fs.String("upstream", "", "Address of the server to forward to (required)")
+	output := fs.String("o", "", "Write the test to `file` instead of stdout")
+	count := fs.Int("n", 0, "Stop after `N` connections (0 = until interrupted)")
+	desc := fs.String("desc", "", "Test description (default: recorded from UPSTREAM)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s record -upstream HOST:PORT [options]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *upstream == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return runner.ExitError
+	}
+	if *desc == "" {
+		*desc = fmt.Sprintf("Recorded from %s on %s", *upstream, time.Now().Format("2006-01-02"))
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		return runner.ExitError
+	}
+	fmt.Fprintf(os.Stderr, "Recording on %s, forwarding to %s\n", ln.Addr(), *upstream)
+
+	// Stop listening on interrupt or after N connections; connections in
+	// flight are still recorded
+	var once sync.Once
+	stop := func() { once.Do(func() { ln.Close() }) }
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		stop()
+	}()
+
+	p := record.NewProxy(*upstream)
+	var mu sync.Mutex
+	done := 0
+	p.OnDone = func(c *record.Conn) {
+		fmt.Fprintf(os.Stderr, "%s: %d exchanges\n", c.Remote, len(c.Exchanges))
+		if c.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.Remote, c.Err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		if *count > 0 && done >= *count {
+			stop()
+		}
+	}
+	if err := p.Serve(ln); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		return runner.ExitError
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+			return runner.ExitError
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := record.WriteVTC(out, *desc, p.Connections()); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[0], err)
+		return runner.ExitError
+	}
+	return runner.ExitPass
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/tunnel"
+	"github.com/perbu/GTest/pkg/util"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// cmdTunnel implements the "tunnel" command
+func cmdTunnel(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*vtc.ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for tunnel command")
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("tunnel: missing tunnel name")
+	}
+
+	name := args[0]
+	args = args[1:]
+
+	// Validate tunnel name starts with 't'
+	if name[0] != 't' {
+		return fmt.Errorf("tunnel name must start with 't' (got %s)", name)
+	}
+
+	// Get or create tunnel
+	var t *tunnel.Tunnel
+	if existing, ok := ctx.Tunnels[name]; ok {
+		t = existing.(*tunnel.Tunnel)
+	} else {
+		t = tunnel.New(logger, ctx.Macros, name)
+		ctx.Tunnels[name] = t
+	}
+
+	// Convert child nodes to spec if present
+	if ctx.CurrentNode != nil && len(ctx.CurrentNode.Children) > 0 {
+		children, err := ctx.ExpandSpecs(ctx.CurrentNode.Children)
+		if err != nil {
+			return fmt.Errorf("tunnel %s: %w", name, err)
+		}
+		t.Spec = nodeToSpec(children)
+	}
+
+	// Parse command options
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		switch arg {
+		case "-listen", "-connect":
+			if i+1 >= len(args) {
+				return fmt.Errorf("tunnel: %s requires an argument", arg)
+			}
+			i++
+			addr, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("tunnel: %s macro expansion failed: %w", arg, err)
+			}
+			if arg == "-listen" {
+				t.Listen = addr
+			} else {
+				t.Connect = addr
+			}
+
+		case "-latency", "-rate":
+			if i+2 >= len(args) {
+				return fmt.Errorf("tunnel: %s requires a direction and a value", arg)
+			}
+			dir, err := parseDirection(args[i+1])
+			if err != nil {
+				return fmt.Errorf("tunnel: %s: %w", arg, err)
+			}
+			value := args[i+2]
+			i += 2
+			if arg == "-latency" {
+				d, err := time.ParseDuration(value)
+				if err != nil || d < 0 {
+					return fmt.Errorf("tunnel: invalid -latency %q", value)
+				}
+				t.Shaping[dir].Latency = d
+			} else {
+				rate, err := util.ParseSize(value)
+				if err != nil || rate == 0 {
+					return fmt.Errorf("tunnel: invalid -rate %q", value)
+				}
+				t.Shaping[dir].Rate = int64(rate)
+			}
+
+		case "-drop", "-dup", "-inject":
+			if i+3 >= len(args) {
+				return fmt.Errorf("tunnel: %s requires a direction, an offset and a value", arg)
+			}
+			dir, err := parseDirection(args[i+1])
+			if err != nil {
+				return fmt.Errorf("tunnel: %s: %w", arg, err)
+			}
+			offset, err := strconv.ParseInt(args[i+2], 10, 64)
+			if err != nil || offset < 0 {
+				return fmt.Errorf("tunnel: invalid %s offset %q", arg, args[i+2])
+			}
+			edit := tunnel.Edit{Offset: offset}
+			switch arg {
+			case "-inject":
+				edit.Kind = tunnel.Inject
+				edit.Data = util.Unescape(args[i+3])
+			default:
+				edit.Kind = tunnel.Drop
+				if arg == "-dup" {
+					edit.Kind = tunnel.Dup
+				}
+				edit.Len, err = strconv.ParseInt(args[i+3], 10, 64)
+				if err != nil || edit.Len < 1 {
+					return fmt.Errorf("tunnel: invalid %s length %q", arg, args[i+3])
+				}
+			}
+			i += 3
+			t.Shaping[dir].Edits = append(t.Shaping[dir].Edits, edit)
+
+		case "-start", "-start+pause":
+			if t.Connect == "" {
+				// VTest2 forwards to the first server by default
+				addr, err := ctx.Macros.Expand(logger, "${s1_sock}")
+				if err != nil {
+					return fmt.Errorf("tunnel: no -connect and no s1 to forward to")
+				}
+				t.Connect = addr
+			}
+			if err := t.Start(tunnelSpecFunc(ctx, t), arg == "-start+pause", ctx.Done()); err != nil {
+				return fmt.Errorf("tunnel: %s failed: %w", arg, err)
+			}
+
+		case "-wait":
+			if err := t.Wait(); err != nil {
+				return fmt.Errorf("tunnel %s: %w", name, err)
+			}
+
+		case "-break":
+			t.Break()
+			if err := t.Wait(); err != nil {
+				logger.Log(3, "%s ended with: %v", name, err)
+			}
+
+		case "-pause":
+			if err := t.Pause(); err != nil {
+				return fmt.Errorf("tunnel: %w", err)
+			}
+
+		case "-resume":
+			if err := t.Resume(); err != nil {
+				return fmt.Errorf("tunnel: %w", err)
+			}
+
+		default:
+			if arg[0] == '-' {
+				return fmt.Errorf("tunnel: unknown option: %s", arg)
+			}
+			// This is the spec (command script)
+			t.Spec = arg
+		}
+	}
+
+	return nil
+}
+
+// parseDirection parses the direction of a shaping option: send for the
+// bytes to the server, recv for those to the client
+func parseDirection(s string) (tunnel.Direction, error) {
+	switch s {
+	case "send":
+		return tunnel.Send, nil
+	case "recv":
+		return tunnel.Recv, nil
+	}
+	return 0, fmt.Errorf("direction must be send or recv, got %q", s)
+}
+
+// tunnelSpecFunc runs the tunnel spec: pause, resume, send N and recv N,
+// and global commands such as barrier and delay
+func tunnelSpecFunc(ctx *vtc.ExecContext, t *tunnel.Tunnel) tunnel.SpecFunc {
+	spec := t.Spec
+	return func() error {
+		for _, line := range strings.Split(spec, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			expanded, err := ctx.Macros.Expand(t.Logger, line)
+			if err != nil {
+				return fmt.Errorf("command '%s' failed: %w", line, err)
+			}
+			tokens, err := util.SplitArgs(expanded)
+			if err != nil || len(tokens) == 0 {
+				return fmt.Errorf("command '%s' failed: cannot parse", line)
+			}
+			if err := tunnelCommand(ctx, t, tokens[0], tokens[1:]); err != nil {
+				return fmt.Errorf("command '%s' failed: %w", line, err)
+			}
+		}
+		return nil
+	}
+}
+
+// tunnelCommand runs one command of a tunnel spec
+func tunnelCommand(ctx *vtc.ExecContext, t *tunnel.Tunnel, cmd string, args []string) error {
+	switch cmd {
+	case "pause":
+		return t.Pause()
+	case "resume":
+		return t.Resume()
+	case "send", "recv":
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires a byte count", cmd)
+		}
+		n, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid byte count %q", args[0])
+		}
+		dir := tunnel.Send
+		if cmd == "recv" {
+			dir = tunnel.Recv
+		}
+		return t.Forward(dir, n)
+	default:
+		if _, ok := vtc.GetCommand(cmd); !ok {
+			if vtc.SkipUnknownCommand(ctx, cmd) {
+				return nil
+			}
+			return fmt.Errorf("unknown tunnel command: %s", cmd)
+		}
+		return vtc.ExecuteCommand(cmd, args, ctx, t.Logger)
+	}
+}
@@ -3,6 +3,10 @@ module github.com/perbu/GTest
 go 1.24.7
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/creack/pty v1.1.21
 	github.com/hinshun/vt10x v0.0.0-20220301184237-5011da428d02
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
 )
@@ -60,6 +60,16 @@ func (b *Barrier) Wait() error {
 
 // WaitTimeout waits with a specific timeout
 func (b *Barrier) WaitTimeout(timeout time.Duration) error {
+	return b.wait(timeout, nil)
+}
+
+// WaitAbortable is Wait, giving up when abort is closed
+func (b *Barrier) WaitAbortable(abort <-chan struct{}) error {
+	return b.wait(b.Timeout, abort)
+}
+
+// wait waits until the barrier releases, timeout passes or abort is closed
+func (b *Barrier) wait(timeout time.Duration, abort <-chan struct{}) error {
 	b.mutex.Lock()
 	cycle := b.cycle
 
@@ -94,10 +104,21 @@ func (b *Barrier) WaitTimeout(timeout time.Duration) error {
 	case <-done:
 		return nil
 	case <-time.After(timeout):
-		b.mutex.Lock()
-		b.current-- // Remove ourselves from the count
-		b.mutex.Unlock()
+		b.leave(cycle)
 		return fmt.Errorf("barrier %s: timeout after %v", b.Name, timeout)
+	case <-abort:
+		b.leave(cycle)
+		return fmt.Errorf("barrier %s: aborted", b.Name)
+	}
+}
+
+// leave removes a waiter that gave up from the count, unless the barrier
+// released in the meantime
+func (b *Barrier) leave(cycle int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cycle == cycle {
+		b.current--
 	}
 }
 
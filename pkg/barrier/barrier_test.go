@@ -100,6 +100,31 @@ func TestBarrier_Timeout(t *testing.T) {
 	}
 }
 
+func TestBarrier_WaitAbortable(t *testing.T) {
+	logger := logging.NewLogger("test")
+	b := New("b1", logger)
+
+	if err := b.Start(2); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	abort := make(chan struct{})
+	time.AfterFunc(50*time.Millisecond, func() { close(abort) })
+	if err := b.WaitAbortable(abort); err == nil {
+		t.Fatal("Expected abort error, got nil")
+	}
+
+	// The aborted waiter no longer counts towards the barrier
+	errs := make(chan error, 1)
+	go func() { errs <- b.WaitTimeout(time.Second) }()
+	if err := b.WaitTimeout(time.Second); err != nil {
+		t.Errorf("Wait failed: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("Wait failed: %v", err)
+	}
+}
+
 func TestBarrier_Sync(t *testing.T) {
 	logger := logging.NewLogger("test")
 	b := New("b1", logger)
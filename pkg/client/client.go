@@ -3,12 +3,14 @@
 package client
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/macro"
 	gnet "github.com/perbu/GTest/pkg/net"
 	"github.com/perbu/GTest/pkg/session"
 )
@@ -35,21 +37,33 @@ type Client struct {
 	Session      *session.Session
 	Spec         string
 	ConnectAddr  string
+	BindAddr     string          // Local address for the connection (-bind)
+	Interface    string          // Take the local address from this interface (-interface)
+	Via          *Via            // Reach ConnectAddr through this proxy (-via)
+	DialPolicy   gnet.DialPolicy // Address selection for multi-address names
 	ProxySpec    string
 	ProxyVersion ProxyVersion
+	TLS          *gnet.TLSOptions // Speak TLS on the connection (-tls)
+	Macros       *macro.Store     // Gets ${NAME_tls_*} after each handshake, if set
 	Running      bool
+	ConnectTime  time.Duration // How long the last Connect took
 
 	// Internal
 	stopChan chan struct{}
 	wg       sync.WaitGroup
 	mutex    sync.Mutex
 	thread   *time.Timer
+	conns    int    // Connections established
+	last     string // Summary of the last exchange, for dump
+	stats    map[net.Conn]*session.ConnStats
 }
 
 // New creates a new client with the given name
 func New(logger *logging.Logger, name string) *Client {
-	sessLogger := logging.NewLogger(name)
-	sess := session.New(sessLogger, name)
+	// The client logs under its own name, with the test's levels and
+	// fatal handling
+	logger = logger.Child(name)
+	sess := session.New(logger, name)
 
 	return &Client{
 		Name:         name,
@@ -69,6 +83,58 @@ func (c *Client) SetConnect(addr string) {
 	c.ConnectAddr = addr
 }
 
+// SetBind sets the local address and interface used for connecting
+func (c *Client) SetBind(addr, iface string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.BindAddr = addr
+	c.Interface = iface
+}
+
+// localAddr returns the address to bind outgoing connections to
+func (c *Client) localAddr() (string, error) {
+	if c.Interface == "" {
+		return c.BindAddr, nil
+	}
+
+	ip, err := gnet.InterfaceAddr(c.Interface)
+	if err != nil {
+		return "", err
+	}
+	host, port, _, err := gnet.ParseAddress(c.BindAddr)
+	if err != nil {
+		return "", err
+	}
+	if host != "" {
+		return "", fmt.Errorf("-bind %s conflicts with -interface %s: use -bind :PORT", c.BindAddr, c.Interface)
+	}
+	if port == "" {
+		port = "0"
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
+// SetDialPolicy sets how names resolving to several addresses are connected
+func (c *Client) SetDialPolicy(policy gnet.DialPolicy) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.DialPolicy = policy
+}
+
+// SetVia routes connections through an intermediary proxy
+func (c *Client) SetVia(via *Via) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Via = via
+}
+
+// SetTLS makes the client speak TLS, or plain TCP if opts is nil
+func (c *Client) SetTLS(opts *gnet.TLSOptions) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.TLS = opts
+}
+
 // SetProxy sets the PROXY protocol configuration
 func (c *Client) SetProxy(version ProxyVersion, spec string) {
 	c.mutex.Lock()
@@ -89,14 +155,40 @@ func (c *Client) Connect() (net.Conn, error) {
 	c.Logger.Log(3, "Connect to %s", c.ConnectAddr)
 	c.Logger.Debug("Attempting to connect to %s with 10s timeout", c.ConnectAddr)
 
+	localAddr, err := c.localAddr()
+	if err != nil {
+		return nil, err
+	}
+	if localAddr != "" {
+		c.Logger.Log(3, "Binding to %s", localAddr)
+	}
+
 	// Establish connection with timeout
-	conn, err := gnet.TCPConnect(c.ConnectAddr, 10*time.Second)
+	start := time.Now()
+	dialAddr := c.ConnectAddr
+	if c.Via != nil {
+		if gnet.IsUnixSocket(c.ConnectAddr) {
+			return nil, fmt.Errorf("-via cannot reach Unix socket %s", c.ConnectAddr)
+		}
+		dialAddr = c.Via.Addr
+	}
+	conn, err := gnet.TCPConnectPolicy(dialAddr, localAddr, c.DialPolicy, 10*time.Second)
 	if err != nil {
-		c.Logger.Debug("Connection failed to %s: %v", c.ConnectAddr, err)
-		return nil, fmt.Errorf("failed to connect to %s: %w", c.ConnectAddr, err)
+		c.Logger.Debug("Connection failed to %s: %v", dialAddr, err)
+		return nil, fmt.Errorf("failed to connect to %s: %w", dialAddr, err)
 	}
 
-	c.Logger.Log(3, "connected fd to %s", c.ConnectAddr)
+	if c.Via != nil {
+		c.Logger.Log(3, "Tunneling to %s via %s://%s", c.ConnectAddr, c.Via.Scheme, c.Via.Addr)
+		tunneled, err := c.Via.Handshake(conn, c.ConnectAddr, 10*time.Second)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tunneled
+	}
+
+	c.Logger.Log(3, "connected fd to %s (%s)", c.ConnectAddr, conn.RemoteAddr())
 	c.Logger.Debug("Successfully connected to %s", c.ConnectAddr)
 
 	// Send PROXY protocol header if configured
@@ -110,10 +202,65 @@ func (c *Client) Connect() (net.Conn, error) {
 		}
 	}
 
+	if c.TLS != nil {
+		tlsConn, err := gnet.TLSClient(conn, c.TLS, 10*time.Second)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		state := tlsConn.ConnectionState()
+		c.Logger.Log(3, "TLS handshake done: %s, %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		if c.Macros != nil {
+			for name, value := range gnet.MacroValues(&state) {
+				c.Macros.DefineIn(c.Name, name, value)
+			}
+		}
+		conn = tlsConn
+	}
+
+	c.ConnectTime = time.Since(start)
+	c.mutex.Lock()
+	c.conns++
+	if c.stats == nil {
+		c.stats = make(map[net.Conn]*session.ConnStats)
+	}
+	c.stats[conn] = &session.ConnStats{Seq: c.conns}
+	c.mutex.Unlock()
 	c.Logger.Debug("Connect completed successfully for client %s", c.Name)
 	return conn, nil
 }
 
+// Connections returns the number of connections established so far
+func (c *Client) Connections() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.conns
+}
+
+// ConnStats returns the stats of an open connection made by Connect
+func (c *Client) ConnStats(conn net.Conn) *session.ConnStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if stats, ok := c.stats[conn]; ok {
+		return stats
+	}
+	return &session.ConnStats{Seq: c.conns}
+}
+
+// SetLast records a summary of the last exchange
+func (c *Client) SetLast(summary string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.last = summary
+}
+
+// Last returns the summary recorded by SetLast
+func (c *Client) Last() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last
+}
+
 // sendProxyHeader sends the PROXY protocol header
 // TODO: Implement full PROXY protocol support in Phase 3
 func (c *Client) sendProxyHeader(conn net.Conn) error {
@@ -130,6 +277,7 @@ func (c *Client) Start(processFunc ProcessFunc) error {
 		return fmt.Errorf("client %s already running", c.Name)
 	}
 	c.Running = true
+	c.stopChan = make(chan struct{})
 	c.mutex.Unlock()
 
 	c.Logger.Log(2, "Starting client %s", c.Name)
@@ -153,13 +301,16 @@ func (c *Client) Run(processFunc ProcessFunc) error {
 	disconnectFunc := func(conn net.Conn) error {
 		c.Logger.Log(3, "closing connection")
 		c.Logger.Debug("Session disconnectFunc closing connection")
+		c.mutex.Lock()
+		delete(c.stats, conn)
+		c.mutex.Unlock()
 		return conn.Close()
 	}
 
 	procFunc := func(conn net.Conn, spec string) (net.Conn, error) {
 		if processFunc != nil {
 			c.Logger.Debug("Session procFunc calling processFunc")
-			err := processFunc(conn, spec)
+			err := c.process(processFunc, conn, spec)
 			if err != nil {
 				c.Logger.Debug("Session processFunc returned error: %v", err)
 			} else {
@@ -181,6 +332,18 @@ func (c *Client) Run(processFunc ProcessFunc) error {
 	return nil
 }
 
+// process runs processFunc. A panic in it is reported as fatal, which
+// fails the test, instead of taking down the whole run.
+func (c *Client) process(processFunc ProcessFunc, conn net.Conn, spec string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("client %s: panic: %v", c.Name, r)
+			c.Logger.Fatal("%v", err)
+		}
+	}()
+	return processFunc(conn, spec)
+}
+
 // run executes the client in a goroutine
 func (c *Client) run(processFunc ProcessFunc) {
 	defer c.wg.Done()
@@ -196,6 +359,14 @@ func (c *Client) run(processFunc ProcessFunc) {
 	}
 }
 
+// IsRunning reports whether the client has been started and not yet
+// finished
+func (c *Client) IsRunning() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.Running
+}
+
 // Wait waits for the client to complete
 func (c *Client) Wait() {
 	c.wg.Wait()
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// startEcho starts a TCP server that echoes one line back
+func startEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				io.WriteString(conn, line)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startProxy starts a one-shot proxy that runs handshake on the accepted
+// connection and then splices it to the target it returns
+func startProxy(t *testing.T, handshake func(conn net.Conn) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		target := handshake(conn)
+		if target == "" {
+			return
+		}
+		upstream, err := net.Dial("tcp", target)
+		if err != nil {
+			return
+		}
+		defer upstream.Close()
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+	}()
+	return ln.Addr().String()
+}
+
+func roundTrip(t *testing.T, c *Client) {
+	conn, err := c.Connect()
+	if err != nil {
+		t.Fatalf("Connect() failed: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "ping\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("Expected echo through proxy, got %q (%v)", line, err)
+	}
+}
+
+func TestVia_SOCKS5(t *testing.T) {
+	target := startEcho(t)
+	proxy := startProxy(t, func(conn net.Conn) string {
+		buf := make([]byte, 512)
+		io.ReadFull(conn, buf[:3]) // version, 1 method, user/pass
+		conn.Write([]byte{0x05, 0x02})
+
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != "alice" || string(pass) != "secret" {
+			conn.Write([]byte{0x01, 0x01})
+			return ""
+		}
+		conn.Write([]byte{0x01, 0x00})
+
+		io.ReadFull(conn, buf[:4]) // ver, cmd, rsv, atyp=IPv4
+		io.ReadFull(conn, buf[:6])
+		ip := net.IP(buf[:4]).String()
+		port := int(buf[4])<<8 | int(buf[5])
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return net.JoinHostPort(ip, strconv.Itoa(port))
+	})
+
+	c := New(logging.NewLogger("test"), "c1")
+	c.SetConnect(target)
+	via, err := ParseVia("socks5://alice:secret@" + proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetVia(via)
+	roundTrip(t, c)
+}
+
+func TestVia_HTTPConnect(t *testing.T) {
+	target := startEcho(t)
+	proxy := startProxy(t, func(conn net.Conn) string {
+		br := bufio.NewReader(conn)
+		line, _ := br.ReadString('\n')
+		var auth string
+		for {
+			hdr, _ := br.ReadString('\n')
+			if strings.TrimSpace(hdr) == "" {
+				break
+			}
+			if strings.HasPrefix(hdr, "Proxy-Authorization:") {
+				auth = strings.TrimSpace(strings.TrimPrefix(hdr, "Proxy-Authorization:"))
+			}
+		}
+		if auth != "Basic Ym9iOnB3" {
+			io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return ""
+		}
+		io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return strings.Fields(line)[1]
+	})
+
+	c := New(logging.NewLogger("test"), "c1")
+	c.SetConnect(target)
+	via, err := ParseVia("http://bob:pw@" + proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetVia(via)
+	roundTrip(t, c)
+
+	if _, err := ParseVia("ftp://" + proxy); err == nil {
+		t.Error("Expected error for unsupported scheme")
+	}
+}
@@ -2,13 +2,52 @@ package hpack
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
+// Decoding errors, wrapped with the details by Decode. In HTTP/2 each of
+// them is a connection error of type COMPRESSION_ERROR.
+var (
+	ErrIndexOutOfRange = errors.New("index out of range")
+	ErrIntegerOverflow = errors.New("integer overflow")
+	ErrHuffman         = errors.New("invalid Huffman code or padding")
+	ErrHeaderListSize  = errors.New("header list size exceeded")
+	ErrTruncated       = errors.New("truncated header block")
+)
+
+// errorNames are the short names ErrorName gives the decoding errors
+var errorNames = []struct {
+	err  error
+	name string
+}{
+	{ErrIndexOutOfRange, "index"},
+	{ErrIntegerOverflow, "integer"},
+	{ErrHuffman, "huffman"},
+	{ErrHeaderListSize, "listsize"},
+	{ErrTruncated, "truncated"},
+}
+
+// ErrorName returns a short name for the decoding error err wraps ("index",
+// "integer", "huffman", "listsize" or "truncated"), or "" if none
+func ErrorName(err error) string {
+	for _, e := range errorNames {
+		if errors.Is(err, e.err) {
+			return e.name
+		}
+	}
+	return ""
+}
+
 // Decoder decodes HPACK-encoded header blocks
 type Decoder struct {
 	table *Table
+
+	// Largest header list accepted (SETTINGS_MAX_HEADER_LIST_SIZE), as
+	// the sum of the field sizes; 0 for no limit
+	maxHeaderListSize uint32
 }
 
 // NewDecoder creates a new HPACK decoder
@@ -22,6 +61,7 @@ func NewDecoder(maxDynamicTableSize uint32) *Decoder {
 func (d *Decoder) Decode(data []byte) ([]HeaderField, error) {
 	buf := bytes.NewReader(data)
 	var headers []HeaderField
+	var listSize uint64
 
 	for buf.Len() > 0 {
 		b, err := buf.ReadByte()
@@ -48,8 +88,9 @@ func (d *Decoder) Decode(data []byte) ([]HeaderField, error) {
 
 		case b&0x20 != 0:
 			// Dynamic Table Size Update (001xxxxx)
-			err = d.decodeDynamicTableSizeUpdate(buf)
-			continue
+			if err = d.decodeDynamicTableSizeUpdate(buf); err == nil {
+				continue
+			}
 
 		case b&0x10 != 0:
 			// Literal Never Indexed (0001xxxx)
@@ -60,10 +101,17 @@ func (d *Decoder) Decode(data []byte) ([]HeaderField, error) {
 			hf, err = d.decodeLiteralWithoutIndexing(buf)
 		}
 
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrTruncated
+		}
 		if err != nil {
 			return nil, err
 		}
 
+		listSize += uint64(hf.Size())
+		if d.maxHeaderListSize > 0 && listSize > uint64(d.maxHeaderListSize) {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrHeaderListSize, d.maxHeaderListSize)
+		}
 		headers = append(headers, hf)
 	}
 
@@ -77,10 +125,6 @@ func (d *Decoder) decodeIndexed(buf *bytes.Reader) (HeaderField, error) {
 		return HeaderField{}, err
 	}
 
-	if index == 0 {
-		return HeaderField{}, fmt.Errorf("invalid index: 0")
-	}
-
 	hf, err := d.table.Lookup(int(index))
 	if err != nil {
 		return HeaderField{}, err
@@ -196,7 +240,8 @@ func (d *Decoder) decodeDynamicTableSizeUpdate(buf *bytes.Reader) error {
 	return nil
 }
 
-// decodeInteger decodes an integer with N-bit prefix as per RFC 7541 Section 5.1
+// decodeInteger decodes an integer with N-bit prefix as per RFC 7541 Section 5.1.
+// No HPACK integer needs more than 32 bits; larger ones are overflows.
 func decodeInteger(buf *bytes.Reader, n uint) (uint64, error) {
 	if n < 1 || n > 8 {
 		return 0, fmt.Errorf("invalid prefix length: %d", n)
@@ -225,13 +270,16 @@ func decodeInteger(buf *bytes.Reader, n uint) (uint64, error) {
 
 		value += uint64(b&0x7f) << m
 		m += 7
+		if value > math.MaxUint32 {
+			return 0, fmt.Errorf("%w: value above 2^32-1", ErrIntegerOverflow)
+		}
 
 		if b&0x80 == 0 {
 			break
 		}
 
-		if m > 63 {
-			return 0, fmt.Errorf("integer overflow")
+		if m >= 35 {
+			return 0, fmt.Errorf("%w: more than 5 continuation bytes", ErrIntegerOverflow)
 		}
 	}
 
@@ -253,19 +301,16 @@ func decodeString(buf *bytes.Reader) (string, error) {
 		return "", err
 	}
 
+	if length > uint64(buf.Len()) {
+		return "", fmt.Errorf("%w: string of %d bytes with %d left", ErrTruncated, length, buf.Len())
+	}
 	data := make([]byte, length)
-	n, err := io.ReadFull(buf, data)
-	if err != nil {
+	if _, err := io.ReadFull(buf, data); err != nil {
 		return "", err
 	}
-	if uint64(n) != length {
-		return "", fmt.Errorf("incomplete string: expected %d bytes, got %d", length, n)
-	}
 
 	if huffman {
-		// Huffman decoding not implemented yet - just return raw
-		// For now, treat as literal
-		return string(data), nil
+		return huffmanDecode(data)
 	}
 
 	return string(data), nil
@@ -275,3 +320,15 @@ func decodeString(buf *bytes.Reader) (string, error) {
 func (d *Decoder) SetMaxDynamicTableSize(size uint32) {
 	d.table.SetMaxDynamicSize(size)
 }
+
+// Reset empties the dynamic table, for a peer that reset its encoder
+// without telling
+func (d *Decoder) Reset() {
+	d.table.Reset()
+}
+
+// SetMaxHeaderListSize sets the largest header list Decode accepts (0 for
+// no limit)
+func (d *Decoder) SetMaxHeaderListSize(size uint32) {
+	d.maxHeaderListSize = size
+}
@@ -0,0 +1,66 @@
+package hpack
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestDecode_Huffman(t *testing.T) {
+	// RFC 7541 C.4.1
+	block, _ := hex.DecodeString("828684418cf1e3c2e5f23a6ba0ab90f4ff")
+	headers, err := NewDecoder(4096).Decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 4 || headers[3].Name != ":authority" || headers[3].Value != "www.example.com" {
+		t.Errorf("Decoded %v", headers)
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		block string
+		want  error
+	}{
+		{"index zero", "80", ErrIndexOutOfRange},
+		{"index beyond tables", "be", ErrIndexOutOfRange},
+		{"integer overflow", "ffffffffff7f", ErrIntegerOverflow},
+		{"too many continuation bytes", "ff8080808080", ErrIntegerOverflow},
+		// Literal without indexing, name "a", then the value
+		{"long Huffman padding", "000161821fff", ErrHuffman},   // "a" and 11 bits of padding
+		{"Huffman padding not ones", "000161811a", ErrHuffman}, // "a" and padding 010
+		{"Huffman EOS", "00016184ffffffff", ErrHuffman},
+		{"truncated string", "0001610561", ErrTruncated},
+		{"truncated integer", "ff", ErrTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := hex.DecodeString(tt.block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewDecoder(4096).Decode(block)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Decode error %v, want %v", err, tt.want)
+			}
+			if ErrorName(err) == "" {
+				t.Errorf("No name for %v", err)
+			}
+		})
+	}
+}
+
+func TestDecode_HeaderListSize(t *testing.T) {
+	// :method GET and :path / are 42 and 38 bytes
+	d := NewDecoder(4096)
+	d.SetMaxHeaderListSize(79)
+	if _, err := d.Decode([]byte{0x82, 0x84}); !errors.Is(err, ErrHeaderListSize) {
+		t.Errorf("Decode error %v, want %v", err, ErrHeaderListSize)
+	}
+	d.SetMaxHeaderListSize(80)
+	if _, err := d.Decode([]byte{0x82, 0x84}); err != nil {
+		t.Error(err)
+	}
+}
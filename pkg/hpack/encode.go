@@ -9,6 +9,10 @@ import (
 type Encoder struct {
 	table *Table
 	buf   bytes.Buffer
+
+	// Start the next header block with size updates that empty the
+	// peer's dynamic table, after Reset
+	resetPending bool
 }
 
 // NewEncoder creates a new HPACK encoder
@@ -21,6 +25,7 @@ func NewEncoder(maxDynamicTableSize uint32) *Encoder {
 // Encode encodes a list of header fields into HPACK format
 func (e *Encoder) Encode(headers []HeaderField) ([]byte, error) {
 	e.buf.Reset()
+	e.writePendingReset()
 
 	for _, hf := range headers {
 		if err := e.encodeField(hf); err != nil {
@@ -125,6 +130,33 @@ func (e *Encoder) SetMaxDynamicTableSize(size uint32) error {
 	return nil
 }
 
+// Reset empties the dynamic table. The next header block starts with a
+// dynamic table size update to 0 and one back to the maximum, so the
+// peer's decoder empties its table too (RFC 7541 section 4.2).
+func (e *Encoder) Reset() {
+	e.table.Reset()
+	e.resetPending = true
+}
+
+// writePendingReset writes the size updates a Reset asked for
+func (e *Encoder) writePendingReset() {
+	if !e.resetPending {
+		return
+	}
+	e.resetPending = false
+	encodeInteger(&e.buf, 5, 0x20, 0)
+	encodeInteger(&e.buf, 5, 0x20, uint64(e.table.dynamic.maxSize))
+}
+
+// Observe takes a header block the encoder did not produce (e.g. one sent
+// as raw bytes) into its dynamic table, as the peer's decoder will, so the
+// blocks it encodes next still match the peer's table
+func (e *Encoder) Observe(block []byte) error {
+	d := &Decoder{table: e.table}
+	_, err := d.Decode(block)
+	return err
+}
+
 // GetTable returns the encoder's table for lookups
 func (e *Encoder) GetTable() *Table {
 	return e.table
@@ -201,6 +233,7 @@ type HpackInstruction struct {
 // EncodeExplicit encodes header fields using explicit HPACK instructions
 func (e *Encoder) EncodeExplicit(instructions []HpackInstruction) ([]byte, error) {
 	e.buf.Reset()
+	e.writePendingReset()
 
 	for _, inst := range instructions {
 		var err error
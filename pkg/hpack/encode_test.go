@@ -0,0 +1,44 @@
+package hpack
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncoder_Observe(t *testing.T) {
+	e := NewEncoder(4096)
+	// Literal with incremental indexing, new name: x-a: 1
+	if err := e.Observe([]byte{0x40, 3, 'x', '-', 'a', 1, '1'}); err != nil {
+		t.Fatal(err)
+	}
+	block, err := e.Encode([]HeaderField{{Name: "x-a", Value: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(block, []byte{0xbe}) {
+		t.Errorf("Encoded %x, want be (dynamic index 62)", block)
+	}
+}
+
+func TestEncoder_Reset(t *testing.T) {
+	e := NewEncoder(4096)
+	d := NewDecoder(4096)
+	block, _ := e.Encode([]HeaderField{{Name: "x-a", Value: "1"}})
+	if _, err := d.Decode(block); err != nil {
+		t.Fatal(err)
+	}
+
+	e.Reset()
+	block, _ = e.Encode([]HeaderField{{Name: "x-b", Value: "2"}})
+	if !bytes.HasPrefix(block, []byte{0x20, 0x3f, 0xe1, 0x1f}) {
+		t.Errorf("Block %x does not start with size updates to 0 and 4096", block)
+	}
+	headers, err := d.Decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || d.table.DynamicTableLen() != 1 || e.table.DynamicTableLen() != 1 {
+		t.Errorf("After reset: %v, decoder table %d entries, encoder table %d",
+			headers, d.table.DynamicTableLen(), e.table.DynamicTableLen())
+	}
+}
@@ -0,0 +1,30 @@
+package hpack
+
+import (
+	"testing"
+)
+
+// FuzzHpackDecode checks that no header block makes the decoder panic.
+// Each input is decoded twice by the same decoder, so that the second
+// pass runs against the dynamic table the first one built.
+func FuzzHpackDecode(f *testing.F) {
+	block, err := NewEncoder(4096).Encode([]HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/index.html"},
+		{Name: "custom-key", Value: "custom-value"},
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(block, uint16(4096))
+	// Table size update, then an indexed field
+	f.Add([]byte{0x3f, 0xe1, 0x1f, 0x82}, uint16(0))
+	// RFC 7541 C.4.1
+	f.Add([]byte{0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff}, uint16(256))
+
+	f.Fuzz(func(t *testing.T, data []byte, tableSize uint16) {
+		d := NewDecoder(uint32(tableSize))
+		d.Decode(data)
+		d.Decode(data)
+	})
+}
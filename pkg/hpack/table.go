@@ -175,7 +175,7 @@ func NewTable(maxDynamicSize uint32) *Table {
 // Indices 1-61 are static table, 62+ are dynamic table
 func (t *Table) Lookup(index int) (HeaderField, error) {
 	if index < 1 {
-		return HeaderField{}, fmt.Errorf("invalid index: %d (must be >= 1)", index)
+		return HeaderField{}, fmt.Errorf("%w: %d (must be >= 1)", ErrIndexOutOfRange, index)
 	}
 
 	if index <= staticTableSize {
@@ -188,7 +188,7 @@ func (t *Table) Lookup(index int) (HeaderField, error) {
 		return hf, nil
 	}
 
-	return HeaderField{}, fmt.Errorf("index %d not found in dynamic table", index)
+	return HeaderField{}, fmt.Errorf("%w: %d not in the static or dynamic table", ErrIndexOutOfRange, index)
 }
 
 // Search looks for a header field in both tables
@@ -224,6 +224,12 @@ func (t *Table) Add(hf HeaderField) {
 	t.dynamic.Add(hf)
 }
 
+// Reset empties the dynamic table, keeping its maximum size
+func (t *Table) Reset() {
+	t.dynamic.entries = t.dynamic.entries[:0]
+	t.dynamic.size = 0
+}
+
 // SetMaxDynamicSize updates the maximum dynamic table size
 func (t *Table) SetMaxDynamicSize(maxSize uint32) {
 	t.dynamic.SetMaxSize(maxSize)
@@ -1,10 +1,19 @@
 package http1
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"os"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/perbu/GTest/pkg/session"
 )
 
 // Send sends raw bytes to the connection
@@ -34,9 +43,114 @@ func (h *HTTP) SendHex(hexStr string) error {
 	return h.Write(data)
 }
 
+// SendFile streams the contents of a file to the connection
+func (h *HTTP) SendFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("sendfrom: %w", err)
+	}
+	defer f.Close()
+
+	if h.SegmentSize > 0 {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return fmt.Errorf("sendfrom: %w", err)
+		}
+		return h.writeMessage([][]byte{data}, nil)
+	}
+
+	if h.Timeout > 0 {
+		h.Conn.SetWriteDeadline(time.Now().Add(h.Timeout))
+	}
+
+	n, err := io.Copy(h.Conn, f)
+	if err != nil {
+		return fmt.Errorf("sendfrom: write failed after %d bytes: %w", n, err)
+	}
+
+	h.Logger.Log(4, "Sent %d bytes from %s", n, filename)
+	return nil
+}
+
 // Recv receives a specified number of bytes from the connection
 func (h *HTTP) Recv(n int) ([]byte, error) {
-	return h.ReadBytes(n)
+	data, err := h.ReadBytes(n)
+	if err != nil {
+		return nil, err
+	}
+	h.Received = data
+	return data, nil
+}
+
+// RecvUntil receives bytes until the data ends with pattern. If max is
+// positive, failing to see the pattern within max bytes is an error.
+func (h *HTTP) RecvUntil(pattern string, max int) ([]byte, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("recv: empty -until pattern")
+	}
+	if h.Timeout > 0 {
+		h.Conn.SetReadDeadline(time.Now().Add(h.Timeout))
+	}
+
+	var data []byte
+	for !bytes.HasSuffix(data, []byte(pattern)) {
+		if max > 0 && len(data) >= max {
+			h.Received = data
+			return nil, fmt.Errorf("recv: %q not found in %d bytes", pattern, max)
+		}
+		b, err := h.RxBuf.ReadByte()
+		if err != nil {
+			h.Received = data
+			return nil, fmt.Errorf("recv: waiting for %q after %d bytes: %w", pattern, len(data), err)
+		}
+		data = append(data, b)
+	}
+
+	h.Logger.Log(4, "Received %d bytes up to %q", len(data), pattern)
+	h.Received = data
+	return data, nil
+}
+
+// WriteBody writes the current body to a file, truncating it unless
+// appendMode is set
+func (h *HTTP) WriteBody(filename string, appendMode bool) error {
+	flags := os.O_CREATE | os.O_WRONLY
+	if appendMode {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("write_body: %w", err)
+	}
+	if err := h.copyBodyTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("write_body: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write_body: %w", err)
+	}
+
+	h.Logger.Log(3, "write_body: wrote %d bytes to %s", h.BodyLen, filename)
+	return nil
+}
+
+// copyBodyTo writes the current body to w, from its file if it was
+// spooled to disk
+func (h *HTTP) copyBodyTo(w io.Writer) error {
+	if h.BodyFile == "" {
+		_, err := w.Write(h.Body)
+		return err
+	}
+	f, err := os.Open(h.BodyFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
 
 // SetIOTimeout sets the I/O timeout for subsequent operations
@@ -46,6 +160,9 @@ func (h *HTTP) SetIOTimeout(d time.Duration) {
 
 // Gunzip decompresses the body in place
 func (h *HTTP) Gunzip() error {
+	if h.BodyFile != "" {
+		return fmt.Errorf("gunzip: the body of %d bytes was spooled to disk", h.BodyLen)
+	}
 	if len(h.Body) == 0 {
 		return nil
 	}
@@ -60,3 +177,36 @@ func (h *HTTP) Gunzip() error {
 	h.Logger.Log(3, "gunzip: decompressed to %d bytes", h.BodyLen)
 	return nil
 }
+
+// ExpectClose waits for the peer to close the connection. Any data
+// received before EOF, or the timeout expiring, is an error.
+func (h *HTTP) ExpectClose() error {
+	if h.Timeout > 0 {
+		h.Conn.SetReadDeadline(time.Now().Add(h.Timeout))
+	}
+
+	buf := make([]byte, 1)
+	n, err := h.RxBuf.Read(buf)
+	if n > 0 {
+		return fmt.Errorf("expect_close: received data instead of close: %q", buf[:n])
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+		h.Logger.Log(3, "expect_close: connection closed by peer")
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("expect_close: connection still open after %v", h.Timeout)
+	}
+	return fmt.Errorf("expect_close: %w", err)
+}
+
+// SetConn replaces the connection, discarding any buffered input, and
+// starts new connection stats
+func (h *HTTP) SetConn(conn net.Conn) {
+	h.Conn = conn
+	h.RxBuf = bufio.NewReader(conn)
+	h.lastExch = false
+	h.closed = false
+	h.Stats = &session.ConnStats{Seq: h.Stats.Seq + 1}
+}
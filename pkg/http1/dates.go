@@ -0,0 +1,44 @@
+package http1
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/perbu/GTest/pkg/util"
+)
+
+// now returns the current time of the test clock
+func (h *HTTP) now() time.Time {
+	if h.Clock != nil {
+		return h.Clock()
+	}
+	return time.Now()
+}
+
+// addCacheHeaders sets Date, Age and Expires from the test clock.
+// Explicit -hdr values win over generated ones.
+func (h *HTTP) addCacheHeaders(opts *TxRespOptions) {
+	if opts.DateOffset == nil && opts.Age == nil && opts.Expires == nil {
+		return
+	}
+	if opts.Headers == nil {
+		opts.Headers = make(map[string]string)
+	}
+	setDefault := func(name, value string) {
+		if _, exists := opts.Headers[name]; !exists {
+			opts.Headers[name] = value
+		}
+	}
+
+	date := h.now()
+	if opts.DateOffset != nil {
+		date = date.Add(*opts.DateOffset)
+		setDefault("Date", date.UTC().Format(util.HTTPDateFormat))
+	}
+	if opts.Age != nil {
+		setDefault("Age", strconv.Itoa(*opts.Age))
+	}
+	if opts.Expires != nil {
+		setDefault("Expires", date.Add(*opts.Expires).UTC().Format(util.HTTPDateFormat))
+	}
+}
@@ -0,0 +1,202 @@
+package http1
+
+import "github.com/perbu/GTest/pkg/vtc"
+
+// Options shared by txreq and txresp
+var txOptions = []vtc.OptionDoc{
+	{Name: "-proto", Arg: "PROTO", Help: "Protocol version (default HTTP/1.1)"},
+	{Name: "-hdr", Arg: "\"NAME: VALUE\"", Help: "Add a header (repeatable)"},
+	{Name: "-hdrfrom", Arg: "FILE", Help: "Add the header lines in FILE verbatim"},
+	{Name: "-body", Arg: "STRING", Help: "Send STRING as the body"},
+	{Name: "-bodylen", Arg: "N", Help: "Send a generated body of N bytes"},
+	{Name: "-bodyfrom", Arg: "FILE", Help: "Send the contents of FILE as the body"},
+	{Name: "-chunked", Help: "Send the body chunked"},
+	{Name: "-gzip", Help: "Compress the body with gzip"},
+	{Name: "-gzipbody", Arg: "STRING", Help: "Send STRING compressed with gzip"},
+	{Name: "-encoding", Arg: "CODING", Help: "Compress the body with gzip, deflate, br, zstd, ..."},
+	{Name: "-flush", Arg: "N,N,...", Help: "Write the message in pieces of these sizes"},
+	{Name: "-hdrlf", Arg: "\"NAME: VALUE\"", Help: "Add a header ended by a bare LF"},
+	{Name: "-hdrindent", Arg: "\"NAME: VALUE\"", Help: "Add a header with whitespace before its name"},
+	{Name: "-hdrnul", Arg: "\"NAME: VALUE\"", Help: "Add a header with NUL bytes at each \\0, or at its end"},
+	{Name: "-lf", Help: "End the start and header lines with LF instead of CRLF"},
+	{Name: "-nofinalcrlf", Help: "Leave out the empty line ending the headers"},
+}
+
+// Options shared by rxreq, rxreqhdrs and rxreqbody
+var rxReqOptions = []vtc.OptionDoc{
+	{Name: "-timeout", Arg: "DURATION", Help: "Timeout for this command only"},
+	{Name: "-maxhdrs", Arg: "N", Help: "Fail on more than N headers"},
+	{Name: "-maxhdrlen", Arg: "BYTES", Help: "Fail on a header block longer than BYTES"},
+	{Name: "-spool", Arg: "SIZE", Help: "Spool a body longer than SIZE (K, M or G suffix) to a file"},
+}
+
+// Docs documents the commands of HTTP/1 client and server specs
+var Docs = []vtc.CommandDoc{
+	{
+		Name:    "txreq",
+		Context: vtc.DocHTTP1,
+		Usage:   "[options]",
+		Help:    "Sends a request. Host, User-Agent and Content-Length are added unless given or turned off.",
+		Options: append([]vtc.OptionDoc{
+			{Name: "-method", Arg: "METHOD", Help: "Request method (default GET)"},
+			{Name: "-req", Arg: "METHOD", Help: "Same as -method"},
+			{Name: "-url", Arg: "URL", Help: "Request target (default /)"},
+			{Name: "-nohost", Help: "Don't send Host"},
+			{Name: "-nouseragent", Help: "Don't send User-Agent"},
+			{Name: "-absolute", Help: "Send the URL in absolute-form"},
+			{Name: "-asterisk", Help: "Send * as the URL"},
+			{Name: "-urllen", Arg: "N", Help: "Pad the URL with x to N bytes"},
+			{Name: "-nosp", Arg: "url|proto", Help: "Leave out the space before the URL or the protocol"},
+			{Name: "-cl", Arg: "VALUE", Help: "Send Content-Length: VALUE verbatim instead of the computed one (repeatable)"},
+			{Name: "-te", Arg: "VALUE", Help: "Send Transfer-Encoding: VALUE without framing the body by it"},
+			{Name: "-foldhdr", Arg: "\"NAME: VALUE\" MORE", Help: "Add a header continued on an obs-fold line"},
+		}, txOptions...),
+		Unsupported: []string{"-nolen", "-hdrlen", "-gziplevel", "-gziplen", "-gzipresidual", "-up"},
+	},
+	{
+		Name:    "txresp",
+		Context: vtc.DocHTTP1,
+		Usage:   "[options]",
+		Help:    "Sends a response. Server and Content-Length are added unless given or turned off.",
+		Options: append([]vtc.OptionDoc{
+			{Name: "-status", Arg: "CODE", Help: "Status code (default 200, or 206 with -range)"},
+			{Name: "-reason", Arg: "TEXT", Help: "Reason phrase (default for the status)"},
+			{Name: "-nolen", Help: "Don't send Content-Length"},
+			{Name: "-noserver", Help: "Don't send Server"},
+			{Name: "-gziplevel", Arg: "N", Help: "gzip compression level, 0 to 9, for this and later responses"},
+			{Name: "-gziptrunc", Arg: "N", Help: "Cut N bytes off the end of the gzip stream"},
+			{Name: "-gzipbadcrc", Help: "Corrupt the gzip CRC"},
+			{Name: "-gziplen-mismatch", Help: "Corrupt the gzip length trailer"},
+			{Name: "-range", Arg: "START-END/TOTAL", Help: "Send that slice of the body with Content-Range"},
+			{Name: "-date-offset", Arg: "DURATION", Help: "Send Date shifted from the test clock"},
+			{Name: "-age", Arg: "SECONDS", Help: "Send Age"},
+			{Name: "-expires", Arg: "DURATION", Help: "Send Expires relative to Date"},
+			{Name: "-preamble", Arg: "BYTES", Help: "Send BYTES (with \\r, \\n, \\xHH escapes) before the status line"},
+			{Name: "-close-after-headers", Help: "Close the connection instead of sending the body"},
+			{Name: "-extra-response", Help: "Follow up with an unsolicited 200 response"},
+		}, txOptions...),
+		Unsupported: []string{"-nodate", "-hdrlen", "-gziplen", "-gzipresidual"},
+	},
+	{
+		Name:    "rxreq",
+		Context: vtc.DocHTTP1,
+		Usage:   "[options]",
+		Help:    "Receives a request, with its body.",
+		Options: rxReqOptions,
+	},
+	{
+		Name:    "rxreqhdrs",
+		Context: vtc.DocHTTP1,
+		Usage:   "[options]",
+		Help:    "Receives the request line and headers only; rxreqbody reads the body.",
+		Options: rxReqOptions,
+	},
+	{
+		Name:    "rxreqbody",
+		Context: vtc.DocHTTP1,
+		Usage:   "[options]",
+		Help:    "Receives the body of a request read with rxreqhdrs.",
+		Options: rxReqOptions,
+	},
+	{
+		Name:    "rxresp",
+		Context: vtc.DocHTTP1,
+		Usage:   "[options]",
+		Help:    "Receives a response, with its body.",
+		Options: []vtc.OptionDoc{
+			{Name: "-no_obj", Help: "Don't read the body"},
+			{Name: "-interim", Help: "Collect 1xx responses and go on to the final one"},
+			{Name: "-spool", Arg: "SIZE", Help: "Spool a body longer than SIZE (K, M or G suffix) to a file"},
+		},
+	},
+	{
+		Name:    "expect",
+		Context: vtc.DocHTTP1,
+		Usage:   "FIELD OP VALUE",
+		Help:    "Checks a field of the last request or response, such as resp.status or req.http.host. OP is ==, !=, <, <=, >, >=, ~, !~ or -within.",
+	},
+	{
+		Name:    "capture",
+		Context: vtc.DocHTTP1,
+		Usage:   "FIELD NAME",
+		Help:    "Defines ${NAME} as the value of an expect FIELD.",
+	},
+	{
+		Name:    "send",
+		Context: vtc.DocHTTP1,
+		Usage:   "STRING",
+		Help:    "Sends STRING as is.",
+	},
+	{
+		Name:    "sendhex",
+		Context: vtc.DocHTTP1,
+		Usage:   "HEX",
+		Help:    "Sends the bytes given in hex.",
+	},
+	{
+		Name:    "sendfrom",
+		Context: vtc.DocHTTP1,
+		Usage:   "FILE",
+		Help:    "Sends the contents of FILE.",
+	},
+	{
+		Name:    "write_body",
+		Context: vtc.DocHTTP1,
+		Usage:   "[-append] FILE",
+		Help:    "Writes the last body to FILE, in ${tmpdir} if relative, and sets ${NAME_body_file}.",
+	},
+	{
+		Name:    "recv",
+		Context: vtc.DocHTTP1,
+		Usage:   "[N] [options]",
+		Help:    "Receives N bytes, or up to a pattern.",
+		Options: []vtc.OptionDoc{
+			{Name: "-until", Arg: "STRING", Help: "Receive until STRING, within N bytes if given"},
+			{Name: "-timeout", Arg: "DURATION", Help: "Timeout for this command only"},
+		},
+	},
+	{
+		Name:    "timeout",
+		Context: vtc.DocHTTP1,
+		Usage:   "DURATION",
+		Help:    "Sets the timeout of later commands.",
+	},
+	{
+		Name:    "txsegment",
+		Context: vtc.DocHTTP1,
+		Usage:   "N [DELAY]",
+		Help:    "Splits later writes into N-byte pieces, DELAY apart. txsegment 0 sends whole writes again.",
+	},
+	{
+		Name:    "gunzip",
+		Context: vtc.DocHTTP1,
+		Help:    "Decompresses the last gzip body.",
+	},
+	{
+		Name:    "decode",
+		Context: vtc.DocHTTP1,
+		Help:    "Decodes the last body by its Content-Encoding. Received bodies are kept as sent until decode or gunzip.",
+	},
+	{
+		Name:    "tunneled",
+		Context: vtc.DocHTTP1,
+		Usage:   "SPEC",
+		Help:    "Runs SPEC, with ||| for newlines, on the connection after a 2xx response to CONNECT.",
+	},
+	{
+		Name:    "expect_close",
+		Context: vtc.DocHTTP1,
+		Help:    "Expects the peer to close the connection.",
+	},
+	{
+		Name:    "accept",
+		Context: vtc.DocHTTP1,
+		Help:    "Closes the connection and waits for the next one. Server specs only.",
+	},
+	{
+		Name:    "repeat",
+		Context: vtc.DocHTTP1,
+		Usage:   "N { COMMANDS }",
+		Help:    "Runs COMMANDS N times on the connection, with ${iteration} numbering them from 1. Also in HTTP/2 specs and streams, and as VTest2's loop.",
+	},
+}
@@ -0,0 +1,256 @@
+package http1
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported content-codings for -encoding and the decode command
+const (
+	EncodingIdentity   = "identity"
+	EncodingGzip       = "gzip"
+	EncodingDeflate    = "deflate"     // zlib-wrapped deflate (RFC 9110)
+	EncodingDeflateRaw = "deflate-raw" // raw deflate, sent as "deflate"
+	EncodingBrotli     = "br"
+	EncodingZstd       = "zstd"
+)
+
+// contentEncodingName returns the Content-Encoding header value for an encoding
+func contentEncodingName(encoding string) string {
+	if strings.EqualFold(encoding, EncodingDeflateRaw) {
+		return EncodingDeflate
+	}
+	return encoding
+}
+
+// isGzipEncoding reports whether encoding names gzip or its x-gzip alias
+func isGzipEncoding(encoding string) bool {
+	return strings.EqualFold(encoding, EncodingGzip) || strings.EqualFold(encoding, "x-gzip")
+}
+
+// EncodeBody compresses data with the named content-coding
+func (h *HTTP) EncodeBody(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch strings.ToLower(encoding) {
+	case EncodingIdentity, "":
+		return data, nil
+	case EncodingGzip, "x-gzip":
+		return h.CompressBody(data)
+	case EncodingDeflate:
+		w, err = zlib.NewWriterLevel(&buf, h.deflateLevel())
+	case EncodingDeflateRaw:
+		w, err = flate.NewWriter(&buf, h.deflateLevel())
+	case EncodingBrotli:
+		level := brotli.DefaultCompression
+		if h.GzipLevel != -1 {
+			level = h.GzipLevel
+		}
+		w = brotli.NewWriterLevel(&buf, level)
+	case EncodingZstd:
+		w, err = zstd.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s writer creation failed: %w", encoding, err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("%s write failed: %w", encoding, err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("%s close failed: %w", encoding, err)
+	}
+
+	encoded := buf.Bytes()
+	h.Logger.Log(3, "Encoded (%s) %d bytes to %d bytes", encoding, len(data), len(encoded))
+	return encoded, nil
+}
+
+// DecodeBody decompresses data encoded with the named content-coding.
+// For "deflate" both the zlib-wrapped and the raw form are accepted. The
+// gzip or zlib header of the data is kept in GzipInfo.
+func (h *HTTP) DecodeBody(encoding string, data []byte) ([]byte, error) {
+	decoded, info, err := h.decodeBody(encoding, data)
+	if info != nil {
+		h.GzipInfo = info
+	}
+	return decoded, err
+}
+
+// decodeBody is DecodeBody, returning the gzip or zlib header of the
+// data, if it has one, instead of keeping it
+func (h *HTTP) decodeBody(encoding string, data []byte) ([]byte, *GzipInfo, error) {
+	var r io.Reader
+	var info *GzipInfo
+
+	switch strings.ToLower(encoding) {
+	case EncodingIdentity, "":
+		return data, nil, nil
+	case EncodingGzip, "x-gzip":
+		return h.gunzip(data)
+	case EncodingDeflate:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			// Many servers send raw deflate despite the RFC
+			h.Logger.Log(4, "deflate: no zlib header, trying raw deflate")
+			return h.decodeBody(EncodingDeflateRaw, data)
+		}
+		defer zr.Close()
+		r = zr
+		// CINFO in the zlib header carries the window size
+		info = &GzipInfo{WBits: int(data[0]>>4) + 8}
+	case EncodingDeflateRaw:
+		fr := flate.NewReader(bytes.NewReader(data))
+		defer fr.Close()
+		r = fr
+	case EncodingBrotli:
+		r = brotli.NewReader(bytes.NewReader(data))
+	case EncodingZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("zstd reader creation failed: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, info, fmt.Errorf("%s read failed: %w", encoding, err)
+	}
+
+	h.Logger.Log(3, "Decoded (%s) %d bytes to %d bytes", encoding, len(data), len(decoded))
+	return decoded, info, nil
+}
+
+// Decode decompresses the body in place according to the Content-Encoding
+// of the last received message. Stacked codings ("gzip, br") are undone
+// in reverse order of application.
+func (h *HTTP) Decode() error {
+	if h.BodyFile != "" {
+		return fmt.Errorf("decode: the body of %d bytes was spooled to disk", h.BodyLen)
+	}
+	if len(h.Body) == 0 {
+		return nil
+	}
+
+	if h.contentEncoding(h.rxRequest) == "" {
+		return fmt.Errorf("decode: no Content-Encoding on received message")
+	}
+
+	body, info, err := h.decodedBody(h.rxRequest)
+	if info != nil {
+		h.GzipInfo = info
+	}
+	if err != nil {
+		return err
+	}
+
+	h.Body = body
+	h.BodyLen = len(body)
+	h.Logger.Log(3, "decode: decompressed to %d bytes", h.BodyLen)
+	return nil
+}
+
+// decodedBody returns the body with the request or response Content-Encoding
+// undone, and the gzip or zlib header met last, leaving h untouched. A body
+// without Content-Encoding is returned as-is, so comparisons work for both
+// encoded and plain messages.
+func (h *HTTP) decodedBody(isRequest bool) ([]byte, *GzipInfo, error) {
+	ce := h.contentEncoding(isRequest)
+	if ce == "" {
+		return h.Body, nil, nil
+	}
+
+	codings := strings.Split(ce, ",")
+	body := h.Body
+	var info *GzipInfo
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.TrimSpace(codings[i])
+		decoded, header, err := h.decodeBody(coding, body)
+		if header != nil {
+			info = header
+		}
+		if err != nil {
+			return nil, info, fmt.Errorf("decode failed: %w", err)
+		}
+		body = decoded
+	}
+	return body, info, nil
+}
+
+// contentEncoding returns the Content-Encoding of the request or response
+func (h *HTTP) contentEncoding(isRequest bool) string {
+	if isRequest {
+		return h.GetRequestHeader("Content-Encoding")
+	}
+	return h.GetResponseHeader("Content-Encoding")
+}
+
+// GzipDamage describes deliberate corruption applied to gzip output
+type GzipDamage struct {
+	Trunc       int  // Drop this many bytes from the end of the stream
+	BadCRC      bool // Invert the CRC32 in the trailer
+	LenMismatch bool // Store a wrong ISIZE in the trailer
+}
+
+// IsZero reports whether no damage is requested
+func (d GzipDamage) IsZero() bool {
+	return d.Trunc == 0 && !d.BadCRC && !d.LenMismatch
+}
+
+// damageGzip applies the requested corruption to a gzip stream.
+// The trailer is the last 8 bytes: CRC32 then ISIZE, both little-endian.
+func (h *HTTP) damageGzip(data []byte, d GzipDamage) ([]byte, error) {
+	if len(data) < 18 {
+		return nil, fmt.Errorf("gzip stream too short to damage (%d bytes)", len(data))
+	}
+
+	out := make([]byte, len(data))
+	copy(out, data)
+	trailer := len(out) - 8
+
+	if d.BadCRC {
+		for i := 0; i < 4; i++ {
+			out[trailer+i] ^= 0xff
+		}
+		h.Logger.Log(3, "gzip: corrupted CRC32")
+	}
+	if d.LenMismatch {
+		isize := binary.LittleEndian.Uint32(out[trailer+4:])
+		binary.LittleEndian.PutUint32(out[trailer+4:], isize+1)
+		h.Logger.Log(3, "gzip: ISIZE set to %d (actual %d)", isize+1, isize)
+	}
+	if d.Trunc > 0 {
+		if d.Trunc >= len(out) {
+			return nil, fmt.Errorf("cannot truncate %d bytes from %d byte gzip stream", d.Trunc, len(out))
+		}
+		out = out[:len(out)-d.Trunc]
+		h.Logger.Log(3, "gzip: truncated stream by %d bytes", d.Trunc)
+	}
+
+	return out, nil
+}
+
+// deflateLevel maps GzipLevel onto a compress/flate level
+func (h *HTTP) deflateLevel() int {
+	if h.GzipLevel == -1 {
+		return flate.DefaultCompression
+	}
+	return h.GzipLevel
+}
@@ -2,9 +2,12 @@ package http1
 
 import (
 	"fmt"
-	"regexp"
+	"net"
 	"strconv"
 	"strings"
+
+	gnet "github.com/perbu/GTest/pkg/net"
+	"github.com/perbu/GTest/pkg/util"
 )
 
 // Expect performs an assertion on HTTP fields
@@ -19,7 +22,7 @@ func (h *HTTP) Expect(field, op, expected string) error {
 	}
 
 	// Perform comparison
-	result, err := compare(actual, op, expected)
+	result, err := util.Compare(actual, op, expected)
 	if err != nil {
 		return err
 	}
@@ -34,6 +37,14 @@ func (h *HTTP) Expect(field, op, expected string) error {
 
 // getField retrieves the value of a field from the HTTP session
 func (h *HTTP) getField(field string) (string, error) {
+	// Bytes read by the last recv command
+	switch field {
+	case "recv":
+		return string(h.Received), nil
+	case "recv.len":
+		return strconv.Itoa(len(h.Received)), nil
+	}
+
 	parts := strings.SplitN(field, ".", 3)
 	if len(parts) < 2 {
 		return "", fmt.Errorf("invalid field: %s", field)
@@ -43,6 +54,12 @@ func (h *HTTP) getField(field string) (string, error) {
 	name := parts[1]
 
 	switch category {
+	case "conn":
+		return h.getConnField(name)
+	case "timing":
+		return h.Timing.Get(name)
+	case "tls":
+		return h.getTLSField(name)
 	case "req":
 		return h.getRequestField(name, parts)
 	case "resp":
@@ -52,6 +69,62 @@ func (h *HTTP) getField(field string) (string, error) {
 	}
 }
 
+// getConnField retrieves addresses of the connection (e.g. "conn.remote_ip",
+// "conn.local_port", "conn.family") and its reuse: "conn.reused" is true
+// once a second request is sent or received on it, "conn.requests" counts
+// them, "conn.seq" numbers the connection and "conn.count" counts those of
+// the client or server so far
+func (h *HTTP) getConnField(name string) (string, error) {
+	switch name {
+	case "reused":
+		return strconv.FormatBool(h.Stats.Requests > 1), nil
+	case "requests":
+		return strconv.Itoa(h.Stats.Requests), nil
+	case "seq":
+		return strconv.Itoa(h.Stats.Seq), nil
+	case "count":
+		if h.ConnCount == nil {
+			return strconv.Itoa(h.Stats.Seq), nil
+		}
+		return strconv.Itoa(h.ConnCount()), nil
+	}
+
+	remote, _ := h.Conn.RemoteAddr().(*net.TCPAddr)
+	local, _ := h.Conn.LocalAddr().(*net.TCPAddr)
+	if remote == nil || local == nil {
+		return "", fmt.Errorf("conn.%s: not a TCP connection", name)
+	}
+
+	switch name {
+	case "remote_ip":
+		return remote.IP.String(), nil
+	case "remote_port":
+		return strconv.Itoa(remote.Port), nil
+	case "local_ip":
+		return local.IP.String(), nil
+	case "local_port":
+		return strconv.Itoa(local.Port), nil
+	case "family":
+		if remote.IP.To4() != nil {
+			return "4", nil
+		}
+		return "6", nil
+	default:
+		return "", fmt.Errorf("unknown conn field: %s", name)
+	}
+}
+
+// getTLSField retrieves properties of a TLS connection and of the
+// certificate the peer presented (e.g. "tls.version", "tls.peer_cn",
+// "tls.verify")
+func (h *HTTP) getTLSField(name string) (string, error) {
+	conn, ok := h.Conn.(*gnet.TLSConn)
+	if !ok {
+		return "", fmt.Errorf("tls.%s: not a TLS connection", name)
+	}
+	return conn.Field(name)
+}
+
 // getRequestField retrieves a request field value
 func (h *HTTP) getRequestField(name string, parts []string) (string, error) {
 	switch name {
@@ -61,10 +134,10 @@ func (h *HTTP) getRequestField(name string, parts []string) (string, error) {
 		return h.URL, nil
 	case "proto":
 		return h.Proto, nil
-	case "body":
-		return string(h.Body), nil
-	case "bodylen":
-		return strconv.Itoa(h.BodyLen), nil
+	case "body", "bodylen":
+		return h.getBodyField(name, parts, true)
+	case "gzip":
+		return h.getGzipField(parts)
 	case "http":
 		// req.http.headername
 		if len(parts) < 3 {
@@ -85,10 +158,12 @@ func (h *HTTP) getResponseField(name string, parts []string) (string, error) {
 		return h.Reason, nil
 	case "proto":
 		return h.Proto, nil
-	case "body":
-		return string(h.Body), nil
-	case "bodylen":
-		return strconv.Itoa(h.BodyLen), nil
+	case "body", "bodylen":
+		return h.getBodyField(name, parts, false)
+	case "gzip":
+		return h.getGzipField(parts)
+	case "range":
+		return h.getRangeField(parts)
 	case "http":
 		// resp.http.headername
 		if len(parts) < 3 {
@@ -96,106 +171,118 @@ func (h *HTTP) getResponseField(name string, parts []string) (string, error) {
 		}
 		return h.GetResponseHeader(parts[2]), nil
 	default:
+		if strings.HasPrefix(name, "interim") {
+			return h.getInterimField(name, parts)
+		}
 		return "", fmt.Errorf("unknown response field: %s", name)
 	}
 }
 
-// compare performs the comparison operation
-func compare(actual, op, expected string) (bool, error) {
-	// Handle <undef> special value
-	isActualUndef := (actual == "")
-	isExpectedUndef := (expected == "<undef>")
-
-	switch op {
-	case "==", "-eq":
-		// Check if comparing with <undef>
-		if isExpectedUndef {
-			return isActualUndef, nil
-		}
-		// -eq can be either string or numeric, try numeric first
-		if op == "-eq" {
-			actualInt, err1 := strconv.ParseInt(actual, 0, 64)
-			expectedInt, err2 := strconv.ParseInt(expected, 0, 64)
-			if err1 == nil && err2 == nil {
-				return actualInt == expectedInt, nil
-			}
-		}
-		return actual == expected, nil
-	case "!=", "-ne":
-		// Check if comparing with <undef>
-		if isExpectedUndef {
-			return !isActualUndef, nil
-		}
-		// -ne is numeric not-equal
-		if op == "-ne" {
-			return compareNumeric(actual, "!=", expected)
-		}
-		return actual != expected, nil
-	case "~":
-		// Regex match
-		re, err := regexp.Compile(expected)
-		if err != nil {
-			return false, fmt.Errorf("invalid regex %s: %w", expected, err)
-		}
-		return re.MatchString(actual), nil
-	case "!~":
-		// Regex not match
-		re, err := regexp.Compile(expected)
-		if err != nil {
-			return false, fmt.Errorf("invalid regex %s: %w", expected, err)
+// getInterimField retrieves fields of a 1xx response collected by
+// rxresp -interim (e.g. "resp.interim[0].status", "resp.interim[0].http.link",
+// "resp.interim.count")
+func (h *HTTP) getInterimField(name string, parts []string) (string, error) {
+	if len(parts) < 3 {
+		return "", fmt.Errorf("missing interim field name")
+	}
+	if name == "interim" {
+		if parts[2] != "count" {
+			return "", fmt.Errorf("unknown interim field: %s", parts[2])
 		}
-		return !re.MatchString(actual), nil
-	case "<", "-lt":
-		return compareNumeric(actual, "<", expected)
-	case ">", "-gt":
-		return compareNumeric(actual, ">", expected)
-	case "<=", "-le":
-		return compareNumeric(actual, "<=", expected)
-	case ">=", "-ge":
-		return compareNumeric(actual, ">=", expected)
+		return strconv.Itoa(len(h.Interim)), nil
+	}
+
+	idx, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "interim["), "]"))
+	if err != nil || !strings.HasSuffix(name, "]") {
+		return "", fmt.Errorf("invalid interim index: %s", name)
+	}
+	if idx < 0 || idx >= len(h.Interim) {
+		return "", fmt.Errorf("interim response %d not received (got %d)", idx, len(h.Interim))
+	}
+	ir := h.Interim[idx]
+
+	switch {
+	case parts[2] == "status":
+		return strconv.Itoa(ir.Status), nil
+	case parts[2] == "reason":
+		return ir.Reason, nil
+	case strings.HasPrefix(parts[2], "http."):
+		return findHeader(ir.Headers, strings.TrimPrefix(parts[2], "http.")), nil
 	default:
-		return false, fmt.Errorf("unknown operator: %s", op)
+		return "", fmt.Errorf("unknown interim field: %s", parts[2])
 	}
 }
 
-// compareNumeric performs numeric comparison
-func compareNumeric(actual, op, expected string) (bool, error) {
-	// Try to parse as integers first (base 0 auto-detects hex with 0x prefix)
-	actualInt, err1 := strconv.ParseInt(actual, 0, 64)
-	expectedInt, err2 := strconv.ParseInt(expected, 0, 64)
-
-	if err1 == nil && err2 == nil {
-		// Both are integers
-		switch op {
-		case "<":
-			return actualInt < expectedInt, nil
-		case ">":
-			return actualInt > expectedInt, nil
-		case "<=":
-			return actualInt <= expectedInt, nil
-		case ">=":
-			return actualInt >= expectedInt, nil
+// getBodyField retrieves body or bodylen. With a ".decoded" suffix the body
+// is compared after undoing its Content-Encoding, so assertions do not depend
+// on the exact bytes produced by a particular compressor. A checksum suffix
+// (e.g. "resp.body.sha256", "resp.body.decoded.md5") yields the hex digest,
+// and "resp.body.head.N" and "resp.body.tail.N" the first and last N bytes.
+func (h *HTTP) getBodyField(name string, parts []string, isRequest bool) (string, error) {
+	if h.BodyFile != "" {
+		return h.spooledBodyField(name, parts)
+	}
+
+	body := h.Body
+	if len(parts) < 3 {
+		if name == "bodylen" {
+			return strconv.Itoa(h.BodyLen), nil
 		}
+		return string(body), nil
 	}
 
-	// Try as floats
-	actualFloat, err1 := strconv.ParseFloat(actual, 64)
-	expectedFloat, err2 := strconv.ParseFloat(expected, 64)
+	mods := strings.Split(parts[2], ".")
+	if mods[0] == "decoded" {
+		// An expect leaves the gzip fields as they were
+		decoded, _, err := h.decodedBody(isRequest)
+		if err != nil {
+			return "", err
+		}
+		body = decoded
+		mods = mods[1:]
+	}
 
-	if err1 != nil || err2 != nil {
-		return false, fmt.Errorf("cannot compare non-numeric values with %s", op)
+	switch {
+	case len(mods) == 0 && name == "bodylen":
+		return strconv.Itoa(len(body)), nil
+	case len(mods) == 0:
+		return string(body), nil
+	case len(mods) == 1 && name == "body":
+		return util.Checksum(mods[0], body)
+	case len(mods) == 2 && name == "body" && (mods[0] == "head" || mods[0] == "tail"):
+		return bodyEnd(body, mods[0], mods[1])
+	default:
+		return "", fmt.Errorf("unknown body modifier: %s", parts[2])
 	}
+}
 
-	switch op {
-	case "<":
-		return actualFloat < expectedFloat, nil
-	case ">":
-		return actualFloat > expectedFloat, nil
-	case "<=":
-		return actualFloat <= expectedFloat, nil
-	case ">=":
-		return actualFloat >= expectedFloat, nil
+// getGzipField retrieves header fields of the last gunzipped body
+// (e.g. "resp.gzip.os", "resp.gzip.mtime", "resp.gzip.name")
+func (h *HTTP) getGzipField(parts []string) (string, error) {
+	if len(parts) < 3 {
+		return "", fmt.Errorf("missing gzip field name")
+	}
+	if h.GzipInfo == nil {
+		return "", fmt.Errorf("no gzip body has been decompressed")
 	}
 
-	return false, fmt.Errorf("unknown numeric operator: %s", op)
+	switch parts[2] {
+	case "os":
+		return strconv.Itoa(int(h.GzipInfo.OS)), nil
+	case "mtime":
+		if h.GzipInfo.ModTime.IsZero() {
+			return "0", nil
+		}
+		return strconv.FormatInt(h.GzipInfo.ModTime.Unix(), 10), nil
+	case "name":
+		return h.GzipInfo.Name, nil
+	case "comment":
+		return h.GzipInfo.Comment, nil
+	case "xfl":
+		return strconv.Itoa(int(h.GzipInfo.XFL)), nil
+	case "wbits":
+		return strconv.Itoa(h.GzipInfo.WBits), nil
+	default:
+		return "", fmt.Errorf("unknown gzip field: %s", parts[2])
+	}
 }
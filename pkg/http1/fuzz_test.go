@@ -0,0 +1,52 @@
+package http1
+
+import (
+	"testing"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// fuzzFields are checked after a message was received, to run the field
+// lookups over whatever was parsed
+var fuzzFields = []string{"req.url", "req.http.host", "resp.reason", "resp.http.content-type", "bodylen", "body.md5", "body.head.4"}
+
+// fuzzReceive receives one message from data and looks up a few fields,
+// which may fail but must not panic
+func fuzzReceive(t *testing.T, data []byte, rx func(h *HTTP) error) {
+	defer logging.ResetOutput()
+	h := New(newMockConn(string(data)), logging.NewLogger("fuzz"))
+	if err := rx(h); err != nil {
+		return
+	}
+	for _, field := range fuzzFields {
+		h.Expect(field, "==", "")
+	}
+}
+
+// FuzzRxReq checks that no request makes rxreq panic
+func FuzzRxReq(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	f.Add([]byte("POST /p HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+	f.Add([]byte("POST /p HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5;ext=1\r\nhello\r\n0\r\nTrailer: x\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\n folded\r\nX: a\r\n b\r\n\r\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzReceive(t, data, func(h *HTTP) error {
+			return h.RxReq(&RxReqOptions{MaxHdrs: 64})
+		})
+	})
+}
+
+// FuzzRxResp checks that no response makes rxresp panic
+func FuzzRxResp(f *testing.F) {
+	f.Add([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+	f.Add([]byte("HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 204 No Content\r\n\r\n"))
+	f.Add([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n"))
+	f.Add([]byte("HTTP/1.0 200 OK\r\nConnection: close\r\n\r\nuntil eof"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzReceive(t, data, func(h *HTTP) error {
+			return h.RxResp(&RxRespOptions{Interim: true})
+		})
+	})
+}
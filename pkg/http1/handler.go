@@ -2,11 +2,16 @@ package http1
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/perbu/GTest/pkg/session"
+	"github.com/perbu/GTest/pkg/util"
 	"github.com/perbu/GTest/pkg/vtc"
 )
 
@@ -14,6 +19,21 @@ import (
 type Handler struct {
 	HTTP    *HTTP
 	Context interface{} // ExecContext for global commands (optional)
+
+	// AcceptFunc waits for the next connection to a server (optional).
+	// Only server specs set it, enabling the accept command.
+	AcceptFunc func(timeout time.Duration) (net.Conn, error)
+
+	// ConnStats returns the stats of a connection picked up by accept
+	// (optional)
+	ConnStats func(net.Conn) *session.ConnStats
+
+	// Expanded marks a spec whose macros were already expanded as a whole,
+	// as -dispatch-spec-per-conn does, so its lines are not expanded again
+	Expanded bool
+
+	nonFatal bool            // Set by non_fatal: failing commands are recorded, not fatal
+	macros   *vtc.MacroStore // Snapshot of the test's macros taken when the spec started
 }
 
 // NewHandler creates a new HTTP command handler
@@ -30,33 +50,92 @@ func (h *Handler) SetContext(ctx interface{}) {
 // This is the main entry point for executing HTTP commands from VTC specs
 func (h *Handler) ProcessSpec(spec string) error {
 	h.HTTP.Logger.Debug("ProcessSpec called with spec length: %d", len(spec))
+	h.snapshotMacros()
 
 	// Parse the spec into lines
 	lines := strings.Split(spec, "\n")
 	h.HTTP.Logger.Debug("ProcessSpec parsed %d lines", len(lines))
 
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
+	if err := h.runLines(lines); err != nil {
+		return err
+	}
+
+	h.HTTP.Logger.Debug("ProcessSpec completed successfully")
+	return nil
+}
+
+// runLines runs spec lines, and the repeat blocks among them
+func (h *Handler) runLines(lines []string) error {
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
 		h.HTTP.Logger.Debug("Processing line %d: %s", i+1, line)
 
-		// Parse the command line
-		err := h.ProcessCommand(line)
+		if vtc.IsRepeat(line) {
+			block, err := vtc.ParseRepeat(lines, i, h.expandLine)
+			if err != nil {
+				return err
+			}
+			if err := block.Run(h.runLines); err != nil {
+				return err
+			}
+			i = block.End
+			continue
+		}
+
+		// Expand macros as late as possible, then run the command
+		expanded, err := h.expandLine(line)
+		if err == nil {
+			err = h.ProcessCommand(expanded)
+		}
 		if err != nil {
 			h.HTTP.Logger.Debug("Command failed on line %d: %v", i+1, err)
+			if h.nonFatal {
+				h.recordSoftFailure(line, err)
+				continue
+			}
 			return fmt.Errorf("command '%s' failed: %w", line, err)
 		}
 
 		h.HTTP.Logger.Debug("Line %d completed successfully", i+1)
 	}
-
-	h.HTTP.Logger.Debug("ProcessSpec completed successfully")
 	return nil
 }
 
+// snapshotMacros freezes the test's macros for the rest of the spec, so
+// a server restarting elsewhere does not change them mid-spec. Macros the
+// spec itself defines go to both the snapshot and the shared store.
+func (h *Handler) snapshotMacros() {
+	if h.macros != nil {
+		return
+	}
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok && ctx.Macros != nil {
+		h.macros = ctx.Macros.Snapshot()
+	}
+}
+
+// expandLine expands the macros in a spec line just before it runs.
+// tunneled is left alone: its nested lines are expanded as they run.
+func (h *Handler) expandLine(line string) (string, error) {
+	if h.macros == nil || h.Expanded || strings.HasPrefix(line, "tunneled ") {
+		return line, nil
+	}
+	return h.macros.Expand(h.HTTP.Logger, line)
+}
+
+// defineMacro defines a macro for the rest of this spec and for the test
+func (h *Handler) defineMacro(name, value string) {
+	if h.macros != nil {
+		h.macros.Define(name, value)
+	}
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok && ctx.Macros != nil {
+		ctx.Macros.Define(name, value)
+	}
+}
+
 // ProcessCommand processes a single HTTP command
 func (h *Handler) ProcessCommand(cmdLine string) error {
 	// Tokenize the command line
@@ -67,6 +146,7 @@ func (h *Handler) ProcessCommand(cmdLine string) error {
 
 	cmd := tokens[0]
 	args := tokens[1:]
+	vtc.ChaosDelay(h.Context)
 
 	h.HTTP.Logger.Debug("ProcessCommand: cmd=%s, args=%v", cmd, args)
 
@@ -81,47 +161,113 @@ func (h *Handler) ProcessCommand(cmdLine string) error {
 	case "rxreq":
 		h.HTTP.Logger.Debug("Executing rxreq")
 		err = h.handleRxReq(args)
+	case "rxreqhdrs":
+		h.HTTP.Logger.Debug("Executing rxreqhdrs")
+		err = h.handleRxReqHdrs(args)
+	case "rxreqbody":
+		h.HTTP.Logger.Debug("Executing rxreqbody")
+		err = h.handleRxReqBody(args)
 	case "rxresp":
 		h.HTTP.Logger.Debug("Executing rxresp")
 		err = h.handleRxResp(args)
 	case "expect":
 		h.HTTP.Logger.Debug("Executing expect")
 		err = h.handleExpect(args)
+	case "capture":
+		h.HTTP.Logger.Debug("Executing capture")
+		err = h.handleCapture(args)
+	case "setvar":
+		err = vtc.SpecSetvar(args, h.Context, h.HTTP.Logger)
 	case "send":
 		h.HTTP.Logger.Debug("Executing send")
 		err = h.handleSend(args)
 	case "sendhex":
 		h.HTTP.Logger.Debug("Executing sendhex")
 		err = h.handleSendHex(args)
+	case "sendfrom":
+		h.HTTP.Logger.Debug("Executing sendfrom")
+		err = h.handleSendFrom(args)
+	case "write_body":
+		h.HTTP.Logger.Debug("Executing write_body")
+		err = h.handleWriteBody(args)
 	case "recv":
 		h.HTTP.Logger.Debug("Executing recv")
 		err = h.handleRecv(args)
 	case "timeout":
 		h.HTTP.Logger.Debug("Executing timeout")
 		err = h.handleTimeout(args)
+	case "txsegment":
+		h.HTTP.Logger.Debug("Executing txsegment")
+		err = h.handleTxSegment(args)
 	case "gunzip":
 		h.HTTP.Logger.Debug("Executing gunzip")
 		err = h.HTTP.Gunzip()
+	case "decode":
+		h.HTTP.Logger.Debug("Executing decode")
+		err = h.HTTP.Decode()
 	case "delay":
 		h.HTTP.Logger.Debug("Executing delay")
 		err = h.handleDelay(args)
+	case "fatal":
+		h.nonFatal = false
+	case "non_fatal":
+		h.nonFatal = true
+	case "tunneled":
+		h.HTTP.Logger.Debug("Executing tunneled")
+		err = h.handleTunneled(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(cmdLine), "tunneled")))
+	case "expect_close":
+		h.HTTP.Logger.Debug("Executing expect_close")
+		err = h.HTTP.ExpectClose()
+	case "accept":
+		h.HTTP.Logger.Debug("Executing accept")
+		err = h.handleAccept()
 	default:
-		// Try to execute as a global VTC command
-		err = h.tryGlobalCommand(cmd, args)
-		if err != nil {
+		if _, ok := vtc.GetCommand(cmd); !ok {
+			if vtc.SkipUnknownCommand(h.Context, cmd) {
+				return nil
+			}
 			err = fmt.Errorf("unknown HTTP command: %s", cmd)
+			break
 		}
+		// Try to execute as a global VTC command
+		err = h.tryGlobalCommand(cmd, args)
 	}
 
 	if err != nil {
 		h.HTTP.Logger.Debug("Command %s failed: %v", cmd, err)
 	} else {
 		h.HTTP.Logger.Debug("Command %s completed successfully", cmd)
+		switch cmd {
+		case "rxreq", "rxreqhdrs", "rxreqbody", "rxresp":
+			h.defineTimingMacros()
+		}
 	}
 
 	return err
 }
 
+// defineTimingMacros publishes the last timings as ${NAME_timing_FIELD}
+// (e.g. ${c1_timing_ttfb}) in seconds
+func (h *Handler) defineTimingMacros() {
+	if h.HTTP.Name == "" {
+		return
+	}
+	for _, field := range util.TimingFields {
+		value, _ := h.HTTP.Timing.Get(field)
+		h.defineMacro(h.HTTP.Name+"_timing_"+field, value)
+	}
+}
+
+// recordSoftFailure logs a failure that non_fatal turned into a warning and
+// reports it to the test context for the final summary
+func (h *Handler) recordSoftFailure(line string, err error) {
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok {
+		ctx.RecordSoftFailure("%s: command '%s' failed: %v", h.HTTP.Name, line, err)
+		return
+	}
+	h.HTTP.Logger.Warning("Non-fatal failure: command '%s' failed: %v", line, err)
+}
+
 // tryGlobalCommand attempts to execute a command as a global VTC command
 func (h *Handler) tryGlobalCommand(cmd string, args []string) error {
 	if h.Context == nil {
@@ -179,6 +325,16 @@ func (h *Handler) handleTxReq(args []string) error {
 				opts.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 			}
 			i++
+		case "-hdrfrom":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-hdrfrom requires an argument")
+			}
+			lines, err := h.readHeadersFromFile(args[i+1])
+			if err != nil {
+				return fmt.Errorf("-hdrfrom failed: %w", err)
+			}
+			opts.RawHeaders = append(opts.RawHeaders, lines...)
+			i++
 		case "-body":
 			if i+1 >= len(args) {
 				return fmt.Errorf("-body requires an argument")
@@ -195,6 +351,16 @@ func (h *Handler) handleTxReq(args []string) error {
 			}
 			opts.BodyLen = n
 			i++
+		case "-flush":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-flush requires an argument")
+			}
+			sizes, err := parseFlush(args[i+1])
+			if err != nil {
+				return err
+			}
+			opts.Flush = sizes
+			i++
 		case "-bodyfrom":
 			if i+1 >= len(args) {
 				return fmt.Errorf("-bodyfrom requires an argument")
@@ -210,6 +376,12 @@ func (h *Handler) handleTxReq(args []string) error {
 			opts.Chunked = true
 		case "-gzip":
 			opts.Gzip = true
+		case "-encoding":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-encoding requires an argument")
+			}
+			opts.Encoding = args[i+1]
+			i++
 		case "-gzipbody":
 			if i+1 >= len(args) {
 				return fmt.Errorf("-gzipbody requires an argument")
@@ -221,6 +393,74 @@ func (h *Handler) handleTxReq(args []string) error {
 			opts.NoHost = true
 		case "-nouseragent":
 			opts.NoUserAgent = true
+		case "-absolute":
+			opts.AbsoluteForm = true
+		case "-asterisk":
+			opts.URL = "*"
+		case "-urllen":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-urllen requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return fmt.Errorf("invalid -urllen: %w", err)
+			}
+			opts.URLLen = n
+			i++
+		case "-nosp":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-nosp requires an argument")
+			}
+			switch args[i+1] {
+			case "url":
+				opts.NoSPAfterMeth = true
+			case "proto":
+				opts.NoSPAfterURL = true
+			default:
+				return fmt.Errorf("invalid -nosp %q (want url or proto)", args[i+1])
+			}
+			i++
+		case "-cl":
+			// Sent verbatim ("007", " 7", "7, 7"), in order with -te and
+			// -foldhdr; repeat for duplicate headers
+			if i+1 >= len(args) {
+				return fmt.Errorf("-cl requires an argument")
+			}
+			opts.RawHeaders = append(opts.RawHeaders, "Content-Length: "+args[i+1])
+			opts.NoLen = true
+			i++
+		case "-te":
+			// Only the header: the body is framed by -chunked, or sent as is
+			if i+1 >= len(args) {
+				return fmt.Errorf("-te requires an argument")
+			}
+			opts.RawHeaders = append(opts.RawHeaders, "Transfer-Encoding: "+args[i+1])
+			opts.NoTE = true
+			i++
+		case "-foldhdr":
+			// Header continued on an obs-fold line: "Name: value" continuation
+			if i+2 >= len(args) {
+				return fmt.Errorf("-foldhdr requires two arguments")
+			}
+			name, _, _ := strings.Cut(args[i+1], ":")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "content-length":
+				opts.NoLen = true
+			case "transfer-encoding":
+				opts.NoTE = true
+			}
+			opts.RawHeaders = append(opts.RawHeaders, args[i+1]+"\r\n "+args[i+2])
+			i += 2
+		case "-hdrlf", "-hdrindent", "-hdrnul":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires an argument", args[i])
+			}
+			opts.RawHeaders = append(opts.RawHeaders, malformedHeader(args[i], args[i+1]))
+			i++
+		case "-lf":
+			opts.BareLF = true
+		case "-nofinalcrlf":
+			opts.NoFinalCRLF = true
 		default:
 			return fmt.Errorf("unknown txreq option: %s", args[i])
 		}
@@ -237,6 +477,7 @@ func (h *Handler) handleTxResp(args []string) error {
 		Proto:  "HTTP/1.1",
 		Headers: make(map[string]string),
 	}
+	statusSet := false
 
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
@@ -249,6 +490,7 @@ func (h *Handler) handleTxResp(args []string) error {
 				return fmt.Errorf("invalid -status: %w", err)
 			}
 			opts.Status = n
+			statusSet = true
 			i++
 		case "-reason":
 			if i+1 >= len(args) {
@@ -272,6 +514,16 @@ func (h *Handler) handleTxResp(args []string) error {
 				opts.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
 			}
 			i++
+		case "-hdrfrom":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-hdrfrom requires an argument")
+			}
+			lines, err := h.readHeadersFromFile(args[i+1])
+			if err != nil {
+				return fmt.Errorf("-hdrfrom failed: %w", err)
+			}
+			opts.RawHeaders = append(opts.RawHeaders, lines...)
+			i++
 		case "-body":
 			if i+1 >= len(args) {
 				return fmt.Errorf("-body requires an argument")
@@ -288,6 +540,16 @@ func (h *Handler) handleTxResp(args []string) error {
 			}
 			opts.BodyLen = n
 			i++
+		case "-flush":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-flush requires an argument")
+			}
+			sizes, err := parseFlush(args[i+1])
+			if err != nil {
+				return err
+			}
+			opts.Flush = sizes
+			i++
 		case "-bodyfrom":
 			if i+1 >= len(args) {
 				return fmt.Errorf("-bodyfrom requires an argument")
@@ -303,6 +565,12 @@ func (h *Handler) handleTxResp(args []string) error {
 			opts.Chunked = true
 		case "-gzip":
 			opts.Gzip = true
+		case "-encoding":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-encoding requires an argument")
+			}
+			opts.Encoding = args[i+1]
+			i++
 		case "-gzipbody":
 			if i+1 >= len(args) {
 				return fmt.Errorf("-gzipbody requires an argument")
@@ -323,24 +591,181 @@ func (h *Handler) handleTxResp(args []string) error {
 			}
 			h.HTTP.GzipLevel = n
 			i++
+		case "-gziptrunc":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-gziptrunc requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid -gziptrunc: %s", args[i+1])
+			}
+			opts.GzipDamage.Trunc = n
+			i++
+		case "-gzipbadcrc":
+			opts.GzipDamage.BadCRC = true
+		case "-gziplen-mismatch":
+			opts.GzipDamage.LenMismatch = true
 		case "-nolen":
 			opts.NoLen = true
 		case "-noserver":
 			opts.NoServer = true
+		case "-range":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-range requires an argument")
+			}
+			r, err := ParseByteRange(args[i+1])
+			if err != nil {
+				return fmt.Errorf("invalid -range: %w", err)
+			}
+			opts.Range = &r
+			i++
+		case "-date-offset":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-date-offset requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return fmt.Errorf("invalid -date-offset: %w", err)
+			}
+			opts.DateOffset = &d
+			i++
+		case "-age":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-age requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid -age: %s", args[i+1])
+			}
+			opts.Age = &n
+			i++
+		case "-expires":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-expires requires an argument")
+			}
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return fmt.Errorf("invalid -expires: %w", err)
+			}
+			opts.Expires = &d
+			i++
+		case "-hdrlf", "-hdrindent", "-hdrnul":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires an argument", args[i])
+			}
+			opts.RawHeaders = append(opts.RawHeaders, malformedHeader(args[i], args[i+1]))
+			i++
+		case "-lf":
+			opts.BareLF = true
+		case "-nofinalcrlf":
+			opts.NoFinalCRLF = true
+		case "-preamble":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-preamble requires an argument")
+			}
+			opts.Preamble = util.Unescape(args[i+1])
+			i++
+		case "-close-after-headers":
+			opts.CloseAfterHeaders = true
+		case "-extra-response":
+			opts.ExtraResponse = true
 		default:
 			return fmt.Errorf("unknown txresp option: %s", args[i])
 		}
 	}
 
+	// A range response is 206 unless the test asks otherwise
+	if opts.Range != nil && !statusSet {
+		opts.Status = 206
+		opts.Reason = getDefaultReason(206)
+	}
+
 	return h.HTTP.TxResp(opts)
 }
 
 // handleRxReq processes rxreq command
 func (h *Handler) handleRxReq(args []string) error {
-	opts := &RxReqOptions{}
+	opts, err := parseRxReqOptions("rxreq", args)
+	if err != nil {
+		return err
+	}
+	opts.SpoolDir = h.spoolDir(opts.Spool)
 	return h.HTTP.RxReq(opts)
 }
 
+// handleRxReqHdrs processes rxreqhdrs command
+func (h *Handler) handleRxReqHdrs(args []string) error {
+	opts, err := parseRxReqOptions("rxreqhdrs", args)
+	if err != nil {
+		return err
+	}
+	return h.HTTP.RxReqHdrs(opts)
+}
+
+// handleRxReqBody processes rxreqbody command
+func (h *Handler) handleRxReqBody(args []string) error {
+	opts, err := parseRxReqOptions("rxreqbody", args)
+	if err != nil {
+		return err
+	}
+	opts.SpoolDir = h.spoolDir(opts.Spool)
+	return h.HTTP.RxReqBody(opts)
+}
+
+// parseRxReqOptions parses the options shared by rxreq, rxreqhdrs and rxreqbody
+func parseRxReqOptions(cmd string, args []string) (*RxReqOptions, error) {
+	opts := &RxReqOptions{}
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-timeout":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("-timeout requires an argument")
+			}
+			d, err := parseTimeout(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			opts.Timeout = d
+			i++
+		case "-maxhdrs":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("-maxhdrs requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid -maxhdrs: %s", args[i+1])
+			}
+			opts.MaxHdrs = n
+			i++
+		case "-maxhdrlen":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("-maxhdrlen requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid -maxhdrlen: %s", args[i+1])
+			}
+			opts.MaxHdrLen = n
+			i++
+		case "-spool":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("-spool requires an argument")
+			}
+			n, err := parseSpool(args[i+1])
+			if err != nil {
+				return nil, err
+			}
+			opts.Spool = n
+			i++
+		default:
+			return nil, fmt.Errorf("unknown %s option: %s", cmd, args[i])
+		}
+	}
+
+	return opts, nil
+}
+
 // handleRxResp processes rxresp command
 func (h *Handler) handleRxResp(args []string) error {
 	opts := &RxRespOptions{}
@@ -349,14 +774,51 @@ func (h *Handler) handleRxResp(args []string) error {
 		switch args[i] {
 		case "-no_obj":
 			opts.NoObj = true
+		case "-interim":
+			opts.Interim = true
+		case "-spool":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-spool requires an argument")
+			}
+			n, err := parseSpool(args[i+1])
+			if err != nil {
+				return err
+			}
+			opts.Spool = n
+			i++
 		default:
 			return fmt.Errorf("unknown rxresp option: %s", args[i])
 		}
 	}
 
+	opts.SpoolDir = h.spoolDir(opts.Spool)
 	return h.HTTP.RxResp(opts)
 }
 
+// parseSpool parses the -spool threshold: a byte count with an optional
+// K, M or G suffix
+func parseSpool(s string) (int64, error) {
+	n, err := util.ParseSize(s)
+	if err != nil || n < 1 || n > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid -spool: %s", s)
+	}
+	return int64(n), nil
+}
+
+// spoolDir returns the directory for bodies spooled to disk: the client's
+// or server's directory in ${tmpdir}
+func (h *Handler) spoolDir(spool int64) string {
+	ctx, ok := h.Context.(*vtc.ExecContext)
+	if spool == 0 || !ok || h.HTTP.Name == "" {
+		return ""
+	}
+	dir, err := ctx.ObjectDir(h.HTTP.Name)
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
 // handleExpect processes expect command
 func (h *Handler) handleExpect(args []string) error {
 	if len(args) < 3 {
@@ -370,6 +832,71 @@ func (h *Handler) handleExpect(args []string) error {
 	return h.HTTP.Expect(field, op, expected)
 }
 
+// handleCapture stores the value of an expect field in a macro, for later
+// lines and specs: capture resp.http.x-req-id req_id
+func (h *Handler) handleCapture(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("capture requires 2 arguments: field name")
+	}
+
+	value, err := h.HTTP.getField(args[0])
+	if err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+
+	h.defineMacro(args[1], value)
+	h.HTTP.Logger.Log(4, "capture %s = %q", args[1], value)
+	return nil
+}
+
+// handleAccept closes the current connection and waits for the next one
+func (h *Handler) handleAccept() error {
+	if h.AcceptFunc == nil {
+		return fmt.Errorf("accept is only available in server specs")
+	}
+
+	h.HTTP.Close()
+	conn, err := h.AcceptFunc(h.HTTP.Timeout)
+	if err != nil {
+		return fmt.Errorf("accept failed: %w", err)
+	}
+
+	h.HTTP.SetConn(conn)
+	if h.ConnStats != nil {
+		h.HTTP.Stats = h.ConnStats(conn)
+	}
+	h.HTTP.Logger.Log(3, "accepted new connection")
+	return nil
+}
+
+// handleTunneled runs a nested spec over an established CONNECT tunnel.
+// The nested spec gets fresh HTTP state but shares the connection, so
+// the tunneled exchange is independent of the CONNECT request itself.
+func (h *Handler) handleTunneled(spec string) error {
+	if !h.HTTP.tunnelEstablished() {
+		return fmt.Errorf("tunneled requires a 2xx response to CONNECT")
+	}
+
+	spec = strings.ReplaceAll(spec, "|||", "\n")
+	if strings.TrimSpace(spec) == "" {
+		return fmt.Errorf("tunneled: no spec provided")
+	}
+
+	inner := New(h.HTTP.Conn, h.HTTP.Logger)
+	inner.RxBuf = h.HTTP.RxBuf
+	inner.Name = h.HTTP.Name
+	inner.Timeout = h.HTTP.Timeout
+
+	nested := NewHandler(inner)
+	nested.Context = h.Context
+	nested.nonFatal = h.nonFatal
+	nested.macros = h.macros
+	nested.Expanded = h.Expanded
+
+	h.HTTP.Logger.Log(3, "tunneled: running nested spec to %s", h.HTTP.URL)
+	return nested.ProcessSpec(spec)
+}
+
 // handleSend processes send command
 func (h *Handler) handleSend(args []string) error {
 	if len(args) < 1 {
@@ -390,18 +917,97 @@ func (h *Handler) handleSendHex(args []string) error {
 	return h.HTTP.SendHex(hexStr)
 }
 
-// handleRecv processes recv command
-func (h *Handler) handleRecv(args []string) error {
+// handleSendFrom processes sendfrom command
+func (h *Handler) handleSendFrom(args []string) error {
 	if len(args) < 1 {
-		return fmt.Errorf("recv requires byte count argument")
+		return fmt.Errorf("sendfrom requires a file argument")
 	}
+	return h.HTTP.SendFile(h.resolveFile(args[0]))
+}
 
-	n, err := strconv.Atoi(args[0])
-	if err != nil {
-		return fmt.Errorf("invalid byte count: %w", err)
+// handleWriteBody processes write_body command. Relative paths are
+// placed in ${tmpdir}, and ${NAME_body_file} is set to the file written.
+func (h *Handler) handleWriteBody(args []string) error {
+	var filename string
+	appendMode := false
+
+	for _, arg := range args {
+		switch arg {
+		case "-append":
+			appendMode = true
+		default:
+			if filename != "" {
+				return fmt.Errorf("write_body: unexpected argument %s", arg)
+			}
+			filename = arg
+		}
+	}
+	if filename == "" {
+		return fmt.Errorf("write_body requires a file argument")
+	}
+
+	ctx, ok := h.Context.(*vtc.ExecContext)
+	if ok && !filepath.IsAbs(filename) && ctx.TmpDir != "" {
+		filename = filepath.Join(ctx.TmpDir, filename)
+	}
+
+	if err := h.HTTP.WriteBody(filename, appendMode); err != nil {
+		return err
+	}
+	if ok {
+		ctx.AddArtifact(filename)
+	}
+
+	if h.HTTP.Name != "" {
+		h.defineMacro(h.HTTP.Name+"_body_file", filename)
+	}
+	return nil
+}
+
+// handleRecv processes recv command
+func (h *Handler) handleRecv(args []string) error {
+	n := 0
+	var until string
+	var timeout time.Duration
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-until":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-until requires an argument")
+			}
+			until = args[i+1]
+			i++
+		case "-timeout":
+			if i+1 >= len(args) {
+				return fmt.Errorf("-timeout requires an argument")
+			}
+			d, err := parseTimeout(args[i+1])
+			if err != nil {
+				return err
+			}
+			timeout = d
+			i++
+		default:
+			count, err := strconv.Atoi(args[i])
+			if err != nil {
+				return fmt.Errorf("invalid byte count: %w", err)
+			}
+			n = count
+		}
 	}
 
-	_, err = h.HTTP.Recv(n)
+	defer h.HTTP.overrideTimeout(timeout)()
+
+	if until != "" {
+		// A byte count bounds the search for the pattern
+		_, err := h.HTTP.RecvUntil(until, n)
+		return err
+	}
+	if n <= 0 {
+		return fmt.Errorf("recv requires a byte count or -until")
+	}
+	_, err := h.HTTP.Recv(n)
 	return err
 }
 
@@ -411,18 +1017,54 @@ func (h *Handler) handleTimeout(args []string) error {
 		return fmt.Errorf("timeout requires duration argument")
 	}
 
-	d, err := time.ParseDuration(args[0])
+	d, err := parseTimeout(args[0])
+	if err != nil {
+		return err
+	}
+
+	h.HTTP.SetIOTimeout(d)
+	return nil
+}
+
+// handleTxSegment processes "txsegment N [DELAY]": all later writes on the
+// connection are split into N-byte pieces, DELAY apart. "txsegment 0"
+// sends whole writes again.
+func (h *Handler) handleTxSegment(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("txsegment: usage: txsegment N [DELAY]")
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 {
+		return fmt.Errorf("txsegment: invalid size %q", args[0])
+	}
+	var delay time.Duration
+	if len(args) == 2 {
+		if delay, err = parseTimeout(args[1]); err != nil {
+			return fmt.Errorf("txsegment: %w", err)
+		}
+	}
+
+	h.HTTP.SegmentSize = n
+	h.HTTP.SegmentDelay = delay
+	if n == 0 {
+		h.HTTP.SegmentDelay = 0
+	}
+	h.HTTP.Logger.Log(3, "txsegment: %d bytes, %v apart", n, delay)
+	return nil
+}
+
+// parseTimeout parses a Go duration or a plain number of seconds
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
 	if err != nil {
 		// Try parsing as seconds
-		seconds, err2 := strconv.ParseFloat(args[0], 64)
+		seconds, err2 := strconv.ParseFloat(s, 64)
 		if err2 != nil {
-			return fmt.Errorf("invalid timeout: %w", err)
+			return 0, fmt.Errorf("invalid timeout: %w", err)
 		}
 		d = time.Duration(seconds * float64(time.Second))
 	}
-
-	h.HTTP.SetIOTimeout(d)
-	return nil
+	return d, nil
 }
 
 // handleDelay processes delay command - sleeps for specified duration
@@ -446,8 +1088,25 @@ func (h *Handler) handleDelay(args []string) error {
 	return nil
 }
 
+// malformedHeader builds the header line for -hdrlf (ended by a bare LF),
+// -hdrindent (whitespace before the name) and -hdrnul (each \0 in the
+// value, or the end of the value, becomes a NUL byte)
+func malformedHeader(opt, hdr string) string {
+	switch opt {
+	case "-hdrlf":
+		return hdr + "\n"
+	case "-hdrindent":
+		return " " + hdr
+	default:
+		if strings.Contains(hdr, `\0`) {
+			return strings.ReplaceAll(hdr, `\0`, "\x00")
+		}
+		return hdr + "\x00"
+	}
+}
+
 // tokenizeCommand splits a command line into tokens
-// Handles quoted strings
+// Handles quoted strings and decodes verbatim $"..." tokens
 func tokenizeCommand(line string) []string {
 	var tokens []string
 	var current strings.Builder
@@ -457,6 +1116,14 @@ func tokenizeCommand(line string) []string {
 	for i := 0; i < len(line); i++ {
 		ch := line[i]
 
+		if ch == '$' && !inQuote && current.Len() == 0 {
+			if end := util.VerbatimEnd(line, i); end > 0 {
+				current.WriteString(line[i:end])
+				i = end - 1
+				continue
+			}
+		}
+
 		switch {
 		case (ch == '"' || ch == '\'') && !inQuote:
 			inQuote = true
@@ -478,6 +1145,9 @@ func tokenizeCommand(line string) []string {
 		tokens = append(tokens, current.String())
 	}
 
+	for i := range tokens {
+		tokens[i] = util.UnquoteVerbatim(tokens[i])
+	}
 	return tokens
 }
 
@@ -489,3 +1159,47 @@ func (h *Handler) readBodyFromFile(filename string) ([]byte, error) {
 	}
 	return data, nil
 }
+
+// readHeadersFromFile reads header lines from a file, one per line.
+// Lines are sent verbatim, so malformed fixtures survive unchanged.
+func (h *Handler) readHeadersFromFile(filename string) ([]string, error) {
+	data, err := os.ReadFile(h.resolveFile(filename))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %w", filename, err)
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// resolveFile locates a relative fixture path in ${tmpdir}, then
+// ${testdir}. Paths found in neither are left relative to the cwd.
+func (h *Handler) resolveFile(filename string) string {
+	ctx, ok := h.Context.(*vtc.ExecContext)
+	if filepath.IsAbs(filename) || !ok {
+		return filename
+	}
+
+	dirs := []string{ctx.TmpDir}
+	if h.macros != nil {
+		if testDir, ok := h.macros.Get("testdir"); ok {
+			dirs = append(dirs, testDir)
+		}
+	}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		candidate := filepath.Join(dir, filename)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return filename
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/session"
 )
 
 const (
@@ -31,19 +32,36 @@ type HTTP struct {
 	Timeout time.Duration
 	Name    string // Client or server name (for default headers)
 
+	// Clock is the test clock for generated dates (defaults to time.Now)
+	Clock func() time.Time
+
+	// Stats follows Conn across the repeats of a spec, and ConnCount
+	// returns how many connections its client or server has had, for the
+	// conn.reused, conn.requests, conn.seq and conn.count expect fields
+	Stats     *session.ConnStats
+	ConnCount func() int
+
 	// Request and response storage
 	ReqHeaders  []string // Request headers
 	RespHeaders []string // Response headers
 	Body        []byte   // Message body
 	BodyLen     int      // Body length
+	BodyFile    string   // File holding the last received body if it was spooled to disk, else empty
 
 	// Receive buffer
 	RxBuf    *bufio.Reader
 	RxBytes  []byte // Raw received bytes
+	Received []byte // Bytes read by the last recv command
+
+	// Set by txsegment: every write is split into pieces of SegmentSize
+	// bytes, SegmentDelay apart (0 sends whole writes)
+	SegmentSize  int
+	SegmentDelay time.Duration
 
 	// Gzip state
 	GzipLevel    int
 	GzipResidual int
+	GzipInfo     *GzipInfo // Header of the last decompressed gzip stream
 
 	// Request/response line components
 	Method     string // HTTP method (for requests)
@@ -52,9 +70,23 @@ type HTTP struct {
 	Status     int    // Response status code
 	Reason     string // Response reason phrase
 
+	// Interim (1xx) responses received before the final response
+	Interim []InterimResponse
+
+	// Latencies of the last received message
+	Timing Timing
+
 	// Flags
 	Fatal      bool // Fatal error occurred
 	HeadMethod bool // Last request was HEAD
+
+	rxRequest bool      // Last received message was a request
+	lastExch  bool      // The last request was HTTP/1.0 without keep-alive: the client closes after the response
+	closed    bool      // The client closed the connection after a last exchange
+	sentAt    time.Time // Start of the last txreq/txresp
+
+	bodyHead []byte // First bytes of a spooled body
+	bodyTail []byte // Last bytes of a spooled body
 }
 
 // New creates a new HTTP session on the given connection
@@ -67,6 +99,7 @@ func New(conn net.Conn, logger *logging.Logger) *HTTP {
 		RespHeaders: make([]string, 0, MaxHeaders),
 		RxBuf:      bufio.NewReader(conn),
 		GzipLevel:  -1, // Default compression
+		Stats:      &session.ConnStats{Seq: 1},
 	}
 }
 
@@ -83,7 +116,9 @@ func (h *HTTP) ResetRequest() {
 	h.Proto = "HTTP/1.1"
 	h.Body = nil
 	h.BodyLen = 0
+	h.dropSpool()
 	h.HeadMethod = false
+	h.GzipInfo = nil
 }
 
 // ResetResponse clears response state
@@ -94,24 +129,25 @@ func (h *HTTP) ResetResponse() {
 	h.Proto = "HTTP/1.1"
 	h.Body = nil
 	h.BodyLen = 0
+	h.dropSpool()
+	h.Interim = nil
+	h.GzipInfo = nil
 }
 
 // GetRequestHeader retrieves a request header value
 func (h *HTTP) GetRequestHeader(name string) string {
-	lowerName := strings.ToLower(name)
-	for _, hdr := range h.ReqHeaders {
-		parts := strings.SplitN(hdr, ":", 2)
-		if len(parts) == 2 && strings.ToLower(strings.TrimSpace(parts[0])) == lowerName {
-			return strings.TrimSpace(parts[1])
-		}
-	}
-	return ""
+	return findHeader(h.ReqHeaders, name)
 }
 
 // GetResponseHeader retrieves a response header value
 func (h *HTTP) GetResponseHeader(name string) string {
+	return findHeader(h.RespHeaders, name)
+}
+
+// findHeader returns the value of the first header line matching name
+func findHeader(headers []string, name string) string {
 	lowerName := strings.ToLower(name)
-	for _, hdr := range h.RespHeaders {
+	for _, hdr := range headers {
 		parts := strings.SplitN(hdr, ":", 2)
 		if len(parts) == 2 && strings.ToLower(strings.TrimSpace(parts[0])) == lowerName {
 			return strings.TrimSpace(parts[1])
@@ -120,8 +156,22 @@ func (h *HTTP) GetResponseHeader(name string) string {
 	return ""
 }
 
+// headerHasToken reports whether a comma-separated header lists token,
+// ignoring case (e.g. "Connection: keep-alive")
+func headerHasToken(headers []string, name, token string) bool {
+	for _, t := range strings.Split(findHeader(headers, name), ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
 // Write sends raw bytes to the connection
 func (h *HTTP) Write(data []byte) error {
+	if h.SegmentSize > 0 {
+		return h.writeMessage([][]byte{data}, nil)
+	}
 	if h.Timeout > 0 {
 		h.Conn.SetWriteDeadline(time.Now().Add(h.Timeout))
 	}
@@ -217,21 +267,52 @@ func (h *HTTP) CompressBody(data []byte) ([]byte, error) {
 	return compressed, nil
 }
 
-// DecompressBody decompresses gzip-encoded data
+// GzipInfo holds the header fields of a decompressed gzip stream
+type GzipInfo struct {
+	OS      byte
+	ModTime time.Time
+	Name    string
+	Comment string
+	XFL     byte // Extra flags: 2 = max compression, 4 = fastest
+	WBits   int  // zlib windowBits needed to inflate the stream
+}
+
+// DecompressBody decompresses gzip-encoded data, and keeps its header in
+// GzipInfo
 func (h *HTTP) DecompressBody(data []byte) ([]byte, error) {
+	decompressed, info, err := h.gunzip(data)
+	if info != nil {
+		h.GzipInfo = info
+	}
+	return decompressed, err
+}
+
+// gunzip decompresses gzip-encoded data and returns its header, leaving
+// GzipInfo alone
+func (h *HTTP) gunzip(data []byte) ([]byte, *GzipInfo, error) {
 	r, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		return nil, fmt.Errorf("gzip reader creation failed: %w", err)
+		return nil, nil, fmt.Errorf("gzip reader creation failed: %w", err)
 	}
 	defer r.Close()
 
+	// gzip always uses a 32K window; zlib signals the gzip wrapper with +16
+	info := &GzipInfo{
+		OS:      r.Header.OS,
+		ModTime: r.Header.ModTime,
+		Name:    r.Header.Name,
+		Comment: r.Header.Comment,
+		XFL:     data[8],
+		WBits:   15 + 16,
+	}
+
 	decompressed, err := io.ReadAll(r)
 	if err != nil {
-		return nil, fmt.Errorf("gzip read failed: %w", err)
+		return nil, info, fmt.Errorf("gzip read failed: %w", err)
 	}
 
 	h.Logger.Log(3, "Decompressed %d bytes to %d bytes", len(data), len(decompressed))
-	return decompressed, nil
+	return decompressed, info, nil
 }
 
 // GenerateBody generates a synthetic body of the specified length
@@ -260,20 +341,28 @@ func GenerateBody(length int, random bool) []byte {
 // ParseChunkedBody reads a chunked transfer-encoded body
 func (h *HTTP) ParseChunkedBody() ([]byte, error) {
 	var body bytes.Buffer
+	if err := h.copyChunkedBody(&body, h.RxBuf); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
 
+// copyChunkedBody reads a chunked transfer-encoded body from r into w
+func (h *HTTP) copyChunkedBody(w io.Writer, r io.Reader) error {
 	for {
 		// Read chunk size line
 		line, err := h.ReadLine()
 		if err != nil {
-			return nil, fmt.Errorf("reading chunk size: %w", err)
+			return fmt.Errorf("reading chunk size: %w", err)
 		}
 
-		// Parse chunk size (hex)
+		// Parse chunk size (hex, without a sign, and fitting an int64)
 		parts := strings.SplitN(line, ";", 2)
-		chunkSize, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 16, 64)
+		size, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 16, 63)
 		if err != nil {
-			return nil, fmt.Errorf("invalid chunk size '%s': %w", line, err)
+			return fmt.Errorf("invalid chunk size '%s': %w", line, err)
 		}
+		chunkSize := int64(size)
 
 		h.Logger.Log(4, "Chunk size: %d", chunkSize)
 
@@ -283,7 +372,7 @@ func (h *HTTP) ParseChunkedBody() ([]byte, error) {
 			for {
 				line, err := h.ReadLine()
 				if err != nil {
-					return nil, fmt.Errorf("reading trailer: %w", err)
+					return fmt.Errorf("reading trailer: %w", err)
 				}
 				if line == "" {
 					break
@@ -294,22 +383,20 @@ func (h *HTTP) ParseChunkedBody() ([]byte, error) {
 		}
 
 		// Read chunk data
-		chunk, err := h.ReadBytes(int(chunkSize))
-		if err != nil {
-			return nil, fmt.Errorf("reading chunk data: %w", err)
+		if _, err := io.CopyN(w, r, chunkSize); err != nil {
+			return fmt.Errorf("reading chunk data: %w", err)
 		}
-
-		body.Write(chunk)
+		h.Logger.Log(4, "Received %d bytes", chunkSize)
 
 		// Read trailing CRLF after chunk data
 		line, err = h.ReadLine()
 		if err != nil {
-			return nil, fmt.Errorf("reading chunk trailer: %w", err)
+			return fmt.Errorf("reading chunk trailer: %w", err)
 		}
 		if line != "" {
 			h.Logger.Log(2, "Warning: expected empty line after chunk, got: %s", line)
 		}
 	}
 
-	return body.Bytes(), nil
+	return nil
 }
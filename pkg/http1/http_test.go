@@ -2,22 +2,36 @@ package http1
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/md5"
 	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/session"
+	"github.com/perbu/GTest/pkg/util"
+	"github.com/perbu/GTest/pkg/vtc"
 )
 
 // mockConn is a mock connection for testing
 type mockConn struct {
-	readBuf  *bytes.Buffer
-	writeBuf *bytes.Buffer
-	closed   bool
+	readBuf   *bytes.Buffer
+	writeBuf  *bytes.Buffer
+	closed    bool
+	deadlines int // SetWriteDeadline calls, one per write of a message
 }
 
 func newMockConn(data string) *mockConn {
@@ -44,7 +58,7 @@ func (m *mockConn) LocalAddr() net.Addr                { return nil }
 func (m *mockConn) RemoteAddr() net.Addr               { return nil }
 func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
 func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
-func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { m.deadlines++; return nil }
 
 func (m *mockConn) Written() string {
 	return m.writeBuf.String()
@@ -615,7 +629,7 @@ func TestTxResp_CustomHeaders(t *testing.T) {
 	err := h.TxResp(&TxRespOptions{
 		Status: 200,
 		Headers: map[string]string{
-			"X-Custom":     "value",
+			"X-Custom":      "value",
 			"Cache-Control": "no-cache",
 		},
 	})
@@ -634,6 +648,31 @@ func TestTxResp_CustomHeaders(t *testing.T) {
 
 // Test Edge Cases and Helper Functions
 
+func TestLogMessages(t *testing.T) {
+	logging.ResetOutput()
+	logging.SetBodyExcerpt(4)
+	defer logging.SetBodyExcerpt(0)
+
+	conn := newMockConn("POST /x HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello world")
+	h := New(conn, logging.NewLogger("s1"))
+	if err := h.RxReq(&RxReqOptions{}); err != nil {
+		t.Fatalf("RxReq failed: %v", err)
+	}
+	if err := h.TxResp(&TxRespOptions{Body: []byte("ok"), NoServer: true}); err != nil {
+		t.Fatalf("TxResp failed: %v", err)
+	}
+
+	out := logging.GetOutput()
+	for _, want := range []string{
+		"http[ 0] |POST", "http[ 2] |HTTP/1.1", "http[ 3] |Host: a", "bodylen = 11", "body|hell\n",
+		"txresp|HTTP/1.1 200 OK", "txresp|Content-Length: 2", "bodylen = 2", "body|ok",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in the log:\n%s", want, out)
+		}
+	}
+}
+
 func TestGenerateBody(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -754,18 +793,18 @@ func TestParseChunkedBody_MultipleChunks(t *testing.T) {
 }
 
 func TestParseChunkedBody_InvalidChunkSize(t *testing.T) {
-	data := "INVALID\r\n"
-
-	conn := newMockConn(data)
-	logger := logging.NewLogger("test")
-	h := New(conn, logger)
-
-	_, err := h.ParseChunkedBody()
-	if err == nil {
-		t.Fatal("Expected error for invalid chunk size, got nil")
-	}
-	if !strings.Contains(err.Error(), "invalid chunk size") {
-		t.Errorf("Expected 'invalid chunk size' error, got: %v", err)
+	for _, data := range []string{"INVALID\r\n", "-5\r\nhello\r\n0\r\n\r\n", "8000000000000000\r\n"} {
+		conn := newMockConn(data)
+		logger := logging.NewLogger("test")
+		h := New(conn, logger)
+
+		_, err := h.ParseChunkedBody()
+		if err == nil {
+			t.Fatalf("Expected error for invalid chunk size in %q, got nil", data)
+		}
+		if !strings.Contains(err.Error(), "invalid chunk size") {
+			t.Errorf("Expected 'invalid chunk size' error, got: %v", err)
+		}
 	}
 }
 
@@ -1153,3 +1192,1254 @@ func TestRxResp_GzipBody(t *testing.T) {
 		t.Errorf("Expected decompressed body '%s', got '%s'", string(originalBody), string(h2.Body))
 	}
 }
+
+func TestEncodeDecodeBody_AllEncodings(t *testing.T) {
+	logger := logging.NewLogger("test")
+	h := New(newMockConn(""), logger)
+
+	original := []byte("The quick brown fox jumps over the lazy dog, repeatedly and at length.")
+
+	for _, enc := range []string{"gzip", "deflate", "deflate-raw", "br", "zstd", "identity"} {
+		encoded, err := h.EncodeBody(enc, original)
+		if err != nil {
+			t.Fatalf("EncodeBody(%s) failed: %v", enc, err)
+		}
+		decoded, err := h.DecodeBody(enc, encoded)
+		if err != nil {
+			t.Fatalf("DecodeBody(%s) failed: %v", enc, err)
+		}
+		if !bytes.Equal(decoded, original) {
+			t.Errorf("%s: round trip mismatch", enc)
+		}
+	}
+}
+
+func TestDecodeBody_DeflateAcceptsRaw(t *testing.T) {
+	logger := logging.NewLogger("test")
+	h := New(newMockConn(""), logger)
+
+	raw, err := h.EncodeBody("deflate-raw", []byte("raw deflate payload"))
+	if err != nil {
+		t.Fatalf("EncodeBody failed: %v", err)
+	}
+
+	decoded, err := h.DecodeBody("deflate", raw)
+	if err != nil {
+		t.Fatalf("DecodeBody(deflate) of raw data failed: %v", err)
+	}
+	if string(decoded) != "raw deflate payload" {
+		t.Errorf("Unexpected decoded body: %q", decoded)
+	}
+}
+
+func TestTxResp_EncodingHeader(t *testing.T) {
+	conn := newMockConn("")
+	logger := logging.NewLogger("test")
+	h := New(conn, logger)
+
+	err := h.TxResp(&TxRespOptions{
+		Status:   200,
+		Body:     []byte("brotli body"),
+		Encoding: "br",
+	})
+	if err != nil {
+		t.Fatalf("TxResp with Encoding failed: %v", err)
+	}
+
+	if !strings.Contains(conn.Written(), "Content-Encoding: br\r\n") {
+		t.Errorf("Expected Content-Encoding: br header in output")
+	}
+}
+
+func TestTxResp_EncodingHeaderIgnoresCase(t *testing.T) {
+	conn := newMockConn("")
+	logger := logging.NewLogger("test")
+	h := New(conn, logger)
+
+	err := h.TxResp(&TxRespOptions{
+		Status:   200,
+		Body:     []byte("raw deflate body"),
+		Encoding: "Deflate-Raw",
+	})
+	if err != nil {
+		t.Fatalf("TxResp with Encoding failed: %v", err)
+	}
+
+	if !strings.Contains(conn.Written(), "Content-Encoding: deflate\r\n") {
+		t.Errorf("Expected Content-Encoding: deflate header in output")
+	}
+}
+
+func TestRxResp_DecodeStackedEncodings(t *testing.T) {
+	logger := logging.NewLogger("test")
+	h := New(newMockConn(""), logger)
+
+	original := []byte("stacked content-coding body")
+	gz, err := h.EncodeBody("gzip", original)
+	if err != nil {
+		t.Fatalf("gzip failed: %v", err)
+	}
+	body, err := h.EncodeBody("zstd", gz)
+	if err != nil {
+		t.Fatalf("zstd failed: %v", err)
+	}
+
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Encoding: gzip, zstd\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n" +
+		string(body)
+
+	h2 := New(newMockConn(data), logger)
+	if err := h2.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	if err := h2.Decode(); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if !bytes.Equal(h2.Body, original) {
+		t.Errorf("Expected decoded body %q, got %q", original, h2.Body)
+	}
+}
+
+func TestTxResp_GzipDamage(t *testing.T) {
+	logger := logging.NewLogger("test")
+	body := []byte("body that will be damaged on the wire")
+
+	cases := []struct {
+		name   string
+		damage GzipDamage
+	}{
+		{"trunc", GzipDamage{Trunc: 4}},
+		{"badcrc", GzipDamage{BadCRC: true}},
+		{"lenmismatch", GzipDamage{LenMismatch: true}},
+	}
+
+	for _, tc := range cases {
+		h := New(newMockConn(""), logger)
+		err := h.TxResp(&TxRespOptions{
+			Status:     200,
+			Body:       body,
+			Gzip:       true,
+			GzipDamage: tc.damage,
+		})
+		if err != nil {
+			t.Fatalf("%s: TxResp failed: %v", tc.name, err)
+		}
+		if _, err := h.DecompressBody(h.Body); err == nil {
+			t.Errorf("%s: expected damaged gzip body to fail decompression", tc.name)
+		}
+	}
+}
+
+func TestTxResp_GzipDamageXGzip(t *testing.T) {
+	conn := newMockConn("")
+	logger := logging.NewLogger("test")
+	h := New(conn, logger)
+
+	err := h.TxResp(&TxRespOptions{
+		Status:     200,
+		Body:       []byte("x-gzip body that will be damaged"),
+		Encoding:   "x-gzip",
+		GzipDamage: GzipDamage{BadCRC: true},
+	})
+	if err != nil {
+		t.Fatalf("TxResp with x-gzip damage failed: %v", err)
+	}
+	if !strings.Contains(conn.Written(), "Content-Encoding: x-gzip\r\n") {
+		t.Errorf("Expected Content-Encoding: x-gzip header in output")
+	}
+	if _, err := h.DecompressBody(h.Body); err == nil {
+		t.Errorf("expected damaged x-gzip body to fail decompression")
+	}
+}
+
+func TestExpect_DecodedBody(t *testing.T) {
+	logger := logging.NewLogger("test")
+	h := New(newMockConn(""), logger)
+
+	compressed, err := h.CompressBody([]byte("fixture body"))
+	if err != nil {
+		t.Fatalf("CompressBody failed: %v", err)
+	}
+
+	data := "HTTP/1.1 200 OK\r\n" +
+		"Content-Encoding: gzip\r\n" +
+		"Content-Length: " + strconv.Itoa(len(compressed)) + "\r\n" +
+		"\r\n" +
+		string(compressed)
+
+	h2 := New(newMockConn(data), logger)
+	if err := h2.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+
+	if err := h2.Expect("resp.body.decoded", "==", "fixture body"); err != nil {
+		t.Errorf("resp.body.decoded: %v", err)
+	}
+	if err := h2.Expect("resp.bodylen.decoded", "==", "12"); err != nil {
+		t.Errorf("resp.bodylen.decoded: %v", err)
+	}
+	// Expects decode for themselves: the gzip fields stay those of the
+	// last gunzip or decode, here none
+	if h2.GzipInfo != nil {
+		t.Errorf("resp.body.decoded set GzipInfo to %+v", h2.GzipInfo)
+	}
+	if err := h2.Expect("resp.gzip.wbits", "==", "31"); err == nil {
+		t.Error("Expected no gzip fields after an expect on the decoded body")
+	}
+	// The stored body must remain compressed
+	if err := h2.Expect("resp.bodylen", "==", strconv.Itoa(len(compressed))); err != nil {
+		t.Errorf("resp.bodylen: %v", err)
+	}
+}
+
+func TestExpect_GzipHeaderFields(t *testing.T) {
+	logger := logging.NewLogger("test")
+	h := New(newMockConn(""), logger)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Name = "index.html"
+	zw.OS = 3
+	zw.ModTime = time.Unix(1700000000, 0)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	h.Body = buf.Bytes()
+	h.BodyLen = len(h.Body)
+
+	if err := h.Gunzip(); err != nil {
+		t.Fatalf("Gunzip failed: %v", err)
+	}
+
+	checks := map[string]string{
+		"resp.gzip.os":    "3",
+		"resp.gzip.mtime": "1700000000",
+		"resp.gzip.name":  "index.html",
+		"resp.gzip.wbits": "31",
+	}
+	for field, want := range checks {
+		if err := h.Expect(field, "==", want); err != nil {
+			t.Errorf("%s: %v", field, err)
+		}
+	}
+	if err := h.Expect("resp.gzip.bogus", "==", ""); err == nil {
+		t.Error("expected error for unknown gzip field")
+	}
+
+	// zlib streams report the window size from the CMF byte
+	var zbuf bytes.Buffer
+	zlw := zlib.NewWriter(&zbuf)
+	zlw.Write([]byte("hello"))
+	zlw.Close()
+	if _, err := h.DecodeBody(EncodingDeflate, zbuf.Bytes()); err != nil {
+		t.Fatalf("DecodeBody failed: %v", err)
+	}
+	if err := h.Expect("resp.gzip.wbits", "==", "15"); err != nil {
+		t.Errorf("zlib wbits: %v", err)
+	}
+}
+
+func TestExpect_GzipFieldsResetPerMessage(t *testing.T) {
+	logger := logging.NewLogger("test")
+	h := New(newMockConn("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nplain"), logger)
+
+	compressed, err := h.CompressBody([]byte("hello"))
+	if err != nil {
+		t.Fatalf("CompressBody failed: %v", err)
+	}
+	h.Body = compressed
+	if err := h.Gunzip(); err != nil {
+		t.Fatalf("Gunzip failed: %v", err)
+	}
+
+	if err := h.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	if err := h.Expect("resp.gzip.os", "==", "255"); err == nil {
+		t.Error("expected gzip fields of the previous message to be cleared")
+	}
+}
+
+func TestTxResp_Range(t *testing.T) {
+	conn := newMockConn("")
+	logger := logging.NewLogger("test")
+	h := New(conn, logger)
+
+	r, err := ParseByteRange("2-5/10")
+	if err != nil {
+		t.Fatalf("ParseByteRange failed: %v", err)
+	}
+	err = h.TxResp(&TxRespOptions{
+		Status: 206,
+		Body:   []byte("0123456789"),
+		Range:  &r,
+	})
+	if err != nil {
+		t.Fatalf("TxResp with Range failed: %v", err)
+	}
+
+	out := conn.Written()
+	if !strings.Contains(out, "Content-Range: bytes 2-5/10\r\n") {
+		t.Errorf("Expected Content-Range header, got %q", out)
+	}
+	if !strings.HasSuffix(out, "\r\n\r\n2345") {
+		t.Errorf("Expected sliced body, got %q", out)
+	}
+
+	h2 := New(newMockConn(out), logger)
+	if err := h2.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	for field, want := range map[string]string{
+		"resp.range.start": "2",
+		"resp.range.end":   "5",
+		"resp.range.total": "10",
+	} {
+		if err := h2.Expect(field, "==", want); err != nil {
+			t.Errorf("%s: %v", field, err)
+		}
+	}
+
+	for _, bad := range []string{"5-2/10", "0-9/9", "0-4", "a-b/c"} {
+		if _, err := ParseByteRange(bad); err == nil {
+			t.Errorf("ParseByteRange(%q): expected error", bad)
+		}
+	}
+}
+
+func TestRxResp_EOFDelimitedBody(t *testing.T) {
+	data := "HTTP/1.0 200 OK\r\n" +
+		"Server: test\r\n" +
+		"\r\n" +
+		"body until close"
+
+	h := New(newMockConn(data), logging.NewLogger("test"))
+	if err := h.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	if string(h.Body) != "body until close" {
+		t.Errorf("Expected EOF-delimited body, got %q", h.Body)
+	}
+	if err := h.Expect("resp.proto", "==", "HTTP/1.0"); err != nil {
+		t.Error(err)
+	}
+	if err := h.ExpectClose(); err != nil {
+		t.Errorf("ExpectClose after EOF: %v", err)
+	}
+}
+
+func TestTxReq_HTTP10NoChunked(t *testing.T) {
+	h := New(newMockConn(""), logging.NewLogger("test"))
+	err := h.TxReq(&TxReqOptions{Proto: "HTTP/1.0", Body: []byte("x"), Chunked: true})
+	if err == nil {
+		t.Error("Expected error for chunked HTTP/1.0 request")
+	}
+}
+
+func TestExpectClose_DataPending(t *testing.T) {
+	h := New(newMockConn("HTTP/1.1 200 OK\r\n"), logging.NewLogger("test"))
+	if err := h.ExpectClose(); err == nil {
+		t.Error("Expected ExpectClose to fail when data is pending")
+	}
+}
+
+func TestRxResp_InterimResponses(t *testing.T) {
+	data := "HTTP/1.1 100 Continue\r\n" +
+		"\r\n" +
+		"HTTP/1.1 103 Early Hints\r\n" +
+		"Link: </style.css>; rel=preload\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 2\r\n" +
+		"\r\n" +
+		"ok"
+
+	h := New(newMockConn(data), logging.NewLogger("test"))
+	if err := h.RxResp(&RxRespOptions{Interim: true}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+
+	checks := map[string]string{
+		"resp.status":               "200",
+		"resp.body":                 "ok",
+		"resp.interim.count":        "2",
+		"resp.interim[0].status":    "100",
+		"resp.interim[1].status":    "103",
+		"resp.interim[1].reason":    "Early Hints",
+		"resp.interim[1].http.link": "</style.css>; rel=preload",
+	}
+	for field, want := range checks {
+		if err := h.Expect(field, "==", want); err != nil {
+			t.Errorf("%s: %v", field, err)
+		}
+	}
+	if err := h.Expect("resp.interim[2].status", "==", "100"); err == nil {
+		t.Error("Expected error for missing interim response")
+	}
+}
+
+func TestConnectTunnel(t *testing.T) {
+	conn := newMockConn("HTTP/1.1 200 Connection established\r\n\r\ntunneled")
+	h := New(conn, logging.NewLogger("test"))
+
+	if err := h.TxReq(&TxReqOptions{Method: "CONNECT", URL: "example.com:443"}); err != nil {
+		t.Fatalf("TxReq failed: %v", err)
+	}
+	out := conn.Written()
+	if !strings.HasPrefix(out, "CONNECT example.com:443 HTTP/1.1\r\n") {
+		t.Errorf("Unexpected request line: %q", out)
+	}
+	if !strings.Contains(out, "Host: example.com:443\r\n") {
+		t.Errorf("Expected Host to match the authority, got %q", out)
+	}
+
+	if err := h.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	if h.BodyLen != 0 {
+		t.Errorf("Expected no body on CONNECT 200, got %q", h.Body)
+	}
+
+	// Bytes after the response belong to the tunnel
+	data, err := h.Recv(8)
+	if err != nil || string(data) != "tunneled" {
+		t.Errorf("Expected tunneled bytes, got %q (%v)", data, err)
+	}
+}
+
+func TestHandler_Tunneled(t *testing.T) {
+	data := "HTTP/1.1 200 Connection established\r\n\r\n" +
+		"HTTP/1.1 204 No Content\r\n\r\n"
+	conn := newMockConn(data)
+	handler := NewHandler(New(conn, logging.NewLogger("test")))
+
+	spec := "txreq -method CONNECT -url example.com:443\n" +
+		"rxresp\n" +
+		"tunneled txreq -url /inner|||rxresp|||expect resp.status == 204\n"
+	if err := handler.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if !strings.Contains(conn.Written(), "GET /inner HTTP/1.1\r\n") {
+		t.Errorf("Expected the nested request on the tunnel, got %q", conn.Written())
+	}
+}
+
+func TestHandler_NonFatal(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), "", time.Second)
+
+	handler := NewHandler(New(newMockConn(data), logger))
+	handler.SetContext(ctx)
+
+	spec := "rxresp\n" +
+		"non_fatal\n" +
+		"expect resp.status == 404\n" +
+		"fatal\n" +
+		"expect resp.status == 200\n"
+	if err := handler.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if n := len(ctx.SoftFailures()); n != 1 {
+		t.Errorf("Expected 1 soft failure, got %d", n)
+	}
+
+	if err := handler.ProcessSpec("expect resp.status == 404"); err == nil {
+		t.Error("Expected failure after fatal")
+	}
+}
+
+func TestRxReqHdrsBody_Split(t *testing.T) {
+	data := "POST /upload HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello"
+
+	h := New(newMockConn(data), logging.NewLogger("test"))
+	if err := h.RxReqHdrs(&RxReqOptions{}); err != nil {
+		t.Fatalf("RxReqHdrs failed: %v", err)
+	}
+	if h.Method != "POST" || h.BodyLen != 0 {
+		t.Errorf("Expected headers only, got method %s bodylen %d", h.Method, h.BodyLen)
+	}
+
+	if err := h.RxReqBody(&RxReqOptions{}); err != nil {
+		t.Fatalf("RxReqBody failed: %v", err)
+	}
+	if string(h.Body) != "hello" {
+		t.Errorf("Expected body hello, got %q", h.Body)
+	}
+	if h.GetRequestHeader("Host") != "example.com" {
+		t.Error("Headers lost after RxReqBody")
+	}
+}
+
+func TestRxReq_HeaderLimits(t *testing.T) {
+	data := "GET / HTTP/1.1\r\n" +
+		"A: 1\r\n" +
+		"B: 2\r\n" +
+		"X-Long: 0123456789\r\n" +
+		"\r\n"
+
+	h := New(newMockConn(data), logging.NewLogger("test"))
+	if err := h.RxReq(&RxReqOptions{MaxHdrs: 2}); err == nil {
+		t.Error("Expected error for too many headers")
+	}
+
+	h = New(newMockConn(data), logging.NewLogger("test"))
+	if err := h.RxReq(&RxReqOptions{MaxHdrLen: 10}); err == nil {
+		t.Error("Expected error for long header line")
+	}
+
+	h = New(newMockConn(data), logging.NewLogger("test"))
+	h.Timeout = time.Second
+	if err := h.RxReq(&RxReqOptions{MaxHdrs: 3, MaxHdrLen: 20, Timeout: time.Minute}); err != nil {
+		t.Errorf("RxReq within limits failed: %v", err)
+	}
+	if h.Timeout != time.Second {
+		t.Errorf("Expected timeout to be restored, got %v", h.Timeout)
+	}
+}
+
+func TestRecv_UntilPattern(t *testing.T) {
+	data := "+OK ready\r\n-ERR bad\r\n"
+
+	h := New(newMockConn(data), logging.NewLogger("test"))
+	if _, err := h.RecvUntil("\r\n", 0); err != nil {
+		t.Fatalf("RecvUntil failed: %v", err)
+	}
+	if err := h.Expect("recv", "==", "+OK ready\r\n"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("recv.len", "==", "11"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := h.RecvUntil("\r\n", 4); err == nil {
+		t.Error("Expected error when pattern exceeds byte limit")
+	}
+
+	h = New(newMockConn(data), logging.NewLogger("test"))
+	if _, err := h.RecvUntil("DONE", 0); err == nil {
+		t.Error("Expected error when connection closes before pattern")
+	}
+	if err := h.Expect("recv", "~", "ERR"); err != nil {
+		t.Errorf("Partial data not exposed: %v", err)
+	}
+}
+
+func TestSendFrom_HdrFrom(t *testing.T) {
+	tmpDir := t.TempDir()
+	raw := "GET /x HTTP/1.1\r\nHost: a\r\n\r\n"
+	if err := os.WriteFile(filepath.Join(tmpDir, "req.raw"), []byte(raw), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "hdrs.txt"), []byte("X-A: 1\nX-A: 2\r\nBad Header\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), tmpDir, time.Second)
+
+	conn := newMockConn("")
+	handler := NewHandler(New(conn, logger))
+	handler.SetContext(ctx)
+
+	if err := handler.ProcessCommand("sendfrom req.raw"); err != nil {
+		t.Fatalf("sendfrom failed: %v", err)
+	}
+	if got := conn.Written(); got != raw {
+		t.Errorf("Expected file contents sent verbatim, got %q", got)
+	}
+
+	conn = newMockConn("")
+	handler.HTTP.SetConn(conn)
+	if err := handler.ProcessCommand("txreq -nouseragent -hdrfrom hdrs.txt"); err != nil {
+		t.Fatalf("txreq -hdrfrom failed: %v", err)
+	}
+	if !strings.Contains(conn.Written(), "X-A: 1\r\nX-A: 2\r\nBad Header\r\n") {
+		t.Errorf("Expected header lines in order, got %q", conn.Written())
+	}
+}
+
+func TestWriteBody(t *testing.T) {
+	tmpDir := t.TempDir()
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), tmpDir, time.Second)
+
+	h := New(newMockConn(""), logger)
+	h.Name = "c1"
+	handler := NewHandler(h)
+	handler.SetContext(ctx)
+
+	h.Body = []byte("abc")
+	if err := handler.ProcessCommand("write_body body.bin"); err != nil {
+		t.Fatalf("write_body failed: %v", err)
+	}
+	h.Body = []byte("def")
+	if err := handler.ProcessCommand("write_body -append body.bin"); err != nil {
+		t.Fatalf("write_body -append failed: %v", err)
+	}
+
+	path := filepath.Join(tmpDir, "body.bin")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "abcdef" {
+		t.Errorf("Expected abcdef, got %q", data)
+	}
+	if got, _ := ctx.Macros.Get("c1_body_file"); got != path {
+		t.Errorf("Expected c1_body_file=%s, got %q", path, got)
+	}
+}
+
+func TestExpect_BodyChecksum(t *testing.T) {
+	h := New(newMockConn(""), logging.NewLogger("test"))
+	h.Body = []byte("hello")
+	h.BodyLen = len(h.Body)
+
+	if err := h.Expect("resp.body.md5", "==", "5d41402abc4b2a76b9719d911017c592"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("req.body.sha256", "==", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("resp.body.decoded.sha1", "==", "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("resp.body.sha3", "==", ""); err == nil {
+		t.Error("Expected error for unknown checksum")
+	}
+	if err := h.Expect("resp.bodylen.md5", "==", ""); err == nil {
+		t.Error("Expected error for checksum of bodylen")
+	}
+}
+
+func TestTxResp_CacheDates(t *testing.T) {
+	conn := newMockConn("")
+	h := New(conn, logging.NewLogger("test"))
+	h.Clock = func() time.Time { return time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) }
+	handler := NewHandler(h)
+
+	if err := handler.ProcessCommand("txresp -date-offset -1h -age 3 -expires 10m"); err != nil {
+		t.Fatalf("txresp failed: %v", err)
+	}
+	written := conn.Written()
+	for _, want := range []string{
+		"Date: Mon, 01 Jan 2024 11:00:00 GMT\r\n",
+		"Age: 3\r\n",
+		"Expires: Mon, 01 Jan 2024 11:10:00 GMT\r\n",
+	} {
+		if !strings.Contains(written, want) {
+			t.Errorf("Expected %q in response, got %q", want, written)
+		}
+	}
+
+	if err := h.Expect("resp.http.age", "-within", "2 5"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("resp.http.age", "-within", "4 5"); err == nil {
+		t.Error("Expected -within to fail outside the range")
+	}
+}
+
+func TestTiming_FieldsAndMacros(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), "", time.Second)
+
+	h := New(newMockConn(data), logger)
+	h.Name = "c1"
+	h.Timing.Connect = 3 * time.Millisecond
+	handler := NewHandler(h)
+	handler.SetContext(ctx)
+
+	if err := handler.ProcessSpec("txreq\nrxresp\n"); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+
+	if h.Timing.TTFB <= 0 || h.Timing.Headers < h.Timing.TTFB || h.Timing.Total < h.Timing.Headers {
+		t.Errorf("Inconsistent timings: %+v", h.Timing)
+	}
+	if err := h.Expect("timing.connect", "==", "0.003000"); err != nil {
+		t.Error(err)
+	}
+	if err := h.Expect("timing.total", "<", "1s"); err != nil {
+		t.Error(err)
+	}
+	if _, err := h.getField("timing.bogus"); err == nil {
+		t.Error("Expected error for unknown timing field")
+	}
+	if v, ok := ctx.Macros.Get("c1_timing_ttfb"); !ok || v == "" {
+		t.Error("Expected c1_timing_ttfb macro to be defined")
+	}
+}
+
+func TestSetvar_ExpandsOnce(t *testing.T) {
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), "", time.Second)
+	ctx.Macros.Define("name", "world")
+
+	handler := NewHandler(New(newMockConn(""), logger))
+	handler.SetContext(ctx)
+	if err := handler.ProcessSpec("setvar greeting \"hello ${name}\"\nsetvar literal \"$${name}\"\n"); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	for name, want := range map[string]string{"greeting": "hello world", "literal": "${name}"} {
+		if got, _ := ctx.Var(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTxReq_Smuggling(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{
+			// CL.TE: both headers, in command order, chunked body
+			"txreq -nohost -nouseragent -method POST -cl 4 -chunked -body abc",
+			"POST / HTTP/1.1\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		},
+		{
+			// TE first, explicit TE replaces the automatic one
+			"txreq -nohost -nouseragent -te chunked -cl 4 -chunked -body abc",
+			"GET / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 4\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		},
+		{
+			// Duplicate and padded Content-Length, body sent as is
+			"txreq -nohost -nouseragent -cl 3 -cl 007 -body abc",
+			"GET / HTTP/1.1\r\nContent-Length: 3\r\nContent-Length: 007\r\n\r\nabc",
+		},
+		{
+			"txreq -nohost -nouseragent -te xchunked -body abc",
+			"GET / HTTP/1.1\r\nTransfer-Encoding: xchunked\r\nContent-Length: 3\r\n\r\nabc",
+		},
+		{
+			// obs-fold continuation line
+			`txreq -nohost -nouseragent -foldhdr "Transfer-Encoding:" chunked -chunked -body abc`,
+			"GET / HTTP/1.1\r\nTransfer-Encoding:\r\n chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		conn := newMockConn("")
+		handler := NewHandler(New(conn, logging.NewLogger("test")))
+		if err := handler.ProcessCommand(tt.cmd); err != nil {
+			t.Errorf("%s: %v", tt.cmd, err)
+			continue
+		}
+		if got := conn.Written(); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	handler := NewHandler(New(newMockConn(""), logging.NewLogger("test")))
+	if err := handler.ProcessCommand("txreq -foldhdr X-A:"); err == nil {
+		t.Error("Expected error for -foldhdr without continuation")
+	}
+}
+
+func TestTx_LineEndings(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{
+			"txreq -nohost -nouseragent -lf -hdrfrom hdrs.txt -body ab",
+			"GET / HTTP/1.1\nX-A: 1\nContent-Length: 2\n\nab",
+		},
+		{
+			"txreq -nohost -nouseragent -nofinalcrlf -hdrlf X-A:1 -hdrindent X-B:2",
+			"GET / HTTP/1.1\r\nX-A:1\n X-B:2\r\n",
+		},
+		{
+			`txreq -nohost -nouseragent -hdrnul "X-A: a\0b" -hdrnul "X-B: c"`,
+			"GET / HTTP/1.1\r\nX-A: a\x00b\r\nX-B: c\x00\r\n\r\n",
+		},
+		{
+			"txresp -noserver -lf -hdrindent X-A:1 -body ab",
+			"HTTP/1.1 200 OK\n X-A:1\nContent-Length: 2\n\nab",
+		},
+		{
+			"txresp -noserver -nolen -nofinalcrlf -hdrlf X-A:1",
+			"HTTP/1.1 200 OK\r\nX-A:1\n",
+		},
+	}
+
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "hdrs.txt"), []byte("X-A: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), tmpDir, time.Second)
+
+	for _, tt := range tests {
+		conn := newMockConn("")
+		handler := NewHandler(New(conn, logger))
+		handler.SetContext(ctx)
+		if err := handler.ProcessCommand(tt.cmd); err != nil {
+			t.Errorf("%s: %v", tt.cmd, err)
+			continue
+		}
+		if got := conn.Written(); got != tt.want {
+			t.Errorf("%s:\n got %q\nwant %q", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestTxReq_RequestLine(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{`txreq -nouseragent -absolute -url /a -hdr "Host: example.com"`, "GET http://example.com/a HTTP/1.1\r\n"},
+		{`txreq -nouseragent -absolute -url /a -hdr "host: example.com"`, "GET http://example.com/a HTTP/1.1\r\n"},
+		{"txreq -nouseragent -nohost -absolute", "GET http://localhost/ HTTP/1.1\r\n"},
+		{"txreq -nouseragent -method OPTIONS -asterisk", "OPTIONS * HTTP/1.1\r\n"},
+		{"txreq -nouseragent -url /ab -urllen 6", "GET /abxxx HTTP/1.1\r\n"},
+		{"txreq -nouseragent -nosp url -nosp proto -url /a", "GET/aHTTP/1.1\r\n"},
+		{"txreq -nouseragent -proto http/1.1", "GET / http/1.1\r\n"},
+		{"txreq -nouseragent -proto HTTP/9.9", "GET / HTTP/9.9\r\n"},
+	}
+
+	for _, tt := range tests {
+		conn := newMockConn("")
+		handler := NewHandler(New(conn, logging.NewLogger("test")))
+		if err := handler.ProcessCommand(tt.cmd); err != nil {
+			t.Errorf("%s: %v", tt.cmd, err)
+			continue
+		}
+		if got := conn.Written(); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("%s:\n got %q\nwant prefix %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	handler := NewHandler(New(newMockConn(""), logging.NewLogger("test")))
+	if err := handler.ProcessCommand("txreq -nosp method"); err == nil {
+		t.Error("Expected error for invalid -nosp")
+	}
+}
+
+func TestTxResp_FramingAnomalies(t *testing.T) {
+	conn := newMockConn("")
+	handler := NewHandler(New(conn, logging.NewLogger("test")))
+	if err := handler.ProcessCommand(`txresp -noserver -preamble "junk\r\n\x01" -extra-response -body ab`); err != nil {
+		t.Fatal(err)
+	}
+	want := "junk\r\n\x01HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nab" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nextra"
+	if got := conn.Written(); got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+
+	conn = newMockConn("")
+	handler = NewHandler(New(conn, logging.NewLogger("test")))
+	if err := handler.ProcessCommand("txresp -noserver -close-after-headers -body abc"); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.Written(); got != "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\n" {
+		t.Errorf("got %q, want headers only", got)
+	}
+	if !conn.closed {
+		t.Error("Expected connection to be closed")
+	}
+}
+
+func TestHandler_MacroExpansion(t *testing.T) {
+	logger := logging.NewLogger("test")
+	macros := vtc.NewMacroStore()
+	macros.DefineIn("s1", "port", "8080")
+	ctx := vtc.NewExecContext(logger, macros, "", time.Second)
+
+	conn := newMockConn("")
+	handler := NewHandler(New(conn, logger))
+	handler.SetContext(ctx)
+
+	spec := `txreq -url "/${s1_port}" -hdr "X-Port: ${s1_port}" -hdr "X-Lit: $${s1_port}" -body "${s1_port}"`
+	if err := handler.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	out := conn.Written()
+	for _, want := range []string{"GET /8080 HTTP/1.1\r\n", "X-Port: 8080\r\n", "X-Lit: ${s1_port}\r\n", "\r\n\r\n8080"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in %q", want, out)
+		}
+	}
+
+	// Lines are expanded against the snapshot taken when the spec started
+	if err := handler.ProcessSpec(`txreq -hdr "X-Gone: ${undefined}"`); err == nil {
+		t.Error("Expected undefined macro to fail the command")
+	}
+
+	// Already expanded specs run as-is
+	conn = newMockConn("")
+	handler = NewHandler(New(conn, logger))
+	handler.SetContext(ctx)
+	handler.Expanded = true
+	if err := handler.ProcessSpec(`txreq -hdr "X-Lit: ${s1_port}"`); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if out := conn.Written(); !strings.Contains(out, "X-Lit: ${s1_port}\r\n") {
+		t.Errorf("Expected literal macro in %q", out)
+	}
+}
+
+func TestHandler_Verbatim(t *testing.T) {
+	conn := newMockConn("")
+	handler := NewHandler(New(conn, logging.NewLogger("test")))
+
+	body := "{\"a\": 1}\n  ${not_a_macro} # |||"
+	if err := handler.ProcessSpec("txreq -body " + util.QuoteVerbatim(body) + " -hdr \"X-After: 1\""); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	out := conn.Written()
+	for _, want := range []string{"X-After: 1\r\n", "Content-Length: 31\r\n", "\r\n\r\n" + body} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected %q in %q", want, out)
+		}
+	}
+}
+
+func TestHandler_Capture(t *testing.T) {
+	data := "HTTP/1.1 200 OK\r\nX-Req-Id: abc123\r\nContent-Length: 6\r\n\r\nabc123"
+	logger := logging.NewLogger("test")
+	macros := vtc.NewMacroStore()
+	ctx := vtc.NewExecContext(logger, macros, "", time.Second)
+
+	handler := NewHandler(New(newMockConn(data), logger))
+	handler.SetContext(ctx)
+
+	spec := "rxresp\n" +
+		"capture resp.http.x-req-id req_id\n" +
+		"expect resp.body == ${req_id}\n"
+	if err := handler.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if v, _ := macros.Get("req_id"); v != "abc123" {
+		t.Errorf("Expected req_id to reach the test's macros, got %q", v)
+	}
+
+	if err := handler.ProcessCommand("capture resp.bogus x"); err == nil {
+		t.Error("Expected error for unknown field")
+	}
+	if err := handler.ProcessCommand("capture resp.status"); err == nil {
+		t.Error("Expected error for missing macro name")
+	}
+}
+
+func TestHandler_Repeat(t *testing.T) {
+	logger := logging.NewLogger("test")
+	macros := vtc.NewMacroStore()
+	macros.Define("n", "2")
+	ctx := vtc.NewExecContext(logger, macros, "", time.Second)
+
+	conn := newMockConn("")
+	handler := NewHandler(New(conn, logger))
+	handler.SetContext(ctx)
+
+	// Nested blocks number their own iterations, and may take their
+	// count from the enclosing one
+	spec := "repeat ${n} {\n" +
+		"txreq -url \"/o${iteration}\"\n" +
+		"repeat ${iteration} {\n" +
+		"txreq -url \"/i${iteration}\"\n" +
+		"}\n" +
+		"}\n" +
+		"txreq -url /last\n"
+	if err := handler.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	var urls []string
+	for _, line := range strings.Split(conn.Written(), "\r\n") {
+		if strings.HasPrefix(line, "GET ") {
+			urls = append(urls, strings.Fields(line)[1])
+		}
+	}
+	if got, want := strings.Join(urls, " "), "/o1 /i1 /o2 /i1 /i2 /last"; got != want {
+		t.Errorf("Expected requests %q, got %q", want, got)
+	}
+
+	for _, spec := range []string{
+		"repeat 2 {\ntxreq\n",
+		"repeat x {\ntxreq\n}",
+		"repeat -1 {\ntxreq\n}",
+		"txreq -url /${iteration}",
+		"repeat 2 {\nbogus\n}",
+	} {
+		handler := NewHandler(New(newMockConn(""), logger))
+		handler.SetContext(ctx)
+		if err := handler.ProcessSpec(spec); err == nil {
+			t.Errorf("ProcessSpec(%q): expected an error", spec)
+		}
+	}
+}
+
+func TestRxResp_Spool(t *testing.T) {
+	tmpDir := t.TempDir()
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), tmpDir, time.Second)
+
+	body := strings.Repeat("0123456789", 10000) + "end"
+	data := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"
+	h := New(newMockConn(data), logger)
+	h.Name = "c1"
+	handler := NewHandler(h)
+	handler.SetContext(ctx)
+
+	spec := "rxresp -spool 1K\n" +
+		"expect resp.bodylen == 100003\n" +
+		"expect resp.body.md5 == " + fmt.Sprintf("%x", md5.Sum([]byte(body))) + "\n" +
+		"expect resp.body.head.12 == 012345678901\n" +
+		"expect resp.body.tail.5 == 89end\n" +
+		"write_body copy.bin\n"
+	if err := handler.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if h.Body != nil || h.BodyFile == "" || filepath.Dir(h.BodyFile) != filepath.Join(tmpDir, "c1") {
+		t.Errorf("Expected the body to be spooled to ${tmpdir}/c1, got file %q", h.BodyFile)
+	}
+	if copied, err := os.ReadFile(filepath.Join(tmpDir, "copy.bin")); err != nil || string(copied) != body {
+		t.Errorf("Expected write_body to copy the spooled body, got %d bytes, %v", len(copied), err)
+	}
+	if err := h.Expect("resp.body", "==", body); err == nil {
+		t.Error("Expected an error comparing a spooled body")
+	}
+	if err := handler.ProcessCommand("gunzip"); err == nil {
+		t.Error("Expected gunzip to fail on a spooled body")
+	}
+
+	spooled := h.BodyFile
+	if err := handler.ProcessSpec("rxresp -spool 1K\nexpect resp.body == abc\nexpect resp.body.tail.2 == bc\n"); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if h.BodyFile != "" {
+		t.Errorf("Expected a small body to stay in memory, got file %q", h.BodyFile)
+	}
+	if _, err := os.Stat(spooled); !os.IsNotExist(err) {
+		t.Errorf("Expected the previous spool file to be removed, got %v", err)
+	}
+
+	if err := handler.ProcessCommand("rxresp -spool 0"); err == nil {
+		t.Error("Expected error for -spool 0")
+	}
+}
+
+func TestTx_VectoredWrites(t *testing.T) {
+	n := 3*len(bodyPattern) + 123
+	if got := bytes.Join(generatedBody(n), nil); !bytes.Equal(got, GenerateBody(n, false)) {
+		t.Fatal("Expected the streamed body to match GenerateBody")
+	}
+
+	conn := newMockConn("")
+	h := New(conn, logging.NewLogger("test"))
+	handler := NewHandler(h)
+	if err := handler.ProcessCommand("txresp -body \"hello world\" -flush 5,0"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.deadlines != 2 || !strings.HasSuffix(conn.Written(), "\r\n\r\nhello world") {
+		t.Errorf("Expected 2 writes of the response, got %d: %q", conn.deadlines, conn.Written())
+	}
+
+	conn = newMockConn("")
+	h = New(conn, logging.NewLogger("test"))
+	handler = NewHandler(h)
+	if err := handler.ProcessCommand("txreq -bodylen 2000000 -chunked -flush 1000000"); err != nil {
+		t.Fatal(err)
+	}
+	want := "\r\n\r\n1e8480\r\n" + string(GenerateBody(2000000, false)) + "\r\n0\r\n\r\n"
+	if !strings.HasSuffix(conn.Written(), want) {
+		t.Error("Expected the generated body in a single chunk")
+	}
+	if conn.deadlines != 3 {
+		t.Errorf("Expected 3 writes, got %d", conn.deadlines)
+	}
+	if h.Body != nil || h.BodyLen != 2000000 {
+		t.Errorf("Expected a streamed body of 2000000 bytes, got %d bytes kept, bodylen %d", len(h.Body), h.BodyLen)
+	}
+
+	conn = newMockConn("")
+	handler = NewHandler(New(conn, logging.NewLogger("test")))
+	if err := handler.ProcessCommand("txresp -bodylen 2000000"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.deadlines != 1 || !strings.Contains(conn.Written(), "Content-Length: 2000000\r\n") {
+		t.Errorf("Expected the response in one write, got %d", conn.deadlines)
+	}
+
+	if err := handler.ProcessCommand("txresp -flush 1,x"); err == nil {
+		t.Error("Expected error for invalid -flush")
+	}
+}
+
+func TestHandler_TxSegment(t *testing.T) {
+	conn := newMockConn("")
+	h := New(conn, logging.NewLogger("test"))
+	handler := NewHandler(h)
+
+	if err := handler.ProcessSpec("txsegment 7\nsend abcdefghijklmnop\n"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.deadlines != 3 || conn.Written() != "abcdefghijklmnop" {
+		t.Errorf("Expected 3 writes of abcdefghijklmnop, got %d of %q", conn.deadlines, conn.Written())
+	}
+
+	conn.deadlines = 0
+	if err := handler.ProcessCommand("txresp -body \"hello world\""); err != nil {
+		t.Fatal(err)
+	}
+	sent := len(conn.Written()) - len("abcdefghijklmnop")
+	if want := (sent + 6) / 7; conn.deadlines != want {
+		t.Errorf("Expected the response in %d writes, got %d", want, conn.deadlines)
+	}
+
+	conn.deadlines = 0
+	start := time.Now()
+	if err := handler.ProcessSpec("txsegment 1 10ms\nsend abc\n"); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); conn.deadlines != 3 || elapsed < 20*time.Millisecond {
+		t.Errorf("Expected 3 writes 10ms apart, got %d in %v", conn.deadlines, elapsed)
+	}
+
+	conn.deadlines = 0
+	if err := handler.ProcessSpec("txsegment 0\nsend abc\n"); err != nil {
+		t.Fatal(err)
+	}
+	if conn.deadlines != 1 || h.SegmentDelay != 0 {
+		t.Errorf("Expected whole writes after txsegment 0, got %d writes", conn.deadlines)
+	}
+
+	if err := handler.ProcessCommand("txsegment -1"); err == nil {
+		t.Error("Expected error for a negative size")
+	}
+}
+
+func TestExpect_ConnReuse(t *testing.T) {
+	data := "GET /a HTTP/1.1\r\n\r\nGET /b HTTP/1.1\r\n\r\n"
+	h := New(newMockConn(data), logging.NewLogger("test"))
+	h.Stats = &session.ConnStats{Seq: 2}
+	h.ConnCount = func() int { return 3 }
+
+	if err := h.RxReq(&RxReqOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{"conn.reused": "false", "conn.requests": "1", "conn.seq": "2", "conn.count": "3"} {
+		if err := h.Expect(field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+	if err := h.RxReq(&RxReqOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Expect("conn.reused", "==", "true"); err != nil {
+		t.Error(err)
+	}
+
+	h.SetConn(newMockConn(""))
+	if err := h.Expect("conn.requests", "==", "0"); err != nil {
+		t.Errorf("Expected new stats for a new connection: %v", err)
+	}
+}
+
+// TestDocs checks that the documented options of each command are the
+// ones its parser accepts
+func TestDocs(t *testing.T) {
+	parsers := map[string]string{
+		"txreq":     "handleTxReq",
+		"txresp":    "handleTxResp",
+		"rxreq":     "parseRxReqOptions",
+		"rxreqhdrs": "parseRxReqOptions",
+		"rxreqbody": "parseRxReqOptions",
+		"rxresp":    "handleRxResp",
+		"recv":      "handleRecv",
+	}
+
+	file, err := parser.ParseFile(token.NewFileSet(), "handler.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(map[string][]string)
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		ast.Inspect(fn, func(n ast.Node) bool {
+			clause, ok := n.(*ast.CaseClause)
+			if !ok {
+				return true
+			}
+			for _, expr := range clause.List {
+				if lit, ok := expr.(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					if opt, _ := strconv.Unquote(lit.Value); strings.HasPrefix(opt, "-") {
+						accepted[fn.Name.Name] = append(accepted[fn.Name.Name], opt)
+					}
+				}
+			}
+			return true
+		})
+	}
+
+	for _, doc := range Docs {
+		fn, ok := parsers[doc.Name]
+		if !ok {
+			if len(doc.Options) > 0 {
+				t.Errorf("%s: options documented but no parser to check them against", doc.Name)
+			}
+			continue
+		}
+		var documented []string
+		for _, opt := range doc.Options {
+			documented = append(documented, opt.Name)
+		}
+		want := append([]string(nil), accepted[fn]...)
+		sort.Strings(documented)
+		sort.Strings(want)
+		if strings.Join(documented, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: documented options\n%v\nparser accepts\n%v", doc.Name, documented, want)
+		}
+	}
+}
+
+func TestRxResp_HTTP10ClosesConnection(t *testing.T) {
+	logger := logging.NewLogger("test")
+	resp := "HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\nok"
+
+	conn := newMockConn(resp)
+	h := New(conn, logger)
+	if err := h.TxReq(&TxReqOptions{Proto: "HTTP/1.0"}); err != nil {
+		t.Fatalf("TxReq failed: %v", err)
+	}
+	if err := h.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	if !conn.closed {
+		t.Error("expected the connection to be closed after an HTTP/1.0 exchange")
+	}
+	if err := h.TxReq(&TxReqOptions{Proto: "HTTP/1.0"}); err == nil {
+		t.Error("expected txreq on the closed connection to fail")
+	}
+
+	// Connection: keep-alive keeps it open
+	conn = newMockConn(resp)
+	h = New(conn, logger)
+	err := h.TxReq(&TxReqOptions{
+		Proto:   "HTTP/1.0",
+		Headers: map[string]string{"Connection": "Keep-Alive"},
+	})
+	if err != nil {
+		t.Fatalf("TxReq failed: %v", err)
+	}
+	if err := h.RxResp(&RxRespOptions{}); err != nil {
+		t.Fatalf("RxResp failed: %v", err)
+	}
+	if conn.closed {
+		t.Error("expected Connection: keep-alive to keep the connection open")
+	}
+}
@@ -0,0 +1,50 @@
+package http1
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// Messages are logged the way VTest2 logs them, so that logs can be
+// compared when porting tests: the start line and headers at info level,
+// the body length, an excerpt of the body when logging.BodyExcerpt is
+// set, and a hexdump of the body at debug level.
+
+// logHead logs the parts of a received start line as http[ 0] to
+// http[ 2], then each header line
+func (h *HTTP) logHead(start [3]string, headers []string) {
+	for i, field := range start {
+		h.Logger.Dump(logging.LevelInfo, fmt.Sprintf("http[%2d] ", i), field, -1)
+	}
+	for i, line := range headers {
+		h.Logger.Dump(logging.LevelInfo, fmt.Sprintf("http[%2d] ", i+3), line, -1)
+	}
+}
+
+// logTx logs the start line and headers of a sent message, a line at a time
+func (h *HTTP) logTx(prefix string, head []byte) {
+	for _, line := range strings.Split(strings.TrimRight(string(head), "\r\n"), "\n") {
+		h.Logger.Dump(logging.LevelInfo, prefix, strings.TrimSuffix(line, "\r"), -1)
+	}
+}
+
+// logBody logs the length of the last body, its first bytes and a
+// hexdump. Only the head of a spooled body is at hand, and none of a
+// large generated one.
+func (h *HTTP) logBody() {
+	h.Logger.Log(logging.LevelInfo, "bodylen = %d", h.BodyLen)
+
+	body := h.Body
+	if body == nil {
+		body = h.bodyHead
+	}
+	if len(body) == 0 {
+		return
+	}
+	if n := logging.BodyExcerpt(); n > 0 {
+		h.Logger.Dump(logging.LevelInfo, "body", string(body), n)
+	}
+	h.Logger.Hexdump(logging.LevelDebug, "body", body)
+}
@@ -0,0 +1,103 @@
+package http1
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteRange describes a satisfied byte range as carried in Content-Range.
+// Total is -1 when the complete length is unknown ("*").
+type ByteRange struct {
+	Start int
+	End   int
+	Total int
+}
+
+// String formats the range as a Content-Range header value
+func (r ByteRange) String() string {
+	total := "*"
+	if r.Total >= 0 {
+		total = strconv.Itoa(r.Total)
+	}
+	return fmt.Sprintf("bytes %d-%d/%s", r.Start, r.End, total)
+}
+
+// ParseByteRange parses "<start>-<end>/<total>", optionally prefixed with
+// the "bytes " unit as found in a Content-Range header
+func ParseByteRange(s string) (ByteRange, error) {
+	var r ByteRange
+
+	spec := strings.TrimSpace(s)
+	spec = strings.TrimPrefix(spec, "bytes ")
+	spec = strings.TrimSpace(spec)
+
+	rangePart, totalPart, ok := strings.Cut(spec, "/")
+	if !ok {
+		return r, fmt.Errorf("invalid range %q: missing /total", s)
+	}
+	startPart, endPart, ok := strings.Cut(rangePart, "-")
+	if !ok {
+		return r, fmt.Errorf("invalid range %q: missing start-end", s)
+	}
+
+	var err error
+	if r.Start, err = strconv.Atoi(startPart); err != nil || r.Start < 0 {
+		return r, fmt.Errorf("invalid range start %q", startPart)
+	}
+	if r.End, err = strconv.Atoi(endPart); err != nil || r.End < r.Start {
+		return r, fmt.Errorf("invalid range end %q", endPart)
+	}
+	if totalPart == "*" {
+		r.Total = -1
+	} else if r.Total, err = strconv.Atoi(totalPart); err != nil || r.Total <= r.End {
+		return r, fmt.Errorf("invalid range total %q", totalPart)
+	}
+
+	return r, nil
+}
+
+// sliceRange returns the part of body selected by r. An empty body is
+// generated from the total length so "-range" works on its own.
+func sliceRange(body []byte, r ByteRange) ([]byte, error) {
+	if body == nil {
+		if r.Total < 0 {
+			return nil, fmt.Errorf("-range with unknown total requires a body")
+		}
+		body = GenerateBody(r.Total, false)
+	}
+	if r.End >= len(body) {
+		return nil, fmt.Errorf("range %d-%d exceeds body length %d", r.Start, r.End, len(body))
+	}
+	return body[r.Start : r.End+1], nil
+}
+
+// getRangeField retrieves start, end or total from the response Content-Range
+func (h *HTTP) getRangeField(parts []string) (string, error) {
+	if len(parts) < 3 {
+		return "", fmt.Errorf("missing range field name")
+	}
+
+	cr := h.GetResponseHeader("Content-Range")
+	if cr == "" {
+		return "", fmt.Errorf("no Content-Range header in response")
+	}
+	r, err := ParseByteRange(cr)
+	if err != nil {
+		return "", err
+	}
+
+	switch parts[2] {
+	case "start":
+		return strconv.Itoa(r.Start), nil
+	case "end":
+		return strconv.Itoa(r.End), nil
+	case "total":
+		if r.Total < 0 {
+			return "*", nil
+		}
+		return strconv.Itoa(r.Total), nil
+	default:
+		return "", fmt.Errorf("unknown range field: %s", parts[2])
+	}
+}
@@ -2,24 +2,55 @@ package http1
 
 import (
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // RxReqOptions contains options for receiving an HTTP request
 type RxReqOptions struct {
-	// Currently no options, but we keep this for future extensibility
+	Timeout   time.Duration // Override the I/O timeout for this command
+	MaxHdrs   int           // Fail if more headers are received (0 = no limit)
+	MaxHdrLen int           // Fail if a header line is longer (0 = no limit)
+	Spool     int64         // Spool a body longer than this to a file in SpoolDir (0 = never)
+	SpoolDir  string        // Directory for spooled bodies (default: os.TempDir)
 }
 
 // RxReq receives and parses an HTTP request
 func (h *HTTP) RxReq(opts *RxReqOptions) error {
+	defer h.overrideTimeout(opts.Timeout)()
+
+	if err := h.rxReqHdrs(opts); err != nil {
+		return err
+	}
+	return h.rxReqBody(opts)
+}
+
+// RxReqHdrs receives the request line and headers, leaving the body unread
+func (h *HTTP) RxReqHdrs(opts *RxReqOptions) error {
+	defer h.overrideTimeout(opts.Timeout)()
+	return h.rxReqHdrs(opts)
+}
+
+// RxReqBody receives the body of a request whose headers were read by RxReqHdrs
+func (h *HTTP) RxReqBody(opts *RxReqOptions) error {
+	defer h.overrideTimeout(opts.Timeout)()
+	return h.rxReqBody(opts)
+}
+
+func (h *HTTP) rxReqHdrs(opts *RxReqOptions) error {
 	h.ResetRequest()
+	h.rxRequest = true
+	h.startRx()
 
 	// Read request line
 	line, err := h.ReadLine()
 	if err != nil {
 		return fmt.Errorf("reading request line: %w", err)
 	}
+	h.markFirstByte()
+	h.Stats.Requests++
 
 	// Parse request line: METHOD URL PROTO
 	parts := strings.SplitN(line, " ", 3)
@@ -35,23 +66,42 @@ func (h *HTTP) RxReq(opts *RxReqOptions) error {
 	h.Logger.Log(3, "rxreq: %s %s", h.Method, h.URL)
 
 	// Read headers
-	err = h.readHeaders(true)
+	err = h.readHeaders(true, opts.MaxHdrs, opts.MaxHdrLen)
 	if err != nil {
 		return fmt.Errorf("reading headers: %w", err)
 	}
+	h.markHeaders()
+	h.logHead([3]string{h.Method, h.URL, h.Proto}, h.ReqHeaders)
+	return nil
+}
 
+func (h *HTTP) rxReqBody(opts *RxReqOptions) error {
 	// Read body if present
-	err = h.readBody(true)
+	err := h.readBody(true, &bodySpool{limit: opts.Spool, dir: opts.SpoolDir})
 	if err != nil {
 		return fmt.Errorf("reading body: %w", err)
 	}
+	h.markBody()
 
-	h.Logger.Log(4, "bodylen = %d", h.BodyLen)
+	h.logBody()
 	return nil
 }
 
-// readHeaders reads HTTP headers (common for requests and responses)
-func (h *HTTP) readHeaders(isRequest bool) error {
+// overrideTimeout sets the I/O timeout for a single command and returns a
+// function restoring the previous value. A zero duration changes nothing.
+func (h *HTTP) overrideTimeout(d time.Duration) func() {
+	if d <= 0 {
+		return func() {}
+	}
+	old := h.Timeout
+	h.Timeout = d
+	return func() { h.Timeout = old }
+}
+
+// readHeaders reads HTTP headers (common for requests and responses).
+// maxHdrs and maxHdrLen limit the header count and line length; 0 means
+// no limit.
+func (h *HTTP) readHeaders(isRequest bool, maxHdrs, maxHdrLen int) error {
 	var headers *[]string
 	if isRequest {
 		headers = &h.ReqHeaders
@@ -70,15 +120,22 @@ func (h *HTTP) readHeaders(isRequest bool) error {
 			break
 		}
 
+		if maxHdrLen > 0 && len(line) > maxHdrLen {
+			return fmt.Errorf("header line of %d bytes exceeds limit of %d", len(line), maxHdrLen)
+		}
+		if maxHdrs > 0 && len(*headers) >= maxHdrs {
+			return fmt.Errorf("more than %d headers", maxHdrs)
+		}
+
 		*headers = append(*headers, line)
-		h.Logger.Log(4, "Header: %s", line)
 	}
 
 	return nil
 }
 
-// readBody reads the HTTP body based on Content-Length or chunked encoding
-func (h *HTTP) readBody(isRequest bool) error {
+// readBody reads the HTTP body based on Content-Length or chunked
+// encoding into spool
+func (h *HTTP) readBody(isRequest bool, spool *bodySpool) error {
 	var contentLength int
 	var chunked bool
 	var header string
@@ -109,26 +166,33 @@ func (h *HTTP) readBody(isRequest bool) error {
 	chunked = strings.Contains(strings.ToLower(te), "chunked")
 
 	// Read body
-	var body []byte
 	var err error
-
 	if chunked {
 		// Read chunked body
-		body, err = h.ParseChunkedBody()
-		if err != nil {
-			return fmt.Errorf("reading chunked body: %w", err)
+		if err = h.copyChunkedBody(spool, spool.reader(h)); err != nil {
+			err = fmt.Errorf("reading chunked body: %w", err)
 		}
 	} else if contentLength > 0 {
 		// Read fixed-length body
-		body, err = h.ReadBytes(contentLength)
-		if err != nil {
-			return fmt.Errorf("reading body: %w", err)
+		if _, err = io.CopyN(spool, spool.reader(h), int64(contentLength)); err != nil {
+			err = fmt.Errorf("reading body: read bytes failed: %w", err)
+		} else {
+			h.Logger.Log(4, "Received %d bytes", contentLength)
+		}
+	} else if !isRequest && header == "" {
+		// Response without framing: body runs until the server closes
+		if _, err = io.Copy(spool, spool.reader(h)); err != nil {
+			err = fmt.Errorf("reading EOF-delimited body: %w", err)
+		} else {
+			h.Logger.Log(4, "Received %d bytes until EOF", spool.n)
 		}
 	}
+	if err != nil {
+		spool.discard()
+		return err
+	}
 
 	// Store the body as-is (don't auto-decompress)
 	// VTC tests expect manual decompression via the 'gunzip' command
-	h.Body = body
-	h.BodyLen = len(body)
-	return nil
+	return h.setReceivedBody(spool)
 }
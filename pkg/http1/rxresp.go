@@ -8,18 +8,84 @@ import (
 
 // RxRespOptions contains options for receiving an HTTP response
 type RxRespOptions struct {
-	NoObj bool // Don't read the body
+	NoObj   bool // Don't read the body
+	Interim bool // Collect 1xx responses and continue to the final response
+
+	Spool    int64  // Spool a body longer than this to a file in SpoolDir (0 = never)
+	SpoolDir string // Directory for spooled bodies (default: os.TempDir)
+}
+
+// InterimResponse is a 1xx response received ahead of the final response
+type InterimResponse struct {
+	Status  int
+	Reason  string
+	Headers []string
 }
 
 // RxResp receives and parses an HTTP response
 func (h *HTTP) RxResp(opts *RxRespOptions) error {
 	h.ResetResponse()
+	h.rxRequest = false
+	h.startRx()
+
+	if err := h.readStatusAndHeaders(); err != nil {
+		return err
+	}
+
+	// 101 switches protocols, so it is always the final response
+	for opts.Interim && h.Status >= 100 && h.Status < 200 && h.Status != 101 {
+		h.Interim = append(h.Interim, InterimResponse{
+			Status:  h.Status,
+			Reason:  h.Reason,
+			Headers: append([]string(nil), h.RespHeaders...),
+		})
+		h.RespHeaders = h.RespHeaders[:0]
+		if err := h.readStatusAndHeaders(); err != nil {
+			return err
+		}
+	}
+
+	h.markHeaders()
+
+	// A 2xx answer to CONNECT has no body: the connection is now a tunnel
+	if h.tunnelEstablished() {
+		h.Logger.Log(3, "rxresp: tunnel to %s established", h.URL)
+		return nil
+	}
+
+	// Read body if requested and conditions are met
+	if !opts.NoObj && !h.HeadMethod {
+		// Check if we should read a body
+		// For 1xx, 204, 304, don't read body
+		if h.Status < 200 || h.Status == 204 || h.Status == 304 {
+			h.Logger.Log(4, "No body expected for status %d", h.Status)
+		} else {
+			err := h.readBody(false, &bodySpool{limit: opts.Spool, dir: opts.SpoolDir})
+			if err != nil {
+				return fmt.Errorf("reading body: %w", err)
+			}
+			h.markBody()
+		}
+	}
+
+	h.logBody()
 
+	if h.lastExch {
+		h.Logger.Log(3, "rxresp: closing connection after HTTP/1.0 exchange")
+		h.closed = true
+		return h.Close()
+	}
+	return nil
+}
+
+// readStatusAndHeaders reads a status line and the following headers
+func (h *HTTP) readStatusAndHeaders() error {
 	// Read status line
 	line, err := h.ReadLine()
 	if err != nil {
 		return fmt.Errorf("reading status line: %w", err)
 	}
+	h.markFirstByte()
 
 	// Parse status line: PROTO STATUS REASON
 	parts := strings.SplitN(line, " ", 3)
@@ -43,25 +109,16 @@ func (h *HTTP) RxResp(opts *RxRespOptions) error {
 	h.Logger.Log(3, "rxresp: %d %s", h.Status, h.Reason)
 
 	// Read headers
-	err = h.readHeaders(false)
+	err = h.readHeaders(false, 0, 0)
 	if err != nil {
 		return fmt.Errorf("reading headers: %w", err)
 	}
+	h.logHead([3]string{h.Proto, strconv.Itoa(h.Status), h.Reason}, h.RespHeaders)
 
-	// Read body if requested and conditions are met
-	if !opts.NoObj && !h.HeadMethod {
-		// Check if we should read a body
-		// For 1xx, 204, 304, don't read body
-		if h.Status < 200 || h.Status == 204 || h.Status == 304 {
-			h.Logger.Log(4, "No body expected for status %d", h.Status)
-		} else {
-			err = h.readBody(false)
-			if err != nil {
-				return fmt.Errorf("reading body: %w", err)
-			}
-		}
-	}
-
-	h.Logger.Log(4, "bodylen = %d", h.BodyLen)
 	return nil
 }
+
+// tunnelEstablished reports whether the current response accepts a CONNECT
+func (h *HTTP) tunnelEstablished() bool {
+	return h.Method == "CONNECT" && h.Status >= 200 && h.Status < 300
+}
@@ -0,0 +1,185 @@
+package http1
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perbu/GTest/pkg/util"
+)
+
+// SpoolKeep is the number of bytes at the start and at the end of a body
+// spooled to disk that stay in memory for resp.body.head.N and
+// resp.body.tail.N
+const SpoolKeep = 64 * 1024
+
+// bodySpool receives a body in memory up to limit bytes, and in a
+// temporary file in dir once it grows beyond. A limit of 0 keeps the whole
+// body in memory.
+type bodySpool struct {
+	limit int64
+	dir   string
+
+	mem  []byte
+	file *os.File
+	n    int64
+	head []byte // First SpoolKeep bytes, once spooled
+	tail []byte // Last SpoolKeep bytes, once spooled
+}
+
+// Write implements io.Writer
+func (s *bodySpool) Write(p []byte) (int, error) {
+	if s.file == nil {
+		if s.limit <= 0 || s.n+int64(len(p)) <= s.limit {
+			s.mem = append(s.mem, p...)
+			s.n += int64(len(p))
+			return len(p), nil
+		}
+		if err := s.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.file.Write(p)
+	s.n += int64(n)
+	if len(s.head) < SpoolKeep {
+		s.head = append(s.head, p[:min(n, SpoolKeep-len(s.head))]...)
+	}
+	s.tail = append(s.tail, p[:n]...)
+	if len(s.tail) > SpoolKeep {
+		s.tail = s.tail[len(s.tail)-SpoolKeep:]
+	}
+	return n, err
+}
+
+// spill moves the body received so far to a temporary file
+func (s *bodySpool) spill() error {
+	f, err := os.CreateTemp(s.dir, "body-*")
+	if err != nil {
+		return fmt.Errorf("spooling body: %w", err)
+	}
+	if _, err := f.Write(s.mem); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("spooling body: %w", err)
+	}
+	s.file = f
+	s.head = append([]byte(nil), s.mem[:min(len(s.mem), SpoolKeep)]...)
+	s.tail = append([]byte(nil), s.mem[len(s.mem)-min(len(s.mem), SpoolKeep):]...)
+	s.mem = nil
+	return nil
+}
+
+// discard removes the temporary file of a body that failed to arrive
+func (s *bodySpool) discard() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+	}
+}
+
+// reader returns the reader a body is copied from. Without spooling the
+// read deadline covers the whole body as it always has; a spooled body may
+// take long to arrive, so its deadline is renewed before each read and
+// only a stalled transfer times out.
+func (s *bodySpool) reader(h *HTTP) io.Reader {
+	if h.Timeout > 0 {
+		h.Conn.SetReadDeadline(time.Now().Add(h.Timeout))
+	}
+	if s.limit > 0 {
+		return idleReader{h}
+	}
+	return h.RxBuf
+}
+
+// idleReader reads from the receive buffer, renewing the read deadline
+// before each read
+type idleReader struct {
+	h *HTTP
+}
+
+func (r idleReader) Read(p []byte) (int, error) {
+	if r.h.Timeout > 0 {
+		r.h.Conn.SetReadDeadline(time.Now().Add(r.h.Timeout))
+	}
+	return r.h.RxBuf.Read(p)
+}
+
+// setReceivedBody stores a received body: in h.Body if it stayed in
+// memory, or as h.BodyFile if it was spooled to disk
+func (h *HTTP) setReceivedBody(s *bodySpool) error {
+	h.dropSpool()
+	h.BodyLen = int(s.n)
+	if s.file == nil {
+		h.Body = s.mem
+		return nil
+	}
+
+	if err := s.file.Close(); err != nil {
+		os.Remove(s.file.Name())
+		return fmt.Errorf("spooling body: %w", err)
+	}
+	h.Body = nil
+	h.BodyFile = s.file.Name()
+	h.bodyHead = s.head
+	h.bodyTail = s.tail
+	h.Logger.Log(3, "Spooled body of %d bytes to %s", s.n, h.BodyFile)
+	return nil
+}
+
+// dropSpool removes the file of the last spooled body
+func (h *HTTP) dropSpool() {
+	if h.BodyFile == "" {
+		return
+	}
+	os.Remove(h.BodyFile)
+	h.BodyFile = ""
+	h.bodyHead = nil
+	h.bodyTail = nil
+}
+
+// spooledBodyField is getBodyField for a body spooled to disk: its length,
+// checksums and first and last bytes can be checked, the body itself not
+func (h *HTTP) spooledBodyField(name string, parts []string) (string, error) {
+	if name == "bodylen" && len(parts) < 3 {
+		return strconv.Itoa(h.BodyLen), nil
+	}
+	if name == "body" && len(parts) == 3 {
+		mods := strings.Split(parts[2], ".")
+		switch {
+		case len(mods) == 2 && (mods[0] == "head" || mods[0] == "tail"):
+			if n, err := strconv.Atoi(mods[1]); err == nil && n > SpoolKeep {
+				return "", fmt.Errorf("body.%s.%d: only %d bytes are kept of a spooled body", mods[0], n, SpoolKeep)
+			}
+			kept := h.bodyHead
+			if mods[0] == "tail" {
+				kept = h.bodyTail
+			}
+			return bodyEnd(kept, mods[0], mods[1])
+		case len(mods) == 1 && mods[0] != "decoded":
+			f, err := os.Open(h.BodyFile)
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return util.ChecksumReader(mods[0], f)
+		}
+	}
+	return "", fmt.Errorf("the body of %d bytes was spooled to disk: only bodylen, checksums, body.head.N and body.tail.N can be checked", h.BodyLen)
+}
+
+// bodyEnd returns the first (head) or last (tail) n bytes of body
+func bodyEnd(body []byte, end, count string) (string, error) {
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("invalid byte count in body.%s.%s", end, count)
+	}
+	n = min(n, len(body))
+	if end == "head" {
+		return string(body[:n]), nil
+	}
+	return string(body[len(body)-n:]), nil
+}
@@ -0,0 +1,77 @@
+package http1
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Timing holds the latencies of the last received message. Durations are
+// measured from the preceding txreq/txresp, or from the start of the
+// receive command when nothing was sent first.
+type Timing struct {
+	Connect time.Duration // Opening the connection (clients only)
+	TTFB    time.Duration // Until the first line of the message arrived
+	Headers time.Duration // Until the headers were complete
+	Body    time.Duration // Reading the body, after the headers
+	Total   time.Duration // Until the message was complete
+
+	start     time.Time
+	headersAt time.Time
+}
+
+// Get returns a timing field in seconds
+func (t *Timing) Get(name string) (string, error) {
+	var d time.Duration
+	switch name {
+	case "connect":
+		d = t.Connect
+	case "ttfb":
+		d = t.TTFB
+	case "headers":
+		d = t.Headers
+	case "body":
+		d = t.Body
+	case "total":
+		d = t.Total
+	default:
+		return "", fmt.Errorf("unknown timing field: %s", name)
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64), nil
+}
+
+// markSent records the start of an exchange
+func (h *HTTP) markSent() {
+	h.sentAt = time.Now()
+}
+
+// startRx resets the receive timings, keeping the connect time
+func (h *HTTP) startRx() {
+	start := h.sentAt
+	if start.IsZero() {
+		start = time.Now()
+	}
+	h.sentAt = time.Time{}
+	h.Timing = Timing{Connect: h.Timing.Connect, start: start}
+}
+
+// markFirstByte records the arrival of the first line
+func (h *HTTP) markFirstByte() {
+	if h.Timing.TTFB == 0 {
+		h.Timing.TTFB = time.Since(h.Timing.start)
+	}
+}
+
+// markHeaders records the end of the headers
+func (h *HTTP) markHeaders() {
+	h.Timing.headersAt = time.Now()
+	h.Timing.Headers = h.Timing.headersAt.Sub(h.Timing.start)
+	h.Timing.Total = h.Timing.Headers
+}
+
+// markBody records the end of the body
+func (h *HTTP) markBody() {
+	now := time.Now()
+	h.Timing.Body = now.Sub(h.Timing.headersAt)
+	h.Timing.Total = now.Sub(h.Timing.start)
+}
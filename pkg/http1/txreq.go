@@ -7,21 +7,39 @@ import (
 
 // TxReqOptions contains options for transmitting an HTTP request
 type TxReqOptions struct {
-	Method       string            // HTTP method
-	URL          string            // Request URL
-	Proto        string            // HTTP protocol version
-	Headers      map[string]string // Custom headers
-	Body         []byte            // Request body
-	BodyLen      int               // Generated body length (if Body is nil)
-	Chunked      bool              // Use chunked encoding
-	Gzip         bool              // Compress body with gzip
-	NoHost       bool              // Don't send Host header
-	NoUserAgent  bool              // Don't send User-Agent header
+	Method      string            // HTTP method
+	URL         string            // Request URL
+	Proto       string            // HTTP protocol version
+	Headers     map[string]string // Custom headers
+	RawHeaders  []string          // Header lines sent verbatim, in order (CRLF added unless one ends in LF)
+	NoLen       bool              // Don't send the automatic Content-Length
+	NoTE        bool              // Don't send the automatic Transfer-Encoding with Chunked
+	BareLF      bool              // End the request and header lines with LF instead of CRLF
+	NoFinalCRLF bool              // Leave out the empty line ending the headers
+	Body        []byte            // Request body
+	BodyLen     int               // Generated body length (if Body is nil)
+	Chunked     bool              // Use chunked encoding
+	Gzip        bool              // Compress body with gzip
+	Encoding    string            // Content-coding to apply (gzip, deflate, br, zstd, ...)
+	NoHost      bool              // Don't send Host header
+	NoUserAgent bool              // Don't send User-Agent header
+	Flush       []int             // Sizes of successive writes (see writeMessage)
+
+	// Request line anomalies
+	AbsoluteForm  bool // Send the URL in absolute-form, with the Host header's value
+	URLLen        int  // Pad the URL with 'x' to this many bytes
+	NoSPAfterMeth bool // Leave out the SP between method and URL
+	NoSPAfterURL  bool // Leave out the SP between URL and protocol
 }
 
 // TxReq transmits an HTTP request
 func (h *HTTP) TxReq(opts *TxReqOptions) error {
+	if h.closed {
+		return fmt.Errorf("connection closed after an HTTP/1.0 exchange without Connection: keep-alive")
+	}
 	h.ResetRequest()
+	h.markSent()
+	h.Stats.Requests++
 
 	// Set defaults
 	if opts.Method == "" {
@@ -34,6 +52,24 @@ func (h *HTTP) TxReq(opts *TxReqOptions) error {
 		opts.Proto = "HTTP/1.1"
 	}
 
+	// HTTP/1.0 has no chunked transfer-coding
+	if opts.Chunked && opts.Proto == "HTTP/1.0" {
+		return fmt.Errorf("chunked encoding is not available in HTTP/1.0")
+	}
+
+	if opts.AbsoluteForm && !strings.Contains(opts.URL, "://") {
+		host := "localhost"
+		for name, v := range opts.Headers {
+			if strings.EqualFold(name, "Host") {
+				host = v
+			}
+		}
+		opts.URL = "http://" + host + opts.URL
+	}
+	if n := opts.URLLen - len(opts.URL); n > 0 {
+		opts.URL += strings.Repeat("x", n)
+	}
+
 	// Store request info
 	h.Method = opts.Method
 	h.URL = opts.URL
@@ -42,29 +78,47 @@ func (h *HTTP) TxReq(opts *TxReqOptions) error {
 
 	// Build request line
 	var req strings.Builder
-	fmt.Fprintf(&req, "%s %s %s\r\n", opts.Method, opts.URL, opts.Proto)
+	req.WriteString(opts.Method)
+	if !opts.NoSPAfterMeth {
+		req.WriteByte(' ')
+	}
+	req.WriteString(opts.URL)
+	if !opts.NoSPAfterURL {
+		req.WriteByte(' ')
+	}
+	req.WriteString(opts.Proto + "\r\n")
 
-	// Prepare body
+	// Prepare body. A large generated body sent as is isn't built in memory.
 	body := opts.Body
-	if body == nil && opts.BodyLen > 0 {
+	streamed := body == nil && opts.BodyLen >= streamBodyMin && opts.Encoding == "" && !opts.Gzip
+	if body == nil && opts.BodyLen > 0 && !streamed {
 		body = GenerateBody(opts.BodyLen, false)
 	}
 
 	// Compress if requested
-	if opts.Gzip && len(body) > 0 {
-		compressed, err := h.CompressBody(body)
+	if opts.Gzip && opts.Encoding == "" {
+		opts.Encoding = EncodingGzip
+	}
+	if opts.Encoding != "" && len(body) > 0 {
+		compressed, err := h.EncodeBody(opts.Encoding, body)
 		if err != nil {
-			return fmt.Errorf("gzip compression failed: %w", err)
+			return fmt.Errorf("%s compression failed: %w", opts.Encoding, err)
 		}
 		body = compressed
 		if opts.Headers == nil {
 			opts.Headers = make(map[string]string)
 		}
-		opts.Headers["Content-Encoding"] = "gzip"
+		opts.Headers["Content-Encoding"] = contentEncodingName(opts.Encoding)
 	}
 
+	h.dropSpool()
 	h.Body = body
 	h.BodyLen = len(body)
+	bodySegs := [][]byte{body}
+	if streamed {
+		h.BodyLen = opts.BodyLen
+		bodySegs = generatedBody(opts.BodyLen)
+	}
 
 	// Add default headers
 	if !opts.NoHost && opts.Proto == "HTTP/1.1" {
@@ -73,7 +127,12 @@ func (h *HTTP) TxReq(opts *TxReqOptions) error {
 			if opts.Headers == nil {
 				opts.Headers = make(map[string]string)
 			}
-			opts.Headers["Host"] = "localhost"
+			host := "localhost"
+			if opts.Method == "CONNECT" {
+				// CONNECT uses authority-form: the URL is the host
+				host = opts.URL
+			}
+			opts.Headers["Host"] = host
 		}
 	}
 
@@ -96,72 +155,58 @@ func (h *HTTP) TxReq(opts *TxReqOptions) error {
 		h.ReqHeaders = append(h.ReqHeaders, fmt.Sprintf("%s: %s", name, value))
 		fmt.Fprintf(&req, "%s: %s\r\n", name, value)
 	}
+	for _, line := range opts.RawHeaders {
+		h.ReqHeaders = append(h.ReqHeaders, strings.TrimSuffix(line, "\n"))
+		writeRawHeader(&req, line)
+	}
 
 	// Handle body
 	if opts.Chunked {
-		// Chunked encoding
-		req.WriteString("Transfer-Encoding: chunked\r\n")
-		req.WriteString("\r\n")
-
-		// Send headers
-		err := h.Write([]byte(req.String()))
-		if err != nil {
-			return err
+		// Chunked encoding, in one chunk
+		if !opts.NoTE {
+			req.WriteString("Transfer-Encoding: chunked\r\n")
 		}
-
-		// Send body as chunks
-		return h.sendChunked(body)
-	} else {
+		bodySegs = chunkedBody(bodySegs, h.BodyLen)
+	} else if h.BodyLen > 0 && !opts.NoLen {
 		// Regular body with Content-Length
-		if len(body) > 0 {
-			fmt.Fprintf(&req, "Content-Length: %d\r\n", len(body))
-		}
-		req.WriteString("\r\n")
-
-		// Send headers
-		err := h.Write([]byte(req.String()))
-		if err != nil {
-			return err
-		}
+		fmt.Fprintf(&req, "Content-Length: %d\r\n", h.BodyLen)
+	}
 
-		// Send body
-		if len(body) > 0 {
-			err = h.Write(body)
-			if err != nil {
-				return err
-			}
-		}
+	// Send headers and body together
+	head := headerBlock(req.String(), opts.BareLF, opts.NoFinalCRLF)
+	if err := h.writeMessage(append([][]byte{head}, bodySegs...), opts.Flush); err != nil {
+		return err
 	}
 
+	// HTTP/1.0 closes the connection after the response unless the
+	// request asks to keep it alive
+	h.lastExch = opts.Proto == "HTTP/1.0" && !headerHasToken(h.ReqHeaders, "Connection", "keep-alive")
+
 	h.Logger.Log(3, "txreq: %s %s", opts.Method, opts.URL)
+	h.logTx("txreq", head)
+	h.logBody()
 	return nil
 }
 
-// sendChunked sends data using chunked transfer encoding
-func (h *HTTP) sendChunked(data []byte) error {
-	// Send body in one chunk
-	chunkSize := fmt.Sprintf("%x\r\n", len(data))
-	err := h.Write([]byte(chunkSize))
-	if err != nil {
-		return err
-	}
-
-	err = h.Write(data)
-	if err != nil {
-		return err
+// writeRawHeader writes a header line followed by CRLF, or as is if it
+// already ends in LF
+func writeRawHeader(b *strings.Builder, line string) {
+	if strings.HasSuffix(line, "\n") {
+		b.WriteString(line)
+		return
 	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
 
-	err = h.Write([]byte("\r\n"))
-	if err != nil {
-		return err
+// headerBlock ends the start line and headers in head with the empty line,
+// then applies the line ending options
+func headerBlock(head string, bareLF, noFinalCRLF bool) []byte {
+	if !noFinalCRLF {
+		head += "\r\n"
 	}
-
-	// Send final chunk (0-sized)
-	err = h.Write([]byte("0\r\n\r\n"))
-	if err != nil {
-		return err
+	if bareLF {
+		head = strings.ReplaceAll(head, "\r\n", "\n")
 	}
-
-	h.Logger.Log(4, "Sent chunked body (%d bytes)", len(data))
-	return nil
+	return []byte(head)
 }
@@ -3,25 +3,45 @@ package http1
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // TxRespOptions contains options for transmitting an HTTP response
 type TxRespOptions struct {
-	Status    int               // HTTP status code
-	Reason    string            // Reason phrase
-	Proto     string            // HTTP protocol version
-	Headers   map[string]string // Custom headers
-	Body      []byte            // Response body
-	BodyLen   int               // Generated body length (if Body is nil)
-	Chunked   bool              // Use chunked encoding
-	Gzip      bool              // Compress body with gzip
-	NoLen     bool              // Don't send Content-Length
-	NoServer  bool              // Don't send Server header
+	Status      int               // HTTP status code
+	Reason      string            // Reason phrase
+	Proto       string            // HTTP protocol version
+	Headers     map[string]string // Custom headers
+	RawHeaders  []string          // Header lines sent verbatim, in order (CRLF added unless one ends in LF)
+	Body        []byte            // Response body
+	BodyLen     int               // Generated body length (if Body is nil)
+	Chunked     bool              // Use chunked encoding
+	Gzip        bool              // Compress body with gzip
+	Encoding    string            // Content-coding to apply (gzip, deflate, br, zstd, ...)
+	GzipDamage  GzipDamage        // Deliberate corruption of the gzip stream
+	Range       *ByteRange        // Send only this slice of the body with Content-Range
+	NoLen       bool              // Don't send Content-Length
+	NoServer    bool              // Don't send Server header
+	DateOffset  *time.Duration    // Send Date shifted from the test clock
+	Age         *int              // Send Age in seconds
+	Expires     *time.Duration    // Send Expires relative to Date
+	BareLF      bool              // End the status and header lines with LF instead of CRLF
+	NoFinalCRLF bool              // Leave out the empty line ending the headers
+	Flush       []int             // Sizes of successive writes (see writeMessage)
+
+	// Origin protocol violations
+	Preamble          []byte // Garbage sent before the status line
+	CloseAfterHeaders bool   // Close the connection instead of sending the body
+	ExtraResponse     bool   // Follow up with an unsolicited 200 response
 }
 
+// extraResponseBody is the body of the response sent by ExtraResponse
+const extraResponseBody = "extra"
+
 // TxResp transmits an HTTP response
 func (h *HTTP) TxResp(opts *TxRespOptions) error {
 	h.ResetResponse()
+	h.markSent()
 
 	// Set defaults
 	if opts.Status == 0 {
@@ -43,27 +63,65 @@ func (h *HTTP) TxResp(opts *TxRespOptions) error {
 	var resp strings.Builder
 	fmt.Fprintf(&resp, "%s %d %s\r\n", opts.Proto, opts.Status, opts.Reason)
 
-	// Prepare body
+	// Prepare body. A large generated body sent as is isn't built in memory.
 	body := opts.Body
-	if body == nil && opts.BodyLen > 0 {
+	streamed := body == nil && opts.BodyLen >= streamBodyMin && opts.Encoding == "" && !opts.Gzip &&
+		opts.GzipDamage.IsZero() && opts.Range == nil
+	if body == nil && opts.BodyLen > 0 && !streamed {
 		body = GenerateBody(opts.BodyLen, false)
 	}
 
 	// Compress if requested
-	if opts.Gzip && len(body) > 0 {
-		compressed, err := h.CompressBody(body)
+	if opts.Gzip && opts.Encoding == "" {
+		opts.Encoding = EncodingGzip
+	}
+	if opts.Encoding != "" && len(body) > 0 {
+		compressed, err := h.EncodeBody(opts.Encoding, body)
 		if err != nil {
-			return fmt.Errorf("gzip compression failed: %w", err)
+			return fmt.Errorf("%s compression failed: %w", opts.Encoding, err)
 		}
 		body = compressed
 		if opts.Headers == nil {
 			opts.Headers = make(map[string]string)
 		}
-		opts.Headers["Content-Encoding"] = "gzip"
+		opts.Headers["Content-Encoding"] = contentEncodingName(opts.Encoding)
+	}
+
+	// Corrupt the gzip stream for negative tests
+	if !opts.GzipDamage.IsZero() {
+		if !isGzipEncoding(opts.Encoding) {
+			return fmt.Errorf("gzip damage options require gzip encoding")
+		}
+		damaged, err := h.damageGzip(body, opts.GzipDamage)
+		if err != nil {
+			return err
+		}
+		body = damaged
+	}
+
+	// Slice the body for partial content
+	if opts.Range != nil {
+		sliced, err := sliceRange(body, *opts.Range)
+		if err != nil {
+			return err
+		}
+		body = sliced
+		if opts.Headers == nil {
+			opts.Headers = make(map[string]string)
+		}
+		opts.Headers["Content-Range"] = opts.Range.String()
 	}
 
+	h.dropSpool()
 	h.Body = body
 	h.BodyLen = len(body)
+	bodySegs := [][]byte{body}
+	if streamed {
+		h.BodyLen = opts.BodyLen
+		bodySegs = generatedBody(opts.BodyLen)
+	}
+
+	h.addCacheHeaders(opts)
 
 	// Add default Server header
 	if !opts.NoServer {
@@ -85,44 +143,50 @@ func (h *HTTP) TxResp(opts *TxRespOptions) error {
 		h.RespHeaders = append(h.RespHeaders, fmt.Sprintf("%s: %s", name, value))
 		fmt.Fprintf(&resp, "%s: %s\r\n", name, value)
 	}
+	for _, line := range opts.RawHeaders {
+		h.RespHeaders = append(h.RespHeaders, strings.TrimSuffix(line, "\n"))
+		writeRawHeader(&resp, line)
+	}
 
 	// Handle body
 	if opts.Chunked {
 		// Chunked encoding
 		resp.WriteString("Transfer-Encoding: chunked\r\n")
-		resp.WriteString("\r\n")
+	} else if !opts.NoLen && !h.tunnelEstablished() {
+		// Regular body with Content-Length (unless NoLen is set or the
+		// response opens a CONNECT tunnel, which must not carry one)
+		fmt.Fprintf(&resp, "Content-Length: %d\r\n", h.BodyLen)
+	}
 
-		// Send headers
-		err := h.Write([]byte(resp.String()))
-		if err != nil {
+	// Send headers, after any garbage preamble, and body together
+	head := headerBlock(resp.String(), opts.BareLF, opts.NoFinalCRLF)
+	segs := [][]byte{opts.Preamble, head}
+	if opts.CloseAfterHeaders {
+		if err := h.writeMessage(segs, opts.Flush); err != nil {
 			return err
 		}
+		h.Logger.Log(3, "txresp: %d %s, closing after headers", opts.Status, opts.Reason)
+		h.logTx("txresp", head)
+		return h.Close()
+	}
+	if opts.Chunked {
+		bodySegs = chunkedBody(bodySegs, h.BodyLen)
+	}
+	if err := h.writeMessage(append(segs, bodySegs...), opts.Flush); err != nil {
+		return err
+	}
 
-		// Send body as chunks
-		return h.sendChunked(body)
-	} else {
-		// Regular body with Content-Length (unless NoLen is set)
-		if !opts.NoLen {
-			fmt.Fprintf(&resp, "Content-Length: %d\r\n", len(body))
-		}
-		resp.WriteString("\r\n")
-
-		// Send headers
-		err := h.Write([]byte(resp.String()))
-		if err != nil {
+	// Follow up with a response nobody asked for
+	if opts.ExtraResponse {
+		extra := fmt.Sprintf("%s 200 OK\r\nContent-Length: %d\r\n\r\n%s", opts.Proto, len(extraResponseBody), extraResponseBody)
+		if err := h.Write([]byte(extra)); err != nil {
 			return err
 		}
-
-		// Send body
-		if len(body) > 0 {
-			err = h.Write(body)
-			if err != nil {
-				return err
-			}
-		}
 	}
 
 	h.Logger.Log(3, "txresp: %d %s", opts.Status, opts.Reason)
+	h.logTx("txresp", head)
+	h.logBody()
 	return nil
 }
 
@@ -0,0 +1,123 @@
+package http1
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bodyPeriod is the length after which a body made by GenerateBody
+// repeats: a newline every 64 bytes, and the 94 printable characters in turn
+const bodyPeriod = 64 * 94
+
+// streamBodyMin is the size from which a generated body is sent as slices
+// of a repeating pattern instead of being built in memory. The sender then
+// only keeps its length.
+const streamBodyMin = 1 << 20
+
+// writeBatch bounds the bytes of a single vectored write, so that the I/O
+// timeout applies to each batch rather than to a whole large message
+const writeBatch = 4 << 20
+
+// bodyPattern holds whole periods of the generated body, about 64 KiB
+var bodyPattern = GenerateBody(bodyPeriod*11, false)
+
+// generatedBody returns a body of n bytes equal to GenerateBody(n, false),
+// as slices of bodyPattern
+func generatedBody(n int) [][]byte {
+	var segs [][]byte
+	for n > 0 {
+		seg := bodyPattern[:min(n, len(bodyPattern))]
+		segs = append(segs, seg)
+		n -= len(seg)
+	}
+	return segs
+}
+
+// chunkedBody frames a body of n bytes as a single chunk and the last chunk
+func chunkedBody(body [][]byte, n int) [][]byte {
+	segs := [][]byte{[]byte(fmt.Sprintf("%x\r\n", n))}
+	segs = append(segs, body...)
+	return append(segs, []byte("\r\n"), []byte("0\r\n\r\n"))
+}
+
+// writeMessage sends the segments of a message with vectored writes,
+// without first copying them into one buffer. Without flush sizes the
+// message goes out in writes of up to writeBatch bytes, or of SegmentSize
+// bytes after txsegment. With them, the first write carries flush[0]
+// bytes, the second flush[1] and so on, the last size repeating; a size of
+// 0 sends the rest of the message. Writes are SegmentDelay apart.
+func (h *HTTP) writeMessage(segs [][]byte, flush []int) error {
+	total := 0
+	var pending [][]byte
+	for _, seg := range segs {
+		if len(seg) > 0 {
+			pending = append(pending, seg)
+			total += len(seg)
+		}
+	}
+
+	sent, writes := 0, 0
+	for len(pending) > 0 {
+		size := writeBatch
+		if len(flush) > 0 {
+			size = flush[min(writes, len(flush)-1)]
+		} else if h.SegmentSize > 0 {
+			size = h.SegmentSize
+		}
+		if size <= 0 || size > total-sent {
+			size = total - sent
+		}
+
+		if writes > 0 && h.SegmentDelay > 0 {
+			time.Sleep(h.SegmentDelay)
+		}
+
+		var batch net.Buffers
+		batch, pending = splitSegments(pending, size)
+		if h.Timeout > 0 {
+			h.Conn.SetWriteDeadline(time.Now().Add(h.Timeout))
+		}
+		n, err := batch.WriteTo(h.Conn)
+		sent += int(n)
+		writes++
+		if err != nil {
+			return fmt.Errorf("write failed after %d of %d bytes: %w", sent, total, err)
+		}
+	}
+
+	h.Logger.Log(4, "Sent %d bytes in %d writes", sent, writes)
+	return nil
+}
+
+// splitSegments returns the segments holding the first n bytes of segs,
+// and those holding the rest. A segment split in two is updated in segs.
+func splitSegments(segs [][]byte, n int) (head, rest [][]byte) {
+	for len(segs) > 0 && n > 0 {
+		seg := segs[0]
+		if len(seg) > n {
+			head = append(head, seg[:n])
+			segs[0] = seg[n:]
+			return head, segs
+		}
+		head = append(head, seg)
+		n -= len(seg)
+		segs = segs[1:]
+	}
+	return head, segs
+}
+
+// parseFlush parses the -flush write sizes: byte counts separated by commas
+func parseFlush(s string) ([]int, error) {
+	var sizes []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid -flush %q: want byte counts such as 1 or 10,100,0", s)
+		}
+		sizes = append(sizes, n)
+	}
+	return sizes, nil
+}
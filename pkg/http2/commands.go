@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/perbu/GTest/pkg/hpack"
+	"github.com/perbu/GTest/pkg/util"
 )
 
 // TxReqOptions represents options for sending an HTTP/2 request
@@ -18,21 +20,44 @@ type TxReqOptions struct {
 	Body             []byte
 	EndStream        bool
 	HpackInstructions []hpack.HpackInstruction // Explicit HPACK instructions
+	Frame            FrameOptions              // Padding and priority of the HEADERS frame
+	NoHdrEnd         bool                      // Leave END_HEADERS unset; txcont continues the block
 }
 
 // TxReq sends an HTTP/2 request on a stream
 func (c *Conn) TxReq(streamID uint32, opts TxReqOptions) error {
+	if err := c.checkGoAway(streamID); err != nil {
+		return err
+	}
+	if !opts.Frame.NoEnforce {
+		if err := c.checkConcurrency(streamID); err != nil {
+			return err
+		}
+	}
 	stream := c.streams.GetOrCreate(streamID, fmt.Sprintf("stream-%d", streamID))
+	stream.mu.Lock()
+	closed := stream.State == StreamClosed
+	stream.mu.Unlock()
+	if closed {
+		// Reusing a closed stream's ID (a protocol error) starts afresh
+		stream = c.streams.Create(streamID, fmt.Sprintf("stream-%d", streamID))
+	}
+	stream.MarkSent()
 
 	var headerBlock []byte
 	var err error
 
+	// Streams running in parallel must send their header blocks in the
+	// order they encoded them
+	c.headersMu.Lock()
+
 	// Use explicit HPACK instructions if provided
 	if len(opts.HpackInstructions) > 0 {
 		c.encoderMu.Lock()
 		headerBlock, err = c.encoder.EncodeExplicit(opts.HpackInstructions)
 		c.encoderMu.Unlock()
 		if err != nil {
+			c.headersMu.Unlock()
 			return fmt.Errorf("failed to encode explicit headers: %w", err)
 		}
 
@@ -74,6 +99,7 @@ func (c *Conn) TxReq(streamID uint32, opts TxReqOptions) error {
 		headerBlock, err = c.encoder.Encode(headers)
 		c.encoderMu.Unlock()
 		if err != nil {
+			c.headersMu.Unlock()
 			return fmt.Errorf("failed to encode headers: %w", err)
 		}
 
@@ -83,13 +109,14 @@ func (c *Conn) TxReq(streamID uint32, opts TxReqOptions) error {
 		}
 	}
 
-	// Determine if we should set END_STREAM
-	endStream := opts.EndStream || len(opts.Body) == 0
+	// END_STREAM goes on HEADERS only if there is no body to follow
+	endStream := opts.EndStream && len(opts.Body) == 0
 
 	// Send HEADERS frame
 	c.writeMu.Lock()
-	err = WriteHeadersFrame(c.conn, streamID, headerBlock, endStream, true)
+	err = WriteHeadersFrameWith(c.conn, streamID, headerBlock, endStream, !opts.NoHdrEnd, opts.Frame)
 	c.writeMu.Unlock()
+	c.headersMu.Unlock()
 	if err != nil {
 		return fmt.Errorf("failed to write HEADERS frame: %w", err)
 	}
@@ -97,11 +124,9 @@ func (c *Conn) TxReq(streamID uint32, opts TxReqOptions) error {
 	stream.UpdateState(endStream, true)
 	c.logger.Log(3, "Sent HEADERS on stream %d (END_STREAM=%v)", streamID, endStream)
 
-	// Send DATA frame if there's a body and we haven't set END_STREAM yet
+	// Send DATA frames if there's a body and we haven't set END_STREAM yet
 	if len(opts.Body) > 0 && !endStream {
-		c.writeMu.Lock()
-		err = WriteDataFrame(c.conn, streamID, opts.Body, opts.EndStream)
-		c.writeMu.Unlock()
+		err = c.writeData(stream, opts.Body, opts.EndStream, FrameOptions{NoEnforce: opts.Frame.NoEnforce})
 		if err != nil {
 			return fmt.Errorf("failed to write DATA frame: %w", err)
 		}
@@ -122,6 +147,8 @@ type TxRespOptions struct {
 	Body              []byte
 	EndStream         bool
 	HpackInstructions []hpack.HpackInstruction // Explicit HPACK instructions
+	Frame             FrameOptions             // Padding and priority of the HEADERS frame
+	NoHdrEnd          bool                     // Leave END_HEADERS unset; txcont continues the block
 }
 
 // TxResp sends an HTTP/2 response on a stream
@@ -130,16 +157,22 @@ func (c *Conn) TxResp(streamID uint32, opts TxRespOptions) error {
 	if !ok {
 		return fmt.Errorf("stream %d not found", streamID)
 	}
+	stream.MarkSent()
 
 	var headerBlock []byte
 	var err error
 
+	// Streams running in parallel must send their header blocks in the
+	// order they encoded them
+	c.headersMu.Lock()
+
 	// Use explicit HPACK instructions if provided
 	if len(opts.HpackInstructions) > 0 {
 		c.encoderMu.Lock()
 		headerBlock, err = c.encoder.EncodeExplicit(opts.HpackInstructions)
 		c.encoderMu.Unlock()
 		if err != nil {
+			c.headersMu.Unlock()
 			return fmt.Errorf("failed to encode explicit headers: %w", err)
 		}
 
@@ -178,6 +211,7 @@ func (c *Conn) TxResp(streamID uint32, opts TxRespOptions) error {
 		headerBlock, err = c.encoder.Encode(headers)
 		c.encoderMu.Unlock()
 		if err != nil {
+			c.headersMu.Unlock()
 			return fmt.Errorf("failed to encode headers: %w", err)
 		}
 
@@ -187,13 +221,16 @@ func (c *Conn) TxResp(streamID uint32, opts TxRespOptions) error {
 		}
 	}
 
-	// Determine if we should set END_STREAM
-	endStream := opts.EndStream || len(opts.Body) == 0
+	// END_STREAM goes on HEADERS only if there is no body to follow; a 1xx
+	// response never ends the stream
+	interim := len(opts.Status) == 3 && opts.Status[0] == '1'
+	endStream := !interim && opts.EndStream && len(opts.Body) == 0
 
 	// Send HEADERS frame
 	c.writeMu.Lock()
-	err = WriteHeadersFrame(c.conn, streamID, headerBlock, endStream, true)
+	err = WriteHeadersFrameWith(c.conn, streamID, headerBlock, endStream, !opts.NoHdrEnd, opts.Frame)
 	c.writeMu.Unlock()
+	c.headersMu.Unlock()
 	if err != nil {
 		return fmt.Errorf("failed to write HEADERS frame: %w", err)
 	}
@@ -201,11 +238,9 @@ func (c *Conn) TxResp(streamID uint32, opts TxRespOptions) error {
 	stream.UpdateState(endStream, true)
 	c.logger.Log(3, "Sent HEADERS on stream %d (END_STREAM=%v)", streamID, endStream)
 
-	// Send DATA frame if there's a body and we haven't set END_STREAM yet
+	// Send DATA frames if there's a body and we haven't set END_STREAM yet
 	if len(opts.Body) > 0 && !endStream {
-		c.writeMu.Lock()
-		err = WriteDataFrame(c.conn, streamID, opts.Body, opts.EndStream)
-		c.writeMu.Unlock()
+		err = c.writeData(stream, opts.Body, opts.EndStream, FrameOptions{NoEnforce: opts.Frame.NoEnforce})
 		if err != nil {
 			return fmt.Errorf("failed to write DATA frame: %w", err)
 		}
@@ -221,17 +256,18 @@ func (c *Conn) TxResp(streamID uint32, opts TxRespOptions) error {
 
 // RxReq receives an HTTP/2 request on a stream
 func (c *Conn) RxReq(streamID uint32) error {
-	stream, ok := c.streams.Get(streamID)
-	if !ok {
-		return fmt.Errorf("stream %d not found", streamID)
-	}
+	// The client may not have opened the stream yet; the receive loop
+	// fills in the one made here when it does
+	stream := c.streams.GetOrCreate(streamID, fmt.Sprintf("stream-%d", streamID))
 
 	// Wait for the request (headers and potentially body)
-	// The frame receive loop will populate the stream
-	stream.Wait()
+	if err := stream.Wait(c.ctx.Done()); err != nil {
+		return err
+	}
 
 	c.logger.Log(3, "Received request on stream %d: %s %s",
 		streamID, stream.Method, stream.Path)
+	c.markExchange(streamID)
 
 	return nil
 }
@@ -244,25 +280,58 @@ func (c *Conn) RxResp(streamID uint32) error {
 	}
 
 	// Wait for the response
-	stream.Wait()
+	if err := stream.Wait(c.ctx.Done()); err != nil {
+		return err
+	}
 
 	c.logger.Log(3, "Received response on stream %d: status %s",
 		streamID, stream.Status)
+	c.markExchange(streamID)
 
 	return nil
 }
 
-// TxData sends a DATA frame on a stream
-func (c *Conn) TxData(streamID uint32, data []byte, endStream bool) error {
+// markExchange records the stream that received a message last
+func (c *Conn) markExchange(streamID uint32) {
+	c.mu.Lock()
+	c.lastExchange = streamID
+	c.mu.Unlock()
+}
+
+// LastExchange describes the request and response of the stream that
+// received a message last, for dump and the ${NAME_last} macro, or
+// returns "" if none did
+func (c *Conn) LastExchange() string {
+	c.mu.Lock()
+	id := c.lastExchange
+	c.mu.Unlock()
+
+	stream, ok := c.streams.Get(id)
+	if id == 0 || !ok {
+		return ""
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	summary := strings.TrimSpace(stream.Method + " " + stream.Path)
+	if stream.Status != "" {
+		summary = strings.TrimSpace(summary + " -> " + stream.Status)
+	}
+	body := stream.RespBody
+	if !c.isClient {
+		body = stream.ReqBody
+	}
+	return fmt.Sprintf("%s (stream %d, %d body bytes)", summary, id, len(body))
+}
+
+// TxData sends a DATA frame on a stream, padded as opts says
+func (c *Conn) TxData(streamID uint32, data []byte, endStream bool, opts FrameOptions) error {
 	stream, ok := c.streams.Get(streamID)
 	if !ok {
 		return fmt.Errorf("stream %d not found", streamID)
 	}
 
-	c.writeMu.Lock()
-	err := WriteDataFrame(c.conn, streamID, data, endStream)
-	c.writeMu.Unlock()
-	if err != nil {
+	if err := c.writeData(stream, data, endStream, opts); err != nil {
 		return err
 	}
 
@@ -275,6 +344,81 @@ func (c *Conn) TxData(streamID uint32, data []byte, endStream bool) error {
 	return nil
 }
 
+// writeData sends data as DATA frames no larger than the peer's
+// MAX_FRAME_SIZE, with END_STREAM on the last, and charges them to the
+// send windows. Windows may go negative: they are tracked, not waited for.
+// opts.FrameSize makes the frames smaller and opts.Pace spaces them out.
+func (c *Conn) writeData(stream *Stream, data []byte, endStream bool, opts FrameOptions) error {
+	overhead := 0
+	if opts.Padded {
+		overhead = 1 + len(opts.Pad)
+	}
+	chunk := len(data)
+	if !opts.NoEnforce {
+		chunk = max(int(c.remoteSetting(SettingMaxFrameSize))-overhead, 1)
+	}
+	if opts.FrameSize > 0 {
+		chunk = min(chunk, opts.FrameSize)
+	}
+
+	for first := true; ; first = false {
+		if opts.Pace > 0 && !first {
+			select {
+			case <-time.After(opts.Pace):
+			case <-c.ctx.Done():
+				return fmt.Errorf("connection closed while sending DATA on stream %d", stream.ID)
+			}
+		}
+
+		n := min(len(data), chunk)
+		last := n == len(data)
+
+		c.writeMu.Lock()
+		err := WriteDataFrameWith(c.conn, stream.ID, data[:n], endStream && last, opts)
+		c.writeMu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		c.sendWindow -= int32(n + overhead)
+		c.mu.Unlock()
+		stream.UpdateSendWindow(-int32(n + overhead))
+
+		if last {
+			return nil
+		}
+		data = data[n:]
+	}
+}
+
+// checkConcurrency returns an error if opening the stream would exceed the
+// peer's MAX_CONCURRENT_STREAMS. There is no limit until the peer's
+// SETTINGS carry one.
+func (c *Conn) checkConcurrency(streamID uint32) error {
+	if stream, ok := c.streams.Get(streamID); ok {
+		stream.mu.Lock()
+		opening := stream.State == StreamIdle || stream.State == StreamClosed
+		stream.mu.Unlock()
+		if !opening {
+			return nil
+		}
+	}
+
+	c.mu.Lock()
+	setting, ok := c.remoteSettings[SettingMaxConcurrentStreams]
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	limit := int(setting)
+	if open := c.streams.CountOpen(streamID%2 == 1); open >= limit {
+		return fmt.Errorf("stream %d would exceed the peer's MAX_CONCURRENT_STREAMS (%d streams open, limit %d)",
+			streamID, open, limit)
+	}
+	return nil
+}
+
 // RxData waits to receive a DATA frame on a stream
 func (c *Conn) RxData(streamID uint32) ([]byte, error) {
 	stream, ok := c.streams.Get(streamID)
@@ -283,87 +427,301 @@ func (c *Conn) RxData(streamID uint32) ([]byte, error) {
 	}
 
 	// Wait for data
-	stream.Wait()
+	if err := stream.Wait(c.ctx.Done()); err != nil {
+		return nil, err
+	}
+	stream.mu.Lock()
+	stream.dataTaken = stream.DataFrames
+	stream.mu.Unlock()
 
+	body := c.rxBody(stream)
 	c.logger.Log(3, "Received DATA on stream %d: %d bytes",
-		streamID, len(stream.ReqBody))
+		streamID, len(body))
+
+	return body, nil
+}
+
+// rxBody returns the body received on a stream: the response on a
+// client, the request on a server
+func (c *Conn) rxBody(stream *Stream) []byte {
+	if c.isClient {
+		return stream.RespBody
+	}
+	return stream.ReqBody
+}
+
+// RxDataFrames waits until n more DATA frames have arrived on a stream
+// than rxdata has taken, and takes them
+func (c *Conn) RxDataFrames(streamID uint32, n int) ([]byte, error) {
+	stream, ok := c.streams.Get(streamID)
+	if !ok {
+		return nil, fmt.Errorf("stream %d not found", streamID)
+	}
 
-	return stream.ReqBody, nil
+	for {
+		stream.mu.Lock()
+		got := stream.DataFrames - stream.dataTaken
+		ended := stream.State == StreamHalfClosedRemote || stream.State == StreamClosed
+		if got >= n {
+			stream.dataTaken += n
+			body := c.rxBody(stream)
+			stream.mu.Unlock()
+			c.logger.Log(3, "Received %d DATA frames on stream %d", n, streamID)
+			return body, nil
+		}
+		stream.mu.Unlock()
+		if ended {
+			return nil, fmt.Errorf("stream %d ended after %d of %d DATA frames", streamID, got, n)
+		}
+
+		select {
+		case <-stream.signal:
+		case <-c.ctx.Done():
+			return nil, fmt.Errorf("connection closed after %d of %d DATA frames on stream %d", got, n, streamID)
+		}
+	}
+}
+
+// WaitEnd waits until the peer has ended a stream, with END_STREAM or
+// RST_STREAM, so that the whole body has arrived
+func (c *Conn) WaitEnd(streamID uint32) error {
+	stream, ok := c.streams.Get(streamID)
+	if !ok {
+		return fmt.Errorf("stream %d not found", streamID)
+	}
+
+	for {
+		stream.mu.Lock()
+		ended := stream.State == StreamHalfClosedRemote || stream.State == StreamClosed
+		stream.mu.Unlock()
+		if ended {
+			return nil
+		}
+
+		select {
+		case <-stream.signal:
+		case <-c.ctx.Done():
+			return fmt.Errorf("connection closed before the end of stream %d", streamID)
+		}
+	}
 }
 
 // Expect performs assertions on stream data
 func (c *Conn) Expect(streamID uint32, field, op, expected string) error {
+	actual, err := c.Field(streamID, field)
+	if err != nil {
+		return err
+	}
+	// The expected value may be a stream field too, to compare streams:
+	// expect stream.3.order < stream.5.order
+	if strings.HasPrefix(expected, "stream.") {
+		if expected, err = c.Field(streamID, expected); err != nil {
+			return err
+		}
+	}
+	if !isErrCodeField(field) {
+		return c.compare(actual, op, expected, field)
+	}
+
+	// Error codes compare by number, and may be given by name
+	if code, err := ParseErrCode(expected); err == nil {
+		expected = strconv.FormatUint(uint64(code), 10)
+	}
+	if err := c.compare(actual, op, expected, field); err != nil {
+		if code, perr := ParseErrCode(actual); perr == nil {
+			return fmt.Errorf("%w (%s)", err, ErrCodeName(code))
+		}
+		return err
+	}
+	return nil
+}
+
+// Field returns the value of a field as expect sees it, e.g.
+// "resp.http.x-req-id" on a stream or "settings.max_frame_size"
+func (c *Conn) Field(streamID uint32, field string) (string, error) {
+	// Frames are queued whether or not the stream is known; GOAWAY and
+	// SETTINGS belong to the connection, as do stream 0's windows
+	switch prefix, _, _ := strings.Cut(field, "."); prefix {
+	case "frame":
+		return c.getFrameField(streamID, field)
+	case "goaway":
+		return c.getGoAwayField(field)
+	case "rst":
+		return c.getRstField(streamID, field)
+	case "conn":
+		return c.getConnErrorField(field)
+	case "settings":
+		return c.getSettingsField(field)
+	case "stream":
+		return c.getStreamField(streamID, field)
+	}
+
 	stream, ok := c.streams.Get(streamID)
 	if !ok {
-		return fmt.Errorf("stream %d not found", streamID)
+		return "", fmt.Errorf("stream %d not found", streamID)
 	}
 
 	stream.mu.Lock()
 	defer stream.mu.Unlock()
 
 	// Extract the actual value based on field
-	var actual string
 	parts := strings.Split(field, ".")
 
 	if len(parts) < 2 {
-		return fmt.Errorf("invalid field format: %s", field)
+		return "", fmt.Errorf("invalid field format: %s", field)
 	}
 
 	reqOrResp := parts[0]
 	fieldName := strings.Join(parts[1:], ".")
 
 	switch reqOrResp {
+	case "timing":
+		return getTimingField(stream, fieldName, c.ConnectTime)
 	case "req":
-		actual = c.getReqField(stream, fieldName)
+		return c.getReqField(stream, fieldName)
 	case "resp":
-		actual = c.getRespField(stream, fieldName)
+		return c.getRespField(stream, fieldName)
+	case "push":
+		return c.getPushField(stream, fieldName)
 	default:
-		return fmt.Errorf("invalid field prefix: %s (must be 'req' or 'resp')", reqOrResp)
+		return "", fmt.Errorf("invalid field prefix: %s (must be 'req', 'resp', 'push', 'frame' or 'timing')", reqOrResp)
 	}
+}
 
-	// Perform comparison
-	return c.compare(actual, op, expected, field)
+// getStreamField extracts "stream.window" (what the peer may still send),
+// "stream.peer_window" (what we may still send), of the connection on
+// stream 0, and "stream.order", the place of the stream's first header
+// block among those received. "stream.N.order" and the like are those of
+// stream N, from any stream.
+func (c *Conn) getStreamField(streamID uint32, field string) (string, error) {
+	name := strings.TrimPrefix(field, "stream.")
+	if id, rest, ok := strings.Cut(name, "."); ok {
+		n, err := strconv.ParseUint(id, 10, 31)
+		if err != nil {
+			return "", fmt.Errorf("unknown stream field: %s", field)
+		}
+		streamID, name = uint32(n), rest
+	}
+
+	switch name {
+	case "window":
+		return strconv.Itoa(int(c.GetRecvWindow(streamID))), nil
+	case "peer_window":
+		return strconv.Itoa(int(c.GetSendWindow(streamID))), nil
+	case "order":
+		stream, ok := c.streams.Get(streamID)
+		if !ok {
+			return "", fmt.Errorf("stream %d not found", streamID)
+		}
+		stream.mu.Lock()
+		defer stream.mu.Unlock()
+		if stream.Order == 0 {
+			return "", fmt.Errorf("stream %d has received no HEADERS", streamID)
+		}
+		return strconv.Itoa(stream.Order), nil
+	default:
+		return "", fmt.Errorf("unknown stream field: %s", field)
+	}
 }
 
 // getReqField extracts request field values
-func (c *Conn) getReqField(stream *Stream, field string) string {
+func (c *Conn) getReqField(stream *Stream, field string) (string, error) {
 	switch field {
 	case "method":
-		return stream.Method
-	case "path":
-		return stream.Path
+		return stream.Method, nil
+	case "path", "url":
+		return stream.Path, nil
 	case "scheme":
-		return stream.Scheme
+		return stream.Scheme, nil
 	case "authority":
-		return stream.Authority
+		return stream.Authority, nil
 	case "body":
-		return string(stream.ReqBody)
+		return string(stream.ReqBody), nil
 	case "bodylen":
-		return strconv.Itoa(len(stream.ReqBody))
+		return strconv.Itoa(len(stream.ReqBody)), nil
 	default:
+		if algo, ok := strings.CutPrefix(field, "body."); ok {
+			return util.Checksum(algo, stream.ReqBody)
+		}
 		// Check if it's a header
 		if strings.HasPrefix(field, "http.") {
 			headerName := strings.TrimPrefix(field, "http.")
-			return stream.GetHeader(stream.ReqHeaders, headerName)
+			return stream.GetHeader(stream.ReqHeaders, headerName), nil
 		}
 	}
-	return ""
+	return "", nil
 }
 
 // getRespField extracts response field values
-func (c *Conn) getRespField(stream *Stream, field string) string {
+func (c *Conn) getRespField(stream *Stream, field string) (string, error) {
 	switch field {
 	case "status":
-		return stream.Status
+		return stream.Status, nil
 	case "body":
-		return string(stream.RespBody)
+		return string(stream.RespBody), nil
 	case "bodylen":
-		return strconv.Itoa(len(stream.RespBody))
+		return strconv.Itoa(len(stream.RespBody)), nil
+	case "interim.count":
+		return strconv.Itoa(len(stream.Interim)), nil
 	default:
+		if algo, ok := strings.CutPrefix(field, "body."); ok {
+			return util.Checksum(algo, stream.RespBody)
+		}
 		// Check if it's a header
 		if strings.HasPrefix(field, "http.") {
 			headerName := strings.TrimPrefix(field, "http.")
-			return stream.GetHeader(stream.RespHeaders, headerName)
+			return stream.GetHeader(stream.RespHeaders, headerName), nil
+		}
+		if strings.HasPrefix(field, "interim[") {
+			return getInterimField(stream, field), nil
+		}
+	}
+	return "", nil
+}
+
+// getPushField extracts fields of the PUSH_PROMISE rxpush took last:
+// "id" (or "promised_id") and the promised request as "req.*". The stream
+// lock must be held by the caller.
+func (c *Conn) getPushField(stream *Stream, field string) (string, error) {
+	p := stream.Push
+	if p == nil {
+		return "", nil
+	}
+	switch field {
+	case "id", "promised_id":
+		return strconv.FormatUint(uint64(p.PromisedID), 10), nil
+	}
+	if name, ok := strings.CutPrefix(field, "req."); ok {
+		req := NewStream(p.PromisedID, "")
+		for _, hf := range p.Headers {
+			req.AddReqHeader(hf.Name, hf.Value)
+		}
+		return c.getReqField(req, name)
+	}
+	return "", nil
+}
+
+// getInterimField extracts fields of a 1xx response, e.g. "interim[0].status"
+// or "interim[0].http.link". The stream lock must be held by the caller.
+func getInterimField(stream *Stream, field string) string {
+	idxStr, rest, ok := strings.Cut(strings.TrimPrefix(field, "interim["), "].")
+	if !ok {
+		return ""
+	}
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil || idx < 0 || idx >= len(stream.Interim) {
+		return ""
+	}
+	ir := stream.Interim[idx]
+
+	if rest == "status" {
+		return ir.Status
+	}
+	if name, ok := strings.CutPrefix(rest, "http."); ok {
+		for _, hf := range ir.Headers {
+			if hf.Name == name {
+				return hf.Value
+			}
 		}
 	}
 	return ""
@@ -390,29 +748,40 @@ func (c *Conn) compare(actual, op, expected, field string) error {
 			return fmt.Errorf("expect %s !~ %q failed: got %q", field, expected, actual)
 		}
 	default:
-		// Numeric comparisons
-		actualInt, err1 := strconv.Atoi(actual)
-		expectedInt, err2 := strconv.Atoi(expected)
+		if util.IsToleranceOp(op) {
+			ok, err := util.CompareTolerance(actual, op, expected)
+			if err != nil {
+				return fmt.Errorf("expect %s: %w", field, err)
+			}
+			if !ok {
+				return fmt.Errorf("expect %s %s %s failed: got %s", field, op, expected, actual)
+			}
+			break
+		}
+
+		// Numeric comparisons (floats and durations in seconds)
+		actualNum, err1 := util.ParseNumber(actual)
+		expectedNum, err2 := util.ParseNumber(expected)
 		if err1 != nil || err2 != nil {
 			return fmt.Errorf("invalid numeric comparison for %s: %s %s %s", field, actual, op, expected)
 		}
 
 		switch op {
 		case "<":
-			if !(actualInt < expectedInt) {
-				return fmt.Errorf("expect %s < %s failed: got %d", field, expected, actualInt)
+			if !(actualNum < expectedNum) {
+				return fmt.Errorf("expect %s < %s failed: got %s", field, expected, actual)
 			}
 		case ">":
-			if !(actualInt > expectedInt) {
-				return fmt.Errorf("expect %s > %s failed: got %d", field, expected, actualInt)
+			if !(actualNum > expectedNum) {
+				return fmt.Errorf("expect %s > %s failed: got %s", field, expected, actual)
 			}
 		case "<=":
-			if !(actualInt <= expectedInt) {
-				return fmt.Errorf("expect %s <= %s failed: got %d", field, expected, actualInt)
+			if !(actualNum <= expectedNum) {
+				return fmt.Errorf("expect %s <= %s failed: got %s", field, expected, actual)
 			}
 		case ">=":
-			if !(actualInt >= expectedInt) {
-				return fmt.Errorf("expect %s >= %s failed: got %d", field, expected, actualInt)
+			if !(actualNum >= expectedNum) {
+				return fmt.Errorf("expect %s >= %s failed: got %s", field, expected, actual)
 			}
 		default:
 			return fmt.Errorf("unknown operator: %s", op)
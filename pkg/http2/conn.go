@@ -2,6 +2,7 @@ package http2
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -21,6 +22,10 @@ const (
 
 	// DefaultWindowSize is the default flow control window size
 	DefaultWindowSize = 65535 // 64KB - 1
+
+	// DefaultSettingsTimeout is how long StartAndWaitSettings waits for
+	// the SETTINGS exchange
+	DefaultSettingsTimeout = 5 * time.Second
 )
 
 // Conn represents an HTTP/2 connection
@@ -35,14 +40,21 @@ type Conn struct {
 	decoderMu sync.Mutex // Protects decoder (must be used sequentially)
 
 	// Write synchronization
-	writeMu sync.Mutex // Protects writes to conn to prevent frame corruption
+	writeMu   sync.Mutex // Protects writes to conn to prevent frame corruption
+	headersMu sync.Mutex // Keeps header blocks in the order the HPACK encoder saw them
 
 	// Stream management
 	streams *StreamManager
 
+	// Received frames per stream, for rxframe
+	frameQueues map[uint32]*frameQueue
+	framesMu    sync.Mutex
+
 	// Settings
 	localSettings  map[SettingID]uint32
 	remoteSettings map[SettingID]uint32
+	lastSettings   *SettingsFrame // Taken by rxsettings, for settings.* expects
+	rstErrs        map[uint32]uint32 // Error code of the RST_STREAM rxrst took last, per stream
 
 	// Flow control
 	sendWindow int32
@@ -55,8 +67,44 @@ type Conn struct {
 	frameRecvLoop  bool
 	lastStreamID   uint32
 	nextStreamID   uint32
+	nextPeerStream uint32 // The client stream "stream next" takes on a server
+	headerBlocks   int    // Streams numbered by their first header block, for stream.N.order
+	lastExchange   uint32 // Stream of the last rxreq or rxresp, for LastExchange
 	isClient       bool
 	enforcedFC     bool // Enforce flow control
+
+	// GOAWAY received from the peer. goAwayRecv is closed on the first one.
+	// Unless gracefulGoAway is set, a GOAWAY stops the connection.
+	goAway         *GoAway
+	goAwayRecv     chan struct{}
+	gracefulGoAway bool
+
+	// Closed on the peer's first SETTINGS, once applied, and on the first
+	// SETTINGS ACK. Only the receive loop closes them.
+	settingsRecv  chan struct{}
+	settingsAcked chan struct{}
+
+	// First connection error we detected and answered with GOAWAY
+	connErr *ConnError
+
+	// Header block being received: HEADERS or PUSH_PROMISE without
+	// END_HEADERS waiting for CONTINUATION. Only the receive loop touches
+	// these.
+	contStream    uint32
+	contBlock     []byte
+	contEndStream bool
+	contPromised  uint32 // Promised stream if the block is a PUSH_PROMISE's
+
+	// ConnectTime is how long the client took to connect (clients only)
+	ConnectTime time.Duration
+
+	// Perturb, if set, is called before a SETTINGS ACK goes out, to
+	// vary when the peer sees it (-chaos)
+	Perturb func()
+
+	// Abort, if set, ends waits for a frame when it is closed, as when
+	// the test is aborted or times out
+	Abort <-chan struct{}
 }
 
 // NewConn creates a new HTTP/2 connection
@@ -69,6 +117,8 @@ func NewConn(conn net.Conn, logger *logging.Logger, isClient bool) *Conn {
 		encoder: hpack.NewEncoder(4096), // Default table size
 		decoder: hpack.NewDecoder(4096),
 		streams: NewStreamManager(),
+		frameQueues: make(map[uint32]*frameQueue),
+		rstErrs:     make(map[uint32]uint32),
 		localSettings: map[SettingID]uint32{
 			SettingHeaderTableSize:      4096,
 			SettingEnablePush:           1,
@@ -76,10 +126,10 @@ func NewConn(conn net.Conn, logger *logging.Logger, isClient bool) *Conn {
 			SettingInitialWindowSize:    DefaultWindowSize,
 			SettingMaxFrameSize:         DefaultMaxFrameSize,
 		},
+		// MAX_CONCURRENT_STREAMS is unlimited until the peer sets it
 		remoteSettings: map[SettingID]uint32{
 			SettingHeaderTableSize:      4096,
 			SettingEnablePush:           1,
-			SettingMaxConcurrentStreams: 100,
 			SettingInitialWindowSize:    DefaultWindowSize,
 			SettingMaxFrameSize:         DefaultMaxFrameSize,
 		},
@@ -89,7 +139,11 @@ func NewConn(conn net.Conn, logger *logging.Logger, isClient bool) *Conn {
 		cancel:       cancel,
 		isClient:     isClient,
 		enforcedFC:   true,
+		goAwayRecv:   make(chan struct{}),
+		settingsRecv:  make(chan struct{}),
+		settingsAcked: make(chan struct{}),
 		nextStreamID: 1,
+		nextPeerStream: 1,
 	}
 
 	if isClient {
@@ -129,6 +183,48 @@ func (c *Conn) Start() error {
 	return nil
 }
 
+// StartAndWaitSettings starts the connection like Start, then waits for
+// the SETTINGS exchange: the peer's initial SETTINGS received and applied,
+// and ours acknowledged. Frames sent after it follow the peer's settings,
+// and the peer has taken ours, so specs need no sleep to get there.
+func (c *Conn) StartAndWaitSettings(timeout time.Duration) error {
+	if err := c.Start(); err != nil {
+		return err
+	}
+	return c.WaitSettings(timeout)
+}
+
+// WaitSettings waits up to timeout for the peer's first SETTINGS and the
+// ACK of ours
+func (c *Conn) WaitSettings(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, wait := range []struct {
+		done <-chan struct{}
+		what string
+	}{
+		{c.settingsRecv, "SETTINGS"},
+		{c.settingsAcked, "SETTINGS ACK"},
+	} {
+		select {
+		case <-wait.done:
+			continue
+		case <-c.ctx.Done():
+		case <-timer.C:
+			return fmt.Errorf("no %s from the peer within %v", wait.what, timeout)
+		}
+		// The connection may have ended right after the frame came
+		select {
+		case <-wait.done:
+		default:
+			return fmt.Errorf("connection closed waiting for %s", wait.what)
+		}
+	}
+	c.logger.Log(3, "SETTINGS exchanged")
+	return nil
+}
+
 // Stop closes the HTTP/2 connection
 func (c *Conn) Stop() error {
 	c.cancel()
@@ -170,14 +266,8 @@ func (c *Conn) ReceivePreface() error {
 // SendSettings sends a SETTINGS frame
 func (c *Conn) SendSettings(ack bool) error {
 	var settings []Setting
-
 	if !ack {
-		c.mu.Lock()
-		settings = make([]Setting, 0, len(c.localSettings))
-		for id, value := range c.localSettings {
-			settings = append(settings, Setting{ID: id, Value: value})
-		}
-		c.mu.Unlock()
+		settings = c.localSettingsList()
 	}
 
 	c.logger.Log(3, "Sending SETTINGS (ack=%v, %d settings)", ack, len(settings))
@@ -186,6 +276,17 @@ func (c *Conn) SendSettings(ack bool) error {
 	return WriteSettingsFrame(c.conn, 0, ack, settings)
 }
 
+// localSettingsList returns the local settings as sent in SETTINGS
+func (c *Conn) localSettingsList() []Setting {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	settings := make([]Setting, 0, len(c.localSettings))
+	for id, value := range c.localSettings {
+		settings = append(settings, Setting{ID: id, Value: value})
+	}
+	return settings
+}
+
 // SendSettingsAck sends a SETTINGS ACK frame
 func (c *Conn) SendSettingsAck() error {
 	return c.SendSettings(true)
@@ -205,6 +306,13 @@ func (c *Conn) UpdateSetting(id SettingID, value uint32) {
 	}
 }
 
+// remoteSetting retrieves a setting of the peer
+func (c *Conn) remoteSetting(id SettingID) uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remoteSettings[id]
+}
+
 // GetSetting retrieves a local setting value
 func (c *Conn) GetSetting(id SettingID) uint32 {
 	c.mu.Lock()
@@ -218,10 +326,13 @@ func (c *Conn) frameReceiveLoop() {
 	c.frameRecvLoop = true
 	c.mu.Unlock()
 
+	// Once nothing more can be received, commands waiting on the context
+	// (rxpush) give up instead of hanging
 	defer func() {
 		c.mu.Lock()
 		c.frameRecvLoop = false
 		c.mu.Unlock()
+		c.cancel()
 	}()
 
 	for {
@@ -260,6 +371,14 @@ func (c *Conn) frameReceiveLoop() {
 func (c *Conn) processFrame(frame Frame) error {
 	c.logger.Log(4, "Received frame: type=%s, flags=0x%x, stream=%d, length=%d",
 		frame.Header.Type, frame.Header.Flags, frame.Header.StreamID, frame.Header.Length)
+	c.queueFrame(frame)
+
+	// Nothing but CONTINUATION on the same stream may interrupt a header
+	// block (RFC 7540 section 6.10)
+	if c.contStream != 0 && (frame.Header.Type != FrameContinuation || frame.Header.StreamID != c.contStream) {
+		return c.connectionError(ErrCodeProtocol, fmt.Sprintf("%s frame on stream %d inside the header block of stream %d",
+			frame.Header.Type, frame.Header.StreamID, c.contStream))
+	}
 
 	switch frame.Header.Type {
 	case FrameSettings:
@@ -278,6 +397,8 @@ func (c *Conn) processFrame(frame Frame) error {
 		return c.handleRSTStream(frame)
 	case FrameContinuation:
 		return c.handleContinuation(frame)
+	case FramePushPromise:
+		return c.handlePushPromise(frame)
 	default:
 		c.logger.Log(2, "Unhandled frame type: %s", frame.Header.Type)
 	}
@@ -289,6 +410,7 @@ func (c *Conn) processFrame(frame Frame) error {
 func (c *Conn) handleSettings(frame Frame) error {
 	if frame.Header.Flags.Has(FlagAck) {
 		c.logger.Log(3, "Received SETTINGS ACK")
+		closeOnce(c.settingsAcked)
 		return nil
 	}
 
@@ -296,8 +418,27 @@ func (c *Conn) handleSettings(frame Frame) error {
 	if err != nil {
 		return err
 	}
+	c.applyRemoteSettings(settings)
+	closeOnce(c.settingsRecv)
+
+	// Send ACK asynchronously to prevent deadlock with synchronous pipes
+	// When both sides exchange SETTINGS simultaneously, sending ACK in the
+	// receive loop would block, causing deadlock. By sending async, the
+	// receive loop can continue reading while the ACK is being sent.
+	go func() {
+		if c.Perturb != nil {
+			c.Perturb()
+		}
+		if err := c.SendSettingsAck(); err != nil {
+			c.logger.Log(1, "Failed to send SETTINGS ACK: %v", err)
+		}
+	}()
+
+	return nil
+}
 
-	// Update remote settings
+// applyRemoteSettings takes settings received from the peer into use
+func (c *Conn) applyRemoteSettings(settings []Setting) {
 	var needsDecoderUpdate bool
 	var newTableSize uint32
 
@@ -314,24 +455,18 @@ func (c *Conn) handleSettings(frame Frame) error {
 	}
 	c.mu.Unlock()
 
+	for _, setting := range settings {
+		if setting.ID == SettingInitialWindowSize {
+			c.streams.UpdateInitialWindow(int32(setting.Value), true)
+		}
+	}
+
 	// Update decoder table size outside of c.mu lock to avoid lock ordering issues
 	if needsDecoderUpdate {
 		c.decoderMu.Lock()
 		c.decoder.SetMaxDynamicTableSize(newTableSize)
 		c.decoderMu.Unlock()
 	}
-
-	// Send ACK asynchronously to prevent deadlock with synchronous pipes
-	// When both sides exchange SETTINGS simultaneously, sending ACK in the
-	// receive loop would block, causing deadlock. By sending async, the
-	// receive loop can continue reading while the ACK is being sent.
-	go func() {
-		if err := c.SendSettingsAck(); err != nil {
-			c.logger.Log(1, "Failed to send SETTINGS ACK: %v", err)
-		}
-	}()
-
-	return nil
 }
 
 // handlePing processes a PING frame
@@ -362,14 +497,65 @@ func (c *Conn) handlePing(frame Frame) error {
 	return nil
 }
 
+// GoAway is the content of a GOAWAY frame
+type GoAway struct {
+	LastStreamID uint32
+	ErrorCode    uint32
+	Debug        []byte
+}
+
 // handleGoAway processes a GOAWAY frame
 func (c *Conn) handleGoAway(frame Frame) error {
 	if len(frame.Payload) < 8 {
 		return fmt.Errorf("invalid GOAWAY payload length: %d", len(frame.Payload))
 	}
 
-	c.logger.Log(2, "Received GOAWAY")
-	c.cancel() // Stop the connection
+	ga := &GoAway{
+		LastStreamID: binary.BigEndian.Uint32(frame.Payload[0:4]) & 0x7FFFFFFF,
+		ErrorCode:    binary.BigEndian.Uint32(frame.Payload[4:8]),
+		Debug:        append([]byte(nil), frame.Payload[8:]...),
+	}
+	c.mu.Lock()
+	first := c.goAway == nil
+	c.goAway = ga // A later GOAWAY may lower the last stream
+	graceful := c.gracefulGoAway
+	c.mu.Unlock()
+	if first {
+		close(c.goAwayRecv)
+	}
+
+	c.logger.Log(2, "Received GOAWAY (lastStreamID=%d, errorCode=%s, debug=%q)",
+		ga.LastStreamID, ErrCodeName(ga.ErrorCode), ga.Debug)
+	if !graceful {
+		c.cancel() // Stop the connection
+		return nil
+	}
+
+	// Streams up to the last one carry on; ours above it were never
+	// processed by the peer and are closed
+	for _, id := range c.streams.List() {
+		if id > ga.LastStreamID && (id%2 == 1) == c.isClient {
+			if stream, ok := c.streams.Get(id); ok {
+				stream.mu.Lock()
+				stream.State = StreamClosed
+				stream.mu.Unlock()
+				stream.Signal()
+			}
+		}
+	}
+	return nil
+}
+
+// checkGoAway returns an error if a GOAWAY from the peer rules out opening
+// the stream
+func (c *Conn) checkGoAway(streamID uint32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.goAway != nil && streamID > c.goAway.LastStreamID && (streamID%2 == 1) == c.isClient {
+		return fmt.Errorf("stream %d not opened: GOAWAY received with last stream %d",
+			streamID, c.goAway.LastStreamID)
+	}
 	return nil
 }
 
@@ -402,25 +588,63 @@ func (c *Conn) handleWindowUpdate(frame Frame) error {
 
 // handleHeaders processes a HEADERS frame
 func (c *Conn) handleHeaders(frame Frame) error {
-	stream := c.streams.GetOrCreate(frame.Header.StreamID, fmt.Sprintf("stream-%d", frame.Header.StreamID))
+	block, err := framePayload(frame)
+	if err != nil {
+		return err
+	}
+
+	// Track the highest stream the peer opened, for GOAWAY
+	peerStream := (frame.Header.StreamID%2 == 1) != c.isClient
+	c.mu.Lock()
+	if peerStream && frame.Header.StreamID > c.lastStreamID {
+		c.lastStreamID = frame.Header.StreamID
+	}
+	c.mu.Unlock()
+
+	endStream := frame.Header.Flags.Has(FlagEndStream)
+	if !frame.Header.Flags.Has(FlagEndHeaders) {
+		c.contStream = frame.Header.StreamID
+		c.contBlock = append([]byte(nil), block...)
+		c.contEndStream = endStream
+		c.contPromised = 0
+		c.logger.Log(3, "Received HEADERS on stream %d without END_HEADERS", frame.Header.StreamID)
+		return nil
+	}
+	return c.handleHeaderBlock(frame.Header.StreamID, block, endStream)
+}
+
+// handleHeaderBlock processes a complete header block
+func (c *Conn) handleHeaderBlock(streamID uint32, block []byte, endStream bool) error {
+	stream := c.streams.GetOrCreate(streamID, fmt.Sprintf("stream-%d", streamID))
 
 	// Decode HPACK headers (must be serialized)
 	c.decoderMu.Lock()
-	headers, err := c.decoder.Decode(frame.Payload)
+	headers, err := c.decoder.Decode(block)
 	c.decoderMu.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to decode headers: %w", err)
+		return c.hpackError(err)
 	}
+	c.numberStream(stream)
 
 	// Determine if this is a request or response by checking for pseudo-headers
 	isResponse := false
+	isInterim := false
 	for _, hf := range headers {
 		if hf.Name == ":status" {
 			isResponse = true
+			isInterim = len(hf.Value) == 3 && hf.Value[0] == '1'
 			break
 		}
 	}
 
+	// 1xx responses are kept apart; rxresp keeps waiting for the final one
+	if isInterim {
+		stream.markReceived(false, false)
+		stream.AddInterim(headers)
+		c.logger.Log(3, "Received interim HEADERS on stream %d", streamID)
+		return nil
+	}
+
 	// Add headers to stream using the appropriate method
 	for _, hf := range headers {
 		if isResponse {
@@ -430,10 +654,10 @@ func (c *Conn) handleHeaders(frame Frame) error {
 		}
 	}
 
-	endStream := frame.Header.Flags.Has(FlagEndStream)
+	stream.markReceived(true, endStream)
 	stream.UpdateState(endStream, false)
 
-	c.logger.Log(3, "Received HEADERS on stream %d (END_STREAM=%v)", frame.Header.StreamID, endStream)
+	c.logger.Log(3, "Received HEADERS on stream %d (END_STREAM=%v)", streamID, endStream)
 
 	// Signal the stream
 	stream.Signal()
@@ -441,6 +665,20 @@ func (c *Conn) handleHeaders(frame Frame) error {
 	return nil
 }
 
+// numberStream gives a stream its place in the order the streams' first
+// header blocks came in
+func (c *Conn) numberStream(stream *Stream) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.Order != 0 {
+		return
+	}
+	c.mu.Lock()
+	c.headerBlocks++
+	stream.Order = c.headerBlocks
+	c.mu.Unlock()
+}
+
 // handleData processes a DATA frame
 func (c *Conn) handleData(frame Frame) error {
 	stream, ok := c.streams.Get(frame.Header.StreamID)
@@ -448,13 +686,32 @@ func (c *Conn) handleData(frame Frame) error {
 		return fmt.Errorf("DATA frame for unknown stream %d", frame.Header.StreamID)
 	}
 
-	stream.AppendReqBody(frame.Payload)
+	data, err := framePayload(frame)
+	if err != nil {
+		return err
+	}
+	// A client receives the response body, a server the request's
+	if c.isClient {
+		stream.AppendRespBody(data)
+	} else {
+		stream.AppendReqBody(data)
+	}
+	stream.mu.Lock()
+	stream.DataFrames++
+	stream.mu.Unlock()
+
+	// The whole payload, padding included, counts against flow control
+	c.mu.Lock()
+	c.recvWindow -= int32(frame.Header.Length)
+	c.mu.Unlock()
+	stream.UpdateRecvWindow(-int32(frame.Header.Length))
 
 	endStream := frame.Header.Flags.Has(FlagEndStream)
+	stream.markReceived(false, endStream)
 	stream.UpdateState(endStream, false)
 
 	c.logger.Log(3, "Received DATA on stream %d: %d bytes (END_STREAM=%v)",
-		frame.Header.StreamID, len(frame.Payload), endStream)
+		frame.Header.StreamID, len(data), endStream)
 
 	// Signal the stream
 	stream.Signal()
@@ -474,12 +731,123 @@ func (c *Conn) handleRSTStream(frame Frame) error {
 	return nil
 }
 
-// handleContinuation processes a CONTINUATION frame
+// handleContinuation processes a CONTINUATION frame, completing the header
+// block once END_HEADERS is set
 func (c *Conn) handleContinuation(frame Frame) error {
 	c.logger.Log(3, "Received CONTINUATION on stream %d", frame.Header.StreamID)
-	// CONTINUATION frames extend HEADERS frames
-	// For simplicity, we'll handle them similarly to HEADERS
-	return c.handleHeaders(frame)
+	if c.contStream == 0 {
+		return c.connectionError(ErrCodeProtocol,
+			fmt.Sprintf("CONTINUATION on stream %d without a header block", frame.Header.StreamID))
+	}
+
+	c.contBlock = append(c.contBlock, frame.Payload...)
+	if !frame.Header.Flags.Has(FlagEndHeaders) {
+		return nil
+	}
+	streamID, block, endStream, promisedID := c.contStream, c.contBlock, c.contEndStream, c.contPromised
+	c.contStream, c.contBlock, c.contPromised = 0, nil, 0
+	if promisedID != 0 {
+		return c.handlePushBlock(streamID, promisedID, block)
+	}
+	return c.handleHeaderBlock(streamID, block, endStream)
+}
+
+// handlePushPromise processes a PUSH_PROMISE frame
+func (c *Conn) handlePushPromise(frame Frame) error {
+	if !c.isClient {
+		return c.connectionError(ErrCodeProtocol, "PUSH_PROMISE sent to a server")
+	}
+	if c.GetSetting(SettingEnablePush) == 0 {
+		return c.connectionError(ErrCodeProtocol, "PUSH_PROMISE with SETTINGS_ENABLE_PUSH disabled")
+	}
+
+	payload, err := framePayload(frame)
+	if err != nil {
+		return err
+	}
+	if len(payload) < 4 {
+		return fmt.Errorf("invalid PUSH_PROMISE payload length: %d", len(payload))
+	}
+	promisedID := binary.BigEndian.Uint32(payload[0:4]) & 0x7FFFFFFF
+	if promisedID == 0 || promisedID%2 != 0 {
+		return c.connectionError(ErrCodeProtocol, fmt.Sprintf("PUSH_PROMISE promising invalid stream %d", promisedID))
+	}
+
+	block := payload[4:]
+	if !frame.Header.Flags.Has(FlagEndHeaders) {
+		c.contStream = frame.Header.StreamID
+		c.contBlock = append([]byte(nil), block...)
+		c.contEndStream = false
+		c.contPromised = promisedID
+		c.logger.Log(3, "Received PUSH_PROMISE on stream %d without END_HEADERS", frame.Header.StreamID)
+		return nil
+	}
+	return c.handlePushBlock(frame.Header.StreamID, promisedID, block)
+}
+
+// handlePushBlock processes the complete header block of a PUSH_PROMISE:
+// the promised stream is reserved with the promised request, and the push
+// is queued on the stream it came on for rxpush
+func (c *Conn) handlePushBlock(streamID, promisedID uint32, block []byte) error {
+	c.decoderMu.Lock()
+	headers, err := c.decoder.Decode(block)
+	c.decoderMu.Unlock()
+	if err != nil {
+		return c.hpackError(err)
+	}
+
+	promised := c.streams.GetOrCreate(promisedID, fmt.Sprintf("stream-%d", promisedID))
+	if err := promised.Reserve(false); err != nil {
+		return c.connectionError(ErrCodeProtocol, err.Error())
+	}
+	for _, hf := range headers {
+		promised.AddReqHeader(hf.Name, hf.Value)
+	}
+
+	c.logger.Log(3, "Received PUSH_PROMISE on stream %d (promised=%d)", streamID, promisedID)
+	stream := c.streams.GetOrCreate(streamID, fmt.Sprintf("stream-%d", streamID))
+	stream.AddPush(PushPromise{PromisedID: promisedID, Headers: headers})
+	return nil
+}
+
+// ConnError is a connection error we detected in what the peer sent
+type ConnError struct {
+	Code   uint32
+	Reason string
+	Hpack  string // hpack.ErrorName of the decoding error, if HPACK failed
+}
+
+// connectionError sends GOAWAY with the error code and returns an error
+// that ends the receive loop
+func (c *Conn) connectionError(code uint32, reason string) error {
+	return c.recordError(&ConnError{Code: code, Reason: reason})
+}
+
+// hpackError answers a header block that failed to decode with a
+// COMPRESSION_ERROR (RFC 7540 section 4.3)
+func (c *Conn) hpackError(err error) error {
+	return c.recordError(&ConnError{
+		Code:   ErrCodeCompression,
+		Reason: "HPACK: " + err.Error(),
+		Hpack:  hpack.ErrorName(err),
+	})
+}
+
+// recordError keeps the first connection error for conn.* expects and
+// sends GOAWAY with its code
+func (c *Conn) recordError(e *ConnError) error {
+	code, reason := e.Code, e.Reason
+	c.mu.Lock()
+	if c.connErr == nil {
+		c.connErr = e
+	}
+	lastStreamID := c.lastStreamID
+	c.mu.Unlock()
+
+	if err := c.TxGoAway(lastStreamID, code, reason); err != nil {
+		c.logger.Log(2, "Failed to send GOAWAY: %v", err)
+	}
+	return fmt.Errorf("connection error (code %d): %s", code, reason)
 }
 
 // NextStreamID returns the next stream ID to use
@@ -492,6 +860,56 @@ func (c *Conn) NextStreamID() uint32 {
 	return id
 }
 
+// SetNextStreamID overrides the ID NextStreamID returns next, whether or
+// not it is valid for this side of the connection
+func (c *Conn) SetNextStreamID(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextStreamID = id
+	c.logger.Log(3, "Next stream ID set to %d", id)
+}
+
+// specStream returns the counter "stream next" takes its IDs from: our
+// own streams on a client, and the client's streams on a server, which
+// answers them. c.mu must be held.
+func (c *Conn) specStream() *uint32 {
+	if c.isClient {
+		return &c.nextStreamID
+	}
+	return &c.nextPeerStream
+}
+
+// NextSpecStreamID returns the stream "stream next" takes: 1, 3, 5... on
+// both sides, continuing after the streams a spec named by ID
+func (c *Conn) NextSpecStreamID() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := c.specStream()
+	id := *next
+	*next += 2
+	return id
+}
+
+// SetNextSpecStreamID overrides the ID "stream next" takes next, whether
+// or not it is valid
+func (c *Conn) SetNextSpecStreamID(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	*c.specStream() = id
+	c.logger.Log(3, "Next stream ID set to %d", id)
+}
+
+// UseSpecStreamID notes a stream a spec named by ID, so that "stream
+// next" continues after it, as in VTest2
+func (c *Conn) UseSpecStreamID(id uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	next := c.specStream()
+	if id >= *next && id%2 == *next%2 {
+		*next = id + 2
+	}
+}
+
 // WriteFrame writes a frame to the connection
 func (c *Conn) WriteFrame(frame Frame) error {
 	c.writeMu.Lock()
@@ -510,3 +928,13 @@ func (c *Conn) WriteRawFrame(length uint32, frameType FrameType, flags Flags, st
 func (c *Conn) GetStream(streamID uint32) (*Stream, bool) {
 	return c.streams.Get(streamID)
 }
+
+// closeOnce closes ch unless it is closed already. Only one goroutine may
+// close it.
+func closeOnce(ch chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
@@ -0,0 +1,1215 @@
+package http2
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/GTest/pkg/hpack"
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/util"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+func headersFrame(streamID uint32, flags Flags, block []byte) Frame {
+	return Frame{
+		Header:  FrameHeader{Length: uint32(len(block)), Type: FrameHeaders, Flags: flags, StreamID: streamID},
+		Payload: block,
+	}
+}
+
+func TestConn_Continuation(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	block, err := hpack.NewEncoder(4096).Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/split"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.processFrame(headersFrame(1, FlagEndStream, block[:2])); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.GetStream(1); ok {
+		t.Fatal("Stream created before the header block was complete")
+	}
+	cont := Frame{
+		Header:  FrameHeader{Type: FrameContinuation, Flags: FlagEndHeaders, StreamID: 1},
+		Payload: block[2:],
+	}
+	if err := c.processFrame(cont); err != nil {
+		t.Fatal(err)
+	}
+	stream, ok := c.GetStream(1)
+	if !ok {
+		t.Fatal("Stream not created")
+	}
+	if stream.Method != "GET" || stream.Path != "/split" {
+		t.Errorf("Got %s %s, want GET /split", stream.Method, stream.Path)
+	}
+}
+
+func TestConn_InterruptedHeaderBlock(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	goaway := make(chan Frame, 1)
+	go func() {
+		if f, err := ReadFrame(b); err == nil {
+			goaway <- f
+		}
+	}()
+
+	if err := c.processFrame(headersFrame(1, FlagNone, []byte{0x82})); err != nil {
+		t.Fatal(err)
+	}
+	ping := Frame{Header: FrameHeader{Type: FramePing, Length: 8}, Payload: make([]byte, 8)}
+	if err := c.processFrame(ping); err == nil {
+		t.Fatal("Expected connection error for PING inside a header block")
+	}
+
+	f := <-goaway
+	if f.Header.Type != FrameGoAway {
+		t.Fatalf("Got %s frame, want GOAWAY", f.Header.Type)
+	}
+	if code := uint32(f.Payload[4])<<24 | uint32(f.Payload[5])<<16 | uint32(f.Payload[6])<<8 | uint32(f.Payload[7]); code != ErrCodeProtocol {
+		t.Errorf("GOAWAY error code %d, want PROTOCOL_ERROR", code)
+	}
+	if last := f.Payload[3]; last != 1 {
+		t.Errorf("GOAWAY last stream %d, want 1", last)
+	}
+}
+
+func TestConn_PushPromise(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	srv := NewConn(a, logging.NewLogger("test"), false)
+	cli := NewConn(b, logging.NewLogger("test"), true)
+	srv.streams.Create(1, "stream-1")
+	cli.streams.Create(1, "stream-1")
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := srv.TxPushPromise(1, TxPushOptions{
+			PromisedID: 2,
+			Method:     "GET",
+			Path:       "/pushed",
+			Scheme:     "https",
+			Authority:  "example.com",
+			Frame:      FrameOptions{Padded: true, Pad: []byte("pad")},
+		})
+		sent <- err
+	}()
+	frame, err := ReadFrame(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if frame.Header.Type != FramePushPromise || !frame.Header.Flags.Has(FlagEndHeaders|FlagPadded) {
+		t.Fatalf("Got %s frame with flags %#x", frame.Header.Type, frame.Header.Flags)
+	}
+	if s, _ := srv.GetStream(2); s.State != StreamReservedLocal {
+		t.Errorf("Server promised stream is %s, want reserved(local)", s.State)
+	}
+
+	if err := cli.processFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	promised, ok := cli.GetStream(2)
+	if !ok {
+		t.Fatal("Promised stream not created")
+	}
+	if promised.State != StreamReservedRemote || promised.Path != "/pushed" {
+		t.Errorf("Promised stream is %s with path %q", promised.State, promised.Path)
+	}
+
+	if _, err := cli.RxPush(1); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"push.id":            "2",
+		"push.req.url":       "/pushed",
+		"push.req.authority": "example.com",
+		"req.method":         "GET",
+	} {
+		if err := cli.Expect(1, field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+
+	promised.UpdateState(false, false)
+	if promised.State != StreamHalfClosedLocal {
+		t.Errorf("Promised stream is %s after the pushed response, want half-closed(local)", promised.State)
+	}
+}
+
+func TestConn_RxFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	winup := Frame{Header: FrameHeader{Type: FrameWindowUpdate, Length: 4}, Payload: []byte{0, 0, 0, 1}}
+	ping := Frame{Header: FrameHeader{Type: FramePing, Flags: FlagAck, Length: 8}, Payload: make([]byte, 8)}
+	for _, f := range []Frame{winup, ping} {
+		if err := c.processFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pingType := FramePing
+	if _, err := c.RxFrame(0, &pingType); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"frame.type":     "6",
+		"frame.typename": "PING",
+		"frame.flags":    "1",
+		"frame.size":     "8",
+		"frame.streamid": "0",
+	} {
+		if err := c.Expect(0, field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// A frame arriving later wakes a waiting rxframe
+	got := make(chan error, 1)
+	go func() {
+		_, err := c.RxFrame(3, nil)
+		got <- err
+	}()
+	if err := c.processFrame(Frame{Header: FrameHeader{Type: FrameRSTStream, Length: 4, StreamID: 3}, Payload: make([]byte, 4)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Expect(3, "frame.type", "==", "3"); err != nil {
+		t.Error(err)
+	}
+
+	// Nothing left: the wait ends when the test is aborted
+	abort := make(chan struct{})
+	c.Abort = abort
+	close(abort)
+	if _, err := c.RxFrame(0, nil); err == nil {
+		t.Error("Expected error once the test is aborted")
+	}
+	c.Abort = nil
+
+	// Or with the connection
+	c.cancel()
+	if _, err := c.RxFrame(0, nil); err == nil {
+		t.Error("Expected error once the connection is closed")
+	}
+}
+
+func goAwayFrame(lastStreamID, code uint32, debug string) Frame {
+	var buf bytes.Buffer
+	WriteGoAwayFrame(&buf, lastStreamID, code, []byte(debug))
+	f, _ := ReadFrame(&buf)
+	return f
+}
+
+func TestConn_GoAway(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	c.SetGracefulGoAway(true)
+	open := c.streams.Create(1, "stream-1")
+	open.State = StreamOpen
+	refused := c.streams.Create(3, "stream-3")
+	refused.State = StreamOpen
+
+	if err := c.processFrame(goAwayFrame(1, ErrCodeNo, "bye")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RxGoAway(); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"goaway.err":        "0",
+		"goaway.laststream": "1",
+		"goaway.debug":      "bye",
+	} {
+		if err := c.Expect(1, field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if c.ctx.Err() != nil {
+		t.Error("Graceful GOAWAY stopped the connection")
+	}
+	if open.State != StreamOpen || refused.State != StreamClosed {
+		t.Errorf("Streams 1 and 3 are %s and %s, want open and closed", open.State, refused.State)
+	}
+	if err := c.checkGoAway(1); err != nil {
+		t.Error(err)
+	}
+	if err := c.checkGoAway(5); err == nil {
+		t.Error("Expected new stream 5 to be refused after GOAWAY")
+	}
+}
+
+func TestConn_GoAwayStops(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+
+	if err := c.processFrame(goAwayFrame(0, ErrCodeProtocol, "")); err != nil {
+		t.Fatal(err)
+	}
+	if c.ctx.Err() == nil {
+		t.Error("GOAWAY did not stop the connection")
+	}
+	ga, err := c.RxGoAway()
+	if err != nil || ga.ErrorCode != ErrCodeProtocol {
+		t.Errorf("RxGoAway = %+v, %v", ga, err)
+	}
+}
+
+func TestConn_Settings(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	go io.Copy(io.Discard, b)
+
+	stream := c.streams.Create(1, "stream-1")
+	stream.State = StreamOpen
+
+	var buf bytes.Buffer
+	WriteSettingsFrame(&buf, 0, false, []Setting{
+		{ID: SettingInitialWindowSize, Value: 100},
+		{ID: SettingMaxFrameSize, Value: 16384},
+		{ID: SettingMaxConcurrentStreams, Value: 1},
+	})
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RxSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]string{
+		"settings.ack":        "false",
+		"settings.winsize":    "100",
+		"settings.maxstreams": "1",
+		"settings.hdrtbl":     "<undef>",
+		"stream.peer_window":  "100",
+	} {
+		if err := c.Expect(1, field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// 20000 bytes take two frames and leave the stream window negative
+	if err := c.TxData(1, make([]byte, 20000), false, FrameOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if w := c.GetSendWindow(1); w != 100-20000 {
+		t.Errorf("Stream send window %d, want %d", w, 100-20000)
+	}
+	c.TxSettings(false, map[SettingID]uint32{SettingInitialWindowSize: 1000})
+	if w := c.GetRecvWindow(1); w != 1000 {
+		t.Errorf("Stream receive window %d after our SETTINGS, want 1000", w)
+	}
+
+	if err := c.checkConcurrency(3); err == nil {
+		t.Error("Expected stream 3 to exceed MAX_CONCURRENT_STREAMS")
+	}
+	if err := c.TxReq(3, TxReqOptions{Method: "GET", Path: "/", Frame: FrameOptions{NoEnforce: true}}); err != nil {
+		t.Errorf("-noenforce: %v", err)
+	}
+}
+
+func TestConn_ConcurrencyBeforeSettings(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+
+	for id := uint32(1); id < 400; id += 2 {
+		c.streams.Create(id, "stream").State = StreamOpen
+	}
+	if err := c.checkConcurrency(401); err != nil {
+		t.Errorf("Limited before the peer's SETTINGS: %v", err)
+	}
+
+	c.applyRemoteSettings([]Setting{{ID: SettingMaxConcurrentStreams, Value: 100}})
+	if err := c.checkConcurrency(401); err == nil {
+		t.Error("Expected stream 401 to exceed MAX_CONCURRENT_STREAMS")
+	}
+}
+
+func TestConn_WaitSettings(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	go io.Copy(io.Discard, b)
+
+	// A peer that never answers
+	if err := c.StartAndWaitSettings(50 * time.Millisecond); err == nil {
+		t.Fatal("Expected a timeout without the peer's SETTINGS")
+	}
+
+	// The peer's SETTINGS alone is not enough, its ACK of ours is needed
+	for _, ack := range []bool{false, true} {
+		var buf bytes.Buffer
+		WriteSettingsFrame(&buf, 0, ack, nil)
+		frame, err := ReadFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.processFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+		err = c.WaitSettings(50 * time.Millisecond)
+		if ack && err != nil {
+			t.Errorf("WaitSettings after the ACK: %v", err)
+		} else if !ack && err == nil {
+			t.Error("WaitSettings returned before the ACK")
+		}
+	}
+
+	// A connection that ends gives up at once
+	d := NewConn(nil, logging.NewLogger("test"), true)
+	d.cancel()
+	if err := d.WaitSettings(time.Minute); err == nil {
+		t.Error("Expected an error on a closed connection")
+	}
+}
+
+func TestParseErrCode(t *testing.T) {
+	for s, want := range map[string]uint32{
+		"0":                  ErrCodeNo,
+		"7":                  ErrCodeRefusedStream,
+		"0xb":                ErrCodeEnhanceYourCalm,
+		"PROTOCOL_ERROR":     ErrCodeProtocol,
+		"flow_control_error": ErrCodeFlowControl,
+		"HTTP_1_1_REQUIRED":  ErrCodeHTTP11Required,
+		"4294967295":         0xffffffff,
+	} {
+		if got, err := ParseErrCode(s); err != nil || got != want {
+			t.Errorf("ParseErrCode(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"PROTOCOL", "", "-1", "4294967296"} {
+		if _, err := ParseErrCode(s); err == nil {
+			t.Errorf("ParseErrCode(%q) should fail", s)
+		}
+	}
+	if name := ErrCodeName(ErrCodeCancel); name != "CANCEL" {
+		t.Errorf("ErrCodeName(CANCEL) = %s", name)
+	}
+	if name := ErrCodeName(0x42); name != "66" {
+		t.Errorf("ErrCodeName(0x42) = %s, want 66", name)
+	}
+}
+
+func TestConn_RxRst(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+
+	if err := c.Expect(1, "rst.err", "==", "CANCEL"); err == nil {
+		t.Error("Expected rst.err to fail before rxrst")
+	}
+
+	var buf bytes.Buffer
+	WriteRSTStreamFrame(&buf, 1, ErrCodeRefusedStream)
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RxRst(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ op, value string }{
+		{"==", "REFUSED_STREAM"},
+		{"==", "refused_stream"},
+		{"==", "7"},
+		{"!=", "CANCEL"},
+		{">", "PROTOCOL_ERROR"},
+	} {
+		if err := c.Expect(1, "rst.err", tc.op, tc.value); err != nil {
+			t.Error(err)
+		}
+	}
+	err = c.Expect(1, "rst.err", "==", "CANCEL")
+	if err == nil || !strings.Contains(err.Error(), "REFUSED_STREAM") {
+		t.Errorf("Expected a failure naming REFUSED_STREAM, got %v", err)
+	}
+}
+
+func TestWriteData_Chunks(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	c.remoteSettings[SettingMaxFrameSize] = 10
+	stream := c.streams.Create(1, "stream-1")
+
+	sizes := make(chan []int, 1)
+	go func() {
+		var got []int
+		for {
+			f, err := ReadFrame(b)
+			if err != nil {
+				break
+			}
+			got = append(got, int(f.Header.Length))
+			if f.Header.Flags.Has(FlagEndStream) {
+				break
+			}
+		}
+		sizes <- got
+	}()
+	if err := c.writeData(stream, make([]byte, 15), true, FrameOptions{Padded: true, Pad: []byte("xx")}); err != nil {
+		t.Fatal(err)
+	}
+	// Each frame carries 7 bytes of data plus 3 of padding
+	if got := <-sizes; fmt.Sprint(got) != "[10 10 4]" {
+		t.Errorf("Frame sizes %v, want [10 10 4]", got)
+	}
+}
+
+func TestWriteData_Paced(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	stream := c.streams.Create(1, "stream-1")
+
+	sizes := make(chan []int, 1)
+	go func() {
+		var got []int
+		for {
+			f, err := ReadFrame(b)
+			if err != nil {
+				break
+			}
+			got = append(got, int(f.Header.Length))
+			if f.Header.Flags.Has(FlagEndStream) {
+				break
+			}
+		}
+		sizes <- got
+	}()
+	start := time.Now()
+	if err := c.writeData(stream, make([]byte, 2500), true, FrameOptions{FrameSize: 1000, Pace: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Three frames paced 10ms apart sent in %v", elapsed)
+	}
+	if got := <-sizes; fmt.Sprint(got) != "[1000 1000 500]" {
+		t.Errorf("Frame sizes %v, want [1000 1000 500]", got)
+	}
+}
+
+func TestConn_RxDataFrames(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+	stream := c.streams.Create(1, "stream-1")
+	stream.UpdateState(false, false)
+
+	got := make(chan error, 1)
+	go func() {
+		_, err := c.RxDataFrames(1, 2)
+		got <- err
+	}()
+	for _, data := range []string{"ab", "cd", "ef"} {
+		if err := c.processFrame(Frame{
+			Header:  FrameHeader{Length: 2, Type: FrameData, StreamID: 1},
+			Payload: []byte(data),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-got; err != nil {
+		t.Fatal(err)
+	}
+
+	// One frame is left; the stream ends before a second one
+	if err := c.processFrame(Frame{
+		Header: FrameHeader{Type: FrameData, Flags: FlagEndStream, StreamID: 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.RxDataFrames(1, 3); err == nil {
+		t.Error("Expected error for a stream ending after 2 of 3 DATA frames")
+	}
+	if _, err := c.RxDataFrames(1, 2); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestConn_RxDataBody checks that DATA frames go to the response body on
+// a client, and to the request body on a server
+func TestConn_RxDataBody(t *testing.T) {
+	for _, isClient := range []bool{true, false} {
+		a, b := net.Pipe()
+		c := NewConn(a, logging.NewLogger("test"), isClient)
+		stream := c.streams.Create(1, "stream-1")
+		stream.UpdateState(false, false)
+		for _, data := range []string{"hello, ", "world"} {
+			if err := c.processFrame(Frame{
+				Header:  FrameHeader{Length: uint32(len(data)), Type: FrameData, StreamID: 1},
+				Payload: []byte(data),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, other := stream.ReqBody, stream.RespBody
+		if isClient {
+			body, other = stream.RespBody, stream.ReqBody
+		}
+		if string(body) != "hello, world" || len(other) != 0 {
+			t.Errorf("client %v: got request body %q and response body %q", isClient, stream.ReqBody, stream.RespBody)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+// TestConn_BodyChecksum checks the req.body.ALGO and resp.body.ALGO
+// fields, and that an unknown algorithm fails instead of giving ""
+func TestConn_BodyChecksum(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	stream := c.streams.Create(1, "stream-1")
+	stream.AppendReqBody([]byte("hello"))
+	stream.AppendRespBody([]byte("hello"))
+
+	for _, field := range []string{"req.body.md5", "resp.body.md5"} {
+		if got, err := c.Field(1, field); err != nil || got != "5d41402abc4b2a76b9719d911017c592" {
+			t.Errorf("%s = %q, %v", field, got, err)
+		}
+	}
+	for _, field := range []string{"req.body.sha265", "resp.body.sha265"} {
+		if _, err := c.Field(1, field); err == nil || !strings.Contains(err.Error(), "unknown checksum algorithm: sha265") {
+			t.Errorf("%s: expected an unknown algorithm error, got %v", field, err)
+		}
+	}
+}
+
+// TestConn_RxReqClosed checks that rxreq on a stream the peer never
+// opens fails once the connection ends, instead of waiting forever
+func TestConn_RxReqClosed(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	got := make(chan error, 1)
+	go func() {
+		got <- c.RxReq(1)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	c.Stop()
+
+	select {
+	case err := <-got:
+		if err == nil || !strings.Contains(err.Error(), "connection closed waiting on stream 1") {
+			t.Errorf("RxReq() = %v, want a connection closed error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("RxReq() still waiting after the connection closed")
+	}
+}
+
+func TestConn_EndStreamPlacement(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	frames := make(chan Frame, 8)
+	go func() {
+		for {
+			frame, err := ReadFrame(b)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- frame
+		}
+	}()
+	next := func() Frame {
+		t.Helper()
+		select {
+		case frame := <-frames:
+			return frame
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for a frame")
+			return Frame{}
+		}
+	}
+
+	tests := []struct {
+		opts TxReqOptions
+		want []string // frame type and whether it carries END_STREAM
+	}{
+		{TxReqOptions{EndStream: true}, []string{"HEADERS true"}},
+		{TxReqOptions{EndStream: true, Body: []byte("abc")}, []string{"HEADERS false", "DATA true"}},
+		{TxReqOptions{}, []string{"HEADERS false"}},
+		{TxReqOptions{Body: []byte("abc")}, []string{"HEADERS false", "DATA false"}},
+	}
+	for i, tt := range tests {
+		id := uint32(2*i + 1)
+		tt.opts.Method, tt.opts.Path = "POST", "/"
+		if err := c.TxReq(id, tt.opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tt.want {
+			frame := next()
+			got := fmt.Sprintf("%s %v", frame.Header.Type, frame.Header.Flags.Has(FlagEndStream))
+			if got != want {
+				t.Errorf("stream %d: got %s, want %s", id, got, want)
+			}
+		}
+	}
+
+	// A response with a body ends the stream on its last DATA frame
+	c.streams.Create(9, "stream-9")
+	if err := c.TxResp(9, TxRespOptions{Status: "200", Body: []byte("abc"), EndStream: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"HEADERS false", "DATA true"} {
+		frame := next()
+		if got := fmt.Sprintf("%s %v", frame.Header.Type, frame.Header.Flags.Has(FlagEndStream)); got != want {
+			t.Errorf("response: got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestConn_StreamIDPolicy(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	go io.Copy(io.Discard, b)
+
+	if id := c.NextStreamID(); id != 1 {
+		t.Errorf("first client stream = %d, want 1", id)
+	}
+	c.SetNextStreamID(0)
+	if id := c.NextStreamID(); id != 0 {
+		t.Errorf("overridden stream = %d, want 0", id)
+	}
+	if id := c.NextStreamID(); id != 2 {
+		t.Errorf("stream after override = %d, want 2", id)
+	}
+
+	// Reusing a closed stream starts it afresh
+	if err := c.TxReq(1, TxReqOptions{Method: "GET", Path: "/a", EndStream: true}); err != nil {
+		t.Fatal(err)
+	}
+	old, _ := c.GetStream(1)
+	old.State = StreamClosed
+	if err := c.TxReq(1, TxReqOptions{Method: "GET", Path: "/b", EndStream: true}); err != nil {
+		t.Fatal(err)
+	}
+	stream, _ := c.GetStream(1)
+	if stream == old || stream.Path != "/b" || stream.State != StreamHalfClosedLocal {
+		t.Errorf("reused stream: path %q, state %s", stream.Path, stream.State)
+	}
+}
+
+func TestConn_SpecStreamID(t *testing.T) {
+	for _, isClient := range []bool{true, false} {
+		c := NewConn(nil, logging.NewLogger("test"), isClient)
+		var got []uint32
+		got = append(got, c.NextSpecStreamID())
+		c.UseSpecStreamID(7)
+		c.UseSpecStreamID(4) // Not a client stream
+		c.UseSpecStreamID(5) // Below the next one
+		got = append(got, c.NextSpecStreamID())
+		c.SetNextSpecStreamID(2)
+		got = append(got, c.NextSpecStreamID(), c.NextSpecStreamID())
+		if fmt.Sprint(got) != "[1 9 2 4]" {
+			t.Errorf("client=%v: stream next took %v, want [1 9 2 4]", isClient, got)
+		}
+	}
+
+	// A server's own streams, for pushes, stay even
+	c := NewConn(nil, logging.NewLogger("test"), false)
+	c.NextSpecStreamID()
+	if id := c.NextStreamID(); id != 2 {
+		t.Errorf("Server stream %d, want 2", id)
+	}
+}
+
+func TestHandler_Stream0(t *testing.T) {
+	h := NewHandler(NewConn(nil, logging.NewLogger("test"), true))
+	for _, line := range []string{"txreq", "rxresp", "txdata -data x", "txpush", "expect resp.status == 200"} {
+		err := h.ProcessStreamCommand(0, line)
+		if err == nil || !strings.Contains(err.Error(), "stream 0 is the connection") {
+			t.Errorf("%s on stream 0: got %v", line, err)
+		}
+	}
+}
+
+func TestConn_StreamOrder(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	enc := hpack.NewEncoder(4096)
+	for _, id := range []uint32{3, 1} {
+		block, err := enc.Encode([]hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":path", Value: "/"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.processFrame(headersFrame(id, FlagEndStream|FlagEndHeaders, block)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if v, err := c.Field(3, "stream.order"); err != nil || v != "1" {
+		t.Errorf("stream.order on stream 3: %q, %v", v, err)
+	}
+	if v, err := c.Field(0, "stream.1.order"); err != nil || v != "2" {
+		t.Errorf("stream.1.order: %q, %v", v, err)
+	}
+	if err := c.Expect(0, "stream.3.order", "<", "stream.1.order"); err != nil {
+		t.Error(err)
+	}
+	if err := c.Expect(1, "stream.order", "<", "stream.3.order"); err == nil {
+		t.Error("Expected stream 1 to come after stream 3")
+	}
+	if _, err := c.Field(0, "stream.5.order"); err == nil {
+		t.Error("Expected an error for a stream that received nothing")
+	}
+}
+
+func TestConn_ParallelHeaders(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+
+	const streams = 50
+	errs := make(chan error, 1)
+	go func() {
+		dec := hpack.NewDecoder(4096)
+		for i := 0; i < streams; i++ {
+			f, err := ReadFrame(b)
+			var headers []hpack.HeaderField
+			if err == nil {
+				headers, err = dec.Decode(f.Payload)
+			}
+			if err != nil {
+				errs <- fmt.Errorf("header block %d: %w", i, err)
+				return
+			}
+			want := hpack.HeaderField{Name: "x-stream", Value: fmt.Sprint(f.Header.StreamID)}
+			if got := headers[len(headers)-1]; got != want {
+				errs <- fmt.Errorf("stream %d: got %v, want %v", f.Header.StreamID, got, want)
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	// Each request adds to the dynamic table the next one refers to, so
+	// the blocks only decode in the order they were encoded
+	for i := 0; i < streams; i++ {
+		id := uint32(2*i + 1)
+		go c.TxReq(id, TxReqOptions{
+			Method:    "GET",
+			Path:      "/",
+			Scheme:    "http",
+			Authority: "example.com",
+			Headers:   map[string]string{"x-stream": fmt.Sprint(id)},
+			EndStream: true,
+		})
+	}
+	if err := <-errs; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHandler_Barrier(t *testing.T) {
+	vtc.RegisterBuiltinCommands()
+	logger := logging.NewLogger("test")
+	ctx := vtc.NewExecContext(logger, vtc.NewMacroStore(), "", time.Second)
+	if err := vtc.ExecuteCommand("barrier", []string{"bt", "cond", "1"}, ctx, logger); err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(NewConn(nil, logger, true))
+	h.SetContext(ctx)
+
+	// Streams started and not waited for end with the spec
+	spec := "barrier b1 cond 3\nstream 1 barrier b1 sync -start\nstream 3 barrier b1 sync -start\nbarrier b1 sync"
+	if err := h.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+	if len(h.activeStreams) != 0 {
+		t.Errorf("Streams %v left running", h.activeStreams)
+	}
+
+	// The test's barriers stay the test's
+	if err := h.ProcessCommand("barrier bt sync"); err != nil {
+		t.Error(err)
+	}
+	if _, ok := h.barriers["bt"]; ok {
+		t.Error("The test's barrier was declared again for the connection")
+	}
+	if err := h.ProcessStreamCommand(1, "barrier b2 sync"); err == nil {
+		t.Error("Expected an error for an undeclared barrier")
+	}
+}
+
+func TestConn_Upgrade(t *testing.T) {
+	a, b := net.Pipe()
+	srv := NewConn(a, logging.NewLogger("test"), false)
+	cli := NewConn(b, logging.NewLogger("test"), true)
+	defer srv.Stop()
+	defer cli.Stop()
+	cli.UpdateSetting(SettingMaxConcurrentStreams, 7)
+
+	upgraded := make(chan error, 1)
+	go func() { upgraded <- srv.RxUpgrade() }()
+	if err := cli.TxUpgrade(UpgradeOptions{
+		Method:    "POST",
+		Path:      "/up",
+		Authority: "example.com",
+		Headers:   map[string]string{"X-Foo": "bar"},
+		Body:      []byte("hello"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-upgraded; err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.remoteSetting(SettingMaxConcurrentStreams); got != 7 {
+		t.Errorf("Server got MAX_CONCURRENT_STREAMS %d from HTTP2-Settings, want 7", got)
+	}
+	s, ok := srv.GetStream(1)
+	if !ok {
+		t.Fatal("Server stream 1 not created")
+	}
+	if s.State != StreamHalfClosedRemote {
+		t.Errorf("Server stream 1 is %s, want half-closed(remote)", s.State)
+	}
+	if got := s.GetHeader(s.ReqHeaders, "x-foo"); got != "bar" {
+		t.Errorf("x-foo = %q, want bar", got)
+	}
+	for _, name := range []string{"connection", "upgrade", "http2-settings"} {
+		if got := s.GetHeader(s.ReqHeaders, name); got != "" {
+			t.Errorf("%s = %q carried into stream 1", name, got)
+		}
+	}
+	for field, want := range map[string]string{
+		"req.method":    "POST",
+		"req.url":       "/up",
+		"req.authority": "example.com",
+		"req.body":      "hello",
+	} {
+		if err := srv.Expect(1, field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if s, _ := cli.GetStream(1); s.State != StreamHalfClosedLocal {
+		t.Errorf("Client stream 1 is %s, want half-closed(local)", s.State)
+	}
+	if id := cli.NextStreamID(); id != 3 {
+		t.Errorf("Next client stream ID = %d, want 3", id)
+	}
+}
+
+func TestUpgradeSpec(t *testing.T) {
+	if !UpgradeSpec("\n\t# h2c\n\ttxupgrade -url /\n\tstream 1 {\n\t} -run\n") {
+		t.Error("Spec starting with txupgrade not detected")
+	}
+	if UpgradeSpec("\n\tstream 1 {\n\t\ttxreq\n\t} -run\n\trxupgrade\n") {
+		t.Error("Spec not starting with an upgrade detected")
+	}
+}
+
+func TestSettingsSpec(t *testing.T) {
+	if !SettingsSpec("\n\tstream 0 {\n\t\ttxsettings -hdrtbl 256\n\t\trxsettings\n\t} -run\n") {
+		t.Error("Spec exchanging SETTINGS not detected")
+	}
+	if SettingsSpec("\n\tstream 1 {\n\t\ttxreq -hdr \"x: txsettings\"\n\t\trxresp\n\t} -run\n") {
+		t.Error("Spec without SETTINGS commands detected")
+	}
+}
+
+func TestConn_HpackError(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	if err := c.Expect(0, "conn.err", "==", "<undef>"); err != nil {
+		t.Error(err)
+	}
+
+	goAway := make(chan Frame, 1)
+	go func() {
+		f, _ := ReadFrame(b)
+		goAway <- f
+	}()
+	// Index 62 with an empty dynamic table
+	if err := c.processFrame(headersFrame(1, FlagEndHeaders|FlagEndStream, []byte{0xbe})); err == nil {
+		t.Fatal("Expected error for an out of range index")
+	}
+	f := <-goAway
+	if f.Header.Type != FrameGoAway || len(f.Payload) < 8 || f.Payload[7] != byte(ErrCodeCompression) {
+		t.Errorf("Got %s frame %v, want GOAWAY COMPRESSION_ERROR", f.Header.Type, f.Payload)
+	}
+
+	c.cancel()
+	connErr, err := c.RxError()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connErr.Code != ErrCodeCompression {
+		t.Errorf("Connection error code %d, want %d", connErr.Code, ErrCodeCompression)
+	}
+	for field, want := range map[string]string{
+		"conn.err":   "9",
+		"conn.hpack": "index",
+	} {
+		if err := c.Expect(0, field, "==", want); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestConn_SendHexHpack(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), true)
+	go io.Copy(io.Discard, b)
+
+	// HEADERS without END_HEADERS, then CONTINUATION adding x-a: 1
+	hex := "000001 01 01 00000001 82" + "000007 09 04 00000001 4003782d610131"
+	if err := c.SendHex(hex); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.encoder.GetTable().DynamicTableLen(); n != 0 {
+		t.Errorf("Plain sendhex changed the encoder table to %d entries", n)
+	}
+	if err := c.SendHexHpack(hex); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.encoder.GetTable().DynamicTableLen(); n != 1 {
+		t.Errorf("Encoder table has %d entries, want 1", n)
+	}
+
+	c.ResetHpack(true, false)
+	if n := c.encoder.GetTable().DynamicTableLen(); n != 0 {
+		t.Errorf("Encoder table has %d entries after reset", n)
+	}
+}
+
+func TestHandler_Capture(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	logger := logging.NewLogger("test")
+	c := NewConn(a, logger, false)
+
+	block, err := hpack.NewEncoder(4096).Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+		{Name: "x-req-id", Value: "abc123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processFrame(headersFrame(1, FlagEndStream|FlagEndHeaders, block)); err != nil {
+		t.Fatal(err)
+	}
+
+	macros := vtc.NewMacroStore()
+	h := NewHandler(c)
+	h.SetContext(vtc.NewExecContext(logger, macros, "", time.Second))
+
+	spec := "stream 1 capture req.http.x-req-id req_id|||expect req.http.x-req-id == ${req_id} -run"
+	if err := h.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec failed: %v", err)
+	}
+
+	// Verbatim tokens stay whole through the nested stream spec
+	spec = "stream 1 expect req.http.x-req-id == " + util.QuoteVerbatim("abc123") + "|||expect req.http.x-req-id != " + util.QuoteVerbatim("a\"b|||c") + " -run"
+	if err := h.ProcessSpec(spec); err != nil {
+		t.Fatalf("ProcessSpec with verbatim tokens failed: %v", err)
+	}
+	if v, _ := macros.Get("req_id"); v != "abc123" {
+		t.Errorf("Expected req_id to reach the test's macros, got %q", v)
+	}
+
+	if err := h.ProcessStreamCommand(1, "capture req.bogus x"); err != nil {
+		t.Errorf("Unexpected error for an empty field: %v", err)
+	}
+	if err := h.ProcessStreamCommand(1, "capture req.http.x-req-id"); err == nil {
+		t.Error("Expected error for missing macro name")
+	}
+}
+
+func TestConn_LastExchange(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := NewConn(a, logging.NewLogger("test"), false)
+
+	if got := c.LastExchange(); got != "" {
+		t.Errorf("Got %q before any exchange, want none", got)
+	}
+
+	block, err := hpack.NewEncoder(4096).Encode([]hpack.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/last"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.processFrame(headersFrame(1, FlagEndHeaders|FlagEndStream, block)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RxReq(1); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.LastExchange(), "GET /last (stream 1, 0 body bytes)"; got != want {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+// TestDocs checks that every command of the handler is documented, and
+// that the documented options of each are the ones its parser accepts
+func TestDocs(t *testing.T) {
+	parsers := map[string][]string{
+		"stream":      {"handleStream"},
+		"txsettings":  {"handleTxSettings"},
+		"txupgrade":   {"handleTxUpgrade"},
+		"hpack_reset": {"handleHpackReset"},
+		"txreq":       {"handleTxReq", "parseFrameOption"},
+		"txresp":      {"handleTxResp", "parseFrameOption"},
+		"txdata":      {"handleTxData", "parseFrameOption"},
+		"rxdata":      {"handleRxData"},
+		"txpush":      {"handleTxPush", "parseFrameOption"},
+		"txcont":      {"handleTxCont"},
+		"rxframe":     {"handleRxFrame"},
+		"txprio":      {"handleTxPrio"},
+		"txrst":       {"handleTxRst"},
+		"txping":      {"handleTxPing"},
+		"txgoaway":    {"handleTxGoAway"},
+		"txwinup":     {"handleTxWinup"},
+	}
+	// Priority options of parseFrameOption that txdata and txpush refuse
+	headersOnly := map[string]bool{"-dep": true, "-ex": true, "-weight": true}
+	// Global commands, documented with the test commands
+	global := map[string]bool{"setvar": true, "delay": true, "barrier": true, "fatal": true, "non_fatal": true}
+
+	file, err := parser.ParseFile(token.NewFileSet(), "handler.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(map[string][]string)
+	commands := make(map[string]string) // Command -> context
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		ast.Inspect(fn, func(n ast.Node) bool {
+			clause, ok := n.(*ast.CaseClause)
+			if !ok {
+				return true
+			}
+			for _, expr := range clause.List {
+				lit, ok := expr.(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					continue
+				}
+				name, _ := strconv.Unquote(lit.Value)
+				switch {
+				case strings.HasPrefix(name, "-"):
+					accepted[fn.Name.Name] = append(accepted[fn.Name.Name], name)
+				case fn.Name.Name == "ProcessCommand":
+					commands[name] = vtc.DocHTTP2
+				case fn.Name.Name == "ProcessStreamCommand" && commands[name] == "":
+					commands[name] = vtc.DocStream
+				}
+			}
+			return true
+		})
+	}
+
+	documented := make(map[string]bool)
+	for _, doc := range Docs {
+		documented[doc.Name] = true
+	}
+	for name, context := range commands {
+		if !documented[name] && !global[name] {
+			t.Errorf("%s: not documented (%s)", name, context)
+		}
+	}
+
+	for _, doc := range Docs {
+		fns, ok := parsers[doc.Name]
+		if !ok {
+			if len(doc.Options) > 0 {
+				t.Errorf("%s: options documented but no parser to check them against", doc.Name)
+			}
+			continue
+		}
+		var got, want []string
+		for _, opt := range doc.Options {
+			got = append(got, opt.Name)
+		}
+		for _, fn := range fns {
+			for _, opt := range accepted[fn] {
+				if fn == "parseFrameOption" && headersOnly[opt] && doc.Name != "txreq" && doc.Name != "txresp" {
+					continue
+				}
+				want = append(want, opt)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s: documented options\n%v\nparser accepts\n%v", doc.Name, got, want)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package http2
+
+import "github.com/perbu/GTest/pkg/vtc"
+
+// Padding options of txreq, txresp, txdata and txpush
+var padOptions = []vtc.OptionDoc{
+	{Name: "-pad", Arg: "STRING", Help: "Set PADDED and pad with STRING"},
+	{Name: "-padlen", Arg: "N", Help: "Set PADDED and pad with N zero bytes"},
+	{Name: "-padfield", Arg: "N", Help: "Send N as the Pad Length, whatever the padding"},
+	{Name: "-noenforce", Help: "Ignore the peer's MAX_FRAME_SIZE and MAX_CONCURRENT_STREAMS"},
+}
+
+// Priority options of txreq and txresp
+var priorityOptions = []vtc.OptionDoc{
+	{Name: "-dep", Arg: "ID", Help: "Set PRIORITY on HEADERS, depending on stream ID"},
+	{Name: "-ex", Help: "Make the -dep dependency exclusive"},
+	{Name: "-weight", Arg: "N", Help: "Weight of the PRIORITY on HEADERS (default 16)"},
+}
+
+// Options shared by txreq and txresp
+var txOptions = []vtc.OptionDoc{
+	{Name: "-hdr", Arg: "\"NAME: VALUE\"", Help: "Add a header (repeatable)"},
+	{Name: "-body", Arg: "STRING", Help: "Send STRING as the body, in DATA frames"},
+	{Name: "-nostrend", Help: "Don't set END_STREAM"},
+	{Name: "-nohdrend", Help: "Don't set END_HEADERS, so that txcont can follow"},
+	{Name: "-idxHdr", Arg: "INDEX", Help: "Add an HPACK indexed header field"},
+	{Name: "-litIdxHdr", Arg: "inc|not|never INDEX huf|plain VALUE", Help: "Add an HPACK literal with an indexed name"},
+	{Name: "-litHdr", Arg: "inc|not|never huf|plain NAME huf|plain VALUE", Help: "Add an HPACK literal with a new name"},
+}
+
+// Docs documents the commands of HTTP/2 client and server specs, and of
+// the stream blocks in them
+var Docs = []vtc.CommandDoc{
+	{
+		Name:    "stream",
+		Context: vtc.DocHTTP2,
+		Usage:   "ID|next [{ SPEC }] -run|-start|-wait",
+		Help:    "Runs SPEC on a stream; stream 0 is the connection. next takes the stream ID after the last one. -start runs it in the background and -wait waits for it.",
+		Options: []vtc.OptionDoc{
+			{Name: "-run", Help: "Run the spec and wait for it (default)"},
+			{Name: "-start", Help: "Run the spec in the background"},
+			{Name: "-wait", Help: "Wait for a started stream"},
+		},
+	},
+	{
+		Name:    "txpri",
+		Context: vtc.DocHTTP2,
+		Help:    "Sends the client connection preface.",
+	},
+	{
+		Name:    "rxpri",
+		Context: vtc.DocHTTP2,
+		Help:    "Receives the client connection preface.",
+	},
+	{
+		Name:    "txsettings",
+		Context: vtc.DocHTTP2,
+		Usage:   "[options]",
+		Help:    "Sends a SETTINGS frame with the given settings.",
+		Options: []vtc.OptionDoc{
+			{Name: "-ack", Help: "Send a SETTINGS ACK"},
+			{Name: "-push", Arg: "true|false", Help: "SETTINGS_ENABLE_PUSH"},
+			{Name: "-hdrtbl", Arg: "N", Help: "SETTINGS_HEADER_TABLE_SIZE"},
+			{Name: "-maxstreams", Arg: "N", Help: "SETTINGS_MAX_CONCURRENT_STREAMS"},
+			{Name: "-winsize", Arg: "N", Help: "SETTINGS_INITIAL_WINDOW_SIZE"},
+			{Name: "-framesize", Arg: "N", Help: "SETTINGS_MAX_FRAME_SIZE"},
+			{Name: "-hdrsize", Arg: "N", Help: "SETTINGS_MAX_HEADER_LIST_SIZE"},
+		},
+	},
+	{
+		Name:    "rxsettings",
+		Context: vtc.DocHTTP2,
+		Help:    "Receives a SETTINGS frame, for settings.* expects.",
+	},
+	{
+		Name:    "txupgrade",
+		Context: vtc.DocHTTP2,
+		Usage:   "[options]",
+		Help:    "Sends an HTTP/1.1 request upgrading the connection to h2c. The request goes on as stream 1.",
+		Options: []vtc.OptionDoc{
+			{Name: "-method", Arg: "METHOD", Help: "Request method (default GET)"},
+			{Name: "-req", Arg: "METHOD", Help: "Same as -method"},
+			{Name: "-url", Arg: "URL", Help: "Request target (default /)"},
+			{Name: "-hdr", Arg: "\"NAME: VALUE\"", Help: "Add a header (repeatable)"},
+			{Name: "-body", Arg: "STRING", Help: "Request body"},
+			{Name: "-nosettings", Help: "Leave out the HTTP2-Settings header"},
+		},
+	},
+	{
+		Name:    "rxupgrade",
+		Context: vtc.DocHTTP2,
+		Help:    "Receives an HTTP/1.1 request upgrading to h2c, answers 101 and goes on with HTTP/2. The request becomes stream 1.",
+	},
+	{
+		Name:    "sendhex",
+		Context: vtc.DocHTTP2,
+		Usage:   "[-hpack] HEX",
+		Help:    "Sends the bytes given in hex. With -hpack, the header blocks in them update the HPACK tables. Also in streams.",
+	},
+	{
+		Name:    "hpack_reset",
+		Context: vtc.DocHTTP2,
+		Usage:   "[-enc] [-dec]",
+		Help:    "Empties the HPACK dynamic tables, both unless one is picked. Also in streams.",
+		Options: []vtc.OptionDoc{
+			{Name: "-enc", Help: "Empty the encoder table"},
+			{Name: "-dec", Help: "Empty the decoder table"},
+		},
+	},
+	{
+		Name:    "nextstreamid",
+		Context: vtc.DocHTTP2,
+		Usage:   "ID",
+		Help:    "Sets the ID stream next takes next, even, zero or used ones included. Also in streams.",
+	},
+	{
+		Name:    "graceful_goaway",
+		Context: vtc.DocHTTP2,
+		Help:    "Lets streams up to the last stream of a received GOAWAY carry on, instead of stopping the connection. Also in streams.",
+	},
+	{
+		Name:    "rxerror",
+		Context: vtc.DocHTTP2,
+		Help:    "Waits for the connection to fail on an error in what the peer sent, for conn.* expects. Also in streams.",
+	},
+	{
+		Name:    "capture",
+		Context: vtc.DocHTTP2,
+		Usage:   "FIELD NAME",
+		Help:    "Defines ${NAME} as the value of an expect FIELD. Also in streams.",
+	},
+	{
+		Name:    "expect",
+		Context: vtc.DocHTTP2,
+		Usage:   "FIELD OP VALUE",
+		Help:    "Checks a connection field: settings.*, goaway.*, conn.*, frame.*, stream.* or rst.*.",
+	},
+	{
+		Name:    "txreq",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a request as HEADERS and DATA frames.",
+		Options: append(append(append([]vtc.OptionDoc{
+			{Name: "-method", Arg: "METHOD", Help: "Request method (default GET)"},
+			{Name: "-req", Arg: "METHOD", Help: "Same as -method"},
+			{Name: "-url", Arg: "URL", Help: "Request path (default /)"},
+			{Name: "-scheme", Arg: "SCHEME", Help: "Request scheme (default http)"},
+		}, txOptions...), padOptions...), priorityOptions...),
+	},
+	{
+		Name:    "txresp",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a response as HEADERS and DATA frames.",
+		Options: append(append(append([]vtc.OptionDoc{
+			{Name: "-status", Arg: "CODE", Help: "Status code (default 200)"},
+		}, txOptions...), padOptions...), priorityOptions...),
+	},
+	{
+		Name:    "rxreq",
+		Context: vtc.DocStream,
+		Help:    "Receives a request, with its body.",
+	},
+	{
+		Name:    "rxresp",
+		Context: vtc.DocStream,
+		Help:    "Receives a response, with its body.",
+	},
+	{
+		Name:    "rxhdrs",
+		Context: vtc.DocStream,
+		Help:    "Waits for the headers of the stream.",
+	},
+	{
+		Name:    "txdata",
+		Context: vtc.DocStream,
+		Usage:   "[options] [STRING]",
+		Help:    "Sends STRING in DATA frames.",
+		Options: append([]vtc.OptionDoc{
+			{Name: "-data", Arg: "STRING", Help: "Data to send"},
+			{Name: "-datalen", Arg: "N", Help: "Send N generated bytes"},
+			{Name: "-framesize", Arg: "N", Help: "Split the data in frames of at most N bytes"},
+			{Name: "-pace", Arg: "DURATION", Help: "Wait between frames"},
+			{Name: "-nostrend", Help: "Don't set END_STREAM"},
+		}, padOptions...),
+	},
+	{
+		Name:    "rxdata",
+		Context: vtc.DocStream,
+		Usage:   "[-some N]",
+		Help:    "Waits for the data of the stream.",
+		Options: []vtc.OptionDoc{
+			{Name: "-some", Arg: "N", Help: "Wait for exactly the next N DATA frames"},
+		},
+	},
+	{
+		Name:    "txpush",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a PUSH_PROMISE.",
+		Options: append([]vtc.OptionDoc{
+			{Name: "-promised", Arg: "ID", Help: "Promised stream ID (default: the next free one)"},
+			{Name: "-method", Arg: "METHOD", Help: "Request method (default GET)"},
+			{Name: "-req", Arg: "METHOD", Help: "Same as -method"},
+			{Name: "-url", Arg: "URL", Help: "Request path (default /)"},
+			{Name: "-scheme", Arg: "SCHEME", Help: "Request scheme (default http)"},
+			{Name: "-hdr", Arg: "\"NAME: VALUE\"", Help: "Add a header (repeatable)"},
+			{Name: "-nohdrend", Help: "Don't set END_HEADERS, so that txcont can follow"},
+		}, padOptions...),
+	},
+	{
+		Name:    "rxpush",
+		Context: vtc.DocStream,
+		Help:    "Waits for a PUSH_PROMISE on the stream, for push.* expects.",
+	},
+	{
+		Name:    "txcont",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a CONTINUATION frame.",
+		Options: []vtc.OptionDoc{
+			{Name: "-hdr", Arg: "NAME VALUE", Help: "Add a header (repeatable)"},
+			{Name: "-hex", Arg: "HEX", Help: "Add header block bytes given in hex"},
+			{Name: "-nohdrend", Help: "Don't set END_HEADERS"},
+		},
+	},
+	{
+		Name:    "rxframe",
+		Context: vtc.DocStream,
+		Usage:   "[-type TYPE]",
+		Help:    "Takes the next frame received on the stream, for frame.* expects.",
+		Options: []vtc.OptionDoc{
+			{Name: "-type", Arg: "TYPE", Help: "Skip frames of other types; a name such as HEADERS, or a number"},
+		},
+	},
+	{
+		Name:    "txprio",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a PRIORITY frame.",
+		Options: []vtc.OptionDoc{
+			{Name: "-stream", Arg: "ID", Help: "Stream depended on (default 0)"},
+			{Name: "-weight", Arg: "N", Help: "Weight as sent (default 16)"},
+			{Name: "-excl", Help: "Make the dependency exclusive"},
+		},
+	},
+	{
+		Name:    "rxprio",
+		Context: vtc.DocStream,
+		Help:    "Accepted, but doesn't wait for a PRIORITY frame yet.",
+	},
+	{
+		Name:    "txrst",
+		Context: vtc.DocStream,
+		Usage:   "[-err CODE]",
+		Help:    "Sends a RST_STREAM.",
+		Options: []vtc.OptionDoc{
+			{Name: "-err", Arg: "CODE", Help: "Error code, by number or name (default NO_ERROR)"},
+		},
+	},
+	{
+		Name:    "rxrst",
+		Context: vtc.DocStream,
+		Help:    "Waits for a RST_STREAM on the stream, for rst.err expects.",
+	},
+	{
+		Name:    "txping",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a PING.",
+		Options: []vtc.OptionDoc{
+			{Name: "-data", Arg: "STRING", Help: "Up to 8 bytes of data"},
+			{Name: "-ack", Help: "Send a PING ACK"},
+		},
+	},
+	{
+		Name:    "rxping",
+		Context: vtc.DocStream,
+		Help:    "Waits for a PING.",
+	},
+	{
+		Name:    "txgoaway",
+		Context: vtc.DocStream,
+		Usage:   "[options]",
+		Help:    "Sends a GOAWAY.",
+		Options: []vtc.OptionDoc{
+			{Name: "-laststream", Arg: "ID", Help: "Last stream ID (default 0)"},
+			{Name: "-err", Arg: "CODE", Help: "Error code, by number or name (default NO_ERROR)"},
+			{Name: "-debug", Arg: "STRING", Help: "Debug data"},
+		},
+	},
+	{
+		Name:    "rxgoaway",
+		Context: vtc.DocStream,
+		Help:    "Waits for a GOAWAY, for goaway.* expects.",
+	},
+	{
+		Name:    "txwinup",
+		Context: vtc.DocStream,
+		Usage:   "[-size N]",
+		Help:    "Sends a WINDOW_UPDATE; on stream 0 for the connection.",
+		Options: []vtc.OptionDoc{
+			{Name: "-size", Arg: "N", Help: "Window size increment (default 1)"},
+		},
+	},
+	{
+		Name:    "rxwinup",
+		Context: vtc.DocStream,
+		Help:    "Waits for a WINDOW_UPDATE on the stream.",
+	},
+	{
+		Name:    "expect",
+		Context: vtc.DocStream,
+		Usage:   "FIELD OP VALUE",
+		Help:    "Checks a field of the stream, such as resp.status, req.http.host, stream.window or frame.type. OP is ==, !=, <, <=, >, >=, ~ or !~ (substring match) or -within.",
+	},
+}
@@ -0,0 +1,58 @@
+package http2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errCodeNames are the names RFC 7540 section 7 gives the error codes
+var errCodeNames = map[uint32]string{
+	ErrCodeNo:                 "NO_ERROR",
+	ErrCodeProtocol:           "PROTOCOL_ERROR",
+	ErrCodeInternal:           "INTERNAL_ERROR",
+	ErrCodeFlowControl:        "FLOW_CONTROL_ERROR",
+	ErrCodeSettingsTimeout:    "SETTINGS_TIMEOUT",
+	ErrCodeStreamClosed:       "STREAM_CLOSED",
+	ErrCodeFrameSize:          "FRAME_SIZE_ERROR",
+	ErrCodeRefusedStream:      "REFUSED_STREAM",
+	ErrCodeCancel:             "CANCEL",
+	ErrCodeCompression:        "COMPRESSION_ERROR",
+	ErrCodeConnect:            "CONNECT_ERROR",
+	ErrCodeEnhanceYourCalm:    "ENHANCE_YOUR_CALM",
+	ErrCodeInadequateSecurity: "INADEQUATE_SECURITY",
+	ErrCodeHTTP11Required:     "HTTP_1_1_REQUIRED",
+}
+
+// ErrCodeName returns the name of an error code, or its number if it has
+// none
+func ErrCodeName(code uint32) string {
+	if name, ok := errCodeNames[code]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(code), 10)
+}
+
+// ParseErrCode parses an error code given by name (e.g. "PROTOCOL_ERROR"
+// or "protocol_error") or number
+func ParseErrCode(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 0, 32); err == nil {
+		return uint32(n), nil
+	}
+	for code, name := range errCodeNames {
+		if strings.EqualFold(s, name) {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown error code: %s", s)
+}
+
+// isErrCodeField reports whether an expect field holds an error code,
+// which may then be compared to a name
+func isErrCodeField(field string) bool {
+	switch field {
+	case "rst.err", "goaway.err", "conn.err":
+		return true
+	}
+	return false
+}
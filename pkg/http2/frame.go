@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"time"
 )
 
 // Frame types as defined in RFC 7540
@@ -107,8 +108,9 @@ func WriteFrameHeader(w io.Writer, h FrameHeader) error {
 	// Flags (8 bits)
 	buf[4] = byte(h.Flags)
 
-	// Stream ID (31 bits, R bit is always 0)
-	binary.BigEndian.PutUint32(buf[5:9], h.StreamID&0x7FFFFFFF)
+	// Stream ID (31 bits). IDs beyond 2^31-1, which only a spec can ask
+	// for, come out with the R bit set.
+	binary.BigEndian.PutUint32(buf[5:9], h.StreamID)
 
 	_, err := w.Write(buf[:])
 	return err
@@ -251,12 +253,7 @@ func WriteSettingsFrame(w io.Writer, streamID uint32, ack bool, settings []Setti
 		flags = FlagAck
 	}
 
-	payload := make([]byte, len(settings)*6)
-	for i, s := range settings {
-		binary.BigEndian.PutUint16(payload[i*6:], uint16(s.ID))
-		binary.BigEndian.PutUint32(payload[i*6+2:], s.Value)
-	}
-
+	payload := encodeSettings(settings)
 	return WriteFrame(w, Frame{
 		Header: FrameHeader{
 			Length:   uint32(len(payload)),
@@ -268,6 +265,17 @@ func WriteSettingsFrame(w io.Writer, streamID uint32, ack bool, settings []Setti
 	})
 }
 
+// encodeSettings encodes settings as a SETTINGS frame payload, which is
+// also the value of HTTP2-Settings in an h2c upgrade before base64
+func encodeSettings(settings []Setting) []byte {
+	payload := make([]byte, len(settings)*6)
+	for i, s := range settings {
+		binary.BigEndian.PutUint16(payload[i*6:], uint16(s.ID))
+		binary.BigEndian.PutUint32(payload[i*6+2:], s.Value)
+	}
+	return payload
+}
+
 // ParseSettingsFrame parses the payload of a SETTINGS frame
 func ParseSettingsFrame(payload []byte) ([]Setting, error) {
 	if len(payload)%6 != 0 {
@@ -286,27 +294,92 @@ func ParseSettingsFrame(payload []byte) ([]Setting, error) {
 	return settings, nil
 }
 
+// FrameOptions holds the optional fields of DATA and HEADERS frames
+type FrameOptions struct {
+	Padded   bool      // Set PADDED and add a Pad Length field
+	Pad      []byte    // Padding appended to the payload
+	PadField *int      // Pad Length field value, if not len(Pad); may be invalid
+	Priority *Priority // Set PRIORITY and add the priority fields (HEADERS only)
+
+	// Ignore the peer's SETTINGS: send DATA in one frame whatever its
+	// MAX_FRAME_SIZE, and open streams beyond its MAX_CONCURRENT_STREAMS
+	NoEnforce bool
+
+	// Split DATA into frames carrying at most FrameSize bytes, and wait
+	// Pace between them (txdata -framesize and -pace)
+	FrameSize int
+	Pace      time.Duration
+}
+
+// Priority is the stream dependency and weight carried by HEADERS
+type Priority struct {
+	Exclusive bool
+	DependsOn uint32
+	Weight    uint8 // Sent as is (the effective weight is one more)
+}
+
+// wrap adds the padding and priority fields around a frame payload and
+// returns the flags they need
+func (o FrameOptions) wrap(payload []byte) ([]byte, Flags) {
+	flags := FlagNone
+	var buf []byte
+	if o.Padded {
+		flags |= FlagPadded
+		padField := len(o.Pad)
+		if o.PadField != nil {
+			padField = *o.PadField
+		}
+		buf = append(buf, byte(padField))
+	}
+	if o.Priority != nil {
+		flags |= FlagPriority
+		dep := o.Priority.DependsOn & 0x7FFFFFFF
+		if o.Priority.Exclusive {
+			dep |= 0x80000000
+		}
+		buf = binary.BigEndian.AppendUint32(buf, dep)
+		buf = append(buf, o.Priority.Weight)
+	}
+	if flags == FlagNone {
+		return payload, flags
+	}
+	buf = append(buf, payload...)
+	return append(buf, o.Pad...), flags
+}
+
 // WriteDataFrame writes a DATA frame
 func WriteDataFrame(w io.Writer, streamID uint32, data []byte, endStream bool) error {
-	flags := FlagNone
+	return WriteDataFrameWith(w, streamID, data, endStream, FrameOptions{})
+}
+
+// WriteDataFrameWith writes a DATA frame with optional padding
+func WriteDataFrameWith(w io.Writer, streamID uint32, data []byte, endStream bool, opts FrameOptions) error {
+	opts.Priority = nil
+	payload, flags := opts.wrap(data)
 	if endStream {
-		flags = FlagEndStream
+		flags |= FlagEndStream
 	}
 
 	return WriteFrame(w, Frame{
 		Header: FrameHeader{
-			Length:   uint32(len(data)),
+			Length:   uint32(len(payload)),
 			Type:     FrameData,
 			Flags:    flags,
 			StreamID: streamID,
 		},
-		Payload: data,
+		Payload: payload,
 	})
 }
 
 // WriteHeadersFrame writes a HEADERS frame
 func WriteHeadersFrame(w io.Writer, streamID uint32, headerBlock []byte, endStream, endHeaders bool) error {
-	flags := FlagNone
+	return WriteHeadersFrameWith(w, streamID, headerBlock, endStream, endHeaders, FrameOptions{})
+}
+
+// WriteHeadersFrameWith writes a HEADERS frame with optional padding and
+// priority
+func WriteHeadersFrameWith(w io.Writer, streamID uint32, headerBlock []byte, endStream, endHeaders bool, opts FrameOptions) error {
+	payload, flags := opts.wrap(headerBlock)
 	if endStream {
 		flags |= FlagEndStream
 	}
@@ -316,15 +389,60 @@ func WriteHeadersFrame(w io.Writer, streamID uint32, headerBlock []byte, endStre
 
 	return WriteFrame(w, Frame{
 		Header: FrameHeader{
-			Length:   uint32(len(headerBlock)),
+			Length:   uint32(len(payload)),
 			Type:     FrameHeaders,
 			Flags:    flags,
 			StreamID: streamID,
 		},
-		Payload: headerBlock,
+		Payload: payload,
+	})
+}
+
+// WritePushPromiseFrameWith writes a PUSH_PROMISE frame with optional
+// padding
+func WritePushPromiseFrameWith(w io.Writer, streamID, promisedID uint32, headerBlock []byte, endHeaders bool, opts FrameOptions) error {
+	opts.Priority = nil
+	block := binary.BigEndian.AppendUint32(nil, promisedID&0x7FFFFFFF)
+	payload, flags := opts.wrap(append(block, headerBlock...))
+	if endHeaders {
+		flags |= FlagEndHeaders
+	}
+
+	return WriteFrame(w, Frame{
+		Header: FrameHeader{
+			Length:   uint32(len(payload)),
+			Type:     FramePushPromise,
+			Flags:    flags,
+			StreamID: streamID,
+		},
+		Payload: payload,
 	})
 }
 
+// framePayload strips the padding, and for HEADERS the priority fields, from
+// a received DATA, HEADERS or PUSH_PROMISE frame
+func framePayload(frame Frame) ([]byte, error) {
+	payload := frame.Payload
+	if frame.Header.Flags.Has(FlagPadded) {
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("PADDED %s frame without Pad Length", frame.Header.Type)
+		}
+		padLen := int(payload[0])
+		if padLen >= len(payload) {
+			return nil, fmt.Errorf("%s frame padding (%d) not less than frame length (%d)",
+				frame.Header.Type, padLen, len(payload))
+		}
+		payload = payload[1 : len(payload)-padLen]
+	}
+	if frame.Header.Type == FrameHeaders && frame.Header.Flags.Has(FlagPriority) {
+		if len(payload) < 5 {
+			return nil, fmt.Errorf("HEADERS frame too short for priority fields")
+		}
+		payload = payload[5:]
+	}
+	return payload, nil
+}
+
 // WriteRSTStreamFrame writes an RST_STREAM frame
 func WriteRSTStreamFrame(w io.Writer, streamID uint32, errorCode uint32) error {
 	payload := make([]byte, 4)
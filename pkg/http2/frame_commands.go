@@ -1,11 +1,15 @@
 package http2
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/perbu/GTest/pkg/hpack"
 )
 
 // TxPri sends the HTTP/2 connection preface
@@ -27,26 +31,91 @@ func (c *Conn) TxSettings(ack bool, settings map[SettingID]uint32) error {
 			c.localSettings[id] = value
 		}
 		c.mu.Unlock()
+
+		if size, ok := settings[SettingInitialWindowSize]; ok {
+			c.streams.UpdateInitialWindow(int32(size), false)
+		}
+		if size, ok := settings[SettingMaxHeaderListSize]; ok {
+			c.decoderMu.Lock()
+			c.decoder.SetMaxHeaderListSize(size)
+			c.decoderMu.Unlock()
+		}
 	}
 
 	return c.SendSettings(ack)
 }
 
-// RxSettings waits to receive a SETTINGS frame
-func (c *Conn) RxSettings() (map[SettingID]uint32, error) {
-	// Settings are handled automatically by the frame receive loop
-	// This is a simplified implementation - in production you'd want to wait for specific settings
+// SettingsFrame is a received SETTINGS frame
+type SettingsFrame struct {
+	Ack    bool
+	Values map[SettingID]uint32 // Only the settings the frame carried
+}
+
+// RxSettings waits for the next SETTINGS frame, ACKs included, and makes
+// it the one settings.* expects look at. The frame receive loop has
+// already applied and acknowledged it.
+func (c *Conn) RxSettings() (SettingsFrame, error) {
 	c.logger.Log(3, "Waiting for SETTINGS frame")
-	time.Sleep(100 * time.Millisecond) // Give time for frame to arrive
+	settingsType := FrameSettings
+	frame, err := c.RxFrame(0, &settingsType)
+	if err != nil {
+		return SettingsFrame{}, err
+	}
 
-	c.mu.Lock()
-	settings := make(map[SettingID]uint32)
-	for id, value := range c.remoteSettings {
-		settings[id] = value
+	sf := SettingsFrame{Ack: frame.Header.Flags.Has(FlagAck), Values: make(map[SettingID]uint32)}
+	if !sf.Ack {
+		settings, err := ParseSettingsFrame(frame.Payload)
+		if err != nil {
+			return SettingsFrame{}, err
+		}
+		for _, setting := range settings {
+			sf.Values[setting.ID] = setting.Value
+		}
 	}
+
+	c.mu.Lock()
+	c.lastSettings = &sf
 	c.mu.Unlock()
+	return sf, nil
+}
+
+// settingNames maps the settings.* expect fields to setting IDs
+var settingNames = map[string]SettingID{
+	"hdrtbl":     SettingHeaderTableSize,
+	"push":       SettingEnablePush,
+	"maxstreams": SettingMaxConcurrentStreams,
+	"winsize":    SettingInitialWindowSize,
+	"framesize":  SettingMaxFrameSize,
+	"hdrsize":    SettingMaxHeaderListSize,
+}
 
-	return settings, nil
+// getSettingsField extracts fields of the SETTINGS frame rxsettings took
+// last (e.g. "settings.winsize"), "<undef>" for settings it did not carry.
+// Before any rxsettings they show the peer's current settings.
+func (c *Conn) getSettingsField(field string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := strings.TrimPrefix(field, "settings.")
+	sf := c.lastSettings
+	if sf == nil {
+		sf = &SettingsFrame{Values: c.remoteSettings}
+	}
+	if name == "ack" {
+		return strconv.FormatBool(sf.Ack), nil
+	}
+	id, ok := settingNames[name]
+	if !ok {
+		return "", fmt.Errorf("unknown settings field: %s", field)
+	}
+	value, ok := sf.Values[id]
+	if !ok {
+		return "<undef>", nil
+	}
+	if id == SettingEnablePush {
+		return strconv.FormatBool(value == 1), nil
+	}
+	return strconv.FormatUint(uint64(value), 10), nil
 }
 
 // TxPing sends a PING frame
@@ -68,41 +137,140 @@ func (c *Conn) RxPing() ([8]byte, error) {
 
 // TxGoAway sends a GOAWAY frame
 func (c *Conn) TxGoAway(lastStreamID uint32, errorCode uint32, debugData string) error {
-	c.logger.Log(3, "Sending GOAWAY (lastStreamID=%d, errorCode=%d)", lastStreamID, errorCode)
+	c.logger.Log(3, "Sending GOAWAY (lastStreamID=%d, errorCode=%s)", lastStreamID, ErrCodeName(errorCode))
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 	return WriteGoAwayFrame(c.conn, lastStreamID, errorCode, []byte(debugData))
 }
 
 // RxGoAway waits to receive a GOAWAY frame
-func (c *Conn) RxGoAway() error {
-	// GOAWAY frames are handled automatically by the frame receive loop
+func (c *Conn) RxGoAway() (GoAway, error) {
 	c.logger.Log(3, "Waiting for GOAWAY frame")
-	return nil
+	select {
+	case <-c.goAwayRecv:
+	case <-c.ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.goAway == nil {
+		return GoAway{}, fmt.Errorf("connection closed without GOAWAY")
+	}
+	return *c.goAway, nil
+}
+
+// SetGracefulGoAway makes a received GOAWAY leave the connection running,
+// so streams up to its last stream can complete
+func (c *Conn) SetGracefulGoAway(graceful bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gracefulGoAway = graceful
+	c.logger.Log(3, "Graceful GOAWAY: %v", graceful)
+}
+
+// getGoAwayField extracts fields of the last GOAWAY received (e.g.
+// "goaway.err")
+func (c *Conn) getGoAwayField(field string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.goAway == nil {
+		return "", fmt.Errorf("%s: no GOAWAY received", field)
+	}
+	switch strings.TrimPrefix(field, "goaway.") {
+	case "err":
+		return strconv.FormatUint(uint64(c.goAway.ErrorCode), 10), nil
+	case "laststream":
+		return strconv.FormatUint(uint64(c.goAway.LastStreamID), 10), nil
+	case "debug":
+		return string(c.goAway.Debug), nil
+	default:
+		return "", fmt.Errorf("unknown GOAWAY field: %s", field)
+	}
+}
+
+// RxError waits for the connection to fail on a connection error we
+// detected in what the peer sent, and returns it
+func (c *Conn) RxError() (ConnError, error) {
+	<-c.ctx.Done()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connErr == nil {
+		return ConnError{}, fmt.Errorf("connection closed without a connection error")
+	}
+	return *c.connErr, nil
+}
+
+// getConnErrorField extracts fields of the connection error we detected
+// (e.g. "conn.err"); all of them are <undef> if there was none
+func (c *Conn) getConnErrorField(field string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := strings.TrimPrefix(field, "conn.")
+	switch name {
+	case "err", "reason", "hpack":
+	default:
+		return "", fmt.Errorf("unknown connection error field: %s", field)
+	}
+	if c.connErr == nil {
+		return "<undef>", nil
+	}
+	switch name {
+	case "err":
+		return strconv.FormatUint(uint64(c.connErr.Code), 10), nil
+	case "reason":
+		return c.connErr.Reason, nil
+	default:
+		return c.connErr.Hpack, nil
+	}
 }
 
 // TxRst sends an RST_STREAM frame
 func (c *Conn) TxRst(streamID uint32, errorCode uint32) error {
-	c.logger.Log(3, "Sending RST_STREAM (stream=%d, errorCode=%d)", streamID, errorCode)
+	c.logger.Log(3, "Sending RST_STREAM (stream=%d, errorCode=%s)", streamID, ErrCodeName(errorCode))
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 	return WriteRSTStreamFrame(c.conn, streamID, errorCode)
 }
 
-// RxRst waits to receive an RST_STREAM frame on a stream
+// RxRst waits for the next RST_STREAM frame on a stream and keeps its
+// error code for rst.err expects
 func (c *Conn) RxRst(streamID uint32) error {
-	stream, ok := c.streams.Get(streamID)
-	if !ok {
-		return fmt.Errorf("stream %d not found", streamID)
+	c.logger.Log(3, "Waiting for RST_STREAM on stream %d", streamID)
+	rstType := FrameRSTStream
+	frame, err := c.RxFrame(streamID, &rstType)
+	if err != nil {
+		return err
 	}
+	if len(frame.Payload) != 4 {
+		return fmt.Errorf("invalid RST_STREAM payload length: %d", len(frame.Payload))
+	}
+	code := binary.BigEndian.Uint32(frame.Payload)
 
-	// Wait for RST_STREAM
-	stream.Wait()
-
-	c.logger.Log(3, "Received RST_STREAM on stream %d", streamID)
+	c.mu.Lock()
+	c.rstErrs[streamID] = code
+	c.mu.Unlock()
+	c.logger.Log(3, "Received RST_STREAM on stream %d (errorCode=%s)", streamID, ErrCodeName(code))
 	return nil
 }
 
+// getRstField extracts "rst.err", the error code of the RST_STREAM rxrst
+// took last on a stream
+func (c *Conn) getRstField(streamID uint32, field string) (string, error) {
+	if field != "rst.err" {
+		return "", fmt.Errorf("unknown RST_STREAM field: %s", field)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	code, ok := c.rstErrs[streamID]
+	if !ok {
+		return "", fmt.Errorf("%s: no RST_STREAM received on stream %d (use rxrst)", field, streamID)
+	}
+	return strconv.FormatUint(uint64(code), 10), nil
+}
+
 // TxWinup sends a WINDOW_UPDATE frame
 func (c *Conn) TxWinup(streamID uint32, increment uint32) error {
 	c.logger.Log(3, "Sending WINDOW_UPDATE (stream=%d, increment=%d)", streamID, increment)
@@ -121,6 +289,17 @@ func (c *Conn) RxWinup(streamID uint32) (uint32, error) {
 
 // SendHex sends raw hexadecimal data (allows for malformed frames)
 func (c *Conn) SendHex(hexData string) error {
+	return c.sendHex(hexData, false)
+}
+
+// SendHexHpack sends raw hexadecimal data like SendHex, and takes the
+// header blocks of the frames in it through the encoder's dynamic table,
+// as through the peer's decoder
+func (c *Conn) SendHexHpack(hexData string) error {
+	return c.sendHex(hexData, true)
+}
+
+func (c *Conn) sendHex(hexData string, hpackAware bool) error {
 	// Remove spaces and newlines
 	hexData = strings.ReplaceAll(hexData, " ", "")
 	hexData = strings.ReplaceAll(hexData, "\n", "")
@@ -132,6 +311,10 @@ func (c *Conn) SendHex(hexData string) error {
 		return fmt.Errorf("invalid hex data: %w", err)
 	}
 
+	if hpackAware {
+		c.observeHeaderBlocks(data)
+	}
+
 	c.logger.Log(3, "Sending raw hex data: %d bytes", len(data))
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
@@ -139,6 +322,67 @@ func (c *Conn) SendHex(hexData string) error {
 	return err
 }
 
+// observeHeaderBlocks parses raw data as frames and takes the header
+// blocks of HEADERS and PUSH_PROMISE, with their CONTINUATIONs, into the
+// encoder's dynamic table. Parsing stops at the first malformed frame;
+// blocks that fail to decode are logged and change the table as far as
+// they got, as they would the peer's.
+func (c *Conn) observeHeaderBlocks(data []byte) {
+	r := bytes.NewReader(data)
+	var block []byte
+	for {
+		frame, err := ReadFrame(r)
+		if err != nil {
+			return
+		}
+		payload, err := framePayload(frame)
+		if err != nil {
+			return
+		}
+		switch frame.Header.Type {
+		case FrameHeaders:
+			block = append([]byte(nil), payload...)
+		case FramePushPromise:
+			if len(payload) < 4 {
+				return
+			}
+			block = append([]byte(nil), payload[4:]...)
+		case FrameContinuation:
+			block = append(block, payload...)
+		default:
+			continue
+		}
+		if !frame.Header.Flags.Has(FlagEndHeaders) {
+			continue
+		}
+
+		c.encoderMu.Lock()
+		err = c.encoder.Observe(block)
+		c.encoderMu.Unlock()
+		if err != nil {
+			c.logger.Log(2, "Header block in sendhex does not decode: %v", err)
+		}
+		block = nil
+	}
+}
+
+// ResetHpack empties the dynamic tables: the encoder's (the next header
+// block then tells the peer to empty its decoder's too), the decoder's,
+// or both
+func (c *Conn) ResetHpack(encoder, decoder bool) {
+	if encoder {
+		c.encoderMu.Lock()
+		c.encoder.Reset()
+		c.encoderMu.Unlock()
+	}
+	if decoder {
+		c.decoderMu.Lock()
+		c.decoder.Reset()
+		c.decoderMu.Unlock()
+	}
+	c.logger.Log(3, "Reset HPACK tables (encoder=%v, decoder=%v)", encoder, decoder)
+}
+
 // WriteRaw writes a raw frame with manual control (for malformed frames)
 func (c *Conn) WriteRaw(length uint32, frameType FrameType, flags Flags, streamID uint32, payload []byte) error {
 	c.logger.Log(3, "Sending raw frame: type=%s, length=%d, flags=0x%x, stream=%d",
@@ -148,26 +392,75 @@ func (c *Conn) WriteRaw(length uint32, frameType FrameType, flags Flags, streamI
 	return WriteRawFrame(c.conn, length, frameType, flags, streamID, payload)
 }
 
-// TxPushPromise sends a PUSH_PROMISE frame
-func (c *Conn) TxPushPromise(streamID uint32, promisedStreamID uint32, headers []string) error {
-	// Build header block
-	// Simplified implementation - in production would use HPACK encoding
-	payload := make([]byte, 4+len(headers)*10) // Rough estimate
-	binary.BigEndian.PutUint32(payload[0:4], promisedStreamID&0x7FFFFFFF)
+// TxPushOptions represents options for sending a PUSH_PROMISE
+type TxPushOptions struct {
+	PromisedID uint32 // Stream to reserve; 0 takes the next server stream
+	Method     string
+	Path       string
+	Scheme     string
+	Authority  string
+	Headers    map[string]string
+	Frame      FrameOptions // Padding of the PUSH_PROMISE frame
+	NoHdrEnd   bool         // Leave END_HEADERS unset; txcont continues the block
+}
+
+// TxPushPromise sends a PUSH_PROMISE on a stream carrying the promised
+// request, and reserves the promised stream for the pushed response
+func (c *Conn) TxPushPromise(streamID uint32, opts TxPushOptions) (uint32, error) {
+	promisedID := opts.PromisedID
+	if promisedID == 0 {
+		promisedID = c.NextStreamID()
+	}
+	promised := c.streams.GetOrCreate(promisedID, fmt.Sprintf("stream-%d", promisedID))
+	if err := promised.Reserve(true); err != nil {
+		return 0, err
+	}
+
+	headers := []hpack.HeaderField{
+		{Name: ":method", Value: opts.Method},
+		{Name: ":path", Value: opts.Path},
+		{Name: ":scheme", Value: opts.Scheme},
+		{Name: ":authority", Value: opts.Authority},
+	}
+	for name, value := range opts.Headers {
+		headers = append(headers, hpack.HeaderField{Name: name, Value: value})
+	}
+
+	c.headersMu.Lock()
+	defer c.headersMu.Unlock()
+	c.encoderMu.Lock()
+	headerBlock, err := c.encoder.Encode(headers)
+	c.encoderMu.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode headers: %w", err)
+	}
+	for _, hf := range headers {
+		promised.AddReqHeader(hf.Name, hf.Value)
+	}
 
-	c.logger.Log(3, "Sending PUSH_PROMISE (stream=%d, promised=%d)", streamID, promisedStreamID)
+	c.logger.Log(3, "Sending PUSH_PROMISE (stream=%d, promised=%d)", streamID, promisedID)
 
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
-	return WriteFrame(c.conn, Frame{
-		Header: FrameHeader{
-			Length:   uint32(len(payload)),
-			Type:     FramePushPromise,
-			Flags:    FlagEndHeaders,
-			StreamID: streamID,
-		},
-		Payload: payload,
-	})
+	if err := WritePushPromiseFrameWith(c.conn, streamID, promisedID, headerBlock, !opts.NoHdrEnd, opts.Frame); err != nil {
+		return 0, fmt.Errorf("failed to write PUSH_PROMISE frame: %w", err)
+	}
+	return promisedID, nil
+}
+
+// RxPush waits for a PUSH_PROMISE on a stream
+func (c *Conn) RxPush(streamID uint32) (PushPromise, error) {
+	stream, ok := c.streams.Get(streamID)
+	if !ok {
+		return PushPromise{}, fmt.Errorf("stream %d not found", streamID)
+	}
+
+	p, err := stream.NextPush(c.ctx)
+	if err != nil {
+		return PushPromise{}, err
+	}
+	c.logger.Log(3, "Received push on stream %d: promised stream %d", streamID, p.PromisedID)
+	return p, nil
 }
 
 // TxContinuation sends a CONTINUATION frame
@@ -192,6 +485,34 @@ func (c *Conn) TxContinuation(streamID uint32, headerBlock []byte, endHeaders bo
 	})
 }
 
+// TxCont sends a CONTINUATION frame whose block is the HPACK encoding of
+// headers followed by raw
+func (c *Conn) TxCont(streamID uint32, headers []hpack.HeaderField, raw []byte, endHeaders bool) error {
+	var block []byte
+	if len(headers) > 0 {
+		c.encoderMu.Lock()
+		encoded, err := c.encoder.Encode(headers)
+		c.encoderMu.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to encode headers: %w", err)
+		}
+		block = encoded
+	}
+	block = append(block, raw...)
+
+	if stream, ok := c.streams.Get(streamID); ok {
+		for _, hf := range headers {
+			if c.isClient {
+				stream.AddReqHeader(hf.Name, hf.Value)
+			} else {
+				stream.AddRespHeader(hf.Name, hf.Value)
+			}
+		}
+	}
+
+	return c.TxContinuation(streamID, block, endHeaders)
+}
+
 // TxPriority sends a PRIORITY frame
 func (c *Conn) TxPriority(streamID uint32, exclusive bool, dependsOn uint32, weight uint8) error {
 	payload := make([]byte, 5)
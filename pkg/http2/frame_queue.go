@@ -0,0 +1,119 @@
+package http2
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxQueuedFrames bounds each stream's queue of frames no rxframe has
+// taken; the oldest are dropped beyond it
+const maxQueuedFrames = 1024
+
+// frameQueue holds the frames received on one stream (0 for the
+// connection) for rxframe, and the frame rxframe took last
+type frameQueue struct {
+	mu     sync.Mutex
+	frames []Frame
+	last   *Frame
+	signal chan struct{}
+}
+
+// frameQueue returns the queue of a stream, creating it if needed
+func (c *Conn) frameQueue(streamID uint32) *frameQueue {
+	c.framesMu.Lock()
+	defer c.framesMu.Unlock()
+
+	q, ok := c.frameQueues[streamID]
+	if !ok {
+		q = &frameQueue{signal: make(chan struct{}, 1)}
+		c.frameQueues[streamID] = q
+	}
+	return q
+}
+
+// queueFrame makes a received frame available to rxframe
+func (c *Conn) queueFrame(frame Frame) {
+	q := c.frameQueue(frame.Header.StreamID)
+	q.mu.Lock()
+	if len(q.frames) >= maxQueuedFrames {
+		q.frames = q.frames[1:]
+	}
+	q.frames = append(q.frames, frame)
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// RxFrame waits for the next frame on a stream, skipping frames of other
+// types if a type is given, and makes it the one frame.* expects look at
+func (c *Conn) RxFrame(streamID uint32, frameType *FrameType) (Frame, error) {
+	q := c.frameQueue(streamID)
+	for {
+		q.mu.Lock()
+		for i, f := range q.frames {
+			if frameType != nil && f.Header.Type != *frameType {
+				continue
+			}
+			q.frames = q.frames[i+1:]
+			q.last = &f
+			q.mu.Unlock()
+			c.logger.Log(3, "Took %s frame on stream %d (%d skipped)", f.Header.Type, streamID, i)
+			return f, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.signal:
+		case <-c.ctx.Done():
+			return Frame{}, fmt.Errorf("connection closed waiting for a frame on stream %d", streamID)
+		case <-c.Abort:
+			return Frame{}, fmt.Errorf("test aborted waiting for a frame on stream %d", streamID)
+		}
+	}
+}
+
+// getFrameField extracts fields of the frame rxframe took last on a stream
+// (e.g. "frame.type")
+func (c *Conn) getFrameField(streamID uint32, field string) (string, error) {
+	q := c.frameQueue(streamID)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.last == nil {
+		return "", fmt.Errorf("%s: no frame received on stream %d (use rxframe)", field, streamID)
+	}
+	h := q.last.Header
+	switch strings.TrimPrefix(field, "frame.") {
+	case "type":
+		return strconv.Itoa(int(h.Type)), nil
+	case "typename":
+		return h.Type.String(), nil
+	case "size":
+		return strconv.FormatUint(uint64(h.Length), 10), nil
+	case "flags":
+		return strconv.Itoa(int(h.Flags)), nil
+	case "streamid", "stream":
+		return strconv.FormatUint(uint64(h.StreamID), 10), nil
+	default:
+		return "", fmt.Errorf("unknown frame field: %s", field)
+	}
+}
+
+// ParseFrameType parses a frame type given by name (e.g. "HEADERS" or
+// "headers") or number
+func ParseFrameType(s string) (FrameType, error) {
+	if n, err := strconv.ParseUint(s, 0, 8); err == nil {
+		return FrameType(n), nil
+	}
+	for t := FrameData; t <= FrameContinuation; t++ {
+		if strings.EqualFold(s, t.String()) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown frame type: %s", s)
+}
@@ -0,0 +1,76 @@
+package http2
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameOptions_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	opts := FrameOptions{
+		Padded:   true,
+		Pad:      []byte("xyz"),
+		Priority: &Priority{Exclusive: true, DependsOn: 3, Weight: 200},
+	}
+	if err := WriteHeadersFrameWith(&buf, 1, []byte("block"), true, true, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFlags := FlagPadded | FlagPriority | FlagEndStream | FlagEndHeaders
+	if frame.Header.Flags != wantFlags {
+		t.Errorf("flags = %#x, want %#x", frame.Header.Flags, wantFlags)
+	}
+	want := []byte{3, 0x80, 0, 0, 3, 200, 'b', 'l', 'o', 'c', 'k', 'x', 'y', 'z'}
+	if !bytes.Equal(frame.Payload, want) {
+		t.Errorf("payload = %v, want %v", frame.Payload, want)
+	}
+
+	payload, err := framePayload(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != "block" {
+		t.Errorf("framePayload = %q, want block", payload)
+	}
+}
+
+func TestFrameOptions_InvalidPadding(t *testing.T) {
+	var buf bytes.Buffer
+	padField := 10
+	opts := FrameOptions{Padded: true, PadField: &padField}
+	if err := WriteDataFrameWith(&buf, 1, []byte("abc"), false, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	frame, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame.Payload, []byte{10, 'a', 'b', 'c'}) {
+		t.Errorf("payload = %v", frame.Payload)
+	}
+	if _, err := framePayload(frame); err == nil {
+		t.Error("Expected error for padding not less than frame length")
+	}
+}
+
+func TestWriteFrameHeader_ReservedBit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFrameHeader(&buf, FrameHeader{Type: FrameHeaders, StreamID: 1<<31 + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.Bytes()[5:9]; !bytes.Equal(got, []byte{0x80, 0, 0, 1}) {
+		t.Errorf("stream ID bytes = %v, want R bit and 1", got)
+	}
+	h, err := ReadFrameHeader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.StreamID != 1 {
+		t.Errorf("parsed stream ID = %d, want 1 (R bit ignored)", h.StreamID)
+	}
+}
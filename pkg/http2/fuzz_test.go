@@ -0,0 +1,44 @@
+package http2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// FuzzReadFrame checks that no byte stream makes reading frames, or
+// processing them on a server connection, panic
+func FuzzReadFrame(f *testing.F) {
+	var seed bytes.Buffer
+	WriteSettingsFrame(&seed, 0, false, []Setting{{ID: SettingInitialWindowSize, Value: 1}})
+	WriteHeadersFrameWith(&seed, 1, []byte{0x82, 0x84}, false, false, FrameOptions{Padded: true, Pad: []byte{0}})
+	WriteFrame(&seed, Frame{Header: FrameHeader{Type: FrameContinuation, Flags: FlagEndHeaders, StreamID: 1}, Payload: []byte{0x86}})
+	WriteDataFrame(&seed, 1, []byte("body"), true)
+	WriteGoAwayFrame(&seed, 1, 0, []byte("bye"))
+	f.Add(seed.Bytes())
+	f.Add([]byte{0, 0, 1, byte(FrameData), byte(FlagPadded), 0, 0, 0, 1, 5})
+
+	logger := logging.NewLogger("fuzz")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer logging.ResetOutput()
+		a, b := net.Pipe()
+		defer a.Close()
+		defer b.Close()
+		go io.Copy(io.Discard, b)
+
+		c := NewConn(a, logger, false)
+		r := bytes.NewReader(data)
+		for {
+			frame, err := ReadFrame(r)
+			if err != nil {
+				return
+			}
+			if err := c.processFrame(frame); err != nil {
+				return
+			}
+		}
+	})
+}
@@ -1,20 +1,35 @@
 package http2
 
 import (
+	"encoding/hex"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/perbu/GTest/pkg/barrier"
 	"github.com/perbu/GTest/pkg/hpack"
+	"github.com/perbu/GTest/pkg/util"
+	"github.com/perbu/GTest/pkg/vtc"
 )
 
 // Handler processes HTTP/2 command specifications
 type Handler struct {
 	Conn          *Conn
+	Name          string      // Client or server name, for ${NAME_timing_FIELD} (optional)
+	Context       interface{} // ExecContext for soft failure reporting (optional)
 	activeStreams map[uint32]*StreamContext
 	streamsMu     sync.Mutex
+	barriers      map[string]*barrier.Barrier // Barriers first declared in this spec, for its streams
+	barriersMu    sync.Mutex
+	nonFatal      bool            // Set by non_fatal: failing commands are recorded, not fatal
+	macros        *vtc.MacroStore // Snapshot of the test's macros taken when the spec started
+
+	// Expanded marks a spec whose macros were already expanded as a whole,
+	// as -dispatch-spec-per-conn does, so its lines are not expanded again
+	Expanded bool
 }
 
 // StreamContext holds execution context for a stream
@@ -29,40 +44,119 @@ func NewHandler(conn *Conn) *Handler {
 	return &Handler{
 		Conn:          conn,
 		activeStreams: make(map[uint32]*StreamContext),
+		barriers:      make(map[string]*barrier.Barrier),
 	}
 }
 
+// SetContext sets the execution context used to report soft failures,
+// to end waits for frames when the test is aborted, and to perturb the
+// connection's timing under -chaos
+func (h *Handler) SetContext(ctx interface{}) {
+	h.Context = ctx
+	if ctx, ok := ctx.(*vtc.ExecContext); ok {
+		h.Conn.Abort = ctx.Done()
+		if ctx.Chaos != nil {
+			h.Conn.Perturb = ctx.Chaos.Delay
+		}
+	}
+}
+
+// recordSoftFailure logs a failure that non_fatal turned into a warning and
+// reports it to the test context for the final summary
+func (h *Handler) recordSoftFailure(line string, err error) {
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok {
+		ctx.RecordSoftFailure("command '%s' failed: %v", line, err)
+		return
+	}
+	h.Conn.logger.Warning("Non-fatal failure: command '%s' failed: %v", line, err)
+}
+
 // ProcessSpec processes an HTTP/2 command specification string
 // This is the main entry point for executing HTTP/2 commands from VTC specs
 func (h *Handler) ProcessSpec(spec string) error {
 	h.Conn.logger.Debug("HTTP/2 ProcessSpec called with spec length: %d", len(spec))
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok && ctx.Macros != nil && h.macros == nil {
+		h.macros = ctx.Macros.Snapshot()
+	}
 
 	// Parse the spec into lines
 	lines := strings.Split(spec, "\n")
 	h.Conn.logger.Debug("HTTP/2 ProcessSpec parsed %d lines", len(lines))
 
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
+	if err := h.runLines(lines); err != nil {
+		return err
+	}
+
+	// Streams started with -start end with the spec, as in VTest2
+	if err := h.waitStartedStreams(); err != nil {
+		return err
+	}
+
+	h.Conn.logger.Debug("HTTP/2 ProcessSpec completed successfully")
+	return nil
+}
+
+// runLines runs connection-level spec lines, and the repeat blocks among
+// them
+func (h *Handler) runLines(lines []string) error {
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
 		h.Conn.logger.Debug("Processing line %d: %s", i+1, line)
 
-		// Parse the command line
-		err := h.ProcessCommand(line)
+		if vtc.IsRepeat(line) {
+			block, err := vtc.ParseRepeat(lines, i, h.expandLine)
+			if err != nil {
+				return err
+			}
+			if err := block.Run(h.runLines); err != nil {
+				return err
+			}
+			i = block.End
+			continue
+		}
+
+		// Expand macros as late as possible, then run the command
+		expanded, err := h.expandLine(line)
+		if err == nil {
+			err = h.ProcessCommand(expanded)
+		}
 		if err != nil {
 			h.Conn.logger.Debug("Command failed on line %d: %v", i+1, err)
+			if h.nonFatal {
+				h.recordSoftFailure(line, err)
+				continue
+			}
 			return fmt.Errorf("command '%s' failed: %w", line, err)
 		}
 
 		h.Conn.logger.Debug("Line %d completed successfully", i+1)
 	}
-
-	h.Conn.logger.Debug("HTTP/2 ProcessSpec completed successfully")
 	return nil
 }
 
+// expandLine expands the macros in a spec line just before it runs.
+// stream is left alone: its nested lines are expanded as they run.
+func (h *Handler) expandLine(line string) (string, error) {
+	if h.macros == nil || h.Expanded || strings.HasPrefix(line, "stream ") {
+		return line, nil
+	}
+	return h.macros.Expand(h.Conn.logger, line)
+}
+
+// defineMacro defines a macro for the rest of this spec and for the test
+func (h *Handler) defineMacro(name, value string) {
+	if h.macros != nil {
+		h.macros.Define(name, value)
+	}
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok && ctx.Macros != nil {
+		ctx.Macros.Define(name, value)
+	}
+}
+
 // ProcessCommand processes a single HTTP/2 command
 func (h *Handler) ProcessCommand(cmdLine string) error {
 	// Tokenize the command line
@@ -73,6 +167,10 @@ func (h *Handler) ProcessCommand(cmdLine string) error {
 
 	cmd := tokens[0]
 	args := tokens[1:]
+	if cmd != "stream" {
+		args = decodeVerbatim(args)
+		vtc.ChaosDelay(h.Context)
+	}
 
 	h.Conn.logger.Debug("ProcessCommand: cmd=%s, args=%v", cmd, args)
 
@@ -96,10 +194,38 @@ func (h *Handler) ProcessCommand(cmdLine string) error {
 	case "sendhex":
 		h.Conn.logger.Debug("Executing sendhex")
 		err = h.handleSendHex(args)
+	case "hpack_reset":
+		err = h.handleHpackReset(args)
 	case "delay":
 		h.Conn.logger.Debug("Executing delay")
 		err = h.handleDelay(args)
+	case "barrier":
+		err = h.handleBarrier(args)
+	case "graceful_goaway":
+		h.Conn.SetGracefulGoAway(true)
+	case "nextstreamid":
+		err = h.handleNextStreamID(args)
+	case "capture":
+		err = h.handleCapture(0, args)
+	case "setvar":
+		err = vtc.SpecSetvar(args, h.Context, h.Conn.logger)
+	case "rxerror":
+		h.Conn.logger.Debug("Executing rxerror")
+		_, err = h.Conn.RxError()
+	case "txupgrade":
+		h.Conn.logger.Debug("Executing txupgrade")
+		err = h.handleTxUpgrade(args)
+	case "rxupgrade":
+		h.Conn.logger.Debug("Executing rxupgrade")
+		err = h.Conn.RxUpgrade()
+	case "fatal":
+		h.nonFatal = false
+	case "non_fatal":
+		h.nonFatal = true
 	default:
+		if vtc.SkipUnknownCommand(h.Context, cmd) {
+			return nil
+		}
 		err = fmt.Errorf("unknown HTTP/2 command: %s", cmd)
 	}
 
@@ -112,6 +238,14 @@ func (h *Handler) ProcessCommand(cmdLine string) error {
 	return err
 }
 
+// requestCommands carry a request, a response or their frames, which
+// stream 0, the connection itself, cannot
+var requestCommands = map[string]bool{
+	"txreq": true, "rxreq": true, "txresp": true, "rxresp": true,
+	"txdata": true, "rxdata": true, "rxhdrs": true, "txcont": true,
+	"txpush": true, "rxpush": true,
+}
+
 // ProcessStreamCommand processes a command in the context of a specific stream
 func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 	// Tokenize the command line
@@ -121,7 +255,11 @@ func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 	}
 
 	cmd := tokens[0]
-	args := tokens[1:]
+	if streamID == 0 && requestCommands[cmd] {
+		return fmt.Errorf("%s: stream 0 is the connection and takes only connection-level commands; use a stream of its own (stream 1, stream next)", cmd)
+	}
+	args := decodeVerbatim(tokens[1:])
+	vtc.ChaosDelay(h.Context)
 
 	h.Conn.logger.Debug("ProcessStreamCommand: stream=%d, cmd=%s, args=%v", streamID, cmd, args)
 
@@ -135,16 +273,20 @@ func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 		err = h.handleTxResp(streamID, args)
 	case "rxreq":
 		h.Conn.logger.Debug("Executing rxreq on stream %d", streamID)
-		err = h.Conn.RxReq(streamID)
+		if err = h.Conn.RxReq(streamID); err == nil {
+			h.defineTimingMacros(streamID)
+		}
 	case "rxresp":
 		h.Conn.logger.Debug("Executing rxresp on stream %d", streamID)
-		err = h.Conn.RxResp(streamID)
+		if err = h.Conn.RxResp(streamID); err == nil {
+			h.defineTimingMacros(streamID)
+		}
 	case "txdata":
 		h.Conn.logger.Debug("Executing txdata on stream %d", streamID)
 		err = h.handleTxData(streamID, args)
 	case "rxdata":
 		h.Conn.logger.Debug("Executing rxdata on stream %d", streamID)
-		_, err = h.Conn.RxData(streamID)
+		err = h.handleRxData(streamID, args)
 	case "rxhdrs":
 		h.Conn.logger.Debug("Executing rxhdrs on stream %d", streamID)
 		// rxhdrs is implicitly handled by rxreq/rxresp
@@ -153,8 +295,20 @@ func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 		if !ok {
 			err = fmt.Errorf("stream %d not found", streamID)
 		} else {
-			stream.Wait()
+			err = stream.Wait(h.Conn.ctx.Done())
 		}
+	case "txpush":
+		h.Conn.logger.Debug("Executing txpush on stream %d", streamID)
+		err = h.handleTxPush(streamID, args)
+	case "rxpush":
+		h.Conn.logger.Debug("Executing rxpush on stream %d", streamID)
+		_, err = h.Conn.RxPush(streamID)
+	case "rxframe":
+		h.Conn.logger.Debug("Executing rxframe on stream %d", streamID)
+		err = h.handleRxFrame(streamID, args)
+	case "txcont":
+		h.Conn.logger.Debug("Executing txcont on stream %d", streamID)
+		err = h.handleTxCont(streamID, args)
 	case "txprio":
 		h.Conn.logger.Debug("Executing txprio on stream %d", streamID)
 		err = h.handleTxPrio(streamID, args)
@@ -181,7 +335,14 @@ func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 		err = h.handleTxGoAway(streamID, args)
 	case "rxgoaway":
 		h.Conn.logger.Debug("Executing rxgoaway on stream %d", streamID)
-		err = h.Conn.RxGoAway()
+		_, err = h.Conn.RxGoAway()
+	case "rxerror":
+		h.Conn.logger.Debug("Executing rxerror on stream %d", streamID)
+		_, err = h.Conn.RxError()
+	case "graceful_goaway":
+		h.Conn.SetGracefulGoAway(true)
+	case "nextstreamid":
+		err = h.handleNextStreamID(args)
 	case "txwinup":
 		h.Conn.logger.Debug("Executing txwinup on stream %d", streamID)
 		err = h.handleTxWinup(streamID, args)
@@ -191,13 +352,24 @@ func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 	case "expect":
 		h.Conn.logger.Debug("Executing expect on stream %d", streamID)
 		err = h.handleExpect(streamID, args)
+	case "capture":
+		err = h.handleCapture(streamID, args)
+	case "setvar":
+		err = vtc.SpecSetvar(args, h.Context, h.Conn.logger)
 	case "sendhex":
 		h.Conn.logger.Debug("Executing sendhex on stream %d", streamID)
 		err = h.handleSendHex(args)
+	case "hpack_reset":
+		err = h.handleHpackReset(args)
 	case "delay":
 		h.Conn.logger.Debug("Executing delay")
 		err = h.handleDelay(args)
+	case "barrier":
+		err = h.handleBarrier(args)
 	default:
+		if vtc.SkipUnknownCommand(h.Context, cmd) {
+			return nil
+		}
 		err = fmt.Errorf("unknown HTTP/2 stream command: %s", cmd)
 	}
 
@@ -211,16 +383,25 @@ func (h *Handler) ProcessStreamCommand(streamID uint32, cmdLine string) error {
 }
 
 // handleStream processes the stream command
-// Syntax: stream ID { commands... } -run|-start|-wait
+// Syntax: stream ID|next { commands... } -run|-start|-wait
 func (h *Handler) handleStream(args []string) error {
 	if len(args) < 2 {
 		return fmt.Errorf("stream: requires stream ID and spec or flags")
 	}
 
-	// Parse stream ID
-	streamID, err := strconv.ParseUint(args[0], 10, 32)
-	if err != nil {
-		return fmt.Errorf("stream: invalid stream ID: %w", err)
+	// Parse stream ID; "next" takes the one after the last stream, the
+	// client's streams on both sides
+	var streamID uint32
+	if args[0] == "next" {
+		streamID = h.Conn.NextSpecStreamID()
+		h.Conn.logger.Log(4, "stream next: stream %d", streamID)
+	} else {
+		id, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("stream: invalid stream ID: %w", err)
+		}
+		streamID = uint32(id)
+		h.Conn.UseSpecStreamID(streamID)
 	}
 
 	// Look for flags and collect spec parts
@@ -243,7 +424,7 @@ func (h *Handler) handleStream(args []string) error {
 
 	// Handle -wait flag (wait for stream to complete)
 	if runMode == "wait" {
-		return h.waitForStream(uint32(streamID))
+		return h.waitForStream(streamID)
 	}
 
 	// Join spec parts with spaces (they have been split by the tokenizer)
@@ -258,11 +439,11 @@ func (h *Handler) handleStream(args []string) error {
 
 	// Execute stream spec
 	if runMode == "start" {
-		return h.startStream(uint32(streamID), spec)
+		return h.startStream(streamID, spec)
 	}
 
 	// Default to -run (synchronous execution)
-	return h.runStream(uint32(streamID), spec)
+	return h.runStream(streamID, spec)
 }
 
 // runStream executes a stream spec synchronously
@@ -272,23 +453,65 @@ func (h *Handler) runStream(streamID uint32, spec string) error {
 	// Parse the spec into lines
 	lines := strings.Split(spec, "\n")
 
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
+	// Streams start with the connection's setting and may override it
+	nonFatal := h.nonFatal
+	if err := h.runStreamLines(streamID, lines, &nonFatal); err != nil {
+		return err
+	}
+
+	h.Conn.logger.Debug("Stream %d completed successfully", streamID)
+	return nil
+}
+
+// runStreamLines runs the lines of a stream spec, and the repeat blocks
+// among them. fatal and non_fatal set *nonFatal for the rest of the stream.
+func (h *Handler) runStreamLines(streamID uint32, lines []string, nonFatal *bool) error {
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
 
 		h.Conn.logger.Debug("Stream %d line %d: %s", streamID, i+1, line)
 
+		switch line {
+		case "fatal":
+			*nonFatal = false
+			continue
+		case "non_fatal":
+			*nonFatal = true
+			continue
+		}
+
+		if vtc.IsRepeat(line) {
+			block, err := vtc.ParseRepeat(lines, i, h.expandLine)
+			if err != nil {
+				return fmt.Errorf("stream %d: %w", streamID, err)
+			}
+			err = block.Run(func(body []string) error {
+				return h.runStreamLines(streamID, body, nonFatal)
+			})
+			if err != nil {
+				return fmt.Errorf("stream %d: %w", streamID, err)
+			}
+			i = block.End
+			continue
+		}
+
 		// Execute the command in the stream context
-		err := h.ProcessStreamCommand(streamID, line)
+		expanded, err := h.expandLine(line)
+		if err == nil {
+			err = h.ProcessStreamCommand(streamID, expanded)
+		}
 		if err != nil {
 			h.Conn.logger.Debug("Stream %d command failed on line %d: %v", streamID, i+1, err)
+			if *nonFatal {
+				h.recordSoftFailure(fmt.Sprintf("stream %d: %s", streamID, line), err)
+				continue
+			}
 			return fmt.Errorf("stream %d command '%s' failed: %w", streamID, line, err)
 		}
 	}
-
-	h.Conn.logger.Debug("Stream %d completed successfully", streamID)
 	return nil
 }
 
@@ -346,20 +569,52 @@ func (h *Handler) waitForStream(streamID uint32) error {
 	return nil
 }
 
+// waitStartedStreams waits for the streams started with -start that were
+// not waited for, in stream order
+func (h *Handler) waitStartedStreams() error {
+	h.streamsMu.Lock()
+	ids := make([]uint32, 0, len(h.activeStreams))
+	for id := range h.activeStreams {
+		ids = append(ids, id)
+	}
+	h.streamsMu.Unlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var firstErr error
+	for _, id := range ids {
+		if err := h.waitForStream(id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // tokenizeCommand splits a command line into tokens
-// Handles quoted strings and basic tokenization
+// Handles quoted strings and basic tokenization. Verbatim $"..." tokens
+// are kept as they are, for decodeVerbatim or a nested stream spec.
 func tokenizeCommand(line string) []string {
 	var tokens []string
 	var current strings.Builder
 	inQuote := false
 	escaped := false
+	skip := 0
 
-	for _, ch := range line {
+	for i, ch := range line {
+		if i < skip {
+			continue
+		}
 		if escaped {
 			current.WriteRune(ch)
 			escaped = false
 			continue
 		}
+		if ch == '$' && !inQuote && current.Len() == 0 {
+			if end := util.VerbatimEnd(line, i); end > 0 {
+				current.WriteString(line[i:end])
+				skip = end
+				continue
+			}
+		}
 
 		switch ch {
 		case '\\':
@@ -392,8 +647,74 @@ func (h *Handler) handleDelay(args []string) error {
 		return fmt.Errorf("delay: missing duration")
 	}
 
-	// Parse duration (in seconds unless unit specified)
-	durationStr := args[0]
+	duration, err := parseDuration(args[0])
+	if err != nil {
+		return fmt.Errorf("delay: %w", err)
+	}
+
+	h.Conn.logger.Debug("Delaying for %v", duration)
+	time.Sleep(duration)
+	return nil
+}
+
+// handleBarrier runs a barrier command. A barrier the test declared is
+// the test's, as everywhere else; one first declared in this spec belongs
+// to the connection, for its streams to meet at:
+//
+//	barrier b1 cond 2
+//	stream 1 { barrier b1 sync; txreq } -start
+//	stream 3 { barrier b1 sync; txreq } -start
+func (h *Handler) handleBarrier(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("barrier: usage: barrier NAME cond COUNT [-cyclic] | barrier NAME sync")
+	}
+	name := args[0]
+	if ctx, ok := h.Context.(*vtc.ExecContext); ok {
+		if _, declared := ctx.Barriers[name]; declared {
+			return vtc.ExecuteCommand("barrier", args, h.Context, h.Conn.logger)
+		}
+	}
+	if name[0] != 'b' {
+		return fmt.Errorf("barrier name must start with 'b' (got %s)", name)
+	}
+
+	h.barriersMu.Lock()
+	b, ok := h.barriers[name]
+	switch args[1] {
+	case "cond", "sock":
+		if !ok {
+			b = barrier.New(name, h.Conn.logger)
+			h.barriers[name] = b
+		}
+		h.barriersMu.Unlock()
+		if len(args) < 3 {
+			return fmt.Errorf("barrier: %s requires a count", args[1])
+		}
+		count, err := strconv.Atoi(args[2])
+		if err != nil || count < 1 {
+			return fmt.Errorf("barrier: invalid count: %s", args[2])
+		}
+		b.Cyclic = len(args) > 3 && args[3] == "-cyclic"
+		return b.Start(count)
+	case "sync":
+		h.barriersMu.Unlock()
+		if !ok {
+			return fmt.Errorf("barrier %s: not declared (barrier %s cond COUNT)", name, name)
+		}
+		if ctx, ok := h.Context.(*vtc.ExecContext); ok {
+			return vtc.SyncBarrier(ctx, b)
+		}
+		return b.Sync()
+	default:
+		h.barriersMu.Unlock()
+		return fmt.Errorf("barrier: unknown option: %s", args[1])
+	}
+}
+
+// parseDuration parses a duration in seconds unless a unit is given
+// (e.g. "0.5" or "10ms")
+func parseDuration(s string) (time.Duration, error) {
+	durationStr := s
 	if !strings.Contains(durationStr, "s") && !strings.Contains(durationStr, "m") {
 		durationStr += "s" // Default to seconds
 	}
@@ -401,27 +722,126 @@ func (h *Handler) handleDelay(args []string) error {
 	duration, err := time.ParseDuration(durationStr)
 	if err != nil {
 		// Try parsing as float seconds
-		if seconds, err := strconv.ParseFloat(args[0], 64); err == nil {
-			duration = time.Duration(seconds * float64(time.Second))
-		} else {
-			return fmt.Errorf("delay: invalid duration: %s", args[0])
+		seconds, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %s", s)
 		}
+		duration = time.Duration(seconds * float64(time.Second))
 	}
-
-	h.Conn.logger.Debug("Delaying for %v", duration)
-	time.Sleep(duration)
-	return nil
+	return duration, nil
 }
 
+// handleSendHex sends raw bytes; with -hpack, header blocks in them update
+// the encoder's dynamic table so later txreq/txresp stay in step with the
+// peer
+// Syntax: sendhex [-hpack] HEX
 func (h *Handler) handleSendHex(args []string) error {
+	hpackAware := false
+	if len(args) > 0 && args[0] == "-hpack" {
+		hpackAware = true
+		args = args[1:]
+	}
 	if len(args) == 0 {
 		return fmt.Errorf("sendhex: missing hex data")
 	}
 
 	hexData := strings.Join(args, " ")
+	if hpackAware {
+		return h.Conn.SendHexHpack(hexData)
+	}
 	return h.Conn.SendHex(hexData)
 }
 
+// handleHpackReset empties the HPACK dynamic tables, both unless -enc or
+// -dec picks one
+// Syntax: hpack_reset [-enc] [-dec]
+func (h *Handler) handleHpackReset(args []string) error {
+	encoder, decoder := len(args) == 0, len(args) == 0
+	for _, arg := range args {
+		switch arg {
+		case "-enc":
+			encoder = true
+		case "-dec":
+			decoder = true
+		default:
+			return fmt.Errorf("hpack_reset: unknown option: %s", arg)
+		}
+	}
+	h.Conn.ResetHpack(encoder, decoder)
+	return nil
+}
+
+// handleNextStreamID sets the ID "stream next" takes next; later ones
+// follow in steps of 2. Any ID goes, so a client can use even, zero,
+// decreasing or closed stream IDs, or ones beyond 2^31-1.
+// Syntax: nextstreamid ID
+func (h *Handler) handleNextStreamID(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("nextstreamid: requires a stream ID")
+	}
+	id, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("nextstreamid: invalid stream ID: %w", err)
+	}
+	h.Conn.SetNextSpecStreamID(uint32(id))
+	return nil
+}
+
+// handleTxUpgrade sends an HTTP/1.1 request upgrading the connection to
+// h2c; the request continues as stream 1
+// Syntax: txupgrade [-method M] [-url U] [-hdr "name: value"] [-body B] [-nosettings]
+func (h *Handler) handleTxUpgrade(args []string) error {
+	opts := UpgradeOptions{
+		Method:    "GET",
+		Path:      "/",
+		Authority: "localhost",
+		Headers:   make(map[string]string),
+	}
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-method", "-req":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txupgrade: -method requires an argument")
+			}
+			opts.Method = args[i+1]
+			i++
+		case "-url":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txupgrade: -url requires an argument")
+			}
+			opts.Path = args[i+1]
+			i++
+		case "-hdr":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txupgrade: -hdr requires an argument")
+			}
+			parts := strings.SplitN(args[i+1], ":", 2)
+			if len(parts) == 2 {
+				name := strings.TrimSpace(parts[0])
+				if strings.EqualFold(name, "host") {
+					opts.Authority = strings.TrimSpace(parts[1])
+				} else {
+					opts.Headers[name] = strings.TrimSpace(parts[1])
+				}
+			}
+			i++
+		case "-body":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txupgrade: -body requires an argument")
+			}
+			opts.Body = []byte(args[i+1])
+			i++
+		case "-nosettings":
+			opts.NoSettings = true
+		default:
+			return fmt.Errorf("txupgrade: unknown option: %s", args[i])
+		}
+	}
+
+	return h.Conn.TxUpgrade(opts)
+}
+
 func (h *Handler) handleTxSettings(args []string) error {
 	settings := make(map[SettingID]uint32)
 	ack := false
@@ -525,6 +945,12 @@ func (h *Handler) handleTxReq(streamID uint32, args []string) error {
 	var hpackInstructions []hpack.HpackInstruction
 
 	for i := 0; i < len(args); i++ {
+		if next, ok, err := parseFrameOption("txreq", args, i, &opts.Frame); err != nil {
+			return err
+		} else if ok {
+			i = next
+			continue
+		}
 		switch args[i] {
 		case "-method", "-req":
 			if i+1 >= len(args) {
@@ -562,6 +988,8 @@ func (h *Handler) handleTxReq(streamID uint32, args []string) error {
 			i++
 		case "-nostrend":
 			opts.EndStream = false
+		case "-nohdrend":
+			opts.NoHdrEnd = true
 		case "-idxHdr":
 			// Indexed header field
 			if i+1 >= len(args) {
@@ -659,6 +1087,12 @@ func (h *Handler) handleTxResp(streamID uint32, args []string) error {
 	var hpackInstructions []hpack.HpackInstruction
 
 	for i := 0; i < len(args); i++ {
+		if next, ok, err := parseFrameOption("txresp", args, i, &opts.Frame); err != nil {
+			return err
+		} else if ok {
+			i = next
+			continue
+		}
 		switch args[i] {
 		case "-status":
 			if i+1 >= len(args) {
@@ -684,6 +1118,8 @@ func (h *Handler) handleTxResp(streamID uint32, args []string) error {
 			i++
 		case "-nostrend":
 			opts.EndStream = false
+		case "-nohdrend":
+			opts.NoHdrEnd = true
 		case "-idxHdr":
 			// Indexed header field
 			if i+1 >= len(args) {
@@ -758,9 +1194,16 @@ func (h *Handler) handleTxResp(streamID uint32, args []string) error {
 
 func (h *Handler) handleTxData(streamID uint32, args []string) error {
 	var data []byte
+	var frame FrameOptions
 	endStream := true
 
 	for i := 0; i < len(args); i++ {
+		if next, ok, err := parseFrameOption("txdata", args, i, &frame); err != nil {
+			return err
+		} else if ok {
+			i = next
+			continue
+		}
 		switch args[i] {
 		case "-data":
 			if i+1 >= len(args) {
@@ -768,6 +1211,36 @@ func (h *Handler) handleTxData(streamID uint32, args []string) error {
 			}
 			data = []byte(args[i+1])
 			i++
+		case "-datalen":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txdata: -datalen requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("txdata: invalid -datalen value: %s", args[i+1])
+			}
+			data = []byte(util.GenerateBody(n, ""))
+			i++
+		case "-framesize":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txdata: -framesize requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("txdata: invalid -framesize value: %s", args[i+1])
+			}
+			frame.FrameSize = n
+			i++
+		case "-pace":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txdata: -pace requires an argument")
+			}
+			d, err := parseDuration(args[i+1])
+			if err != nil {
+				return fmt.Errorf("txdata: -pace: %w", err)
+			}
+			frame.Pace = d
+			i++
 		case "-nostrend":
 			endStream = false
 		default:
@@ -776,7 +1249,244 @@ func (h *Handler) handleTxData(streamID uint32, args []string) error {
 		}
 	}
 
-	return h.Conn.TxData(streamID, data, endStream)
+	return h.Conn.TxData(streamID, data, endStream, frame)
+}
+
+// handleRxData waits for DATA on a stream; with -some N, for exactly the
+// next N DATA frames
+// Syntax: rxdata [-some N]
+func (h *Handler) handleRxData(streamID uint32, args []string) error {
+	some := 0
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-some":
+			if i+1 >= len(args) {
+				return fmt.Errorf("rxdata: -some requires an argument")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("rxdata: invalid -some value: %s", args[i+1])
+			}
+			some = n
+			i++
+		default:
+			return fmt.Errorf("rxdata: unknown option: %s", args[i])
+		}
+	}
+
+	if some == 0 {
+		_, err := h.Conn.RxData(streamID)
+		return err
+	}
+	_, err := h.Conn.RxDataFrames(streamID, some)
+	return err
+}
+
+// parseFrameOption handles the padding and -noenforce options of txreq,
+// txresp, txdata and txpush and the priority options of txreq and txresp. It returns the index of the
+// last argument used, and false if args[i] is not one of them.
+func parseFrameOption(cmd string, args []string, i int, fo *FrameOptions) (int, bool, error) {
+	byteArg := func() (int, error) {
+		if i+1 >= len(args) {
+			return 0, fmt.Errorf("%s: %s requires an argument", cmd, args[i])
+		}
+		n, err := strconv.ParseUint(args[i+1], 10, 8)
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid %s value: %w", cmd, args[i], err)
+		}
+		return int(n), nil
+	}
+	priority := func() *Priority {
+		if fo.Priority == nil {
+			fo.Priority = &Priority{Weight: 16}
+		}
+		return fo.Priority
+	}
+
+	switch args[i] {
+	case "-noenforce":
+		fo.NoEnforce = true
+		return i, true, nil
+	case "-pad":
+		if i+1 >= len(args) {
+			return 0, false, fmt.Errorf("%s: -pad requires an argument", cmd)
+		}
+		fo.Padded = true
+		fo.Pad = []byte(args[i+1])
+		return i + 1, true, nil
+	case "-padlen":
+		n, err := byteArg()
+		if err != nil {
+			return 0, false, err
+		}
+		fo.Padded = true
+		fo.Pad = make([]byte, n)
+		return i + 1, true, nil
+	case "-padfield":
+		// Pad Length as sent, e.g. longer than the frame
+		n, err := byteArg()
+		if err != nil {
+			return 0, false, err
+		}
+		fo.Padded = true
+		fo.PadField = &n
+		return i + 1, true, nil
+	}
+
+	if cmd == "txdata" || cmd == "txpush" {
+		return i, false, nil
+	}
+	switch args[i] {
+	case "-dep":
+		if i+1 >= len(args) {
+			return 0, false, fmt.Errorf("%s: -dep requires an argument", cmd)
+		}
+		val, err := strconv.ParseUint(args[i+1], 10, 31)
+		if err != nil {
+			return 0, false, fmt.Errorf("%s: invalid -dep value: %w", cmd, err)
+		}
+		priority().DependsOn = uint32(val)
+		return i + 1, true, nil
+	case "-ex":
+		priority().Exclusive = true
+		return i, true, nil
+	case "-weight":
+		n, err := byteArg()
+		if err != nil {
+			return 0, false, err
+		}
+		priority().Weight = uint8(n)
+		return i + 1, true, nil
+	}
+	return i, false, nil
+}
+
+// handleTxPush sends a PUSH_PROMISE
+// Syntax: txpush [-promised ID] [-method M] [-url U] [-scheme S] [-hdr "name: value"]... [-nohdrend] [padding options]
+func (h *Handler) handleTxPush(streamID uint32, args []string) error {
+	opts := TxPushOptions{
+		Method:    "GET",
+		Path:      "/",
+		Scheme:    "http",
+		Authority: "localhost",
+		Headers:   make(map[string]string),
+	}
+
+	for i := 0; i < len(args); i++ {
+		if next, ok, err := parseFrameOption("txpush", args, i, &opts.Frame); err != nil {
+			return err
+		} else if ok {
+			i = next
+			continue
+		}
+		switch args[i] {
+		case "-promised":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txpush: -promised requires an argument")
+			}
+			val, err := strconv.ParseUint(args[i+1], 10, 31)
+			if err != nil {
+				return fmt.Errorf("txpush: invalid -promised value: %w", err)
+			}
+			opts.PromisedID = uint32(val)
+			i++
+		case "-method", "-req":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txpush: -method requires an argument")
+			}
+			opts.Method = args[i+1]
+			i++
+		case "-url":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txpush: -url requires an argument")
+			}
+			opts.Path = args[i+1]
+			i++
+		case "-scheme":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txpush: -scheme requires an argument")
+			}
+			opts.Scheme = args[i+1]
+			i++
+		case "-hdr":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txpush: -hdr requires an argument")
+			}
+			parts := strings.SplitN(args[i+1], ":", 2)
+			if len(parts) == 2 {
+				opts.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+			}
+			i++
+		case "-nohdrend":
+			opts.NoHdrEnd = true
+		default:
+			return fmt.Errorf("txpush: unknown option %s", args[i])
+		}
+	}
+
+	_, err := h.Conn.TxPushPromise(streamID, opts)
+	return err
+}
+
+// handleTxCont sends a CONTINUATION frame
+// Syntax: txcont [-hdr NAME VALUE]... [-hex HEX] [-nohdrend]
+func (h *Handler) handleTxCont(streamID uint32, args []string) error {
+	var headers []hpack.HeaderField
+	var raw []byte
+	endHeaders := true
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-hdr":
+			if i+2 >= len(args) {
+				return fmt.Errorf("txcont: -hdr requires a name and a value")
+			}
+			headers = append(headers, hpack.HeaderField{Name: args[i+1], Value: args[i+2]})
+			i += 2
+		case "-hex":
+			if i+1 >= len(args) {
+				return fmt.Errorf("txcont: -hex requires an argument")
+			}
+			b, err := hex.DecodeString(strings.ReplaceAll(args[i+1], " ", ""))
+			if err != nil {
+				return fmt.Errorf("txcont: invalid -hex: %w", err)
+			}
+			raw = append(raw, b...)
+			i++
+		case "-nohdrend":
+			endHeaders = false
+		default:
+			return fmt.Errorf("txcont: unknown option %s", args[i])
+		}
+	}
+
+	return h.Conn.TxCont(streamID, headers, raw, endHeaders)
+}
+
+// handleRxFrame waits for the next frame on the stream
+// Syntax: rxframe [-type TYPE]
+func (h *Handler) handleRxFrame(streamID uint32, args []string) error {
+	var frameType *FrameType
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-type":
+			if i+1 >= len(args) {
+				return fmt.Errorf("rxframe: -type requires an argument")
+			}
+			t, err := ParseFrameType(args[i+1])
+			if err != nil {
+				return fmt.Errorf("rxframe: %w", err)
+			}
+			frameType = &t
+			i++
+		default:
+			return fmt.Errorf("rxframe: unknown option %s", args[i])
+		}
+	}
+
+	_, err := h.Conn.RxFrame(streamID, frameType)
+	return err
 }
 
 func (h *Handler) handleTxPrio(streamID uint32, args []string) error {
@@ -823,11 +1533,11 @@ func (h *Handler) handleTxRst(streamID uint32, args []string) error {
 			if i+1 >= len(args) {
 				return fmt.Errorf("txrst: -err requires an argument")
 			}
-			val, err := strconv.ParseUint(args[i+1], 10, 32)
+			val, err := ParseErrCode(args[i+1])
 			if err != nil {
 				return fmt.Errorf("txrst: invalid -err value: %w", err)
 			}
-			errorCode = uint32(val)
+			errorCode = val
 			i++
 		}
 	}
@@ -880,11 +1590,11 @@ func (h *Handler) handleTxGoAway(streamID uint32, args []string) error {
 			if i+1 >= len(args) {
 				return fmt.Errorf("txgoaway: -err requires an argument")
 			}
-			val, err := strconv.ParseUint(args[i+1], 10, 32)
+			val, err := ParseErrCode(args[i+1])
 			if err != nil {
 				return fmt.Errorf("txgoaway: invalid -err value: %w", err)
 			}
-			errorCode = uint32(val)
+			errorCode = val
 			i++
 		case "-debug":
 			if i+1 >= len(args) {
@@ -938,6 +1648,23 @@ func (h *Handler) handleExpect(streamID uint32, args []string) error {
 	return h.Conn.Expect(streamID, field, op, expected)
 }
 
+// handleCapture stores the value of an expect field in a macro, for later
+// lines and specs: capture resp.http.x-req-id req_id
+func (h *Handler) handleCapture(streamID uint32, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("capture: requires 2 arguments: field name")
+	}
+
+	value, err := h.Conn.Field(streamID, args[0])
+	if err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+
+	h.defineMacro(args[1], value)
+	h.Conn.logger.Log(4, "capture %s = %q", args[1], value)
+	return nil
+}
+
 func (h *Handler) handleConnectionExpect(field, op, expected string) error {
 	// Handle connection-level expectations (settings, ping, goaway, winup, prio, rst, frame)
 	parts := strings.Split(field, ".")
@@ -945,12 +1672,24 @@ func (h *Handler) handleConnectionExpect(field, op, expected string) error {
 		return fmt.Errorf("expect: invalid field format: %s", field)
 	}
 
-	// For now, implement basic frame field expectations
-	// The actual implementation would need to store received frames for validation
 	h.Conn.logger.Debug("Connection-level expect: %s %s %s", field, op, expected)
+	switch parts[0] {
+	case "frame", "goaway", "settings", "stream", "conn", "rst":
+		return h.Conn.Expect(0, field, op, expected)
+	case "req", "resp", "push", "timing":
+		return fmt.Errorf("expect %s: stream 0 is the connection and has no requests or responses", field)
+	}
 
-	// TODO: Implement proper connection-level expectations
-	// This would require storing received SETTINGS, PING, GOAWAY frames
+	// TODO: Implement ping, winup and prio expectations
+	// This would require storing received PING, WINDOW_UPDATE and PRIORITY frames
 
 	return nil
 }
+
+// decodeVerbatim decodes the verbatim $"..." tokens among args
+func decodeVerbatim(args []string) []string {
+	for i := range args {
+		args[i] = util.UnquoteVerbatim(args[i])
+	}
+	return args
+}
@@ -1,6 +1,7 @@
 package http2
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -60,13 +61,32 @@ type Stream struct {
 	Authority string
 	Status    string
 
+	// Interim (1xx) responses received before the final HEADERS
+	Interim []InterimResponse
+
+	// PUSH_PROMISEs received on this stream, and the one rxpush took last
+	Pushes []PushPromise
+	Push   *PushPromise
+
 	// Flow control windows
 	SendWindow int32
 	RecvWindow int32
 
+	// DATA frames received, and how many of them rxdata has taken
+	DataFrames int
+	dataTaken  int
+
+	timing streamTiming
+
+	// Place of the stream's first header block among those the connection
+	// received, from 1; 0 until it comes
+	Order int
+
 	// Synchronization
-	mu     sync.Mutex
-	signal chan struct{} // For stream events
+	mu         sync.Mutex
+	signal     chan struct{} // For stream events
+	pushSignal chan struct{} // For PUSH_PROMISEs, kept apart so rxresp is not woken
+	pushIdx    int           // Next entry of Pushes for rxpush
 }
 
 // NewStream creates a new stream
@@ -82,6 +102,7 @@ func NewStream(id uint32, name string) *Stream {
 		SendWindow: 65535, // Default initial window size
 		RecvWindow: 65535,
 		signal:     make(chan struct{}, 1),
+		pushSignal: make(chan struct{}, 1),
 	}
 }
 
@@ -123,6 +144,25 @@ func (s *Stream) UpdateState(endStream bool, sending bool) error {
 			s.State = StreamClosed
 		}
 
+	case StreamReservedLocal:
+		// A pushed response opens the stream towards the client only
+		if sending {
+			if endStream {
+				s.State = StreamClosed
+			} else {
+				s.State = StreamHalfClosedRemote
+			}
+		}
+
+	case StreamReservedRemote:
+		if !sending {
+			if endStream {
+				s.State = StreamClosed
+			} else {
+				s.State = StreamHalfClosedLocal
+			}
+		}
+
 	case StreamClosed:
 		// Already closed, no state change
 	}
@@ -163,6 +203,90 @@ func (s *Stream) AddRespHeader(name, value string) {
 	s.RespHeaders = append(s.RespHeaders, hpack.HeaderField{Name: name, Value: value})
 }
 
+// InterimResponse is a 1xx HEADERS block received ahead of the final response
+type InterimResponse struct {
+	Status  string
+	Headers []hpack.HeaderField
+}
+
+// AddInterim records a 1xx response without touching the final response
+func (s *Stream) AddInterim(headers []hpack.HeaderField) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ir := InterimResponse{Headers: headers}
+	for _, hf := range headers {
+		if hf.Name == ":status" {
+			ir.Status = hf.Value
+		}
+	}
+	s.Interim = append(s.Interim, ir)
+}
+
+// PushPromise is a PUSH_PROMISE: the stream it reserves and the request the
+// pushed response answers
+type PushPromise struct {
+	PromisedID uint32
+	Headers    []hpack.HeaderField
+}
+
+// Reserve puts an idle stream in the reserved state of a PUSH_PROMISE that
+// was sent (local) or received (remote)
+func (s *Stream) Reserve(local bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.State != StreamIdle {
+		return fmt.Errorf("stream %d cannot be reserved in state %s", s.ID, s.State)
+	}
+	if local {
+		s.State = StreamReservedLocal
+	} else {
+		s.State = StreamReservedRemote
+	}
+	return nil
+}
+
+// AddPush records a PUSH_PROMISE received on the stream
+func (s *Stream) AddPush(p PushPromise) {
+	s.mu.Lock()
+	s.Pushes = append(s.Pushes, p)
+	s.mu.Unlock()
+
+	select {
+	case s.pushSignal <- struct{}{}:
+	default:
+	}
+}
+
+// NextPush waits for a PUSH_PROMISE not yet taken and makes it the current
+// one. As in VTest2, the promised request also replaces the request fields.
+func (s *Stream) NextPush(ctx context.Context) (PushPromise, error) {
+	for {
+		s.mu.Lock()
+		if s.pushIdx < len(s.Pushes) {
+			p := s.Pushes[s.pushIdx]
+			s.pushIdx++
+			s.Push = &p
+			s.Method, s.Path, s.Scheme, s.Authority = "", "", "", ""
+			s.ReqHeaders = make([]hpack.HeaderField, 0, len(p.Headers))
+			s.mu.Unlock()
+
+			for _, hf := range p.Headers {
+				s.AddReqHeader(hf.Name, hf.Value)
+			}
+			return p, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.pushSignal:
+		case <-ctx.Done():
+			return PushPromise{}, fmt.Errorf("connection closed waiting for PUSH_PROMISE on stream %d", s.ID)
+		}
+	}
+}
+
 // AppendReqBody appends data to the request body
 func (s *Stream) AppendReqBody(data []byte) {
 	s.mu.Lock()
@@ -177,11 +301,9 @@ func (s *Stream) AppendRespBody(data []byte) {
 	s.RespBody = append(s.RespBody, data...)
 }
 
-// GetHeader retrieves a header value by name
+// GetHeader retrieves a header value by name. The stream lock must be held
+// by the caller, as it is for the stream's header lists.
 func (s *Stream) GetHeader(headers []hpack.HeaderField, name string) string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	for _, hf := range headers {
 		if hf.Name == name {
 			return hf.Value
@@ -198,9 +320,21 @@ func (s *Stream) Signal() {
 	}
 }
 
-// Wait waits for a signal with a timeout
-func (s *Stream) Wait() {
-	<-s.signal
+// Wait waits for a signal, and fails once done is closed, as it is when
+// the connection ends
+func (s *Stream) Wait(done <-chan struct{}) error {
+	select {
+	case <-s.signal:
+		return nil
+	case <-done:
+	}
+	// The last frame may have come right before the connection ended
+	select {
+	case <-s.signal:
+		return nil
+	default:
+		return fmt.Errorf("connection closed waiting on stream %d", s.ID)
+	}
 }
 
 // UpdateSendWindow updates the send window size
@@ -221,23 +355,82 @@ func (s *Stream) UpdateRecvWindow(delta int32) {
 type StreamManager struct {
 	streams map[uint32]*Stream
 	mu      sync.RWMutex
+
+	// SETTINGS_INITIAL_WINDOW_SIZE of the peer (send windows) and ours
+	// (receive windows)
+	initialSend int32
+	initialRecv int32
 }
 
 // NewStreamManager creates a new stream manager
 func NewStreamManager() *StreamManager {
 	return &StreamManager{
-		streams: make(map[uint32]*Stream),
+		streams:     make(map[uint32]*Stream),
+		initialSend: DefaultWindowSize,
+		initialRecv: DefaultWindowSize,
 	}
 }
 
+// newStream creates a stream with the current initial windows; sm.mu must
+// be held
+func (sm *StreamManager) newStream(id uint32, name string) *Stream {
+	s := NewStream(id, name)
+	s.SendWindow = sm.initialSend
+	s.RecvWindow = sm.initialRecv
+	sm.streams[id] = s
+	return s
+}
+
 // Create creates a new stream with the given ID and name
 func (sm *StreamManager) Create(id uint32, name string) *Stream {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
+	return sm.newStream(id, name)
+}
+
+// UpdateInitialWindow applies a new SETTINGS_INITIAL_WINDOW_SIZE: the
+// difference is added to the send (peer's setting) or receive (ours) window
+// of every stream, which may make it negative (RFC 7540 section 6.9.2)
+func (sm *StreamManager) UpdateInitialWindow(size int32, send bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
 
-	s := NewStream(id, name)
-	sm.streams[id] = s
-	return s
+	var delta int32
+	if send {
+		delta = size - sm.initialSend
+		sm.initialSend = size
+	} else {
+		delta = size - sm.initialRecv
+		sm.initialRecv = size
+	}
+	for _, s := range sm.streams {
+		if send {
+			s.UpdateSendWindow(delta)
+		} else {
+			s.UpdateRecvWindow(delta)
+		}
+	}
+}
+
+// CountOpen returns the number of open or half-closed streams with odd
+// (client) or even (server) IDs, which count against MAX_CONCURRENT_STREAMS
+func (sm *StreamManager) CountOpen(odd bool) int {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	n := 0
+	for id, s := range sm.streams {
+		if (id%2 == 1) != odd {
+			continue
+		}
+		s.mu.Lock()
+		switch s.State {
+		case StreamOpen, StreamHalfClosedLocal, StreamHalfClosedRemote:
+			n++
+		}
+		s.mu.Unlock()
+	}
+	return n
 }
 
 // Get retrieves a stream by ID
@@ -270,10 +463,7 @@ func (sm *StreamManager) GetOrCreate(id uint32, name string) *Stream {
 	if s, ok := sm.streams[id]; ok {
 		return s
 	}
-
-	s := NewStream(id, name)
-	sm.streams[id] = s
-	return s
+	return sm.newStream(id, name)
 }
 
 // Delete removes a stream from the manager
@@ -0,0 +1,92 @@
+package http2
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/perbu/GTest/pkg/util"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// streamTiming records when a stream's exchange progressed
+type streamTiming struct {
+	sentAt    time.Time // Last txreq/txresp on the stream
+	firstAt   time.Time // First HEADERS received, interim included
+	headersAt time.Time // Final HEADERS received
+	endAt     time.Time // END_STREAM received
+}
+
+// MarkSent starts a new exchange on the stream
+func (s *Stream) MarkSent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timing = streamTiming{sentAt: time.Now()}
+}
+
+// markReceived records the arrival of a frame from the peer
+func (s *Stream) markReceived(finalHeaders, endStream bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.timing.firstAt.IsZero() {
+		s.timing.firstAt = now
+	}
+	if finalHeaders && s.timing.headersAt.IsZero() {
+		s.timing.headersAt = now
+	}
+	if endStream {
+		s.timing.endAt = now
+	}
+}
+
+// getTimingField returns a timing of the stream in seconds (e.g.
+// "timing.ttfb"). Without a preceding send, times count from the first
+// HEADERS. The stream lock must be held by the caller.
+func getTimingField(stream *Stream, name string, connect time.Duration) (string, error) {
+	t := stream.timing
+	ref := t.sentAt
+	if ref.IsZero() {
+		ref = t.firstAt
+	}
+	since := func(from, to time.Time) time.Duration {
+		if from.IsZero() || to.IsZero() {
+			return 0
+		}
+		return to.Sub(from)
+	}
+
+	var d time.Duration
+	switch name {
+	case "connect":
+		d = connect
+	case "ttfb":
+		d = since(ref, t.firstAt)
+	case "headers":
+		d = since(ref, t.headersAt)
+	case "body":
+		d = since(t.headersAt, t.endAt)
+	case "total":
+		d = since(ref, t.endAt)
+	default:
+		return "", fmt.Errorf("unknown timing field: %s", name)
+	}
+	return strconv.FormatFloat(d.Seconds(), 'f', 6, 64), nil
+}
+
+// defineTimingMacros publishes the timings of the message just received
+// on a stream as ${NAME_timing_FIELD} (e.g. ${c1_timing_ttfb}) in seconds
+func (h *Handler) defineTimingMacros(streamID uint32) {
+	ctx, ok := h.Context.(*vtc.ExecContext)
+	if !ok || ctx.Macros == nil || h.Name == "" {
+		return
+	}
+	for _, field := range util.TimingFields {
+		value, err := h.Conn.Field(streamID, "timing."+field)
+		if err != nil {
+			return
+		}
+		ctx.Macros.Define(h.Name+"_timing_"+field, value)
+	}
+}
@@ -0,0 +1,200 @@
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// UpgradeOptions represents the HTTP/1.1 request of an h2c upgrade
+// (RFC 7540 section 3.2)
+type UpgradeOptions struct {
+	Method     string
+	Path       string
+	Authority  string
+	Headers    map[string]string
+	Body       []byte
+	NoSettings bool // Leave out HTTP2-Settings, which makes the upgrade invalid
+}
+
+// bufferedConn reads through the reader that parsed the HTTP/1.1 part of
+// an upgrade, so HTTP/2 frames that arrived with it are not lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// UpgradeSpec reports whether a spec starts with an h2c upgrade, in which
+// case HTTP/2 starts once the upgrade is done rather than on connect
+func UpgradeSpec(spec string) bool {
+	for _, line := range strings.Split(spec, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cmd, _, _ := strings.Cut(line, " ")
+		return cmd == "txupgrade" || cmd == "rxupgrade"
+	}
+	return false
+}
+
+// SettingsSpec reports whether a spec sends or receives SETTINGS frames
+// itself, in which case it runs without waiting for the exchange first
+func SettingsSpec(spec string) bool {
+	for _, line := range strings.Split(spec, "\n") {
+		cmd, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if cmd == "txsettings" || cmd == "rxsettings" {
+			return true
+		}
+	}
+	return false
+}
+
+// TxUpgrade sends an HTTP/1.1 request asking to upgrade to h2c, waits for
+// 101 Switching Protocols and starts HTTP/2, the request becoming stream 1
+func (c *Conn) TxUpgrade(opts UpgradeOptions) error {
+	settings := c.localSettingsList()
+	payload := encodeSettings(settings)
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "%s %s HTTP/1.1\r\n", opts.Method, opts.Path)
+	fmt.Fprintf(&req, "Host: %s\r\n", opts.Authority)
+	if opts.NoSettings {
+		req.WriteString("Connection: Upgrade\r\n")
+	} else {
+		req.WriteString("Connection: Upgrade, HTTP2-Settings\r\n")
+		fmt.Fprintf(&req, "HTTP2-Settings: %s\r\n", base64.RawURLEncoding.EncodeToString(payload))
+	}
+	req.WriteString("Upgrade: h2c\r\n")
+	for name, value := range opts.Headers {
+		fmt.Fprintf(&req, "%s: %s\r\n", name, value)
+	}
+	if len(opts.Body) > 0 {
+		fmt.Fprintf(&req, "Content-Length: %d\r\n", len(opts.Body))
+	}
+	req.WriteString("\r\n")
+	req.Write(opts.Body)
+
+	c.logger.Log(3, "Sending h2c upgrade request: %s %s", opts.Method, opts.Path)
+	c.writeMu.Lock()
+	_, err := c.conn.Write(req.Bytes())
+	c.writeMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send upgrade request: %w", err)
+	}
+
+	br := bufio.NewReader(c.conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read upgrade response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return fmt.Errorf("upgrade refused: %s", resp.Status)
+	}
+	c.logger.Log(3, "Received 101 Switching Protocols, starting HTTP/2")
+	c.conn = &bufferedConn{Conn: c.conn, r: br}
+
+	stream := c.streams.GetOrCreate(1, "stream-1")
+	stream.MarkSent()
+	stream.AddReqHeader(":method", opts.Method)
+	stream.AddReqHeader(":path", opts.Path)
+	stream.AddReqHeader(":scheme", "http")
+	stream.AddReqHeader(":authority", opts.Authority)
+	for name, value := range opts.Headers {
+		stream.AddReqHeader(strings.ToLower(name), value)
+	}
+	stream.AppendReqBody(opts.Body)
+	stream.UpdateState(true, true)
+	c.SetNextStreamID(3)
+
+	return c.Start()
+}
+
+// RxUpgrade receives an HTTP/1.1 request asking to upgrade to h2c, answers
+// 101 Switching Protocols and starts HTTP/2, the request becoming stream 1.
+// The settings in HTTP2-Settings apply as if sent in a SETTINGS frame.
+func (c *Conn) RxUpgrade() error {
+	br := bufio.NewReader(c.conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("failed to read upgrade request: %w", err)
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read upgrade request body: %w", err)
+	}
+
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "h2c") {
+		return fmt.Errorf("not an h2c upgrade: Upgrade is %q", req.Header.Get("Upgrade"))
+	}
+	encoded := req.Header.Get("HTTP2-Settings")
+	if encoded == "" {
+		return fmt.Errorf("h2c upgrade without HTTP2-Settings")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return fmt.Errorf("invalid HTTP2-Settings: %w", err)
+	}
+	settings, err := ParseSettingsFrame(payload)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP2-Settings: %w", err)
+	}
+	c.applyRemoteSettings(settings)
+
+	c.logger.Log(3, "Received h2c upgrade request: %s %s, sending 101", req.Method, req.RequestURI)
+	c.writeMu.Lock()
+	_, err = io.WriteString(c.conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	c.writeMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send 101 response: %w", err)
+	}
+	c.conn = &bufferedConn{Conn: c.conn, r: br}
+
+	stream := c.streams.GetOrCreate(1, "stream-1")
+	stream.AddReqHeader(":method", req.Method)
+	stream.AddReqHeader(":path", req.RequestURI)
+	stream.AddReqHeader(":scheme", "http")
+	stream.AddReqHeader(":authority", req.Host)
+	dropConnectionHeaders(req.Header)
+	for name, values := range req.Header {
+		for _, value := range values {
+			stream.AddReqHeader(strings.ToLower(name), value)
+		}
+	}
+	stream.AppendReqBody(body)
+	stream.markReceived(true, true)
+	stream.UpdateState(true, false)
+	stream.Signal()
+
+	c.mu.Lock()
+	c.lastStreamID = 1
+	c.nextPeerStream = 3
+	c.mu.Unlock()
+
+	return c.Start()
+}
+
+// dropConnectionHeaders removes the headers that only applied to the
+// HTTP/1.1 connection, and those its Connection header names, so the
+// upgraded request reads like one received over HTTP/2 (RFC 9113
+// section 8.2.2)
+func dropConnectionHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range []string{"Connection", "Upgrade", "HTTP2-Settings", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding"} {
+		header.Del(name)
+	}
+}
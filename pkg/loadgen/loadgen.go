@@ -0,0 +1,471 @@
+// Package loadgen drives concurrent clients for sustained-load tests.
+// Each client runs a spec over and over against one address, for a while
+// or until a number of requests is reached, and the latency of every run
+// is recorded so that throughput and percentiles can be checked against
+// thresholds.
+package loadgen
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+	gnet "github.com/perbu/GTest/pkg/net"
+)
+
+// ProcessFunc runs the spec once over conn
+type ProcessFunc func(conn net.Conn) error
+
+// LoadGen represents a load generator
+type LoadGen struct {
+	Name        string
+	Logger      *logging.Logger
+	Spec        string
+	ConnectAddr string
+	Clients     int           // Concurrent clients (-clients)
+	Duration    time.Duration // Stop after this long (-duration)
+	Requests    int           // Stop after this many spec runs in all (-requests)
+	KeepAlive   bool          // Keep the connection between runs (-keepalive)
+	Thresholds  []Threshold   // Checked when a run ends (-expect)
+	Running     bool
+
+	// Internal
+	mutex  sync.Mutex
+	wg     sync.WaitGroup
+	result *Result
+	err    error         // Outcome of the last background run
+	stop   chan struct{} // Closed by Stop to end the background run
+}
+
+// New creates a new load generator with the given name
+func New(logger *logging.Logger, name string) *LoadGen {
+	return &LoadGen{
+		Name:    name,
+		Logger:  logger,
+		Clients: 1,
+	}
+}
+
+// Result holds what a run measured
+type Result struct {
+	Requests  int           // Successful spec runs
+	Errors    int           // Failed connects and spec runs
+	Elapsed   time.Duration // Wall time of the run
+	FirstErr  error         // The first failure, for the report
+	latencies []time.Duration
+}
+
+// RPS returns the successful spec runs per second
+func (r *Result) RPS() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Percentile returns the latency below which p percent of the runs
+// finished, by nearest rank
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(r.latencies))))
+	rank = min(max(rank, 1), len(r.latencies))
+	return r.latencies[rank-1]
+}
+
+// Mean returns the average latency
+func (r *Result) Mean() time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, l := range r.latencies {
+		sum += l
+	}
+	return sum / time.Duration(len(r.latencies))
+}
+
+// Fields lists the names accepted by Value, in report order
+var Fields = []string{"requests", "errors", "rps", "min", "mean", "p50", "p90", "p95", "p99", "max"}
+
+// Value returns a field of the result. Latencies are in seconds.
+func (r *Result) Value(field string) (float64, error) {
+	switch field {
+	case "requests":
+		return float64(r.Requests), nil
+	case "errors":
+		return float64(r.Errors), nil
+	case "rps":
+		return r.RPS(), nil
+	case "min":
+		return r.Percentile(0).Seconds(), nil
+	case "mean":
+		return r.Mean().Seconds(), nil
+	case "max":
+		return r.Percentile(100).Seconds(), nil
+	}
+	if p, ok := percentileField(field); ok {
+		return r.Percentile(p).Seconds(), nil
+	}
+	return 0, fmt.Errorf("unknown loadgen field %q", field)
+}
+
+// Format returns a field as it is shown in macros and the report:
+// latencies as durations, rps with one decimal
+func (r *Result) Format(field string) (string, error) {
+	v, err := r.Value(field)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case field == "requests" || field == "errors":
+		return strconv.FormatFloat(v, 'f', 0, 64), nil
+	case field == "rps":
+		return strconv.FormatFloat(v, 'f', 1, 64), nil
+	}
+	return time.Duration(v * float64(time.Second)).Round(time.Microsecond).String(), nil
+}
+
+// String summarizes the result on one line
+func (r *Result) String() string {
+	return fmt.Sprintf("%d requests, %d errors in %s: %.1f req/s, p50 %s, p99 %s, max %s",
+		r.Requests, r.Errors, r.Elapsed.Round(time.Millisecond), r.RPS(),
+		r.Percentile(50).Round(time.Microsecond), r.Percentile(99).Round(time.Microsecond),
+		r.Percentile(100).Round(time.Microsecond))
+}
+
+// isLatency reports whether field is measured in time
+func isLatency(field string) bool {
+	switch field {
+	case "requests", "errors", "rps":
+		return false
+	}
+	return true
+}
+
+// percentileField parses pN and pN.M field names
+func percentileField(field string) (float64, bool) {
+	if len(field) < 2 || field[0] != 'p' {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(field[1:], 64)
+	if err != nil || p <= 0 || p > 100 {
+		return 0, false
+	}
+	return p, true
+}
+
+// Threshold is a pass/fail condition on a result field, such as
+// "p99 < 50ms" or "rps >= 1000"
+type Threshold struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// String returns the threshold as written
+func (t Threshold) String() string {
+	return t.Field + " " + t.Op + " " + t.Value
+}
+
+// ParseThreshold checks a threshold's field, operator and value
+func ParseThreshold(field, op, value string) (Threshold, error) {
+	t := Threshold{Field: field, Op: op, Value: value}
+	if _, err := (&Result{}).Value(field); err != nil {
+		return t, err
+	}
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return t, fmt.Errorf("invalid loadgen operator %q in %s", op, t)
+	}
+	if _, err := t.limit(); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+// limit returns the threshold value in the unit of Value: seconds for
+// latencies, which are written as durations
+func (t Threshold) limit() (float64, error) {
+	if isLatency(t.Field) {
+		d, err := time.ParseDuration(t.Value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration in %s: %w", t, err)
+		}
+		return d.Seconds(), nil
+	}
+	v, err := strconv.ParseFloat(t.Value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number in %s", t)
+	}
+	return v, nil
+}
+
+// Check returns an error if r does not meet the threshold
+func (t Threshold) Check(r *Result) error {
+	got, err := r.Value(t.Field)
+	if err != nil {
+		return err
+	}
+	want, err := t.limit()
+	if err != nil {
+		return err
+	}
+
+	var ok bool
+	switch t.Op {
+	case "==":
+		ok = got == want
+	case "!=":
+		ok = got != want
+	case "<":
+		ok = got < want
+	case "<=":
+		ok = got <= want
+	case ">":
+		ok = got > want
+	case ">=":
+		ok = got >= want
+	}
+	if !ok {
+		shown, _ := r.Format(t.Field)
+		return fmt.Errorf("%s failed: %s is %s", t, t.Field, shown)
+	}
+	return nil
+}
+
+// Check tests the result against the thresholds. Unless one of them is
+// about errors, any failed run fails the check.
+func (l *LoadGen) Check(r *Result) error {
+	errorsChecked := false
+	for _, t := range l.Thresholds {
+		if err := t.Check(r); err != nil {
+			return fmt.Errorf("loadgen %s: %w", l.Name, err)
+		}
+		errorsChecked = errorsChecked || t.Field == "errors"
+	}
+	if !errorsChecked && r.Errors > 0 {
+		return fmt.Errorf("loadgen %s: %d of %d runs failed, first: %w", l.Name, r.Errors, r.Requests+r.Errors, r.FirstErr)
+	}
+	return nil
+}
+
+// Result returns the result of the last run, or nil while none finished
+func (l *LoadGen) Result() *Result {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.result
+}
+
+// Run drives the clients until the duration has passed, the requests
+// are done or cancel is closed, then checks the thresholds
+func (l *LoadGen) Run(process ProcessFunc, cancel <-chan struct{}) (*Result, error) {
+	return l.run(process, cancel, nil)
+}
+
+// run is Run, also ending when stop is closed
+func (l *LoadGen) run(process ProcessFunc, cancel, stop <-chan struct{}) (*Result, error) {
+	if l.ConnectAddr == "" {
+		return nil, fmt.Errorf("loadgen %s: no connection address specified", l.Name)
+	}
+	if l.Duration <= 0 && l.Requests <= 0 {
+		return nil, fmt.Errorf("loadgen %s: needs -duration or -requests", l.Name)
+	}
+	if l.Clients < 1 {
+		return nil, fmt.Errorf("loadgen %s: -clients must be at least 1", l.Name)
+	}
+
+	l.Logger.Log(2, "Running loadgen %s: %d clients against %s", l.Name, l.Clients, l.ConnectAddr)
+
+	run := &runState{
+		process: process,
+		cancel:  cancel,
+		stop:    stop,
+		result:  &Result{},
+	}
+	if l.Requests > 0 {
+		run.budget.Store(int64(l.Requests))
+	} else {
+		run.budget.Store(math.MaxInt64)
+	}
+	start := time.Now()
+	if l.Duration > 0 {
+		run.deadline = start.Add(l.Duration)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < l.Clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.client(run)
+		}()
+	}
+	wg.Wait()
+
+	r := run.result
+	r.Elapsed = time.Since(start)
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+
+	l.mutex.Lock()
+	l.result = r
+	l.mutex.Unlock()
+
+	l.Logger.Log(1, "loadgen %s: %s", l.Name, r)
+	return r, l.Check(r)
+}
+
+// Start runs the load generator in a goroutine
+func (l *LoadGen) Start(process ProcessFunc, cancel <-chan struct{}) error {
+	l.mutex.Lock()
+	if l.Running {
+		l.mutex.Unlock()
+		return fmt.Errorf("loadgen %s already running", l.Name)
+	}
+	l.Running = true
+	l.result = nil
+	l.err = nil
+	stop := make(chan struct{})
+	l.stop = stop
+	l.mutex.Unlock()
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		_, err := l.run(process, cancel, stop)
+		l.mutex.Lock()
+		l.Running = false
+		l.err = err
+		l.mutex.Unlock()
+	}()
+	return nil
+}
+
+// Wait waits for a run begun by Start and returns its outcome
+func (l *LoadGen) Wait() error {
+	l.wg.Wait()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
+}
+
+// Stop ends a run begun by Start once the spec runs in progress are
+// done, and reports whether one was running
+func (l *LoadGen) Stop() bool {
+	l.mutex.Lock()
+	if !l.Running || l.stop == nil {
+		l.mutex.Unlock()
+		return false
+	}
+	close(l.stop)
+	l.stop = nil
+	l.mutex.Unlock()
+
+	l.wg.Wait()
+	return true
+}
+
+// The wait of a client after a failed connect, doubled after each
+const (
+	connectBackoff    = 10 * time.Millisecond
+	maxConnectBackoff = time.Second
+)
+
+// runState is shared by the clients of one run
+type runState struct {
+	process  ProcessFunc
+	cancel   <-chan struct{}
+	stop     <-chan struct{} // Closed by Stop; nil outside of Start
+	deadline time.Time       // Zero without -duration
+	budget   atomic.Int64    // Spec runs left to start
+
+	mutex  sync.Mutex
+	result *Result
+}
+
+// done reports whether the run is over
+func (s *runState) done() bool {
+	select {
+	case <-s.cancel:
+		return true
+	case <-s.stop:
+		return true
+	default:
+	}
+	return !s.deadline.IsZero() && !time.Now().Before(s.deadline)
+}
+
+// pause waits for d, or less if the run ends first
+func (s *runState) pause(d time.Duration) {
+	if !s.deadline.IsZero() {
+		d = min(d, time.Until(s.deadline))
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.cancel:
+	case <-s.stop:
+	case <-timer.C:
+	}
+}
+
+// record adds the outcome of one spec run
+func (s *runState) record(latency time.Duration, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.result.Errors++
+		if s.result.FirstErr == nil {
+			s.result.FirstErr = err
+		}
+		return
+	}
+	s.result.Requests++
+	s.result.latencies = append(s.result.latencies, latency)
+}
+
+// client runs the spec until the run is over. The latency of a run
+// includes the connect when it needs one. A failed run closes the
+// connection, and the next one connects again. After a failed connect
+// the client waits before the next, from connectBackoff up to
+// maxConnectBackoff, so that a refused connection is not retried at
+// full speed.
+func (l *LoadGen) client(run *runState) {
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	backoff := connectBackoff
+	for !run.done() && run.budget.Add(-1) >= 0 {
+		start := time.Now()
+		if conn == nil {
+			c, err := gnet.TCPConnect(l.ConnectAddr, 10*time.Second)
+			if err != nil {
+				run.record(0, err)
+				run.pause(backoff)
+				backoff = min(2*backoff, maxConnectBackoff)
+				continue
+			}
+			conn = c
+			backoff = connectBackoff
+		}
+
+		err := run.process(conn)
+		run.record(time.Since(start), err)
+		if err != nil || !l.KeepAlive {
+			conn.Close()
+			conn = nil
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package loadgen
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+func TestResult_Percentile(t *testing.T) {
+	r := &Result{Requests: 100, Elapsed: 2 * time.Second}
+	for i := 1; i <= 100; i++ {
+		r.latencies = append(r.latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	tests := []struct {
+		field string
+		want  string
+	}{
+		{"requests", "100"},
+		{"rps", "50.0"},
+		{"min", "1ms"},
+		{"p50", "50ms"},
+		{"p99", "99ms"},
+		{"p99.9", "100ms"},
+		{"max", "100ms"},
+		{"mean", "50.5ms"},
+	}
+	for _, tt := range tests {
+		got, err := r.Format(tt.field)
+		if err != nil {
+			t.Fatalf("Format(%s): %v", tt.field, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.field, got, tt.want)
+		}
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	r := &Result{Requests: 10, Errors: 1, Elapsed: time.Second, latencies: []time.Duration{10 * time.Millisecond}}
+
+	tests := []struct {
+		field, op, value string
+		pass             bool
+	}{
+		{"p99", "<", "50ms", true},
+		{"p99", "<", "5ms", false},
+		{"rps", ">=", "10", true},
+		{"rps", ">", "10", false},
+		{"errors", "==", "1", true},
+	}
+	for _, tt := range tests {
+		th, err := ParseThreshold(tt.field, tt.op, tt.value)
+		if err != nil {
+			t.Fatalf("ParseThreshold(%s %s %s): %v", tt.field, tt.op, tt.value, err)
+		}
+		if err := th.Check(r); (err == nil) != tt.pass {
+			t.Errorf("%s: got %v, want pass=%v", th, err, tt.pass)
+		}
+	}
+
+	for _, bad := range [][3]string{{"p99", "<", "50"}, {"rps", "<", "fast"}, {"latency", "<", "1s"}, {"rps", "=~", "1"}} {
+		if _, err := ParseThreshold(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("ParseThreshold(%v): expected an error", bad)
+		}
+	}
+}
+
+// listen accepts connections and holds them open until the test ends
+func listen(t *testing.T) (string, *atomic.Int32) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func TestLoadGen_Run(t *testing.T) {
+	addr, accepted := listen(t)
+
+	l := New(logging.NewLogger("test"), "l1")
+	l.ConnectAddr = addr
+	l.Clients = 4
+	l.Requests = 100
+	l.KeepAlive = true
+
+	var runs atomic.Int32
+	r, err := l.Run(func(conn net.Conn) error {
+		runs.Add(1)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Requests != 100 || runs.Load() != 100 {
+		t.Errorf("Expected 100 runs, got %d recorded and %d made", r.Requests, runs.Load())
+	}
+	if n := accepted.Load(); n > 4 {
+		t.Errorf("Expected at most one connection per client with -keepalive, got %d", n)
+	}
+}
+
+func TestLoadGen_Errors(t *testing.T) {
+	addr, _ := listen(t)
+
+	l := New(logging.NewLogger("test"), "l1")
+	l.ConnectAddr = addr
+	l.Requests = 10
+
+	var n int
+	process := func(conn net.Conn) error {
+		n++
+		if n%2 == 0 {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	if _, err := l.Run(process, nil); err == nil || !strings.Contains(err.Error(), "5 of 10 runs failed") {
+		t.Errorf("Expected failed runs to fail the check, got %v", err)
+	}
+
+	// An errors threshold replaces the default check
+	th, _ := ParseThreshold("errors", "<=", "5")
+	l.Thresholds = []Threshold{th}
+	n = 0
+	if _, err := l.Run(process, nil); err != nil {
+		t.Errorf("Expected errors <= 5 to pass, got %v", err)
+	}
+}
+
+func TestLoadGen_Duration(t *testing.T) {
+	addr, _ := listen(t)
+
+	l := New(logging.NewLogger("test"), "l1")
+	l.ConnectAddr = addr
+	l.Clients = 2
+	l.Duration = 100 * time.Millisecond
+
+	if err := l.Start(func(conn net.Conn) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	r := l.Result()
+	if r.Elapsed < l.Duration || r.Requests == 0 {
+		t.Errorf("Expected a run of at least %s with requests, got %s", l.Duration, r)
+	}
+}
+
+func TestLoadGen_Stop(t *testing.T) {
+	addr, _ := listen(t)
+
+	l := New(logging.NewLogger("test"), "l1")
+	l.ConnectAddr = addr
+	l.Duration = time.Hour
+
+	if l.Stop() {
+		t.Error("Stop reported a run before Start")
+	}
+	if err := l.Start(func(conn net.Conn) error {
+		time.Sleep(time.Millisecond)
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan bool)
+	go func() { stopped <- l.Stop() }()
+	select {
+	case ok := <-stopped:
+		if !ok {
+			t.Error("Stop did not report the running run")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not end the run")
+	}
+	if l.Running {
+		t.Error("Still running after Stop")
+	}
+}
+
+func TestLoadGen_ConnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	l := New(logging.NewLogger("test"), "l1")
+	l.ConnectAddr = addr
+	l.Duration = 300 * time.Millisecond
+
+	r, err := l.Run(func(conn net.Conn) error { return nil }, nil)
+	if err == nil {
+		t.Error("Expected refused connections to fail the check")
+	}
+	// 10ms, 20ms, 40ms... between attempts, instead of a busy loop
+	if r.Errors == 0 || r.Errors > 10 {
+		t.Errorf("Expected a few connect attempts in %s, got %d", l.Duration, r.Errors)
+	}
+}
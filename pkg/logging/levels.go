@@ -0,0 +1,158 @@
+package logging
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AllComponents names the default level in SetLevels and SetLevel
+const AllComponents = "all"
+
+var levelNames = []string{"fatal", "error", "warning", "info", "debug"}
+
+// Component levels set with SetLevels, under globalMutex
+var globalLevels map[string]int
+
+// ParseLevel parses a level name (error, warning, info, debug) or number
+func ParseLevel(s string) (int, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= LevelFatal && n <= LevelDebug {
+		return n, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q (want error, warning, info or debug)", s)
+}
+
+// LevelName returns the name of a level
+func LevelName(level int) string {
+	if level < 0 || level >= len(levelNames) {
+		return strconv.Itoa(level)
+	}
+	return levelNames[level]
+}
+
+// ParseLevels parses a comma-separated list of component=level pairs,
+// such as "http2=debug,c1=warning". A bare level sets the default for
+// all components.
+func ParseLevels(spec string) (map[string]int, error) {
+	levels := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		component, name, ok := strings.Cut(item, "=")
+		if !ok {
+			component, name = AllComponents, item
+		}
+		if component == "" {
+			return nil, fmt.Errorf("missing component in %q", item)
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return nil, err
+		}
+		levels[component] = level
+	}
+	return levels, nil
+}
+
+// SetLevels sets the levels of all loggers from a ParseLevels list.
+// Levels set on a logger with SetLevel take precedence.
+func SetLevels(spec string) error {
+	levels, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	globalLevels = levels
+	return nil
+}
+
+// globalLevel returns the level SetLevels gave component
+func globalLevel(component string) (int, bool) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	level, ok := globalLevels[component]
+	return level, ok
+}
+
+// levelSet holds the levels set with SetLevel. It is shared by a logger
+// and its children, so one loglevel command covers the whole test.
+type levelSet struct {
+	mutex  sync.Mutex
+	levels map[string]int
+}
+
+func (s *levelSet) get(component string) (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	level, ok := s.levels[component]
+	return level, ok
+}
+
+// SetLevel sets the most verbose level shown for a component, or for all
+// of them, in l and the loggers that share its levels: its children and
+// its parent's
+func (l *Logger) SetLevel(component string, level int) {
+	l.levels.mutex.Lock()
+	defer l.levels.mutex.Unlock()
+	if l.levels.levels == nil {
+		l.levels.levels = make(map[string]int)
+	}
+	l.levels.levels[component] = level
+}
+
+// SetComponent names the kind of logger, such as http1 for the HTTP/1
+// sessions of a client, so that levels can be set for all of them as
+// well as by the logger's ID
+func (l *Logger) SetComponent(component string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.component = component
+}
+
+// Enabled reports whether a message at level would be logged. A level
+// set for the logger's ID, then for its component, wins over the default
+// for all of them; without any, debug messages are shown in verbose mode
+// only.
+func (l *Logger) Enabled(level int) bool {
+	if level <= LevelFatal {
+		return level == LevelFatal
+	}
+	return level <= l.maxLevel()
+}
+
+func (l *Logger) maxLevel() int {
+	l.mutex.Lock()
+	names := []string{l.id}
+	if l.component != "" && l.component != l.id {
+		names = append(names, l.component)
+	}
+	l.mutex.Unlock()
+
+	for _, name := range names {
+		if level, ok := l.levels.get(name); ok {
+			return level
+		}
+		if level, ok := globalLevel(name); ok {
+			return level
+		}
+	}
+	if level, ok := l.levels.get(AllComponents); ok {
+		return level
+	}
+	if level, ok := globalLevel(AllComponents); ok {
+		return level
+	}
+	if IsVerbose() {
+		return LevelDebug
+	}
+	return LevelInfo
+}
@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels("warning, http2=debug,c1=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{AllComponents: LevelWarning, "http2": LevelDebug, "c1": LevelInfo}
+	if len(levels) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, levels)
+	}
+	for component, level := range want {
+		if levels[component] != level {
+			t.Errorf("%s: expected %s, got %s", component, LevelName(level), LevelName(levels[component]))
+		}
+	}
+
+	for _, bad := range []string{"http2=loud", "=debug", "7"} {
+		if _, err := ParseLevels(bad); err == nil {
+			t.Errorf("ParseLevels(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	ResetOutput()
+	defer SetLevels("")
+	if err := SetLevels("http2=debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	test := NewLogger("test")
+	h1 := test.Child("http1")
+	h2 := test.Child("http2")
+
+	h1.Debug("h1 debug")
+	h2.Debug("h2 debug")
+	if out := GetOutput(); strings.Contains(out, "h1 debug") || !strings.Contains(out, "h2 debug") {
+		t.Errorf("Expected only the http2 debug message, got:\n%s", out)
+	}
+
+	// Levels set on a logger cover its children, and a component's own
+	// level wins over the default
+	test.SetLevel(AllComponents, LevelError)
+	h1.Info("h1 info")
+	h2.Debug("h2 still debug")
+	test.Fatal("always")
+	out := GetOutput()
+	if strings.Contains(out, "h1 info") || !strings.Contains(out, "h2 still debug") || !strings.Contains(out, "always") {
+		t.Errorf("Unexpected output after SetLevel:\n%s", out)
+	}
+
+	if NewLogger("other").Enabled(LevelDebug) {
+		t.Error("Expected SetLevel to leave unrelated loggers alone")
+	}
+
+	// A session logger is found by its component, and first by its ID
+	c1 := test.Child("c1")
+	c1.SetComponent("http2")
+	if !c1.Enabled(LevelDebug) {
+		t.Error("Expected the http2 level to apply to c1's session")
+	}
+	test.SetLevel("c1", LevelWarning)
+	if c1.Enabled(LevelInfo) {
+		t.Error("Expected c1's own level to win over its component's")
+	}
+}
@@ -38,6 +38,9 @@ var (
 
 	// Global verbosity setting
 	verboseMode bool
+
+	// Bytes of each message body shown, see SetBodyExcerpt
+	bodyExcerpt int
 )
 
 // Logger represents a logger instance with a unique ID
@@ -46,6 +49,46 @@ type Logger struct {
 	buf    bytes.Buffer
 	mutex  sync.Mutex
 	active bool
+	err    error // First fatal message, see Err
+
+	component string      // Kind of logger for levels, see SetComponent
+	onFatal   func(error) // Told of each fatal message, see OnFatal
+	levels    *levelSet   // Shared with children, see SetLevel
+	out       *Output     // Shared with children, see SetOutput
+}
+
+// Output collects the log of one test, apart from that of the tests
+// running at the same time, with its own dT timestamps
+type Output struct {
+	mutex         sync.Mutex
+	buf           bytes.Buffer
+	start         time.Time
+	lastTimestamp int
+}
+
+// NewOutput returns an empty output whose timestamps start now
+func NewOutput() *Output {
+	return &Output{start: time.Now(), lastTimestamp: -1}
+}
+
+// String returns what was logged to o
+func (o *Output) String() string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.buf.String()
+}
+
+// write appends a message to o, after its timestamp if that changed
+func (o *Output) write(msg []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	ts := int(time.Since(o.start).Milliseconds())
+	if ts != o.lastTimestamp {
+		fmt.Fprintf(&o.buf, "**** dT    %d.%03d\n", ts/1000, ts%1000)
+		o.lastTimestamp = ts
+	}
+	o.buf.Write(msg)
+	o.buf.WriteByte('\n')
 }
 
 // SetVerbose sets the global verbose mode
@@ -62,6 +105,21 @@ func IsVerbose() bool {
 	return verboseMode
 }
 
+// SetBodyExcerpt sets how many bytes of each message body are logged
+// at info level (0 = none)
+func SetBodyExcerpt(n int) {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	bodyExcerpt = n
+}
+
+// BodyExcerpt returns how many bytes of each message body are logged
+func BodyExcerpt() int {
+	globalMutex.Lock()
+	defer globalMutex.Unlock()
+	return bodyExcerpt
+}
+
 // NewLogger creates a new logger with the given ID
 func NewLogger(id string) *Logger {
 	if !globalStarted {
@@ -74,10 +132,39 @@ func NewLogger(id string) *Logger {
 	}
 
 	return &Logger{
-		id: id,
+		id:     id,
+		levels: &levelSet{},
 	}
 }
 
+// Child returns a new logger with the given ID whose fatal messages go to
+// the same OnFatal handler as l's, and which shares l's levels and output
+func (l *Logger) Child(id string) *Logger {
+	c := NewLogger(id)
+	l.mutex.Lock()
+	c.onFatal = l.onFatal
+	c.out = l.out
+	l.mutex.Unlock()
+	c.levels = l.levels
+	return c
+}
+
+// SetOutput sends what l and the children made after this logs to out
+// instead of the global output
+func (l *Logger) SetOutput(out *Output) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.out = out
+}
+
+// OnFatal sets the handler told of each fatal message, such as the test
+// that owns the logger, which then fails and unwinds
+func (l *Logger) OnFatal(fn func(error)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onFatal = fn
+}
+
 // getTimestamp returns the current timestamp in milliseconds since start
 func getTimestamp() int {
 	if !globalStarted {
@@ -87,11 +174,15 @@ func getTimestamp() int {
 	return int(elapsed.Milliseconds())
 }
 
-// emit outputs the logger's buffer to the global buffer
+// emit outputs the logger's buffer to its output, or the global buffer
 func (l *Logger) emit() {
 	if l.buf.Len() == 0 {
 		return
 	}
+	if l.out != nil {
+		l.out.write(l.buf.Bytes())
+		return
+	}
 
 	globalMutex.Lock()
 	defer globalMutex.Unlock()
@@ -116,22 +207,35 @@ func (l *Logger) leadin(level int) {
 	fmt.Fprintf(&l.buf, "%s %-5s ", lead[level], l.id)
 }
 
-// Fatal logs a fatal message and should cause test failure
+// Fatal logs a fatal message. It doesn't panic, which would take the
+// whole process down from any goroutine: the first fatal message is kept
+// for Err, the OnFatal handler is told, and the caller returns an error
+// as usual.
 func (l *Logger) Fatal(format string, args ...interface{}) {
-	l.mutex.Lock()
-	l.buf.Reset()
-	l.active = true
-
-	l.leadin(LevelFatal)
-	fmt.Fprintf(&l.buf, format, args...)
+	l.Log(LevelFatal, format, args...)
+}
 
-	l.active = false
-	l.emit()
-	l.buf.Reset()
+// fatal records a fatal message and reports it to the OnFatal handler,
+// which may log through l: the mutex must not be held
+func (l *Logger) fatal(msg string) {
+	err := fmt.Errorf("FATAL: %s", msg)
+	l.mutex.Lock()
+	if l.err == nil {
+		l.err = err
+	}
+	handler := l.onFatal
 	l.mutex.Unlock()
 
-	// In a real implementation, this would trigger test failure
-	panic(fmt.Sprintf("FATAL: "+format, args...))
+	if handler != nil {
+		handler(err)
+	}
+}
+
+// Err returns the first message logged at LevelFatal, or nil
+func (l *Logger) Err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
 }
 
 // Log logs a message at the specified level
@@ -140,14 +244,12 @@ func (l *Logger) Log(level int, format string, args ...interface{}) {
 		return
 	}
 
-	// Filter debug messages when not in verbose mode
-	if level == LevelDebug && !IsVerbose() {
+	// Filter by the component's level; fatal messages always get through
+	if !l.Enabled(level) {
 		return
 	}
 
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
-
 	l.buf.Reset()
 	l.active = true
 
@@ -157,23 +259,21 @@ func (l *Logger) Log(level int, format string, args ...interface{}) {
 	l.active = false
 	l.emit()
 	l.buf.Reset()
+	l.mutex.Unlock()
 
 	if level == LevelFatal {
-		panic(fmt.Sprintf("FATAL: "+format, args...))
+		l.fatal(fmt.Sprintf(format, args...))
 	}
 }
 
 // Dump dumps a string with optional prefix
 // If len is negative, the entire string is dumped
 func (l *Logger) Dump(level int, prefix string, data string, length int) {
-	// Filter debug messages when not in verbose mode
-	if level == LevelDebug && !IsVerbose() {
+	if !l.Enabled(level) {
 		return
 	}
 
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
-
 	l.buf.Reset()
 	l.active = true
 
@@ -209,22 +309,20 @@ func (l *Logger) Dump(level int, prefix string, data string, length int) {
 	l.active = false
 	l.emit()
 	l.buf.Reset()
+	l.mutex.Unlock()
 
 	if level == LevelFatal {
-		panic("FATAL: dump failed")
+		l.fatal(prefix + "dump failed")
 	}
 }
 
 // Hexdump dumps binary data as hexadecimal
 func (l *Logger) Hexdump(level int, prefix string, data []byte) {
-	// Filter debug messages when not in verbose mode
-	if level == LevelDebug && !IsVerbose() {
+	if !l.Enabled(level) {
 		return
 	}
 
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
-
 	l.buf.Reset()
 	l.active = true
 
@@ -256,9 +354,10 @@ func (l *Logger) Hexdump(level int, prefix string, data []byte) {
 	l.active = false
 	l.emit()
 	l.buf.Reset()
+	l.mutex.Unlock()
 
 	if level == LevelFatal {
-		panic("FATAL: hexdump failed")
+		l.fatal(prefix + "hexdump failed")
 	}
 }
 
@@ -124,3 +124,60 @@ func TestConcurrentLogging(t *testing.T) {
 		t.Error("Expected output from concurrent logging")
 	}
 }
+
+func TestFatal(t *testing.T) {
+	ResetOutput()
+	l := NewLogger("fatal")
+	if l.Err() != nil {
+		t.Fatal("Expected no error before a fatal message")
+	}
+
+	l.Fatal("first %d", 1)
+	l.Log(LevelFatal, "second")
+
+	if err := l.Err(); err == nil || err.Error() != "FATAL: first 1" {
+		t.Errorf("Expected the first fatal message, got %v", err)
+	}
+	if !strings.Contains(GetOutput(), "second") {
+		t.Error("Expected every fatal message to be logged")
+	}
+}
+
+func TestOnFatal(t *testing.T) {
+	l := NewLogger("test")
+	var got []error
+	l.OnFatal(func(err error) {
+		got = append(got, err)
+		l.Info("handler may log: %v", err) // Must not deadlock
+	})
+
+	l.Child("c1").Fatal("from child")
+	l.Fatal("from parent")
+
+	if len(got) != 2 || got[0].Error() != "FATAL: from child" {
+		t.Errorf("Expected both fatal messages to reach the handler, got %v", got)
+	}
+	if err := l.Err(); err == nil || err.Error() != "FATAL: from parent" {
+		t.Errorf("Expected the child's fatal message to stay out of Err, got %v", err)
+	}
+}
+
+func TestOutput(t *testing.T) {
+	ResetOutput()
+	a, b := NewOutput(), NewOutput()
+	la, lb := NewLogger("a"), NewLogger("b")
+	la.SetOutput(a)
+	lb.SetOutput(b)
+	la.Child("a1").Info("from a")
+	lb.Info("from b")
+
+	if got := a.String(); !strings.Contains(got, "from a") || strings.Contains(got, "from b") || !strings.HasPrefix(got, "**** dT    0.") {
+		t.Errorf("Output a = %q", got)
+	}
+	if got := b.String(); !strings.Contains(got, "from b") || strings.Contains(got, "from a") {
+		t.Errorf("Output b = %q", got)
+	}
+	if got := GetOutput(); got != "" {
+		t.Errorf("Expected nothing in the global output, got %q", got)
+	}
+}
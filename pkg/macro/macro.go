@@ -9,16 +9,23 @@ import (
 	"github.com/perbu/GTest/pkg/logging"
 )
 
-// Store manages macro definitions and expansion
+// Store manages macro definitions and expansion. It is shared by a test
+// and is safe for concurrent use by client and server goroutines
 type Store struct {
-	macros map[string]string
-	mutex  sync.RWMutex
+	macros        map[string]string
+	owners        map[string]string // Macro name to the namespace that defined it
+	mutex         sync.RWMutex
+	ignoreUnknown bool // Leave undefined macros unexpanded
+
+	// dynamic resolves names that are not defined, at expansion time
+	dynamic func(name string) (string, bool)
 }
 
 // New creates a new macro store
 func New() *Store {
 	return &Store{
 		macros: make(map[string]string),
+		owners: make(map[string]string),
 	}
 }
 
@@ -27,6 +34,42 @@ func (ms *Store) Define(name, value string) {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	ms.macros[name] = value
+	delete(ms.owners, name)
+}
+
+// DefineIn defines ${ns_name} as a macro owned by the object ns, such as
+// a server defining ${s1_addr}. DeleteNamespace removes them together.
+func (ms *Store) DefineIn(ns, name, value string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	full := ns + "_" + name
+	ms.macros[full] = value
+	ms.owners[full] = ns
+}
+
+// Namespace returns the macros owned by ns, keyed by their short name
+func (ms *Store) Namespace(ns string) map[string]string {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	result := make(map[string]string)
+	for full, owner := range ms.owners {
+		if owner == ns {
+			result[strings.TrimPrefix(full, ns+"_")] = ms.macros[full]
+		}
+	}
+	return result
+}
+
+// DeleteNamespace removes all macros owned by ns
+func (ms *Store) DeleteNamespace(ns string) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for full, owner := range ms.owners {
+		if owner == ns {
+			delete(ms.macros, full)
+			delete(ms.owners, full)
+		}
+	}
 }
 
 // Definef defines a macro with a formatted value
@@ -34,6 +77,24 @@ func (ms *Store) Definef(name, format string, args ...interface{}) {
 	ms.Define(name, fmt.Sprintf(format, args...))
 }
 
+// SetIgnoreUnknown makes Expand leave undefined macros in the text as-is
+// instead of failing (the "feature ignore_unknown_macro" behavior)
+func (ms *Store) SetIgnoreUnknown(ignore bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.ignoreUnknown = ignore
+}
+
+// SetDynamic installs a function that resolves names with no definition
+// when they are expanded, e.g. ${var.NAME} for test variables. Unlike
+// defined macros, dynamic values are looked up anew by every expansion,
+// including expansions of a Snapshot.
+func (ms *Store) SetDynamic(fn func(name string) (string, bool)) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.dynamic = fn
+}
+
 // Get retrieves a macro value
 func (ms *Store) Get(name string) (string, bool) {
 	ms.mutex.RLock()
@@ -47,6 +108,7 @@ func (ms *Store) Delete(name string) {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	delete(ms.macros, name)
+	delete(ms.owners, name)
 }
 
 // All returns all macro definitions
@@ -60,7 +122,8 @@ func (ms *Store) All() map[string]string {
 	return result
 }
 
-// Expand expands all ${name} macros in the text
+// Expand expands all ${name} macros in the text. "$${" is an escape that
+// produces a literal "${" without expanding what follows.
 func (ms *Store) Expand(logger *logging.Logger, text string) (string, error) {
 	var result strings.Builder
 	result.Grow(len(text))
@@ -74,6 +137,14 @@ func (ms *Store) Expand(logger *logging.Logger, text string) (string, error) {
 			break
 		}
 
+		// "$${" is a literal "${"
+		if start > 0 && text[start-1] == '$' {
+			result.WriteString(text[:start-1])
+			result.WriteString("${")
+			text = text[start+2:]
+			continue
+		}
+
 		// Append text before the macro
 		result.WriteString(text[:start])
 
@@ -94,6 +165,9 @@ func (ms *Store) Expand(logger *logging.Logger, text string) (string, error) {
 		if !ok {
 			// Try dynamic macro expansion (e.g., functions)
 			value, ok = ms.expandDynamic(logger, macroName)
+			if !ok && ms.ignoresUnknown() {
+				value, ok = text[start:end+1], true
+			}
 			if !ok {
 				if logger != nil {
 					logger.Error("Macro ${%s} not found", macroName)
@@ -112,14 +186,22 @@ func (ms *Store) Expand(logger *logging.Logger, text string) (string, error) {
 	return result.String(), nil
 }
 
-// expandDynamic handles dynamic macro expansion (functions, etc.)
+// ignoresUnknown reports whether SetIgnoreUnknown is in effect
+func (ms *Store) ignoresUnknown() bool {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	return ms.ignoreUnknown
+}
+
+// expandDynamic handles dynamic macro expansion through SetDynamic
 func (ms *Store) expandDynamic(logger *logging.Logger, name string) (string, bool) {
-	// For now, we don't support dynamic macros
-	// In the future, this could handle things like:
-	// - ${rand} for random numbers
-	// - ${date} for current date
-	// - Function calls with arguments
-	return "", false
+	ms.mutex.RLock()
+	fn := ms.dynamic
+	ms.mutex.RUnlock()
+	if fn == nil {
+		return "", false
+	}
+	return fn(name)
 }
 
 // Clone creates a copy of the macro store
@@ -128,14 +210,29 @@ func (ms *Store) Clone() *Store {
 	defer ms.mutex.RUnlock()
 
 	clone := New()
+	clone.ignoreUnknown = ms.ignoreUnknown
+	clone.dynamic = ms.dynamic
 	for k, v := range ms.macros {
 		clone.macros[k] = v
 	}
+	for k, v := range ms.owners {
+		clone.owners[k] = v
+	}
 	return clone
 }
 
+// Snapshot returns a copy of the store as it is now, for a spec to expand
+// macros against while it runs. Later changes to the store, such as a
+// server restarting on a new port, do not show up in the snapshot.
+func (ms *Store) Snapshot() *Store {
+	return ms.Clone()
+}
+
 // Merge merges another macro store into this one
 func (ms *Store) Merge(other *Store) {
+	if ms == other {
+		return
+	}
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 
@@ -145,6 +242,9 @@ func (ms *Store) Merge(other *Store) {
 	for k, v := range other.macros {
 		ms.macros[k] = v
 	}
+	for k, v := range other.owners {
+		ms.owners[k] = v
+	}
 }
 
 // MustExpand expands macros and panics on error
@@ -177,6 +277,7 @@ func (ms *Store) Clear() {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 	ms.macros = make(map[string]string)
+	ms.owners = make(map[string]string)
 }
 
 // Exists checks if a macro is defined
@@ -0,0 +1,184 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DefaultAttemptDelay is the RFC 8305 "Connection Attempt Delay"
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// DialPolicy controls connecting to a host name with several addresses
+type DialPolicy struct {
+	Race         bool          // Race attempts Happy Eyeballs style (RFC 8305)
+	Prefer       string        // "v4" or "v6": family tried first ("" = v6 when racing)
+	AttemptDelay time.Duration // Delay between racing attempts (0 = DefaultAttemptDelay)
+}
+
+// IsZero reports whether the policy leaves connecting to the Go dialer
+func (p DialPolicy) IsZero() bool {
+	return !p.Race && p.Prefer == ""
+}
+
+// lookupIPAddr resolves host names; tests replace it
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// TCPConnectPolicy connects to addr following policy. Without Race the
+// addresses are tried one at a time in preference order, which makes the
+// chosen address deterministic.
+func TCPConnectPolicy(addr, localAddr string, policy DialPolicy, timeout time.Duration) (net.Conn, error) {
+	if policy.IsZero() {
+		return TCPConnectFrom(addr, localAddr, timeout)
+	}
+	if policy.Prefer != "" && policy.Prefer != "v4" && policy.Prefer != "v6" {
+		return nil, fmt.Errorf("invalid address family preference %q (want v4 or v6)", policy.Prefer)
+	}
+
+	host, port, isUnix, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if isUnix {
+		return UnixConnect(host, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ips, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving %s: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("resolving %s: no addresses", host)
+	}
+
+	dialer := &net.Dialer{}
+	if localAddr != "" {
+		local, err := resolveLocalAddr(localAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = local
+	}
+
+	targets := make([]string, 0, len(ips))
+	for _, ip := range orderAddrs(ips, policy) {
+		targets = append(targets, net.JoinHostPort(ipString(ip.IP, ip.Zone), port))
+	}
+
+	if !policy.Race {
+		var lastErr error
+		for _, target := range targets {
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			if err == nil {
+				return conn, nil
+			}
+			lastErr = err
+		}
+		return nil, fmt.Errorf("TCP connect to %s failed: %w", addr, lastErr)
+	}
+
+	delay := policy.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+	return raceConnect(ctx, dialer, targets, delay)
+}
+
+// orderAddrs sorts addresses by family preference. When racing, the
+// families are interleaved as RFC 8305 section 4 recommends; otherwise all
+// addresses of the preferred family come first.
+func orderAddrs(ips []net.IPAddr, policy DialPolicy) []net.IPAddr {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v6, v4
+	if policy.Prefer == "v4" {
+		first, second = v4, v6
+	}
+
+	if !policy.Race {
+		return append(first, second...)
+	}
+
+	ordered := make([]net.IPAddr, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
+
+// raceConnect starts an attempt every delay, or as soon as the previous
+// one fails, and returns the first connection established
+func raceConnect(ctx context.Context, dialer *net.Dialer, targets []string, delay time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(targets))
+	started, failed := 0, 0
+	startNext := func() {
+		target := targets[started]
+		started++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			results <- result{conn, err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			if r.err == nil {
+				// Close the losers once their attempts finish
+				pending := started - failed - 1
+				go func() {
+					for i := 0; i < pending; i++ {
+						if l := <-results; l.conn != nil {
+							l.conn.Close()
+						}
+					}
+				}()
+				return r.conn, nil
+			}
+			failed++
+			lastErr = r.err
+			if started < len(targets) {
+				startNext()
+				timer.Reset(delay)
+			} else if failed == started {
+				return nil, fmt.Errorf("all %d connection attempts failed: %w", started, lastErr)
+			}
+		case <-timer.C:
+			if started < len(targets) {
+				startNext()
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connection attempts timed out: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package net
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspCertID is the CertID of an OCSP single response (RFC 6960), which
+// x/crypto/ocsp does not return: only its serial number
+type ocspCertID struct {
+	HashAlgorithm asn1.RawValue
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+// OCSPStatus returns the status a stapled OCSP response gives cert:
+// "good", "revoked" or "unknown"
+func OCSPStatus(staple []byte, cert *x509.Certificate) (string, error) {
+	resp, err := parseOCSP(staple, cert)
+	if err != nil {
+		return "", err
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return "good", nil
+	case ocsp.Revoked:
+		return "revoked", nil
+	default:
+		return "unknown", nil
+	}
+}
+
+// VerifyOCSP checks that a stapled OCSP response is for cert as issued
+// by issuer, is current, and is signed by issuer or by a responder
+// issuer delegated OCSP signing to in the response
+func VerifyOCSP(staple []byte, cert, issuer *x509.Certificate) error {
+	resp, err := parseOCSP(staple, cert)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if resp.ThisUpdate.After(now) {
+		return fmt.Errorf("OCSP response is not valid before %s", resp.ThisUpdate.Format(time.RFC3339))
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+		return fmt.Errorf("OCSP response expired at %s", resp.NextUpdate.Format(time.RFC3339))
+	}
+
+	// parseOCSP checked the signature against the responder certificate
+	// in the response, if there is one
+	if resp.Certificate == nil || resp.Certificate.Equal(issuer) {
+		if err := resp.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("OCSP response signature: %w", err)
+		}
+	} else {
+		responder := resp.Certificate
+		if err := responder.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("OCSP responder %q is not issued by %q", responder.Subject.CommonName, issuer.Subject.CommonName)
+		}
+		if !hasExtKeyUsage(responder, x509.ExtKeyUsageOCSPSigning) {
+			return fmt.Errorf("OCSP responder %q is not delegated OCSP signing", responder.Subject.CommonName)
+		}
+	}
+
+	return checkOCSPIssuer(resp, cert, issuer)
+}
+
+// parseOCSP parses a successful OCSP response and finds its answer for
+// cert by serial number. A responder certificate in the response must
+// have signed it.
+func parseOCSP(staple []byte, cert *x509.Certificate) (*ocsp.Response, error) {
+	resp, err := ocsp.ParseResponseForCert(staple, cert, nil)
+	var status ocsp.ResponseError
+	switch {
+	case err == nil:
+		return resp, nil
+	case errors.As(err, &status):
+		return nil, fmt.Errorf("OCSP response status %d", status.Status)
+	case err == ocsp.ParseError("no response matching the supplied certificate"):
+		return nil, fmt.Errorf("OCSP response is not for serial %s", cert.SerialNumber)
+	default:
+		return nil, fmt.Errorf("malformed OCSP response: %w", err)
+	}
+}
+
+// checkOCSPIssuer checks that the answer resp gives for cert names
+// issuer by the hashes of its name and key, so that it is not for a
+// certificate of another CA with the same serial number
+func checkOCSPIssuer(resp *ocsp.Response, cert, issuer *x509.Certificate) error {
+	der, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: resp.IssuerHash})
+	if err != nil {
+		return fmt.Errorf("OCSP issuer hash: %w", err)
+	}
+	want, err := ocsp.ParseRequest(der)
+	if err != nil {
+		return fmt.Errorf("OCSP issuer hash: %w", err)
+	}
+
+	// The single responses are the fourth element of the response data,
+	// after the optional version
+	var data struct {
+		Version     int `asn1:"optional,explicit,default:0,tag:0"`
+		ResponderID asn1.RawValue
+		ProducedAt  asn1.RawValue
+		Responses   []asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(resp.TBSResponseData, &data); err != nil {
+		return fmt.Errorf("malformed OCSP response: %w", err)
+	}
+	for _, single := range data.Responses {
+		var id ocspCertID
+		if _, err := asn1.Unmarshal(single.Bytes, &id); err != nil {
+			return fmt.Errorf("malformed OCSP response: %w", err)
+		}
+		if id.SerialNumber == nil || id.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			continue
+		}
+		if bytes.Equal(id.NameHash, want.IssuerNameHash) && bytes.Equal(id.KeyHash, want.IssuerKeyHash) {
+			return nil
+		}
+	}
+	return fmt.Errorf("OCSP response for serial %s is not for a certificate issued by %q", cert.SerialNumber, issuer.Subject.CommonName)
+}
+
+// hasExtKeyUsage reports whether cert allows usage
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package net
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testCert makes a certificate for name signed by parent, or self-signed
+// if parent is nil
+func testCert(t *testing.T, name string, serial int64, parent *x509.Certificate, parentKey crypto.Signer, ca bool, usage ...x509.ExtKeyUsage) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           usage,
+	}
+	if ca {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyOCSP(t *testing.T) {
+	ca, caKey := testCert(t, "CA", 1, nil, nil, true)
+	leaf, _ := testCert(t, "leaf", 2, ca, caKey, false)
+	responder, responderKey := testCert(t, "responder", 3, ca, caKey, false, x509.ExtKeyUsageOCSPSigning)
+	plain, plainKey := testCert(t, "plain", 4, ca, caKey, false, x509.ExtKeyUsageServerAuth)
+	// Another CA of the same name, whose certificates can have the
+	// same serial numbers
+	other, _ := testCert(t, "CA", 1, nil, nil, true)
+
+	response := func(issuer, signer *x509.Certificate, key crypto.Signer) []byte {
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: leaf.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if signer != issuer {
+			template.Certificate = signer
+		}
+		der, err := ocsp.CreateResponse(issuer, signer, template, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+
+	tests := []struct {
+		name   string
+		staple []byte
+		want   string
+	}{
+		{"issuer", response(ca, ca, caKey), ""},
+		{"delegated", response(ca, responder, responderKey), ""},
+		{"not delegated", response(ca, plain, plainKey), `OCSP responder "plain" is not delegated OCSP signing`},
+		{"other issuer", response(other, ca, caKey), `OCSP response for serial 2 is not for a certificate issued by "CA"`},
+	}
+	for _, tt := range tests {
+		got := ""
+		if err := VerifyOCSP(tt.staple, leaf, ca); err != nil {
+			got = err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("%s: VerifyOCSP() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
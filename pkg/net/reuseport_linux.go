@@ -0,0 +1,6 @@
+package net
+
+import "golang.org/x/sys/unix"
+
+// soReusePort is SO_REUSEPORT, which the syscall package leaves out on Linux
+const soReusePort = unix.SO_REUSEPORT
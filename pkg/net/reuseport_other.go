@@ -0,0 +1,6 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package net
+
+// soReusePort is 0 where SO_REUSEPORT is not known
+const soReusePort = 0
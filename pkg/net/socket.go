@@ -4,8 +4,10 @@
 package net
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"syscall"
@@ -19,24 +21,81 @@ const (
 	PortBufferSize = 16
 )
 
-// AddrInfo contains address and port information
+// AddrInfo contains address and port information. Addr is a host name,
+// an IP address without brackets (an IPv6 one with its zone, as in
+// "fe80::1%eth0") or a Unix socket path.
 type AddrInfo struct {
 	Addr string
 	Port string
 }
 
-// IsUnixSocket checks if the given path is a Unix socket path
+// String returns the address in a form ParseAddress accepts:
+// "host:port", "[v6]:port" or the socket path
+func (a *AddrInfo) String() string {
+	if a.Port == "" {
+		return a.Addr
+	}
+	return net.JoinHostPort(a.Addr, a.Port)
+}
+
+// BracketHost puts brackets around an IPv6 literal, so that a port can
+// be appended to it. Other hosts are returned as they are.
+func BracketHost(host string) string {
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// tcpAddrInfo returns the address of a TCP endpoint, keeping the zone of
+// a link-local IPv6 address
+func tcpAddrInfo(addr *net.TCPAddr) *AddrInfo {
+	return &AddrInfo{
+		Addr: ipString(addr.IP, addr.Zone),
+		Port: strconv.Itoa(addr.Port),
+	}
+}
+
+// ipString formats an IP address with its zone, if any
+func ipString(ip net.IP, zone string) string {
+	if zone == "" {
+		return ip.String()
+	}
+	return ip.String() + "%" + zone
+}
+
+// IsUnixSocket checks if the given path is a Unix socket path: an
+// absolute path, a Windows one with a drive letter such as C:\tmp\s.sock,
+// or an abstract socket
 func IsUnixSocket(path string) bool {
-	return strings.HasPrefix(path, "/") || strings.HasPrefix(path, "@")
+	return strings.HasPrefix(path, "/") || strings.HasPrefix(path, "@") || hasDriveLetter(path)
+}
+
+// hasDriveLetter reports whether path starts with a drive, as in C:\ or
+// C:/, which no host:port does
+func hasDriveLetter(path string) bool {
+	if len(path) < 3 || path[1] != ':' || (path[2] != '\\' && path[2] != '/') {
+		return false
+	}
+	c := path[0] | 0x20
+	return c >= 'a' && c <= 'z'
 }
 
 // ParseAddress parses an address string into host and port components.
-// Supports formats: "host:port", "/path/to/socket", "@abstract-socket"
+// Supports formats: "host:port", "[v6]:port", "[fe80::1%eth0]:port", a
+// bare IPv6 literal, "host port" (as VTest2 writes sockets),
+// "/path/to/socket", "C:\path\to\socket" and "@abstract-socket". IPv6
+// hosts are returned without brackets, with their zone.
 func ParseAddress(addr string) (host, port string, isUnix bool, err error) {
 	if IsUnixSocket(addr) {
 		return addr, "", true, nil
 	}
 
+	if h, p, ok := strings.Cut(addr, " "); ok {
+		host = strings.TrimSuffix(strings.TrimPrefix(h, "["), "]")
+		return host, strings.TrimSpace(p), false, nil
+	}
+
 	// Check for IPv6 addresses [host]:port
 	if strings.HasPrefix(addr, "[") {
 		endBracket := strings.Index(addr, "]")
@@ -44,12 +103,24 @@ func ParseAddress(addr string) (host, port string, isUnix bool, err error) {
 			return "", "", false, fmt.Errorf("invalid IPv6 address format: %s", addr)
 		}
 		host = addr[1:endBracket]
-		if len(addr) > endBracket+1 && addr[endBracket+1] == ':' {
-			port = addr[endBracket+2:]
+		rest := addr[endBracket+1:]
+		switch {
+		case rest == "":
+		case rest[0] == ':':
+			port = rest[1:]
+		default:
+			return "", "", false, fmt.Errorf("invalid IPv6 address format: %s", addr)
 		}
 		return host, port, false, nil
 	}
 
+	// An IPv6 literal has no port unless it is in brackets
+	if strings.Count(addr, ":") > 1 {
+		if _, err := netip.ParseAddr(addr); err == nil {
+			return addr, "", false, nil
+		}
+	}
+
 	// Regular host:port format
 	lastColon := strings.LastIndex(addr, ":")
 	if lastColon == -1 {
@@ -64,6 +135,13 @@ func ParseAddress(addr string) (host, port string, isUnix bool, err error) {
 
 // TCPConnect establishes a TCP connection to the given address with timeout
 func TCPConnect(addr string, timeout time.Duration) (net.Conn, error) {
+	return TCPConnectFrom(addr, "", timeout)
+}
+
+// TCPConnectFrom is TCPConnect with the local end bound to localAddr
+// ("host", "host:port", ":port" or "[v6]:port"). An empty localAddr lets
+// the kernel choose.
+func TCPConnectFrom(addr, localAddr string, timeout time.Duration) (net.Conn, error) {
 	host, port, isUnix, err := ParseAddress(addr)
 	if err != nil {
 		return nil, err
@@ -84,6 +162,13 @@ func TCPConnect(addr string, timeout time.Duration) (net.Conn, error) {
 	dialer := &net.Dialer{
 		Timeout: timeout,
 	}
+	if localAddr != "" {
+		local, err := resolveLocalAddr(localAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = local
+	}
 
 	conn, err := dialer.Dial("tcp", netAddr)
 	if err != nil {
@@ -93,6 +178,61 @@ func TCPConnect(addr string, timeout time.Duration) (net.Conn, error) {
 	return conn, nil
 }
 
+// resolveLocalAddr resolves a bind address for an outgoing connection
+func resolveLocalAddr(localAddr string) (*net.TCPAddr, error) {
+	host, port, isUnix, err := ParseAddress(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	if isUnix {
+		return nil, fmt.Errorf("cannot bind TCP connection to %s", localAddr)
+	}
+	if port == "" {
+		port = "0"
+	}
+
+	local, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address %s: %w", localAddr, err)
+	}
+	return local, nil
+}
+
+// InterfaceAddr returns the first IPv4 address of a network interface,
+// or its first IPv6 address if it has no IPv4 one. A link-local IPv6
+// address comes with the interface as its zone.
+func InterfaceAddr(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("interface %s: %w", name, err)
+	}
+
+	var v6 string
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if v6 == "" {
+			v6 = ipNet.IP.String()
+			if ipNet.IP.IsLinkLocalUnicast() {
+				v6 += "%" + iface.Name
+			}
+		}
+	}
+	if v6 == "" {
+		return "", fmt.Errorf("interface %s has no IP address", name)
+	}
+	return v6, nil
+}
+
 // UnixConnect establishes a Unix domain socket connection with timeout
 func UnixConnect(path string, timeout time.Duration) (net.Conn, error) {
 	network := "unix"
@@ -115,15 +255,28 @@ func UnixConnect(path string, timeout time.Duration) (net.Conn, error) {
 	return conn, nil
 }
 
-// TCPListen creates a TCP listening socket on the given address
+// ListenOptions controls the sockets created by TCPListenOpts
+type ListenOptions struct {
+	Backlog   int  // Length of the accept queue (0 = system default)
+	ReusePort bool // Set SO_REUSEPORT, so that other sockets can listen on the same port
+}
+
+// TCPListen creates a TCP listening socket on the given address, with the
+// given backlog (0 = system default)
 func TCPListen(addr string, backlog int) (net.Listener, *AddrInfo, error) {
+	return TCPListenOpts(addr, ListenOptions{Backlog: backlog})
+}
+
+// TCPListenOpts creates a TCP listening socket on the given address. Like
+// all Go listeners on Unix, it has SO_REUSEADDR set.
+func TCPListenOpts(addr string, opts ListenOptions) (net.Listener, *AddrInfo, error) {
 	host, port, isUnix, err := ParseAddress(addr)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	if isUnix {
-		return UnixListen(host, backlog)
+		return UnixListen(host, opts.Backlog)
 	}
 
 	// If no port specified, use random port
@@ -131,23 +284,74 @@ func TCPListen(addr string, backlog int) (net.Listener, *AddrInfo, error) {
 		port = "0"
 	}
 
+	lc := net.ListenConfig{}
+	if opts.ReusePort {
+		if soReusePort == 0 {
+			return nil, nil, fmt.Errorf("SO_REUSEPORT is not supported on this platform")
+		}
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var setErr error
+			err := c.Control(func(fd uintptr) {
+				setErr = setsockoptInt(fd, syscall.SOL_SOCKET, soReusePort, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return setErr
+		}
+	}
+
 	listenAddr := net.JoinHostPort(host, port)
-	listener, err := net.Listen("tcp", listenAddr)
+	listener, err := lc.Listen(context.Background(), "tcp", listenAddr)
 	if err != nil {
 		return nil, nil, fmt.Errorf("TCP listen on %s failed: %w", listenAddr, err)
 	}
+	if err := setBacklog(listener, opts.Backlog); err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("TCP listen on %s failed: %w", listenAddr, err)
+	}
 
-	// Get the actual address
-	tcpAddr := listener.Addr().(*net.TCPAddr)
-	addrInfo := &AddrInfo{
-		Addr: tcpAddr.IP.String(),
-		Port: strconv.Itoa(tcpAddr.Port),
+	// Get the actual address. Go may leave out the zone of a link-local
+	// address, which is needed to connect to it.
+	addrInfo := tcpAddrInfo(listener.Addr().(*net.TCPAddr))
+	if _, zone, ok := strings.Cut(host, "%"); ok && !strings.Contains(addrInfo.Addr, "%") {
+		addrInfo.Addr += "%" + zone
 	}
 
 	return listener, addrInfo, nil
 }
 
-// UnixListen creates a Unix domain socket listening on the given path
+// setBacklog sets the length of a listener's accept queue. Go listens
+// with the system maximum; calling listen(2) again on the socket lowers
+// it.
+func setBacklog(listener net.Listener, backlog int) error {
+	if backlog <= 0 {
+		return nil
+	}
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	err = rawConn.Control(func(fd uintptr) {
+		listenErr = listenFD(fd, backlog)
+	})
+	if err != nil {
+		return err
+	}
+	if listenErr != nil {
+		return fmt.Errorf("backlog %d: %w", backlog, listenErr)
+	}
+	return nil
+}
+
+// UnixListen creates a Unix domain socket listening on the given path,
+// with the given backlog (0 = system default)
 func UnixListen(path string, backlog int) (net.Listener, *AddrInfo, error) {
 	network := "unix"
 	addr := path
@@ -161,6 +365,10 @@ func UnixListen(path string, backlog int) (net.Listener, *AddrInfo, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("Unix listen on %s failed: %w", path, err)
 	}
+	if err := setBacklog(listener, backlog); err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("Unix listen on %s failed: %w", path, err)
+	}
 
 	addrInfo := &AddrInfo{
 		Addr: path,
@@ -172,7 +380,7 @@ func UnixListen(path string, backlog int) (net.Listener, *AddrInfo, error) {
 
 // SetReceiveBuffer sets the receive buffer size for a connection
 func SetReceiveBuffer(conn net.Conn, size int) error {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
+	if tcpConn, ok := RawConn(conn).(*net.TCPConn); ok {
 		rawConn, err := tcpConn.SyscallConn()
 		if err != nil {
 			return err
@@ -180,7 +388,7 @@ func SetReceiveBuffer(conn net.Conn, size int) error {
 
 		var setErr error
 		err = rawConn.Control(func(fd uintptr) {
-			setErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
+			setErr = setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, size)
 		})
 		if err != nil {
 			return err
@@ -193,7 +401,7 @@ func SetReceiveBuffer(conn net.Conn, size int) error {
 
 // SetBlocking sets the blocking mode for a connection
 func SetBlocking(conn net.Conn, blocking bool) error {
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
+	if tcpConn, ok := RawConn(conn).(*net.TCPConn); ok {
 		rawConn, err := tcpConn.SyscallConn()
 		if err != nil {
 			return err
@@ -201,7 +409,7 @@ func SetBlocking(conn net.Conn, blocking bool) error {
 
 		var setErr error
 		err = rawConn.Control(func(fd uintptr) {
-			setErr = syscall.SetNonblock(int(fd), !blocking)
+			setErr = setNonblock(fd, !blocking)
 		})
 		if err != nil {
 			return err
@@ -217,10 +425,7 @@ func GetLocalAddr(conn net.Conn) *AddrInfo {
 	addr := conn.LocalAddr()
 
 	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
-		return &AddrInfo{
-			Addr: tcpAddr.IP.String(),
-			Port: strconv.Itoa(tcpAddr.Port),
-		}
+		return tcpAddrInfo(tcpAddr)
 	}
 
 	if unixAddr, ok := addr.(*net.UnixAddr); ok {
@@ -241,10 +446,7 @@ func GetRemoteAddr(conn net.Conn) *AddrInfo {
 	addr := conn.RemoteAddr()
 
 	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
-		return &AddrInfo{
-			Addr: tcpAddr.IP.String(),
-			Port: strconv.Itoa(tcpAddr.Port),
-		}
+		return tcpAddrInfo(tcpAddr)
 	}
 
 	if unixAddr, ok := addr.(*net.UnixAddr); ok {
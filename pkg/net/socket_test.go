@@ -1,6 +1,11 @@
 package net
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,7 +23,18 @@ func TestParseAddress(t *testing.T) {
 		{"[::1]:8080", "::1", "8080", false, false},
 		{"/tmp/socket", "/tmp/socket", "", true, false},
 		{"@abstract", "@abstract", "", true, false},
+		{`C:\tmp\socket`, `C:\tmp\socket`, "", true, false},
+		{"d:/tmp/socket", "d:/tmp/socket", "", true, false},
 		{"localhost", "localhost", "", false, false},
+		{"[fe80::1%eth0]:0", "fe80::1%eth0", "0", false, false},
+		{"[::1]", "::1", "", false, false},
+		{"::1", "::1", "", false, false},
+		{"fe80::1%eth0", "fe80::1%eth0", "", false, false},
+		{"127.0.0.1 80", "127.0.0.1", "80", false, false},
+		{"::1 80", "::1", "80", false, false},
+		{"[::1] 80", "::1", "80", false, false},
+		{"[::1", "", "", false, true},
+		{"[::1]80", "", "", false, true},
 	}
 
 	for _, tt := range tests {
@@ -99,3 +115,210 @@ func TestTCPListenAndConnect(t *testing.T) {
 		t.Errorf("GetRemoteAddr() port = %v, want %v", remoteAddr.Port, addrInfo.Port)
 	}
 }
+
+func TestTCPConnectFrom(t *testing.T) {
+	listener, addrInfo, err := TCPListen("127.0.0.1:0", 10)
+	if err != nil {
+		t.Fatalf("TCPListen() failed: %v", err)
+	}
+	defer listener.Close()
+
+	connectAddr := addrInfo.Addr + ":" + addrInfo.Port
+	conn, err := TCPConnectFrom(connectAddr, "127.0.0.1", 5*time.Second)
+	if err != nil {
+		t.Fatalf("TCPConnectFrom() failed: %v", err)
+	}
+	defer conn.Close()
+
+	if local := GetLocalAddr(conn); local.Addr != "127.0.0.1" {
+		t.Errorf("GetLocalAddr() = %v, want 127.0.0.1", local.Addr)
+	}
+
+	if _, err := TCPConnectFrom(connectAddr, "/tmp/sock", time.Second); err == nil {
+		t.Error("TCPConnectFrom() with a Unix bind address should fail")
+	}
+}
+
+func TestAddrInfoString(t *testing.T) {
+	tests := []struct {
+		info AddrInfo
+		want string
+	}{
+		{AddrInfo{"127.0.0.1", "80"}, "127.0.0.1:80"},
+		{AddrInfo{"::1", "80"}, "[::1]:80"},
+		{AddrInfo{"fe80::1%eth0", "80"}, "[fe80::1%eth0]:80"},
+		{AddrInfo{"/tmp/sock", ""}, "/tmp/sock"},
+	}
+	for _, tt := range tests {
+		if got := tt.info.String(); got != tt.want {
+			t.Errorf("AddrInfo%v.String() = %q, want %q", tt.info, got, tt.want)
+		}
+		host, port, _, err := ParseAddress(tt.info.String())
+		if err != nil || host != tt.info.Addr || port != tt.info.Port {
+			t.Errorf("ParseAddress(%q) = %q, %q, %v, want %q, %q", tt.info.String(), host, port, err, tt.info.Addr, tt.info.Port)
+		}
+	}
+
+	for host, want := range map[string]string{
+		"127.0.0.1":    "127.0.0.1",
+		"localhost":    "localhost",
+		"::1":          "[::1]",
+		"[::1]":        "[::1]",
+		"fe80::1%eth0": "[fe80::1%eth0]",
+	} {
+		if got := BracketHost(host); got != want {
+			t.Errorf("BracketHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestTCPListen_IPv6Zone(t *testing.T) {
+	addr, err := linkLocalAddr()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	listener, addrInfo, err := TCPListen("["+addr+"]:0", 0)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	defer listener.Close()
+
+	if addrInfo.Addr != addr {
+		t.Errorf("TCPListen() addr = %q, want %q", addrInfo.Addr, addr)
+	}
+
+	conn, err := TCPConnect(addrInfo.String(), 5*time.Second)
+	if err != nil {
+		t.Fatalf("TCPConnect(%q) failed: %v", addrInfo.String(), err)
+	}
+	defer conn.Close()
+
+	if remote := GetRemoteAddr(conn); remote.Addr != addr {
+		t.Errorf("GetRemoteAddr() = %q, want %q", remote.Addr, addr)
+	}
+}
+
+// linkLocalAddr returns a link-local IPv6 address of an interface that
+// is up, with the interface as its zone
+func linkLocalAddr() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ipNet.IP.String() + "%" + iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no link-local IPv6 address")
+}
+
+func TestTCPListenOpts_ReusePort(t *testing.T) {
+	opts := ListenOptions{ReusePort: true}
+	first, addrInfo, err := TCPListenOpts("127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("TCPListenOpts() failed: %v", err)
+	}
+	defer first.Close()
+
+	addr := addrInfo.Addr + ":" + addrInfo.Port
+	second, _, err := TCPListenOpts(addr, opts)
+	if err != nil {
+		t.Fatalf("second TCPListenOpts() on %s failed: %v", addr, err)
+	}
+	defer second.Close()
+
+	if _, _, err := TCPListen(addr, 0); err == nil {
+		t.Errorf("TCPListen() without ReusePort on %s should fail", addr)
+	}
+}
+
+func TestTCPListenOpts_Backlog(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("accept queue overflow behaviour is Linux specific")
+	}
+
+	listener, addrInfo, err := TCPListenOpts("127.0.0.1:0", ListenOptions{Backlog: 1})
+	if err != nil {
+		t.Fatalf("TCPListenOpts() failed: %v", err)
+	}
+	defer listener.Close()
+
+	// Nothing accepts, so connections past the backlog are not completed
+	addr := addrInfo.Addr + ":" + addrInfo.Port
+	failed := 0
+	for i := 0; i < 5; i++ {
+		conn, err := TCPConnect(addr, 200*time.Millisecond)
+		if err != nil {
+			failed++
+			continue
+		}
+		defer conn.Close()
+	}
+	if failed == 0 {
+		t.Errorf("all connections succeeded with a backlog of 1")
+	}
+}
+
+func TestOrderAddrs(t *testing.T) {
+	ips := []net.IPAddr{
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("192.0.2.2")},
+		{IP: net.ParseIP("2001:db8::1")},
+	}
+
+	tests := []struct {
+		policy   DialPolicy
+		expected string
+	}{
+		{DialPolicy{Race: true}, "2001:db8::1 192.0.2.1 192.0.2.2"},
+		{DialPolicy{Race: true, Prefer: "v4"}, "192.0.2.1 2001:db8::1 192.0.2.2"},
+		{DialPolicy{Prefer: "v4"}, "192.0.2.1 192.0.2.2 2001:db8::1"},
+		{DialPolicy{Prefer: "v6"}, "2001:db8::1 192.0.2.1 192.0.2.2"},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, ip := range orderAddrs(ips, tt.policy) {
+			got = append(got, ip.IP.String())
+		}
+		if strings.Join(got, " ") != tt.expected {
+			t.Errorf("orderAddrs(%+v) = %v, want %s", tt.policy, got, tt.expected)
+		}
+	}
+}
+
+func TestTCPConnectPolicy_Race(t *testing.T) {
+	listener, addrInfo, err := TCPListen("127.0.0.2:0", 10)
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	defer listener.Close()
+
+	// Nothing listens on 127.0.0.3, so the race must fall over to .2
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.3")}, {IP: net.ParseIP("127.0.0.2")}}, nil
+	}
+	defer func() { lookupIPAddr = net.DefaultResolver.LookupIPAddr }()
+
+	for _, policy := range []DialPolicy{{Race: true}, {Prefer: "v4"}} {
+		conn, err := TCPConnectPolicy("dual.test:"+addrInfo.Port, "", policy, 5*time.Second)
+		if err != nil {
+			t.Fatalf("TCPConnectPolicy(%+v) failed: %v", policy, err)
+		}
+		if remote := GetRemoteAddr(conn); remote.Addr != "127.0.0.2" {
+			t.Errorf("TCPConnectPolicy(%+v) connected to %s, want 127.0.0.2", policy, remote.Addr)
+		}
+		conn.Close()
+	}
+}
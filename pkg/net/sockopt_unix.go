@@ -0,0 +1,20 @@
+//go:build unix
+
+package net
+
+import "syscall"
+
+// setsockoptInt sets an integer socket option on the socket of fd
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
+
+// listenFD calls listen(2) on the socket of fd
+func listenFD(fd uintptr, backlog int) error {
+	return syscall.Listen(int(fd), backlog)
+}
+
+// setNonblock puts the socket of fd in or out of non-blocking mode
+func setNonblock(fd uintptr, nonblocking bool) error {
+	return syscall.SetNonblock(int(fd), nonblocking)
+}
@@ -0,0 +1,18 @@
+package net
+
+import "syscall"
+
+// setsockoptInt sets an integer socket option on the socket of fd
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+}
+
+// listenFD calls listen on the socket of fd
+func listenFD(fd uintptr, backlog int) error {
+	return syscall.Listen(syscall.Handle(fd), backlog)
+}
+
+// setNonblock puts the socket of fd in or out of non-blocking mode
+func setNonblock(fd uintptr, nonblocking bool) error {
+	return syscall.SetNonblock(syscall.Handle(fd), nonblocking)
+}
@@ -0,0 +1,437 @@
+package net
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSOptions configures TLS on the connections of a client or server
+type TLSOptions struct {
+	// Cert and Key are PEM files with the certificate to present. A
+	// server without them presents a self-signed one for localhost.
+	Cert string
+	Key  string
+	// CAFile holds the PEM certificates the peer's certificate is
+	// verified with. The handshake does not depend on the outcome,
+	// which is left to the spec to check as tls.verify.
+	CAFile string
+	// ServerName is sent as SNI by a client and verified against the
+	// server's certificate
+	ServerName string
+	// SNI, if set, is sent instead of ServerName. The certificate is
+	// still verified against ServerName, or SNI without one.
+	SNI string
+	// SessionCache, if set, lets a client resume sessions across its
+	// connections
+	SessionCache tls.ClientSessionCache
+	// HostCerts are the certificates a server presents instead of Cert
+	// to clients that ask for their host by SNI
+	HostCerts []HostCert
+	// RequestClientCert makes a server ask for a client certificate
+	RequestClientCert bool
+	// NoTickets makes a server refuse to resume sessions
+	NoTickets bool
+	// OCSP is a DER OCSP response file a server staples to Cert
+	OCSP string
+	// ALPN lists the protocols a client offers, such as h2
+	ALPN []string
+}
+
+// HostCert is a certificate a server presents for a host name, which may
+// be a wildcard such as *.example.com
+type HostCert struct {
+	Host string
+	Cert string
+	Key  string
+	// OCSP is a DER OCSP response file stapled to Cert
+	OCSP string
+}
+
+// TLSConn is a TLS connection that verifies its peer's certificate
+// against TLSOptions.CAFile once the handshake is done
+type TLSConn struct {
+	*tls.Conn
+	isServer bool
+	opts     *TLSOptions
+
+	verifyOnce sync.Once
+	verify     string
+}
+
+// TLSServer wraps a connection accepted by a server, with a config made
+// by ServerTLSConfig. The handshake happens on the first read or write.
+func TLSServer(conn net.Conn, config *tls.Config, opts *TLSOptions) *TLSConn {
+	return &TLSConn{Conn: tls.Server(conn, config), isServer: true, opts: opts}
+}
+
+// TLSClient wraps a connection made by a client and does the handshake
+func TLSClient(conn net.Conn, opts *TLSOptions, timeout time.Duration) (*TLSConn, error) {
+	serverName := opts.ServerName
+	if opts.SNI != "" {
+		serverName = opts.SNI
+	}
+	config := &tls.Config{
+		ServerName: serverName,
+		// The server certificate is verified after the handshake, so
+		// that a test can look at a certificate that fails
+		InsecureSkipVerify: true,
+		ClientSessionCache: opts.SessionCache,
+		NextProtos:         opts.ALPN,
+	}
+	if opts.Cert != "" || opts.Key != "" {
+		cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		// Sent whether or not the server's CA list names its issuer
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+
+	c := &TLSConn{Conn: tls.Client(conn, config), opts: opts}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := c.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	return c, nil
+}
+
+// ServerTLSConfig builds the configuration of a server from opts
+func ServerTLSConfig(opts *TLSOptions) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if opts.Cert != "" || opts.Key != "" {
+		cert, err = tls.LoadX509KeyPair(opts.Cert, opts.Key)
+	} else {
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("server certificate: %w", err)
+	}
+	if opts.OCSP != "" {
+		cert.OCSPStaple, err = os.ReadFile(opts.OCSP)
+		if err != nil {
+			return nil, fmt.Errorf("OCSP response: %w", err)
+		}
+	}
+
+	config := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		SessionTicketsDisabled: opts.NoTickets,
+	}
+	if len(opts.HostCerts) > 0 {
+		hosts := make(map[string]*tls.Certificate, len(opts.HostCerts))
+		for _, hc := range opts.HostCerts {
+			c, err := tls.LoadX509KeyPair(hc.Cert, hc.Key)
+			if err != nil {
+				return nil, fmt.Errorf("certificate for %s: %w", hc.Host, err)
+			}
+			if hc.OCSP != "" {
+				c.OCSPStaple, err = os.ReadFile(hc.OCSP)
+				if err != nil {
+					return nil, fmt.Errorf("OCSP response for %s: %w", hc.Host, err)
+				}
+			}
+			hosts[strings.ToLower(hc.Host)] = &c
+		}
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c := hostCert(hosts, hello.ServerName); c != nil {
+				return c, nil
+			}
+			return &cert, nil
+		}
+	}
+	if opts.RequestClientCert {
+		// Any certificate is accepted; tls.verify tells whether it
+		// verified
+		config.ClientAuth = tls.RequestClientCert
+		if opts.CAFile != "" {
+			pool, err := loadCAs(opts.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientCAs = pool
+		}
+	}
+	return config, nil
+}
+
+// hostCert finds the certificate for an SNI name, by the name itself or
+// a wildcard for its parent domain
+func hostCert(hosts map[string]*tls.Certificate, name string) *tls.Certificate {
+	if name == "" {
+		return nil
+	}
+	name = strings.ToLower(name)
+	if c, ok := hosts[name]; ok {
+		return c
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return hosts["*"+name[i:]]
+	}
+	return nil
+}
+
+// loadCAs reads a PEM file of CA certificates
+func loadCAs(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA file %s: no certificates", file)
+	}
+	return pool, nil
+}
+
+var (
+	selfSignedOnce sync.Once
+	selfSigned     tls.Certificate
+	selfSignedErr  error
+)
+
+// selfSignedCert returns a certificate for localhost, 127.0.0.1 and ::1,
+// made once per run
+func selfSignedCert() (tls.Certificate, error) {
+	selfSignedOnce.Do(func() {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			selfSignedErr = err
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			selfSignedErr = err
+			return
+		}
+		selfSigned = tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	})
+	return selfSigned, selfSignedErr
+}
+
+// Verify returns how the peer's certificate verified against the CA
+// file: "ok", "none" if the peer sent none, "unchecked" if there is no
+// CA file, or why it failed
+func (c *TLSConn) Verify() string {
+	c.verifyOnce.Do(func() {
+		if err := c.Handshake(); err != nil {
+			c.verify = err.Error()
+			return
+		}
+		c.verify = c.verifyPeer()
+	})
+	return c.verify
+}
+
+func (c *TLSConn) verifyPeer() string {
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "none"
+	}
+	if c.opts.CAFile == "" {
+		return "unchecked"
+	}
+	pool, err := loadCAs(c.opts.CAFile)
+	if err != nil {
+		return err.Error()
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if c.isServer {
+		opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	} else {
+		opts.DNSName = c.opts.ServerName
+		if opts.DNSName == "" {
+			opts.DNSName = c.opts.SNI
+		}
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// Field returns a property of the connection for expect: verify, or one
+// of the fields of StateField
+func (c *TLSConn) Field(name string) (string, error) {
+	if err := c.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	if name == "verify" {
+		return c.Verify(), nil
+	}
+	state := c.ConnectionState()
+	return StateField(&state, name)
+}
+
+// macroFields are the fields clients and servers define as
+// ${NAME_tls_FIELD} macros after each handshake
+var macroFields = []string{"version", "cipher", "sni", "alpn", "resumed", "peer_cn", "peer_digest"}
+
+// MacroValues returns the fields of a handshake to define as macros,
+// keyed by their name with a tls_ prefix
+func MacroValues(state *tls.ConnectionState) map[string]string {
+	values := make(map[string]string, len(macroFields))
+	for _, name := range macroFields {
+		values["tls_"+name], _ = StateField(state, name)
+	}
+	return values
+}
+
+// StateField returns a property of a handshake: version, cipher, sni,
+// alpn, resumed ("true" or "false"), of the peer's certificate peer_cn,
+// peer_san, peer_issuer, peer_serial and peer_digest (the SHA-256 of the
+// certificate, in hex), of the chain it came with chain, chain_len and
+// chain_order, and of a stapled OCSP response ocsp and ocsp_verify. A
+// peer field is empty when the peer sent no certificate.
+func StateField(state *tls.ConnectionState, name string) (string, error) {
+	var peer *x509.Certificate
+	if len(state.PeerCertificates) > 0 {
+		peer = state.PeerCertificates[0]
+	}
+
+	switch name {
+	case "chain", "chain_len", "chain_order":
+		return chainField(state.PeerCertificates, name), nil
+	case "ocsp", "ocsp_verify":
+		return ocspField(state, name), nil
+	case "version":
+		return tls.VersionName(state.Version), nil
+	case "cipher":
+		return tls.CipherSuiteName(state.CipherSuite), nil
+	case "sni":
+		return state.ServerName, nil
+	case "alpn":
+		return state.NegotiatedProtocol, nil
+	case "resumed":
+		return strconv.FormatBool(state.DidResume), nil
+	case "peer_cn", "peer_san", "peer_issuer", "peer_serial", "peer_digest":
+		if peer == nil {
+			return "", nil
+		}
+	default:
+		return "", fmt.Errorf("unknown tls field: %s", name)
+	}
+
+	switch name {
+	case "peer_cn":
+		return peer.Subject.CommonName, nil
+	case "peer_san":
+		return strings.Join(subjectAltNames(peer), ","), nil
+	case "peer_issuer":
+		return peer.Issuer.CommonName, nil
+	case "peer_serial":
+		return peer.SerialNumber.String(), nil
+	default:
+		sum := sha256.Sum256(peer.Raw)
+		return hex.EncodeToString(sum[:]), nil
+	}
+}
+
+// chainField returns the common names of the certificates of a chain in
+// the order they were sent, their number, or whether each one is issued
+// by the next
+func chainField(certs []*x509.Certificate, name string) string {
+	switch name {
+	case "chain":
+		names := make([]string, len(certs))
+		for i, cert := range certs {
+			names[i] = cert.Subject.CommonName
+		}
+		return strings.Join(names, ",")
+	case "chain_len":
+		return strconv.Itoa(len(certs))
+	default:
+		for i := 0; i+1 < len(certs); i++ {
+			if err := certs[i].CheckSignatureFrom(certs[i+1]); err != nil {
+				return fmt.Sprintf("certificate %d (%s) is not issued by certificate %d (%s)",
+					i+1, certs[i].Subject.CommonName, i+2, certs[i+1].Subject.CommonName)
+			}
+		}
+		return "ok"
+	}
+}
+
+// ocspField returns the status of a stapled OCSP response, or whether it
+// verifies against the issuer the peer sent after its certificate:
+// "none" without a staple, and the error if it is malformed or does not
+// verify
+func ocspField(state *tls.ConnectionState, name string) string {
+	certs := state.PeerCertificates
+	if len(state.OCSPResponse) == 0 || len(certs) == 0 {
+		return "none"
+	}
+	if name == "ocsp" {
+		status, err := OCSPStatus(state.OCSPResponse, certs[0])
+		if err != nil {
+			return err.Error()
+		}
+		return status
+	}
+	if len(certs) < 2 || certs[0].CheckSignatureFrom(certs[1]) != nil {
+		return "no issuer after the certificate"
+	}
+	if err := VerifyOCSP(state.OCSPResponse, certs[0], certs[1]); err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// subjectAltNames lists the names of a certificate: DNS names, IP
+// addresses, email addresses and URIs, in that order
+func subjectAltNames(cert *x509.Certificate) []string {
+	var names []string
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// RawConn returns the connection under a TLS one, or conn itself
+func RawConn(conn net.Conn) net.Conn {
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		return c.NetConn()
+	}
+	return conn
+}
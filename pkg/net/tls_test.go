@@ -0,0 +1,215 @@
+package net
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The certificates of tests/tls
+const certDir = "../../tests/tls/"
+
+// tlsPair runs a TLS handshake between a server and a client made with
+// the given options, and returns both ends
+func tlsPair(t *testing.T, server, client *TLSOptions) (*TLSConn, *TLSConn) {
+	t.Helper()
+	config, err := ServerTLSConfig(server)
+	if err != nil {
+		t.Fatalf("ServerTLSConfig() failed: %v", err)
+	}
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	s := TLSServer(a, config, server)
+	done := make(chan error, 1)
+	go func() { done <- s.Handshake() }()
+	c, err := TLSClient(b, client, 5*time.Second)
+	if err != nil {
+		t.Fatalf("TLSClient() failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("server handshake failed: %v", err)
+	}
+	return s, c
+}
+
+func field(t *testing.T, c *TLSConn, name string) string {
+	t.Helper()
+	value, err := c.Field(name)
+	if err != nil {
+		t.Fatalf("Field(%s) failed: %v", name, err)
+	}
+	return value
+}
+
+func TestTLS_ClientCert(t *testing.T) {
+	server := &TLSOptions{CAFile: certDir + "ca.pem", RequestClientCert: true}
+	s, c := tlsPair(t, server, &TLSOptions{Cert: certDir + "client.pem", Key: certDir + "client.key"})
+
+	if got := field(t, s, "peer_cn"); got != "client1" {
+		t.Errorf("peer_cn = %q, want client1", got)
+	}
+	if got := field(t, s, "peer_san"); got != "client1.example,spiffe://example/client1" {
+		t.Errorf("peer_san = %q", got)
+	}
+	if got := field(t, s, "verify"); got != "ok" {
+		t.Errorf("verify = %q, want ok", got)
+	}
+	// The self-signed server certificate, not checked without a CA file
+	if got := field(t, c, "peer_cn"); got != "localhost" {
+		t.Errorf("client peer_cn = %q, want localhost", got)
+	}
+	if got := field(t, c, "verify"); got != "unchecked" {
+		t.Errorf("client verify = %q, want unchecked", got)
+	}
+}
+
+func TestTLS_Verify(t *testing.T) {
+	server := &TLSOptions{CAFile: certDir + "ca.pem", RequestClientCert: true}
+	tests := []struct {
+		name   string
+		client *TLSOptions
+		want   string
+	}{
+		{"no certificate", &TLSOptions{}, "none"},
+		{"unknown issuer", &TLSOptions{Cert: certDir + "rogue.pem", Key: certDir + "rogue.key"}, "unknown authority"},
+		// A server certificate is not for client authentication
+		{"wrong usage", &TLSOptions{Cert: certDir + "server.pem", Key: certDir + "server.key"}, "incompatible key usage"},
+	}
+	for _, tt := range tests {
+		s, _ := tlsPair(t, server, tt.client)
+		if got := field(t, s, "verify"); !strings.Contains(got, tt.want) {
+			t.Errorf("%s: verify = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// The client checks the server's name against its certificate
+	server = &TLSOptions{Cert: certDir + "server.pem", Key: certDir + "server.key"}
+	_, c := tlsPair(t, server, &TLSOptions{CAFile: certDir + "ca.pem", ServerName: "localhost"})
+	if got := field(t, c, "verify"); got != "ok" {
+		t.Errorf("client verify = %q, want ok", got)
+	}
+	_, c = tlsPair(t, server, &TLSOptions{CAFile: certDir + "ca.pem", ServerName: "example.com"})
+	if got := field(t, c, "verify"); !strings.Contains(got, "example.com") {
+		t.Errorf("client verify = %q, want a name mismatch", got)
+	}
+}
+
+func TestTLS_HostCerts(t *testing.T) {
+	server := &TLSOptions{
+		Cert: certDir + "server.pem",
+		Key:  certDir + "server.key",
+		HostCerts: []HostCert{
+			{Host: "a.example", Cert: certDir + "a.example.pem", Key: certDir + "a.example.key"},
+			{Host: "*.b.example", Cert: certDir + "b.example.pem", Key: certDir + "b.example.key"},
+			{Host: "chain.example", Cert: certDir + "chain.pem", Key: certDir + "chain.key", OCSP: certDir + "ocsp-good.der"},
+		},
+	}
+	tests := []struct {
+		sni  string
+		want string
+	}{
+		{"a.example", "a.example"},
+		{"A.Example", "a.example"},
+		{"www.b.example", "b.example"},
+		{"b.example", "localhost"},
+		{"other.example", "localhost"},
+		{"", "localhost"},
+	}
+	for _, tt := range tests {
+		s, c := tlsPair(t, server, &TLSOptions{SNI: tt.sni})
+		if got := field(t, c, "peer_cn"); got != tt.want {
+			t.Errorf("SNI %q: peer_cn = %q, want %q", tt.sni, got, tt.want)
+		}
+		if got := field(t, s, "sni"); got != tt.sni {
+			t.Errorf("SNI %q: server sni = %q", tt.sni, got)
+		}
+	}
+
+	// A host certificate has its own staple, and the others have none
+	_, c := tlsPair(t, server, &TLSOptions{SNI: "chain.example"})
+	if got := field(t, c, "ocsp_verify"); got != "ok" {
+		t.Errorf("chain.example: ocsp_verify = %q, want ok", got)
+	}
+	_, c = tlsPair(t, server, &TLSOptions{SNI: "a.example"})
+	if got := field(t, c, "ocsp"); got != "none" {
+		t.Errorf("a.example: ocsp = %q, want none", got)
+	}
+
+	// SNI does not change the name the certificate is verified against
+	_, c = tlsPair(t, server, &TLSOptions{CAFile: certDir + "ca.pem", ServerName: "localhost", SNI: "other.example"})
+	if got := field(t, c, "verify"); got != "ok" {
+		t.Errorf("client verify = %q, want ok", got)
+	}
+}
+
+func TestTLS_StateFields(t *testing.T) {
+	server := &TLSOptions{Cert: certDir + "server.pem", Key: certDir + "server.key"}
+	_, c := tlsPair(t, server, &TLSOptions{})
+
+	certs := c.ConnectionState().PeerCertificates
+	want := fmt.Sprintf("%x", sha256.Sum256(certs[0].Raw))
+	if got := field(t, c, "peer_digest"); got != want {
+		t.Errorf("peer_digest = %q, want %q", got, want)
+	}
+	if got := field(t, c, "resumed"); got != "false" {
+		t.Errorf("resumed = %q, want false", got)
+	}
+
+	values := MacroValues(&tls.ConnectionState{Version: tls.VersionTLS12, DidResume: true})
+	if values["tls_version"] != "TLS 1.2" || values["tls_resumed"] != "true" || values["tls_peer_cn"] != "" {
+		t.Errorf("MacroValues() = %v", values)
+	}
+	if _, err := c.Field("bogus"); err == nil {
+		t.Error("Field(bogus) should fail")
+	}
+}
+
+func TestTLS_ChainAndOCSP(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *TLSOptions
+		want   map[string]string
+	}{
+		{"good", &TLSOptions{Cert: certDir + "chain.pem", Key: certDir + "chain.key", OCSP: certDir + "ocsp-good.der"}, map[string]string{
+			"chain":       "chain.example,GTest Chain Intermediate",
+			"chain_len":   "2",
+			"chain_order": "ok",
+			"ocsp":        "good",
+			"ocsp_verify": "ok",
+		}},
+		{"revoked", &TLSOptions{Cert: certDir + "chain.pem", Key: certDir + "chain.key", OCSP: certDir + "ocsp-revoked.der"}, map[string]string{
+			"ocsp":        "revoked",
+			"ocsp_verify": "ok",
+		}},
+		{"forged", &TLSOptions{Cert: certDir + "chain.pem", Key: certDir + "chain.key", OCSP: certDir + "ocsp-forged.der"}, map[string]string{
+			"ocsp":        "good",
+			"ocsp_verify": `OCSP responder "rogue" is not issued by "GTest Chain Intermediate"`,
+		}},
+		{"other certificate", &TLSOptions{Cert: certDir + "server.pem", Key: certDir + "server.key", OCSP: certDir + "ocsp-good.der"}, map[string]string{
+			"chain_len": "1",
+			"ocsp":      "OCSP response is not for serial 3",
+		}},
+		{"misordered", &TLSOptions{Cert: certDir + "chain-misordered.pem", Key: certDir + "chain.key"}, map[string]string{
+			"chain_len":   "3",
+			"chain_order": "certificate 1 (chain.example) is not issued by certificate 2 (GTest Chain Root)",
+			"ocsp":        "none",
+			"ocsp_verify": "none",
+		}},
+	}
+	for _, tt := range tests {
+		_, c := tlsPair(t, tt.server, &TLSOptions{})
+		for name, want := range tt.want {
+			if got := field(t, c, name); got != want {
+				t.Errorf("%s: %s = %q, want %q", tt.name, name, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package process
+
+import "syscall"
+
+// groupAttr makes a process the leader of a process group of its own
+func groupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// groupAlive reports whether anything is left in the process group of
+// the process
+func (p *Process) groupAlive() bool {
+	return syscall.Kill(-p.Cmd.Process.Pid, 0) == nil
+}
+
+// signalGroup sends sig to the process group of the process. A group
+// that is gone already is not an error.
+func (p *Process) signalGroup(sig syscall.Signal) error {
+	if p.Cmd.Process == nil {
+		return nil
+	}
+	err := syscall.Kill(-p.Cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil
+	}
+	return err
+}
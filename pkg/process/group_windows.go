@@ -0,0 +1,45 @@
+package process
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// groupAttr starts a process in a process group of its own. Windows has
+// no process groups to signal, so the group is its tree of processes.
+func groupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// groupAlive reports whether the process still runs. Children it left
+// behind are not tracked once it has exited.
+func (p *Process) groupAlive() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// signalGroup ends the tree of processes of the process for SIGKILL and
+// SIGTERM, which Windows cannot tell apart; other signals do not exist
+// there. A process that is gone already is not an error.
+func (p *Process) signalGroup(sig syscall.Signal) error {
+	if p.Cmd.Process == nil {
+		return nil
+	}
+	if sig != syscall.SIGKILL && sig != syscall.SIGTERM {
+		return fmt.Errorf("%s cannot be sent on Windows", SignalName(sig))
+	}
+	if !p.groupAlive() {
+		return nil
+	}
+	pid := strconv.Itoa(p.Cmd.Process.Pid)
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", pid).Run(); err != nil {
+		return p.Cmd.Process.Kill()
+	}
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
@@ -42,12 +43,23 @@ type Process struct {
 	StdoutPath string
 	StderrPath string
 
+	// quiet keeps output lines out of the log, see SetQuiet
+	quiet bool
+
 	// State
 	started   bool
 	done      chan struct{}
 	err       error
 }
 
+// outputDelay is how long Wait waits for the output of an exited
+// process to be read to its end
+const outputDelay = time.Second
+
+// StopTimeout is how long Stop waits for the process to exit after
+// closing its input, and again after SIGTERM
+const StopTimeout = 5 * time.Second
+
 // New creates a new process manager
 func New(name string, logger *logging.Logger, tmpDir string, command string, args ...string) *Process {
 	cmd := exec.Command(command, args...)
@@ -99,20 +111,32 @@ func (p *Process) Start() error {
 		return fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 
-	p.stdout, err = p.Cmd.StdoutPipe()
+	// The output goes through pipes of our own rather than StdoutPipe,
+	// so that Wait does not close them under the readers
+	stdoutR, stdoutW, err := os.Pipe()
 	if err != nil {
 		p.closeOutputFiles()
 		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
-
-	p.stderr, err = p.Cmd.StderrPipe()
+	stderrR, stderrW, err := os.Pipe()
 	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
 		p.closeOutputFiles()
 		return fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
-
-	// Start the process
-	if err := p.Cmd.Start(); err != nil {
+	p.stdout, p.stderr = stdoutR, stderrR
+	p.Cmd.Stdout, p.Cmd.Stderr = stdoutW, stderrW
+
+	// Start the process in a process group of its own, so that Kill and
+	// Stop also reach what a shell-wrapped command runs in the background
+	p.Cmd.SysProcAttr = groupAttr()
+	err = p.Cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdoutR.Close()
+		stderrR.Close()
 		p.closeOutputFiles()
 		return fmt.Errorf("failed to start process: %w", err)
 	}
@@ -120,14 +144,37 @@ func (p *Process) Start() error {
 	p.started = true
 	p.Logger.Debug("Process %s started (pid %d)", p.Name, p.Cmd.Process.Pid)
 
-	// Start output capture goroutines
-	go p.captureOutput(p.stdout, &p.stdoutBuf, p.stdoutFile, "stdout")
-	go p.captureOutput(p.stderr, &p.stderrBuf, p.stderrFile, "stderr")
+	// Start output capture goroutines. Children left running in the
+	// background may keep the pipes open, and go on being logged.
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		p.captureOutput(p.stdout, &p.stdoutBuf, p.stdoutFile, "out")
+	}()
+	go func() {
+		defer readers.Done()
+		p.captureOutput(p.stderr, &p.stderrBuf, p.stderrFile, "err")
+	}()
+	captured := make(chan struct{})
+	go func() {
+		readers.Wait()
+		p.stdout.Close()
+		p.stderr.Close()
+		p.mutex.Lock()
+		p.closeOutputFiles()
+		p.mutex.Unlock()
+		close(captured)
+	}()
 
-	// Wait for process to complete
+	// Wait for process to complete, and for its output to be read unless
+	// something it left behind holds on to it
 	go func() {
 		p.err = p.Cmd.Wait()
-		p.closeOutputFiles()
+		select {
+		case <-captured:
+		case <-time.After(outputDelay):
+		}
 		close(p.done)
 		p.Logger.Debug("Process %s exited", p.Name)
 	}()
@@ -144,7 +191,8 @@ func (p *Process) startWithTerminal() error {
 	}
 	p.Terminal = terminal
 
-	// Start process with PTY
+	// Start process with PTY. It becomes the leader of a new session,
+	// and so of a process group of its own.
 	if err := terminal.Start(p.Cmd); err != nil {
 		return fmt.Errorf("failed to start process with terminal: %w", err)
 	}
@@ -163,7 +211,16 @@ func (p *Process) startWithTerminal() error {
 	return nil
 }
 
-// captureOutput captures output from a reader
+// SetQuiet stops (or resumes) logging the output lines of the process.
+// They are still captured and written to the output files.
+func (p *Process) SetQuiet(quiet bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.quiet = quiet
+}
+
+// captureOutput captures output from a reader, and logs each line as
+// "pNAME_out> line" or "pNAME_err> line" as it comes
 func (p *Process) captureOutput(r io.Reader, buf *bytes.Buffer, file *os.File, name string) {
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
@@ -177,9 +234,12 @@ func (p *Process) captureOutput(r io.Reader, buf *bytes.Buffer, file *os.File, n
 		if file != nil {
 			file.WriteString(lineWithNewline)
 		}
+		quiet := p.quiet
 		p.mutex.Unlock()
 
-		p.Logger.Debug("Process %s [%s]: %s", p.Name, name, line)
+		if !quiet {
+			p.Logger.Log(3, "%s_%s> %s", p.Name, name, line)
+		}
 	}
 }
 
@@ -281,20 +341,20 @@ func (p *Process) WaitTimeout(timeout time.Duration) error {
 	}
 }
 
-// Kill kills the process
+// Kill kills the process and everything else in its process group
 func (p *Process) Kill() error {
 	if !p.started {
 		return fmt.Errorf("process not started")
 	}
 
-	if p.Cmd.Process == nil {
-		return nil
-	}
-
-	return p.Cmd.Process.Kill()
+	return p.signalGroup(syscall.SIGKILL)
 }
 
-// Stop gracefully stops the process
+// Stop gracefully stops the process: it closes stdin and gives the
+// process StopTimeout to exit, then sends SIGTERM to its process group,
+// and SIGKILL if that is not enough. Children left behind in the group
+// are killed. The exit error is returned only if the process exited on
+// its own.
 func (p *Process) Stop() error {
 	if !p.started {
 		return fmt.Errorf("process not started")
@@ -305,8 +365,90 @@ func (p *Process) Stop() error {
 		p.stdin.Close()
 	}
 
-	// Wait for process with timeout
-	return p.WaitTimeout(5 * time.Second)
+	select {
+	case <-p.done:
+		p.signalGroup(syscall.SIGKILL)
+		return p.err
+	case <-time.After(StopTimeout):
+	}
+
+	p.Logger.Log(3, "Process %s did not exit at end of input, terminating it", p.Name)
+	p.signalGroup(syscall.SIGTERM)
+	select {
+	case <-p.done:
+	case <-time.After(StopTimeout):
+		p.Logger.Log(3, "Process %s did not exit on SIGTERM, killing it", p.Name)
+	}
+	p.signalGroup(syscall.SIGKILL)
+	<-p.done
+	return nil
+}
+
+// Signal sends sig to the process, which must still be running. A
+// command run under a shell gets it only if the shell execs it.
+func (p *Process) Signal(sig syscall.Signal) error {
+	if err := p.checkRunning(); err != nil {
+		return err
+	}
+	p.Logger.Log(3, "Sending %s", SignalName(sig))
+	return p.Cmd.Process.Signal(sig)
+}
+
+// SignalGroup sends sig to the process group of the process, which must
+// still be running: the process and the children it started, such as a
+// daemon run under sh -c
+func (p *Process) SignalGroup(sig syscall.Signal) error {
+	if err := p.checkRunning(); err != nil {
+		return err
+	}
+	p.Logger.Log(3, "Sending %s to the process group", SignalName(sig))
+	return p.signalGroup(sig)
+}
+
+// checkRunning fails unless the process has started and not exited
+func (p *Process) checkRunning() error {
+	if !p.started {
+		return fmt.Errorf("process not started")
+	}
+	select {
+	case <-p.done:
+		return fmt.Errorf("process %s has exited", p.Name)
+	default:
+	}
+	return nil
+}
+
+// ExitSignal returns the signal that killed the process, and false if it
+// exited on its own or is still running
+func (p *Process) ExitSignal() (syscall.Signal, bool) {
+	if p.Cmd.ProcessState == nil {
+		return 0, false
+	}
+	status, ok := p.Cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return 0, false
+	}
+	return status.Signal(), true
+}
+
+// Reap kills what is left of the process group at the end of a test:
+// the process itself if it still runs, and the children it left behind.
+// It reports whether anything was left.
+func (p *Process) Reap() bool {
+	if !p.started || p.Cmd.Process == nil {
+		return false
+	}
+	if !p.groupAlive() {
+		return false
+	}
+
+	p.signalGroup(syscall.SIGKILL)
+	select {
+	case <-p.done:
+	case <-time.After(StopTimeout):
+		p.Logger.Warning("Process %s did not exit on SIGKILL", p.Name)
+	}
+	return true
 }
 
 // ExitCode returns the exit code of the process
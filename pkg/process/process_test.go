@@ -0,0 +1,234 @@
+//go:build unix
+
+package process
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// startWithChild starts a shell that leaves a sleep running in the
+// background, and returns the process and the pid of the sleep
+func startWithChild(t *testing.T, script string) (*Process, int) {
+	t.Helper()
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "bg.pid")
+	p := New("p1", logging.NewLogger("test"), dir, "sh", "-c", "sleep 300 & echo $! > "+pidFile+"; "+script)
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(pidFile)
+		if err == nil && strings.HasSuffix(string(data), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil {
+				t.Fatalf("bad pid file: %q", data)
+			}
+			return p, pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("background child did not start")
+	return nil, 0
+}
+
+// alive reports whether pid runs, counting zombies as gone
+func alive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	_, rest, _ := strings.Cut(string(stat), ") ")
+	return !strings.HasPrefix(rest, "Z")
+}
+
+// waitGone waits for pid to exit
+func waitGone(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for alive(pid) {
+		if time.Now().After(deadline) {
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("background child %d still running", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKill_ProcessGroup(t *testing.T) {
+	p, child := startWithChild(t, "wait")
+	if err := p.Kill(); err != nil {
+		t.Fatalf("Kill() failed: %v", err)
+	}
+	waitGone(t, child)
+	if err := p.WaitTimeout(5 * time.Second); err == nil {
+		t.Error("Wait() after Kill() should report the signal")
+	}
+}
+
+func TestStop_KillsLeftovers(t *testing.T) {
+	// The shell exits at once; its child stays behind
+	p, child := startWithChild(t, "exit 0")
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop() failed: %v", err)
+	}
+	waitGone(t, child)
+}
+
+func TestReap(t *testing.T) {
+	p, child := startWithChild(t, "exit 0")
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait() failed: %v", err)
+	}
+	if !alive(child) {
+		t.Fatal("background child exited with its parent")
+	}
+	if !p.Reap() {
+		t.Error("Reap() found nothing left")
+	}
+	waitGone(t, child)
+}
+
+func TestOutputLogged(t *testing.T) {
+	logging.ResetOutput()
+	logger := logging.NewLogger("test")
+
+	p := New("p1", logger, t.TempDir(), "sh", "-c", "echo hello; echo oops >&2; printf partial")
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("Wait() failed: %v", err)
+	}
+
+	out := logging.GetOutput()
+	for _, want := range []string{"p1_out> hello", "p1_err> oops", "p1_out> partial"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log has no %q:\n%s", want, out)
+		}
+	}
+	if got := p.GetStdout(); got != "hello\npartial\n" {
+		t.Errorf("GetStdout() = %q", got)
+	}
+
+	logging.ResetOutput()
+	p = New("p2", logger, t.TempDir(), "sh", "-c", "echo hello")
+	p.SetQuiet(true)
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	p.Wait()
+	if out := logging.GetOutput(); strings.Contains(out, "p2_out>") {
+		t.Errorf("quiet process logged its output:\n%s", out)
+	}
+	if data, err := os.ReadFile(p.StdoutPath); err != nil || string(data) != "hello\n" {
+		t.Errorf("stdout file = %q, %v", data, err)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		in   string
+		want syscall.Signal
+		err  bool
+	}{
+		{"HUP", syscall.SIGHUP, false},
+		{"SIGHUP", syscall.SIGHUP, false},
+		{"usr1", syscall.SIGUSR1, false},
+		{"SigTerm", syscall.SIGTERM, false},
+		{"9", syscall.SIGKILL, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"NOPE", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSignal(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseSignal(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+	if name := SignalName(syscall.SIGHUP); name != "SIGHUP" {
+		t.Errorf("SignalName(SIGHUP) = %q", name)
+	}
+}
+
+func TestSignal(t *testing.T) {
+	dir := t.TempDir()
+	p := New("p1", logging.NewLogger("test"), dir, "sh", "-c", `trap 'echo reload' HUP; echo ready; while :; do sleep 0.1; done`)
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer p.Kill()
+
+	waitText := func(text string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !p.ExpectText(text) {
+			if time.Now().After(deadline) {
+				t.Fatalf("output %q not seen", text)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitText("ready")
+	if err := p.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("Signal(HUP) failed: %v", err)
+	}
+	waitText("reload")
+	if _, ok := p.ExitSignal(); ok {
+		t.Error("ExitSignal() reported a signal for a running process")
+	}
+
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal(TERM) failed: %v", err)
+	}
+	p.WaitTimeout(5 * time.Second)
+	if sig, ok := p.ExitSignal(); !ok || sig != syscall.SIGTERM {
+		t.Errorf("ExitSignal() = %v, %v; want SIGTERM", sig, ok)
+	}
+	if err := p.Signal(syscall.SIGHUP); err == nil {
+		t.Error("Signal() to an exited process should fail")
+	}
+}
+
+func TestSignalGroup(t *testing.T) {
+	// The shell dies by SIGTERM, but its child only gets it when the
+	// whole group is signalled
+	p, child := startWithChild(t, "wait")
+	defer p.Kill()
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("Signal(TERM) failed: %v", err)
+	}
+	p.WaitTimeout(5 * time.Second)
+	if sig, ok := p.ExitSignal(); !ok || sig != syscall.SIGTERM {
+		t.Errorf("ExitSignal() = %v, %v; want SIGTERM", sig, ok)
+	}
+	if !alive(child) {
+		t.Fatal("Signal() reached the child of the shell")
+	}
+	syscall.Kill(child, syscall.SIGKILL)
+
+	p, child = startWithChild(t, "wait")
+	defer p.Kill()
+	if err := p.SignalGroup(syscall.SIGTERM); err != nil {
+		t.Fatalf("SignalGroup(TERM) failed: %v", err)
+	}
+	waitGone(t, child)
+	p.WaitTimeout(5 * time.Second)
+	if err := p.SignalGroup(syscall.SIGTERM); err == nil {
+		t.Error("SignalGroup() to an exited process should fail")
+	}
+}
@@ -0,0 +1,34 @@
+package process
+
+import (
+	"runtime"
+	"strings"
+)
+
+// DefaultShell runs the commands of process and shell that need a shell:
+// sh, or cmd on Windows
+var DefaultShell = defaultShell()
+
+func defaultShell() string {
+	if runtime.GOOS == "windows" {
+		return "cmd"
+	}
+	return "sh"
+}
+
+// ShellCommand returns the command line that has shell run script: cmd
+// gets it after /C, powershell and pwsh after -Command, and sh and the
+// other POSIX shells after -c
+func ShellCommand(shell, script string) []string {
+	// The base name, whichever separator the path uses
+	name := strings.ToLower(shell[strings.LastIndexAny(shell, `/\`)+1:])
+	name = strings.TrimSuffix(name, ".exe")
+	switch name {
+	case "cmd":
+		return []string{shell, "/C", script}
+	case "powershell", "pwsh":
+		return []string{shell, "-NoProfile", "-NonInteractive", "-Command", script}
+	default:
+		return []string{shell, "-c", script}
+	}
+}
@@ -0,0 +1,25 @@
+package process
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestShellCommand(t *testing.T) {
+	tests := []struct {
+		shell string
+		want  []string
+	}{
+		{"sh", []string{"sh", "-c", "echo hi"}},
+		{"/bin/bash", []string{"/bin/bash", "-c", "echo hi"}},
+		{"cmd", []string{"cmd", "/C", "echo hi"}},
+		{`C:\Windows\System32\CMD.EXE`, []string{`C:\Windows\System32\CMD.EXE`, "/C", "echo hi"}},
+		{"pwsh", []string{"pwsh", "-NoProfile", "-NonInteractive", "-Command", "echo hi"}},
+		{"powershell.exe", []string{"powershell.exe", "-NoProfile", "-NonInteractive", "-Command", "echo hi"}},
+	}
+	for _, tt := range tests {
+		if got := ShellCommand(tt.shell, "echo hi"); !slices.Equal(got, tt.want) {
+			t.Errorf("ShellCommand(%q) = %q, want %q", tt.shell, got, tt.want)
+		}
+	}
+}
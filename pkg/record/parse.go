@@ -0,0 +1,197 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+// Header is a header field as seen on the wire
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Exchange is one HTTP/1 request and its response
+type Exchange struct {
+	Method     string
+	URL        string
+	Proto      string
+	ReqHeaders []Header
+	ReqBody    []byte
+	ReqChunked bool
+
+	RespProto   string
+	Status      int
+	Reason      string
+	RespHeaders []Header
+	RespBody    []byte
+	RespChunked bool
+	NoResponse  bool // The connection closed before a response arrived
+}
+
+// Parse splits the bytes sent in each direction of a connection into
+// exchanges. Interim (1xx) responses are skipped. What was parsed before an
+// error is returned along with it.
+func Parse(reqData, respData []byte) ([]Exchange, error) {
+	reqs := bufio.NewReader(bytes.NewReader(reqData))
+	resps := bufio.NewReader(bytes.NewReader(respData))
+
+	var exchanges []Exchange
+	for {
+		if _, err := reqs.Peek(1); err == io.EOF {
+			return exchanges, nil
+		}
+
+		var ex Exchange
+		if err := readRequest(reqs, &ex); err != nil {
+			return exchanges, fmt.Errorf("request %d: %w", len(exchanges)+1, err)
+		}
+		if _, err := resps.Peek(1); err == io.EOF {
+			ex.NoResponse = true
+			return append(exchanges, ex), nil
+		}
+		if err := readResponse(resps, &ex); err != nil {
+			return exchanges, fmt.Errorf("response %d: %w", len(exchanges)+1, err)
+		}
+		exchanges = append(exchanges, ex)
+
+		// CONNECT and Upgrade hand the connection over to another protocol
+		if ex.Status == 101 || (ex.Method == "CONNECT" && ex.Status/100 == 2) {
+			return exchanges, nil
+		}
+	}
+}
+
+func readRequest(r *bufio.Reader, ex *Exchange) error {
+	line, err := readLine(r)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed request line %q", line)
+	}
+	ex.Method, ex.URL, ex.Proto = parts[0], parts[1], parts[2]
+
+	if ex.ReqHeaders, err = readHeaders(r); err != nil {
+		return err
+	}
+	ex.ReqBody, ex.ReqChunked, err = readBody(r, ex.ReqHeaders, false)
+	return err
+}
+
+func readResponse(r *bufio.Reader, ex *Exchange) error {
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			return fmt.Errorf("malformed status line %q", line)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return fmt.Errorf("malformed status line %q", line)
+		}
+		ex.RespProto, ex.Status = parts[0], status
+		ex.Reason = ""
+		if len(parts) == 3 {
+			ex.Reason = parts[2]
+		}
+
+		if ex.RespHeaders, err = readHeaders(r); err != nil {
+			return err
+		}
+		if status >= 100 && status < 200 && status != 101 {
+			continue
+		}
+
+		// Responses to HEAD and 204/304 never have a body
+		if ex.Method == "HEAD" || status == 204 || status == 304 || status == 101 {
+			return nil
+		}
+		ex.RespBody, ex.RespChunked, err = readBody(r, ex.RespHeaders, true)
+		return err
+	}
+}
+
+// readLine reads a line without its CRLF (or bare LF)
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readHeaders(r *bufio.Reader) ([]Header, error) {
+	var headers []Header
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return headers, nil
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed header %q", line)
+		}
+		headers = append(headers, Header{Name: name, Value: strings.TrimSpace(value)})
+	}
+}
+
+// readBody reads a message body framed by Transfer-Encoding or
+// Content-Length. Without either a response body runs to the end of the
+// connection and a request has none.
+func readBody(r *bufio.Reader, headers []Header, toEOF bool) ([]byte, bool, error) {
+	if te := headerValue(headers, "Transfer-Encoding"); strings.EqualFold(te, "chunked") {
+		body, err := io.ReadAll(httputil.NewChunkedReader(r))
+		if err != nil {
+			return nil, true, fmt.Errorf("chunked body: %w", err)
+		}
+		// Skip the trailer section
+		if _, err := readHeaders(r); err != nil {
+			return nil, true, fmt.Errorf("chunked trailer: %w", err)
+		}
+		return body, true, nil
+	}
+
+	if cl := headerValue(headers, "Content-Length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, false, fmt.Errorf("invalid Content-Length %q", cl)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, false, fmt.Errorf("body: %w", err)
+		}
+		return body, false, nil
+	}
+
+	if !toEOF {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(r)
+	return body, false, err
+}
+
+// headerValue returns the first value of the named header
+func headerValue(headers []Header, name string) string {
+	for _, h := range headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
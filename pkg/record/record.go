@@ -0,0 +1,128 @@
+// Package record proxies HTTP/1 traffic between a real client and server,
+// captures the exchanges and turns them into a skeleton VTC test.
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Conn is one proxied connection
+type Conn struct {
+	Remote    string     // Address of the client
+	Exchanges []Exchange // Request/response pairs, in order
+	Err       error      // Why the traffic could not be (fully) parsed
+}
+
+// Proxy is a transparent TCP proxy that records what passes through it
+type Proxy struct {
+	Upstream    string        // Address of the real server
+	DialTimeout time.Duration // Timeout connecting upstream (default 5s)
+	OnDone      func(*Conn)   // Called when a connection has been recorded
+
+	mu    sync.Mutex
+	conns []*Conn
+	wg    sync.WaitGroup
+}
+
+// NewProxy creates a proxy forwarding to upstream
+func NewProxy(upstream string) *Proxy {
+	return &Proxy{Upstream: upstream, DialTimeout: 5 * time.Second}
+}
+
+// Serve accepts connections on ln and proxies each one upstream until ln
+// is closed. Connections still open at that point are waited for.
+func (p *Proxy) Serve(ln net.Listener) error {
+	defer p.wg.Wait()
+	for {
+		client, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		// Slots are taken in accept order, so the generated test replays
+		// connections in the order they were opened
+		c := &Conn{Remote: client.RemoteAddr().String()}
+		p.mu.Lock()
+		p.conns = append(p.conns, c)
+		p.mu.Unlock()
+
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.proxy(client, c)
+		}()
+	}
+}
+
+// Connections returns a snapshot of the connections accepted so far;
+// those still open have no exchanges yet
+func (p *Proxy) Connections() []*Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := make([]*Conn, len(p.conns))
+	for i, c := range p.conns {
+		snapshot := *c
+		conns[i] = &snapshot
+	}
+	return conns
+}
+
+// proxy relays one connection in both directions, then parses the
+// captured bytes
+func (p *Proxy) proxy(client net.Conn, c *Conn) {
+	defer client.Close()
+
+	upstream, err := net.DialTimeout("tcp", p.Upstream, p.DialTimeout)
+	if err != nil {
+		p.finish(c, nil, err)
+		return
+	}
+	defer upstream.Close()
+
+	var reqData, respData bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		relay(upstream, client, &reqData)
+	}()
+	go func() {
+		defer wg.Done()
+		relay(client, upstream, &respData)
+	}()
+	wg.Wait()
+
+	exchanges, err := Parse(reqData.Bytes(), respData.Bytes())
+	p.finish(c, exchanges, err)
+}
+
+// finish stores the result of a connection
+func (p *Proxy) finish(c *Conn, exchanges []Exchange, err error) {
+	p.mu.Lock()
+	c.Exchanges = exchanges
+	c.Err = err
+	p.mu.Unlock()
+
+	if p.OnDone != nil {
+		p.OnDone(c)
+	}
+}
+
+// relay copies src to dst, keeping a copy in capture, and passes the end
+// of the stream on as a half close
+func relay(dst, src net.Conn, capture *bytes.Buffer) {
+	io.Copy(io.MultiWriter(dst, capture), src)
+	if tc, ok := dst.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
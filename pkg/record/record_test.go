@@ -0,0 +1,139 @@
+package record
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+func TestParse(t *testing.T) {
+	reqs := "GET /a HTTP/1.1\r\nHost: example.com\r\n\r\n" +
+		"POST /b HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n" +
+		"HEAD /c HTTP/1.1\r\n\r\n"
+	resps := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello" +
+		"HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 201 Created\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nok\r\n0\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"
+
+	exchanges, err := Parse([]byte(reqs), []byte(resps))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(exchanges) != 3 {
+		t.Fatalf("got %d exchanges, want 3", len(exchanges))
+	}
+
+	if ex := exchanges[0]; ex.URL != "/a" || string(ex.RespBody) != "hello" || headerValue(ex.ReqHeaders, "host") != "example.com" {
+		t.Errorf("exchange 1 = %+v", ex)
+	}
+	if ex := exchanges[1]; !ex.ReqChunked || string(ex.ReqBody) != "abc" || ex.Status != 201 || !ex.RespChunked || string(ex.RespBody) != "ok" {
+		t.Errorf("exchange 2 = %+v", ex)
+	}
+	if ex := exchanges[2]; ex.Method != "HEAD" || len(ex.RespBody) != 0 {
+		t.Errorf("exchange 3 = %+v", ex)
+	}
+}
+
+func TestParse_NoResponse(t *testing.T) {
+	exchanges, err := Parse([]byte("GET / HTTP/1.1\r\n\r\n"), nil)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(exchanges) != 1 || !exchanges[0].NoResponse {
+		t.Errorf("exchanges = %+v", exchanges)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Quote", `say "hi"`)
+		fmt.Fprintf(w, "%s %s %d", r.Method, r.URL.Path, len(body))
+	})}
+	go srv.Serve(upstream)
+	defer srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *Conn, 1)
+	p := NewProxy(upstream.Addr().String())
+	p.OnDone = func(c *Conn) { done <- c }
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for _, req := range []string{
+		"GET /hello HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"POST /form HTTP/1.1\r\nHost: example.com\r\nContent-Length: 3\r\n\r\na=b",
+	} {
+		if _, err := io.WriteString(conn, req); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	conn.Close()
+
+	c := <-done
+	ln.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("Serve: %v", err)
+	}
+	if c.Err != nil {
+		t.Fatalf("recording failed: %v", c.Err)
+	}
+	if len(c.Exchanges) != 2 {
+		t.Fatalf("got %d exchanges, want 2", len(c.Exchanges))
+	}
+
+	var out strings.Builder
+	if err := WriteVTC(&out, "recorded", p.Connections()); err != nil {
+		t.Fatal(err)
+	}
+	got := out.String()
+	for _, want := range []string{
+		"server s1 {",
+		"expect req.url == /form",
+		"expect req.bodylen == 3",
+		`-hdr "Content-Type: text/plain"`,
+		`-body "GET /hello 0"`,
+		"client c1 -connect ${s1_sock} {",
+		`-hdr "Host: example.com"`,
+		"-body a=b",
+		"expect resp.http.content-type == text/plain",
+		"# Header X-Quote omitted: value cannot be quoted",
+		"} -run",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("generated test lacks %q:\n%s", want, got)
+		}
+	}
+
+	// The result must at least parse
+	parser := vtc.NewParser(strings.NewReader(got), nil, logging.NewLogger("test"))
+	if _, err := parser.Parse(); err != nil {
+		t.Errorf("generated test does not parse: %v\n%s", err, got)
+	}
+}
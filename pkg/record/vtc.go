@@ -0,0 +1,199 @@
+package record
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxInlineBody is the largest body written out with -body; longer ones
+// are replaced by a generated body of the same length
+const maxInlineBody = 1024
+
+// Headers the generated commands produce themselves, or whose recorded
+// value would be stale on replay
+var skipHeaders = map[string]bool{
+	"content-length":    true,
+	"transfer-encoding": true,
+	"date":              true,
+}
+
+// WriteVTC writes a test that replays the recorded connections: for each
+// one a server answering with the recorded responses and a client sending
+// the recorded requests and checking the responses it gets back
+func WriteVTC(w io.Writer, desc string, conns []*Conn) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "vtest %s\n", quote(desc))
+
+	n := 0
+	for _, c := range conns {
+		if len(c.Exchanges) == 0 {
+			continue
+		}
+		n++
+		b.WriteString("\n")
+		fmt.Fprintf(&b, "# Connection from %s\n", c.Remote)
+		if c.Err != nil {
+			fmt.Fprintf(&b, "# Recording incomplete: %s\n", commentSafe(c.Err.Error()))
+		}
+		writeServer(&b, n, c.Exchanges)
+		b.WriteString("\n")
+		writeClient(&b, n, c.Exchanges)
+	}
+	if n == 0 {
+		b.WriteString("\n# No HTTP/1 exchanges were recorded\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeServer(b *strings.Builder, n int, exchanges []Exchange) {
+	fmt.Fprintf(b, "server s%d {\n", n)
+	for _, ex := range exchanges {
+		b.WriteString("\trxreq\n")
+		writeExpect(b, "req.method", ex.Method)
+		writeExpect(b, "req.url", ex.URL)
+		if ex.Proto != "HTTP/1.1" {
+			writeExpect(b, "req.proto", ex.Proto)
+		}
+		if len(ex.ReqBody) > 0 {
+			writeExpect(b, "req.bodylen", strconv.Itoa(len(ex.ReqBody)))
+		}
+		if ex.NoResponse {
+			b.WriteString("\t# The connection closed before a response was sent\n")
+			break
+		}
+
+		args := []string{"txresp", "-status", strconv.Itoa(ex.Status)}
+		if ex.Reason != "" && safeValue(ex.Reason) {
+			args = append(args, "-reason", quote(ex.Reason))
+		}
+		if ex.RespProto != "HTTP/1.1" {
+			args = append(args, "-proto", ex.RespProto)
+		}
+		args = append(args, "-noserver") // The recorded Server header, if any, is sent as is
+		args = appendHeaders(b, args, ex.RespHeaders)
+		if ex.RespChunked {
+			args = append(args, "-chunked")
+		}
+		args = appendBody(b, args, ex.RespBody)
+		fmt.Fprintf(b, "\t%s\n", strings.Join(args, " "))
+	}
+	fmt.Fprintf(b, "} -start\n")
+}
+
+func writeClient(b *strings.Builder, n int, exchanges []Exchange) {
+	fmt.Fprintf(b, "client c%d -connect ${s%d_sock} {\n", n, n)
+	for _, ex := range exchanges {
+		args := []string{"txreq", "-method", ex.Method, "-url", quote(ex.URL)}
+		if ex.Proto != "HTTP/1.1" {
+			args = append(args, "-proto", ex.Proto)
+		}
+		// The recorded headers replace the defaults
+		args = append(args, "-nohost", "-nouseragent")
+		args = appendHeaders(b, args, ex.ReqHeaders)
+		if ex.ReqChunked {
+			args = append(args, "-chunked")
+		}
+		args = appendBody(b, args, ex.ReqBody)
+		fmt.Fprintf(b, "\t%s\n", strings.Join(args, " "))
+		if ex.NoResponse {
+			break
+		}
+
+		b.WriteString("\trxresp\n")
+		writeExpect(b, "resp.status", strconv.Itoa(ex.Status))
+		seen := make(map[string]bool)
+		for _, h := range ex.RespHeaders {
+			name := strings.ToLower(h.Name)
+			if skipHeaders[name] || seen[name] || !safeValue(h.Name) || !safeValue(h.Value) {
+				continue
+			}
+			seen[name] = true
+			writeExpect(b, "resp.http."+name, h.Value)
+		}
+		writeExpect(b, "resp.bodylen", strconv.Itoa(len(ex.RespBody)))
+	}
+	fmt.Fprintf(b, "} -run\n")
+}
+
+// writeExpect writes an expect line, or a comment if the value cannot be
+// written in a spec
+func writeExpect(b *strings.Builder, field, value string) {
+	if !safeValue(value) {
+		fmt.Fprintf(b, "\t# %s not checked: value cannot be quoted\n", field)
+		return
+	}
+	fmt.Fprintf(b, "\texpect %s == %s\n", field, quote(value))
+}
+
+// appendHeaders adds a -hdr option for each header the command does not
+// generate itself. Headers that cannot be quoted, and repeats of a header
+// (-hdr keeps one value per name), are noted in a comment.
+func appendHeaders(b *strings.Builder, args []string, headers []Header) []string {
+	seen := make(map[string]bool)
+	for _, h := range headers {
+		name := strings.ToLower(h.Name)
+		switch {
+		case skipHeaders[name]:
+			continue
+		case seen[name]:
+			fmt.Fprintf(b, "\t# Repeated header %s omitted\n", commentSafe(h.Name))
+			continue
+		case !safeValue(h.Name) || !safeValue(h.Value):
+			fmt.Fprintf(b, "\t# Header %s omitted: value cannot be quoted\n", commentSafe(h.Name))
+			continue
+		}
+		seen[name] = true
+		args = append(args, "-hdr", quote(h.Name+": "+h.Value))
+	}
+	return args
+}
+
+// appendBody adds the body as -body when it can be written inline and as
+// -bodylen otherwise
+func appendBody(b *strings.Builder, args []string, body []byte) []string {
+	switch {
+	case len(body) == 0:
+		return args
+	case len(body) <= maxInlineBody && safeValue(string(body)):
+		return append(args, "-body", quote(string(body)))
+	default:
+		fmt.Fprintf(b, "\t# Body of %d bytes replaced by a generated one\n", len(body))
+		return append(args, "-bodylen", strconv.Itoa(len(body)))
+	}
+}
+
+// safeValue reports whether s survives being quoted in a spec: the spec
+// tokenizer has no escapes, so quotes, backslashes, control characters and
+// macro references are out
+func safeValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= 0x7f || c == '"' || c == '\'' || c == '\\' {
+			return false
+		}
+	}
+	return !strings.Contains(s, "${")
+}
+
+// quote double-quotes s when it is empty or contains anything but plain
+// token characters
+func quote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t:{}#\"") {
+		return s
+	}
+	return `"` + s + `"`
+}
+
+// commentSafe keeps a string on one comment line
+func commentSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 {
+			return ' '
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// ANSI colors of result lines and log lines
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorGrey   = "\033[90m"
+)
+
+// maxNameWidth bounds the column test names are padded to, so that one
+// long name doesn't push every result line out
+const maxNameWidth = 40
+
+// nameWidth returns the width of the test name column for a run
+func nameWidth(testFiles []string) int {
+	width := 0
+	for _, testFile := range testFiles {
+		width = max(width, len(filepath.Base(testFile)))
+	}
+	return min(width, maxNameWidth)
+}
+
+// paint wraps s in an ANSI color when the run has color on
+func (r *Runner) paint(color, s string) string {
+	if !r.opts.Color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// writeLog prints a test's log, followed by a copy grouped by object with
+// GroupLogs, and with debug lines and timestamps in grey when the run has
+// color on
+func (r *Runner) writeLog(output string) {
+	if r.opts.GroupLogs && output != "" {
+		if !strings.HasSuffix(output, "\n") {
+			output += "\n"
+		}
+		output += "=== Grouped by object ===\n" + groupLog(output)
+	}
+	if !r.opts.Color {
+		r.opts.Out.Write([]byte(output))
+		return
+	}
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if strings.HasPrefix(line, "****") {
+			b.WriteString(colorGrey + strings.TrimSuffix(line, "\n") + colorReset)
+			if strings.HasSuffix(line, "\n") {
+				b.WriteByte('\n')
+			}
+			continue
+		}
+		b.WriteString(line)
+	}
+	r.opts.Out.Write([]byte(b.String()))
+}
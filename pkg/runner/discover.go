@@ -0,0 +1,252 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// Discover expands command line arguments into test files. Directories are
+// searched recursively for *.vtc files, and glob patterns may use ** to
+// match any number of directories. Other arguments are taken as file names.
+// Duplicates are dropped, keeping the first occurrence.
+func Discover(args []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, arg := range args {
+		switch {
+		case isDir(arg):
+			matches, err := walkMatching(arg, func(path string) bool {
+				return strings.HasSuffix(path, ".vtc")
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range matches {
+				add(m)
+			}
+
+		case strings.ContainsAny(arg, "*?["):
+			matches, err := Glob(arg)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no tests match %s", arg)
+			}
+			for _, m := range matches {
+				add(m)
+			}
+
+		default:
+			add(arg)
+		}
+	}
+	return files, nil
+}
+
+// Glob returns the files matching pattern, where ** matches zero or more
+// directories and * and ? do not match /
+func Glob(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	re, err := globRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk from the longest directory prefix without wildcards
+	root := "."
+	if i := strings.IndexAny(pattern, "*?["); i > 0 {
+		if dir := filepath.Dir(pattern[:i+1]); dir != "" {
+			root = dir
+		}
+	}
+	if !isDir(root) {
+		return nil, nil
+	}
+
+	return walkMatching(root, func(path string) bool {
+		return re.MatchString(filepath.ToSlash(path))
+	})
+}
+
+// globRegexp translates a glob pattern to an anchored regular expression
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	p := filepath.ToSlash(pattern)
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if strings.HasPrefix(p[i:], "**/") {
+				b.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(p[i:], "**") {
+				b.WriteString(".*")
+				i++
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(p[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid pattern %s: unterminated [", pattern)
+			}
+			class := p[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// walkMatching returns the regular files under root accepted by match, in
+// lexical order
+func walkMatching(root string, match func(path string) bool) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && match(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("searching %s: %w", root, err)
+	}
+	return files, nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Order sorts test files: "alpha" by path, "mtime" most recently modified
+// first. An empty order keeps the files as given.
+func Order(files []string, order string) error {
+	switch order {
+	case "":
+	case "alpha":
+		sort.Strings(files)
+	case "mtime":
+		mtimes := make(map[string]int64, len(files))
+		for _, f := range files {
+			if fi, err := os.Stat(f); err == nil {
+				mtimes[f] = fi.ModTime().UnixNano()
+			}
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return mtimes[files[i]] > mtimes[files[j]]
+		})
+	default:
+		return fmt.Errorf("invalid order %q (want alpha or mtime)", order)
+	}
+	return nil
+}
+
+// Shuffle reorders test files pseudo-randomly; the same seed gives the
+// same order, so a failing run can be reproduced
+func Shuffle(files []string, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(files), func(i, j int) {
+		files[i], files[j] = files[j], files[i]
+	})
+}
+
+// Info is what a test's vtest (or varnishtest) line says about it
+type Info struct {
+	Description string
+	Tags        []string
+}
+
+// ReadInfo returns the description and tags from a test's vtest (or
+// varnishtest) line
+func ReadInfo(testFile string) (Info, error) {
+	f, err := os.Open(testFile)
+	if err != nil {
+		return Info{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, keyword := range []string{"vtest", "varnishtest"} {
+			rest, ok := strings.CutPrefix(line, keyword+" ")
+			if !ok {
+				continue
+			}
+			ast, err := vtc.NewParser(strings.NewReader("vtest "+rest), nil, nil).Parse()
+			if err != nil {
+				return Info{}, err
+			}
+			if len(ast.Children) == 0 || ast.Children[0].Type != "vtest" {
+				return Info{}, nil
+			}
+			return Info{Description: ast.Children[0].Name, Tags: ast.Children[0].Tags()}, nil
+		}
+	}
+	return Info{}, scanner.Err()
+}
+
+// Describe returns the description from a test's vtest (or varnishtest)
+// line
+func Describe(testFile string) (string, error) {
+	info, err := ReadInfo(testFile)
+	return info.Description, err
+}
+
+// FilterTags keeps the tests that have one of tags (any test when tags is
+// empty) and none of skipTags. Tests that cannot be read are kept, so that
+// running them reports the error.
+func FilterTags(files, tags, skipTags []string) []string {
+	if len(tags) == 0 && len(skipTags) == 0 {
+		return files
+	}
+	var kept []string
+	for _, f := range files {
+		info, err := ReadInfo(f)
+		if err != nil || (len(tags) == 0 || hasTag(info.Tags, tags)) && !hasTag(info.Tags, skipTags) {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// hasTag reports whether any of have is in want
+func hasTag(have, want []string) bool {
+	for _, h := range have {
+		for _, w := range want {
+			if h == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.vtc", "b.txt", "h2/h2_one.vtc", "h2/deep/h2_two.vtc", "h2/deep/other.vtc"} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("vtest \"test "+name+"\"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j := func(name string) string { return filepath.Join(dir, name) }
+
+	files, err := Discover([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{j("a.vtc"), j("h2/deep/h2_two.vtc"), j("h2/deep/other.vtc"), j("h2/h2_one.vtc")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Directory: got %v, want %v", files, want)
+	}
+
+	files, err = Discover([]string{filepath.Join(dir, "**/h2*.vtc"), j("a.vtc"), j("h2/h2_one.vtc")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{j("h2/deep/h2_two.vtc"), j("h2/h2_one.vtc"), j("a.vtc")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Glob: got %v, want %v", files, want)
+	}
+
+	if _, err := Discover([]string{filepath.Join(dir, "*.none")}); err == nil {
+		t.Error("Expected an error for a glob without matches")
+	}
+
+	desc, err := Describe(j("a.vtc"))
+	if err != nil || desc != "test a.vtc" {
+		t.Errorf("Describe: got %q (%v)", desc, err)
+	}
+}
+
+func TestFilterTags(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for name, line := range map[string]string{
+		"fast.vtc":  `vtest "fast h2" -tags "h2"`,
+		"slow.vtc":  `vtest "slow h2" -tags h2,slow`,
+		"plain.vtc": `varnishtest "no tags"`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(line+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	base := func(files []string) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, filepath.Base(f))
+		}
+		return names
+	}
+
+	info, err := ReadInfo(filepath.Join(dir, "slow.vtc"))
+	if err != nil || info.Description != "slow h2" || !reflect.DeepEqual(info.Tags, []string{"h2", "slow"}) {
+		t.Errorf("ReadInfo: got %+v (%v)", info, err)
+	}
+
+	tests := []struct {
+		tags, skip []string
+		want       []string
+	}{
+		{nil, nil, []string{"fast.vtc", "plain.vtc", "slow.vtc"}},
+		{[]string{"h2"}, nil, []string{"fast.vtc", "slow.vtc"}},
+		{[]string{"h2"}, []string{"slow"}, []string{"fast.vtc"}},
+		{nil, []string{"slow"}, []string{"fast.vtc", "plain.vtc"}},
+		{[]string{"none"}, nil, nil},
+	}
+	for _, tt := range tests {
+		if got := base(FilterTags(files, tt.tags, tt.skip)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tags %v, skip %v: got %v, want %v", tt.tags, tt.skip, got, tt.want)
+		}
+	}
+}
+
+func TestOrderAndShuffle(t *testing.T) {
+	dir := t.TempDir()
+	old := writeTest(t, dir, "b.vtc", "")
+	recent := writeTest(t, dir, "a.vtc", "")
+	os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))
+
+	files := []string{old, recent}
+	if err := Order(files, "alpha"); err != nil || files[0] != recent {
+		t.Errorf("alpha: got %v (%v)", files, err)
+	}
+	files = []string{old, recent}
+	if err := Order(files, "mtime"); err != nil || files[0] != recent {
+		t.Errorf("mtime: got %v (%v)", files, err)
+	}
+	if err := Order(files, "size"); err == nil {
+		t.Error("Expected an error for an unknown order")
+	}
+
+	a := []string{"1", "2", "3", "4", "5", "6"}
+	b := append([]string(nil), a...)
+	Shuffle(a, 42)
+	Shuffle(b, 42)
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("Same seed gave different orders: %v and %v", a, b)
+	}
+}
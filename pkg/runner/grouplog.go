@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"strings"
+)
+
+// logGroup holds the lines of one logger ID in a grouped log
+type logGroup struct {
+	id    string
+	lines []string
+	ts    string // Last timestamp line added
+}
+
+// groupLog rearranges a test's log by object: the lines of each logger
+// ID (the test itself, c1, s1, ...) together, in the order the objects
+// first logged. Each group repeats the timestamps its lines came under,
+// so that the groups can still be lined up against each other.
+func groupLog(output string) string {
+	var groups []*logGroup
+	byID := make(map[string]*logGroup)
+	group := func(id string) *logGroup {
+		g, ok := byID[id]
+		if !ok {
+			g = &logGroup{id: id}
+			byID[id] = g
+			groups = append(groups, g)
+		}
+		return g
+	}
+
+	var ts string // The current timestamp line
+	var last *logGroup
+	for _, line := range strings.SplitAfter(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+
+		id, ok := logLineID(line)
+		switch {
+		case !ok:
+			// The rest of a message that spans lines
+			if last == nil {
+				last = group("")
+			}
+		case id == "dT":
+			ts = line
+			continue
+		default:
+			last = group(id)
+			if ts != "" && last.ts != ts {
+				last.lines = append(last.lines, ts)
+				last.ts = ts
+			}
+		}
+		last.lines = append(last.lines, line)
+	}
+
+	var b strings.Builder
+	for _, g := range groups {
+		if g.id != "" {
+			b.WriteString("--- " + g.id + " ---\n")
+		}
+		for _, line := range g.lines {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// logLineID returns the logger ID of a log line, which starts with a lead
+// such as "*** " and the ID
+func logLineID(line string) (string, bool) {
+	if len(line) < 6 || (line[0] != '*' && line[0] != '-') || line[4] != ' ' {
+		return "", false
+	}
+	fields := strings.Fields(line[5:])
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], true
+}
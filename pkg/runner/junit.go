@@ -0,0 +1,142 @@
+package runner
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// junitSuites is the root of a JUnit XML report
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+// junitSuite holds the tests of a run
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+// junitCase is one test. Its description and tags go in properties.
+type junitCase struct {
+	Name       string           `xml:"name,attr"`
+	Classname  string           `xml:"classname,attr"`
+	File       string           `xml:"file,attr"`
+	Time       string           `xml:"time,attr"`
+	Properties *junitProperties `xml:"properties,omitempty"`
+	Failure    *junitResult     `xml:"failure,omitempty"`
+	Error      *junitResult     `xml:"error,omitempty"`
+	Skipped    *junitResult     `xml:"skipped,omitempty"`
+}
+
+// junitProperties are the name/value pairs of a test case
+type junitProperties struct {
+	Property []junitProperty `xml:"property"`
+}
+
+// junitProperty is one name/value pair
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// junitResult is a failure, error or skip with its message
+type junitResult struct {
+	Message string `xml:"message,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the summary of a run as a JUnit XML report, the
+// format CI systems show test results in. Cancelled tests count as
+// skipped.
+func writeJUnit(w io.Writer, s Summary) error {
+	suite := junitSuite{
+		Name:     "gvtest",
+		Tests:    len(s.Tests),
+		Failures: s.Failed,
+		Errors:   s.Errors,
+		Skipped:  s.Skipped + s.Cancelled,
+		Time:     junitTime(s.Duration),
+	}
+	for _, t := range s.Tests {
+		c := junitCase{
+			Name:      t.Name,
+			Classname: strings.TrimSuffix(filepath.ToSlash(t.File), filepath.Ext(t.File)),
+			File:      t.File,
+			Time:      junitTime(t.Duration),
+		}
+		var props []junitProperty
+		if t.Description != "" {
+			props = append(props, junitProperty{Name: "description", Value: t.Description})
+		}
+		if len(t.Tags) > 0 {
+			props = append(props, junitProperty{Name: "tags", Value: strings.Join(t.Tags, ",")})
+		}
+		if props != nil {
+			c.Properties = &junitProperties{Property: props}
+		}
+		result := &junitResult{Message: t.Error, Text: strings.Join(t.SoftFailures, "\n")}
+		switch t.Status {
+		case "fail":
+			c.Failure = result
+		case "error":
+			c.Error = result
+		case "skip":
+			c.Skipped = &junitResult{Message: t.SkipReason}
+		case "cancelled":
+			c.Skipped = &junitResult{Message: "cancelled"}
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	report := junitSuites{
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Errors:   suite.Errors,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeJUnitFile replaces file with the JUnit report of a run
+func writeJUnitFile(file string, s Summary) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := writeJUnit(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// junitTime formats seconds the way JUnit reports do
+func junitTime(seconds float64) string {
+	return fmt.Sprintf("%.3f", seconds)
+}
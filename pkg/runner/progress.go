@@ -0,0 +1,105 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// progress maintains a live status line for parallel runs. Results are
+// printed above it; the line is cleared before and redrawn after each one.
+type progress struct {
+	out   io.Writer
+	mu    sync.Mutex
+	start time.Time
+	total int
+	shown bool
+	stop  chan struct{}
+	done  chan struct{}
+
+	running, passed, failed, skipped int
+}
+
+// newProgress creates the status line and starts redrawing it
+func newProgress(out io.Writer, total int) *progress {
+	p := &progress{
+		out:   out,
+		start: time.Now(),
+		total: total,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go p.tick()
+	return p
+}
+
+// started counts a test a worker picked up
+func (p *progress) started() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running++
+}
+
+// finished counts a completed test
+func (p *progress) finished(result Result) {
+	p.running--
+	if result.Cancelled() {
+		return
+	}
+	switch result.ExitCode {
+	case ExitPass:
+		p.passed++
+	case ExitSkip:
+		p.skipped++
+	default:
+		p.failed++
+	}
+}
+
+// clear erases the status line so a result can be printed in its place
+func (p *progress) clear() {
+	if p.shown {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// draw writes the status line without a trailing newline
+func (p *progress) draw() {
+	done := p.passed + p.failed + p.skipped
+	fmt.Fprintf(p.out, "\r\033[K[%d/%d] %d passed / %d failed / %d skipped / %d running  %.1fs",
+		done, p.total, p.passed, p.failed, p.skipped, p.running, time.Since(p.start).Seconds())
+	p.shown = true
+}
+
+// tick redraws the status line until summary is called, so the elapsed
+// time keeps moving while long tests run
+func (p *progress) tick() {
+	defer close(p.done)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mu.Lock()
+			p.draw()
+			p.mu.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// summary stops redrawing and replaces the status line with the final
+// counts
+func (p *progress) summary() {
+	close(p.stop)
+	<-p.done
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	fmt.Fprintf(p.out, "%d passed, %d failed, %d skipped in %.1fs\n",
+		p.passed, p.failed, p.skipped, time.Since(p.start).Seconds())
+}
@@ -0,0 +1,463 @@
+// Package runner runs VTC test files sequentially or in parallel and
+// reports their results. It holds the logic shared by the command line
+// front ends.
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// Exit codes, as used by VTest2
+const (
+	ExitPass  = 0
+	ExitFail  = 1
+	ExitSkip  = 77
+	ExitError = 2
+)
+
+// Options controls a test run
+type Options struct {
+	Verbose       bool          // Print logs of passing tests too
+	Verbosity     string        // Log levels by component, see logging.SetLevels
+	BodyExcerpt   int           // Bytes of each message body logged
+	Quiet         bool          // Print nothing but errors
+	KeepTmp       bool          // Keep temp directories
+	Jobs          int           // Number of tests run in parallel
+	Timeout       time.Duration // Per-test timeout
+	DumpAST       bool          // Dump the AST instead of running
+	IgnoreUnknown bool          // Log and skip unknown commands
+	Defines       []string      // Macros to define, as name=value
+	Progress      bool          // Live status line in parallel mode (needs a terminal)
+	FailuresLast  bool          // Hold failure logs until all tests have run
+	MaxFailures   int           // Stop after this many failed tests (0 = run all)
+	Out           io.Writer     // Where results go (default os.Stdout)
+	Color         bool          // Color result lines and grey out debug log lines
+	GroupLogs     bool          // Print test logs grouped by object instead of interleaved
+	Summary       io.Writer     // Where the JSON summary of each run goes (optional)
+	SummaryFile   string        // File the JSON summary of each run is written to (optional)
+	JUnit         string        // File the JUnit XML report of each run is written to (optional)
+	ArtifactDir   string        // Save artifacts of failed tests here (optional)
+	KeepProcesses bool          // Leave processes running when a test ends
+	Tags          []string      // Run only tests with one of these tags
+	SkipTags      []string      // Don't run tests with any of these tags
+	Chaos         *vtc.Chaos    // Seed and longest delay of -chaos (optional)
+	Strict        bool          // Fail tests that leave goroutines, listeners or open files behind
+}
+
+// Result holds the result of running a single test
+type Result struct {
+	TestFile string
+	ExitCode int
+	Output   string
+	Err      error
+	Report   vtc.TestReport
+	Elapsed  time.Duration
+}
+
+// Cancelled reports whether the test was aborted because the run stopped
+func (res Result) Cancelled() bool {
+	return errors.Is(res.Err, vtc.ErrCancelled)
+}
+
+// Runner runs test files with a fixed set of options
+type Runner struct {
+	opts     Options
+	deferred []Result // Failures whose logs are printed at the end
+	results  []Result // Finished tests of the run, for the summary
+	width    int      // Test name column of the result lines
+
+	// Per-run state for MaxFailures
+	stop     chan struct{} // Closed once MaxFailures is reached
+	failures int
+	ran      int
+}
+
+// New creates a runner
+func New(opts Options) *Runner {
+	if opts.Out == nil {
+		opts.Out = os.Stdout
+	}
+	if opts.Jobs < 1 {
+		opts.Jobs = 1
+	}
+	return &Runner{opts: opts}
+}
+
+// Run runs the test files and returns the combined exit code
+func (r *Runner) Run(testFiles []string) int {
+	logging.SetVerbose(r.opts.Verbose)
+	logging.SetBodyExcerpt(r.opts.BodyExcerpt)
+	if err := logging.SetLevels(r.opts.Verbosity); err != nil {
+		fmt.Fprintf(r.opts.Out, "Invalid verbosity: %v\n", err)
+		return ExitError
+	}
+	r.stop = make(chan struct{})
+	r.failures, r.ran = 0, 0
+	r.results = nil
+	start := time.Now()
+	testFiles = FilterTags(testFiles, r.opts.Tags, r.opts.SkipTags)
+	r.width = nameWidth(testFiles)
+
+	var exitCode int
+	if r.opts.Jobs <= 1 || r.opts.DumpAST {
+		exitCode = r.runSequential(testFiles)
+	} else {
+		exitCode = r.runParallel(testFiles, r.opts.Jobs)
+	}
+	r.flushFailures()
+	if r.stopped() && !r.opts.Quiet {
+		fmt.Fprintf(r.opts.Out, "Stopped after %d failures, %d tests not run\n",
+			r.failures, len(testFiles)-r.ran)
+	}
+	if r.opts.Chaos != nil && !r.opts.Quiet {
+		fmt.Fprintf(r.opts.Out, "Chaos seed %d; repeat with -chaos-seed %d\n", r.opts.Chaos.Seed, r.opts.Chaos.Seed)
+	}
+	if r.opts.Summary == nil && r.opts.SummaryFile == "" && r.opts.JUnit == "" {
+		return exitCode
+	}
+	summary := summarize(r.results, len(testFiles), time.Since(start), exitCode)
+	if r.opts.Chaos != nil {
+		summary.ChaosSeed = r.opts.Chaos.Seed
+	}
+	if r.opts.Summary != nil {
+		if err := writeSummary(r.opts.Summary, summary); err != nil {
+			fmt.Fprintf(r.opts.Out, "Writing the summary failed: %v\n", err)
+			exitCode = ExitError
+		}
+	}
+	if r.opts.SummaryFile != "" {
+		if err := writeSummaryFile(r.opts.SummaryFile, summary); err != nil {
+			fmt.Fprintf(r.opts.Out, "Writing the summary failed: %v\n", err)
+			exitCode = ExitError
+		}
+	}
+	if r.opts.JUnit != "" {
+		if err := writeJUnitFile(r.opts.JUnit, summary); err != nil {
+			fmt.Fprintf(r.opts.Out, "Writing the JUnit report failed: %v\n", err)
+			exitCode = ExitError
+		}
+	}
+	return exitCode
+}
+
+// record keeps a finished test for the summary, counts it and stops the
+// run once MaxFailures is reached. Only the goroutine collecting results
+// calls it.
+func (r *Runner) record(result Result) {
+	r.results = append(r.results, result)
+	if result.Cancelled() {
+		return
+	}
+	r.ran++
+	if result.ExitCode != ExitFail && result.ExitCode != ExitError {
+		return
+	}
+	r.failures++
+	if r.opts.MaxFailures > 0 && r.failures >= r.opts.MaxFailures && !r.stopped() {
+		close(r.stop)
+	}
+}
+
+// stopped reports whether MaxFailures has been reached
+func (r *Runner) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// runSequential runs tests one after the other
+func (r *Runner) runSequential(testFiles []string) int {
+	exitCode := ExitPass
+	for _, testFile := range testFiles {
+		if r.stopped() {
+			break
+		}
+		result := r.RunTest(testFile)
+		r.Display(result)
+		r.record(result)
+		exitCode = Combine(exitCode, result.ExitCode)
+	}
+	return exitCode
+}
+
+// runParallel runs tests using a worker pool
+func (r *Runner) runParallel(testFiles []string, numWorkers int) int {
+	// Create channels for work distribution and result collection
+	testChan := make(chan string)
+	resultChan := make(chan Result, len(testFiles))
+
+	var p *progress
+	if r.opts.Progress && !r.opts.Quiet {
+		p = newProgress(r.opts.Out, len(testFiles))
+	}
+
+	// Start worker pool
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for testFile := range testChan {
+				if r.stopped() {
+					continue
+				}
+				if p != nil {
+					p.started()
+				}
+				resultChan <- r.RunTest(testFile)
+			}
+		}()
+	}
+
+	// Send test files to workers until the run is stopped
+	go func() {
+		defer close(testChan)
+		for _, testFile := range testFiles {
+			select {
+			case testChan <- testFile:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+
+	// Wait for all workers to complete
+	go func() {
+		wg.Wait()
+		close(resultChan)
+	}()
+
+	// Collect and display results; each test's log is printed in one piece
+	// once it has finished
+	exitCode := ExitPass
+	for result := range resultChan {
+		if p != nil {
+			p.mu.Lock()
+			p.clear()
+			r.Display(result)
+			p.finished(result)
+			p.draw()
+			p.mu.Unlock()
+		} else {
+			r.Display(result)
+		}
+		r.record(result)
+		if !result.Cancelled() {
+			exitCode = Combine(exitCode, result.ExitCode)
+		}
+	}
+	if p != nil {
+		p.summary()
+	}
+	return exitCode
+}
+
+// flushFailures prints the logs held back by FailuresLast
+func (r *Runner) flushFailures() {
+	if len(r.deferred) == 0 {
+		return
+	}
+	fmt.Fprintf(r.opts.Out, "\n%d failed tests:\n", len(r.deferred))
+	for _, result := range r.deferred {
+		fmt.Fprintf(r.opts.Out, "\n=== %s ===\n", result.TestFile)
+		r.writeLog(result.Output)
+	}
+	r.deferred = nil
+}
+
+// Combine merges two exit codes with priority error > fail > skip > pass
+func Combine(a, b int) int {
+	rank := func(code int) int {
+		switch code {
+		case ExitError:
+			return 3
+		case ExitFail:
+			return 2
+		case ExitSkip:
+			return 1
+		default:
+			return 0
+		}
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
+
+// RunTest runs a single test file and captures its log output
+func (r *Runner) RunTest(testFile string) Result {
+	// Create logger
+	testName := filepath.Base(testFile)
+	logger := logging.NewLogger(testName)
+
+	// The log of each test goes to its own output, as tests may run at
+	// the same time
+	output := logging.NewOutput()
+	logger.SetOutput(output)
+
+	if !r.opts.Quiet {
+		logger.Info("Running test: %s", testFile)
+	}
+
+	// Create macro store with default macros
+	macros := vtc.NewMacroStore()
+	vtc.SetupDefaultMacros(macros, testFile)
+	for _, def := range r.opts.Defines {
+		name, value, _ := strings.Cut(def, "=")
+		macros.Define(name, value)
+	}
+
+	// If just dumping AST, do that
+	if r.opts.DumpAST {
+		ast, err := vtc.ParseTestFileWithComments(testFile, logger, macros)
+		if err != nil {
+			logger.Error("Parse error: %v", err)
+			return Result{TestFile: testFile, ExitCode: ExitError, Err: err, Output: output.String()}
+		}
+		if err := vtc.DumpASTJSON(r.opts.Out, ast); err != nil {
+			return Result{TestFile: testFile, ExitCode: ExitError, Err: err}
+		}
+		return Result{TestFile: testFile, ExitCode: ExitPass}
+	}
+
+	// Run the test
+	start := time.Now()
+	code, report, err := vtc.RunTestWithReport(testFile, logger, macros, vtc.RunOptions{
+		KeepTmp:       r.opts.KeepTmp,
+		Timeout:       r.opts.Timeout,
+		IgnoreUnknown: r.opts.IgnoreUnknown,
+		Cancel:        r.stop,
+		ArtifactDir:   r.opts.ArtifactDir,
+		KeepProcesses: r.opts.KeepProcesses,
+		Chaos:         r.opts.Chaos,
+		Strict:        r.opts.Strict,
+	})
+
+	if err != nil && !errors.Is(err, vtc.ErrCancelled) {
+		switch code {
+		case ExitFail:
+			logger.Error("Test failed: %v", err)
+		case ExitError:
+			logger.Error("Test error: %v", err)
+		}
+	}
+
+	return Result{
+		TestFile: testFile,
+		ExitCode: code,
+		Output:   output.String(),
+		Err:      err,
+		Report:   report,
+		Elapsed:  time.Since(start),
+	}
+}
+
+// Display outputs the result of a test
+func (r *Runner) Display(result Result) {
+	out := r.opts.Out
+	testName := filepath.Base(result.TestFile)
+	if r.opts.DumpAST && result.ExitCode == ExitPass {
+		return
+	}
+
+	elapsed := fmt.Sprintf("%.2fs", result.Elapsed.Seconds())
+	if result.Cancelled() {
+		if !r.opts.Quiet {
+			r.resultLine(colorYellow, "⊘", testName, "cancelled", "")
+		}
+		return
+	}
+
+	switch result.ExitCode {
+	case ExitPass:
+		if !r.opts.Quiet {
+			r.resultLine(colorGreen, "✓", testName, elapsed, reportSuffix(result.Report))
+			printReport(out, result.Report)
+		}
+		// Print logs in verbose mode
+		if r.opts.Verbose && result.Output != "" {
+			r.writeLog(result.Output)
+		}
+	case ExitSkip:
+		if !r.opts.Quiet {
+			r.resultLine(colorYellow, "⊘", testName, "skipped", "")
+		}
+		if r.opts.Verbose && result.Output != "" {
+			r.writeLog(result.Output)
+		}
+	case ExitFail:
+		if !r.opts.Quiet {
+			r.resultLine(colorRed, "✗", testName, elapsed, reportSuffix(result.Report))
+			printReport(out, result.Report)
+		}
+		// Always print logs on failure (unless quiet)
+		r.printFailureLog(result)
+	case ExitError:
+		if !r.opts.Quiet {
+			r.resultLine(colorRed, "✗", testName, "error", "")
+		}
+		// Always print logs on error (unless quiet)
+		r.printFailureLog(result)
+	}
+}
+
+// printFailureLog prints a failed test's log, or holds it for the end of
+// the run with FailuresLast
+func (r *Runner) printFailureLog(result Result) {
+	if r.opts.Quiet || result.Output == "" {
+		return
+	}
+	if r.opts.FailuresLast {
+		r.deferred = append(r.deferred, result)
+		return
+	}
+	r.writeLog(result.Output)
+}
+
+// resultLine prints a test's result with its name padded to the run's
+// name column, so that the status (its time, or why it has none) lines up
+func (r *Runner) resultLine(color, mark, name, status, suffix string) {
+	line := fmt.Sprintf("%s %-*s  %s", mark, r.width, name, status)
+	fmt.Fprintf(r.opts.Out, "%s%s\n", r.paint(color, line), suffix)
+}
+
+// reportSuffix summarizes non-fatal failures and skipped commands for the
+// result line
+func reportSuffix(report vtc.TestReport) string {
+	var notes []string
+	if n := len(report.SoftFailures); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d non-fatal failures", n))
+	}
+	if n := len(report.SkippedCommands); n > 0 {
+		notes = append(notes, fmt.Sprintf("%d unknown commands skipped", n))
+	}
+	if len(notes) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(notes, ", ") + ")"
+}
+
+// printReport lists the failures recorded under non_fatal and the unknown
+// commands that were skipped
+func printReport(out io.Writer, report vtc.TestReport) {
+	for _, f := range report.SoftFailures {
+		fmt.Fprintf(out, "    ! %s\n", f)
+	}
+	if len(report.SkippedCommands) > 0 {
+		fmt.Fprintf(out, "    skipped: %s\n", strings.Join(report.SkippedCommands, ", "))
+	}
+}
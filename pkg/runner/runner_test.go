@@ -0,0 +1,376 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+func init() {
+	vtc.RegisterBuiltinCommands()
+}
+
+func writeTest(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRun_SequentialAndParallel(t *testing.T) {
+	dir := t.TempDir()
+	pass := writeTest(t, dir, "pass.vtc", "vtest \"pass\"\nshell -expect world {echo ${who}}\n")
+	fail := writeTest(t, dir, "fail.vtc", "vtest \"fail\"\nshell -exit 0 {exit 1}\n")
+	skip := writeTest(t, dir, "skip.vtc", "vtest \"skip\"\nfeature cmd no-such-command-here\n")
+
+	for _, jobs := range []int{1, 3} {
+		var out bytes.Buffer
+		r := New(Options{Jobs: jobs, Timeout: 10 * time.Second, Defines: []string{"who=world"}, Out: &out})
+
+		if code := r.Run([]string{pass, skip}); code != ExitSkip {
+			t.Errorf("jobs=%d: expected exit %d for pass+skip, got %d", jobs, ExitSkip, code)
+		}
+		if code := r.Run([]string{pass, fail, skip}); code != ExitFail {
+			t.Errorf("jobs=%d: expected exit %d with a failure, got %d", jobs, ExitFail, code)
+		}
+
+		for _, want := range []string{"✓ pass.vtc  0.", "⊘ skip.vtc  skipped", "✗ fail.vtc  0.", "Test failed"} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("jobs=%d: output missing %q:\n%s", jobs, want, out.String())
+			}
+		}
+	}
+}
+
+func TestRun_ParallelLogs(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 1; i <= 6; i++ {
+		files = append(files, writeTest(t, dir, fmt.Sprintf("ok%d.vtc", i), fmt.Sprintf("vtest \"ok %d\"\ndelay 0.1\nshell {true}\n", i)))
+	}
+	files = append(files, writeTest(t, dir, "fail.vtc", "vtest \"fail\"\ndelay 0.05\nshell -exit 0 {exit 1}\n"))
+
+	var out bytes.Buffer
+	r := New(Options{Jobs: 7, Timeout: 10 * time.Second, Out: &out})
+	if code := r.Run(files); code != ExitFail {
+		t.Fatalf("Expected exit %d, got %d", ExitFail, code)
+	}
+	// The log of the failed test is its own, whole
+	s := out.String()
+	if !strings.Contains(s, "Test: fail") || !strings.Contains(s, "Test failed") {
+		t.Errorf("Expected the whole log of fail.vtc:\n%s", s)
+	}
+	if strings.Contains(s, "Test: ok") {
+		t.Errorf("Expected no lines of the passed tests:\n%s", s)
+	}
+}
+
+func TestCombine(t *testing.T) {
+	tests := []struct{ a, b, want int }{
+		{ExitPass, ExitSkip, ExitSkip},
+		{ExitSkip, ExitPass, ExitSkip},
+		{ExitFail, ExitSkip, ExitFail},
+		{ExitFail, ExitError, ExitError},
+		{ExitError, ExitFail, ExitError},
+	}
+	for _, tt := range tests {
+		if got := Combine(tt.a, tt.b); got != tt.want {
+			t.Errorf("Combine(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestRun_FailuresLastAndProgress(t *testing.T) {
+	dir := t.TempDir()
+	fail := writeTest(t, dir, "fail.vtc", "vtest \"fail\"\nshell -exit 0 {exit 1}\n")
+	pass := writeTest(t, dir, "pass.vtc", "vtest \"pass\"\n")
+
+	var out bytes.Buffer
+	r := New(Options{Jobs: 2, Timeout: 10 * time.Second, FailuresLast: true, Progress: true, Out: &out})
+	if code := r.Run([]string{fail, pass}); code != ExitFail {
+		t.Fatalf("Expected exit %d, got %d", ExitFail, code)
+	}
+
+	s := out.String()
+	logAt := strings.Index(s, "=== "+fail+" ===")
+	if logAt < 0 || logAt < strings.Index(s, "✓ pass.vtc") || logAt < strings.Index(s, "✗ fail.vtc") {
+		t.Errorf("Expected the failure log after all result lines:\n%s", s)
+	}
+	if !strings.Contains(s, "1 passed, 1 failed, 0 skipped in") {
+		t.Errorf("Expected a final summary line:\n%s", s)
+	}
+}
+
+func TestRun_MaxFailures(t *testing.T) {
+	dir := t.TempDir()
+	fail := writeTest(t, dir, "fail.vtc", "vtest \"fail\"\nshell -exit 0 {exit 1}\n")
+	slow := writeTest(t, dir, "slow.vtc", "vtest \"slow\"\ndelay 0.5\nshell {true}\n")
+	var more []string
+	for i := 0; i < 5; i++ {
+		more = append(more, writeTest(t, dir, "pass"+strconv.Itoa(i)+".vtc", "vtest \"pass\"\n"))
+	}
+
+	var out bytes.Buffer
+	r := New(Options{Jobs: 1, Timeout: 10 * time.Second, MaxFailures: 1, Out: &out})
+	if code := r.Run(append([]string{fail}, more...)); code != ExitFail {
+		t.Errorf("Expected exit %d, got %d", ExitFail, code)
+	}
+	if strings.Contains(out.String(), "pass0.vtc") || !strings.Contains(out.String(), "5 tests not run") {
+		t.Errorf("Expected the run to stop after the first failure:\n%s", out.String())
+	}
+
+	// The slow test starts alongside the failing one and is cancelled
+	out.Reset()
+	r = New(Options{Jobs: 2, Timeout: 10 * time.Second, MaxFailures: 1, Out: &out})
+	if code := r.Run(append([]string{slow, fail}, more...)); code != ExitFail {
+		t.Errorf("Expected exit %d, got %d", ExitFail, code)
+	}
+	if !strings.Contains(out.String(), "⊘ slow.vtc   cancelled") {
+		t.Errorf("Expected the running test to be cancelled:\n%s", out.String())
+	}
+}
+
+func TestRun_Timeout(t *testing.T) {
+	dir := t.TempDir()
+	// The barrier would wait for its 30s timeout without the test's
+	hang := writeTest(t, dir, "hang.vtc", "vtest \"hang\"\nbarrier b1 cond 2\nbarrier b1 sync\n")
+
+	var out bytes.Buffer
+	r := New(Options{Jobs: 1, Timeout: 200 * time.Millisecond, Out: &out})
+	start := time.Now()
+	if code := r.Run([]string{hang}); code != ExitFail {
+		t.Errorf("Expected exit %d, got %d", ExitFail, code)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the timeout to end the test, took %v", elapsed)
+	}
+	if !strings.Contains(out.String(), "test timed out after 200ms") {
+		t.Errorf("Expected a timeout error:\n%s", out.String())
+	}
+}
+
+func TestRun_ExpectTestFail(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name, body string
+		want       int
+	}{
+		{"syntax.vtc", "vtest \"bad syntax\"\nexpect_test_fail \"unterminated string\"\nshell \"oops\n", ExitPass},
+		{"fails.vtc", "vtest \"fails\"\nexpect_test_fail {exit code 0, got 1}\nshell -exit 0 {exit 1}\n", ExitPass},
+		{"any.vtc", "vtest \"any\"\nexpect_test_fail\nshell -exit 0 {exit 1}\n", ExitPass},
+		{"other.vtc", "vtest \"other\"\nexpect_test_fail \"timed out\"\nshell -exit 0 {exit 1}\n", ExitFail},
+		{"passes.vtc", "vtest \"passes\"\nexpect_test_fail\nshell {true}\n", ExitFail},
+		{"heredoc.vtc", "vtest \"heredoc\"\nsetvar doc <<EOF\nexpect_test_fail\nEOF\nshell {true}\n", ExitPass},
+		{"nested.vtc", "vtest \"nested\"\nspec t1 {\n\tshell {\n\t\texpect_test_fail\n\t}\n}\nshell {true}\n", ExitPass},
+		{"quoted.vtc", "vtest \"quoted\"\nshell \"echo {\"\nexpect_test_fail\nshell -exit 0 {exit 1}\n", ExitPass},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		r := New(Options{Jobs: 1, Timeout: 10 * time.Second, Out: &out})
+		if code := r.Run([]string{writeTest(t, dir, tt.name, tt.body)}); code != tt.want {
+			t.Errorf("%s: expected exit %d, got %d:\n%s", tt.name, tt.want, code, out.String())
+		}
+	}
+}
+
+func TestDisplay_Color(t *testing.T) {
+	result := Result{
+		TestFile: "dir/pass.vtc",
+		ExitCode: ExitPass,
+		Output:   "***  c1    info\n**** c1    debug\n",
+		Elapsed:  1500 * time.Millisecond,
+	}
+
+	var out bytes.Buffer
+	r := New(Options{Verbose: true, Out: &out})
+	r.width = 10
+	r.Display(result)
+	want := "✓ pass.vtc    1.50s\n" + result.Output
+	if out.String() != want {
+		t.Errorf("Expected plain output %q, got %q", want, out.String())
+	}
+
+	out.Reset()
+	r.opts.Color = true
+	r.Display(result)
+	want = colorGreen + "✓ pass.vtc    1.50s" + colorReset + "\n" +
+		"***  c1    info\n" + colorGrey + "**** c1    debug" + colorReset + "\n"
+	if out.String() != want {
+		t.Errorf("Expected colored output %q, got %q", want, out.String())
+	}
+}
+
+func TestRun_Summary(t *testing.T) {
+	dir := t.TempDir()
+	pass := writeTest(t, dir, "pass.vtc", "vtest \"pass\" -tags fast\n")
+	fail := writeTest(t, dir, "fail.vtc", "vtest \"fail\"\nshell -exit 0 {exit 1}\n")
+	skip := writeTest(t, dir, "skip.vtc", "vtest \"skip\"\nfeature cmd no-such-command-here\n")
+
+	var out, js bytes.Buffer
+	r := New(Options{Timeout: 10 * time.Second, Out: &out, Summary: &js})
+	if code := r.Run([]string{pass, fail, skip}); code != ExitFail {
+		t.Errorf("Expected exit %d, got %d", ExitFail, code)
+	}
+
+	var s Summary
+	if err := json.Unmarshal(js.Bytes(), &s); err != nil {
+		t.Fatalf("Invalid summary %q: %v", js.String(), err)
+	}
+	if s.Passed != 1 || s.Failed != 1 || s.Skipped != 1 || s.ExitCode != ExitFail || len(s.Tests) != 3 {
+		t.Fatalf("Unexpected summary: %+v", s)
+	}
+	byName := make(map[string]TestSummary)
+	for _, test := range s.Tests {
+		byName[test.Name] = test
+	}
+	if got := byName["pass.vtc"]; got.Status != "pass" || got.Description != "pass" || len(got.Tags) != 1 {
+		t.Errorf("Unexpected pass entry: %+v", got)
+	}
+	if got := byName["fail.vtc"]; got.Status != "fail" || !strings.Contains(got.Error, "expected exit code 0") {
+		t.Errorf("Unexpected fail entry: %+v", got)
+	}
+	if got := byName["skip.vtc"]; got.Status != "skip" || !strings.Contains(got.SkipReason, "no-such-command-here") {
+		t.Errorf("Unexpected skip entry: %+v", got)
+	}
+}
+
+func TestRun_SummaryFile(t *testing.T) {
+	dir := t.TempDir()
+	pass := writeTest(t, dir, "pass.vtc", "vtest \"pass\"\n")
+	file := filepath.Join(dir, "summary.json")
+
+	var out bytes.Buffer
+	r := New(Options{Timeout: 10 * time.Second, Out: &out, SummaryFile: file})
+	for range 2 {
+		if code := r.Run([]string{pass}); code != ExitPass {
+			t.Errorf("Expected exit %d, got %d", ExitPass, code)
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Summary
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatalf("Invalid summary (rewritten for each run?) %q: %v", data, err)
+	}
+	if s.Passed != 1 || len(s.Tests) != 1 {
+		t.Errorf("Unexpected summary: %+v", s)
+	}
+}
+
+func TestRun_JUnit(t *testing.T) {
+	dir := t.TempDir()
+	pass := writeTest(t, dir, "pass.vtc", "vtest \"fast pass\" -tags fast,h1\n")
+	fail := writeTest(t, dir, "fail.vtc", "vtest \"fail\"\nshell -exit 0 {exit 1}\n")
+	skip := writeTest(t, dir, "skip.vtc", "vtest \"skip\"\nfeature cmd no-such-command-here\n")
+	report := filepath.Join(dir, "junit.xml")
+
+	var out bytes.Buffer
+	r := New(Options{Timeout: 10 * time.Second, Out: &out, JUnit: report})
+	for range 2 {
+		if code := r.Run([]string{pass, fail, skip}); code != ExitFail {
+			t.Errorf("Expected exit %d, got %d", ExitFail, code)
+		}
+	}
+
+	data, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal(data, &suites); err != nil {
+		t.Fatalf("Invalid report %q: %v", data, err)
+	}
+	if len(suites.Suites) != 1 || suites.Tests != 3 || suites.Failures != 1 || suites.Skipped != 1 {
+		t.Fatalf("Unexpected report (rewritten for each run?):\n%s", data)
+	}
+	for _, c := range suites.Suites[0].Cases {
+		switch c.Name {
+		case "pass.vtc":
+			want := &junitProperties{[]junitProperty{{"description", "fast pass"}, {"tags", "fast,h1"}}}
+			if !reflect.DeepEqual(c.Properties, want) || c.Failure != nil {
+				t.Errorf("Unexpected pass case: %+v", c)
+			}
+		case "fail.vtc":
+			if c.Failure == nil || !strings.Contains(c.Failure.Message, "expected exit code 0") {
+				t.Errorf("Unexpected fail case: %+v", c)
+			}
+		case "skip.vtc":
+			if c.Skipped == nil || !strings.Contains(c.Skipped.Message, "no-such-command-here") {
+				t.Errorf("Unexpected skip case: %+v", c)
+			}
+		}
+	}
+}
+
+func TestRun_Chaos(t *testing.T) {
+	dir := t.TempDir()
+	fail := writeTest(t, dir, "fail.vtc", "vtest \"fail\"\nshell -exit 0 {exit 1}\n")
+
+	var out, js bytes.Buffer
+	r := New(Options{Timeout: 10 * time.Second, Out: &out, Summary: &js, Chaos: vtc.NewChaos(42, time.Millisecond)})
+	if code := r.Run([]string{fail}); code != ExitFail {
+		t.Errorf("Expected exit %d, got %d", ExitFail, code)
+	}
+	for _, want := range []string{"Chaos mode: delays of up to 1ms with seed 42", "Chaos seed 42; repeat with -chaos-seed 42"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in output:\n%s", want, out.String())
+		}
+	}
+	var s Summary
+	if err := json.Unmarshal(js.Bytes(), &s); err != nil || s.ChaosSeed != 42 {
+		t.Errorf("Expected chaos_seed 42 in summary %q (%v)", js.String(), err)
+	}
+}
+
+func TestGroupLog(t *testing.T) {
+	log := "**** dT    0.000\n" +
+		"***  t.vtc Test: grouped\n" +
+		"**   s1    Starting server s1\n" +
+		"**** dT    0.001\n" +
+		"***  c1    txreq: GET /\n" +
+		"***  s1    rxreq: GET /\n" +
+		"continued\n" +
+		"*    t.vtc Test failed\n"
+
+	want := "--- t.vtc ---\n" +
+		"**** dT    0.000\n" +
+		"***  t.vtc Test: grouped\n" +
+		"**** dT    0.001\n" +
+		"*    t.vtc Test failed\n" +
+		"--- s1 ---\n" +
+		"**** dT    0.000\n" +
+		"**   s1    Starting server s1\n" +
+		"**** dT    0.001\n" +
+		"***  s1    rxreq: GET /\n" +
+		"continued\n" +
+		"--- c1 ---\n" +
+		"**** dT    0.001\n" +
+		"***  c1    txreq: GET /\n"
+	if got := groupLog(log); got != want {
+		t.Errorf("Unexpected grouped log:\n%s\nwant:\n%s", got, want)
+	}
+
+	// The interleaved log is kept, with the grouped copy after it
+	var out bytes.Buffer
+	r := New(Options{Out: &out, GroupLogs: true})
+	r.writeLog(log)
+	if got := out.String(); got != log+"=== Grouped by object ===\n"+want {
+		t.Errorf("Unexpected printed log:\n%s", got)
+	}
+}
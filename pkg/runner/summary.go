@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Summary is the machine-readable outcome of a run, written as JSON to
+// Options.Summary and Options.SummaryFile once all tests are done
+type Summary struct {
+	Tests     []TestSummary `json:"tests"`
+	Passed    int           `json:"passed"`
+	Failed    int           `json:"failed"`
+	Skipped   int           `json:"skipped"`
+	Errors    int           `json:"errors"`
+	Cancelled int           `json:"cancelled"`
+	NotRun    int           `json:"not_run"`  // Left out after MaxFailures was reached
+	Duration  float64       `json:"duration"` // Seconds
+	ExitCode  int           `json:"exit_code"`
+	ChaosSeed int64         `json:"chaos_seed,omitempty"` // Seed of -chaos, if the run used it
+}
+
+// TestSummary is the outcome of one test in a Summary
+type TestSummary struct {
+	File            string   `json:"file"`
+	Name            string   `json:"name"`
+	Description     string   `json:"description,omitempty"`
+	Tags            []string `json:"tags,omitempty"`
+	Status          string   `json:"status"` // pass, fail, skip, error or cancelled
+	ExitCode        int      `json:"exit_code"`
+	Duration        float64  `json:"duration"` // Seconds
+	SkipReason      string   `json:"skip_reason,omitempty"`
+	Error           string   `json:"error,omitempty"`
+	SoftFailures    []string `json:"soft_failures,omitempty"`
+	SkippedCommands []string `json:"skipped_commands,omitempty"`
+}
+
+// Status names the outcome of a test: pass, fail, skip, error or cancelled
+func (res Result) Status() string {
+	if res.Cancelled() {
+		return "cancelled"
+	}
+	switch res.ExitCode {
+	case ExitPass:
+		return "pass"
+	case ExitSkip:
+		return "skip"
+	case ExitFail:
+		return "fail"
+	}
+	return "error"
+}
+
+// summarize builds the summary of a run from its results
+func summarize(results []Result, total int, elapsed time.Duration, exitCode int) Summary {
+	s := Summary{
+		Tests:    make([]TestSummary, 0, len(results)),
+		NotRun:   total - len(results),
+		Duration: elapsed.Seconds(),
+		ExitCode: exitCode,
+	}
+	for _, res := range results {
+		t := TestSummary{
+			File:            res.TestFile,
+			Name:            filepath.Base(res.TestFile),
+			Description:     res.Report.Description,
+			Tags:            res.Report.Tags,
+			Status:          res.Status(),
+			ExitCode:        res.ExitCode,
+			Duration:        res.Elapsed.Seconds(),
+			SkipReason:      res.Report.SkipReason,
+			SoftFailures:    res.Report.SoftFailures,
+			SkippedCommands: res.Report.SkippedCommands,
+		}
+		if res.Err != nil {
+			t.Error = res.Err.Error()
+		}
+		s.Tests = append(s.Tests, t)
+
+		switch t.Status {
+		case "pass":
+			s.Passed++
+		case "skip":
+			s.Skipped++
+		case "fail":
+			s.Failed++
+		case "cancelled":
+			s.Cancelled++
+		default:
+			s.Errors++
+		}
+	}
+	return s
+}
+
+// writeSummary writes the summary as indented JSON
+func writeSummary(w io.Writer, s Summary) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// writeSummaryFile replaces file with the summary of a run, so that with
+// -watch it holds the latest run only
+func writeSummaryFile(file string, s Summary) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := writeSummary(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,87 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultWatchInterval is how often Watch checks the tests for changes
+const DefaultWatchInterval = 500 * time.Millisecond
+
+// fileStamp identifies a version of a test file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watch runs the tests returned by discover, then polls them every
+// interval and re-runs the ones that were added or modified, until stop is
+// closed. Tests are discovered again on every poll, so new files in a
+// watched directory are picked up. discover decides the order the tests
+// run in; the tag filters of the Options apply as they do for Run.
+func (r *Runner) Watch(discover func() ([]string, error), interval time.Duration, stop <-chan struct{}) error {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	files, err := r.watchFiles(discover)
+	if err != nil {
+		return err
+	}
+	stamps := stampFiles(files)
+	r.Run(files)
+	fmt.Fprintf(r.opts.Out, "Watching %d tests for changes\n", len(files))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+
+		files, err := r.watchFiles(discover)
+		if err != nil {
+			// Files may be mid-rename while an editor saves them
+			continue
+		}
+		current := stampFiles(files)
+
+		var changed []string
+		for _, f := range files {
+			if stamp, ok := current[f]; ok && stamp != stamps[f] {
+				changed = append(changed, f)
+			}
+		}
+		stamps = current
+		if len(changed) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(r.opts.Out, "\n--- %s: %d changed\n", time.Now().Format("15:04:05"), len(changed))
+		r.Run(changed)
+	}
+}
+
+// watchFiles discovers the tests and keeps the ones the tag filters select
+func (r *Runner) watchFiles(discover func() ([]string, error)) ([]string, error) {
+	files, err := discover()
+	if err != nil {
+		return nil, err
+	}
+	return FilterTags(files, r.opts.Tags, r.opts.SkipTags), nil
+}
+
+// stampFiles records the modification time and size of each file that
+// exists
+func stampFiles(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			stamps[f] = fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+		}
+	}
+	return stamps
+}
@@ -0,0 +1,101 @@
+package runner
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the watcher and test to share
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch_RerunsChangedTests(t *testing.T) {
+	dir := t.TempDir()
+	test := writeTest(t, dir, "w.vtc", "vtest \"w\"\n")
+
+	out := &syncBuffer{}
+	r := New(Options{Timeout: 10 * time.Second, Out: out})
+	stop := make(chan struct{})
+	done := make(chan error)
+	discover := func() ([]string, error) { return Discover([]string{dir}) }
+	go func() { done <- r.Watch(discover, 20*time.Millisecond, stop) }()
+
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(out.String(), want) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %q:\n%s", want, out.String())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitFor("Watching 1 tests")
+	if err := os.WriteFile(test, []byte("vtest \"w\"\nshell -exit 0 {false}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("✗ w.vtc")
+	writeTest(t, dir, "new.vtc", "vtest \"new\"\n")
+	waitFor("✓ new.vtc")
+
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("Watch returned %v", err)
+	}
+}
+
+func TestWatch_OrderAndFilters(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTest(t, dir, "a.vtc", "vtest \"a\"\n")
+	b := writeTest(t, dir, "b.vtc", "vtest \"b\"\n")
+	slow := writeTest(t, dir, "slow.vtc", "vtest \"slow\" -tags slow\n")
+
+	out := &syncBuffer{}
+	r := New(Options{Timeout: 10 * time.Second, Out: out, SkipTags: []string{"slow"}})
+	stop := make(chan struct{})
+	done := make(chan error)
+	discover := func() ([]string, error) { return []string{b, slow, a}, nil }
+	go func() { done <- r.Watch(discover, 20*time.Millisecond, stop) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "Watching") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the first run:\n%s", out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Errorf("Watch returned %v", err)
+	}
+
+	got := out.String()
+	if !strings.Contains(got, "Watching 2 tests") {
+		t.Errorf("Skipped test counted as watched:\n%s", got)
+	}
+	if strings.Contains(got, "slow.vtc") {
+		t.Errorf("Skipped test ran:\n%s", got)
+	}
+	if ia, ib := strings.Index(got, "a.vtc"), strings.Index(got, "b.vtc"); ia < 0 || ib < 0 || ib > ia {
+		t.Errorf("Tests did not run in discovery order:\n%s", got)
+	}
+}
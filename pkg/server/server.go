@@ -3,9 +3,12 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
 	gnet "github.com/perbu/GTest/pkg/net"
@@ -22,39 +25,72 @@ type Server struct {
 	Logger     *logging.Logger
 	Session    *session.Session
 	Spec       string
-	Listen     string
-	Depth      int // Listen backlog depth
+	Listen     string // Address listened on: as set, or as bound once started
+	Depth      int    // Listen backlog depth (0 = system default)
 	Listener   net.Listener
 	Addr       string
 	Port       string
 	Running    bool
 	IsDispatch bool
-	macros     *vtc.MacroStore
+	// SpecPerConn expands macros in the spec for each dispatched
+	// connection, with ${conn_seq}, ${conn_worker} and ${conn_remote}
+	// defined
+	SpecPerConn bool
+
+	// ReusePort sets SO_REUSEPORT, so that other servers can listen on
+	// the same port
+	ReusePort bool
+	// Workers is the number of sockets listening on the port, each with
+	// its own accept loop, like a multi-process origin (0 or 1 = one)
+	Workers int
+
+	// TLS, if set, makes the server speak TLS on accepted connections
+	TLS *gnet.TLSOptions
+
+	// Accept control, for simulating misbehaving backends
+	AcceptLimit   int           // Stop accepting after this many connections (0 = no limit)
+	AcceptDelay   time.Duration // Wait before each accept()
+	CloseOnAccept bool          // Close accepted connections without reading
+
+	macros *vtc.MacroStore
 
 	// Internal
+	bind           string // Listen address as set, for when a restart can't reuse the bound one
+	tlsConfig      *tls.Config
+	listeners      []net.Listener // One per worker; Listener is the first
 	stopChan       chan struct{}
 	wg             sync.WaitGroup
 	mutex          sync.Mutex
-	connCount      int // Number of connections handled
+	connCount      int                             // Number of connections handled
+	accepted       int                             // Number of connections accepted
+	conns          map[net.Conn]*session.ConnStats // Open connections, for StopNow and conn.reused
 	connCountMutex sync.Mutex
 	stopping       bool // Track if stop has been initiated
+	ended          bool // Stopped accepting after the last connection
 	stoppingMutex  sync.Mutex
+	handoff        chan net.Conn // Connections claimed by a spec's accept command
+	session        chan struct{} // Closed when the running session is done (nil if none)
+	last           string        // Summary of the last exchange, for dump
 }
 
 // New creates a new server with the given name
 func New(logger *logging.Logger, macros *vtc.MacroStore, name string) *Server {
-	sessLogger := logging.NewLogger(name)
-	sess := session.New(sessLogger, name)
+	// The server logs under its own name, with the test's levels and
+	// fatal handling
+	logger = logger.Child(name)
+	sess := session.New(logger, name)
 
 	return &Server{
 		Name:     name,
 		Logger:   logger,
 		Session:  sess,
 		Listen:   "127.0.0.1:0", // Default to random port
-		Depth:    10,
+		bind:     "127.0.0.1:0",
+		Depth:    0,
 		Running:  false,
 		macros:   macros,
 		stopChan: make(chan struct{}),
+		handoff:  make(chan net.Conn),
 	}
 }
 
@@ -63,6 +99,7 @@ func (s *Server) SetListen(addr string) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	s.Listen = addr
+	s.bind = addr
 }
 
 // Start starts the server listening on the configured address
@@ -77,9 +114,12 @@ func (s *Server) Start(processFunc ProcessFunc) error {
 	}
 	s.mutex.Unlock()
 
-	// Reset connection counter
+	// Reset connection counters
 	s.connCountMutex.Lock()
 	s.connCount = 0
+	s.accepted = 0
+	s.conns = make(map[net.Conn]*session.ConnStats)
+	s.session = nil
 	s.connCountMutex.Unlock()
 	s.Logger.Debug("Reset connection counter for server %s", s.Name)
 
@@ -87,52 +127,96 @@ func (s *Server) Start(processFunc ProcessFunc) error {
 	s.stoppingMutex.Lock()
 	s.stopChan = make(chan struct{})
 	s.stopping = false
+	s.ended = false
 	s.stoppingMutex.Unlock()
 	s.Logger.Debug("Reset stop channel for server %s", s.Name)
 
 	s.Logger.Log(2, "Starting server %s", s.Name)
 
-	// Create listener
+	s.tlsConfig = nil
+	if s.TLS != nil {
+		config, err := gnet.ServerTLSConfig(s.TLS)
+		if err != nil {
+			return fmt.Errorf("TLS: %w", err)
+		}
+		if s.macros != nil {
+			// Called after each handshake, including resumed ones
+			config.VerifyConnection = func(state tls.ConnectionState) error {
+				for name, value := range gnet.MacroValues(&state) {
+					s.macros.DefineIn(s.Name, name, value)
+				}
+				return nil
+			}
+		}
+		s.tlsConfig = config
+	}
+
+	// Create listener. A restarted server listens on the address it was
+	// bound to before, so that its macros keep their values, unless that
+	// address has been taken meanwhile.
+	opts := gnet.ListenOptions{
+		Backlog:   s.Depth,
+		ReusePort: s.ReusePort || s.Workers > 1,
+	}
 	s.Logger.Debug("Creating listener on %s with backlog %d", s.Listen, s.Depth)
-	listener, addrInfo, err := gnet.TCPListen(s.Listen, s.Depth)
+	listener, addrInfo, err := gnet.TCPListenOpts(s.Listen, opts)
+	if err != nil && s.Listen != s.bind {
+		s.Logger.Log(2, "Cannot listen on %s again (%v), listening on %s", s.Listen, err, s.bind)
+		listener, addrInfo, err = gnet.TCPListenOpts(s.bind, opts)
+	}
 	if err != nil {
 		s.Logger.Debug("Failed to create listener: %v", err)
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
+	// The other workers listen on the port the first one bound
+	listeners := []net.Listener{listener}
+	for len(listeners) < s.Workers {
+		l, _, err := gnet.TCPListenOpts(listener.Addr().String(), opts)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("failed to listen for worker %d: %w", len(listeners)+1, err)
+		}
+		listeners = append(listeners, l)
+	}
+
 	s.Listener = listener
+	s.listeners = listeners
 	s.Addr = addrInfo.Addr
 	s.Port = addrInfo.Port
-	s.Logger.Debug("Listener created, bound to %s:%s", s.Addr, s.Port)
-
 	// Update listen address with actual bound address
-	if addrInfo.Port != "" {
-		s.Listen = fmt.Sprintf("%s:%s", s.Addr, s.Port)
+	s.Listen = addrInfo.String()
+	s.Logger.Debug("Listener created, bound to %s", s.Listen)
+
+	if len(listeners) > 1 {
+		s.Logger.Log(1, "Listen on %s (%d workers)", s.Listen, len(listeners))
 	} else {
-		s.Listen = s.Addr
+		s.Logger.Log(1, "Listen on %s", s.Listen)
 	}
 
-	s.Logger.Log(1, "Listen on %s", s.Listen)
-
 	// Define macros for the server
 	s.Logger.Debug("Defining macros for server %s", s.Name)
 	s.defineMacros()
 
 	s.Running = true
 
-	// Start accept loop in goroutine
-	s.Logger.Debug("Starting accept loop for server %s", s.Name)
-	s.wg.Add(1)
-	go s.acceptLoop(processFunc)
+	// Start an accept loop per listener
+	s.Logger.Debug("Starting accept loops for server %s", s.Name)
+	for i, l := range listeners {
+		s.wg.Add(1)
+		go s.acceptLoop(l, i+1, processFunc)
+	}
 
 	s.Logger.Debug("Server %s start completed", s.Name)
 	return nil
 }
 
-// acceptLoop handles incoming connections
-func (s *Server) acceptLoop(processFunc ProcessFunc) {
+// acceptLoop handles incoming connections on one worker's listener
+func (s *Server) acceptLoop(listener net.Listener, worker int, processFunc ProcessFunc) {
 	defer s.wg.Done()
-	s.Logger.Debug("Accept loop started for server %s", s.Name)
+	s.Logger.Debug("Accept loop %d started for server %s", worker, s.Name)
 
 	for {
 		select {
@@ -142,10 +226,15 @@ func (s *Server) acceptLoop(processFunc ProcessFunc) {
 		default:
 		}
 
+		if !s.waitAccept() {
+			s.Logger.Debug("Accept loop received stop signal for server %s", s.Name)
+			return
+		}
+
 		s.Logger.Debug("Waiting to accept connection on server %s", s.Name)
 		// Set a timeout on Accept so we can check stopChan periodically
 		// Note: We'll use the raw listener for now
-		conn, err := s.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			// Check if we're stopping
 			select {
@@ -161,21 +250,47 @@ func (s *Server) acceptLoop(processFunc ProcessFunc) {
 
 		// Log the accepted connection
 		remoteAddr := gnet.GetRemoteAddr(conn)
-		if remoteAddr.Port != "" {
-			s.Logger.Log(3, "accepted connection from %s:%s", remoteAddr.Addr, remoteAddr.Port)
-			s.Logger.Debug("Connection accepted from %s:%s on server %s", remoteAddr.Addr, remoteAddr.Port, s.Name)
+		if len(s.listeners) > 1 {
+			s.Logger.Log(3, "worker %d accepted connection from %s", worker, remoteAddr)
 		} else {
-			s.Logger.Log(3, "accepted connection from %s", remoteAddr.Addr)
-			s.Logger.Debug("Connection accepted from %s on server %s", remoteAddr.Addr, s.Name)
+			s.Logger.Log(3, "accepted connection from %s", remoteAddr)
+			s.Logger.Debug("Connection accepted from %s on server %s", remoteAddr, s.Name)
+		}
+
+		seq := s.countAccepted()
+
+		if s.CloseOnAccept {
+			s.Logger.Log(3, "closing connection on accept")
+			conn.Close()
+			if !s.IsDispatch {
+				s.countHandled()
+			}
+			continue
 		}
+		if s.tlsConfig != nil {
+			conn = gnet.TLSServer(conn, s.tlsConfig, s.TLS)
+		}
+		s.trackConn(conn, seq)
 
 		// Handle connection based on session settings
 		if s.IsDispatch {
+			// A spec blocked in accept takes precedence over a new handler
+			select {
+			case s.handoff <- conn:
+				s.Logger.Debug("Connection handed off to waiting accept on server %s", s.Name)
+				continue
+			default:
+			}
+
 			// Dispatch mode: handle each connection in a new goroutine
 			s.Logger.Debug("Handling connection in dispatch mode for server %s", s.Name)
 			s.wg.Add(1)
-			go s.handleConnection(conn, processFunc)
+			go s.handleConnection(conn, seq, worker, processFunc)
 		} else {
+			if !s.claimSession(conn) {
+				continue
+			}
+
 			// Regular mode: handle in session (may use keepalive)
 			s.Logger.Debug("Handling connection in session mode for server %s", s.Name)
 			s.wg.Add(1)
@@ -184,15 +299,211 @@ func (s *Server) acceptLoop(processFunc ProcessFunc) {
 	}
 }
 
+// claimSession waits until no session is running and claims the next one
+// for conn. Sessions run one at a time, as in VTest2: a connection
+// arriving during a session is handed to the session's accept command if
+// it reaches one, and otherwise starts the next session. It returns false
+// if the connection was handed off, or closed because the server stopped.
+func (s *Server) claimSession(conn net.Conn) bool {
+	for {
+		select {
+		case <-s.stopChan:
+			s.Logger.Debug("Closing queued connection on stopped server %s", s.Name)
+			s.untrackConn(conn)
+			conn.Close()
+			return false
+		default:
+		}
+
+		s.connCountMutex.Lock()
+		running := s.session
+		if running == nil {
+			s.session = make(chan struct{})
+			s.connCountMutex.Unlock()
+			return true
+		}
+		s.connCountMutex.Unlock()
+
+		select {
+		case s.handoff <- conn:
+			s.Logger.Debug("Connection handed off to waiting accept on server %s", s.Name)
+			return false
+		case <-running:
+		case <-s.stopChan:
+		}
+	}
+}
+
+// releaseSession lets the next connection start a session
+func (s *Server) releaseSession() {
+	s.connCountMutex.Lock()
+	defer s.connCountMutex.Unlock()
+	if s.session != nil {
+		close(s.session)
+		s.session = nil
+	}
+}
+
+// waitAccept applies AcceptDelay and AcceptLimit before the next accept.
+// Past the limit the listener stays open, so clients connect (into the
+// backlog) but are never served. It returns false once the server stops.
+func (s *Server) waitAccept() bool {
+	if s.AcceptLimit > 0 && s.Accepted() >= s.AcceptLimit {
+		s.Logger.Log(3, "accept limit (%d) reached, not accepting", s.AcceptLimit)
+		<-s.stopChan
+		return false
+	}
+
+	if s.AcceptDelay > 0 {
+		select {
+		case <-time.After(s.AcceptDelay):
+		case <-s.stopChan:
+			return false
+		}
+	}
+	return true
+}
+
+// countAccepted increments the accepted connection counter, publishes it
+// as ${sNAME_conn_count} and returns the connection's sequence number
+func (s *Server) countAccepted() int {
+	s.connCountMutex.Lock()
+	s.accepted++
+	seq := s.accepted
+	s.connCountMutex.Unlock()
+
+	if s.macros != nil {
+		s.macros.Definef(s.Name+"_conn_count", "%d", seq)
+	}
+	return seq
+}
+
+// Active returns the number of connections currently open
+func (s *Server) Active() int {
+	s.connCountMutex.Lock()
+	defer s.connCountMutex.Unlock()
+	return len(s.conns)
+}
+
+// SetLast records a summary of the last exchange and publishes it as
+// ${sNAME_last}
+func (s *Server) SetLast(summary string) {
+	s.connCountMutex.Lock()
+	s.last = summary
+	s.connCountMutex.Unlock()
+
+	if s.macros != nil {
+		s.macros.Define(s.Name+"_last", summary)
+	}
+}
+
+// Last returns the summary recorded by SetLast
+func (s *Server) Last() string {
+	s.connCountMutex.Lock()
+	defer s.connCountMutex.Unlock()
+	return s.last
+}
+
+// trackConn records an open connection so StopNow can close it
+func (s *Server) trackConn(conn net.Conn, seq int) {
+	s.connCountMutex.Lock()
+	s.conns[conn] = &session.ConnStats{Seq: seq}
+	s.connCountMutex.Unlock()
+}
+
+// ConnStats returns the stats of an open connection
+func (s *Server) ConnStats(conn net.Conn) *session.ConnStats {
+	s.connCountMutex.Lock()
+	defer s.connCountMutex.Unlock()
+	if stats, ok := s.conns[conn]; ok {
+		return stats
+	}
+	return &session.ConnStats{Seq: s.accepted}
+}
+
+// untrackConn forgets a connection once its handler is done
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connCountMutex.Lock()
+	delete(s.conns, conn)
+	s.connCountMutex.Unlock()
+}
+
+// closeConns closes all open connections. With rst the close is abortive
+// (SO_LINGER 0), so TCP peers see a reset instead of a FIN.
+func (s *Server) closeConns(rst bool) {
+	s.connCountMutex.Lock()
+	defer s.connCountMutex.Unlock()
+
+	for conn := range s.conns {
+		if tc, ok := gnet.RawConn(conn).(*net.TCPConn); ok && rst {
+			tc.SetLinger(0)
+		}
+		conn.Close()
+	}
+	s.Logger.Debug("Closed %d connections on server %s (rst=%v)", len(s.conns), s.Name, rst)
+}
+
+// Accepted returns the number of connections accepted since Start
+func (s *Server) Accepted() int {
+	s.connCountMutex.Lock()
+	defer s.connCountMutex.Unlock()
+	return s.accepted
+}
+
+// connSpec expands the spec for one connection, with ${conn_seq},
+// ${conn_worker} and ${conn_remote} set in a private copy of the macros
+func (s *Server) connSpec(conn net.Conn, seq, worker int) (string, error) {
+	if !s.SpecPerConn || s.macros == nil {
+		return s.Spec, nil
+	}
+
+	macros := s.macros.Clone()
+	macros.Definef("conn_seq", "%d", seq)
+	macros.Definef("conn_worker", "%d", worker)
+	macros.Define("conn_remote", conn.RemoteAddr().String())
+
+	// The repeat blocks of the spec number their own iterations, so
+	// ${iteration} is left for them
+	iteration := "${" + vtc.IterationMacro + "}"
+	parts := strings.Split(s.Spec, iteration)
+	for i, part := range parts {
+		expanded, err := macros.Expand(s.Logger, part)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = expanded
+	}
+	return strings.Join(parts, iteration), nil
+}
+
+// process runs processFunc. A panic in it is reported as fatal, which
+// fails the test, instead of taking down the whole run.
+func (s *Server) process(processFunc ProcessFunc, conn net.Conn, spec string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("server %s: panic: %v", s.Name, r)
+			s.Logger.Fatal("%v", err)
+		}
+	}()
+	return processFunc(conn, spec, s.Listen)
+}
+
 // handleConnection processes a single connection (dispatch mode)
-func (s *Server) handleConnection(conn net.Conn, processFunc ProcessFunc) {
+func (s *Server) handleConnection(conn net.Conn, seq, worker int, processFunc ProcessFunc) {
 	defer s.wg.Done()
+	defer s.untrackConn(conn)
 	defer conn.Close()
 	s.Logger.Debug("Starting connection handler (dispatch mode) for server %s", s.Name)
 
+	spec, err := s.connSpec(conn, seq, worker)
+	if err != nil {
+		s.Logger.Error("Connection %d: spec expansion failed: %v", seq, err)
+		return
+	}
+
 	if processFunc != nil {
 		s.Logger.Debug("Calling processFunc for connection on server %s", s.Name)
-		err := processFunc(conn, s.Spec, s.Listen)
+		err := s.process(processFunc, conn, spec)
 		if err != nil {
 			s.Logger.Error("Connection processing failed: %v", err)
 			s.Logger.Debug("processFunc failed: %v", err)
@@ -208,6 +519,8 @@ func (s *Server) handleConnection(conn net.Conn, processFunc ProcessFunc) {
 // handleSessionConnection processes connections using session settings (repeat, keepalive)
 func (s *Server) handleSessionConnection(conn net.Conn, processFunc ProcessFunc) {
 	defer s.wg.Done()
+	defer s.releaseSession()
+	defer s.untrackConn(conn)
 	s.Logger.Debug("Starting session connection handler for server %s", s.Name)
 
 	// Use the session's Run method
@@ -225,7 +538,7 @@ func (s *Server) handleSessionConnection(conn net.Conn, processFunc ProcessFunc)
 	procFunc := func(c net.Conn, spec string) (net.Conn, error) {
 		if processFunc != nil {
 			s.Logger.Debug("Session procFunc calling processFunc")
-			err := processFunc(c, spec, s.Listen)
+			err := s.process(processFunc, c, spec)
 			if err != nil {
 				s.Logger.Debug("Session processFunc returned error: %v", err)
 			} else {
@@ -245,22 +558,66 @@ func (s *Server) handleSessionConnection(conn net.Conn, processFunc ProcessFunc)
 		s.Logger.Debug("Session.Run completed successfully for server %s", s.Name)
 	}
 
-	// Increment connection counter and check if we should stop
+	s.countHandled()
+}
+
+// countHandled counts a finished session connection and stops the server
+// once the session's repeat count is reached
+func (s *Server) countHandled() {
 	s.connCountMutex.Lock()
 	s.connCount++
 	count := s.connCount
 	s.connCountMutex.Unlock()
 	s.Logger.Debug("Connection count for server %s: %d/%d", s.Name, count, s.Session.Repeat)
 
-	// If we've handled the expected number of connections, stop the server
+	// Once the expected number of connections is handled, the server
+	// ends: it stops accepting, but keeps its macros until stopped, so
+	// that it can be waited for and started again as it was
 	if !s.IsDispatch && count >= s.Session.Repeat {
 		s.Logger.Log(2, "Ending")
-		s.Logger.Debug("Reached expected connection count, stopping server %s", s.Name)
-		go s.Stop() // Stop in goroutine to avoid deadlock
+		s.Logger.Debug("Reached expected connection count, ending server %s", s.Name)
+		s.end()
+	}
+}
+
+// AcceptConn waits for the next connection to the server, for specs that
+// use the accept command to continue on a fresh connection
+func (s *Server) AcceptConn(timeout time.Duration) (net.Conn, error) {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
+
+	select {
+	case conn := <-s.handoff:
+		return conn, nil
+	case <-s.stopChan:
+		return nil, fmt.Errorf("server %s stopped", s.Name)
+	case <-timer:
+		return nil, fmt.Errorf("no connection within %v", timeout)
 	}
 }
 
-// Wait waits for the server to stop
+// IsRunning reports whether the server has been started and not yet
+// waited for or stopped
+func (s *Server) IsRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Running
+}
+
+// Listening reports whether the server still accepts connections
+func (s *Server) Listening() bool {
+	s.mutex.Lock()
+	running := s.Running
+	s.mutex.Unlock()
+	s.stoppingMutex.Lock()
+	defer s.stoppingMutex.Unlock()
+	return running && !s.stopping && !s.ended
+}
+
+// Wait waits for the server to end, after its last connection or once
+// stopped. It can then be started again.
 func (s *Server) Wait() {
 	s.wg.Wait()
 	s.mutex.Lock()
@@ -268,15 +625,73 @@ func (s *Server) Wait() {
 	s.mutex.Unlock()
 }
 
-// Stop stops the server
+// Stop stops the server, waiting for in-flight connections to finish
 func (s *Server) Stop() error {
+	if !s.beginStop() {
+		return nil
+	}
+
+	// Wait for all connections to finish
+	s.Logger.Debug("Waiting for connections to finish for server %s", s.Name)
+	s.wg.Wait()
+	s.Logger.Debug("All connections finished for server %s", s.Name)
+
+	s.endStop()
+	return nil
+}
+
+// StopDrain stops accepting connections and gives in-flight ones up to
+// timeout to finish. Connections still open after that are closed.
+func (s *Server) StopDrain(timeout time.Duration) error {
+	if !s.beginStop() {
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.Logger.Debug("All connections drained for server %s", s.Name)
+	case <-time.After(timeout):
+		s.Logger.Log(2, "Drain timeout (%v) expired, closing remaining connections", timeout)
+		s.closeConns(false)
+		<-done
+	}
+
+	s.endStop()
+	return nil
+}
+
+// StopNow stops the server and closes all connections immediately,
+// resetting them if rst is set
+func (s *Server) StopNow(rst bool) error {
+	if !s.beginStop() {
+		return nil
+	}
+
+	s.closeConns(rst)
+	s.wg.Wait()
+	s.Logger.Debug("All connections finished for server %s", s.Name)
+
+	s.endStop()
+	return nil
+}
+
+// beginStop stops the accept loop. It returns false if the server is not
+// running or is already being stopped by another Stop; a server that has
+// ended on its own can still be stopped.
+func (s *Server) beginStop() bool {
 	s.Logger.Debug("Stop called for server %s", s.Name)
 
 	s.mutex.Lock()
 	if !s.Running {
 		s.mutex.Unlock()
 		s.Logger.Debug("Server %s not running, returning early", s.Name)
-		return nil
+		return false
 	}
 	s.mutex.Unlock()
 
@@ -285,28 +700,47 @@ func (s *Server) Stop() error {
 	if s.stopping {
 		s.stoppingMutex.Unlock()
 		s.Logger.Debug("Server %s already stopping, returning early", s.Name)
-		return nil
+		return false
 	}
 	s.stopping = true
+	ended := s.ended
 	s.stoppingMutex.Unlock()
 
 	s.Logger.Log(2, "Stopping server %s", s.Name)
+	if !ended {
+		s.closeListener()
+	}
+	return true
+}
+
+// end stops accepting once the server has handled its connections, like
+// beginStop, but leaves it to Wait or Stop to mark it stopped
+func (s *Server) end() {
+	s.stoppingMutex.Lock()
+	if s.stopping || s.ended {
+		s.stoppingMutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.stoppingMutex.Unlock()
+	s.closeListener()
+}
 
+// closeListener signals the accept loops to stop and closes the listeners
+func (s *Server) closeListener() {
 	// Signal stop
 	s.Logger.Debug("Closing stop channel for server %s", s.Name)
 	close(s.stopChan)
 
-	// Close listener
-	if s.Listener != nil {
-		s.Logger.Debug("Closing listener for server %s", s.Name)
-		s.Listener.Close()
+	// Close listeners
+	for _, l := range s.listeners {
+		s.Logger.Debug("Closing listener %s for server %s", l.Addr(), s.Name)
+		l.Close()
 	}
+}
 
-	// Wait for all connections to finish
-	s.Logger.Debug("Waiting for connections to finish for server %s", s.Name)
-	s.wg.Wait()
-	s.Logger.Debug("All connections finished for server %s", s.Name)
-
+// endStop marks the server stopped once all connections are done
+func (s *Server) endStop() {
 	s.mutex.Lock()
 	s.Running = false
 	s.mutex.Unlock()
@@ -316,7 +750,6 @@ func (s *Server) Stop() error {
 	s.undefineMacros()
 
 	s.Logger.Debug("Server %s stopped successfully", s.Name)
-	return nil
 }
 
 // Break forces the server to stop (cancel operation)
@@ -324,20 +757,19 @@ func (s *Server) Break() error {
 	return s.Stop()
 }
 
-// defineMacros defines the server macros (addr, port, sock)
+// defineMacros defines the server macros (addr, port, sock) in the
+// server's own namespace
 func (s *Server) defineMacros() {
 	if s.macros == nil {
 		return
 	}
 
-	// Define ${sNAME_addr}
-	s.macros.Definef(s.Name+"_addr", "%s", s.Addr)
-
-	// Define ${sNAME_port}
-	s.macros.Definef(s.Name+"_port", "%s", s.Port)
-
-	// Define ${sNAME_sock}
-	s.macros.Definef(s.Name+"_sock", "%s", s.Listen)
+	// Define ${sNAME_addr}, ${sNAME_port} and ${sNAME_sock}. An IPv6
+	// addr is in brackets, so that "${sNAME_addr}:${sNAME_port}" is an
+	// address too.
+	s.macros.DefineIn(s.Name, "addr", gnet.BracketHost(s.Addr))
+	s.macros.DefineIn(s.Name, "port", s.Port)
+	s.macros.DefineIn(s.Name, "sock", s.Listen)
 }
 
 // undefineMacros removes the server macros
@@ -346,7 +778,5 @@ func (s *Server) undefineMacros() {
 		return
 	}
 
-	s.macros.Delete(s.Name + "_addr")
-	s.macros.Delete(s.Name + "_port")
-	s.macros.Delete(s.Name + "_sock")
+	s.macros.DeleteNamespace(s.Name)
 }
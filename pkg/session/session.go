@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
 )
@@ -28,6 +29,34 @@ type Session struct {
 	Keepalive bool
 	RcvBuf    int
 	FD        net.Conn
+
+	// Retrying, for clients: with ReconnectOnFail a repeat whose connect
+	// or spec fails is run again on a new connection, up to MaxAttempts
+	// times, waiting Backoff before the first retry and twice as long
+	// before each further one, up to BackoffMax
+	ReconnectOnFail bool
+	MaxAttempts     int           // Attempts per repeat (0 = DefaultMaxAttempts)
+	Backoff         time.Duration // Wait before the first retry
+	BackoffMax      time.Duration // Longest wait between retries (0 = no limit)
+
+	// Done, if set, is closed when the test aborts. A retry still
+	// waiting out its backoff then gives up.
+	Done <-chan struct{}
+
+	// Attempts counts the runs of the spec by the last Run, retries
+	// included
+	Attempts int
+}
+
+// DefaultMaxAttempts is the number of attempts per repeat with
+// -reconnect-on-fail when -max-attempts is not given
+const DefaultMaxAttempts = 3
+
+// ConnStats follows one connection across the repeats of a spec, so that
+// a connection kept alive can be told from a new one
+type ConnStats struct {
+	Seq      int // Number of the connection among those of its client or server, from 1
+	Requests int // Requests sent or received on it so far
 }
 
 // New creates a new session with the given name and logger
@@ -79,6 +108,42 @@ func (s *Session) ParseOption(args []string) (int, error) {
 		s.Keepalive = true
 		return 1, nil
 
+	case "-reconnect-on-fail":
+		s.ReconnectOnFail = true
+		return 1, nil
+
+	case "-max-attempts":
+		if len(args) < 2 {
+			return 0, fmt.Errorf("-max-attempts requires an argument")
+		}
+		val, err := strconv.Atoi(args[1])
+		if err != nil {
+			return 0, fmt.Errorf("-max-attempts: invalid value %s: %w", args[1], err)
+		}
+		if val < 1 {
+			return 0, fmt.Errorf("-max-attempts: value must be >= 1, got %d", val)
+		}
+		s.MaxAttempts = val
+		return 2, nil
+
+	case "-backoff", "-backoff-max":
+		if len(args) < 2 {
+			return 0, fmt.Errorf("%s requires an argument", args[0])
+		}
+		val, err := time.ParseDuration(args[1])
+		if err != nil {
+			return 0, fmt.Errorf("%s: invalid duration %s: %w", args[0], args[1], err)
+		}
+		if val < 0 {
+			return 0, fmt.Errorf("%s: duration must be >= 0, got %v", args[0], val)
+		}
+		if args[0] == "-backoff" {
+			s.Backoff = val
+		} else {
+			s.BackoffMax = val
+		}
+		return 2, nil
+
 	default:
 		return 0, nil
 	}
@@ -99,33 +164,35 @@ func (s *Session) Run(
 	s.Logger.Log(2, "Started on %s (%d iterations%s)", addr, s.Repeat,
 		map[bool]string{true: " using keepalive", false: ""}[s.Keepalive])
 	s.Logger.Debug("Session.Run starting: name=%s, addr=%s, repeat=%d, keepalive=%v", s.Name, addr, s.Repeat, s.Keepalive)
+	s.Attempts = 0
 
 	for i := 0; i < s.Repeat; i++ {
 		s.Logger.Debug("Session iteration %d/%d starting", i+1, s.Repeat)
 
-		// Connect if we don't have a connection
-		if conn == nil {
-			s.Logger.Debug("No existing connection, calling connectFunc")
-			conn, err = connectFunc()
-			if err != nil {
-				s.Logger.Debug("connectFunc failed: %v", err)
-				return fmt.Errorf("connection failed: %w", err)
+		for attempt := 1; ; attempt++ {
+			s.Attempts++
+			conn, err = s.attempt(conn, spec, connectFunc, processFunc)
+			if err == nil {
+				break
 			}
-			s.Logger.Debug("connectFunc succeeded")
-		} else {
-			s.Logger.Debug("Reusing existing connection (keepalive)")
-		}
+			conn = nil
 
-		// Process the session
-		s.Logger.Debug("Calling processFunc for iteration %d/%d", i+1, s.Repeat)
-		conn, err = processFunc(conn, spec)
-		if err != nil {
-			s.Logger.Debug("processFunc failed: %v", err)
-			if conn != nil {
-				s.Logger.Debug("Closing connection after processFunc error")
-				conn.Close()
+			maxAttempts := s.maxAttempts()
+			if attempt >= maxAttempts {
+				if attempt > 1 {
+					return fmt.Errorf("%w (after %d attempts)", err, attempt)
+				}
+				return err
+			}
+			delay := s.backoff(attempt)
+			s.Logger.Log(2, "Attempt %d/%d failed (%v), reconnecting in %v", attempt, maxAttempts, err, delay)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-s.Done:
+				timer.Stop()
+				return fmt.Errorf("%w (test aborted before attempt %d)", err, attempt+1)
 			}
-			return fmt.Errorf("process failed: %w", err)
 		}
 		s.Logger.Debug("processFunc completed successfully for iteration %d/%d", i+1, s.Repeat)
 
@@ -158,6 +225,66 @@ func (s *Session) Run(
 	return nil
 }
 
+// attempt runs the spec once, connecting first unless conn is kept alive.
+// A connection the spec failed on is closed.
+func (s *Session) attempt(conn net.Conn, spec string, connectFunc ConnectFunc, processFunc ProcessFunc) (net.Conn, error) {
+	// Connect if we don't have a connection
+	if conn == nil {
+		s.Logger.Debug("No existing connection, calling connectFunc")
+		var err error
+		conn, err = connectFunc()
+		if err != nil {
+			s.Logger.Debug("connectFunc failed: %v", err)
+			return nil, fmt.Errorf("connection failed: %w", err)
+		}
+		s.Logger.Debug("connectFunc succeeded")
+	} else {
+		s.Logger.Debug("Reusing existing connection (keepalive)")
+	}
+
+	// Process the session
+	s.Logger.Debug("Calling processFunc")
+	conn, err := processFunc(conn, spec)
+	if err != nil {
+		s.Logger.Debug("processFunc failed: %v", err)
+		if conn != nil {
+			s.Logger.Debug("Closing connection after processFunc error")
+			conn.Close()
+		}
+		return nil, fmt.Errorf("process failed: %w", err)
+	}
+	return conn, nil
+}
+
+// maxAttempts returns how many times a repeat is tried
+func (s *Session) maxAttempts() int {
+	switch {
+	case !s.ReconnectOnFail:
+		return 1
+	case s.MaxAttempts > 0:
+		return s.MaxAttempts
+	default:
+		return DefaultMaxAttempts
+	}
+}
+
+// backoff returns the wait after the given failed attempt: Backoff,
+// doubled for each attempt after the first (at most 30 times), up to
+// BackoffMax
+func (s *Session) backoff(attempt int) time.Duration {
+	delay := s.Backoff
+	for i := 1; i < attempt && i <= 30 && delay > 0; i++ {
+		delay *= 2
+		if s.BackoffMax > 0 && delay >= s.BackoffMax {
+			break
+		}
+	}
+	if s.BackoffMax > 0 && delay > s.BackoffMax {
+		delay = s.BackoffMax
+	}
+	return delay
+}
+
 // Close closes the session's connection if open
 func (s *Session) Close() error {
 	if s.FD != nil {
@@ -1,7 +1,11 @@
 package session
 
 import (
+	"errors"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
 )
@@ -64,6 +68,42 @@ func TestParseOption(t *testing.T) {
 			wantErr:     true,
 			checkFunc:   func() bool { return true },
 		},
+		{
+			args:        []string{"-reconnect-on-fail"},
+			wantConsumed: 1,
+			wantErr:     false,
+			checkFunc:   func() bool { return sess.ReconnectOnFail },
+		},
+		{
+			args:        []string{"-max-attempts", "5"},
+			wantConsumed: 2,
+			wantErr:     false,
+			checkFunc:   func() bool { return sess.MaxAttempts == 5 },
+		},
+		{
+			args:        []string{"-max-attempts", "0"},
+			wantConsumed: 0,
+			wantErr:     true,
+			checkFunc:   func() bool { return true },
+		},
+		{
+			args:        []string{"-backoff", "100ms"},
+			wantConsumed: 2,
+			wantErr:     false,
+			checkFunc:   func() bool { return sess.Backoff == 100*time.Millisecond },
+		},
+		{
+			args:        []string{"-backoff-max", "1s"},
+			wantConsumed: 2,
+			wantErr:     false,
+			checkFunc:   func() bool { return sess.BackoffMax == time.Second },
+		},
+		{
+			args:        []string{"-backoff", "soon"},
+			wantConsumed: 0,
+			wantErr:     true,
+			checkFunc:   func() bool { return true },
+		},
 		{
 			args:        []string{"-unknown"},
 			wantConsumed: 0,
@@ -89,3 +129,101 @@ func TestParseOption(t *testing.T) {
 		}
 	}
 }
+
+func TestRun_ReconnectOnFail(t *testing.T) {
+	logger := logging.NewLogger("test")
+
+	// The first two connects fail, the third spec run fails, and the
+	// fourth attempt succeeds
+	run := func(sess *Session) (connects int, err error) {
+		procs := 0
+		connect := func() (net.Conn, error) {
+			connects++
+			if connects <= 2 {
+				return nil, errors.New("connection refused")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		}
+		process := func(conn net.Conn, spec string) (net.Conn, error) {
+			procs++
+			if procs == 1 {
+				return conn, errors.New("connection reset")
+			}
+			return conn, nil
+		}
+		err = sess.Run("", "test", connect, nil, process)
+		return connects, err
+	}
+
+	sess := New(logger, "c1")
+	if _, err := run(sess); err == nil {
+		t.Error("Run() without -reconnect-on-fail should fail")
+	}
+	if sess.Attempts != 1 {
+		t.Errorf("Attempts = %d, want 1", sess.Attempts)
+	}
+
+	sess = New(logger, "c1")
+	sess.ReconnectOnFail = true
+	_, err := run(sess)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("Run() with 3 attempts error = %v, want a failure after 3 attempts", err)
+	}
+
+	sess = New(logger, "c1")
+	sess.ReconnectOnFail = true
+	sess.MaxAttempts = 4
+	sess.Backoff = time.Millisecond
+	connects, err := run(sess)
+	if err != nil {
+		t.Fatalf("Run() with 4 attempts failed: %v", err)
+	}
+	if sess.Attempts != 4 || connects != 4 {
+		t.Errorf("Attempts = %d, connects = %d, want 4 and 4", sess.Attempts, connects)
+	}
+}
+
+func TestRun_BackoffStops(t *testing.T) {
+	logger := logging.NewLogger("test")
+	done := make(chan struct{})
+	sess := New(logger, "c1")
+	sess.ReconnectOnFail = true
+	sess.Backoff = time.Hour
+	sess.Done = done
+
+	connect := func() (net.Conn, error) {
+		close(done)
+		return nil, errors.New("connection refused")
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- sess.Run("", "test", connect, nil, nil) }()
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "test aborted before attempt 2") {
+			t.Errorf("Run() error = %v, want it stopped after the first attempt", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() kept waiting out the backoff after Done was closed")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	logger := logging.NewLogger("test")
+	sess := New(logger, "c1")
+	sess.Backoff = 100 * time.Millisecond
+	sess.BackoffMax = time.Second
+
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for i, w := range want {
+		if got := sess.backoff(i + 1); got != w*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w*time.Millisecond)
+		}
+	}
+
+	sess.BackoffMax = 0
+	if got := sess.backoff(100); got <= 0 {
+		t.Errorf("backoff(100) without a maximum = %v, want a positive duration", got)
+	}
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EditKind is what an Edit does to the stream
+type EditKind int
+
+const (
+	Drop   EditKind = iota // Leave out Len bytes
+	Dup                    // Send Len bytes twice
+	Inject                 // Insert Data
+)
+
+// Edit changes the bytes of one direction at an offset of the stream as
+// read from the source, before any other edit
+type Edit struct {
+	Kind   EditKind
+	Offset int64
+	Len    int64  // Bytes dropped or duplicated
+	Data   []byte // Bytes injected
+}
+
+func (e Edit) String() string {
+	switch e.Kind {
+	case Drop:
+		return fmt.Sprintf("drop %d bytes at %d", e.Len, e.Offset)
+	case Dup:
+		return fmt.Sprintf("duplicate %d bytes at %d", e.Len, e.Offset)
+	default:
+		return fmt.Sprintf("inject %d bytes at %d", len(e.Data), e.Offset)
+	}
+}
+
+// Shaping changes how the bytes of one direction flow: late, slowly or
+// edited
+type Shaping struct {
+	Latency time.Duration // Delay every byte by this much
+	Rate    int64         // Bytes per second, 0 for no limit
+	Edits   []Edit
+}
+
+// rewriter applies the edits of a direction to the stream as it is read
+type rewriter struct {
+	edits    []Edit
+	injected []bool   // Inject edits done
+	dups     [][]byte // Bytes of each Dup edit seen so far
+	offset   int64    // Source bytes seen
+}
+
+func newRewriter(edits []Edit) *rewriter {
+	edits = append([]Edit(nil), edits...)
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].Offset < edits[j].Offset })
+	return &rewriter{
+		edits:    edits,
+		injected: make([]bool, len(edits)),
+		dups:     make([][]byte, len(edits)),
+	}
+}
+
+// apply returns data, the next bytes read from the source, as edited
+func (r *rewriter) apply(data []byte) []byte {
+	if len(r.edits) == 0 {
+		r.offset += int64(len(data))
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		pos := r.offset
+		r.offset++
+		drop := false
+		for i, e := range r.edits {
+			switch e.Kind {
+			case Inject:
+				if e.Offset == pos && !r.injected[i] {
+					out = append(out, e.Data...)
+					r.injected[i] = true
+				}
+			case Drop:
+				if pos >= e.Offset && pos < e.Offset+e.Len {
+					drop = true
+				}
+			}
+		}
+		if !drop {
+			out = append(out, b)
+		}
+		for i, e := range r.edits {
+			if e.Kind != Dup || pos < e.Offset || pos >= e.Offset+e.Len {
+				continue
+			}
+			r.dups[i] = append(r.dups[i], b)
+			if pos == e.Offset+e.Len-1 {
+				out = append(out, r.dups[i]...)
+			}
+		}
+	}
+	return out
+}
+
+// flush returns the injects left at the end of the stream
+func (r *rewriter) flush() []byte {
+	var out []byte
+	for i, e := range r.edits {
+		if e.Kind == Inject && !r.injected[i] {
+			out = append(out, e.Data...)
+			r.injected[i] = true
+		}
+	}
+	return out
+}
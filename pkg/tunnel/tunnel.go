@@ -0,0 +1,465 @@
+// Package tunnel forwards bytes between a client and a server, like a
+// man-in-the-middle that can be paused. A tunnel accepts one connection,
+// connects to its target and copies bytes both ways, while a spec pauses
+// the copying and lets a given number of bytes through at a time. This
+// freezes traffic at a chosen point, for testing how a proxy handles
+// stalled or trickling peers.
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+	gnet "github.com/perbu/GTest/pkg/net"
+	"github.com/perbu/GTest/pkg/vtc"
+)
+
+// Direction is one of the two ways bytes flow through a tunnel
+type Direction int
+
+const (
+	Send Direction = iota // From the client to the server
+	Recv                  // From the server to the client
+)
+
+func (d Direction) String() string {
+	if d == Send {
+		return "send"
+	}
+	return "recv"
+}
+
+// SpecFunc runs the spec of a tunnel once its connections are up
+type SpecFunc func() error
+
+// Tunnel represents a byte-forwarding tunnel
+type Tunnel struct {
+	Name    string
+	Logger  *logging.Logger
+	Spec    string
+	Listen  string        // Address to listen on
+	Connect string        // Address to forward to
+	Timeout time.Duration // How long send and recv wait for their bytes
+	Addr    string
+	Port    string
+	Running bool
+
+	// Shaping of the bytes sent to the server and of those received
+	// from it, indexed by Direction
+	Shaping [2]Shaping
+
+	macros *vtc.MacroStore
+
+	// Internal
+	listener  net.Listener
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	wg        sync.WaitGroup
+	conns     []net.Conn
+	paused    bool
+	closed    bool     // Broken, or the connection is over
+	forwarded [2]int64 // Bytes forwarded in each direction
+	allowed   [2]int64 // Bytes that may be forwarded while paused
+	writing   [2]bool  // A write is in flight
+	eof       [2]bool  // The source has nothing more to send
+	specDone  chan struct{}
+	err       error // Outcome of the last run
+}
+
+// New creates a new tunnel with the given name
+func New(logger *logging.Logger, macros *vtc.MacroStore, name string) *Tunnel {
+	t := &Tunnel{
+		Name:    name,
+		Logger:  logger.Child(name),
+		Listen:  "127.0.0.1:0",
+		Timeout: 10 * time.Second,
+		macros:  macros,
+	}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+// Start listens, if the tunnel does not yet, and forwards the next
+// connection in the background. The spec runs once both ends are
+// connected; the tunnel starts out paused if paused is set. done aborts
+// the run.
+func (t *Tunnel) Start(spec SpecFunc, paused bool, done <-chan struct{}) error {
+	t.mutex.Lock()
+	if t.Running {
+		t.mutex.Unlock()
+		return fmt.Errorf("tunnel %s already running", t.Name)
+	}
+	listener := t.listener
+	t.mutex.Unlock()
+	if listener == nil {
+		var addrInfo *gnet.AddrInfo
+		var err error
+		listener, addrInfo, err = gnet.TCPListen(t.Listen, 0)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		t.Listen = addrInfo.String()
+		t.Addr = addrInfo.Addr
+		t.Port = addrInfo.Port
+		t.defineMacros()
+		t.Logger.Log(2, "Listen on %s", t.Listen)
+	}
+
+	t.mutex.Lock()
+	t.listener = listener
+	t.Running = true
+	t.paused = paused
+	t.closed = false
+	t.conns = nil
+	t.forwarded = [2]int64{}
+	t.allowed = [2]int64{}
+	t.eof = [2]bool{}
+	t.err = nil
+	t.specDone = make(chan struct{})
+	specDone := t.specDone
+	t.mutex.Unlock()
+
+	stop := make(chan struct{})
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer close(stop)
+		err := t.run(listener, spec, specDone)
+		t.mutex.Lock()
+		t.err = err
+		t.Running = false
+		t.mutex.Unlock()
+	}()
+	go func() {
+		select {
+		case <-done:
+			t.Break()
+		case <-stop:
+		}
+	}()
+	return nil
+}
+
+// run accepts a connection, connects it to the target, runs the spec
+// and waits for both directions to finish
+func (t *Tunnel) run(listener net.Listener, spec SpecFunc, specDone chan struct{}) error {
+	specClosed := false
+	defer func() {
+		if !specClosed {
+			close(specDone)
+		}
+	}()
+
+	client, err := listener.Accept()
+	if err != nil {
+		return fmt.Errorf("accept failed: %w", err)
+	}
+	t.Logger.Log(3, "Accepted %s", client.RemoteAddr())
+
+	server, err := gnet.TCPConnect(t.Connect, t.Timeout)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	t.Logger.Log(3, "Connected to %s", t.Connect)
+	for dir, shaping := range t.Shaping {
+		if shaping.Latency > 0 {
+			t.Logger.Log(3, "%s: latency %v", Direction(dir), shaping.Latency)
+		}
+		if shaping.Rate > 0 {
+			t.Logger.Log(3, "%s: %d bytes per second", Direction(dir), shaping.Rate)
+		}
+		for _, edit := range shaping.Edits {
+			t.Logger.Log(3, "%s: %s", Direction(dir), edit)
+		}
+	}
+
+	t.mutex.Lock()
+	if t.closed {
+		t.mutex.Unlock()
+		client.Close()
+		server.Close()
+		return fmt.Errorf("tunnel %s broken", t.Name)
+	}
+	t.conns = []net.Conn{client, server}
+	t.mutex.Unlock()
+
+	var pumps sync.WaitGroup
+	pumps.Add(2)
+	go func() {
+		defer pumps.Done()
+		t.pump(Send, client, server)
+	}()
+	go func() {
+		defer pumps.Done()
+		t.pump(Recv, server, client)
+	}()
+
+	if spec != nil {
+		err = spec()
+	}
+	close(specDone)
+	specClosed = true
+
+	if err != nil {
+		t.Break()
+	}
+	pumps.Wait()
+
+	t.mutex.Lock()
+	t.closed = true
+	t.cond.Broadcast()
+	t.Logger.Log(3, "Done, %d bytes sent and %d received", t.forwarded[Send], t.forwarded[Recv])
+	t.mutex.Unlock()
+	client.Close()
+	server.Close()
+	return err
+}
+
+// chunk is a piece of the stream, due to be written at a time
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+// pump copies bytes from src to dst, shaped as set for the direction
+func (t *Tunnel) pump(dir Direction, src, dst net.Conn) {
+	shaping := t.Shaping[dir]
+	chunks := make(chan chunk, 16)
+	go t.read(dir, src, shaping, chunks)
+
+	for c := range chunks {
+		if wait := time.Until(c.due); wait > 0 {
+			time.Sleep(wait)
+		}
+		if err := t.write(dir, dst, c.data, shaping.Rate); err != nil {
+			if err != errClosed {
+				t.Logger.Log(3, "%s: write failed: %v", dir, err)
+			}
+			t.Break()
+			// Let the reader, which the break unblocks, finish
+			for range chunks {
+			}
+			return
+		}
+	}
+
+	t.mutex.Lock()
+	t.eof[dir] = true
+	t.cond.Broadcast()
+	t.mutex.Unlock()
+	// Pass the end of stream on, so that the other side can finish its
+	// answer
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// read reads src until its end, edits what it reads and queues it to be
+// written after the latency of the direction
+func (t *Tunnel) read(dir Direction, src net.Conn, shaping Shaping, chunks chan<- chunk) {
+	defer close(chunks)
+	rw := newRewriter(shaping.Edits)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := src.Read(buf)
+		if n > 0 {
+			if data := rw.apply(buf[:n]); len(data) > 0 {
+				chunks <- chunk{data, time.Now().Add(shaping.Latency)}
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				t.Logger.Log(3, "%s: read failed: %v", dir, err)
+			}
+			if data := rw.flush(); len(data) > 0 {
+				chunks <- chunk{data, time.Now().Add(shaping.Latency)}
+			}
+			return
+		}
+	}
+}
+
+// errClosed is returned by write when the tunnel is broken
+var errClosed = errors.New("tunnel closed")
+
+// write writes data to dst, holding it back while the tunnel is paused
+// and has no bytes allowed in this direction, and at no more than rate
+// bytes per second if rate is set
+func (t *Tunnel) write(dir Direction, dst net.Conn, data []byte, rate int64) error {
+	for len(data) > 0 {
+		t.mutex.Lock()
+		for t.paused && t.allowed[dir] <= t.forwarded[dir] && !t.closed {
+			t.cond.Wait()
+		}
+		if t.closed {
+			t.mutex.Unlock()
+			return errClosed
+		}
+		n := int64(len(data))
+		if t.paused {
+			n = min(n, t.allowed[dir]-t.forwarded[dir])
+		}
+		if rate > 0 {
+			// Pieces of a tenth of a second
+			n = min(n, max(rate/10, 1))
+		}
+		t.writing[dir] = true
+		t.mutex.Unlock()
+
+		written, err := dst.Write(data[:n])
+
+		t.mutex.Lock()
+		t.writing[dir] = false
+		t.forwarded[dir] += int64(written)
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		data = data[written:]
+		if rate > 0 {
+			time.Sleep(time.Duration(int64(written) * int64(time.Second) / rate))
+		}
+	}
+	return nil
+}
+
+// Pause waits for the bytes being written to be forwarded, then holds
+// back all further bytes
+func (t *Tunnel) Pause() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.paused {
+		return fmt.Errorf("tunnel %s already paused", t.Name)
+	}
+	for (t.writing[Send] || t.writing[Recv]) && !t.closed {
+		t.cond.Wait()
+	}
+	t.paused = true
+	t.allowed = t.forwarded
+	t.Logger.Log(3, "Paused after %d bytes sent and %d received", t.forwarded[Send], t.forwarded[Recv])
+	return nil
+}
+
+// Resume lets bytes flow freely again
+func (t *Tunnel) Resume() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.paused {
+		return fmt.Errorf("tunnel %s is not paused", t.Name)
+	}
+	t.paused = false
+	t.cond.Broadcast()
+	t.Logger.Log(3, "Resumed")
+	return nil
+}
+
+// Forward lets n more bytes through in one direction of a paused tunnel
+// and waits until they have been forwarded. The tunnel stays paused.
+func (t *Tunnel) Forward(dir Direction, n int64) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.paused {
+		return fmt.Errorf("tunnel %s must be paused to %s", t.Name, dir)
+	}
+	t.allowed[dir] += n
+	t.cond.Broadcast()
+	t.Logger.Log(3, "%s %d bytes", dir, n)
+
+	expired := false
+	timer := time.AfterFunc(t.Timeout, func() {
+		t.mutex.Lock()
+		expired = true
+		t.cond.Broadcast()
+		t.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	for t.forwarded[dir] < t.allowed[dir] {
+		switch {
+		case t.eof[dir]:
+			return fmt.Errorf("%s %d: the connection ended %d bytes short", dir, n, t.allowed[dir]-t.forwarded[dir])
+		case t.closed:
+			return fmt.Errorf("%s %d: tunnel closed", dir, n)
+		case expired:
+			return fmt.Errorf("%s %d: timeout after %v, %d bytes short", dir, n, t.Timeout, t.allowed[dir]-t.forwarded[dir])
+		}
+		t.cond.Wait()
+	}
+	return nil
+}
+
+// Forwarded returns the bytes forwarded in one direction so far
+func (t *Tunnel) Forwarded(dir Direction) int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.forwarded[dir]
+}
+
+// Wait waits for the spec and the connection to finish, and returns the
+// error of the spec or of the connect. A tunnel still paused when its
+// spec is done is resumed, so that the peers can finish.
+func (t *Tunnel) Wait() error {
+	t.mutex.Lock()
+	specDone := t.specDone
+	t.mutex.Unlock()
+	if specDone != nil {
+		<-specDone
+		t.mutex.Lock()
+		if t.paused {
+			t.Logger.Log(3, "Resuming to finish the connection")
+			t.paused = false
+			t.cond.Broadcast()
+		}
+		t.mutex.Unlock()
+	}
+	t.wg.Wait()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+// Listening reports whether the tunnel is running on its listener. The
+// listener it keeps between runs, after Wait, does not count.
+func (t *Tunnel) Listening() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.listener != nil && t.Running
+}
+
+// Break stops the tunnel: it closes both ends of the connection and the
+// listener. A later Start listens on the same address again.
+func (t *Tunnel) Break() {
+	t.mutex.Lock()
+	t.closed = true
+	conns := t.conns
+	listener := t.listener
+	t.listener = nil
+	t.cond.Broadcast()
+	t.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if listener != nil {
+		listener.Close()
+	}
+}
+
+// defineMacros defines ${tNAME_addr}, ${tNAME_port} and ${tNAME_sock}
+func (t *Tunnel) defineMacros() {
+	if t.macros == nil {
+		return
+	}
+	t.macros.DefineIn(t.Name, "addr", gnet.BracketHost(t.Addr))
+	t.macros.DefineIn(t.Name, "port", t.Port)
+	t.macros.DefineIn(t.Name, "sock", t.Listen)
+}
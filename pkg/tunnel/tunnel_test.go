@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// echoServer echoes one connection back and returns its address
+func echoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	return l.Addr().String()
+}
+
+// startTunnel starts a paused tunnel to addr that runs spec, and
+// connects to it
+func startTunnel(t *testing.T, addr string, spec SpecFunc) (*Tunnel, net.Conn) {
+	t.Helper()
+	tn := New(logging.NewLogger("test"), nil, "t1")
+	tn.Connect = addr
+	tn.Timeout = 2 * time.Second
+	if err := tn.Start(spec, true, nil); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(tn.Break)
+	conn, err := net.Dial("tcp", tn.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return tn, conn
+}
+
+func TestForward(t *testing.T) {
+	tn, conn := startTunnel(t, echoServer(t), nil)
+
+	if _, err := conn.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tn.Forward(Send, 4); err != nil {
+		t.Fatalf("Forward(send) failed: %v", err)
+	}
+	if err := tn.Forward(Recv, 3); err != nil {
+		t.Fatalf("Forward(recv) failed: %v", err)
+	}
+
+	buf := make([]byte, 10)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := io.ReadAtLeast(conn, buf, 3)
+	if err != nil || string(buf[:n]) != "012" {
+		t.Fatalf("read %q, %v; want \"012\"", buf[:n], err)
+	}
+
+	// Nothing more gets through while paused
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("read %q from a paused tunnel", buf[:n])
+	}
+
+	if err := tn.Resume(); err != nil {
+		t.Fatalf("Resume() failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = io.ReadFull(conn, buf[:7])
+	if err != nil || string(buf[:n]) != "3456789" {
+		t.Fatalf("read %q, %v; want \"3456789\"", buf[:n], err)
+	}
+	if got := tn.Forwarded(Send); got != 10 {
+		t.Errorf("Forwarded(send) = %d, want 10", got)
+	}
+
+	if err := tn.Forward(Send, 1); err == nil {
+		t.Error("Forward() on a running tunnel should fail")
+	}
+	if err := tn.Resume(); err == nil {
+		t.Error("Resume() on a running tunnel should fail")
+	}
+}
+
+func TestForward_ShortStream(t *testing.T) {
+	tn, conn := startTunnel(t, echoServer(t), nil)
+	conn.Write([]byte("0123456789"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	err := tn.Forward(Send, 20)
+	if err == nil || !strings.Contains(err.Error(), "10 bytes short") {
+		t.Fatalf("Forward() = %v, want the stream to end 10 bytes short", err)
+	}
+	if got := tn.Forwarded(Send); got != 10 {
+		t.Errorf("Forwarded(send) = %d, want 10", got)
+	}
+}
+
+func TestRewriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		edits []Edit
+		want  string
+	}{
+		{"none", nil, "0123456789"},
+		{"drop", []Edit{{Kind: Drop, Offset: 2, Len: 3}}, "0156789"},
+		{"dup", []Edit{{Kind: Dup, Offset: 3, Len: 4}}, "01234563456789"},
+		{"inject", []Edit{{Kind: Inject, Offset: 4, Data: []byte("xy")}}, "0123xy456789"},
+		{"inject at start", []Edit{{Kind: Inject, Offset: 0, Data: []byte("x")}}, "x0123456789"},
+		{"inject past end", []Edit{{Kind: Inject, Offset: 99, Data: []byte("x")}}, "0123456789x"},
+		{"drop to end", []Edit{{Kind: Drop, Offset: 8, Len: 10}}, "01234567"},
+		{"several", []Edit{
+			{Kind: Inject, Offset: 5, Data: []byte("-")},
+			{Kind: Drop, Offset: 0, Len: 1},
+			{Kind: Dup, Offset: 8, Len: 2},
+		}, "1234-5678989"},
+	}
+	for _, tt := range tests {
+		// The stream arrives in pieces that split the edits
+		rw := newRewriter(tt.edits)
+		var got []byte
+		for _, piece := range []string{"012", "3", "45678", "9"} {
+			got = append(got, rw.apply([]byte(piece))...)
+		}
+		got = append(got, rw.flush()...)
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShaping(t *testing.T) {
+	tn := New(logging.NewLogger("test"), nil, "t1")
+	tn.Connect = echoServer(t)
+	tn.Shaping[Recv] = Shaping{
+		Latency: 200 * time.Millisecond,
+		Edits:   []Edit{{Kind: Inject, Offset: 2, Data: []byte("!")}},
+	}
+	if err := tn.Start(nil, false, nil); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(tn.Break)
+	conn, err := net.Dial("tcp", tn.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.Write([]byte("abcd"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ab!cd" {
+		t.Errorf("read %q, want \"ab!cd\"", buf)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("echo took %v, want at least the 200ms latency", elapsed)
+	}
+}
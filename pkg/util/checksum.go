@@ -0,0 +1,44 @@
+package util
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Checksum returns the lowercase hex digest of data using the named
+// algorithm: md5, sha1, sha256, sha512 or crc32
+func Checksum(algo string, data []byte) (string, error) {
+	return ChecksumReader(algo, bytes.NewReader(data))
+}
+
+// ChecksumReader is Checksum for the data read from r, such as a file
+// too large to hold in memory
+func ChecksumReader(algo string, r io.Reader) (string, error) {
+	var h hash.Hash
+	switch algo {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	case "crc32":
+		h = crc32.NewIEEE()
+	default:
+		return "", fmt.Errorf("unknown checksum algorithm: %s", algo)
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,9 @@
+package util
+
+// HTTPDateFormat is the IMF-fixdate format of HTTP dates, as in the Date
+// and Expires headers
+const HTTPDateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// TimingFields lists the timing fields of a received message that HTTP/1
+// and HTTP/2 expose to expect and as ${NAME_timing_FIELD} macros
+var TimingFields = []string{"connect", "ttfb", "headers", "body", "total"}
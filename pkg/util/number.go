@@ -0,0 +1,204 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseNumber parses a decimal or float value. Durations such as "250ms"
+// or "0.5s" are accepted too and converted to seconds, so timing values
+// can be compared against either form.
+func ParseNumber(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("not a number or duration: %q", s)
+	}
+	return d.Seconds(), nil
+}
+
+// IsToleranceOp reports whether op is handled by CompareTolerance
+func IsToleranceOp(op string) bool {
+	return op == "-within" || op == "≈" || op == "-approx"
+}
+
+// CompareTolerance evaluates the tolerance operators:
+//
+//	-within LO HI          LO <= actual <= HI
+//	≈ VALUE TOL, -approx   |actual - VALUE| <= TOL (TOL may be "N%" of VALUE)
+func CompareTolerance(actual, op, expected string) (bool, error) {
+	args := strings.Fields(expected)
+	if len(args) != 2 {
+		return false, fmt.Errorf("%s requires two operands, got %q", op, expected)
+	}
+
+	val, err := ParseNumber(actual)
+	if err != nil {
+		return false, fmt.Errorf("cannot compare %q with %s: %w", actual, op, err)
+	}
+	a, err := ParseNumber(args[0])
+	if err != nil {
+		return false, fmt.Errorf("invalid %s operand: %w", op, err)
+	}
+
+	if op == "-within" {
+		hi, err := ParseNumber(args[1])
+		if err != nil {
+			return false, fmt.Errorf("invalid %s operand: %w", op, err)
+		}
+		return val >= a && val <= hi, nil
+	}
+
+	var tol float64
+	if pct, ok := strings.CutSuffix(args[1], "%"); ok {
+		p, err := strconv.ParseFloat(pct, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid %s tolerance %q", op, args[1])
+		}
+		tol = a * p / 100
+		if tol < 0 {
+			tol = -tol
+		}
+	} else if tol, err = ParseNumber(args[1]); err != nil {
+		return false, fmt.Errorf("invalid %s tolerance: %w", op, err)
+	}
+	diff := val - a
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= tol, nil
+}
+
+// ParseSize parses a byte count with an optional K, M, G or T suffix
+// (powers of 1024)
+func ParseSize(s string) (uint64, error) {
+	mult := uint64(1)
+	num := strings.ToUpper(s)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if strings.HasSuffix(num, suffix) {
+			num = strings.TrimSuffix(num, suffix)
+			mult = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxUint64/mult {
+		return 0, fmt.Errorf("size %q out of range", s)
+	}
+	return n * mult, nil
+}
+
+// Compare applies an expect operator: ==, !=, <, <=, >, >=, their -eq,
+// -ne, -lt, -le, -gt and -ge forms, the regular expression matches ~ and
+// !~, and the tolerance operators. An empty actual value is "<undef>".
+func Compare(actual, op, expected string) (bool, error) {
+	// Handle <undef> special value
+	isActualUndef := (actual == "")
+	isExpectedUndef := (expected == "<undef>")
+
+	switch op {
+	case "==", "-eq":
+		// Check if comparing with <undef>
+		if isExpectedUndef {
+			return isActualUndef, nil
+		}
+		// -eq can be either string or numeric, try numeric first
+		if op == "-eq" {
+			actualInt, err1 := strconv.ParseInt(actual, 0, 64)
+			expectedInt, err2 := strconv.ParseInt(expected, 0, 64)
+			if err1 == nil && err2 == nil {
+				return actualInt == expectedInt, nil
+			}
+		}
+		return actual == expected, nil
+	case "!=", "-ne":
+		// Check if comparing with <undef>
+		if isExpectedUndef {
+			return !isActualUndef, nil
+		}
+		// -ne is numeric not-equal
+		if op == "-ne" {
+			return compareNumeric(actual, "!=", expected)
+		}
+		return actual != expected, nil
+	case "~":
+		// Regex match
+		re, err := regexp.Compile(expected)
+		if err != nil {
+			return false, fmt.Errorf("invalid regex %s: %w", expected, err)
+		}
+		return re.MatchString(actual), nil
+	case "!~":
+		// Regex not match
+		re, err := regexp.Compile(expected)
+		if err != nil {
+			return false, fmt.Errorf("invalid regex %s: %w", expected, err)
+		}
+		return !re.MatchString(actual), nil
+	case "-within", "≈", "-approx":
+		// Tolerance: "-within LO HI" or "≈ VALUE TOL"
+		return CompareTolerance(actual, op, expected)
+	case "<", "-lt":
+		return compareNumeric(actual, "<", expected)
+	case ">", "-gt":
+		return compareNumeric(actual, ">", expected)
+	case "<=", "-le":
+		return compareNumeric(actual, "<=", expected)
+	case ">=", "-ge":
+		return compareNumeric(actual, ">=", expected)
+	default:
+		return false, fmt.Errorf("unknown operator: %s", op)
+	}
+}
+
+// compareNumeric performs numeric comparison
+func compareNumeric(actual, op, expected string) (bool, error) {
+	// Try to parse as integers first (base 0 auto-detects hex with 0x prefix)
+	actualInt, err1 := strconv.ParseInt(actual, 0, 64)
+	expectedInt, err2 := strconv.ParseInt(expected, 0, 64)
+
+	if err1 == nil && err2 == nil {
+		// Both are integers
+		switch op {
+		case "<":
+			return actualInt < expectedInt, nil
+		case ">":
+			return actualInt > expectedInt, nil
+		case "<=":
+			return actualInt <= expectedInt, nil
+		case ">=":
+			return actualInt >= expectedInt, nil
+		}
+	}
+
+	// Try as floats, or durations in seconds
+	actualFloat, err1 := ParseNumber(actual)
+	expectedFloat, err2 := ParseNumber(expected)
+
+	if err1 != nil || err2 != nil {
+		return false, fmt.Errorf("cannot compare non-numeric values with %s", op)
+	}
+
+	switch op {
+	case "<":
+		return actualFloat < expectedFloat, nil
+	case ">":
+		return actualFloat > expectedFloat, nil
+	case "<=":
+		return actualFloat <= expectedFloat, nil
+	case ">=":
+		return actualFloat >= expectedFloat, nil
+	}
+
+	return false, fmt.Errorf("unknown numeric operator: %s", op)
+}
@@ -0,0 +1,120 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"42", 42},
+		{"0.25", 0.25},
+		{"250ms", 0.25},
+		{"1.5s", 1.5},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNumber(tt.input)
+		if err != nil {
+			t.Errorf("ParseNumber(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseNumber(%q) = %v, expected %v", tt.input, got, tt.expected)
+		}
+	}
+
+	if _, err := ParseNumber("fast"); err == nil {
+		t.Error("Expected error for non-numeric value")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected uint64
+	}{
+		{"512", 512},
+		{"4k", 4096},
+		{"2M", 2 << 20},
+		{"1T", 1 << 40},
+		{"16777215T", 16777215 << 40},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.input)
+		if err != nil {
+			t.Errorf("ParseSize(%q) failed: %v", tt.input, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("ParseSize(%q) = %v, expected %v", tt.input, got, tt.expected)
+		}
+	}
+
+	for _, bad := range []string{"big", "-1K", "16777216T", "18446744073709551615K"} {
+		if _, err := ParseSize(bad); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
+
+func TestCompareTolerance(t *testing.T) {
+	tests := []struct {
+		actual   string
+		op       string
+		expected string
+		result   bool
+	}{
+		{"3", "-within", "2 5", true},
+		{"6", "-within", "2 5", false},
+		{"0.12", "-within", "0 200ms", true},
+		{"1.05", "≈", "1 0.1", true},
+		{"1.2", "≈", "1 0.1", false},
+		{"103", "-approx", "100 5%", true},
+		{"106", "-approx", "100 5%", false},
+	}
+
+	for _, tt := range tests {
+		got, err := CompareTolerance(tt.actual, tt.op, tt.expected)
+		if err != nil {
+			t.Errorf("CompareTolerance(%q %s %q) failed: %v", tt.actual, tt.op, tt.expected, err)
+			continue
+		}
+		if got != tt.result {
+			t.Errorf("CompareTolerance(%q %s %q) = %v, expected %v", tt.actual, tt.op, tt.expected, got, tt.result)
+		}
+	}
+
+	if _, err := CompareTolerance("1", "-within", "2"); err == nil {
+		t.Error("Expected error for missing operand")
+	}
+}
+
+func TestCompare_FloatAndDuration(t *testing.T) {
+	tests := []struct {
+		actual   string
+		op       string
+		expected string
+		result   bool
+	}{
+		{"0.125", "<", "0.5s", true},
+		{"0.75", "<", "500ms", false},
+		{"1.5", ">=", "1.25", true},
+		{"0.98", "≈", "1 0.05", true},
+		{"0x10", "==", "0x10", true},
+	}
+
+	for _, tt := range tests {
+		got, err := Compare(tt.actual, tt.op, tt.expected)
+		if err != nil {
+			t.Errorf("Compare(%q %s %q) failed: %v", tt.actual, tt.op, tt.expected, err)
+			continue
+		}
+		if got != tt.result {
+			t.Errorf("Compare(%q %s %q) = %v, expected %v", tt.actual, tt.op, tt.expected, got, tt.result)
+		}
+	}
+}
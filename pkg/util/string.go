@@ -240,3 +240,82 @@ func StripComments(line string) string {
 
 	return line
 }
+
+// QuoteVerbatim encodes s as a single $"..." token with Go escapes, so that
+// newlines, quotes and the ||| nested-spec delimiter survive the trip
+// through a spec string. $, # and | are escaped as well, so the text is
+// neither macro-expanded, cut as a comment nor split into spec lines.
+func QuoteVerbatim(s string) string {
+	q := strconv.Quote(s)
+	q = strings.NewReplacer("$", `\x24`, "#", `\x23`, "|", `\x7c`).Replace(q)
+	return "$" + q
+}
+
+// VerbatimEnd returns the index just past the $"..." token that starts at
+// line[i], or -1 if there is none
+func VerbatimEnd(line string, i int) int {
+	if !strings.HasPrefix(line[i:], `$"`) {
+		return -1
+	}
+	for j := i + 2; j < len(line); j++ {
+		switch line[j] {
+		case '\\':
+			j++
+		case '"':
+			return j + 1
+		}
+	}
+	return -1
+}
+
+// UnquoteVerbatim decodes a token made by QuoteVerbatim. Other tokens are
+// returned unchanged.
+func UnquoteVerbatim(tok string) string {
+	if len(tok) < 3 || !strings.HasPrefix(tok, `$"`) || !strings.HasSuffix(tok, `"`) {
+		return tok
+	}
+	s, err := strconv.Unquote(tok[1:])
+	if err != nil {
+		return tok
+	}
+	return s
+}
+
+// Unescape turns \r, \n, \t, \0, \\ and \xHH in s into the bytes they
+// stand for; anything else is kept as is
+func Unescape(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		switch s[i+1] {
+		case 'r':
+			b = append(b, '\r')
+		case 'n':
+			b = append(b, '\n')
+		case 't':
+			b = append(b, '\t')
+		case '0':
+			b = append(b, 0)
+		case '\\':
+			b = append(b, '\\')
+		case 'x':
+			if i+3 < len(s) {
+				if v, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+					b = append(b, byte(v))
+					i += 3
+					continue
+				}
+			}
+			b = append(b, s[i])
+			continue
+		default:
+			b = append(b, s[i])
+			continue
+		}
+		i++
+	}
+	return b
+}
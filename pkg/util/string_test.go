@@ -1,6 +1,7 @@
 package util
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -108,3 +109,67 @@ func TestStripComments(t *testing.T) {
 		}
 	}
 }
+
+func TestQuoteVerbatim(t *testing.T) {
+	for _, s := range []string{"", "plain", "two\nlines\r\n", `{"json": "$x # |||"}`, "\x00\xff tab\t"} {
+		q := QuoteVerbatim(s)
+		if strings.ContainsAny(q[1:], "\n\r$#|") {
+			t.Errorf("%q: encoded form %s has unescaped special characters", s, q)
+		}
+		if end := VerbatimEnd("x "+q+" y", 2); end != len(q)+2 {
+			t.Errorf("%q: VerbatimEnd = %d, want %d", s, end, len(q)+2)
+		}
+		if got := UnquoteVerbatim(q); got != s {
+			t.Errorf("Round trip of %q gave %q", s, got)
+		}
+	}
+	if got := UnquoteVerbatim(`"plain"`); got != `"plain"` {
+		t.Errorf("Expected a plain token to be left alone, got %q", got)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tests := []struct {
+		algo     string
+		expected string
+	}{
+		{"md5", "5d41402abc4b2a76b9719d911017c592"},
+		{"sha1", "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"},
+		{"sha256", "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{"crc32", "3610a686"},
+	}
+
+	for _, tt := range tests {
+		sum, err := Checksum(tt.algo, []byte("hello"))
+		if err != nil {
+			t.Errorf("Checksum(%s) failed: %v", tt.algo, err)
+			continue
+		}
+		if sum != tt.expected {
+			t.Errorf("Checksum(%s) = %s, expected %s", tt.algo, sum, tt.expected)
+		}
+	}
+
+	if _, err := Checksum("sha3", nil); err == nil {
+		t.Error("Expected error for unknown algorithm")
+	}
+}
+
+func TestUnescape(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`plain`, "plain"},
+		{`a\r\nb`, "a\r\nb"},
+		{`\t\0\\`, "\t\x00\\"},
+		{`\x41\x7f`, "A\x7f"},
+		{`\xZZ`, `\xZZ`},
+		{`\q`, `\q`},
+		{`end\`, `end\`},
+	}
+	for _, tt := range tests {
+		if got := string(Unescape(tt.in)); got != tt.want {
+			t.Errorf("Unescape(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
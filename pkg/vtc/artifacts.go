@@ -0,0 +1,136 @@
+package vtc
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// ObjectDir returns the directory of a server, client or process under
+// ${tmpdir}, creating it and defining ${NAME_dir} on first use. Without a
+// temporary directory, as in unit tests, it returns "".
+func (ctx *ExecContext) ObjectDir(name string) (string, error) {
+	if ctx.TmpDir == "" {
+		return "", nil
+	}
+	dir := filepath.Join(ctx.TmpDir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory for %s: %w", name, err)
+	}
+	if ctx.Macros != nil {
+		ctx.Macros.Define(name+"_dir", dir)
+	}
+	return dir, nil
+}
+
+// AddArtifact registers a file or directory to be saved when the test
+// fails (gvtest -o DIR), whether or not the temporary directory is kept.
+// Safe for concurrent use.
+func (ctx *ExecContext) AddArtifact(path string) {
+	ctx.artifactsMu.Lock()
+	defer ctx.artifactsMu.Unlock()
+	for _, p := range ctx.artifacts {
+		if p == path {
+			return
+		}
+	}
+	ctx.artifacts = append(ctx.artifacts, path)
+}
+
+// Artifacts returns the registered artifacts in registration order
+func (ctx *ExecContext) Artifacts() []string {
+	ctx.artifactsMu.Lock()
+	defer ctx.artifactsMu.Unlock()
+	return append([]string(nil), ctx.artifacts...)
+}
+
+// SaveArtifacts copies the registered artifacts to dst. Paths inside
+// ${tmpdir} keep their layout below it; others are saved by base name.
+// Artifacts that no longer exist are skipped.
+func (ctx *ExecContext) SaveArtifacts(dst string) error {
+	for _, src := range ctx.Artifacts() {
+		rel := filepath.Base(src)
+		if ctx.TmpDir != "" {
+			if r, err := filepath.Rel(ctx.TmpDir, src); err == nil && !strings.HasPrefix(r, "..") {
+				rel = r
+			}
+		}
+		if err := copyTree(src, filepath.Join(dst, rel)); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to save artifact %s: %w", src, err)
+		}
+	}
+	return nil
+}
+
+// copyTree copies a file, or a directory with everything below it
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+// copyFile copies a regular file, creating the parent directories of dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// cmdArtifact handles "artifact PATH...": the files or directories are
+// saved if the test fails. Relative paths are in ${tmpdir}.
+func cmdArtifact(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("artifact: invalid context")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("artifact: missing path")
+	}
+
+	for _, arg := range args {
+		path, err := tmpPath(ctx, logger, arg)
+		if err != nil {
+			return fmt.Errorf("artifact: %w", err)
+		}
+		ctx.AddArtifact(path)
+		logger.Debug("Registered artifact %s", path)
+	}
+	return nil
+}
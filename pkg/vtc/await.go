@@ -0,0 +1,157 @@
+package vtc
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+	gnet "github.com/perbu/GTest/pkg/net"
+)
+
+// awaitInterval is how often await probes
+const awaitInterval = 50 * time.Millisecond
+
+// cmdAwait handles the "await" command: it probes until a TCP or Unix
+// socket accepts, an HTTP URL answers, or a file exists
+func cmdAwait(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for await command")
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("await: usage: await tcp|http|file TARGET [options]")
+	}
+	kind := args[0]
+	target, err := ctx.Macros.Expand(logger, args[1])
+	if err != nil {
+		return fmt.Errorf("await: %w", err)
+	}
+
+	timeout := 10 * time.Second
+	status := 0
+	for i := 2; i < len(args); i++ {
+		switch args[i] {
+		case "-timeout":
+			if i+1 >= len(args) {
+				return fmt.Errorf("await: -timeout requires a value")
+			}
+			i++
+			seconds, err := strconv.ParseFloat(args[i], 64)
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("await: invalid timeout: %s", args[i])
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+
+		case "-status":
+			if kind != "http" {
+				return fmt.Errorf("await: -status only applies to http")
+			}
+			if i+1 >= len(args) {
+				return fmt.Errorf("await: -status requires a value")
+			}
+			i++
+			var err error
+			status, err = strconv.Atoi(args[i])
+			if err != nil || status < 100 || status > 999 {
+				return fmt.Errorf("await: invalid status: %s", args[i])
+			}
+
+		default:
+			return fmt.Errorf("await: unknown option: %s", args[i])
+		}
+	}
+
+	var probe func(time.Duration) error
+	switch kind {
+	case "tcp":
+		// TARGET is any address a server listens on: host:port,
+		// "host port" as ${sN_sock} has it, or a Unix socket
+		host, port, isUnix, err := gnet.ParseAddress(target)
+		if err != nil {
+			return fmt.Errorf("await: %w", err)
+		}
+		network, addr := "tcp", net.JoinHostPort(host, port)
+		if isUnix {
+			network, addr = "unix", host
+		}
+		probe = func(limit time.Duration) error {
+			conn, err := net.DialTimeout(network, addr, limit)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		}
+	case "http":
+		if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+			return fmt.Errorf("await: http needs an http:// or https:// URL, got %s", target)
+		}
+		probe = func(limit time.Duration) error {
+			return awaitHTTP(target, status, limit)
+		}
+	case "file":
+		probe = func(time.Duration) error {
+			_, err := os.Stat(target)
+			return err
+		}
+	default:
+		return fmt.Errorf("await: unknown probe %s (want tcp, http or file)", kind)
+	}
+
+	logger.Log(3, "Awaiting %s %s", kind, target)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		// A probe may take up to a second of what is left
+		limit := time.Until(deadline)
+		if limit > time.Second {
+			limit = time.Second
+		}
+		err := probe(limit)
+		if err == nil {
+			logger.Log(3, "%s %s ready after %v", kind, target, time.Since(start).Round(time.Millisecond))
+			return nil
+		}
+		if time.Until(deadline) <= 0 {
+			return fmt.Errorf("await: %s %s not ready after %v: %w", kind, target, timeout, err)
+		}
+		logger.Debug("await %s %s: %v", kind, target, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("await: %s %s: test aborted", kind, target)
+		case <-time.After(awaitInterval):
+		}
+	}
+}
+
+// awaitHTTP gets url once. It is ready when the response has the
+// wanted status, or any 2xx status if want is 0. Certificates are not
+// checked, as test servers rarely have real ones.
+func awaitHTTP(url string, want int, limit time.Duration) error {
+	client := &http.Client{
+		Timeout: limit,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if want == 0 && resp.StatusCode/100 == 2 || resp.StatusCode == want {
+		return nil
+	}
+	return fmt.Errorf("status %d", resp.StatusCode)
+}
@@ -2,7 +2,11 @@
 package vtc
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
@@ -11,22 +15,38 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/perbu/GTest/pkg/barrier"
 	"github.com/perbu/GTest/pkg/logging"
 	"github.com/perbu/GTest/pkg/process"
+	"github.com/perbu/GTest/pkg/util"
 )
 
 // RegisterBuiltinCommands registers all built-in VTC commands
 func RegisterBuiltinCommands() {
 	RegisterCommand("barrier", cmdBarrier, FlagGlobal)
 	RegisterCommand("shell", cmdShell, FlagGlobal)
+	RegisterCommand("err_shell", cmdErrShell, FlagGlobal)
+	RegisterCommand("expect", cmdExpect, FlagNone)
 	RegisterCommand("delay", cmdDelay, FlagGlobal)
+	RegisterCommand("clock", cmdClock, FlagGlobal)
+	RegisterCommand("await", cmdAwait, FlagGlobal)
+	RegisterCommand("setvar", cmdSetvar, FlagGlobal)
 	RegisterCommand("feature", cmdFeature, FlagNone)
 	RegisterCommand("filewrite", cmdFilewrite, FlagNone)
+	RegisterCommand("fileread", cmdFileread, FlagNone)
+	RegisterCommand("artifact", cmdArtifact, FlagGlobal)
 	RegisterCommand("process", cmdProcess, FlagNone)
+	RegisterCommand("spec", cmdSpec, FlagNone)
 	RegisterCommand("vtest", cmdVtest, FlagNone)
+	RegisterCommand("expect_test_fail", cmdExpectTestFail, FlagNone)
+	RegisterCommand("fatal", cmdFatal, FlagNone)
+	RegisterCommand("non_fatal", cmdNonFatal, FlagNone)
+	RegisterCommand("ignore_unknown_commands", cmdIgnoreUnknown, FlagNone)
+	RegisterCommand("loglevel", cmdLoglevel, FlagNone)
+	RegisterDocs(builtinDocs)
 	// Note: server and client commands are registered in cmd/gvtest/handlers.go
 }
 
@@ -100,6 +120,109 @@ func cmdVtest(args []string, priv interface{}, logger *logging.Logger) error {
 	return nil
 }
 
+// cmdSetvar handles "setvar NAME VALUE": sets a test variable, which any
+// spec or top-level command reads back as ${var.NAME}
+func cmdSetvar(args []string, priv interface{}, logger *logging.Logger) error {
+	return setvar(args, priv, logger, true)
+}
+
+// SpecSetvar runs setvar from a client or server spec, whose lines have
+// their macros expanded before they run
+func SpecSetvar(args []string, priv interface{}, logger *logging.Logger) error {
+	return setvar(args, priv, logger, false)
+}
+
+// setvar sets the variable, expanding the macros in its value if they
+// have not been already
+func setvar(args []string, priv interface{}, logger *logging.Logger, expand bool) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("setvar: invalid context")
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("setvar: requires a name and a value")
+	}
+
+	value := strings.Join(args[1:], " ")
+	if expand {
+		var err error
+		if value, err = ctx.Macros.Expand(logger, value); err != nil {
+			return fmt.Errorf("setvar: macro expansion failed: %w", err)
+		}
+	}
+	ctx.SetVar(args[0], value)
+	logger.Log(3, "setvar %s = %q", args[0], value)
+	return nil
+}
+
+// cmdFatal handles the "fatal" command: failures abort the test again
+func cmdFatal(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("fatal: invalid context")
+	}
+	ctx.NonFatal = false
+	logger.Debug("Failures are fatal")
+	return nil
+}
+
+// cmdNonFatal handles the "non_fatal" command: failing top-level commands
+// are recorded and reported but the test continues
+func cmdNonFatal(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("non_fatal: invalid context")
+	}
+	ctx.NonFatal = true
+	logger.Debug("Failures are non-fatal")
+	return nil
+}
+
+// cmdIgnoreUnknown handles the "ignore_unknown_commands" command: from here
+// on, unknown commands are logged and skipped instead of failing the test
+func cmdIgnoreUnknown(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("ignore_unknown_commands: invalid context")
+	}
+	ctx.IgnoreUnknown = true
+	logger.Debug("Unknown commands will be skipped")
+	return nil
+}
+
+// cmdLoglevel handles "loglevel [COMPONENT] LEVEL": sets the most verbose
+// level logged for one component of this test (a client or server name,
+// http1, http2), or for all of them
+func cmdLoglevel(args []string, priv interface{}, logger *logging.Logger) error {
+	component, name := logging.AllComponents, ""
+	switch len(args) {
+	case 1:
+		name = args[0]
+	case 2:
+		component, name = args[0], args[1]
+	default:
+		return fmt.Errorf("loglevel: requires [COMPONENT] LEVEL")
+	}
+
+	level, err := logging.ParseLevel(name)
+	if err != nil {
+		return fmt.Errorf("loglevel: %w", err)
+	}
+	logger.SetLevel(component, level)
+	logger.Log(3, "loglevel %s = %s", component, logging.LevelName(level))
+	return nil
+}
+
+// SyncBarrier waits at b until it releases, it times out or the test
+// aborts. An abort returns the error the test failed with.
+func SyncBarrier(ctx *ExecContext, b *barrier.Barrier) error {
+	err := b.WaitAbortable(ctx.Done())
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 // cmdBarrier handles the "barrier" command
 func cmdBarrier(args []string, priv interface{}, logger *logging.Logger) error {
 	ctx, ok := priv.(*ExecContext)
@@ -165,15 +288,12 @@ func cmdBarrier(args []string, priv interface{}, logger *logging.Logger) error {
 			}
 			return b.Start(count)
 
-		case "-wait":
-			return b.Wait()
+		case "-wait", "-sync":
+			return SyncBarrier(ctx, b)
 
 		case "sync":
 			// VTest2 syntax: barrier <name> sync
-			return b.Sync()
-
-		case "-sync":
-			return b.Sync()
+			return SyncBarrier(ctx, b)
 
 		case "-timeout":
 			if i+1 >= len(args) {
@@ -197,7 +317,8 @@ func cmdBarrier(args []string, priv interface{}, logger *logging.Logger) error {
 	return nil
 }
 
-// cmdShell handles the "shell" command
+// cmdShell handles the "shell" command. Its outputs and exit status are
+// exported as ${shell_out}, ${shell_err} and ${shell_status}.
 func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 	ctx, ok := priv.(*ExecContext)
 	if !ok {
@@ -210,11 +331,20 @@ func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 
 	// Parse options
 	var (
-		shellCmd      string
-		expectExit    = 0
-		matchPattern  string
-		expectOutput  string
-		hasExitCode   = false
+		shellCmd     string
+		expectExit   = 0
+		matchPattern string
+		matchStderr  string
+		expectOutput string
+		expectStdout *string
+		expectStderr *string
+		stdin        *string
+		env          []string
+		timeout      time.Duration
+		shell        = process.DefaultShell
+		hasExitCode  = false
+		expectErr    bool
+		execArgs     bool
 	)
 
 	for i := 0; i < len(args); i++ {
@@ -231,6 +361,9 @@ func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 			}
 			hasExitCode = true
 
+		case "-err":
+			expectErr = true
+
 		case "-match":
 			if i+1 >= len(args) {
 				return fmt.Errorf("shell: -match requires a value")
@@ -238,6 +371,13 @@ func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 			i++
 			matchPattern = args[i]
 
+		case "-match-stderr":
+			if i+1 >= len(args) {
+				return fmt.Errorf("shell: -match-stderr requires a value")
+			}
+			i++
+			matchStderr = args[i]
+
 		case "-expect":
 			if i+1 >= len(args) {
 				return fmt.Errorf("shell: -expect requires a value")
@@ -245,6 +385,64 @@ func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 			i++
 			expectOutput = args[i]
 
+		case "-expect-stdout", "-expect-stderr":
+			if i+1 >= len(args) {
+				return fmt.Errorf("shell: %s requires a value", args[i])
+			}
+			value := args[i+1]
+			if args[i] == "-expect-stdout" {
+				expectStdout = &value
+			} else {
+				expectStderr = &value
+			}
+			i++
+
+		case "-stdin":
+			if i+1 >= len(args) {
+				return fmt.Errorf("shell: -stdin requires a value")
+			}
+			i++
+			data, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("shell: macro expansion failed: %w", err)
+			}
+			stdin = &data
+
+		case "-env":
+			if i+1 >= len(args) {
+				return fmt.Errorf("shell: -env requires KEY=VALUE")
+			}
+			i++
+			if !strings.Contains(args[i], "=") {
+				return fmt.Errorf("shell: -env requires KEY=VALUE, got %q", args[i])
+			}
+			kv, err := ctx.Macros.Expand(logger, args[i])
+			if err != nil {
+				return fmt.Errorf("shell: macro expansion failed: %w", err)
+			}
+			env = append(env, kv)
+
+		case "-timeout":
+			if i+1 >= len(args) {
+				return fmt.Errorf("shell: -timeout requires a value")
+			}
+			i++
+			seconds, err := util.ParseNumber(args[i])
+			if err != nil || seconds <= 0 {
+				return fmt.Errorf("shell: invalid timeout: %s", args[i])
+			}
+			timeout = time.Duration(seconds * float64(time.Second))
+
+		case "-shell":
+			if i+1 >= len(args) {
+				return fmt.Errorf("shell: -shell requires a value")
+			}
+			i++
+			shell = args[i]
+
+		case "-exec":
+			execArgs = true
+
 		default:
 			// This is the command to execute
 			shellCmd = args[i]
@@ -255,35 +453,74 @@ func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 		return fmt.Errorf("shell: no command specified")
 	}
 
-	// Expand macros in the shell command
-	shellCmd, err := ctx.Macros.Expand(logger, shellCmd)
-	if err != nil {
-		return fmt.Errorf("shell: macro expansion failed: %w", err)
+	var argv []string
+	if execArgs {
+		var err error
+		if argv, err = execCommand(ctx, logger, shellCmd); err != nil {
+			return fmt.Errorf("shell: %w", err)
+		}
+		logger.Debug("Executing command: %q", argv)
+	} else {
+		// Expand macros in the shell command
+		expanded, err := ctx.Macros.Expand(logger, shellCmd)
+		if err != nil {
+			return fmt.Errorf("shell: macro expansion failed: %w", err)
+		}
+		logger.Debug("Executing shell command: %s", expanded)
+		argv = process.ShellCommand(shell, expanded)
 	}
 
-	// Execute the command
-	logger.Debug("Executing shell command: %s", shellCmd)
-	cmd := exec.Command("sh", "-c", shellCmd)
+	cmdCtx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		cmdCtx, cancel = context.WithTimeout(cmdCtx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(cmdCtx, argv[0], argv[1:]...)
 	cmd.Dir = ctx.TmpDir
+	// Don't wait for background children that keep the pipes open
+	cmd.WaitDelay = time.Second
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if stdin != nil {
+		cmd.Stdin = strings.NewReader(*stdin)
+	}
+
+	var stdout, stderr, combined bytes.Buffer
+	var outputMu sync.Mutex
+	cmd.Stdout = &lockedWriter{mu: &outputMu, w: io.MultiWriter(&stdout, &combined)}
+	cmd.Stderr = &lockedWriter{mu: &outputMu, w: io.MultiWriter(&stderr, &combined)}
 
-	output, err := cmd.CombinedOutput()
+	err := cmd.Run()
 	exitCode := 0
 	if err != nil {
+		if cmdCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("shell: timed out after %v", timeout)
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
 		} else {
 			return fmt.Errorf("shell: failed to execute: %w", err)
 		}
 	}
+	output := combined.String()
+
+	ctx.Macros.Define("shell_out", strings.TrimSuffix(stdout.String(), "\n"))
+	ctx.Macros.Define("shell_err", strings.TrimSuffix(stderr.String(), "\n"))
+	ctx.Macros.Definef("shell_status", "%d", exitCode)
 
 	// Check exit code
 	if hasExitCode && exitCode != expectExit {
 		return fmt.Errorf("shell: expected exit code %d, got %d", expectExit, exitCode)
 	}
+	if expectErr && exitCode == 0 {
+		return fmt.Errorf("shell: expected a non-zero exit code")
+	}
 
 	// Check output match
 	if matchPattern != "" {
-		matched, err := regexp.MatchString(matchPattern, string(output))
+		matched, err := regexp.MatchString(matchPattern, output)
 		if err != nil {
 			return fmt.Errorf("shell: invalid regex: %w", err)
 		}
@@ -291,16 +528,156 @@ func cmdShell(args []string, priv interface{}, logger *logging.Logger) error {
 			return fmt.Errorf("shell: output did not match pattern %s", matchPattern)
 		}
 	}
+	if matchStderr != "" {
+		matched, err := regexp.MatchString(matchStderr, stderr.String())
+		if err != nil {
+			return fmt.Errorf("shell: invalid regex: %w", err)
+		}
+		if !matched {
+			return fmt.Errorf("shell: stderr did not match pattern %s", matchStderr)
+		}
+	}
 
 	// Check exact output
-	if expectOutput != "" && strings.TrimSpace(string(output)) != expectOutput {
-		return fmt.Errorf("shell: expected output %q, got %q", expectOutput, string(output))
+	if expectOutput != "" && strings.TrimSpace(output) != expectOutput {
+		return fmt.Errorf("shell: expected output %q, got %q", expectOutput, output)
+	}
+	if expectStdout != nil && strings.TrimSpace(stdout.String()) != *expectStdout {
+		return fmt.Errorf("shell: expected stdout %q, got %q", *expectStdout, stdout.String())
+	}
+	if expectStderr != nil && strings.TrimSpace(stderr.String()) != *expectStderr {
+		return fmt.Errorf("shell: expected stderr %q, got %q", *expectStderr, stderr.String())
 	}
 
-	logger.Debug("Shell command output: %s", string(output))
+	logger.Debug("Shell command output: %s", output)
 	return nil
 }
 
+// execCommand splits the command of "shell -exec" and "process -exec"
+// into its arguments, with double quotes and backslash escapes, and
+// expands macros in each argument afterwards, so that a value with
+// spaces or quotes stays one argument
+func execCommand(ctx *ExecContext, logger *logging.Logger, command string) ([]string, error) {
+	argv, err := util.SplitArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	for i, arg := range argv {
+		if argv[i], err = ctx.Macros.Expand(logger, arg); err != nil {
+			return nil, fmt.Errorf("macro expansion failed: %w", err)
+		}
+	}
+	return argv, nil
+}
+
+// cmdErrShell handles the VTest2 "err_shell EXPECTED CMD" command: the
+// command must fail and its output must contain EXPECTED. It is the same
+// as "shell -err -match" with EXPECTED taken literally.
+func cmdErrShell(args []string, priv interface{}, logger *logging.Logger) error {
+	if len(args) != 2 {
+		return fmt.Errorf("err_shell: usage: err_shell EXPECTED CMD")
+	}
+	return cmdShell([]string{"-err", "-match", regexp.QuoteMeta(args[0]), args[1]}, priv, logger)
+}
+
+// cmdExpect handles the top-level "expect" command, which checks a value,
+// the contents of a file or the output of a command outside of client and
+// server specs:
+//
+//	expect ${shell_status} == 0
+//	expect -file ${p1_out} -matches "started"
+//	expect -shell "wc -l < log" >= 3
+//
+// OP is one of util.Compare's, -matches (the same as ~) or -contains.
+func cmdExpect(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for expect command")
+	}
+
+	var what, actual string // What is checked, for messages, and its value
+	switch {
+	case len(args) > 1 && args[0] == "-file":
+		filename, err := tmpPath(ctx, logger, args[1])
+		if err != nil {
+			return fmt.Errorf("expect: %w", err)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("expect: %w", err)
+		}
+		what, actual, args = filename, string(data), args[2:]
+	case len(args) > 1 && args[0] == "-shell":
+		if err := cmdShell(args[1:2], priv, logger); err != nil {
+			return fmt.Errorf("expect: %w", err)
+		}
+		actual, _ = ctx.Macros.Get("shell_out")
+		what, args = fmt.Sprintf("output of %q", args[1]), args[2:]
+	case len(args) > 0:
+		value, err := ctx.Macros.Expand(nil, args[0])
+		if err != nil {
+			// A macro that is not defined is <undef>, when it stands
+			// alone, so that it can be compared with that
+			if !isLoneMacro(args[0]) {
+				return fmt.Errorf("expect: %w", err)
+			}
+			value = ""
+		}
+		what, actual, args = args[0], value, args[1:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("expect: usage: expect VALUE|-file FILE|-shell COMMAND OP VALUE")
+	}
+
+	op := args[0]
+	expected, err := ctx.Macros.Expand(logger, strings.Join(args[1:], " "))
+	if err != nil {
+		return fmt.Errorf("expect: %w", err)
+	}
+	var matched bool
+	switch op {
+	case "-contains":
+		matched = strings.Contains(actual, expected)
+	case "-matches":
+		matched, err = util.Compare(actual, "~", expected)
+	default:
+		matched, err = util.Compare(actual, op, expected)
+	}
+	if err != nil {
+		return fmt.Errorf("expect: %w", err)
+	}
+	if !matched {
+		if len(actual) > 200 {
+			actual = actual[:200] + "..."
+		}
+		return fmt.Errorf("expect failed: %s (%q) %s %s", what, actual, op, expected)
+	}
+
+	logger.Log(4, "expect %s %s %s - OK", what, op, expected)
+	return nil
+}
+
+// isLoneMacro reports whether s is one macro reference and nothing else
+func isLoneMacro(s string) bool {
+	return strings.HasPrefix(s, "${") && strings.Index(s, "}") == len(s)-1
+}
+
+// lockedWriter serializes writes from a command's stdout and stderr
+// copiers, which share the combined output buffer
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
 // cmdDelay handles the "delay" command
 func cmdDelay(args []string, priv interface{}, logger *logging.Logger) error {
 	if len(args) == 0 {
@@ -388,39 +765,59 @@ func cmdFeature(args []string, priv interface{}, logger *logging.Logger) error {
 
 			logger.Debug("Group check passed: user is in group '%s'", groupName)
 
-		case "SO_RCVTIMEO_WORKS":
-			// Platform feature check - assume it works on Linux
-			logger.Debug("feature: SO_RCVTIMEO_WORKS check passed")
-
-		case "dns":
-			// Check if DNS resolution works
-			logger.Debug("feature: dns check - assuming available")
-
-		case "ipv4":
-			// Check if IPv4 connectivity is available
-			if !hasIPv4() {
-				ctx.Skip("IPv4 not available")
+		case "disk_space":
+			// Check for free space in the temp directory, e.g. "disk_space 1G"
+			if i+1 >= len(args) {
+				return fmt.Errorf("feature: disk_space requires a size")
+			}
+			i++
+			need, err := util.ParseSize(args[i])
+			if err != nil {
+				return fmt.Errorf("feature: disk_space: %w", err)
+			}
+			dir := ctx.TmpDir
+			if dir == "" {
+				dir = os.TempDir()
+			}
+			avail, err := freeSpace(dir)
+			if err != nil {
+				ctx.Skip(fmt.Sprintf("cannot determine free disk space: %v", err))
 				return nil
 			}
-			logger.Debug("feature: IPv4 is available")
-
-		case "ipv6":
-			// Check if IPv6 connectivity is available
-			if !hasIPv6() {
-				ctx.Skip("IPv6 not available")
+			if avail < need {
+				ctx.Skip(fmt.Sprintf("only %d bytes free in %s, need %s", avail, dir, args[i]))
 				return nil
 			}
-			logger.Debug("feature: IPv6 is available")
+
+		case "ignore_unknown_macro":
+			// Leave undefined macros unexpanded instead of failing
+			ctx.Macros.SetIgnoreUnknown(true)
 
 		default:
-			return fmt.Errorf("feature: unknown feature check: %s", args[i])
+			// Named feature, negated with a leading "!"
+			name, negate := strings.CutPrefix(args[i], "!")
+			present, reason, err := checkFeature(name)
+			if err != nil {
+				return fmt.Errorf("feature: %w", err)
+			}
+			if present == negate {
+				if negate {
+					reason = "feature " + name + " is present"
+				} else if reason == "" {
+					reason = "feature " + name + " not available"
+				}
+				ctx.Skip(reason)
+				return nil
+			}
+			logger.Debug("feature: %s check passed", args[i])
 		}
 	}
 
 	return nil
 }
 
-// cmdFilewrite handles the "filewrite" command
+// cmdFilewrite handles the "filewrite" command:
+// filewrite [-append] [-hex] [-mode PERM] [-mkdir] FILE CONTENT...
 func cmdFilewrite(args []string, priv interface{}, logger *logging.Logger) error {
 	ctx, ok := priv.(*ExecContext)
 	if !ok {
@@ -432,36 +829,55 @@ func cmdFilewrite(args []string, priv interface{}, logger *logging.Logger) error
 	}
 
 	var (
-		filename string
-		content  string
+		filename   string
+		content    string
 		appendMode bool
+		hexMode    bool
+		mkdir      bool
+		mode       os.FileMode
 	)
 
+parse:
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
 		case "-append":
 			appendMode = true
 
+		case "-hex":
+			hexMode = true
+
+		case "-mkdir":
+			mkdir = true
+
+		case "-mode":
+			if i+1 >= len(args) {
+				return fmt.Errorf("filewrite: -mode requires a value")
+			}
+			i++
+			perm, err := strconv.ParseUint(args[i], 8, 32)
+			if err != nil || perm > 0o777 {
+				return fmt.Errorf("filewrite: invalid mode: %s", args[i])
+			}
+			mode = os.FileMode(perm)
+
 		default:
 			if filename == "" {
 				filename = args[i]
-			} else {
-				// Rest is content
-				content = strings.Join(args[i:], " ")
-				break
+				continue
 			}
+			// Rest is content
+			content = strings.Join(args[i:], " ")
+			break parse
 		}
 	}
 
-	// Expand macros in filename
-	filename, err := ctx.Macros.Expand(logger, filename)
-	if err != nil {
-		return fmt.Errorf("filewrite: filename expansion failed: %w", err)
+	if filename == "" {
+		return fmt.Errorf("filewrite: missing filename")
 	}
 
-	// If relative path, make it relative to tmpdir
-	if !filepath.IsAbs(filename) {
-		filename = filepath.Join(ctx.TmpDir, filename)
+	filename, err := tmpPath(ctx, logger, filename)
+	if err != nil {
+		return fmt.Errorf("filewrite: %w", err)
 	}
 
 	// Expand macros in content
@@ -470,6 +886,20 @@ func cmdFilewrite(args []string, priv interface{}, logger *logging.Logger) error
 		return fmt.Errorf("filewrite: content expansion failed: %w", err)
 	}
 
+	data := []byte(content)
+	if hexMode {
+		data, err = hex.DecodeString(strings.Join(strings.Fields(content), ""))
+		if err != nil {
+			return fmt.Errorf("filewrite: invalid hex content: %w", err)
+		}
+	}
+
+	if mkdir {
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			return fmt.Errorf("filewrite: failed to create directory: %w", err)
+		}
+	}
+
 	// Write file
 	flags := os.O_CREATE | os.O_WRONLY
 	if appendMode {
@@ -484,14 +914,190 @@ func cmdFilewrite(args []string, priv interface{}, logger *logging.Logger) error
 	}
 	defer f.Close()
 
-	if _, err := f.WriteString(content); err != nil {
+	if _, err := f.Write(data); err != nil {
 		return fmt.Errorf("filewrite: failed to write: %w", err)
 	}
 
-	logger.Debug("Wrote %d bytes to %s", len(content), filename)
+	// Set the mode explicitly, since the umask and an existing file's
+	// mode would otherwise win
+	if mode != 0 {
+		if err := f.Chmod(mode); err != nil {
+			return fmt.Errorf("filewrite: failed to set mode: %w", err)
+		}
+	}
+
+	logger.Debug("Wrote %d bytes to %s", len(data), filename)
+	return nil
+}
+
+// cmdFileread handles the "fileread" command, which checks a file, for
+// example one written by the process under test:
+// fileread [-expect TEXT] [-match REGEX] [-size N] [-mode PERM]
+// [-md5|-sha1|-sha256|-sha512|-crc32 HEX] [-macro NAME] FILE
+func cmdFileread(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for fileread command")
+	}
+
+	var (
+		filename     string
+		expectText   *string
+		matchPattern string
+		size         = -1
+		mode         os.FileMode
+		sums         = map[string]string{}
+		macroName    string
+	)
+
+	for i := 0; i < len(args); i++ {
+		opt := args[i]
+		if !strings.HasPrefix(opt, "-") {
+			if filename != "" {
+				return fmt.Errorf("fileread: unexpected argument: %s", opt)
+			}
+			filename = opt
+			continue
+		}
+		if i+1 >= len(args) {
+			return fmt.Errorf("fileread: %s requires a value", opt)
+		}
+		i++
+		value := args[i]
+
+		switch opt {
+		case "-expect":
+			expectText = &value
+		case "-match":
+			matchPattern = value
+		case "-macro":
+			macroName = value
+		case "-size":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("fileread: invalid size: %s", value)
+			}
+			size = n
+		case "-mode":
+			perm, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || perm > 0o777 {
+				return fmt.Errorf("fileread: invalid mode: %s", value)
+			}
+			mode = os.FileMode(perm)
+		case "-md5", "-sha1", "-sha256", "-sha512", "-crc32":
+			sums[opt[1:]] = strings.ToLower(value)
+		default:
+			return fmt.Errorf("fileread: unknown option: %s", opt)
+		}
+	}
+
+	if filename == "" {
+		return fmt.Errorf("fileread: missing filename")
+	}
+
+	filename, err := tmpPath(ctx, logger, filename)
+	if err != nil {
+		return fmt.Errorf("fileread: %w", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("fileread: %w", err)
+	}
+
+	if size >= 0 && len(data) != size {
+		return fmt.Errorf("fileread: %s: expected %d bytes, got %d", filename, size, len(data))
+	}
+	if mode != 0 {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return fmt.Errorf("fileread: %w", err)
+		}
+		if got := info.Mode().Perm(); got != mode {
+			return fmt.Errorf("fileread: %s: expected mode %04o, got %04o", filename, mode, got)
+		}
+	}
+	for algo, want := range sums {
+		got, _ := util.Checksum(algo, data)
+		if got != want {
+			return fmt.Errorf("fileread: %s: expected %s %s, got %s", filename, algo, want, got)
+		}
+	}
+	if matchPattern != "" {
+		matched, err := regexp.Match(matchPattern, data)
+		if err != nil {
+			return fmt.Errorf("fileread: invalid regex: %w", err)
+		}
+		if !matched {
+			return fmt.Errorf("fileread: %s did not match pattern %s", filename, matchPattern)
+		}
+	}
+	if expectText != nil && string(data) != *expectText {
+		return fmt.Errorf("fileread: %s: expected %q, got %q", filename, *expectText, data)
+	}
+
+	if macroName != "" {
+		ctx.Macros.Define(macroName, string(data))
+	}
+
+	logger.Debug("Read %d bytes from %s", len(data), filename)
 	return nil
 }
 
+// tmpPath expands macros in a file name and makes relative names
+// relative to ${tmpdir}
+func tmpPath(ctx *ExecContext, logger *logging.Logger, filename string) (string, error) {
+	filename, err := ctx.Macros.Expand(logger, filename)
+	if err != nil {
+		return "", fmt.Errorf("filename expansion failed: %w", err)
+	}
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(ctx.TmpDir, filename)
+	}
+	return filename, nil
+}
+
+// reapProcesses kills the processes a test left running, with whatever
+// they started in the background
+func reapProcesses(ctx *ExecContext) {
+	for name, obj := range ctx.Processes {
+		if p, ok := obj.(*process.Process); ok && p.Reap() {
+			ctx.Logger.Log(3, "Killed process %s, left running at the end of the test", name)
+		}
+	}
+}
+
+// backgroundRun is implemented by the load generators of a test, which
+// may still be running a -start run when it ends
+type backgroundRun interface {
+	Stop() bool
+}
+
+// stopLoadGens ends the load generator runs a test left going
+func stopLoadGens(ctx *ExecContext) {
+	for name, obj := range ctx.LoadGens {
+		if l, ok := obj.(backgroundRun); ok && l.Stop() {
+			ctx.Logger.Log(3, "Stopped loadgen %s, left running at the end of the test", name)
+		}
+	}
+}
+
+// breakable is implemented by the tunnels of a test, which keep their
+// listener between runs
+type breakable interface {
+	Break()
+}
+
+// breakTunnels closes the listeners and connections of the tunnels of a
+// test once it has ended
+func breakTunnels(ctx *ExecContext) {
+	for _, obj := range ctx.Tunnels {
+		if t, ok := obj.(breakable); ok {
+			t.Break()
+		}
+	}
+}
+
 // cmdProcess handles the "process" command
 func cmdProcess(args []string, priv interface{}, logger *logging.Logger) error {
 	ctx, ok := priv.(*ExecContext)
@@ -525,20 +1131,44 @@ func cmdProcess(args []string, priv interface{}, logger *logging.Logger) error {
 	}
 
 	// Parse options and check for flags before -start
-	var useTerminal bool
+	var useTerminal, quiet, execArgs bool
+	shell := process.DefaultShell
 	for i := 0; i < len(args); i++ {
-		if args[i] == "-ansi-response" {
+		switch args[i] {
+		case "-ansi-response":
 			useTerminal = true
+		case "-quiet":
+			quiet = true
+		case "-exec":
+			execArgs = true
+		case "-shell":
+			if i+1 >= len(args) {
+				return fmt.Errorf("process: -shell requires a value")
+			}
+			i++
+			shell = args[i]
 		}
 	}
 
 	// Parse options
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
-		case "-ansi-response":
-			// Flag already processed above
+		case "-ansi-response", "-exec":
+			// Flags already processed above
 			continue
 
+		case "-shell":
+			// Processed above, with its value
+			i++
+
+		case "-log", "-quiet":
+			// Output lines are logged unless -quiet is given; -log, which
+			// VTest2 needs for that, turns the log back on
+			if p != nil {
+				p.SetQuiet(args[i] == "-quiet")
+			}
+			quiet = args[i] == "-quiet"
+
 		case "-start":
 			// Check if command was provided before -start
 			if cmdStr == "" {
@@ -556,12 +1186,18 @@ func cmdProcess(args []string, priv interface{}, logger *logging.Logger) error {
 			}
 
 			// For complex commands with shell syntax, wrap in sh -c
-			// Simple heuristic: if it contains shell metacharacters, use sh -c
-			needsShell := strings.ContainsAny(cmdStr, "|&;<>()$`\\\"'*?[]!{}~")
+			// Simple heuristic: if it contains shell metacharacters, use sh -c.
+			// Any other shell, such as cmd on Windows, runs every command.
+			needsShell := strings.ContainsAny(cmdStr, "|&;<>()$`\\\"'*?[]!{}~") || filepath.Base(shell) != "sh"
 
 			var cmdParts []string
-			if needsShell {
-				cmdParts = []string{"sh", "-c", cmdStr}
+			if execArgs {
+				var err error
+				if cmdParts, err = execCommand(ctx, logger, cmdStr); err != nil {
+					return fmt.Errorf("process: %w", err)
+				}
+			} else if needsShell {
+				cmdParts = process.ShellCommand(shell, cmdStr)
 			} else {
 				// Simple command without shell syntax - split by whitespace
 				cmdParts = strings.Fields(cmdStr)
@@ -570,8 +1206,13 @@ func cmdProcess(args []string, priv interface{}, logger *logging.Logger) error {
 				}
 			}
 
-			p = process.New(procName, logger, ctx.TmpDir, cmdParts[0], cmdParts[1:]...)
+			dir, err := ctx.ObjectDir(procName)
+			if err != nil {
+				return fmt.Errorf("process: %w", err)
+			}
+			p = process.New(procName, logger.Child(procName), dir, cmdParts[0], cmdParts[1:]...)
 			p.UseTerminal = useTerminal
+			p.SetQuiet(quiet)
 			ctx.Processes[procName] = p
 
 			// Start the process
@@ -581,10 +1222,12 @@ func cmdProcess(args []string, priv interface{}, logger *logging.Logger) error {
 
 			// Export macros for stdout and stderr file paths
 			if p.StdoutPath != "" {
+				ctx.AddArtifact(p.StdoutPath)
 				ctx.Macros.Define(procName+"_out", p.StdoutPath)
 				logger.Debug("Exported macro ${%s_out} = %s", procName, p.StdoutPath)
 			}
 			if p.StderrPath != "" {
+				ctx.AddArtifact(p.StderrPath)
 				ctx.Macros.Define(procName+"_err", p.StderrPath)
 				logger.Debug("Exported macro ${%s_err} = %s", procName, p.StderrPath)
 			}
@@ -618,6 +1261,53 @@ func cmdProcess(args []string, priv interface{}, logger *logging.Logger) error {
 			}
 			return p.Kill()
 
+		case "-signal", "-signal-group":
+			if p == nil {
+				return fmt.Errorf("process: process not started")
+			}
+			opt := args[i]
+			if i+1 >= len(args) {
+				return fmt.Errorf("process: %s requires a signal", opt)
+			}
+			i++
+			sig, err := process.ParseSignal(args[i])
+			if err != nil {
+				return fmt.Errorf("process: %w", err)
+			}
+			if opt == "-signal-group" {
+				err = p.SignalGroup(sig)
+			} else {
+				err = p.Signal(sig)
+			}
+			if err != nil {
+				return fmt.Errorf("process: %w", err)
+			}
+
+		case "-expect-signal-exit":
+			if p == nil {
+				return fmt.Errorf("process: process not started")
+			}
+			if i+1 >= len(args) {
+				return fmt.Errorf("process: -expect-signal-exit requires a signal")
+			}
+			i++
+			want, err := process.ParseSignal(args[i])
+			if err != nil {
+				return fmt.Errorf("process: %w", err)
+			}
+			waitErr := p.Wait()
+			got, ok := p.ExitSignal()
+			if !ok {
+				if waitErr != nil {
+					return fmt.Errorf("process: %s exited (%v), expected %s", procName, waitErr, process.SignalName(want))
+				}
+				return fmt.Errorf("process: %s exited normally, expected %s", procName, process.SignalName(want))
+			}
+			if got != want {
+				return fmt.Errorf("process: %s killed by %s, expected %s", procName, process.SignalName(got), process.SignalName(want))
+			}
+			logger.Log(3, "%s killed by %s as expected", procName, process.SignalName(got))
+
 		case "-write":
 			if p == nil {
 				return fmt.Errorf("process: process not started")
@@ -0,0 +1,182 @@
+package vtc
+
+// builtinDocs documents the commands of RegisterBuiltinCommands
+var builtinDocs = []CommandDoc{
+	{
+		Name:    "barrier",
+		Context: DocAny,
+		Usage:   "bNAME cond|sock COUNT [-cyclic] | bNAME sync | bNAME [options]",
+		Help:    "Synchronizes the test, clients and servers. sock barriers work like cond barriers, as everything runs in one process.",
+		Options: []OptionDoc{
+			{Name: "-start", Arg: "[COUNT]", Help: "Set up the barrier for COUNT parties (default 1)"},
+			{Name: "-wait", Help: "Wait until the barrier is released"},
+			{Name: "-sync", Help: "Same as sync"},
+			{Name: "-timeout", Arg: "SECONDS", Help: "Fail a wait that takes longer"},
+			{Name: "-cyclic", Help: "Reset the barrier once it is released"},
+		},
+	},
+	{
+		Name:    "shell",
+		Context: DocAny,
+		Usage:   "[options] COMMAND",
+		Help:    "Runs COMMAND with sh -c, or cmd /C on Windows, or as a list of arguments with -exec. Its outputs and exit status are in ${shell_out}, ${shell_err} and ${shell_status}.",
+		Options: []OptionDoc{
+			{Name: "-exit", Arg: "N", Help: "Expect exit status N (default 0)"},
+			{Name: "-err", Help: "Expect a non-zero exit status"},
+			{Name: "-expect", Arg: "TEXT", Help: "Expect the output to contain TEXT"},
+			{Name: "-expect-stdout", Arg: "TEXT", Help: "Expect standard output to be TEXT"},
+			{Name: "-expect-stderr", Arg: "TEXT", Help: "Expect standard error to be TEXT"},
+			{Name: "-match", Arg: "REGEX", Help: "Expect the output to match REGEX"},
+			{Name: "-match-stderr", Arg: "REGEX", Help: "Expect standard error to match REGEX"},
+			{Name: "-stdin", Arg: "DATA", Help: "Feed DATA to the command"},
+			{Name: "-env", Arg: "KEY=VALUE", Help: "Add to the environment (repeatable)"},
+			{Name: "-timeout", Arg: "SECONDS", Help: "Kill the command after this long"},
+			{Name: "-shell", Arg: "SHELL", Help: "Run COMMAND with SHELL instead of sh (cmd on Windows)"},
+			{Name: "-exec", Help: "Split COMMAND into arguments at spaces, keeping double-quoted ones together, expand macros in each and run it without a shell"},
+		},
+	},
+	{
+		Name:    "err_shell",
+		Context: DocAny,
+		Usage:   "EXPECTED COMMAND",
+		Help:    "Runs COMMAND, which must fail with EXPECTED in its output. Same as shell -err -match with EXPECTED taken literally.",
+	},
+	{
+		Name:    "expect",
+		Context: DocTop,
+		Usage:   "VALUE|-file FILE|-shell COMMAND OP VALUE",
+		Help:    "Checks a value such as a macro, the contents of FILE (relative to ${tmpdir}) or the output of COMMAND, which must succeed, without a client or server. OP is ==, !=, <, <=, >, >=, ~, !~, -within, -matches (the same as ~) or -contains.",
+	},
+	{
+		Name:    "delay",
+		Context: DocAny,
+		Usage:   "SECONDS",
+		Help:    "Sleeps. SECONDS may be fractional or a Go duration such as 100ms.",
+	},
+	{
+		Name:    "clock",
+		Context: DocAny,
+		Usage:   "-set TIME | -advance DURATION | -reset",
+		Help:    "Moves the test clock used by txresp -date-offset, -age and -expires. TIME is Unix seconds or an HTTP date; the clock keeps running from there.",
+	},
+	{
+		Name:    "await",
+		Context: DocAny,
+		Usage:   "tcp ADDR | http URL | file PATH [options]",
+		Help:    "Waits until ADDR accepts connections (a path is a Unix socket), URL answers with a 2xx status, or PATH exists.",
+		Options: []OptionDoc{
+			{Name: "-timeout", Arg: "SECONDS", Help: "Fail after this long (default 10)"},
+			{Name: "-status", Arg: "N", Help: "Wait for status N from the URL instead"},
+		},
+	},
+	{
+		Name:    "setvar",
+		Context: DocAny,
+		Usage:   "NAME VALUE",
+		Help:    "Sets a test variable, read back as ${var.NAME}.",
+	},
+	{
+		Name:    "feature",
+		Context: DocTop,
+		Usage:   "CHECK...",
+		Help:    "Skips the test unless every check holds: cmd NAME, user NAME, group NAME, disk_space SIZE, ignore_unknown_macro, or a named feature (negated with a leading !).",
+	},
+	{
+		Name:    "filewrite",
+		Context: DocTop,
+		Usage:   "[options] FILE CONTENT...",
+		Help:    "Writes CONTENT to FILE. Relative paths are in ${tmpdir}.",
+		Options: []OptionDoc{
+			{Name: "-append", Help: "Append instead of truncating"},
+			{Name: "-hex", Help: "CONTENT is hex"},
+			{Name: "-mkdir", Help: "Create missing parent directories"},
+			{Name: "-mode", Arg: "PERM", Help: "File permissions, in octal"},
+		},
+	},
+	{
+		Name:    "fileread",
+		Context: DocTop,
+		Usage:   "[options] FILE",
+		Help:    "Checks a file, for example one written by the process under test.",
+		Options: []OptionDoc{
+			{Name: "-expect", Arg: "TEXT", Help: "Expect the file to contain TEXT"},
+			{Name: "-match", Arg: "REGEX", Help: "Expect the file to match REGEX"},
+			{Name: "-size", Arg: "N", Help: "Expect a size of N bytes"},
+			{Name: "-mode", Arg: "PERM", Help: "Expect these permissions, in octal"},
+			{Name: "-md5", Arg: "HEX", Help: "Expect this digest; also -sha1, -sha256, -sha512 and -crc32"},
+			{Name: "-macro", Arg: "NAME", Help: "Define ${NAME} as the contents"},
+		},
+	},
+	{
+		Name:    "artifact",
+		Context: DocAny,
+		Usage:   "PATH...",
+		Help:    "Saves the files or directories if the test fails. Relative paths are in ${tmpdir}.",
+	},
+	{
+		Name:    "process",
+		Context: DocTop,
+		Usage:   "pNAME [COMMAND] [options]",
+		Help:    "Runs COMMAND in the background and talks to it.",
+		Options: []OptionDoc{
+			{Name: "-ansi-response", Help: "Run in a terminal emulator (see feature pty)"},
+			{Name: "-shell", Arg: "SHELL", Help: "Run COMMAND through SHELL, such as bash, cmd or powershell, instead of sh (cmd on Windows) when it has shell syntax"},
+			{Name: "-exec", Help: "Split COMMAND into arguments as shell -exec does and run it without a shell"},
+			{Name: "-start", Help: "Start the process"},
+			{Name: "-quiet", Help: "Don't log its output lines"},
+			{Name: "-log", Help: "Log its output lines as pNAME_out> and pNAME_err> (the default)"},
+			{Name: "-wait", Help: "Wait for it to exit"},
+			{Name: "-stop", Help: "Close its input, wait up to 5s for it to exit, then SIGTERM and SIGKILL its process group"},
+			{Name: "-kill", Help: "Kill its process group"},
+			{Name: "-signal", Arg: "SIG", Help: "Send SIG, such as HUP, SIGUSR1 or 15, to the process; under a shell, to the shell"},
+			{Name: "-signal-group", Arg: "SIG", Help: "Send SIG to the process group: the process and the children it started"},
+			{Name: "-expect-signal-exit", Arg: "SIG", Help: "Wait for it to exit and check that SIG killed it"},
+			{Name: "-write", Arg: "DATA", Help: "Write DATA to its input"},
+			{Name: "-writeln", Arg: "DATA", Help: "Write DATA and a newline"},
+			{Name: "-writehex", Arg: "HEX", Help: "Write the bytes given in hex"},
+			{Name: "-expect-text", Arg: "[ROW COL] TEXT", Help: "Wait for TEXT in the output, or on the screen at ROW, COL"},
+			{Name: "-screen_dump", Help: "Log the terminal screen"},
+			{Name: "-resize", Arg: "ROWS COLS", Help: "Resize the terminal"},
+		},
+		Unsupported: []string{"-close", "-dump", "-hexdump", "-expect-cursor", "-expect-exit", "-match-text", "-run"},
+	},
+	{
+		Name:    "spec",
+		Context: DocTop,
+		Usage:   "NAME { ... }",
+		Help:    "Stores a spec body that client and server specs include with use NAME [PARAM=VALUE...].",
+	},
+	{
+		Name:    "vtest",
+		Context: DocTop,
+		Usage:   "DESCRIPTION",
+		Help:    "Describes the test.",
+	},
+	{
+		Name:    "expect_test_fail",
+		Context: DocTop,
+		Usage:   "[REGEX]",
+		Help:    "Expects the test to fail, with an error matching REGEX.",
+	},
+	{
+		Name:    "fatal",
+		Context: DocTop,
+		Help:    "Makes failing commands abort the test again, after non_fatal.",
+	},
+	{
+		Name:    "non_fatal",
+		Context: DocTop,
+		Help:    "Records failing commands and goes on with the test.",
+	},
+	{
+		Name:    "ignore_unknown_commands",
+		Context: DocTop,
+		Help:    "Logs and skips unknown commands from here on instead of failing.",
+	},
+	{
+		Name:    "loglevel",
+		Context: DocTop,
+		Usage:   "[COMPONENT] LEVEL",
+		Help:    "Sets the most verbose level logged for a client or server name, http1, http2, or all of them.",
+	},
+}
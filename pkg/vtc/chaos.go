@@ -0,0 +1,53 @@
+package vtc
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultChaosMax is the longest delay of -chaos
+const DefaultChaosMax = 10 * time.Millisecond
+
+// Chaos perturbs the timing of a test run with -chaos. It sleeps for a
+// random while before each command and where goroutines race, such as
+// connections accepted together and SETTINGS acknowledgements, to bring
+// out tests that only pass in one order. The delays come from Seed, so
+// the seed of a failure gives the same ones again, as far as the
+// goroutines ask for them in the same order.
+type Chaos struct {
+	Seed int64
+	Max  time.Duration
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// NewChaos returns delays of up to max from seed
+func NewChaos(seed int64, max time.Duration) *Chaos {
+	return &Chaos{Seed: seed, Max: max, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Next returns the next delay
+func (c *Chaos) Next() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rng.Int63n(int64(c.Max) + 1))
+}
+
+// Delay sleeps for the next delay. A nil Chaos doesn't.
+func (c *Chaos) Delay() {
+	if c == nil || c.Max <= 0 {
+		return
+	}
+	time.Sleep(c.Next())
+}
+
+// ChaosDelay sleeps at a point where -chaos perturbs the test. priv is
+// the handler's context, which may be nil or not an *ExecContext outside
+// of a test run.
+func ChaosDelay(priv interface{}) {
+	if ctx, ok := priv.(*ExecContext); ok {
+		ctx.Chaos.Delay()
+	}
+}
@@ -0,0 +1,75 @@
+package vtc
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/util"
+)
+
+// Now returns the time of the test clock: the real time, moved by the
+// clock command. txresp -date-offset, -expires and friends use it.
+func (ctx *ExecContext) Now() time.Time {
+	ctx.clockMu.Lock()
+	defer ctx.clockMu.Unlock()
+	return time.Now().Add(ctx.clockOffset)
+}
+
+// cmdClock handles the "clock" command
+func cmdClock(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("invalid context for clock command")
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("clock: missing -set, -advance or -reset")
+	}
+
+	switch args[0] {
+	case "-set":
+		if len(args) < 2 {
+			return fmt.Errorf("clock: -set requires a time")
+		}
+		t, err := parseClockTime(args[1])
+		if err != nil {
+			return fmt.Errorf("clock: %w", err)
+		}
+		ctx.clockMu.Lock()
+		ctx.clockOffset = time.Until(t)
+		ctx.clockMu.Unlock()
+	case "-advance":
+		if len(args) < 2 {
+			return fmt.Errorf("clock: -advance requires a duration")
+		}
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return fmt.Errorf("clock: invalid duration: %s", args[1])
+		}
+		ctx.clockMu.Lock()
+		ctx.clockOffset += d
+		ctx.clockMu.Unlock()
+	case "-reset":
+		ctx.clockMu.Lock()
+		ctx.clockOffset = 0
+		ctx.clockMu.Unlock()
+	default:
+		return fmt.Errorf("clock: unknown option: %s", args[0])
+	}
+
+	logger.Log(3, "clock: now %s", ctx.Now().UTC().Format(util.HTTPDateFormat))
+	return nil
+}
+
+// parseClockTime parses Unix seconds or an HTTP date
+func parseClockTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(util.HTTPDateFormat, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time (want Unix seconds or an HTTP date): %s", s)
+	}
+	return t, nil
+}
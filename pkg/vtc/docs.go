@@ -0,0 +1,147 @@
+package vtc
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Contexts a command is documented for
+const (
+	DocTop    = "test"          // Top-level command of a test
+	DocHTTP1  = "HTTP/1 spec"   // Command in a client or server spec
+	DocHTTP2  = "HTTP/2 spec"   // Command in an HTTP/2 client or server spec
+	DocStream = "HTTP/2 stream" // Command in a stream of an HTTP/2 spec
+	DocAny    = "test or spec"  // Global command, usable anywhere
+)
+
+// OptionDoc describes one option of a command
+type OptionDoc struct {
+	Name string // Option as written, such as "-hdr"
+	Arg  string // Placeholder for its argument, empty for a flag
+	Help string
+}
+
+// CommandDoc describes a command for "gvtest help"
+type CommandDoc struct {
+	Name        string
+	Context     string // DocTop, DocHTTP1, ...
+	Usage       string // Arguments after the name, such as "[options]"
+	Help        string
+	Options     []OptionDoc
+	Unsupported []string // VTest2 options gvtest doesn't accept
+}
+
+var (
+	docsMutex sync.Mutex
+	docs      []CommandDoc
+)
+
+// RegisterDoc adds the documentation of a command. A command used in
+// several contexts, such as txreq in HTTP/1 and HTTP/2 specs, has one
+// doc for each.
+func RegisterDoc(doc CommandDoc) {
+	docsMutex.Lock()
+	defer docsMutex.Unlock()
+	for i, d := range docs {
+		if d.Name == doc.Name && d.Context == doc.Context {
+			docs[i] = doc
+			return
+		}
+	}
+	docs = append(docs, doc)
+}
+
+// RegisterDocs adds the documentation of several commands
+func RegisterDocs(list []CommandDoc) {
+	for _, doc := range list {
+		RegisterDoc(doc)
+	}
+}
+
+// Docs returns the documentation of all commands, sorted by name
+func Docs() []CommandDoc {
+	docsMutex.Lock()
+	defer docsMutex.Unlock()
+	list := append([]CommandDoc(nil), docs...)
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Context < list[j].Context
+	})
+	return list
+}
+
+// LookupDocs returns the documentation of the named command, one per
+// context it is used in
+func LookupDocs(name string) []CommandDoc {
+	var found []CommandDoc
+	for _, doc := range Docs() {
+		if doc.Name == name {
+			found = append(found, doc)
+		}
+	}
+	return found
+}
+
+// Write renders the documentation as help text
+func (d CommandDoc) Write(w io.Writer) {
+	usage := d.Name
+	if d.Usage != "" {
+		usage += " " + d.Usage
+	}
+	fmt.Fprintf(w, "%s  (%s)\n", usage, d.Context)
+	if d.Help != "" {
+		fmt.Fprintf(w, "\n    %s\n", d.Help)
+	}
+	if len(d.Options) > 0 {
+		fmt.Fprintf(w, "\nOptions:\n")
+		width := 0
+		for _, opt := range d.Options {
+			width = max(width, len(opt.synopsis()))
+		}
+		for _, opt := range d.Options {
+			fmt.Fprintf(w, "    %-*s  %s\n", width, opt.synopsis(), opt.Help)
+		}
+	}
+	if len(d.Unsupported) > 0 {
+		fmt.Fprintf(w, "\nVTest2 options not supported: %s\n", strings.Join(d.Unsupported, " "))
+	}
+}
+
+func (o OptionDoc) synopsis() string {
+	if o.Arg == "" {
+		return o.Name
+	}
+	return o.Name + " " + o.Arg
+}
+
+// WriteIndex lists the documented commands with the first sentence of
+// their help, and the registered top-level commands that have none
+func WriteIndex(w io.Writer) {
+	list := Docs()
+	width := 0
+	for _, doc := range list {
+		width = max(width, len(doc.Name))
+	}
+	documented := make(map[string]bool)
+	for _, doc := range list {
+		documented[doc.Name] = true
+		summary, _, _ := strings.Cut(doc.Help, ". ")
+		fmt.Fprintf(w, "%-*s  %-13s  %s\n", width, doc.Name, doc.Context, strings.TrimSuffix(summary, "."))
+	}
+
+	var missing []string
+	for _, name := range ListCommands() {
+		if !documented[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		fmt.Fprintf(w, "\nUndocumented: %s\n", strings.Join(missing, " "))
+	}
+}
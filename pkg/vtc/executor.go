@@ -2,10 +2,15 @@
 package vtc
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/perbu/GTest/pkg/logging"
@@ -13,23 +18,51 @@ import (
 
 // ExecContext holds the execution context for a VTC test
 type ExecContext struct {
-	Macros       *MacroStore
-	Logger       *logging.Logger
-	TmpDir       string
-	Timeout      time.Duration
-	Failed       bool
-	Skipped      bool
-	SkipReason   string
-	Clients      map[string]interface{} // Will be *client.Client
-	Servers      map[string]interface{} // Will be *server.Server
-	Barriers     map[string]interface{} // Will be *barrier.Barrier
-	Processes    map[string]interface{} // Will be *process.Process
-	CurrentNode  *Node                  // Current AST node being executed
+	Macros        *MacroStore
+	Logger        *logging.Logger
+	TmpDir        string
+	Timeout       time.Duration
+	Failed        bool
+	Skipped       bool
+	SkipReason    string
+	Clients       map[string]interface{} // Will be *client.Client
+	Servers       map[string]interface{} // Will be *server.Server
+	Barriers      map[string]interface{} // Will be *barrier.Barrier
+	Processes     map[string]interface{} // Will be *process.Process
+	LoadGens      map[string]interface{} // Will be *loadgen.LoadGen
+	Tunnels       map[string]interface{} // Will be *tunnel.Tunnel
+	CurrentNode   *Node                  // Current AST node being executed
+	NonFatal      bool                   // Top-level failures are recorded, not fatal
+	IgnoreUnknown bool                   // Unknown commands are logged and skipped
+	Chaos         *Chaos                 // Random delays of -chaos, or nil
+
+	softMu       sync.Mutex
+	softFailures []string
+	skipped      map[string]int // Unknown commands skipped, with counts
+
+	varsMu sync.RWMutex
+	vars   map[string]string // Test variables, set with setvar
+
+	portsMu sync.Mutex
+	ports   map[string]int // Ports reserved as ${portN}
+
+	artifactsMu sync.Mutex
+	artifacts   []string // Files saved when the test fails
+
+	specsMu sync.Mutex
+	specs   map[string][]*Node // Reusable spec bodies, defined with spec
+
+	clockMu     sync.Mutex
+	clockOffset time.Duration // Test clock minus real time, set with clock
+
+	abortMu  sync.Mutex
+	abortErr error         // Why the test was aborted, see Abort
+	aborted  chan struct{} // Closed by Abort
 }
 
 // NewExecContext creates a new execution context
 func NewExecContext(logger *logging.Logger, macros *MacroStore, tmpDir string, timeout time.Duration) *ExecContext {
-	return &ExecContext{
+	ctx := &ExecContext{
 		Macros:    macros,
 		Logger:    logger,
 		TmpDir:    tmpDir,
@@ -38,7 +71,80 @@ func NewExecContext(logger *logging.Logger, macros *MacroStore, tmpDir string, t
 		Servers:   make(map[string]interface{}),
 		Barriers:  make(map[string]interface{}),
 		Processes: make(map[string]interface{}),
+		LoadGens:  make(map[string]interface{}),
+		Tunnels:   make(map[string]interface{}),
+		vars:      make(map[string]string),
+		aborted:   make(chan struct{}),
 	}
+	if macros != nil {
+		macros.SetDynamic(ctx.dynamicMacro)
+	}
+	if logger != nil {
+		logger.OnFatal(ctx.Abort)
+	}
+	return ctx
+}
+
+// Abort fails the test from any goroutine: the executor stops before
+// the next command and returns err. Only the first error is kept. Fatal
+// messages on the test's logger and its children abort the test.
+func (ctx *ExecContext) Abort(err error) {
+	ctx.abortMu.Lock()
+	defer ctx.abortMu.Unlock()
+	if ctx.abortErr != nil {
+		return
+	}
+	ctx.abortErr = err
+	close(ctx.aborted)
+}
+
+// Done returns a channel closed when the test is aborted, for commands
+// that wait or loop to give up early
+func (ctx *ExecContext) Done() <-chan struct{} {
+	return ctx.aborted
+}
+
+// Err returns the error the test was aborted with, or nil
+func (ctx *ExecContext) Err() error {
+	ctx.abortMu.Lock()
+	defer ctx.abortMu.Unlock()
+	return ctx.abortErr
+}
+
+// SetVar sets a test variable. Safe for concurrent use by client and
+// server goroutines.
+func (ctx *ExecContext) SetVar(name, value string) {
+	ctx.varsMu.Lock()
+	defer ctx.varsMu.Unlock()
+	ctx.vars[name] = value
+}
+
+// Var returns the current value of a test variable
+func (ctx *ExecContext) Var(name string) (string, bool) {
+	ctx.varsMu.RLock()
+	defer ctx.varsMu.RUnlock()
+	value, ok := ctx.vars[name]
+	return value, ok
+}
+
+// dynamicMacro resolves the macros that have no definition: test
+// variables and reserved ports
+func (ctx *ExecContext) dynamicMacro(name string) (string, bool) {
+	if value, ok := ctx.varMacro(name); ok {
+		return value, true
+	}
+	return ctx.portMacro(name)
+}
+
+// varMacro resolves ${var.NAME} to the current value of a test variable.
+// Variables are not snapshotted like macros, so a running spec sees
+// what other specs set after it started.
+func (ctx *ExecContext) varMacro(name string) (string, bool) {
+	name, ok := strings.CutPrefix(name, "var.")
+	if !ok {
+		return "", false
+	}
+	return ctx.Var(name)
 }
 
 // Fail marks the test as failed
@@ -47,6 +153,64 @@ func (ctx *ExecContext) Fail(format string, args ...interface{}) {
 	ctx.Logger.Error(format, args...)
 }
 
+// RecordSoftFailure records a failure that occurred in non-fatal mode.
+// Safe for concurrent use by client and server goroutines.
+func (ctx *ExecContext) RecordSoftFailure(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	ctx.softMu.Lock()
+	ctx.softFailures = append(ctx.softFailures, msg)
+	ctx.softMu.Unlock()
+	ctx.Logger.Warning("Non-fatal failure: %s", msg)
+}
+
+// SoftFailures returns the failures recorded in non-fatal mode
+func (ctx *ExecContext) SoftFailures() []string {
+	ctx.softMu.Lock()
+	defer ctx.softMu.Unlock()
+	return append([]string(nil), ctx.softFailures...)
+}
+
+// RecordSkippedCommand records an unknown command skipped in
+// ignore-unknown mode. Safe for concurrent use.
+func (ctx *ExecContext) RecordSkippedCommand(name string) {
+	ctx.softMu.Lock()
+	if ctx.skipped == nil {
+		ctx.skipped = make(map[string]int)
+	}
+	ctx.skipped[name]++
+	ctx.softMu.Unlock()
+	ctx.Logger.Warning("Skipping unknown command: %s", name)
+}
+
+// SkippedCommands returns the skipped unknown commands, sorted by name,
+// formatted as "name" or "name (xN)" when skipped more than once
+func (ctx *ExecContext) SkippedCommands() []string {
+	ctx.softMu.Lock()
+	defer ctx.softMu.Unlock()
+
+	names := make([]string, 0, len(ctx.skipped))
+	for name, n := range ctx.skipped {
+		if n > 1 {
+			name = fmt.Sprintf("%s (x%d)", name, n)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SkipUnknownCommand reports whether an unknown command should be skipped
+// rather than failing, recording it if so. priv is the handler's context,
+// which may be nil or not an *ExecContext outside of a test run.
+func SkipUnknownCommand(priv interface{}, name string) bool {
+	ctx, ok := priv.(*ExecContext)
+	if !ok || !ctx.IgnoreUnknown {
+		return false
+	}
+	ctx.RecordSkippedCommand(name)
+	return true
+}
+
 // Skip marks the test as skipped
 func (ctx *ExecContext) Skip(reason string) {
 	ctx.Skipped = true
@@ -54,6 +218,12 @@ func (ctx *ExecContext) Skip(reason string) {
 	ctx.Logger.Info("Test skipped: %s", reason)
 }
 
+// ErrCancelled is returned when a test is aborted through RunOptions.Cancel
+var ErrCancelled = errors.New("test cancelled")
+
+// ErrTimeout is returned when a test runs longer than RunOptions.Timeout
+var ErrTimeout = errors.New("test timed out")
+
 // TestExecutor executes a parsed VTC test
 type TestExecutor struct {
 	Context  *ExecContext
@@ -82,12 +252,27 @@ func (e *TestExecutor) Execute(ast *Node) error {
 			e.Context.Logger.Debug("Test marked as skipped, stopping execution")
 			return nil // Not an error, just skipped
 		}
+		select {
+		case <-e.Context.Done():
+			err := e.Context.Err()
+			if errors.Is(err, ErrCancelled) {
+				e.Context.Logger.Info("Test cancelled")
+			} else {
+				e.Context.Logger.Debug("Test aborted, stopping execution")
+			}
+			return err
+		default:
+		}
 
 		e.Context.Logger.Debug("Executing node %d/%d: type=%s name=%s", i+1, len(ast.Children), node.Type, node.Name)
 
 		// Execute the node
 		if err := e.executeNode(node); err != nil {
 			e.Context.Logger.Debug("Node execution failed: %v", err)
+			if e.Context.NonFatal {
+				e.Context.RecordSoftFailure("%s: %v", node.Name, err)
+				continue
+			}
 			e.Context.Fail("Command failed: %v", err)
 			return err
 		}
@@ -95,6 +280,11 @@ func (e *TestExecutor) Execute(ast *Node) error {
 		e.Context.Logger.Debug("Node %d/%d completed successfully", i+1, len(ast.Children))
 	}
 
+	// A client or server goroutine may have failed during the last command
+	if err := e.Context.Err(); err != nil {
+		return err
+	}
+
 	e.Context.Logger.Debug("Test execution completed successfully")
 	return nil
 }
@@ -106,6 +296,9 @@ func (e *TestExecutor) executeNode(node *Node) error {
 	case "vtest":
 		// Test description - just log it
 		e.Context.Logger.Info("Test: %s", node.Name)
+		if tags := node.Tags(); len(tags) > 0 {
+			e.Context.Logger.Debug("Tags: %s", strings.Join(tags, ", "))
+		}
 		e.Context.Logger.Debug("Test description node processed")
 		return nil
 
@@ -121,6 +314,11 @@ func (e *TestExecutor) executeNode(node *Node) error {
 
 		// Set current node in context so command handlers can access children
 		e.Context.CurrentNode = node
+		e.Context.Chaos.Delay()
+
+		if _, ok := e.Registry.Get(cmdName); !ok && SkipUnknownCommand(e.Context, cmdName) {
+			return nil
+		}
 
 		// Execute the command
 		err := e.Registry.Execute(cmdName, args, e.Context, e.Context.Logger)
@@ -131,9 +329,9 @@ func (e *TestExecutor) executeNode(node *Node) error {
 		}
 		return err
 
-	case "comment":
-		// Ignore comments
-		e.Context.Logger.Debug("Skipping comment node")
+	case "comment", "blank":
+		// Ignore comments and blank lines
+		e.Context.Logger.Debug("Skipping %s node", node.Type)
 		return nil
 
 	default:
@@ -141,8 +339,38 @@ func (e *TestExecutor) executeNode(node *Node) error {
 	}
 }
 
+// RunOptions controls how a test file is run
+type RunOptions struct {
+	KeepTmp       bool            // Keep the temporary directory
+	Timeout       time.Duration   // Test timeout
+	IgnoreUnknown bool            // Log and skip unknown commands
+	Cancel        <-chan struct{} // Closed to abort the test before its next command
+	ArtifactDir   string          // Where artifacts of failed tests are saved (optional)
+	KeepProcesses bool            // Leave processes running when the test ends
+	Chaos         *Chaos          // Seed and longest delay of -chaos, each test drawing its own delays (optional)
+	Strict        bool            // Fail passed tests that leave goroutines, listeners or open files behind
+}
+
+// TestReport carries the outcome of a test beyond its exit code
+type TestReport struct {
+	Description     string   // From the vtest line
+	Tags            []string // From vtest -tags
+	SoftFailures    []string // Failures recorded under non_fatal
+	SkippedCommands []string // Unknown commands skipped in ignore-unknown mode
+	SkipReason      string   // Why the test was skipped, if it was
+}
+
 // RunTest executes a VTC test file
 func RunTest(testFile string, logger *logging.Logger, macros *MacroStore, keepTmp bool, timeout time.Duration) (exitCode int, err error) {
+	exitCode, _, err = RunTestWithReport(testFile, logger, macros, RunOptions{KeepTmp: keepTmp, Timeout: timeout})
+	return exitCode, err
+}
+
+// RunTestWithReport executes a VTC test file and also reports failures that
+// non_fatal recorded and unknown commands that were skipped
+func RunTestWithReport(testFile string, logger *logging.Logger, macros *MacroStore, opts RunOptions) (exitCode int, report TestReport, err error) {
+	keepTmp, timeout := opts.KeepTmp, opts.Timeout
+
 	logger.Debug("RunTest starting for file: %s", testFile)
 	logger.Debug("Timeout: %v, keepTmp: %v", timeout, keepTmp)
 
@@ -150,7 +378,7 @@ func RunTest(testFile string, logger *logging.Logger, macros *MacroStore, keepTm
 	tmpDir, err := os.MkdirTemp("", "gvtest-*")
 	if err != nil {
 		logger.Debug("Failed to create temp dir: %v", err)
-		return 2, fmt.Errorf("failed to create temp dir: %w", err)
+		return 2, report, fmt.Errorf("failed to create temp dir: %w", err)
 	}
 	logger.Debug("Created temp directory: %s", tmpDir)
 
@@ -166,53 +394,150 @@ func RunTest(testFile string, logger *logging.Logger, macros *MacroStore, keepTm
 
 	// Open and parse the test file
 	logger.Debug("Opening test file: %s", testFile)
-	f, err := os.Open(testFile)
+	src, err := os.ReadFile(testFile)
 	if err != nil {
 		logger.Debug("Failed to open test file: %v", err)
-		return 2, fmt.Errorf("failed to open test file: %w", err)
+		return 2, report, fmt.Errorf("failed to open test file: %w", err)
+	}
+
+	expected, err := scanExpectedFailure(bytes.NewReader(src))
+	if err != nil {
+		return 2, report, err
 	}
-	defer f.Close()
 
 	logger.Debug("Parsing test file...")
-	parser := NewParser(f, macros, logger)
+	parser := NewParser(bytes.NewReader(src), macros, logger)
 	ast, err := parser.Parse()
 	if err != nil {
 		logger.Debug("Parse error: %v", err)
-		return 2, fmt.Errorf("parse error: %w", err)
+		err = fmt.Errorf("parse error: %w", err)
+		if expected != nil {
+			exitCode, err = expected.outcome(2, err, report, logger)
+			return exitCode, report, err
+		}
+		return 2, report, err
 	}
 	logger.Debug("Parse completed, AST has %d children", len(ast.Children))
+	for _, node := range ast.Children {
+		if node.Type == "vtest" {
+			report.Description, report.Tags = node.Name, node.Tags()
+			break
+		}
+	}
 
 	// Create execution context
 	logger.Debug("Creating execution context")
 	ctx := NewExecContext(logger, macros, tmpDir, timeout)
+	ctx.IgnoreUnknown = opts.IgnoreUnknown
+	if opts.Chaos != nil {
+		ctx.Chaos = NewChaos(opts.Chaos.Seed, opts.Chaos.Max)
+		logger.Info("Chaos mode: delays of up to %v with seed %d", opts.Chaos.Max, opts.Chaos.Seed)
+	}
+	if opts.Cancel != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-opts.Cancel:
+				ctx.Abort(ErrCancelled)
+			case <-finished:
+			}
+		}()
+	}
+
+	// Save artifacts of a failed test before the temp directory goes away
+	if opts.ArtifactDir != "" {
+		defer func() {
+			if exitCode != 1 && exitCode != 2 {
+				return
+			}
+			dst := filepath.Join(opts.ArtifactDir, strings.TrimSuffix(filepath.Base(testFile), filepath.Ext(testFile)))
+			if err := ctx.SaveArtifacts(dst); err != nil {
+				logger.Warning("%v", err)
+				return
+			}
+			if len(ctx.Artifacts()) > 0 {
+				logger.Info("Saved artifacts to %s", dst)
+			}
+		}()
+	}
+
+	// Invert the result of a negative test, before artifacts are saved
+	if expected != nil {
+		defer func() {
+			exitCode, err = expected.outcome(exitCode, err, report, logger)
+		}()
+	}
+
+	// Close the tunnel listeners once leaks are checked
+	defer breakTunnels(ctx)
+
+	// Check for leaks once the processes are gone, and before a negative
+	// test is inverted
+	testID := newTestID(testFile)
+	if opts.Strict {
+		defer func() {
+			if exitCode != 0 {
+				return
+			}
+			if leakErr := checkLeaks(ctx, testID); leakErr != nil {
+				exitCode, err = 1, leakErr
+			}
+		}()
+	}
+
+	// Free the ports of ${portN} once everything using them is gone
+	defer ctx.ReleasePorts()
+
+	// Kill the processes left running, before their output is saved
+	if !opts.KeepProcesses {
+		defer reapProcesses(ctx)
+	}
+
+	// Stop the load generators left running
+	defer stopLoadGens(ctx)
 
 	// Create executor
 	logger.Debug("Creating test executor")
 	executor := NewTestExecutor(ctx, GlobalRegistry)
 
+	// Abort the test once it has run for its timeout
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			ctx.Abort(fmt.Errorf("%w after %v", ErrTimeout, timeout))
+		})
+		defer timer.Stop()
+	}
+
 	// Execute the test
 	logger.Debug("Beginning test execution")
-	if err := executor.Execute(ast); err != nil {
+	runTagged(testID, func() {
+		err = executor.Execute(ast)
+	})
+	report.SoftFailures = ctx.SoftFailures()
+	report.SkippedCommands = ctx.SkippedCommands()
+	report.SkipReason = ctx.SkipReason
+	if err != nil {
 		if ctx.Skipped {
 			logger.Debug("Test skipped, returning exit code 77")
-			return 77, nil // Skip exit code
+			return 77, report, nil // Skip exit code
 		}
 		logger.Debug("Test execution failed: %v", err)
-		return 1, err // Fail exit code
+		return 1, report, err // Fail exit code
 	}
 
 	if ctx.Failed {
 		logger.Debug("Test marked as failed, returning exit code 1")
-		return 1, fmt.Errorf("test failed")
+		return 1, report, fmt.Errorf("test failed")
 	}
 
 	if ctx.Skipped {
 		logger.Debug("Test skipped, returning exit code 77")
-		return 77, nil
+		return 77, report, nil
 	}
 
 	logger.Debug("Test passed, returning exit code 0")
-	return 0, nil // Pass
+	return 0, report, nil // Pass
 }
 
 // SetupDefaultMacros sets up default macros for a test
@@ -231,6 +556,11 @@ func SetupDefaultMacros(macros *MacroStore, testFile string) {
 
 	// Version info
 	macros.Define("version", "gvtest-0.1.0")
+
+	// The running gvtest binary, for tests that run nested tests
+	if exe, err := os.Executable(); err == nil {
+		macros.Define("gvtest", exe)
+	}
 }
 
 // ParseTestFile is a utility function to just parse a test file
@@ -245,6 +575,20 @@ func ParseTestFile(testFile string, logger *logging.Logger, macros *MacroStore)
 	return parser.Parse()
 }
 
+// ParseTestFileWithComments parses a test file keeping its comments and
+// blank lines in the AST
+func ParseTestFileWithComments(testFile string, logger *logging.Logger, macros *MacroStore) (*Node, error) {
+	f, err := os.Open(testFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	parser := NewParser(f, macros, logger)
+	parser.KeepComments = true
+	return parser.Parse()
+}
+
 // ParseTestReader parses a VTC test from a reader
 func ParseTestReader(r io.Reader, logger *logging.Logger, macros *MacroStore) (*Node, error) {
 	parser := NewParser(r, macros, logger)
@@ -0,0 +1,606 @@
+package vtc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+func runExecutorTest(t *testing.T, input string) (*ExecContext, error) {
+	t.Helper()
+
+	logger := logging.NewLogger("test")
+	ast, err := ParseTestReader(strings.NewReader(input), logger, NewMacroStore())
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	registry := NewCommandRegistry()
+	registry.Register("fatal", cmdFatal, FlagNone)
+	registry.Register("non_fatal", cmdNonFatal, FlagNone)
+	registry.Register("ignore_unknown_commands", cmdIgnoreUnknown, FlagNone)
+	registry.Register("feature", cmdFeature, FlagNone)
+	registry.Register("setvar", cmdSetvar, FlagGlobal)
+	registry.Register("shell", cmdShell, FlagGlobal)
+	registry.Register("err_shell", cmdErrShell, FlagGlobal)
+	registry.Register("expect", cmdExpect, FlagNone)
+	registry.Register("filewrite", cmdFilewrite, FlagNone)
+	registry.Register("fileread", cmdFileread, FlagNone)
+	registry.Register("spec", cmdSpec, FlagNone)
+	registry.Register("loglevel", cmdLoglevel, FlagNone)
+	registry.Register("await", cmdAwait, FlagGlobal)
+	registry.Register("clock", cmdClock, FlagGlobal)
+	registry.Register("barrier", cmdBarrier, FlagGlobal)
+	registry.Register("fail", func(args []string, priv interface{}, logger *logging.Logger) error {
+		return fmt.Errorf("failed on purpose")
+	}, FlagNone)
+	registry.Register("bg_fatal", func(args []string, priv interface{}, logger *logging.Logger) error {
+		// A fatal message from another goroutine, as from a client
+		ctx := priv.(*ExecContext)
+		go logger.Child("c1").Fatal("lost %s", strings.Join(args, " "))
+		<-ctx.Done()
+		return nil
+	}, FlagNone)
+	registry.Register("bg_fatal_later", func(args []string, priv interface{}, logger *logging.Logger) error {
+		// As bg_fatal, but the test goes on until the message arrives
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			logger.Child("c1").Fatal("lost %s", strings.Join(args, " "))
+		}()
+		return nil
+	}, FlagNone)
+
+	ctx := NewExecContext(logger, NewMacroStore(), "", time.Second)
+	return ctx, NewTestExecutor(ctx, registry).Execute(ast)
+}
+
+func TestExecutor_NonFatal(t *testing.T) {
+	ctx, err := runExecutorTest(t, "non_fatal\nfail\nfail\nfatal\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if n := len(ctx.SoftFailures()); n != 2 {
+		t.Errorf("Expected 2 soft failures, got %d", n)
+	}
+
+	if _, err := runExecutorTest(t, "non_fatal\nfatal\nfail\n"); err == nil {
+		t.Error("Expected failure after fatal")
+	}
+}
+
+func TestExecutor_Abort(t *testing.T) {
+	ctx, err := runExecutorTest(t, "bg_fatal the connection\nfail\n")
+	if err == nil || err.Error() != "FATAL: lost the connection" {
+		t.Fatalf("Expected the fatal message to abort the test, got %v", err)
+	}
+	if ctx.Err() != err {
+		t.Errorf("Expected Err to return the abort error, got %v", ctx.Err())
+	}
+
+	// Aborting again keeps the first error
+	ctx.Abort(ErrCancelled)
+	if ctx.Err() != err {
+		t.Errorf("Expected the first abort error to stay, got %v", ctx.Err())
+	}
+}
+
+func TestExecutor_AbortBarrier(t *testing.T) {
+	// The barrier would wait for its 30s timeout without the abort
+	start := time.Now()
+	_, err := runExecutorTest(t, "barrier b1 cond 2\nbg_fatal_later the connection\nbarrier b1 sync\n")
+	if err == nil || err.Error() != "FATAL: lost the connection" {
+		t.Fatalf("Expected the fatal message to end the barrier sync, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the abort to end the sync at once, took %v", elapsed)
+	}
+}
+
+func TestExecutor_Loglevel(t *testing.T) {
+	ctx, err := runExecutorTest(t, "loglevel warning\nloglevel http2 debug\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if ctx.Logger.Enabled(logging.LevelInfo) || !ctx.Logger.Child("http2").Enabled(logging.LevelDebug) {
+		t.Error("Expected warnings by default and debug for http2")
+	}
+
+	if _, err := runExecutorTest(t, "loglevel http2 loud\n"); err == nil {
+		t.Error("Expected an invalid level to fail")
+	}
+}
+
+func TestExecutor_IgnoreUnknown(t *testing.T) {
+	if _, err := runExecutorTest(t, "frobnicate\n"); err == nil {
+		t.Error("Expected unknown command to fail by default")
+	}
+
+	ctx, err := runExecutorTest(t, "ignore_unknown_commands\nfrobnicate\nvarnish v1 -start\nfrobnicate\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	got := strings.Join(ctx.SkippedCommands(), ", ")
+	if got != "frobnicate (x2), varnish" {
+		t.Errorf("Unexpected skipped commands: %s", got)
+	}
+}
+
+func TestExecutor_Feature(t *testing.T) {
+	tests := []struct {
+		input   string
+		skipped bool
+		fails   bool
+	}{
+		{"feature 64bit\n", strconv.IntSize != 64, false},
+		{"feature persistent_storage\n", true, false},
+		{"feature !sanitizer\n", false, false},
+		{"feature gvtest_test_declared\n", false, false},
+		{"feature !gvtest_test_declared\n", true, false},
+		{"feature no_such_feature\n", false, true},
+		{"feature disk_space 1\n", false, false},
+	}
+
+	DeclareFeature("gvtest_test_declared")
+	for _, tt := range tests {
+		ctx, err := runExecutorTest(t, tt.input)
+		if (err != nil) != tt.fails {
+			t.Errorf("%q: unexpected error state: %v", tt.input, err)
+			continue
+		}
+		if ctx.Skipped != tt.skipped {
+			t.Errorf("%q: expected skipped=%v, got %v (%s)", tt.input, tt.skipped, ctx.Skipped, ctx.SkipReason)
+		}
+	}
+}
+
+func TestExecutor_IgnoreUnknownMacro(t *testing.T) {
+	ctx, err := runExecutorTest(t, "feature ignore_unknown_macro\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	got, err := ctx.Macros.Expand(nil, "a ${undefined} b")
+	if err != nil || got != "a ${undefined} b" {
+		t.Errorf("Expected unknown macro to be left as-is, got %q (%v)", got, err)
+	}
+}
+
+func TestExecutor_Setvar(t *testing.T) {
+	ctx, err := runExecutorTest(t, "setvar greeting \"hello world\"\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if v, ok := ctx.Var("greeting"); !ok || v != "hello world" {
+		t.Errorf("Expected greeting to be set, got %q", v)
+	}
+
+	// Snapshots see variables set after they were taken
+	snap := ctx.Macros.Snapshot()
+	ctx.SetVar("greeting", "bye")
+	got, err := snap.Expand(nil, "${var.greeting}")
+	if err != nil || got != "bye" {
+		t.Errorf("Expected the current variable value, got %q (%v)", got, err)
+	}
+	if _, err := snap.Expand(nil, "${var.unset}"); err == nil {
+		t.Error("Expected unset variable to fail expansion")
+	}
+
+	if _, err := runExecutorTest(t, "setvar lonely\n"); err == nil {
+		t.Error("Expected setvar without a value to fail")
+	}
+}
+
+func TestExecutor_Clock(t *testing.T) {
+	ctx, err := runExecutorTest(t, "clock -set \"Sun, 01 Jan 2023 00:00:00 GMT\"\nclock -advance 1h\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	want := time.Date(2023, 1, 1, 1, 0, 0, 0, time.UTC)
+	if d := ctx.Now().Sub(want); d < 0 || d > time.Second {
+		t.Errorf("Expected the clock at %v, got %v", want, ctx.Now())
+	}
+
+	ctx, err = runExecutorTest(t, "clock -set 1700000000\nclock -reset\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if d := time.Since(ctx.Now()); d < -time.Second || d > time.Second {
+		t.Errorf("Expected -reset to return to real time, got %v", ctx.Now())
+	}
+
+	if _, err := runExecutorTest(t, "clock -set yesterday\n"); err == nil {
+		t.Error("Expected an invalid time to fail")
+	}
+}
+
+func TestExecutor_Shell(t *testing.T) {
+	tests := []struct {
+		input string
+		fails bool
+	}{
+		{`shell -stdin "hello" -expect-stdout hello "cat"`, false},
+		{`shell -env GREETING=hi -env OTHER=x -expect-stdout "hi x" "echo $GREETING $OTHER"`, false},
+		{`shell -expect-stdout out -expect-stderr err -match-stderr "^e" "echo out; echo err >&2"`, false},
+		{`shell -expect-stdout err "echo out; echo err >&2"`, true},
+		{`shell -match-stderr out "echo out"`, true},
+		{`shell -exit 3 "exit 3"`, false},
+		{`shell -timeout 0.1 "sleep 5"`, true},
+		{`shell -env NOEQUALS "true"`, true},
+		{`shell -err "exit 1"`, false},
+		{`shell -err "true"`, true},
+		{`shell -exec -expect-stdout "$HOME; *" {echo $HOME; *}`, false},
+		{`shell -exec -exit 1 {false}`, false},
+		{`shell -exec {/no/such/command}`, true},
+		{`err_shell "/no/such/file" "cat /no/such/file"`, false},
+		{`err_shell "a.b" "echo axb; false"`, true},
+		{`err_shell "out" "echo out"`, true},
+	}
+
+	for _, tt := range tests {
+		_, err := runExecutorTest(t, tt.input+"\n")
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: unexpected error state: %v", tt.input, err)
+		}
+	}
+
+	ctx, err := runExecutorTest(t, `shell "echo out; echo err >&2; exit 2"`+"\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	for name, want := range map[string]string{"shell_out": "out", "shell_err": "err", "shell_status": "2"} {
+		if got, _ := ctx.Macros.Get(name); got != want {
+			t.Errorf("Expected ${%s} to be %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestExecutor_FilewriteFileread(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		input string
+		fails bool
+	}{
+		{"filewrite " + dir + "/plain.txt hello world", false},
+		{"fileread -expect \"hello world\" -size 11 " + dir + "/plain.txt", false},
+		{"fileread -expect hello " + dir + "/plain.txt", true},
+		{"filewrite -hex " + dir + "/bin \"00 01 ff\"", false},
+		{"fileread -size 3 -sha256 26a66b061e8f48f39927c312f25293959729eee95978e2892d49d3512a5cc092 " + dir + "/bin", false},
+		{"fileread -md5 00000000000000000000000000000000 " + dir + "/bin", true},
+		{"filewrite -hex " + dir + "/bad zz", true},
+		{"filewrite " + dir + "/a/b/c.txt nested", true},
+		{"filewrite -mkdir -mode 0600 " + dir + "/a/b/c.txt nested", false},
+		{"fileread -mode 0600 -match ^nest " + dir + "/a/b/c.txt", false},
+		{"fileread -mode 0644 " + dir + "/a/b/c.txt", true},
+		{"fileread " + dir + "/missing", true},
+	}
+
+	for _, tt := range tests {
+		_, err := runExecutorTest(t, tt.input+"\n")
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: unexpected error state: %v", tt.input, err)
+		}
+	}
+
+	ctx, err := runExecutorTest(t, "fileread -macro content "+dir+"/plain.txt\n")
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if got, _ := ctx.Macros.Get("content"); got != "hello world" {
+		t.Errorf("Expected ${content} to be the file content, got %q", got)
+	}
+}
+
+func TestExecutor_Expect(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/log", []byte("listening on 8080\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		input string
+		fails bool
+	}{
+		{"setvar port 8080\nexpect ${var.port} == 8080", false},
+		{"setvar port 8080\nexpect ${var.port} != 8080", true},
+		{"expect ${undefined} == <undef>", false},
+		{"expect ${undefined} != <undef>", true},
+		{"setvar port 8080\nexpect ${var.port} == <undef>", true},
+		{"expect x${undefined} == <undef>", true},
+		{"expect 0.25 < 1", false},
+		{"expect abc < 1", true},
+		{"expect -file " + dir + "/log -matches \"^listening on [0-9]+\"", false},
+		{"expect -file " + dir + "/log -contains 8081", true},
+		{"expect -file " + dir + "/missing -contains x", true},
+		{"expect -shell \"echo 3\" -within \"1 5\"", false},
+		{"expect -shell \"exit 1\" == x", true},
+		{"expect 1 ==", true},
+		{"expect 1 <> 1", true},
+	}
+
+	for _, tt := range tests {
+		_, err := runExecutorTest(t, tt.input+"\n")
+		if (err != nil) != tt.fails {
+			t.Errorf("%s: unexpected error state: %v", tt.input, err)
+		}
+	}
+}
+
+func TestExecutor_Await(t *testing.T) {
+	dir := t.TempDir()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+
+	// A file that appears while waiting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(filepath.Join(dir, "ready"), nil, 0644)
+	}()
+	if _, err := runExecutorTest(t, "await file "+filepath.Join(dir, "ready")+" -timeout 5\n"); err != nil {
+		t.Errorf("await file failed: %v", err)
+	}
+
+	tests := []struct {
+		line string
+		want string
+	}{
+		{"await tcp " + l.Addr().String() + "\n", ""},
+		{"await tcp \"" + strings.Replace(l.Addr().String(), ":", " ", 1) + "\"\n", ""},
+		{"await http http://" + l.Addr().String() + "/ -status 503\n", ""},
+		{"await http http://" + l.Addr().String() + "/ -timeout 0.2\n", "not ready after 200ms: status 503"},
+		{"await file " + filepath.Join(dir, "missing") + " -timeout 0.1\n", "no such file"},
+		{"await udp " + l.Addr().String() + "\n", "unknown probe udp"},
+		{"await file x -status 200\n", "-status only applies to http"},
+	}
+	for _, tt := range tests {
+		_, err := runExecutorTest(t, tt.line)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%q failed: %v", tt.line, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%q = %v, want an error with %q", tt.line, err, tt.want)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	a, b := NewChaos(7, time.Millisecond), NewChaos(7, time.Millisecond)
+	for range 100 {
+		d := a.Next()
+		if d != b.Next() {
+			t.Fatal("The same seed gave different delays")
+		}
+		if d < 0 || d > time.Millisecond {
+			t.Fatalf("Delay %v out of range", d)
+		}
+	}
+
+	// No delays without -chaos
+	var none *Chaos
+	none.Delay()
+	ChaosDelay(nil)
+	ChaosDelay(NewExecContext(nil, nil, "", 0))
+}
+
+// fakeListener is a server or tunnel for TestCheckLeaks
+type fakeListener bool
+
+func (l fakeListener) Listening() bool { return bool(l) }
+
+func TestCheckLeaks(t *testing.T) {
+	dir := t.TempDir()
+	ctx := NewExecContext(logging.NewLogger("test"), NewMacroStore(), dir, time.Second)
+	id := newTestID("leaks.vtc")
+	if err := checkLeaks(ctx, id); err != nil {
+		t.Fatalf("Expected no leaks, got %v", err)
+	}
+
+	ctx.Servers["s1"] = fakeListener(true)
+	ctx.Servers["s2"] = fakeListener(false)
+	ctx.Tunnels["t1"] = fakeListener(true)
+	f, err := os.Create(filepath.Join(dir, "open.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	release := make(chan struct{})
+	runTagged(id, func() {
+		go func() { <-release }()
+	})
+
+	err = checkLeaks(ctx, id)
+	if err == nil {
+		t.Fatal("Expected leaks")
+	}
+	want := []string{"s1 still listening", "t1 still listening", "1 goroutine(s) in vtc.TestCheckLeaks"}
+	if _, statErr := os.Stat("/proc/self/fd"); statErr == nil {
+		want = append(want, "open file open.txt")
+	}
+	for _, leak := range want {
+		if !strings.Contains(err.Error(), leak) {
+			t.Errorf("Expected %q in %v", leak, err)
+		}
+	}
+	if strings.Contains(err.Error(), "s2") {
+		t.Errorf("Stopped server s2 reported: %v", err)
+	}
+
+	// Goroutines that finish within the grace period are no leak
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	if leaks := goroutineLeaks(id, time.Second); len(leaks) != 0 {
+		t.Errorf("Expected the goroutine to finish, got %v", leaks)
+	}
+}
+
+func TestExecContext_Ports(t *testing.T) {
+	a := NewExecContext(logging.NewLogger("a"), NewMacroStore(), "", time.Second)
+	b := NewExecContext(logging.NewLogger("b"), NewMacroStore(), "", time.Second)
+
+	seen := make(map[string]bool)
+	for _, ctx := range []*ExecContext{a, b} {
+		for i := 0; i < 5; i++ {
+			name := fmt.Sprintf("${port%d}", i)
+			port, err := ctx.Macros.Expand(ctx.Logger, name)
+			if err != nil {
+				t.Fatalf("Expand(%s) failed: %v", name, err)
+			}
+			if seen[port] {
+				t.Errorf("port %s handed out twice", port)
+			}
+			seen[port] = true
+			if again, _ := ctx.Macros.Expand(ctx.Logger, name); again != port {
+				t.Errorf("%s changed from %s to %s", name, port, again)
+			}
+		}
+	}
+	if _, err := a.Macros.Expand(a.Logger, "${portx}"); err == nil {
+		t.Error("${portx} should not be defined")
+	}
+
+	a.ReleasePorts()
+	b.ReleasePorts()
+	portAlloc.Lock()
+	defer portAlloc.Unlock()
+	if n := len(portAlloc.reserved); n != 0 {
+		t.Errorf("%d ports still reserved after ReleasePorts", n)
+	}
+}
+
+func TestExecContext_Artifacts(t *testing.T) {
+	tmp := t.TempDir()
+	ctx := NewExecContext(logging.NewLogger("test"), NewMacroStore(), tmp, time.Second)
+
+	dir, err := ctx.ObjectDir("s1")
+	if err != nil {
+		t.Fatalf("ObjectDir failed: %v", err)
+	}
+	if got, _ := ctx.Macros.Get("s1_dir"); got != dir {
+		t.Errorf("Expected ${s1_dir} to be %q, got %q", dir, got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "log"), []byte("server log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	if err := os.WriteFile(outside, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx.AddArtifact(dir)
+	ctx.AddArtifact(dir)
+	ctx.AddArtifact(outside)
+	ctx.AddArtifact(filepath.Join(tmp, "missing"))
+	if n := len(ctx.Artifacts()); n != 3 {
+		t.Errorf("Expected 3 artifacts, got %d", n)
+	}
+
+	dst := t.TempDir()
+	if err := ctx.SaveArtifacts(dst); err != nil {
+		t.Fatalf("SaveArtifacts failed: %v", err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dst, "s1", "log"):   "server log",
+		filepath.Join(dst, "outside.txt"): "outside",
+	} {
+		got, err := os.ReadFile(path)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: expected %q, got %q (%v)", path, want, got, err)
+		}
+	}
+}
+
+func TestExecContext_ExpandSpecs(t *testing.T) {
+	ctx, err := runExecutorTest(t, `spec get {
+	txreq -url ${url} -hdr "Host: ${host}"
+	rxresp
+	expect resp.status == ${status}
+}
+spec get_ok {
+	use get url=${url} status=200
+}
+spec loop {
+	use loop
+}
+`)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	ast, err := ParseTestReader(strings.NewReader(`client c1 {
+	use get_ok url=/a
+	stream 1 {
+		use get url=/b status="404"
+	} -run
+}
+`), logging.NewLogger("test"), NewMacroStore())
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	nodes, err := ctx.ExpandSpecs(ast.Children[0].Children)
+	if err != nil {
+		t.Fatalf("ExpandSpecs failed: %v", err)
+	}
+
+	var lines []string
+	var walk func(nodes []*Node, indent string)
+	walk = func(nodes []*Node, indent string) {
+		for _, n := range nodes {
+			lines = append(lines, indent+n.Name+" "+strings.Join(n.Args, " "))
+			walk(n.Children, indent+"  ")
+		}
+	}
+	walk(nodes, "")
+	want := []string{
+		"txreq -url /a -hdr Host: ${host}",
+		"rxresp ",
+		"expect resp.status == 200",
+		"stream 1 -run",
+		"  txreq -url /b -hdr Host: ${host}",
+		"  rxresp ",
+		"  expect resp.status == 404",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expanded spec:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	for _, use := range []string{"use nosuch", "use loop", "use get url"} {
+		if _, err := ctx.ExpandSpecs([]*Node{{Type: "command", Name: "use", Args: strings.Fields(use)[1:]}}); err == nil {
+			t.Errorf("%s: expected an error", use)
+		}
+	}
+}
+
+func TestDocs(t *testing.T) {
+	RegisterBuiltinCommands()
+	for _, name := range ListCommands() {
+		if len(LookupDocs(name)) == 0 {
+			t.Errorf("%s: not documented", name)
+		}
+	}
+
+	docs := LookupDocs("filewrite")
+	if len(docs) != 1 {
+		t.Fatalf("filewrite: got %d docs, want 1", len(docs))
+	}
+	var b strings.Builder
+	docs[0].Write(&b)
+	for _, want := range []string{
+		"filewrite [options] FILE CONTENT...  (test)\n",
+		"    -append     Append instead of truncating\n",
+		"    -mode PERM  File permissions, in octal\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("help is missing %q:\n%s", want, b.String())
+		}
+	}
+}
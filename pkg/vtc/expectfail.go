@@ -0,0 +1,127 @@
+package vtc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/perbu/GTest/pkg/logging"
+	"github.com/perbu/GTest/pkg/util"
+)
+
+// expectedFailure is the "expect_test_fail [REGEX]" marker of a negative
+// test: the test passes only if it fails, and if a pattern is given, only
+// if the failure message matches it.
+type expectedFailure struct {
+	pattern *regexp.Regexp
+}
+
+// scanExpectedFailure looks for the expect_test_fail marker in the test
+// source. It is found by scanning the lines rather than the AST so that
+// tests of syntax errors, which never parse, can be marked as well. Only
+// top-level lines count: the bodies of <<WORD blocks are data, and a
+// marker inside a {...} block belongs to the spec it is in.
+func scanExpectedFailure(r io.Reader) (*expectedFailure, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var heredoc string
+	depth := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if heredoc != "" {
+			if line == heredoc {
+				heredoc = ""
+			}
+			continue
+		}
+		code := strings.TrimSpace(util.StripComments(line))
+		heredoc, _ = heredocWord(code)
+		top := depth == 0
+		depth = max(depth+braceDepth(code), 0)
+		if !top {
+			continue
+		}
+		rest, ok := strings.CutPrefix(line, "expect_test_fail")
+		if !ok || (rest != "" && rest[0] != ' ' && rest[0] != '\t') {
+			continue
+		}
+		pattern := unquoteArg(strings.TrimSpace(rest))
+		if pattern == "" {
+			return &expectedFailure{}, nil
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("expect_test_fail: invalid regex: %w", err)
+		}
+		return &expectedFailure{pattern: re}, nil
+	}
+	return nil, scanner.Err()
+}
+
+// braceDepth returns how many more braces a line opens than it closes,
+// leaving out those in quoted strings and ${...} macros as the parser does
+func braceDepth(line string) int {
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '$' && i+1 < len(line) && line[i+1] == '{' && strings.IndexByte(line[i:], '}') > 0:
+			i += strings.IndexByte(line[i:], '}')
+		case c == '"':
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// unquoteArg strips the "..." or {...} around a single argument
+func unquoteArg(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '{' && s[len(s)-1] == '}') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// outcome turns the result of a test marked with expect_test_fail into its
+// final result. Failures (1) and errors (2) that match become passes,
+// passes become failures and skips are left alone.
+func (x *expectedFailure) outcome(exitCode int, err error, report TestReport, logger *logging.Logger) (int, error) {
+	switch exitCode {
+	case 0:
+		return 1, fmt.Errorf("test passed but was expected to fail")
+	case 1, 2:
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if len(report.SoftFailures) > 0 {
+			msg = strings.Join(append([]string{msg}, report.SoftFailures...), "\n")
+		}
+		if x.pattern != nil && !x.pattern.MatchString(msg) {
+			return 1, fmt.Errorf("test failed with %q, expected a failure matching %s", msg, x.pattern)
+		}
+		logger.Info("Test failed as expected: %s", msg)
+		return 0, nil
+	default:
+		return exitCode, err
+	}
+}
+
+// cmdExpectTestFail handles "expect_test_fail [REGEX]". The marker is
+// picked up before the test is parsed, so executing it does nothing.
+func cmdExpectTestFail(args []string, priv interface{}, logger *logging.Logger) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expect_test_fail: too many arguments")
+	}
+	logger.Debug("Test is expected to fail")
+	return nil
+}
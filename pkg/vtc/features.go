@@ -0,0 +1,101 @@
+package vtc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// FeatureProbe reports whether a feature is present and, when it is not,
+// why. The reason ends up in the skip message.
+type FeatureProbe func() (present bool, reason string)
+
+var (
+	featureMu sync.RWMutex
+	features  = map[string]FeatureProbe{
+		"64bit":             probe64bit,
+		"SO_RCVTIMEO_WORKS": probeRcvTimeo,
+		"abstract_uds":      probeAbstractUDS,
+		"dns":               func() (bool, string) { return true, "" },
+		"ipv4":              func() (bool, string) { return hasIPv4(), "IPv4 not available" },
+		"ipv6":              func() (bool, string) { return hasIPv6(), "IPv6 not available" },
+		"ipv6_loopback":     probeIPv6Loopback,
+		"pty":               probePTY,
+		"root":              func() (bool, string) { return os.Getuid() == 0, "not running as root" },
+		"unprivileged":      func() (bool, string) { return os.Getuid() != 0, "running as root" },
+	}
+	declared = map[string]bool{}
+)
+
+// Features of a Varnish build that a Go binary cannot detect. They are
+// absent unless declared with DeclareFeature (gvtest -feature NAME).
+var buildFeatures = []string{
+	"asan", "coverage", "disable_aslr", "msan", "persistent_storage",
+	"sanitizer", "topbuild", "tsan", "ubsan", "workspace_emulator",
+}
+
+func init() {
+	for _, name := range buildFeatures {
+		reason := fmt.Sprintf("feature %s not declared (gvtest -feature %s)", name, name)
+		features[name] = func() (bool, string) { return false, reason }
+	}
+}
+
+// RegisterFeature adds or replaces the probe for a named feature
+func RegisterFeature(name string, probe FeatureProbe) {
+	featureMu.Lock()
+	defer featureMu.Unlock()
+	features[name] = probe
+}
+
+// DeclareFeature marks a feature as present without probing it. Unknown
+// names become known features.
+func DeclareFeature(name string) {
+	featureMu.Lock()
+	defer featureMu.Unlock()
+	declared[name] = true
+}
+
+// checkFeature evaluates a feature without arguments
+func checkFeature(name string) (bool, string, error) {
+	featureMu.RLock()
+	probe, known := features[name]
+	isDeclared := declared[name]
+	featureMu.RUnlock()
+
+	switch {
+	case isDeclared:
+		return true, "", nil
+	case !known:
+		return false, "", fmt.Errorf("unknown feature check: %s", name)
+	}
+	present, reason := probe()
+	return present, reason, nil
+}
+
+func probe64bit() (bool, string) {
+	return strconv.IntSize == 64, "not a 64 bit platform"
+}
+
+// probeIPv6Loopback checks that servers can listen on [::1], which
+// does not need an IPv6 route like the ipv6 feature does
+func probeIPv6Loopback() (bool, string) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		return false, "cannot listen on [::1]"
+	}
+	ln.Close()
+	return true, ""
+}
+
+// probeAbstractUDS checks for Linux abstract Unix domain sockets
+func probeAbstractUDS() (bool, string) {
+	ln, err := net.Listen("unix", fmt.Sprintf("@gvtest-probe-%d", os.Getpid()))
+	if err != nil {
+		return false, "abstract Unix domain sockets not supported"
+	}
+	ln.Close()
+	return true, ""
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package vtc
+
+func probeRcvTimeo() (bool, string) {
+	return false, "SO_RCVTIMEO probe not supported on this platform"
+}
+
+func probePTY() (bool, string) {
+	return false, "PTYs not supported on this platform"
+}
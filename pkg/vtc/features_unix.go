@@ -0,0 +1,57 @@
+//go:build unix
+
+package vtc
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// probeRcvTimeo checks that a read on a socket with SO_RCVTIMEO set
+// returns once the timeout expires
+func probeRcvTimeo() (bool, string) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return false, "socketpair failed: " + err.Error()
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	tv := syscall.NsecToTimeval((10 * time.Millisecond).Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fds[0], syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return false, "SO_RCVTIMEO not settable: " + err.Error()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := syscall.Read(fds[0], make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EWOULDBLOCK) {
+			return true, ""
+		}
+		return false, "read with SO_RCVTIMEO did not time out"
+	case <-time.After(time.Second):
+		// Unblock the reader before giving up
+		syscall.Shutdown(fds[0], syscall.SHUT_RDWR)
+		return false, "SO_RCVTIMEO has no effect"
+	}
+}
+
+// probePTY checks that a pseudo-terminal can be opened, for processes
+// run with -ansi-response
+func probePTY() (bool, string) {
+	ptmx, tty, err := pty.Open()
+	if err != nil {
+		return false, "cannot open a PTY: " + err.Error()
+	}
+	tty.Close()
+	ptmx.Close()
+	return true, ""
+}
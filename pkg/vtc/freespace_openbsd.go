@@ -0,0 +1,12 @@
+package vtc
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to unprivileged users under path
+func freeSpace(path string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.F_bavail) * uint64(st.F_bsize), nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly && !openbsd && !netbsd && !solaris
+
+package vtc
+
+import "fmt"
+
+func freeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("disk space check not supported on this platform")
+}
@@ -0,0 +1,46 @@
+package vtc
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// addTestFiles seeds the corpus with the repository's test files
+func addTestFiles(f *testing.F, pattern string) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+// FuzzParseVTC checks that no input makes the parser panic or hang, with
+// and without comments kept
+func FuzzParseVTC(f *testing.F) {
+	addTestFiles(f, "../../tests/*.vtc")
+	f.Add([]byte("vtest \"x\"\nclient c1 {\n\ttxreq -body <<EOF\nabc\nEOF\n} -run\n"))
+	f.Add([]byte("server s1 { rxreq; txresp -hdr \"a: {b}\" } -start # end\n"))
+
+	logger := logging.NewLogger("fuzz")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer logging.ResetOutput()
+		for _, keep := range []bool{false, true} {
+			p := NewParser(bytes.NewReader(data), nil, logger)
+			p.KeepComments = keep
+			root, err := p.Parse()
+			if err == nil && root == nil {
+				t.Fatal("Parse returned neither a tree nor an error")
+			}
+		}
+	})
+}
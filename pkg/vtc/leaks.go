@@ -0,0 +1,163 @@
+package vtc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// testLabel is the pprof label that tags the goroutines of a test, and
+// those they start, for -strict
+const testLabel = "gvtest_test"
+
+// leakGrace is how long the goroutines of a test get to finish once it
+// has ended, before -strict reports them
+const leakGrace = time.Second
+
+// testSeq numbers the tests of a run, as tests in parallel may share a
+// file name
+var testSeq atomic.Int64
+
+// Listening is implemented by the servers and tunnels of a test, which
+// may still hold a listening socket when it ends
+type Listening interface {
+	Listening() bool
+}
+
+// newTestID returns the label value for a run of testFile
+func newTestID(testFile string) string {
+	return fmt.Sprintf("%s#%d", testFile, testSeq.Add(1))
+}
+
+// runTagged runs fn with the goroutines it starts tagged with id
+func runTagged(id string, fn func()) {
+	pprof.Do(context.Background(), pprof.Labels(testLabel, id), func(context.Context) {
+		fn()
+	})
+}
+
+// checkLeaks reports what a passed test left behind: servers and tunnels
+// still listening, files under its temp directory still open, and
+// goroutines of its own still running after leakGrace
+func checkLeaks(ctx *ExecContext, id string) error {
+	// The grace period also lets a tunnel or server finish the
+	// connection it was forwarding or serving as the test ended
+	goroutines := goroutineLeaks(id, leakGrace)
+	leaks := listeningLeaks(ctx)
+	leaks = append(leaks, openFileLeaks(ctx.TmpDir)...)
+	leaks = append(leaks, goroutines...)
+	if len(leaks) == 0 {
+		return nil
+	}
+	for _, leak := range leaks {
+		ctx.Logger.Info("Leak: %s", leak)
+	}
+	return fmt.Errorf("test leaked %s", strings.Join(leaks, ", "))
+}
+
+// listeningLeaks lists the servers and tunnels still listening
+func listeningLeaks(ctx *ExecContext) []string {
+	var leaks []string
+	for _, objects := range []map[string]interface{}{ctx.Servers, ctx.Tunnels} {
+		names := make([]string, 0, len(objects))
+		for name, obj := range objects {
+			if l, ok := obj.(Listening); ok && l.Listening() {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			leaks = append(leaks, name+" still listening")
+		}
+	}
+	return leaks
+}
+
+// openFileLeaks lists the files under dir that the process still has
+// open. It needs /proc and finds nothing without it.
+func openFileLeaks(dir string) []string {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil
+	}
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	var leaks []string
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err != nil || !strings.HasPrefix(target, prefix) {
+			continue
+		}
+		leaks = append(leaks, fmt.Sprintf("open file %s", strings.TrimPrefix(target, prefix)))
+	}
+	return leaks
+}
+
+// goroutineLeaks waits up to grace for the goroutines tagged with id to
+// finish, and lists those that don't by the function they run
+func goroutineLeaks(id string, grace time.Duration) []string {
+	deadline := time.Now().Add(grace)
+	for {
+		leaks := taggedGoroutines(id)
+		if len(leaks) == 0 || time.Now().After(deadline) {
+			return leaks
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// taggedGoroutines parses the goroutine profile for the stacks tagged
+// with id. Each stack is a header with its count, an optional labels
+// line and its frames, innermost first, ending in a blank line.
+func taggedGoroutines(id string) []string {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil
+	}
+	label := fmt.Sprintf("%q:%q", testLabel, id)
+
+	var (
+		leaks  []string
+		count  int
+		tagged bool
+		fn     string
+	)
+	flush := func() {
+		if tagged && count > 0 {
+			leaks = append(leaks, fmt.Sprintf("%d goroutine(s) in %s", count, fn))
+		}
+		count, tagged, fn = 0, false, ""
+	}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "# labels: "):
+			tagged = strings.Contains(line, label)
+		case strings.HasPrefix(line, "#\t"):
+			// "#\t0x4f00c1\tpkg.fn+0x41\t/path/file.go:12"; the
+			// last frame is the function the goroutine runs
+			fields := strings.Split(line, "\t")
+			if len(fields) >= 3 {
+				fn, _, _ = strings.Cut(fields[2], "+")
+				fn = fn[strings.LastIndex(fn, "/")+1:]
+			}
+		default:
+			if n, _, ok := strings.Cut(line, " @ "); ok {
+				count, _ = strconv.Atoi(n)
+			}
+		}
+	}
+	flush()
+	return leaks
+}
@@ -1,6 +1,8 @@
 package vtc
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -64,6 +66,8 @@ func TestMacroExpansion(t *testing.T) {
 		{"${name}${count}", "world42", false},
 		{"${undefined}", "", true},
 		{"text ${name} more ${count} text", "text world more 42 text", false},
+		{"$${name} is ${name}", "${name} is world", false},
+		{"$${undefined}", "${undefined}", false},
 	}
 
 	for _, tt := range tests {
@@ -110,6 +114,75 @@ func TestMacroClone(t *testing.T) {
 	}
 }
 
+func TestMacroNamespace(t *testing.T) {
+	ms := NewMacroStore()
+	ms.DefineIn("s1", "addr", "127.0.0.1")
+	ms.DefineIn("s1", "port", "8080")
+	ms.DefineIn("s2", "port", "9090")
+
+	if val, ok := ms.Get("s1_port"); !ok || val != "8080" {
+		t.Errorf("Expected s1_port to be 8080, got %q", val)
+	}
+
+	ns := ms.Namespace("s1")
+	if len(ns) != 2 || ns["addr"] != "127.0.0.1" || ns["port"] != "8080" {
+		t.Errorf("Unexpected s1 namespace: %v", ns)
+	}
+
+	ms.DeleteNamespace("s1")
+	if ms.Exists("s1_addr") || ms.Exists("s1_port") {
+		t.Error("Expected s1 macros to be deleted with their namespace")
+	}
+	if !ms.Exists("s2_port") {
+		t.Error("Expected s2_port to survive deleting s1")
+	}
+}
+
+func TestMacroSnapshot(t *testing.T) {
+	ms := NewMacroStore()
+	ms.DefineIn("s1", "port", "8080")
+
+	snap := ms.Snapshot()
+
+	// A restarted server redefines its macros in the shared store
+	ms.DeleteNamespace("s1")
+	ms.DefineIn("s1", "port", "9090")
+
+	result, err := snap.Expand(nil, "${s1_port}")
+	if err != nil || result != "8080" {
+		t.Errorf("Expected snapshot to keep 8080, got %q (err %v)", result, err)
+	}
+}
+
+func TestMacroConcurrentUse(t *testing.T) {
+	ms := NewMacroStore()
+	ms.DefineIn("s1", "port", "8080")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ms.DefineIn("s1", "port", fmt.Sprintf("%d", 8000+j))
+				ms.Definef(fmt.Sprintf("c%d_last", i), "%d", j)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := ms.Expand(nil, "${s1_port}"); err != nil {
+					t.Errorf("Unexpected error: %v", err)
+					return
+				}
+				ms.Snapshot()
+				ms.Namespace("s1")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 func TestMacroMerge(t *testing.T) {
 	ms1 := NewMacroStore()
 	ms1.Define("foo", "bar")
@@ -2,6 +2,7 @@ package vtc
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strconv"
@@ -25,19 +26,23 @@ const (
 
 // Token represents a lexical token
 type Token struct {
-	Type  string
-	Value string
-	Line  int
-	Col   int
+	Type    string
+	Value   string
+	Line    int
+	Col     int
+	EndLine int // Last line of a token spanning several, such as a <<WORD block
 }
 
-// Node represents an AST node
+// Node represents an AST node. Comment and blank nodes are only produced
+// when the parser keeps comments.
 type Node struct {
-	Type     string   // "vtest", "command", "block", etc.
-	Name     string   // Command name or identifier
-	Args     []string // Command arguments
-	Children []*Node  // Child nodes
-	Line     int      // Source line number
+	Type     string   `json:"type"`               // "vtest", "command", "comment", "blank", etc.
+	Name     string   `json:"name,omitempty"`     // Command name or identifier, or the comment text
+	Args     []string `json:"args,omitempty"`     // Command arguments
+	Comment  string   `json:"comment,omitempty"`  // Comment at the end of the node's line
+	Line     int      `json:"line,omitempty"`     // Source line number
+	EndLine  int      `json:"end_line,omitempty"` // Last source line, e.g. of a block's closing brace
+	Children []*Node  `json:"children,omitempty"` // Child nodes
 }
 
 // Parser parses VTC files
@@ -49,6 +54,13 @@ type Parser struct {
 	current rune
 	tokens  []Token
 	pos     int
+
+	lastLine int // Line of the last consumed token
+
+	// KeepComments adds comment and blank line nodes to the AST, and the
+	// comments at the end of lines to the nodes, for tools that need the
+	// source structure. Execution doesn't need them.
+	KeepComments bool
 }
 
 // NewParser creates a new VTC parser
@@ -80,6 +92,9 @@ func (p *Parser) Parse() (*Node, error) {
 	}
 
 	for !p.isEOF() {
+		if p.parseTrivia(&root.Children) {
+			continue
+		}
 		node, err := p.parseStatement()
 		if err != nil {
 			return nil, err
@@ -89,18 +104,25 @@ func (p *Parser) Parse() (*Node, error) {
 		}
 	}
 
+	root.EndLine = p.lastLine
 	return root, nil
 }
 
 // tokenize reads the file and creates tokens
 func (p *Parser) tokenize() error {
 	scanner := bufio.NewScanner(p.reader)
-	lineNum := 0
-	var continuedLine string
-
+	var rawLines []string
 	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
+		rawLines = append(rawLines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	var continuedLine string
+	for n := 0; n < len(rawLines); n++ {
+		lineNum := n + 1
+		line := rawLines[n]
 
 		// Handle line continuation
 		if strings.HasSuffix(strings.TrimRight(line, " \t"), "\\") {
@@ -117,30 +139,81 @@ func (p *Parser) tokenize() error {
 		}
 
 		// Strip comments
-		line = util.StripComments(line)
-		line = strings.TrimSpace(line)
+		code := util.StripComments(line)
+		comment := strings.TrimSpace(line[len(code):])
+		line = strings.TrimSpace(code)
 
 		// Skip empty lines
 		if line == "" {
+			if p.KeepComments && comment != "" {
+				p.tokens = append(p.tokens, Token{Type: TokenComment, Value: comment, Line: lineNum})
+			} else if p.KeepComments {
+				p.tokens = append(p.tokens, Token{Type: TokenNewline, Line: lineNum})
+			}
 			continue
 		}
 
+		// A line ending in <<WORD starts a verbatim block: the lines up to
+		// the one holding only WORD become a single argument, unchanged
+		word, rest := heredocWord(line)
+		if word != "" {
+			line = rest
+		}
+
 		// Tokenize this line
-		if err := p.tokenizeLine(line, lineNum); err != nil {
-			return fmt.Errorf("line %d: %v", lineNum, err)
+		if line != "" {
+			if err := p.tokenizeLine(line, lineNum); err != nil {
+				return fmt.Errorf("line %d: %v", lineNum, err)
+			}
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		return err
+		if word != "" {
+			end := n + 1
+			for end < len(rawLines) && strings.TrimSpace(rawLines[end]) != word {
+				end++
+			}
+			if end == len(rawLines) {
+				return fmt.Errorf("line %d: missing %s to end the <<%s block", lineNum, word, word)
+			}
+			// Each line keeps its newline, the last one included
+			var body string
+			for _, l := range rawLines[n+1 : end] {
+				body += l + "\n"
+			}
+			p.tokens = append(p.tokens, Token{Type: TokenString, Value: body, Line: lineNum, EndLine: end + 1})
+			n = end
+		}
+
+		if p.KeepComments && comment != "" {
+			p.tokens = append(p.tokens, Token{Type: TokenComment, Value: comment, Line: lineNum})
+		}
 	}
 
 	// Add EOF token
-	p.tokens = append(p.tokens, Token{Type: TokenEOF, Line: lineNum})
+	p.tokens = append(p.tokens, Token{Type: TokenEOF, Line: len(rawLines)})
 
 	return nil
 }
 
+// heredocWord returns WORD and the rest of the line if the line ends in a
+// <<WORD token, where WORD is made of letters, digits and underscores
+func heredocWord(line string) (word, rest string) {
+	i := strings.LastIndex(line, "<<")
+	if i < 0 || (i > 0 && line[i-1] != ' ' && line[i-1] != '\t') {
+		return "", line
+	}
+	word = line[i+2:]
+	if word == "" {
+		return "", line
+	}
+	for _, c := range word {
+		if !util.IsAlnum(c) && c != '_' {
+			return "", line
+		}
+	}
+	return word, strings.TrimSpace(line[:i])
+}
+
 // tokenizeLine tokenizes a single line
 func (p *Parser) tokenizeLine(line string, lineNum int) error {
 	// For Phase 1, we skip macro expansion if macros are undefined
@@ -152,6 +225,10 @@ func (p *Parser) tokenizeLine(line string, lineNum int) error {
 	col := 0
 	isFirstToken := true
 
+	// The PARAM=VALUE arguments of "use" keep the macros in their values
+	// attached, as in addr=${s1_sock}
+	useLine := strings.HasPrefix(line, "use ")
+
 	for i < len(line) {
 		c := line[i]
 
@@ -163,21 +240,16 @@ func (p *Parser) tokenizeLine(line string, lineNum int) error {
 		}
 
 		// Handle ${...} macro references - treat as a single identifier
-		if c == '$' && i+1 < len(line) && line[i+1] == '{' {
-			// Find the closing }
-			j := i + 2
-			for j < len(line) && line[j] != '}' {
-				j++
-			}
-			if j < len(line) {
-				// Include the entire ${...} as one token
-				value := line[i : j+1]
-				p.tokens = append(p.tokens, Token{Type: TokenIdentifier, Value: value, Line: lineNum, Col: col})
-				i = j + 1
-				col += j - i + 1
-				isFirstToken = false
-				continue
+		if c == '$' && i+1 < len(line) && line[i+1] == '{' && strings.IndexByte(line[i:], '}') > 0 {
+			j := i + strings.IndexByte(line[i:], '}') + 1
+			if useLine {
+				j = scanWord(line, i)
 			}
+			p.tokens = append(p.tokens, Token{Type: TokenIdentifier, Value: line[i:j], Line: lineNum, Col: col})
+			col += j - i
+			i = j
+			isFirstToken = false
+			continue
 		}
 
 		// Handle braces (but not as part of ${...})
@@ -220,6 +292,9 @@ func (p *Parser) tokenizeLine(line string, lineNum int) error {
 
 		// Handle identifiers/commands
 		j := i
+		if useLine {
+			j = scanWord(line, i)
+		}
 		for j < len(line) && !isDelimiter(line[j]) {
 			j++
 		}
@@ -245,6 +320,26 @@ func (p *Parser) tokenizeLine(line string, lineNum int) error {
 	return nil
 }
 
+// scanWord returns the end of the word starting at i. Macro references
+// such as ${name} are part of the word, braces and all. Only "use" lines
+// are split this way.
+func scanWord(line string, i int) int {
+	j := i
+	for j < len(line) {
+		if line[j] == '$' && j+1 < len(line) && line[j+1] == '{' {
+			if end := strings.IndexByte(line[j:], '}'); end > 0 {
+				j += end + 1
+				continue
+			}
+		}
+		if isDelimiter(line[j]) {
+			break
+		}
+		j++
+	}
+	return j
+}
+
 // isDelimiter checks if a character is a delimiter
 func isDelimiter(c byte) bool {
 	return c == ' ' || c == '\t' || c == '{' || c == '}' || c == '"'
@@ -278,11 +373,76 @@ func (p *Parser) parseVTest() (*Node, error) {
 	name := nameToken.Value
 	p.consume()
 
-	return &Node{
+	node := &Node{
 		Type: "vtest",
 		Name: name,
 		Line: nameToken.Line,
-	}, nil
+	}
+
+	// Options on the same line: -tags "a,b,c"
+	for tok := p.peek(); tok.Line == nameToken.Line && (tok.Type == TokenIdentifier || tok.Type == TokenString); tok = p.peek() {
+		if tok.Value != "-tags" {
+			return nil, fmt.Errorf("line %d: unknown vtest option %s", tok.Line, tok.Value)
+		}
+		p.consume()
+		value := p.peek()
+		if value.Line != tok.Line || (value.Type != TokenIdentifier && value.Type != TokenString) {
+			return nil, fmt.Errorf("line %d: -tags requires a value", tok.Line)
+		}
+		p.consume()
+		node.Args = append(node.Args, tok.Value, value.Value)
+	}
+
+	node.EndLine = p.lastLine
+	return node, nil
+}
+
+// parseTrivia turns a comment or blank line token into a node, or a
+// comment into the trailing comment of the node before it on the same
+// line. It reports whether it consumed a token.
+func (p *Parser) parseTrivia(nodes *[]*Node) bool {
+	tok := p.peek()
+	switch tok.Type {
+	case TokenComment:
+		p.consume()
+		if n := len(*nodes); n > 0 {
+			prev := (*nodes)[n-1]
+			if prev.Type != "comment" && prev.Type != "blank" && prev.Comment == "" && prev.Line <= tok.Line && tok.Line <= prev.EndLine {
+				prev.Comment = tok.Value
+				return true
+			}
+		}
+		*nodes = append(*nodes, &Node{Type: "comment", Name: tok.Value, Line: tok.Line, EndLine: tok.Line})
+		return true
+	case TokenNewline:
+		p.consume()
+		*nodes = append(*nodes, &Node{Type: "blank", Line: tok.Line, EndLine: tok.Line})
+		return true
+	}
+	return false
+}
+
+// isTrivia reports whether a token is a kept comment or blank line
+func isTrivia(tok Token) bool {
+	return tok.Type == TokenComment || tok.Type == TokenNewline
+}
+
+// Tags returns the tags given to a vtest node with -tags
+func (n *Node) Tags() []string {
+	var tags []string
+	for i := 0; i+1 < len(n.Args); i += 2 {
+		if n.Args[i] == "-tags" {
+			tags = append(tags, SplitTags(n.Args[i+1])...)
+		}
+	}
+	return tags
+}
+
+// SplitTags splits a list of tags separated by commas or spaces
+func SplitTags(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
 }
 
 // parseCommand parses a command with arguments and optional block
@@ -293,6 +453,7 @@ func isCommandKeyword(s string) bool {
 		"expect", "send", "sendhex", "recv",
 		"delay", "barrier", "shell", "process",
 		"timeout", "gunzip", "client", "server",
+		"repeat", "loop",
 	}
 	for _, kw := range keywords {
 		if s == kw {
@@ -354,7 +515,8 @@ func processEscapeSequences(s string) string {
 func (p *Parser) parseCommand() (*Node, error) {
 	cmdToken := p.peek()
 	if cmdToken.Type != TokenCommand && cmdToken.Type != TokenIdentifier {
-		return nil, nil
+		// Nothing consumes the token, so going on would loop forever
+		return nil, fmt.Errorf("line %d: unexpected %q where a command should start", cmdToken.Line, cmdToken.Value)
 	}
 
 	p.consume()
@@ -369,7 +531,7 @@ func (p *Parser) parseCommand() (*Node, error) {
 	// Collect arguments until we hit EOF, a command block, or another command
 	for {
 		tok := p.peek()
-		if tok.Type == TokenEOF || tok.Type == TokenRBrace {
+		if tok.Type == TokenEOF || tok.Type == TokenRBrace || isTrivia(tok) {
 			break
 		}
 
@@ -383,8 +545,11 @@ func (p *Parser) parseCommand() (*Node, error) {
 		if tok.Type == TokenLBrace {
 			// Peek ahead to determine if this is a string or block
 			// Look for command keywords inside the braces
-			savedPos := p.pos
+			savedPos, savedLine := p.pos, p.lastLine
 			p.consume() // consume {
+			for isTrivia(p.peek()) {
+				p.consume()
+			}
 
 			firstInside := p.peek()
 			isBlock := false
@@ -395,7 +560,7 @@ func (p *Parser) parseCommand() (*Node, error) {
 			}
 
 			// Restore position
-			p.pos = savedPos
+			p.pos, p.lastLine = savedPos, savedLine
 
 			if isBlock {
 				// This is a command block, break out and handle below
@@ -406,7 +571,9 @@ func (p *Parser) parseCommand() (*Node, error) {
 			p.consume() // consume {
 			var strParts []string
 			for p.peek().Type != TokenRBrace && p.peek().Type != TokenEOF {
-				strParts = append(strParts, p.peek().Value)
+				if !isTrivia(p.peek()) {
+					strParts = append(strParts, p.peek().Value)
+				}
 				p.consume()
 			}
 
@@ -436,6 +603,9 @@ func (p *Parser) parseCommand() (*Node, error) {
 
 		// Parse block contents
 		for p.peek().Type != TokenRBrace && p.peek().Type != TokenEOF {
+			if p.parseTrivia(&node.Children) {
+				continue
+			}
 			child, err := p.parseCommand()
 			if err != nil {
 				return nil, err
@@ -453,7 +623,7 @@ func (p *Parser) parseCommand() (*Node, error) {
 		// After closing block, continue parsing arguments (e.g., "server s1 {...} -start")
 		for {
 			tok := p.peek()
-			if tok.Type == TokenEOF || tok.Type == TokenLBrace || tok.Type == TokenRBrace {
+			if tok.Type == TokenEOF || tok.Type == TokenLBrace || tok.Type == TokenRBrace || isTrivia(tok) {
 				break
 			}
 
@@ -471,6 +641,7 @@ func (p *Parser) parseCommand() (*Node, error) {
 		}
 	}
 
+	node.EndLine = p.lastLine
 	return node, nil
 }
 
@@ -485,6 +656,7 @@ func (p *Parser) peek() Token {
 // consume advances to the next token
 func (p *Parser) consume() {
 	if p.pos < len(p.tokens) {
+		p.lastLine = max(p.tokens[p.pos].Line, p.tokens[p.pos].EndLine)
 		p.pos++
 	}
 }
@@ -494,6 +666,16 @@ func (p *Parser) isEOF() bool {
 	return p.pos >= len(p.tokens) || p.peek().Type == TokenEOF
 }
 
+// DumpASTJSON writes the AST as indented JSON. Parsed with KeepComments,
+// it holds the comments, blank lines and source lines of the test. It is
+// a summary, not the source: columns, quoting and line continuations are
+// lost, so tools that rewrite tests take the text from the lines it names.
+func DumpASTJSON(w io.Writer, node *Node) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(node)
+}
+
 // DumpAST prints the AST for debugging
 func DumpAST(node *Node, indent int) {
 	if node == nil {
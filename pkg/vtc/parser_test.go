@@ -1,6 +1,9 @@
 package vtc
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -32,6 +35,31 @@ func TestParser_Simple(t *testing.T) {
 	}
 }
 
+func TestParser_VTestTags(t *testing.T) {
+	input := "vtest \"h2 goaway handling\" -tags \"h2,goaway, slow\"\nshell true\n"
+	root, err := NewParser(strings.NewReader(input), nil, nil).Parse()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(root.Children) != 2 {
+		t.Fatalf("Expected 2 children, got %d", len(root.Children))
+	}
+
+	vtest := root.Children[0]
+	if vtest.Name != "h2 goaway handling" {
+		t.Errorf("Expected name 'h2 goaway handling', got '%s'", vtest.Name)
+	}
+	if got := strings.Join(vtest.Tags(), "|"); got != "h2|goaway|slow" {
+		t.Errorf("Expected tags h2|goaway|slow, got %s", got)
+	}
+
+	for _, bad := range []string{`vtest "x" -tags`, `vtest "x" -owner me`} {
+		if _, err := NewParser(strings.NewReader(bad), nil, nil).Parse(); err == nil {
+			t.Errorf("%s: expected a parse error", bad)
+		}
+	}
+}
+
 func TestParser_CommandWithArgs(t *testing.T) {
 	input := `server s1 -start`
 	p := NewParser(strings.NewReader(input), nil, nil)
@@ -119,6 +147,50 @@ server s1 -start  # inline comment`
 	}
 }
 
+func TestParser_KeepComments(t *testing.T) {
+	input := "# header\nvtest \"test\"\n\nserver s1 {  # opens\n\trxreq # first\n\t# alone\n\ttxresp -body <<EOF\n\t\tok # kept\n\tEOF\n} -start # started\n"
+	p := NewParser(strings.NewReader(input), nil, nil)
+	p.KeepComments = true
+	root, err := p.Parse()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	var got []string
+	for _, n := range root.Children {
+		got = append(got, fmt.Sprintf("%s:%s:%d-%d:%s", n.Type, n.Name, n.Line, n.EndLine, n.Comment))
+	}
+	want := []string{"comment:# header:1-1:", "vtest:test:2-2:", "blank::3-3:", "command:server:4-10:# started"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	server := root.Children[3]
+	got = nil
+	for _, n := range server.Children {
+		got = append(got, fmt.Sprintf("%s:%s:%d-%d:%s", n.Type, n.Name, n.Line, n.EndLine, n.Comment))
+	}
+	want = []string{"comment:# opens:4-4:", "command:rxreq:5-5:# first", "comment:# alone:6-6:", "command:txresp:7-9:"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if args := server.Children[3].Args; len(args) != 2 || args[1] != "\t\tok # kept\n" {
+		t.Errorf("Expected the block to keep its comment, got %q", args)
+	}
+
+	var buf bytes.Buffer
+	if err := DumpASTJSON(&buf, root); err != nil {
+		t.Fatalf("DumpASTJSON: %v", err)
+	}
+	var decoded Node
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if len(decoded.Children) != 4 || decoded.Children[3].Comment != "# started" || decoded.EndLine != 10 {
+		t.Errorf("JSON lost structure: %s", buf.String())
+	}
+}
+
 func TestParser_LineContinuation(t *testing.T) {
 	input := `txresp -hdr foo bar \
 	-hdr baz qux`
@@ -186,3 +258,76 @@ func TestParser_MacroExpansion(t *testing.T) {
 		t.Errorf("Expected arg 2 to be '${s1_sock}', got '%s'", cmd.Args[2])
 	}
 }
+
+func TestParser_MacroInWord(t *testing.T) {
+	input := `use get url=${base}/path host=${s1_addr}:${s1_port} $${literal}x`
+	root, err := NewParser(strings.NewReader(input), nil, nil).Parse()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+
+	want := []string{"get", "url=${base}/path", "host=${s1_addr}:${s1_port}", "$${literal}x"}
+	if got := root.Children[0].Args; strings.Join(got, " ") != strings.Join(want, " ") || len(got) != len(want) {
+		t.Errorf("Expected args %q, got %q", want, got)
+	}
+}
+
+func TestParser_Heredoc(t *testing.T) {
+	input := "client c1 {\n\ttxreq -body <<EOF\n  {\"a\": \"b\"}  # kept\n\n\tx\\\nEOF\n\trxresp\n} -run\nshell <<END\nEND\n"
+	root, err := NewParser(strings.NewReader(input), nil, nil).Parse()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if len(root.Children) != 2 {
+		t.Fatalf("Expected 2 children, got %d", len(root.Children))
+	}
+
+	txreq := root.Children[0].Children[0]
+	want := "  {\"a\": \"b\"}  # kept\n\n\tx\\\n"
+	if len(txreq.Args) != 2 || txreq.Args[1] != want {
+		t.Errorf("Expected the body %q, got %q", want, txreq.Args)
+	}
+	if n := len(root.Children[0].Children); n != 2 {
+		t.Errorf("Expected rxresp to follow the block, got %d children", n)
+	}
+	if args := root.Children[1].Args; len(args) != 1 || args[0] != "" {
+		t.Errorf("Expected an empty block, got %q", args)
+	}
+
+	if _, err := NewParser(strings.NewReader("shell <<EOF\necho\n"), nil, nil).Parse(); err == nil {
+		t.Error("Expected an error for a block without its end marker")
+	}
+}
+
+func TestParser_UnexpectedToken(t *testing.T) {
+	// Tokens that can't start a command used to make Parse loop forever
+	for _, input := range []string{"\"x\"\n", "}\n", "server s1 {\n{\n}\n}\n"} {
+		_, err := NewParser(strings.NewReader(input), nil, nil).Parse()
+		if err == nil || !strings.Contains(err.Error(), "where a command should start") {
+			t.Errorf("Parse(%q): expected an unexpected token error, got %v", input, err)
+		}
+	}
+}
+
+func TestParser_RepeatBlock(t *testing.T) {
+	input := "vtest \"x\"\nclient c1 {\n\trepeat 2 {\n\t\trepeat 3 {\n\t\t\ttxreq\n\t\t}\n\t\trxresp\n\t}\n} -run\n"
+	ast, err := NewParser(strings.NewReader(input), nil, nil).Parse()
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	client := ast.Children[1]
+	if len(client.Children) != 1 {
+		t.Fatalf("Expected one block in the client spec, got %d", len(client.Children))
+	}
+	outer := client.Children[0]
+	if outer.Name != "repeat" || len(outer.Args) != 1 || outer.Args[0] != "2" || len(outer.Children) != 2 {
+		t.Fatalf("Unexpected outer block: %+v", outer)
+	}
+	inner := outer.Children[0]
+	if inner.Name != "repeat" || len(inner.Children) != 1 || inner.Children[0].Name != "txreq" {
+		t.Errorf("Unexpected inner block: %+v", inner)
+	}
+	if outer.Children[1].Name != "rxresp" {
+		t.Errorf("Expected rxresp after the inner block, got %+v", outer.Children[1])
+	}
+}
@@ -0,0 +1,92 @@
+package vtc
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The ports handed out as ${portN} come from a range below the ephemeral
+// ports of common systems, so that neither a server listening on port 0
+// nor an outgoing connection gets one from the kernel
+const (
+	portRangeLow  = 20000
+	portRangeHigh = 30000
+)
+
+// portAlloc holds the ports of the tests of this run, so that tests run
+// in parallel with -j never get the same one
+var portAlloc = struct {
+	sync.Mutex
+	next     int
+	reserved map[int]bool
+}{reserved: make(map[int]bool)}
+
+// allocatePort reserves a port that no other test holds and that is free
+// now. Runs of gvtest in parallel start at random places in the range.
+func allocatePort() (int, error) {
+	portAlloc.Lock()
+	defer portAlloc.Unlock()
+	if portAlloc.next == 0 {
+		portAlloc.next = portRangeLow + rand.Intn(portRangeHigh-portRangeLow)
+	}
+	for range portRangeHigh - portRangeLow {
+		port := portAlloc.next
+		portAlloc.next++
+		if portAlloc.next >= portRangeHigh {
+			portAlloc.next = portRangeLow
+		}
+		if portAlloc.reserved[port] {
+			continue
+		}
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		l.Close()
+		portAlloc.reserved[port] = true
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free port between %d and %d", portRangeLow, portRangeHigh)
+}
+
+// portMacro resolves ${port0}, ${port1}, ... to ports reserved for the
+// test on first use
+func (ctx *ExecContext) portMacro(name string) (string, bool) {
+	index, ok := strings.CutPrefix(name, "port")
+	if !ok || index == "" || strings.Trim(index, "0123456789") != "" {
+		return "", false
+	}
+
+	ctx.portsMu.Lock()
+	defer ctx.portsMu.Unlock()
+	port, ok := ctx.ports[name]
+	if !ok {
+		var err error
+		if port, err = allocatePort(); err != nil {
+			ctx.Logger.Error("${%s}: %v", name, err)
+			return "", false
+		}
+		ctx.Logger.Debug("Reserved port %d as ${%s}", port, name)
+		if ctx.ports == nil {
+			ctx.ports = make(map[string]int)
+		}
+		ctx.ports[name] = port
+	}
+	return strconv.Itoa(port), true
+}
+
+// ReleasePorts gives the ports of ${portN} back for other tests to use
+func (ctx *ExecContext) ReleasePorts() {
+	ctx.portsMu.Lock()
+	defer ctx.portsMu.Unlock()
+	portAlloc.Lock()
+	defer portAlloc.Unlock()
+	for _, port := range ctx.ports {
+		delete(portAlloc.reserved, port)
+	}
+	ctx.ports = nil
+}
@@ -0,0 +1,82 @@
+package vtc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// IterationMacro numbers the iterations of a repeat block, from 1
+const IterationMacro = "iteration"
+
+// RepeatBlock is a "repeat N { ... }" block of a client or server spec,
+// or VTest2's "loop N { ... }". The handlers get it as a "repeat N {"
+// line, the lines of its body and a "}" line of its own.
+type RepeatBlock struct {
+	Name  string // "repeat" or "loop"
+	Count int
+	Body  []string
+	End   int // Index of the "}" line
+}
+
+// IsRepeat reports whether a spec line opens a repeat block
+func IsRepeat(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) == 3 && (fields[0] == "repeat" || fields[0] == "loop") && fields[2] == "{"
+}
+
+// ParseRepeat parses the repeat block opened by lines[i], expanding the
+// macros of its count with expand
+func ParseRepeat(lines []string, i int, expand func(string) (string, error)) (*RepeatBlock, error) {
+	fields := strings.Fields(lines[i])
+	count, err := expand(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fields[0], err)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("%s: invalid count: %s", fields[0], count)
+	}
+
+	depth := 0
+	for j := i + 1; j < len(lines); j++ {
+		line := strings.TrimSpace(lines[j])
+		switch {
+		case IsRepeat(line):
+			depth++
+		case line == "}" && depth > 0:
+			depth--
+		case line == "}":
+			return &RepeatBlock{Name: fields[0], Count: n, Body: lines[i+1 : j], End: j}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: no closing }", fields[0])
+}
+
+// Run runs the body Count times. Each time ${iteration} in its lines is
+// replaced by the number of the iteration, except in the bodies of nested
+// blocks, which number their own. This is done before the lines run, so
+// it also reaches the streams a block starts.
+func (b *RepeatBlock) Run(run func(body []string) error) error {
+	macro := "${" + IterationMacro + "}"
+	for n := 1; n <= b.Count; n++ {
+		body := make([]string, len(b.Body))
+		depth := 0
+		for i, line := range b.Body {
+			if depth == 0 {
+				line = strings.ReplaceAll(line, macro, strconv.Itoa(n))
+			}
+			switch trimmed := strings.TrimSpace(line); {
+			case IsRepeat(trimmed):
+				depth++
+			case trimmed == "}" && depth > 0:
+				depth--
+			}
+			body[i] = line
+		}
+		if err := run(body); err != nil {
+			return fmt.Errorf("%s iteration %d: %w", b.Name, n, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package vtc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/perbu/GTest/pkg/logging"
+)
+
+// maxUseDepth bounds nested "use" lines, so that a spec using itself fails
+// instead of recursing forever
+const maxUseDepth = 16
+
+// DefineSpec stores a reusable spec body under name. Safe for concurrent use.
+func (ctx *ExecContext) DefineSpec(name string, body []*Node) {
+	ctx.specsMu.Lock()
+	defer ctx.specsMu.Unlock()
+	if ctx.specs == nil {
+		ctx.specs = make(map[string][]*Node)
+	}
+	ctx.specs[name] = body
+}
+
+// Spec returns the spec body stored under name
+func (ctx *ExecContext) Spec(name string) ([]*Node, bool) {
+	ctx.specsMu.Lock()
+	defer ctx.specsMu.Unlock()
+	body, ok := ctx.specs[name]
+	return body, ok
+}
+
+// ExpandSpecs returns a copy of nodes where each "use NAME [PARAM=VALUE...]"
+// line, at any depth, is replaced by the body stored with "spec NAME", with
+// ${PARAM} substituted in its arguments. Other macros are left for the
+// spec to expand when it runs.
+func (ctx *ExecContext) ExpandSpecs(nodes []*Node) ([]*Node, error) {
+	return ctx.expandSpecs(nodes, nil, 0)
+}
+
+func (ctx *ExecContext) expandSpecs(nodes []*Node, params map[string]string, depth int) ([]*Node, error) {
+	var out []*Node
+	for _, node := range nodes {
+		if node.Type == "command" && node.Name == "use" {
+			if depth >= maxUseDepth {
+				return nil, fmt.Errorf("line %d: use: specs nested too deep", node.Line)
+			}
+			name, useParams, err := parseUse(substituteAll(node.Args, params))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", node.Line, err)
+			}
+			body, ok := ctx.Spec(name)
+			if !ok {
+				return nil, fmt.Errorf("line %d: use: unknown spec %s", node.Line, name)
+			}
+			expanded, err := ctx.expandSpecs(body, useParams, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, expanded...)
+			continue
+		}
+
+		copied := *node
+		copied.Args = substituteAll(node.Args, params)
+		if len(node.Children) > 0 {
+			children, err := ctx.expandSpecs(node.Children, params, depth)
+			if err != nil {
+				return nil, err
+			}
+			copied.Children = children
+		}
+		out = append(out, &copied)
+	}
+	return out, nil
+}
+
+// parseUse splits the arguments of a use line into the spec name and its
+// parameters. A quoted value is a separate token after "PARAM=".
+func parseUse(args []string) (string, map[string]string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("use: missing spec name")
+	}
+	params := make(map[string]string)
+	for i := 1; i < len(args); i++ {
+		key, value, ok := strings.Cut(args[i], "=")
+		if !ok || key == "" {
+			return "", nil, fmt.Errorf("use: expected PARAM=VALUE, got %q", args[i])
+		}
+		if value == "" && i+1 < len(args) && !strings.Contains(args[i+1], "=") {
+			i++
+			value = args[i]
+		}
+		params[key] = value
+	}
+	return args[0], params, nil
+}
+
+// paramRef matches ${NAME}, and $${NAME}, the escape for a literal ${NAME}
+var paramRef = regexp.MustCompile(`\$?\$\{([^}]+)\}`)
+
+// substituteAll replaces ${PARAM} with its value in each argument
+func substituteAll(args []string, params map[string]string) []string {
+	if len(params) == 0 || len(args) == 0 {
+		return args
+	}
+	out := make([]string, len(args))
+	for i, arg := range args {
+		out[i] = paramRef.ReplaceAllStringFunc(arg, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref
+			}
+			if value, ok := params[ref[2:len(ref)-1]]; ok {
+				return value
+			}
+			return ref
+		})
+	}
+	return out
+}
+
+// cmdSpec handles "spec NAME { ... }": stores a spec body that client and
+// server specs include with "use NAME [PARAM=VALUE...]"
+func cmdSpec(args []string, priv interface{}, logger *logging.Logger) error {
+	ctx, ok := priv.(*ExecContext)
+	if !ok {
+		return fmt.Errorf("spec: invalid context")
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("spec: usage: spec NAME { ... }")
+	}
+	if ctx.CurrentNode == nil || len(ctx.CurrentNode.Children) == 0 {
+		return fmt.Errorf("spec %s: missing body", args[0])
+	}
+
+	ctx.DefineSpec(args[0], ctx.CurrentNode.Children)
+	logger.Debug("Defined spec %s with %d lines", args[0], len(ctx.CurrentNode.Children))
+	return nil
+}
@@ -231,3 +231,51 @@ func TestPhase2_MultipleServers(t *testing.T) {
 	// Give servers time to fully start
 	time.Sleep(100 * time.Millisecond)
 }
+
+// TestPhase2_ServerRestart tests that a server that has served its
+// connections can be waited for and started again on the same address,
+// keeping its macros in between
+func TestPhase2_ServerRestart(t *testing.T) {
+	logger := logging.NewLogger("test")
+	macros := macro.New()
+
+	s := server.New(logger, macros, "s1")
+	var first string
+	for run := 1; run <= 3; run++ {
+		if err := s.Start(nil); err != nil {
+			t.Fatalf("Run %d: failed to start server: %v", run, err)
+		}
+		sock, _ := macros.Get("s1_sock")
+		if first == "" {
+			first = sock
+		} else if sock != first {
+			t.Errorf("Run %d: ${s1_sock} = %s, want the first run's %s", run, sock, first)
+		}
+
+		c := client.New(logger, "c1")
+		c.SetConnect(sock)
+		conn, err := c.Connect()
+		if err != nil {
+			t.Fatalf("Run %d: client failed to connect: %v", run, err)
+		}
+		conn.Close()
+
+		s.Wait()
+		if s.IsRunning() {
+			t.Errorf("Run %d: server should not be running after Wait", run)
+		}
+		if got, ok := macros.Get("s1_sock"); !ok || got != sock {
+			t.Errorf("Run %d: ${s1_sock} = %q after Wait, want %q", run, got, sock)
+		}
+	}
+
+	// Stopping a server that was waited for is a no-op; one that is
+	// running loses its macros
+	if err := s.Start(nil); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	s.Stop()
+	if _, ok := macros.Get("s1_sock"); ok {
+		t.Errorf("${s1_sock} should be undefined after Stop")
+	}
+}